@@ -0,0 +1,453 @@
+// Package exporter exports AWS GuardDuty findings from Go programs. It runs
+// the same fetching and writing as the guardduty-export server and command
+// line, without the web server, its configuration file, or its jobs:
+//
+//	cfg, err := config.LoadDefaultConfig(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	result, err := exporter.New(cfg).Export(ctx, exporter.Options{
+//		Regions: []string{"us-east-1", "eu-west-1"},
+//		Format:  "ndjson",
+//		Output:  os.Stdout,
+//	})
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+)
+
+// Types shared with the exporter's fetcher
+type (
+	// Role is an IAM role assumed to export another account
+	Role = gd.Role
+	// Discovery selects the accounts of an organization to export
+	Discovery = gd.Discovery
+	// Filter selects which findings are exported
+	Filter = gd.Filter
+	// Event describes one step of a running export
+	Event = gd.Event
+	// RegionSummary lists the outcome of each account and region
+	RegionSummary = gd.RegionSummary
+	// ExportSummary is the end-of-run report of an export, with the
+	// findings, pages, and API calls of each account and region
+	ExportSummary = gd.ExportSummary
+	RegionOutcome = gd.RegionOutcome
+	// RegionResult holds the findings fetched from one account and region
+	RegionResult = gd.RegionResult
+	// Truncation describes an export stopped by MaxFindings or MaxDuration
+	Truncation = gd.Truncation
+	// GeoIP resolves remote addresses against MaxMind databases
+	GeoIP = gd.GeoIP
+	// Enricher adds to the findings of an export as they are fetched
+	Enricher = gd.Enricher
+)
+
+// RegisterColumn adds a named export column computed from each finding, or
+// replaces the one of the same name, such as for what an Enricher learned.
+// It must be called before any export starts.
+func RegisterColumn(name string, field func(finding types.Finding) string) {
+	export.RegisterColumn(name, field)
+}
+
+// OpenGeoIP opens a MaxMind Country or City database and an ASN database
+// for Options.GeoIP; either path may be empty
+func OpenGeoIP(countryPath, asnPath string) (*GeoIP, error) {
+	return gd.OpenGeoIP(countryPath, asnPath)
+}
+
+// Types of the AWS clients an export calls, for Options.Clients
+type (
+	// Clients builds the GuardDuty, EC2, and STS clients of each account
+	// and region
+	Clients      = gd.Clients
+	GuardDutyAPI = gd.GuardDutyAPI
+	EC2API       = gd.EC2API
+	STSAPI       = gd.STSAPI
+	// Fake is an in-memory AWS that answers exports from the findings
+	// added to it, for tests
+	Fake = gd.Fake
+)
+
+// NewFake returns a Fake without findings whose own credentials belong to
+// accountID, for Options.Clients
+func NewFake(accountID string) *Fake {
+	return gd.NewFake(accountID)
+}
+
+// Types of custom export formats
+type (
+	// FindingWriter writes the findings of an export in one format
+	FindingWriter = export.FindingWriter
+	// RegionWriter is implemented by FindingWriters that record the outcome
+	// of each account and region, such as its error
+	RegionWriter = export.RegionWriter
+	// Format describes an export format and creates its writers
+	Format = export.FormatInfo
+	// WriteOptions are the output options passed to a format's writers
+	WriteOptions = export.WriteOptions
+	// Template writes the findings of the template format
+	Template = export.Template
+	// TemplateSummary is what a template's header and footer are executed
+	// with
+	TemplateSummary = export.TemplateSummary
+)
+
+// ParseTemplate parses a Go template for Options.Template that defines a
+// "finding" template, executed with each finding, and optionally "header"
+// and "footer" ones, executed with a TemplateSummary
+func ParseTemplate(name, text string) (*Template, error) {
+	return export.ParseTemplate(name, text)
+}
+
+// RegisterFormat adds an export format under name, or replaces a built-in
+// one, for the exporter as well as the server and command line. It must be
+// called before any export starts, such as from an init function.
+func RegisterFormat(name string, format Format) {
+	export.RegisterFormat(name, format)
+}
+
+// Options selects what an export fetches and how it is written. Only Output
+// is required; the other fields default as in the server's configuration.
+type Options struct {
+	// Regions are exported along with the enabled regions of RegionGroup,
+	// one of all, us, eu, apac, gov, or cn. With neither set, every enabled
+	// region is exported.
+	Regions     []string
+	RegionGroup string
+	// Roles are assumed to export other accounts, and Discovery adds a role
+	// for each account it finds; with neither, the credentials' own account
+	// is exported
+	Roles     []Role
+	Discovery Discovery
+	Filter    Filter
+	// SortBy and SortOrder sort the findings of each region, as the sort
+	// and sortOrder export options do
+	SortBy    string
+	SortOrder string
+	// Dedupe and DedupeKeep collapse the findings fetched more than once,
+	// as the dedupe and dedupeKeep export options do
+	Dedupe     string
+	DedupeKeep string
+	// ResourceTags looks up the current tags of each finding's resource
+	// through the Resource Groups Tagging API, for the Owner, Team,
+	// Environment, and CostCenter columns. Tags are cached by the Exporter
+	// for an hour.
+	ResourceTags bool
+	// ResourceState looks up whether each finding's instance, buckets, or
+	// EKS cluster still exist and their current state, for the
+	// ResourceExists and ResourceState columns. States are cached by the
+	// Exporter for ten minutes.
+	ResourceState bool
+	// GeoIP sets the country, ASN, and organization of the remote
+	// addresses of the findings from its databases, for the ActorCountry,
+	// ActorAsn, and ActorOrg columns
+	GeoIP *GeoIP
+	// Enrichers are passed each page of findings before it is written
+	Enrichers []Enricher
+	// ReportErrors writes a failed region as an error record and carries on
+	// with the others, instead of failing the export
+	ReportErrors bool
+	// Concurrency is the number of regions fetched at once, 4 by default
+	Concurrency int
+	// Timeout bounds each region, and CallTimeout each AWS API call; zero
+	// means no limit
+	Timeout     time.Duration
+	CallTimeout time.Duration
+	// BatchSize is the number of findings requested per GetFindings call,
+	// at most 50, and BatchRetries the retries of a failed batch
+	BatchSize    int
+	BatchRetries int
+	// Since restricts the export to the findings updated since the
+	// watermarks of a previous Result
+	Since map[string]time.Time
+	// MaxFindings and MaxDuration stop the export once it has written that
+	// many findings or run for that long; the export then succeeds with
+	// Result.Truncated set. Zero means no limit.
+	MaxFindings int
+	MaxDuration time.Duration
+
+	// Format is csv, json, ndjson, xlsx, ocsf, asff, parquet, sqlite, html,
+	// pdf, markdown, cef, leef, or a format added with RegisterFormat, csv by
+	// default
+	Format string
+	Pretty bool
+	// Columns are the CSV and XLSX columns, the default columns when empty,
+	// and Flatten replaces them with every field present in the findings
+	Columns []string
+	Flatten bool
+	// Headers name the Columns in the header row of CSV, XLSX, and HTML
+	// output, one per column, such as for a data warehouse's schema
+	Headers []string
+	// Sanitize escapes CSV cells that spreadsheets would evaluate as
+	// formulas, such as titles starting with =, and normalizes their line
+	// breaks; BOM starts CSV output with a UTF-8 byte order mark for Excel
+	Sanitize bool
+	BOM      bool
+	// CSVDelimiter, CSVLineEnding, CSVQuote, CSVTimeFormat, and CSVTimezone
+	// adapt CSV output to the tools that read it, as the csvDelimiter,
+	// csvLineEnding, csvQuote, csvTimeFormat, and csvTimezone export
+	// options do
+	CSVDelimiter  string
+	CSVLineEnding string
+	CSVQuote      string
+	CSVTimeFormat string
+	CSVTimezone   string
+	// ProductARN is the Security Hub product of ASFF findings
+	ProductARN string
+	// TopFindings is the number of most severe findings in Markdown
+	// reports, 20 when zero, and GroupBy groups them by "type" or
+	// "resource"
+	TopFindings int
+	GroupBy     string
+	// Template writes the findings of the "template" format
+	Template *Template
+	// Compression is gzip or zip, and Split writes a zip archive with a
+	// file per account and region
+	Compression string
+	Split       bool
+
+	// Output receives the export
+	Output io.Writer
+	// Progress, when set, receives the progress events of the export
+	Progress func(Event)
+	// RateLimit, when set, allows that many GuardDuty requests per second
+	// to each account and region, in bursts of up to RateBurst, one
+	// second's worth by default
+	RateLimit float64
+	RateBurst int
+	// Clients, when set, builds the AWS clients of the export in place of
+	// the SDK's, such as a Fake in tests. Tags and resource states are still
+	// looked up through the SDK.
+	Clients Clients
+}
+
+// Result is the outcome of an export
+type Result struct {
+	// Findings is the number of findings written
+	Findings int
+	Regions  RegionSummary
+	// Watermarks are the latest update time of the exported findings of
+	// each detector, the Since of the next incremental export. A region cut
+	// off by a truncation has none, so the next export starts it over.
+	Watermarks map[string]time.Time
+	// Truncated is set when MaxFindings or MaxDuration stopped the export
+	Truncated *Truncation
+	// Summary reports the export's findings by severity, its duration, and
+	// the pages and API calls of each account and region
+	Summary ExportSummary
+}
+
+// Exporter exports the GuardDuty findings readable with an AWS configuration
+type Exporter struct {
+	cfg    aws.Config
+	tags   *gd.TagCache
+	states *gd.StateCache
+}
+
+// New returns an Exporter using cfg, such as the result of
+// config.LoadDefaultConfig. Its region is used to list the regions and for
+// account discovery.
+func New(cfg aws.Config) *Exporter {
+	// The API calls of each account and region are counted for the
+	// summary, without adding to the caller's options
+	cfg.APIOptions = append(slices.Clone(cfg.APIOptions), gd.CountCalls)
+	return &Exporter{
+		cfg:    cfg,
+		tags:   gd.NewTagCache(gd.DefaultTagCacheTTL, gd.DefaultTagConcurrency),
+		states: gd.NewStateCache(gd.DefaultStateCacheTTL, gd.DefaultStateConcurrency, false),
+	}
+}
+
+// Export fetches the findings selected by opts and writes them to
+// opts.Output as they arrive, so memory use stays flat however many findings
+// there are. A region that fails fails the export unless ReportErrors is
+// set, and Output then holds the part of the export written before it.
+func (e *Exporter) Export(ctx context.Context, opts Options) (Result, error) {
+	fetch, write, err := e.options(opts)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := gd.ResolveRegions(ctx, &fetch); err != nil {
+		return Result{}, err
+	}
+	if err := gd.ResolveAccounts(ctx, &fetch); err != nil {
+		return Result{}, err
+	}
+
+	stream := gd.StreamRegions(ctx, fetch, opts.Progress)
+	defer stream.Close()
+	filename := export.Filename(time.Now(), write.Format)
+	totalFindings, err := export.Write(ctx, opts.Output, write, filename, stream)
+	if ctx.Err() != nil {
+		return Result{}, fmt.Errorf("export canceled: %v", ctx.Err())
+	}
+	if result, failed := stream.Failed(); failed {
+		return Result{}, fmt.Errorf("error getting findings for region %s: %v", gd.TargetLabel(result.Account, result.Region), result.Err)
+	}
+	if err != nil {
+		return Result{}, fmt.Errorf("error writing export: %v", err)
+	}
+	results := stream.Results()
+	result := Result{
+		Findings:   totalFindings,
+		Regions:    gd.SummarizeRegions(results),
+		Watermarks: gd.ExportedWatermarks(results),
+		Summary:    stream.Summary(),
+	}
+	if truncation, ok := stream.Truncated(); ok {
+		result.Truncated = &truncation
+	}
+	return result, nil
+}
+
+// options validates opts and fills in the defaults
+func (e *Exporter) options(opts Options) (gd.FetchOptions, export.WriteOptions, error) {
+	if opts.Output == nil {
+		return gd.FetchOptions{}, export.WriteOptions{}, fmt.Errorf("no output to write the export to")
+	}
+	fetch := gd.FetchOptions{
+		Regions:      opts.Regions,
+		RegionGroup:  opts.RegionGroup,
+		AWSConfig:    e.cfg,
+		Roles:        opts.Roles,
+		Discovery:    opts.Discovery,
+		ReportErrors: opts.ReportErrors,
+		Concurrency:  opts.Concurrency,
+		Timeout:      opts.Timeout,
+		CallTimeout:  opts.CallTimeout,
+		Filter:       opts.Filter,
+		Watermarks:   opts.Since,
+		BatchSize:    opts.BatchSize,
+		BatchRetries: opts.BatchRetries,
+		Limiters:     gd.NewRateLimiters(opts.RateLimit, opts.RateBurst),
+		MaxFindings:  opts.MaxFindings,
+		MaxDuration:  opts.MaxDuration,
+		Clients:      opts.Clients,
+	}
+	write := export.WriteOptions{
+		Format:      opts.Format,
+		Pretty:      opts.Pretty,
+		Columns:     opts.Columns,
+		Flatten:     opts.Flatten,
+		Headers:     opts.Headers,
+		Sanitize:    opts.Sanitize,
+		BOM:         opts.BOM,
+		ProductARN:  opts.ProductARN,
+		TopFindings: opts.TopFindings,
+		GroupBy:     opts.GroupBy,
+		Template:    opts.Template,
+		Compression: opts.Compression,
+		Split:       opts.Split,
+	}
+
+	if len(fetch.Regions) == 0 && fetch.RegionGroup == "" {
+		fetch.RegionGroup = "all"
+	}
+	if fetch.RegionGroup != "" && !gd.ValidRegionGroup(fetch.RegionGroup) {
+		return fetch, write, fmt.Errorf("invalid region group %q", fetch.RegionGroup)
+	}
+	for _, role := range fetch.Roles {
+		if err := role.Validate(); err != nil {
+			return fetch, write, err
+		}
+	}
+	if err := fetch.Discovery.Validate(); err != nil {
+		return fetch, write, err
+	}
+	if err := gd.CheckPartition(fetch); err != nil {
+		return fetch, write, err
+	}
+	if fetch.Concurrency <= 0 {
+		fetch.Concurrency = 4
+	}
+	if fetch.MaxFindings < 0 || fetch.MaxDuration < 0 {
+		return fetch, write, fmt.Errorf("invalid limits: MaxFindings and MaxDuration must not be negative")
+	}
+	if fetch.BatchSize <= 0 {
+		fetch.BatchSize = gd.MaxGetFindingsBatch
+	}
+	if fetch.BatchSize > gd.MaxGetFindingsBatch {
+		return fetch, write, fmt.Errorf("invalid batch size %d: must be at most %d", fetch.BatchSize, gd.MaxGetFindingsBatch)
+	}
+	order, err := gd.ParseSort(opts.SortBy, opts.SortOrder)
+	if err != nil {
+		return fetch, write, err
+	}
+	fetch.Sort = order
+	fetch.Dedupe, err = gd.ParseDedupe(opts.Dedupe, opts.DedupeKeep)
+	if err != nil {
+		return fetch, write, err
+	}
+	if opts.ResourceTags {
+		fetch.ResourceTags = e.tags
+	}
+	if opts.ResourceState {
+		fetch.ResourceState, write.States = e.states, e.states
+	}
+	fetch.GeoIP = opts.GeoIP
+	write.CSV, err = export.ParseCSVDialect(opts.CSVDelimiter, opts.CSVLineEnding, opts.CSVQuote, opts.CSVTimeFormat, opts.CSVTimezone)
+	if err != nil {
+		return fetch, write, err
+	}
+	fetch.Enrichers = opts.Enrichers
+
+	if write.Format == "" {
+		write.Format = "csv"
+	}
+	if !export.ValidFormat(write.Format) {
+		return fetch, write, fmt.Errorf("unsupported format %q", write.Format)
+	}
+	if write.Format == "template" && write.Template == nil {
+		return fetch, write, fmt.Errorf("the template format requires a Template")
+	}
+	if len(write.Columns) == 0 {
+		write.Columns = export.DefaultColumns
+		if opts.ResourceTags {
+			write.Columns = append(slices.Clone(write.Columns), gd.ResourceTagKeys...)
+		}
+		if opts.ResourceState {
+			write.Columns = append(slices.Clone(write.Columns), gd.ResourceStateColumns...)
+		}
+		if opts.GeoIP != nil {
+			write.Columns = append(slices.Clone(write.Columns), "ActorAsn", "ActorOrg")
+		}
+	}
+	for _, column := range write.Columns {
+		if err := export.ValidColumn(column); err != nil {
+			return fetch, write, fmt.Errorf("invalid column %q: %v", column, err)
+		}
+	}
+	if len(write.Headers) > 0 && len(write.Headers) != len(write.Columns) {
+		return fetch, write, fmt.Errorf("invalid headers: %d given for %d columns", len(write.Headers), len(write.Columns))
+	}
+	if write.ProductARN != "" && !export.ValidProductARN(write.ProductARN) {
+		return fetch, write, fmt.Errorf("invalid product ARN %q", write.ProductARN)
+	}
+	if write.TopFindings < 0 || write.TopFindings > export.MaxTopFindings {
+		return fetch, write, fmt.Errorf("invalid top findings %d: must be at most %d", write.TopFindings, export.MaxTopFindings)
+	}
+	if !export.ValidGroupBy(write.GroupBy) {
+		return fetch, write, fmt.Errorf("invalid group by %q: must be type or resource", write.GroupBy)
+	}
+	if write.Compression != "" && !export.ValidCompression(write.Compression) {
+		return fetch, write, fmt.Errorf("invalid compression %q: must be gzip or zip", write.Compression)
+	}
+	if write.Split {
+		if write.Compression == export.CompressGzip {
+			return fetch, write, fmt.Errorf("split exports are packaged as zip and cannot be compressed with gzip")
+		}
+		write.Compression = export.CompressZip
+	}
+	return fetch, write, nil
+}
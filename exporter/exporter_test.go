@@ -0,0 +1,88 @@
+package exporter_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/exporter"
+	"guardduty/internal/gd"
+)
+
+func TestExportFake(t *testing.T) {
+	fake := exporter.NewFake("123456789012")
+	fake.PageSize = 1
+	fake.AddFindings(
+		types.Finding{Id: aws.String("a"), Region: aws.String("us-east-1"), Type: aws.String("Recon:EC2/PortProbeUnprotectedPort"), Severity: aws.Float64(2)},
+		types.Finding{Id: aws.String("b"), Region: aws.String("us-east-1"), Type: aws.String("Recon:EC2/PortProbeUnprotectedPort"), Severity: aws.Float64(8)},
+	)
+	var out bytes.Buffer
+	result, err := exporter.New(aws.Config{Region: "us-east-1"}).Export(context.Background(), exporter.Options{
+		Regions: []string{"us-east-1"},
+		Format:  "ndjson",
+		Clients: fake,
+		Output:  &out,
+	})
+	if err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	if result.Findings != 2 {
+		t.Errorf("got %d findings, want 2", result.Findings)
+	}
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), out.Bytes())
+	}
+	var finding types.Finding
+	if err := json.Unmarshal(lines[0], &finding); err != nil {
+		t.Fatalf("invalid finding: %v", err)
+	}
+	if got := aws.ToString(finding.AccountId); got != "123456789012" {
+		t.Errorf("got account %q, want the fake's", got)
+	}
+	if got := fake.Calls("ListFindings"); got != 2 {
+		t.Errorf("got %d ListFindings calls, want 2", got)
+	}
+}
+
+// BenchmarkExport exports the synthetic findings of a region in each of the
+// common formats, reporting the findings written per second
+func BenchmarkExport(b *testing.B) {
+	const findings = 10_000
+	// Leave the log of each region out of the results
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	for _, format := range []string{"csv", "json", "ndjson", "parquet"} {
+		b.Run(format, func(b *testing.B) {
+			synthetic := gd.NewSynthetic(gd.SyntheticOptions{Findings: findings, Seed: 1})
+			opts := exporter.Options{
+				Regions: []string{"us-east-1"},
+				Format:  format,
+				Clients: synthetic,
+				Output:  io.Discard,
+			}
+			exp := exporter.New(aws.Config{Region: "us-east-1"})
+			// The first export generates the findings
+			if _, err := exp.Export(context.Background(), opts); err != nil {
+				b.Fatalf("export failed: %v", err)
+			}
+			b.ResetTimer()
+			for range b.N {
+				result, err := exp.Export(context.Background(), opts)
+				if err != nil {
+					b.Fatalf("export failed: %v", err)
+				}
+				if result.Findings != findings {
+					b.Fatalf("got %d findings, want %d", result.Findings, findings)
+				}
+			}
+			b.ReportMetric(float64(findings*b.N)/b.Elapsed().Seconds(), "findings/s")
+		})
+	}
+}
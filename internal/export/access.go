@@ -0,0 +1,111 @@
+package export
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// bucketField returns a field of the buckets of an S3 finding, joined with
+// "; " when there are several
+func bucketField(f types.Finding, field func(types.S3BucketDetail) string) string {
+	if f.Resource == nil {
+		return ""
+	}
+	var values []string
+	for _, bucket := range f.Resource.S3BucketDetails {
+		if value := field(bucket); value != "" {
+			values = append(values, value)
+		}
+	}
+	return strings.Join(values, "; ")
+}
+
+// bucketPermissions returns the bucket level permissions of a bucket, and
+// the account level ones of its owner
+func bucketPermissions(bucket types.S3BucketDetail) (*types.BucketLevelPermissions, *types.AccountLevelPermissions) {
+	if bucket.PublicAccess == nil || bucket.PublicAccess.PermissionConfiguration == nil {
+		return nil, nil
+	}
+	conf := bucket.PublicAccess.PermissionConfiguration
+	return conf.BucketLevelPermissions, conf.AccountLevelPermissions
+}
+
+// publicGrants lists what of a bucket's ACL and policy allows public access,
+// such as "acl-read, policy-write"
+func publicGrants(bucket types.S3BucketDetail) string {
+	permissions, _ := bucketPermissions(bucket)
+	if permissions == nil {
+		return ""
+	}
+	var grants []string
+	if acl := permissions.AccessControlList; acl != nil {
+		if aws.ToBool(acl.AllowsPublicReadAccess) {
+			grants = append(grants, "acl-read")
+		}
+		if aws.ToBool(acl.AllowsPublicWriteAccess) {
+			grants = append(grants, "acl-write")
+		}
+	}
+	if policy := permissions.BucketPolicy; policy != nil {
+		if aws.ToBool(policy.AllowsPublicReadAccess) {
+			grants = append(grants, "policy-read")
+		}
+		if aws.ToBool(policy.AllowsPublicWriteAccess) {
+			grants = append(grants, "policy-write")
+		}
+	}
+	return strings.Join(grants, ", ")
+}
+
+// blockPublicAccess lists the S3 Block Public Access settings that are on for
+// a bucket, each prefixed by the level that sets it, such as
+// "account.BlockPublicAcls, bucket.RestrictPublicBuckets"
+func blockPublicAccess(bucket types.S3BucketDetail) string {
+	bucketLevel, accountLevel := bucketPermissions(bucket)
+	var settings []string
+	add := func(level string, block *types.BlockPublicAccess) {
+		if block == nil {
+			return
+		}
+		for _, setting := range []struct {
+			name string
+			on   *bool
+		}{
+			{"BlockPublicAcls", block.BlockPublicAcls},
+			{"IgnorePublicAcls", block.IgnorePublicAcls},
+			{"BlockPublicPolicy", block.BlockPublicPolicy},
+			{"RestrictPublicBuckets", block.RestrictPublicBuckets},
+		} {
+			if aws.ToBool(setting.on) {
+				settings = append(settings, level+"."+setting.name)
+			}
+		}
+	}
+	if accountLevel != nil {
+		add("account", accountLevel.BlockPublicAccess)
+	}
+	if bucketLevel != nil {
+		add("bucket", bucketLevel.BlockPublicAccess)
+	}
+	return strings.Join(settings, ", ")
+}
+
+// apiCall returns the API call of a finding whose action is one, as of
+// CloudTrail-based IAM and S3 findings
+func apiCall(f types.Finding) *types.AwsApiCallAction {
+	if f.Service == nil || f.Service.Action == nil {
+		return nil
+	}
+	return f.Service.Action.AwsApiCallAction
+}
+
+// accessKey returns the access key and principal that a finding's activity
+// was made with
+func accessKey(f types.Finding) *types.AccessKeyDetails {
+	if f.Resource == nil {
+		return nil
+	}
+	return f.Resource.AccessKeyDetails
+}
@@ -0,0 +1,116 @@
+package export
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// Aggregator counts the findings of an export as they are fetched, for the
+// web UI's dashboard: by severity and type, by severity in each account and
+// region, and by affected resource. It is a gd.Enricher seeing each page
+// before it is written, so its counts can be read while the export runs,
+// and it keeps counts only, so its memory grows with the distinct types,
+// regions, and resources. An Aggregator is safe for concurrent use.
+type Aggregator struct {
+	mu         sync.Mutex
+	findings   int
+	bySeverity map[string]int
+	byType     map[string]int
+	byRegion   map[regionKey]map[string]int
+	byResource map[string]int
+}
+
+type regionKey struct {
+	account, region string
+}
+
+// Aggregates are the counts of an Aggregator, in the shapes of
+// gd.Statistics so the dashboard draws an export and its preview alike
+type Aggregates struct {
+	Findings   int            `json:"findings"`
+	BySeverity map[string]int `json:"bySeverity"`
+	// ByType counts the findings of each finding type, most common first
+	ByType []gd.TypeCount `json:"byType"`
+	// Regions count the findings of each account and region by severity,
+	// in account and region order
+	Regions      []RegionAggregates `json:"regions"`
+	TopResources []gd.ResourceCount `json:"topResources"`
+}
+
+// RegionAggregates counts the findings of one account and region
+type RegionAggregates struct {
+	Account    string         `json:"account,omitempty"`
+	Region     string         `json:"region"`
+	Findings   int            `json:"findings"`
+	BySeverity map[string]int `json:"bySeverity"`
+}
+
+// NewAggregator returns an Aggregator that has counted no findings
+func NewAggregator() *Aggregator {
+	return &Aggregator{
+		bySeverity: make(map[string]int),
+		byType:     make(map[string]int),
+		byRegion:   make(map[regionKey]map[string]int),
+		byResource: make(map[string]int),
+	}
+}
+
+// Enrich counts a page of findings, leaving them unchanged
+func (a *Aggregator) Enrich(_ context.Context, findings []types.Finding) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, f := range findings {
+		label := gd.SeverityLabel(aws.ToFloat64(f.Severity))
+		a.findings++
+		a.bySeverity[label]++
+		a.byType[aws.ToString(f.Type)]++
+		key := regionKey{aws.ToString(f.AccountId), aws.ToString(f.Region)}
+		if a.byRegion[key] == nil {
+			a.byRegion[key] = make(map[string]int)
+		}
+		a.byRegion[key][label]++
+		if resource := findingResource(f); resource != "" {
+			a.byResource[resource]++
+		}
+	}
+}
+
+// Aggregates returns the counts of the findings seen so far, with the
+// gd.TopResourcesN most affected resources
+func (a *Aggregator) Aggregates() Aggregates {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	aggregates := Aggregates{
+		Findings:     a.findings,
+		BySeverity:   make(map[string]int, len(a.bySeverity)),
+		ByType:       make([]gd.TypeCount, 0, len(a.byType)),
+		Regions:      make([]RegionAggregates, 0, len(a.byRegion)),
+		TopResources: gd.TopResources(a.byResource, gd.TopResourcesN),
+	}
+	for label, n := range a.bySeverity {
+		aggregates.BySeverity[label] = n
+	}
+	for _, t := range topCounts(a.byType, len(a.byType)) {
+		aggregates.ByType = append(aggregates.ByType, gd.TypeCount{Type: t.Name, Findings: t.Findings})
+	}
+	for key, bySeverity := range a.byRegion {
+		region := RegionAggregates{Account: key.account, Region: key.region, BySeverity: make(map[string]int, len(bySeverity))}
+		for label, n := range bySeverity {
+			region.BySeverity[label] = n
+			region.Findings += n
+		}
+		aggregates.Regions = append(aggregates.Regions, region)
+	}
+	slices.SortFunc(aggregates.Regions, func(a, b RegionAggregates) int {
+		return cmp.Or(strings.Compare(a.Account, b.Account), strings.Compare(a.Region, b.Region))
+	})
+	return aggregates
+}
@@ -0,0 +1,292 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// asffSchemaVersion is the AWS Security Finding Format version written
+const asffSchemaVersion = "2018-10-08"
+
+// asffFinding is a GuardDuty finding in the AWS Security Finding Format
+// accepted by Security Hub BatchImportFindings
+type asffFinding struct {
+	SchemaVersion   string            `json:"SchemaVersion"`
+	Id              string            `json:"Id"`
+	ProductArn      string            `json:"ProductArn"`
+	GeneratorId     string            `json:"GeneratorId"`
+	AwsAccountId    string            `json:"AwsAccountId"`
+	Types           []string          `json:"Types"`
+	FirstObservedAt string            `json:"FirstObservedAt,omitempty"`
+	LastObservedAt  string            `json:"LastObservedAt,omitempty"`
+	CreatedAt       string            `json:"CreatedAt"`
+	UpdatedAt       string            `json:"UpdatedAt"`
+	Severity        asffSeverity      `json:"Severity"`
+	Confidence      *int              `json:"Confidence,omitempty"`
+	Title           string            `json:"Title"`
+	Description     string            `json:"Description"`
+	ProductFields   map[string]string `json:"ProductFields,omitempty"`
+	Resources       []asffResource    `json:"Resources"`
+	Network         *asffNetwork      `json:"Network,omitempty"`
+	Workflow        asffWorkflow      `json:"Workflow"`
+	RecordState     string            `json:"RecordState"`
+	Region          string            `json:"Region,omitempty"`
+}
+
+type asffSeverity struct {
+	Label    string `json:"Label"`
+	Original string `json:"Original"`
+}
+
+type asffResource struct {
+	Type      string `json:"Type"`
+	Id        string `json:"Id"`
+	Partition string `json:"Partition"`
+	Region    string `json:"Region"`
+}
+
+type asffNetwork struct {
+	Direction  string `json:"Direction,omitempty"`
+	SourceIpV4 string `json:"SourceIpV4,omitempty"`
+	SourceIpV6 string `json:"SourceIpV6,omitempty"`
+}
+
+type asffWorkflow struct {
+	Status string `json:"Status"`
+}
+
+// asffTypeNamespaces maps the threat purpose of a GuardDuty finding type to
+// the Security Hub finding type namespace and category
+var asffTypeNamespaces = map[string]string{
+	"Backdoor":            "TTPs/Command and Control",
+	"Behavior":            "Unusual Behaviors",
+	"CredentialAccess":    "TTPs/Credential Access",
+	"CryptoCurrency":      "Effects/Resource Consumption",
+	"DefenseEvasion":      "TTPs/Defense Evasion",
+	"Discovery":           "TTPs/Discovery",
+	"Execution":           "TTPs/Execution",
+	"Exfiltration":        "Effects/Data Exfiltration",
+	"Impact":              "Effects",
+	"InitialAccess":       "TTPs/Initial Access",
+	"PenTest":             "TTPs/Discovery",
+	"Persistence":         "TTPs/Persistence",
+	"Policy":              "Software and Configuration Checks/Policy",
+	"PrivilegeEscalation": "TTPs/Privilege Escalation",
+	"Recon":               "TTPs/Discovery",
+	"Stealth":             "TTPs/Defense Evasion",
+	"Trojan":              "TTPs/Execution",
+	"UnauthorizedAccess":  "TTPs/Initial Access",
+}
+
+// asffResourceTypes maps GuardDuty resource types to ASFF resource types
+var asffResourceTypes = map[string]string{
+	"Instance":      "AwsEc2Instance",
+	"AccessKey":     "AwsIamAccessKey",
+	"S3Bucket":      "AwsS3Bucket",
+	"EKSCluster":    "AwsEksCluster",
+	"ECSCluster":    "AwsEcsCluster",
+	"Container":     "Container",
+	"Lambda":        "AwsLambdaFunction",
+	"RDSDBInstance": "AwsRdsDbInstance",
+}
+
+// asffType converts a GuardDuty finding type such as
+// Recon:EC2/PortProbeUnprotectedPort to a Security Hub type such as
+// TTPs/Discovery/Recon:EC2-PortProbeUnprotectedPort
+func asffType(findingType string) string {
+	purpose, _, _ := strings.Cut(findingType, ":")
+	namespace, ok := asffTypeNamespaces[purpose]
+	if !ok {
+		namespace = "Unusual Behaviors"
+	}
+	return namespace + "/" + strings.ReplaceAll(findingType, "/", "-")
+}
+
+// asffSeverityLabel maps a GuardDuty severity to a Security Hub label
+func asffSeverityLabel(severity float64) string {
+	return strings.ToUpper(gd.SeverityLabel(severity))
+}
+
+// toASFF converts a GuardDuty finding. productARN overrides the product the
+// finding is imported as; by default it is the default product of the
+// finding's account, which BatchImportFindings accepts from that account.
+func toASFF(f types.Finding, productARN string) asffFinding {
+	region := aws.ToString(f.Region)
+	partition := aws.ToString(f.Partition)
+	if partition == "" {
+		partition = gd.RegionPartition(region)
+	}
+	account := aws.ToString(f.AccountId)
+	if productARN == "" {
+		productARN = fmt.Sprintf("arn:%s:securityhub:%s:%s:product/%s/default", partition, region, account, account)
+	}
+
+	severity := aws.ToFloat64(f.Severity)
+	finding := asffFinding{
+		SchemaVersion: asffSchemaVersion,
+		Id:            aws.ToString(f.Arn),
+		ProductArn:    productARN,
+		AwsAccountId:  account,
+		Types:         []string{asffType(aws.ToString(f.Type))},
+		CreatedAt:     aws.ToString(f.CreatedAt),
+		UpdatedAt:     aws.ToString(f.UpdatedAt),
+		Severity:      asffSeverity{Label: asffSeverityLabel(severity), Original: fmt.Sprintf("%.1f", severity)},
+		Title:         aws.ToString(f.Title),
+		Description:   aws.ToString(f.Description),
+		ProductFields: map[string]string{
+			"aws/guardduty/findingId": aws.ToString(f.Id),
+			"aws/guardduty/type":      aws.ToString(f.Type),
+		},
+		Resources:   []asffResource{asffResourceOf(f, partition, region, account)},
+		Workflow:    asffWorkflow{Status: "NEW"},
+		RecordState: "ACTIVE",
+		Region:      region,
+	}
+	if finding.Id == "" {
+		finding.Id = aws.ToString(f.Id)
+	}
+	if f.Confidence != nil {
+		confidence := int(*f.Confidence * 10)
+		finding.Confidence = &confidence
+	}
+	// Security Hub requires a description
+	if finding.Description == "" {
+		finding.Description = finding.Title
+	}
+
+	if s := f.Service; s != nil {
+		finding.GeneratorId = fmt.Sprintf("arn:%s:guardduty:%s:%s:detector/%s", partition, region, account, aws.ToString(s.DetectorId))
+		finding.FirstObservedAt = aws.ToString(s.EventFirstSeen)
+		finding.LastObservedAt = aws.ToString(s.EventLastSeen)
+		if s.Archived != nil && *s.Archived {
+			finding.RecordState = "ARCHIVED"
+			finding.Workflow.Status = "SUPPRESSED"
+		}
+		if s.Count != nil {
+			finding.ProductFields["aws/guardduty/service/count"] = fmt.Sprint(*s.Count)
+		}
+		if s.Action != nil && s.Action.ActionType != nil {
+			finding.ProductFields["aws/guardduty/service/action/actionType"] = *s.Action.ActionType
+		}
+	}
+	if finding.GeneratorId == "" {
+		finding.GeneratorId = aws.ToString(f.Type)
+	}
+
+	if ip := actorIP(f); ip != nil {
+		network := &asffNetwork{SourceIpV4: aws.ToString(ip.IpAddressV4), SourceIpV6: aws.ToString(ip.IpAddressV6)}
+		if f.Service.Action.NetworkConnectionAction != nil {
+			// Security Hub uses IN and OUT where GuardDuty uses INBOUND and OUTBOUND
+			switch aws.ToString(f.Service.Action.NetworkConnectionAction.ConnectionDirection) {
+			case "INBOUND":
+				network.Direction = "IN"
+			case "OUTBOUND":
+				network.Direction = "OUT"
+			}
+		}
+		finding.Network = network
+	}
+	return finding
+}
+
+// asffResourceOf describes the affected resource, identified by its ARN
+// where GuardDuty reports one
+func asffResourceOf(f types.Finding, partition, region, account string) asffResource {
+	resource := asffResource{Type: "Other", Partition: partition, Region: region}
+	r := f.Resource
+	if r == nil {
+		resource.Id = aws.ToString(f.Arn)
+		return resource
+	}
+	if t, ok := asffResourceTypes[aws.ToString(r.ResourceType)]; ok {
+		resource.Type = t
+	}
+
+	switch {
+	case resource.Type == "AwsEc2Instance" && r.InstanceDetails != nil:
+		resource.Id = fmt.Sprintf("arn:%s:ec2:%s:%s:instance/%s", partition, region, account, aws.ToString(r.InstanceDetails.InstanceId))
+	case resource.Type == "AwsIamAccessKey" && r.AccessKeyDetails != nil:
+		resource.Id = "AWS::IAM::AccessKey:" + aws.ToString(r.AccessKeyDetails.AccessKeyId)
+	case resource.Type == "AwsS3Bucket" && len(r.S3BucketDetails) > 0:
+		resource.Id = aws.ToString(r.S3BucketDetails[0].Arn)
+	case resource.Type == "AwsEksCluster" && r.EksClusterDetails != nil:
+		resource.Id = aws.ToString(r.EksClusterDetails.Arn)
+	case resource.Type == "AwsEcsCluster" && r.EcsClusterDetails != nil:
+		resource.Id = aws.ToString(r.EcsClusterDetails.Arn)
+	case resource.Type == "AwsLambdaFunction" && r.LambdaDetails != nil:
+		resource.Id = aws.ToString(r.LambdaDetails.FunctionArn)
+	case resource.Type == "AwsRdsDbInstance" && r.RdsDbInstanceDetails != nil:
+		resource.Id = aws.ToString(r.RdsDbInstanceDetails.DbInstanceArn)
+	}
+	if resource.Id == "" {
+		resource.Id = resourceID(r)
+	}
+	if resource.Id == "" {
+		resource.Id = aws.ToString(f.Arn)
+	}
+	return resource
+}
+
+// ValidProductARN reports whether s is a Security Hub product ARN
+func ValidProductARN(s string) bool {
+	parsed, err := arn.Parse(s)
+	return err == nil && parsed.Service == "securityhub" && strings.HasPrefix(parsed.Resource, "product/")
+}
+
+// asffWriter writes the findings as a JSON array of ASFF findings, indented
+// when pretty is set. Failed regions are logged but not written.
+type asffWriter struct {
+	bw         *bufio.Writer
+	productARN string
+	pretty     bool
+	first      bool
+}
+
+func newASFFWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	return &asffWriter{bw: bufio.NewWriter(out), productARN: opts.ProductARN, pretty: opts.Pretty, first: true}
+}
+
+func (w *asffWriter) WriteHeader() error {
+	_, err := w.bw.WriteString("[")
+	return err
+}
+
+func (w *asffWriter) WriteFinding(finding types.Finding) error {
+	var data []byte
+	var err error
+	if w.pretty {
+		data, err = json.MarshalIndent(toASFF(finding, w.productARN), "  ", "  ")
+	} else {
+		data, err = json.Marshal(toASFF(finding, w.productARN))
+	}
+	if err != nil {
+		return fmt.Errorf("error encoding finding: %v", err)
+	}
+
+	if !w.first {
+		w.bw.WriteString(",")
+	}
+	w.first = false
+	if w.pretty {
+		w.bw.WriteString("\n  ")
+	}
+	_, err = w.bw.Write(data)
+	return err
+}
+
+func (w *asffWriter) Close() error {
+	if w.pretty && !w.first {
+		w.bw.WriteString("\n")
+	}
+	w.bw.WriteString("]\n")
+	return w.bw.Flush()
+}
@@ -0,0 +1,205 @@
+package export
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// TableColumn is a column of the Athena table over partitioned exports,
+// with its Hive type
+type TableColumn struct {
+	Name string
+	Type string
+}
+
+// PartitionKeys are the partition columns of the tables over partitioned
+// exports, named as the directories WritePartitions writes
+var PartitionKeys = []TableColumn{{"region", "string"}, {"dt", "string"}}
+
+// TableSchema describes the files of partitioned exports of a format to
+// Athena and the Glue Data Catalog
+type TableSchema struct {
+	Columns         []TableColumn
+	SerDe           string
+	SerDeParameters map[string]string
+	InputFormat     string
+	OutputFormat    string
+	// Parameters are the table properties
+	Parameters map[string]string
+}
+
+// Partition is a partition of a partitioned export: its directory relative
+// to the table location and the values of PartitionKeys
+type Partition struct {
+	Dir    string
+	Values []string
+}
+
+// NewTableSchema returns the schema of the partitioned exports written with
+// opts. Parquet tables have the Parquet columns with their types; CSV
+// tables have the export's columns, in snake case, as strings, so exports
+// sharing a table must have the same columns.
+func NewTableSchema(opts WriteOptions) TableSchema {
+	if opts.Format != "csv" {
+		schema := TableSchema{
+			SerDe:        "org.apache.hadoop.hive.ql.io.parquet.serde.ParquetHiveSerDe",
+			InputFormat:  "org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat",
+			OutputFormat: "org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat",
+			Parameters:   map[string]string{"classification": "parquet"},
+		}
+		for _, column := range parquetColumns {
+			// The region is read from the partition
+			if column.name != "region" {
+				schema.Columns = append(schema.Columns, TableColumn{column.name, parquetHiveType(column)})
+			}
+		}
+		return schema
+	}
+
+	separator := ","
+	if opts.CSV.Delimiter != 0 {
+		separator = string(opts.CSV.Delimiter)
+	}
+	schema := TableSchema{
+		SerDe:           "org.apache.hadoop.hive.serde2.OpenCSVSerde",
+		SerDeParameters: map[string]string{"separatorChar": separator, "quoteChar": `"`},
+		InputFormat:     "org.apache.hadoop.mapred.TextInputFormat",
+		OutputFormat:    "org.apache.hadoop.hive.ql.io.HiveIgnoreKeyTextOutputFormat",
+		Parameters:      map[string]string{"classification": "csv", "skip.header.line.count": "1"},
+	}
+	for _, column := range partitionColumns(opts.Columns) {
+		schema.Columns = append(schema.Columns, TableColumn{TableColumnName(column), "string"})
+	}
+	return schema
+}
+
+// partitionColumns returns the export columns of CSV partitions: Region is
+// left out, as the table reads it from the partition
+func partitionColumns(columns []string) []string {
+	return slices.DeleteFunc(slices.Clone(columns), func(column string) bool { return column == "Region" })
+}
+
+// parquetHiveType returns the Hive type of a Parquet column
+func parquetHiveType(column parquetColumn) string {
+	switch {
+	case column.converted == parquetTimestampMillis:
+		return "timestamp"
+	case column.kind == parquetDouble:
+		return "double"
+	case column.kind == parquetInt32:
+		return "int"
+	case column.kind == parquetInt64:
+		return "bigint"
+	case column.kind == parquetBoolean:
+		return "boolean"
+	}
+	return "string"
+}
+
+// TableColumnName returns the table column of an export column in snake
+// case, such as account_id for AccountId or service_action_action_type for
+// Service.Action.ActionType
+func TableColumnName(column string) string {
+	var b strings.Builder
+	runes := []rune(column)
+	for i, r := range runes {
+		switch {
+		case r == '.':
+			b.WriteByte('_')
+			continue
+		case unicode.IsUpper(r) && i > 0 && runes[i-1] != '.':
+			prev := runes[i-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (i+1 < len(runes) && unicode.IsUpper(prev) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// FilePartitions returns the partitions of the files WritePartitions wrote,
+// in the order of the files
+func FilePartitions(files []string) []Partition {
+	var partitions []Partition
+	for _, file := range files {
+		dir := path.Dir(strings.ReplaceAll(file, "\\", "/"))
+		if slices.ContainsFunc(partitions, func(p Partition) bool { return p.Dir == dir }) {
+			continue
+		}
+		partition := Partition{Dir: dir}
+		for _, part := range strings.Split(dir, "/") {
+			_, value, _ := strings.Cut(part, "=")
+			partition.Values = append(partition.Values, value)
+		}
+		partitions = append(partitions, partition)
+	}
+	return partitions
+}
+
+// TableDDL returns the Athena statements that create the database and the
+// table over the partitioned exports at location, an s3:// URL ending in
+// "/", unless they exist, and add the partitions of an export. Athena runs
+// one statement at a time, so each ends with ";" on a line of its own.
+func (s TableSchema) TableDDL(database, table, location string, partitions []Partition) string {
+	name := fmt.Sprintf("`%s`.`%s`", database, table)
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE DATABASE IF NOT EXISTS `%s`\n;\n\n", database)
+
+	fmt.Fprintf(&b, "CREATE EXTERNAL TABLE IF NOT EXISTS %s (\n", name)
+	for i, column := range s.Columns {
+		sep := ","
+		if i == len(s.Columns)-1 {
+			sep = ""
+		}
+		fmt.Fprintf(&b, "  `%s` %s%s\n", column.Name, column.Type, sep)
+	}
+	keys := make([]string, len(PartitionKeys))
+	for i, key := range PartitionKeys {
+		keys[i] = fmt.Sprintf("`%s` %s", key.Name, key.Type)
+	}
+	fmt.Fprintf(&b, ")\nPARTITIONED BY (%s)\n", strings.Join(keys, ", "))
+	fmt.Fprintf(&b, "ROW FORMAT SERDE %s\n", sqlString(s.SerDe))
+	if len(s.SerDeParameters) > 0 {
+		fmt.Fprintf(&b, "WITH SERDEPROPERTIES (%s)\n", sqlProperties(s.SerDeParameters))
+	}
+	fmt.Fprintf(&b, "STORED AS INPUTFORMAT %s OUTPUTFORMAT %s\n", sqlString(s.InputFormat), sqlString(s.OutputFormat))
+	fmt.Fprintf(&b, "LOCATION %s\n", sqlString(location))
+	fmt.Fprintf(&b, "TBLPROPERTIES (%s)\n;\n", sqlProperties(s.Parameters))
+
+	if len(partitions) > 0 {
+		fmt.Fprintf(&b, "\nALTER TABLE %s ADD IF NOT EXISTS\n", name)
+		for _, partition := range partitions {
+			values := make([]string, len(PartitionKeys))
+			for i, key := range PartitionKeys {
+				values[i] = fmt.Sprintf("`%s` = %s", key.Name, sqlString(partition.Values[i]))
+			}
+			fmt.Fprintf(&b, "  PARTITION (%s) LOCATION %s\n", strings.Join(values, ", "), sqlString(location+partition.Dir+"/"))
+		}
+		b.WriteString(";\n")
+	}
+	return b.String()
+}
+
+// sqlString quotes s as a Hive string literal
+func sqlString(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\t", `\t`).Replace(s)
+	return "'" + s + "'"
+}
+
+// sqlProperties returns the Hive property list of params, sorted by name
+func sqlProperties(params map[string]string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	properties := make([]string, len(names))
+	for i, name := range names {
+		properties[i] = sqlString(name) + " = " + sqlString(params[name])
+	}
+	return strings.Join(properties, ", ")
+}
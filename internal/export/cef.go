@@ -0,0 +1,204 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// The vendor and product that CEF and LEEF events name as their source
+const (
+	eventVendor  = "Amazon"
+	eventProduct = "GuardDuty"
+)
+
+// leefTimeLayout is the layout of LEEF devTime values, which leefTimeFormat
+// describes in Java's date format for the receiver
+const (
+	leefTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+	leefTimeFormat = "yyyy-MM-dd'T'HH:mm:ss.SSSX"
+)
+
+// eventField is a field of a finding in CEF and LEEF events. CEF names the
+// fields without a standard key with its custom string and number keys,
+// labeled with their names, and LEEF with keys of their own.
+type eventField struct {
+	cef   string
+	label string
+	leef  string
+	value string
+}
+
+// eventFields returns the fields of a finding shared by CEF and LEEF events
+func eventFields(f types.Finding) []eventField {
+	fields := []eventField{
+		{"externalId", "", "findingId", aws.ToString(f.Id)},
+		{"cat", "", "cat", eventCategory(aws.ToString(f.Type))},
+		{"msg", "", "description", aws.ToString(f.Description)},
+		{"cs1", "accountId", "accountId", aws.ToString(f.AccountId)},
+		{"cs2", "region", "region", aws.ToString(f.Region)},
+		{"cfp1", "guardDutySeverity", "guardDutySeverity", strconv.FormatFloat(aws.ToFloat64(f.Severity), 'f', -1, 64)},
+	}
+	if f.Resource != nil {
+		fields = append(fields,
+			eventField{"cs3", "resourceType", "resourceType", aws.ToString(f.Resource.ResourceType)},
+			eventField{"cs4", "resourceId", "resourceId", resourceID(f.Resource)})
+		if d := f.Resource.InstanceDetails; d != nil && len(d.NetworkInterfaces) > 0 {
+			fields = append(fields, eventField{"dst", "", "dst", aws.ToString(d.NetworkInterfaces[0].PrivateIpAddress)})
+		}
+	}
+	if ip := actorIP(f); ip != nil {
+		fields = append(fields, eventField{"src", "", "src", aws.ToString(ip.IpAddressV4)})
+	}
+	if f.Service != nil {
+		if f.Service.Action != nil {
+			fields = append(fields, eventField{"act", "", "action", aws.ToString(f.Service.Action.ActionType)})
+		}
+		if f.Service.Count != nil {
+			fields = append(fields, eventField{"cnt", "", "count", strconv.Itoa(int(aws.ToInt32(f.Service.Count)))})
+		}
+	}
+	consoleURL := gd.ConsoleURL(aws.ToString(f.Partition), aws.ToString(f.Region), aws.ToString(f.Id))
+	return append(fields, eventField{"cs5", "consoleUrl", "consoleUrl", consoleURL})
+}
+
+// eventCategory is the threat purpose of a finding type, such as
+// UnauthorizedAccess for UnauthorizedAccess:EC2/SSHBruteForce
+func eventCategory(findingType string) string {
+	category, _, _ := strings.Cut(findingType, ":")
+	return category
+}
+
+// eventSeverity maps a GuardDuty severity to the 0 to 10 scale of CEF and
+// LEEF
+func eventSeverity(severity float64) int {
+	return int(min(max(math.Round(severity), 0), 10))
+}
+
+// eventMillis converts a GuardDuty timestamp to epoch milliseconds, or
+// returns "" if it is missing or malformed
+func eventMillis(s *string) string {
+	t, err := time.Parse(time.RFC3339, aws.ToString(s))
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+	leefHeaderEscaper   = strings.NewReplacer(`|`, `\|`, "\r", " ", "\n", " ", "\t", " ")
+	leefValueEscaper    = strings.NewReplacer("\r", " ", "\n", " ", "\t", " ")
+)
+
+// CEF formats a finding as an ArcSight Common Event Format event, with the
+// finding type as its signature ID and its title as its name. The account,
+// region, resource, and console link are custom string fields labeled with
+// their names.
+func CEF(f types.Finding) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+		eventVendor, eventProduct,
+		cefHeaderEscaper.Replace(aws.ToString(f.SchemaVersion)),
+		cefHeaderEscaper.Replace(aws.ToString(f.Type)),
+		cefHeaderEscaper.Replace(aws.ToString(f.Title)),
+		eventSeverity(aws.ToFloat64(f.Severity)))
+
+	fields := []eventField{{cef: "rt", value: eventMillis(f.UpdatedAt)}}
+	if f.Service != nil {
+		fields = append(fields,
+			eventField{cef: "start", value: eventMillis(f.Service.EventFirstSeen)},
+			eventField{cef: "end", value: eventMillis(f.Service.EventLastSeen)})
+	}
+	first := true
+	write := func(key, value string) {
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		b.WriteString(key + "=" + cefExtensionEscaper.Replace(value))
+	}
+	for _, field := range append(fields, eventFields(f)...) {
+		if field.value == "" {
+			continue
+		}
+		write(field.cef, field.value)
+		if field.label != "" {
+			write(field.cef+"Label", field.label)
+		}
+	}
+	return b.String()
+}
+
+// LEEF formats a finding as an IBM QRadar Log Event Extended Format 1.0
+// event, with the finding type as its event ID and tab-separated
+// attributes. LEEF has no escaping for attribute values, so their tabs and
+// line breaks become spaces.
+func LEEF(f types.Finding) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:1.0|%s|%s|%s|%s|",
+		eventVendor, eventProduct,
+		leefHeaderEscaper.Replace(aws.ToString(f.SchemaVersion)),
+		leefHeaderEscaper.Replace(aws.ToString(f.Type)))
+
+	var fields []eventField
+	if t, err := time.Parse(time.RFC3339, aws.ToString(f.UpdatedAt)); err == nil {
+		fields = append(fields,
+			eventField{leef: "devTime", value: t.Format(leefTimeLayout)},
+			eventField{leef: "devTimeFormat", value: leefTimeFormat})
+	}
+	// LEEF severities start at 1
+	fields = append(fields,
+		eventField{leef: "sev", value: strconv.Itoa(max(eventSeverity(aws.ToFloat64(f.Severity)), 1))},
+		eventField{leef: "title", value: aws.ToString(f.Title)})
+	first := true
+	for _, field := range append(fields, eventFields(f)...) {
+		if field.value == "" {
+			continue
+		}
+		if !first {
+			b.WriteByte('\t')
+		}
+		first = false
+		b.WriteString(field.leef + "=" + leefValueEscaper.Replace(field.value))
+	}
+	return b.String()
+}
+
+// eventWriter writes one CEF or LEEF event per line. Failed regions are
+// logged but not written, since they are not events of GuardDuty.
+type eventWriter struct {
+	bw     *bufio.Writer
+	format func(types.Finding) string
+}
+
+func newCEFWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	return &eventWriter{bw: bufio.NewWriter(out), format: CEF}
+}
+
+func newLEEFWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	return &eventWriter{bw: bufio.NewWriter(out), format: LEEF}
+}
+
+func (w *eventWriter) WriteHeader() error {
+	return nil
+}
+
+func (w *eventWriter) WriteFinding(finding types.Finding) error {
+	w.bw.WriteString(w.format(finding))
+	return w.bw.WriteByte('\n')
+}
+
+func (w *eventWriter) Close() error {
+	return w.bw.Flush()
+}
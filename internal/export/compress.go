@@ -0,0 +1,154 @@
+package export
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"guardduty/internal/gd"
+)
+
+// Export compression: gzip for a single compressed file, or zip for an
+// archive holding the export files
+const (
+	CompressGzip = "gzip"
+	CompressZip  = "zip"
+)
+
+// ValidCompression reports whether c names a compression, or is empty for none
+func ValidCompression(c string) bool {
+	return c == "" || c == CompressGzip || c == CompressZip
+}
+
+// CompressedName returns the name of the export file filename once compressed
+func CompressedName(filename, compression string) string {
+	switch compression {
+	case CompressGzip:
+		return filename + ".gz"
+	case CompressZip:
+		return filename + ".zip"
+	}
+	return filename
+}
+
+// ContentType returns the media type of an export file
+func ContentType(format, compression string) string {
+	switch compression {
+	case CompressGzip:
+		return "application/gzip"
+	case CompressZip:
+		return "application/zip"
+	}
+	return Formats[format].ContentType
+}
+
+// findingSizes are generous sizes of one finding in each format, as written
+// before compression. Formats missing from it, such as those registered,
+// are estimated as JSON.
+var findingSizes = map[string]int64{
+	"csv":      1 << 10,
+	"json":     6 << 10,
+	"ndjson":   6 << 10,
+	"xlsx":     1 << 10,
+	"ocsf":     6 << 10,
+	"asff":     4 << 10,
+	"parquet":  1 << 10,
+	"sqlite":   8 << 10,
+	"html":     3 << 10,
+	"pdf":      2 << 10,
+	"markdown": 1 << 10,
+	"cef":      2 << 10,
+	"leef":     2 << 10,
+	"template": 2 << 10,
+}
+
+// incompressibleFormats are already compressed, so gzip and zip leave them
+// about as large
+var incompressibleFormats = []string{"xlsx", "parquet", "pdf"}
+
+// EstimatedSize returns a rough size, erring high, of an export of findings
+// findings written and compressed as opts selects. Text formats are counted
+// as compressing to a tenth of their size.
+func EstimatedSize(opts WriteOptions, findings int) int64 {
+	size, ok := findingSizes[opts.Format]
+	if !ok {
+		size = findingSizes["json"]
+	}
+	switch {
+	case opts.Flatten:
+		// Every field is a column
+		size = findingSizes["json"]
+	case opts.Pretty:
+		size += size / 3
+	}
+	total := size * int64(findings)
+	if opts.Compression != "" && !slices.Contains(incompressibleFormats, opts.Format) {
+		total /= 10
+	}
+	return total
+}
+
+// Write writes the export to out compressed as opts selects, as its findings
+// are fetched. The gzip header and zip entry are named filename, the
+// uncompressed name, and the zip archive ends with a summary.json of the
+// export's summary; a split export is written as its own archive, whose
+// manifest holds the summary. When
+// a region fails and errors are not reported, Write stops there and returns
+// without an error; the caller checks stream.Failed.
+func Write(ctx context.Context, out io.Writer, opts WriteOptions, filename string, stream *gd.Stream) (int, error) {
+	switch opts.Compression {
+	case CompressGzip:
+		zw := gzip.NewWriter(out)
+		zw.Name = filename
+		zw.ModTime = time.Now()
+		totalFindings, err := writeExport(ctx, zw, opts, stream)
+		if err != nil {
+			return totalFindings, err
+		}
+		if err := zw.Close(); err != nil {
+			return totalFindings, fmt.Errorf("error compressing export: %v", err)
+		}
+		return totalFindings, nil
+	case CompressZip:
+		if opts.Split {
+			return writeSplitExport(ctx, out, opts, stream)
+		}
+		zw := zip.NewWriter(out)
+		entry, err := zw.CreateHeader(&zip.FileHeader{Name: filename, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return 0, fmt.Errorf("error creating archive: %v", err)
+		}
+		totalFindings, err := writeExport(ctx, entry, opts, stream)
+		if err != nil {
+			return totalFindings, err
+		}
+		if err := writeSummaryFile(zw, stream); err != nil {
+			return totalFindings, err
+		}
+		if err := zw.Close(); err != nil {
+			return totalFindings, fmt.Errorf("error compressing export: %v", err)
+		}
+		return totalFindings, nil
+	}
+	return writeExport(ctx, out, opts, stream)
+}
+
+// writeSummaryFile adds the summary of the export read from stream to an
+// archive as summary.json
+func writeSummaryFile(zw *zip.Writer, stream *gd.Stream) error {
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: "summary.json", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return fmt.Errorf("error creating archive: %v", err)
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(stream.Summary()); err != nil {
+		return fmt.Errorf("error writing summary: %v", err)
+	}
+	return nil
+}
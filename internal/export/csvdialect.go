@@ -0,0 +1,202 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	// The image has no zoneinfo for csvTimezone to load
+	_ "time/tzdata"
+)
+
+// The CSV delimiters, by the name the csvDelimiter option takes
+var csvDelimiters = map[string]rune{"comma": ',', "semicolon": ';', "tab": '\t'}
+
+// How CSV cells are quoted: only when they must be, every cell, or every
+// cell that isn't a number
+const (
+	CSVQuoteMinimal    = "minimal"
+	CSVQuoteAll        = "all"
+	CSVQuoteNonNumeric = "nonnumeric"
+)
+
+// How CSV exports write the CreatedAt and UpdatedAt columns: as GuardDuty
+// reports them, as RFC 3339, or as Unix seconds or milliseconds. Any other
+// format is a Go time layout, such as "2006-01-02 15:04:05".
+const (
+	CSVTimeRFC3339     = "rfc3339"
+	CSVTimeEpoch       = "epoch"
+	CSVTimeEpochMillis = "epochms"
+)
+
+// csvTimeColumns are the columns whose timestamps a dialect rewrites
+var csvTimeColumns = map[string]bool{"CreatedAt": true, "UpdatedAt": true}
+
+// CSVDialect adapts CSV exports to the tools that read them. The zero value
+// writes comma-separated, LF-terminated rows quoted only where needed, with
+// timestamps as GuardDuty reports them.
+type CSVDialect struct {
+	Delimiter rune
+	CRLF      bool
+	Quote     string
+	// TimeFormat and Location rewrite the CreatedAt and UpdatedAt columns;
+	// a Location without a TimeFormat writes RFC 3339 in that zone
+	TimeFormat string
+	Location   *time.Location
+}
+
+// ParseCSVDialect reads the csvDelimiter, csvLineEnding, csvQuote,
+// csvTimeFormat, and csvTimezone options
+func ParseCSVDialect(delimiter, lineEnding, quote, timeFormat, timezone string) (CSVDialect, error) {
+	var d CSVDialect
+	if delimiter != "" {
+		r, ok := csvDelimiters[delimiter]
+		if !ok {
+			return d, fmt.Errorf("Invalid csvDelimiter %q: must be comma, semicolon, or tab", delimiter)
+		}
+		d.Delimiter = r
+	}
+	switch lineEnding {
+	case "", "lf":
+	case "crlf":
+		d.CRLF = true
+	default:
+		return d, fmt.Errorf("Invalid csvLineEnding %q: must be lf or crlf", lineEnding)
+	}
+	switch quote {
+	case "", CSVQuoteMinimal:
+	case CSVQuoteAll, CSVQuoteNonNumeric:
+		d.Quote = quote
+	default:
+		return d, fmt.Errorf("Invalid csvQuote %q: must be %s, %s, or %s", quote, CSVQuoteMinimal, CSVQuoteAll, CSVQuoteNonNumeric)
+	}
+	switch {
+	case timeFormat == "", timeFormat == CSVTimeRFC3339, timeFormat == CSVTimeEpoch, timeFormat == CSVTimeEpochMillis:
+		d.TimeFormat = timeFormat
+	case time.Now().Format(timeFormat) == timeFormat:
+		// A layout without any of the reference time's elements
+		return d, fmt.Errorf("Invalid csvTimeFormat %q: must be %s, %s, %s, or a Go time layout", timeFormat, CSVTimeRFC3339, CSVTimeEpoch, CSVTimeEpochMillis)
+	default:
+		d.TimeFormat = timeFormat
+	}
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return d, fmt.Errorf("Invalid csvTimezone %q: must be a time zone such as UTC or Europe/Berlin", timezone)
+		}
+		d.Location = loc
+	}
+	return d, nil
+}
+
+// rewritesTimes reports whether the dialect changes the timestamp columns
+func (d CSVDialect) rewritesTimes() bool {
+	return d.TimeFormat != "" || d.Location != nil
+}
+
+// formatTime rewrites a timestamp cell. Cells that aren't RFC 3339, such as
+// the empty cells of error rows, are left as they are.
+func (d CSVDialect) formatTime(cell string) string {
+	t, err := time.Parse(time.RFC3339Nano, cell)
+	if err != nil {
+		return cell
+	}
+	if d.Location != nil {
+		t = t.In(d.Location)
+	}
+	switch d.TimeFormat {
+	case CSVTimeEpoch:
+		return strconv.FormatInt(t.Unix(), 10)
+	case CSVTimeEpochMillis:
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	case "", CSVTimeRFC3339:
+		return t.Format(time.RFC3339)
+	}
+	return t.Format(d.TimeFormat)
+}
+
+// csvRecordWriter is what the CSV writers write rows with: encoding/csv's
+// writer, or a quotingWriter when every cell or every text cell is quoted
+type csvRecordWriter interface {
+	Write(record []string) error
+	Flush()
+	Error() error
+}
+
+// newRecordWriter returns a record writer for the dialect
+func newRecordWriter(out io.Writer, d CSVDialect) csvRecordWriter {
+	delimiter := d.Delimiter
+	if delimiter == 0 {
+		delimiter = ','
+	}
+	if d.Quote == CSVQuoteAll || d.Quote == CSVQuoteNonNumeric {
+		return &quotingWriter{w: bufio.NewWriter(out), delimiter: delimiter, crlf: d.CRLF, nonNumeric: d.Quote == CSVQuoteNonNumeric}
+	}
+	w := csv.NewWriter(out)
+	w.Comma = delimiter
+	w.UseCRLF = d.CRLF
+	return w
+}
+
+// quotingWriter writes CSV records with every cell quoted, or with every
+// cell quoted except numbers, which encoding/csv can't do
+type quotingWriter struct {
+	w          *bufio.Writer
+	delimiter  rune
+	crlf       bool
+	nonNumeric bool
+	err        error
+}
+
+func (q *quotingWriter) Write(record []string) error {
+	if q.err != nil {
+		return q.err
+	}
+	for i, cell := range record {
+		if i > 0 {
+			q.w.WriteRune(q.delimiter)
+		}
+		if q.nonNumeric && cell != "" {
+			if _, err := strconv.ParseFloat(cell, 64); err == nil {
+				q.w.WriteString(cell)
+				continue
+			}
+		}
+		q.w.WriteByte('"')
+		for len(cell) > 0 {
+			r, size := utf8.DecodeRuneInString(cell)
+			cell = cell[size:]
+			switch {
+			case r == '"':
+				q.w.WriteString(`""`)
+			case r == '\n' && q.crlf:
+				q.w.WriteString("\r\n")
+			case r == '\r' && q.crlf:
+				// Dropped, as encoding/csv does, since \n becomes \r\n
+			default:
+				q.w.WriteRune(r)
+			}
+		}
+		q.w.WriteByte('"')
+	}
+	if q.crlf {
+		_, q.err = q.w.WriteString("\r\n")
+	} else {
+		q.err = q.w.WriteByte('\n')
+	}
+	return q.err
+}
+
+func (q *quotingWriter) Flush() {
+	if err := q.w.Flush(); err != nil && q.err == nil {
+		q.err = err
+	}
+}
+
+func (q *quotingWriter) Error() error {
+	return q.err
+}
@@ -0,0 +1,100 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// DigestFinding is a finding of a digest, with only what a chat message or
+// a ticket needs to point at it
+type DigestFinding struct {
+	ID            string  `json:"id"`
+	Severity      float64 `json:"severity"`
+	SeverityLabel string  `json:"severityLabel"`
+	Title         string  `json:"title"`
+	Type          string  `json:"type"`
+	AccountID     string  `json:"accountId"`
+	Region        string  `json:"region"`
+	Resource      string  `json:"resource,omitempty"`
+	Count         int32   `json:"count"`
+	UpdatedAt     string  `json:"updatedAt"`
+	ConsoleURL    string  `json:"consoleUrl"`
+}
+
+// NewDigestFindings returns the digest findings of findings, in their order
+func NewDigestFindings(findings []types.Finding) []DigestFinding {
+	digest := make([]DigestFinding, len(findings))
+	for i, f := range findings {
+		severity := aws.ToFloat64(f.Severity)
+		digest[i] = DigestFinding{
+			ID:            aws.ToString(f.Id),
+			Severity:      severity,
+			SeverityLabel: gd.SeverityLabel(severity),
+			Title:         aws.ToString(f.Title),
+			Type:          aws.ToString(f.Type),
+			AccountID:     aws.ToString(f.AccountId),
+			Region:        aws.ToString(f.Region),
+			Resource:      findingResource(f),
+			UpdatedAt:     aws.ToString(f.UpdatedAt),
+			ConsoleURL:    gd.ConsoleURL(aws.ToString(f.Partition), aws.ToString(f.Region), aws.ToString(f.Id)),
+		}
+		if f.Service != nil {
+			digest[i].Count = aws.ToInt32(f.Service.Count)
+		}
+	}
+	return digest
+}
+
+// WriteDigestMarkdown writes a digest as a numbered Markdown list rather
+// than a table, which chat clients such as Slack do not render: a line per
+// finding with its severity and its title linking to the console, and one
+// with its type, resource, account and region, and last update. Regions
+// that failed are listed after the findings.
+func WriteDigestMarkdown(out io.Writer, findings []DigestFinding, regions gd.RegionSummary) error {
+	bw := bufio.NewWriter(out)
+	searched := len(regions.Succeeded) + len(regions.Failed) + len(regions.Skipped) + len(regions.Truncated)
+	fmt.Fprintf(bw, "**GuardDuty digest**: %d most severe findings in %d accounts and regions", len(findings), searched)
+	if len(regions.Failed) > 0 {
+		fmt.Fprintf(bw, ", %d failed", len(regions.Failed))
+	}
+	bw.WriteString("\n\n")
+	if len(findings) == 0 {
+		bw.WriteString("No findings.\n")
+	}
+	for i, f := range findings {
+		title := markdownCell(f.Title)
+		if f.ConsoleURL != "" {
+			title = fmt.Sprintf("[%s](%s)", title, f.ConsoleURL)
+		}
+		fmt.Fprintf(bw, "%d. **%.1f %s** %s\n", i+1, f.Severity, f.SeverityLabel, title)
+		details := []string{"`" + strings.ReplaceAll(f.Type, "`", "'") + "`"}
+		if f.Resource != "" {
+			details = append(details, markdownCell(f.Resource))
+		}
+		details = append(details, markdownCell(summaryRegion(f.AccountID, f.Region)), "updated "+markdownCell(f.UpdatedAt))
+		fmt.Fprintf(bw, "   %s\n", strings.Join(details, " · "))
+	}
+	if len(regions.Failed) > 0 {
+		labels := make([]string, 0, len(regions.Failed))
+		for label := range regions.Failed {
+			labels = append(labels, label)
+		}
+		slices.Sort(labels)
+		bw.WriteString("\nFailed:\n")
+		for _, label := range labels {
+			fmt.Fprintf(bw, "- %s: %s\n", markdownCell(label), markdownCell(regions.Failed[label]))
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing digest: %v", err)
+	}
+	return nil
+}
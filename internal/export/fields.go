@@ -0,0 +1,813 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// findingField extracts the value of one export column from a finding
+type findingField func(finding types.Finding) string
+
+// findingFields is the registry of named export columns. Any other column
+// is a dotted path into types.Finding, such as Service.Action.ActionType.
+var findingFields = map[string]findingField{
+	"Region":      func(f types.Finding) string { return aws.ToString(f.Region) },
+	"AccountId":   func(f types.Finding) string { return aws.ToString(f.AccountId) },
+	"FindingId":   func(f types.Finding) string { return aws.ToString(f.Id) },
+	"Title":       func(f types.Finding) string { return aws.ToString(f.Title) },
+	"Description": func(f types.Finding) string { return aws.ToString(f.Description) },
+	"Severity": func(f types.Finding) string {
+		if f.Severity == nil {
+			return ""
+		}
+		return fmt.Sprintf("%.1f", *f.Severity)
+	},
+	// SeverityLabel is the console's Low, Medium, High, or Critical band
+	"SeverityLabel": func(f types.Finding) string {
+		if f.Severity == nil {
+			return ""
+		}
+		return gd.SeverityLabel(*f.Severity)
+	},
+	"CreatedAt":   func(f types.Finding) string { return aws.ToString(f.CreatedAt) },
+	"UpdatedAt":   func(f types.Finding) string { return aws.ToString(f.UpdatedAt) },
+	"FindingType": func(f types.Finding) string { return aws.ToString(f.Type) },
+	"ResourceType": func(f types.Finding) string {
+		if f.Resource == nil {
+			return ""
+		}
+		return aws.ToString(f.Resource.ResourceType)
+	},
+	"ResourceId": func(f types.Finding) string {
+		if f.Resource == nil {
+			return ""
+		}
+		return resourceID(f.Resource)
+	},
+	"ActorIp": func(f types.Finding) string {
+		ip := actorIP(f)
+		if ip == nil {
+			return ""
+		}
+		if v4 := aws.ToString(ip.IpAddressV4); v4 != "" {
+			return v4
+		}
+		return aws.ToString(ip.IpAddressV6)
+	},
+	"ActorCountry": func(f types.Finding) string {
+		if ip := actorIP(f); ip != nil && ip.Country != nil {
+			return aws.ToString(ip.Country.CountryName)
+		}
+		return ""
+	},
+	// ActorAsn and ActorOrg are the autonomous system of the remote address
+	// and the organization announcing it
+	"ActorAsn": func(f types.Finding) string {
+		if ip := actorIP(f); ip != nil && ip.Organization != nil {
+			return aws.ToString(ip.Organization.Asn)
+		}
+		return ""
+	},
+	"ActorOrg": func(f types.Finding) string {
+		if ip := actorIP(f); ip != nil && ip.Organization != nil {
+			if org := aws.ToString(ip.Organization.AsnOrg); org != "" {
+				return org
+			}
+			return aws.ToString(ip.Organization.Org)
+		}
+		return ""
+	},
+	"ActionType": func(f types.Finding) string {
+		if f.Service == nil || f.Service.Action == nil {
+			return ""
+		}
+		return aws.ToString(f.Service.Action.ActionType)
+	},
+	"Count": func(f types.Finding) string {
+		if f.Service == nil || f.Service.Count == nil {
+			return ""
+		}
+		return strconv.Itoa(int(*f.Service.Count))
+	},
+	"Archived": func(f types.Finding) string {
+		if f.Service == nil || f.Service.Archived == nil {
+			return ""
+		}
+		return strconv.FormatBool(*f.Service.Archived)
+	},
+	// DetectorId is the detector that generated the finding, which tells
+	// apart the findings of a region's past and present detectors
+	"DetectorId": func(f types.Finding) string {
+		if f.Service == nil {
+			return ""
+		}
+		return aws.ToString(f.Service.DetectorId)
+	},
+	// ConsoleURL opens the finding in the GuardDuty console
+	"ConsoleURL": func(f types.Finding) string {
+		return gd.ConsoleURL(aws.ToString(f.Partition), aws.ToString(f.Region), aws.ToString(f.Id))
+	},
+	// The states of the finding's resources are those of WriteOptions.States,
+	// and empty in exports that didn't look them up
+	"ResourceExists": func(types.Finding) string { return "" },
+	"ResourceState":  func(types.Finding) string { return "" },
+	// The parts of the finding type, ThreatPurpose:ThreatResource/ThreatFamily.DetectionMechanism!Artifact
+	"ThreatPurpose":      func(f types.Finding) string { return gd.ParseFindingType(aws.ToString(f.Type)).ThreatPurpose },
+	"ThreatResource":     func(f types.Finding) string { return gd.ParseFindingType(aws.ToString(f.Type)).ResourceType },
+	"ThreatFamily":       func(f types.Finding) string { return gd.ParseFindingType(aws.ToString(f.Type)).ThreatFamily },
+	"DetectionMechanism": func(f types.Finding) string { return gd.ParseFindingType(aws.ToString(f.Type)).DetectionMechanism },
+	"Artifact":           func(f types.Finding) string { return gd.ParseFindingType(aws.ToString(f.Type)).Artifact },
+	// The MITRE ATT&CK tactics and techniques the finding type maps to
+	"MitreTactics": func(f types.Finding) string { return strings.Join(gd.MitreAttack(aws.ToString(f.Type)).Tactics, "; ") },
+	"MitreTechniques": func(f types.Finding) string {
+		return strings.Join(gd.MitreAttack(aws.ToString(f.Type)).Techniques, "; ")
+	},
+	// The owner tags of the affected resource, current when the export
+	// looks up resourceTags
+	"Owner":       func(f types.Finding) string { return resourceTag(f.Resource, "Owner") },
+	"Team":        func(f types.Finding) string { return resourceTag(f.Resource, "Team") },
+	"Environment": func(f types.Finding) string { return resourceTag(f.Resource, "Environment") },
+	"CostCenter":  func(f types.Finding) string { return resourceTag(f.Resource, "CostCenter") },
+	// The process, container, and network details of Runtime Monitoring
+	// findings
+	"ProcessName": func(f types.Finding) string {
+		if p := runtimeProcess(f); p != nil {
+			return aws.ToString(p.Name)
+		}
+		return ""
+	},
+	"ProcessPath": func(f types.Finding) string {
+		if p := runtimeProcess(f); p != nil {
+			return aws.ToString(p.ExecutablePath)
+		}
+		return ""
+	},
+	"ProcessSha256": func(f types.Finding) string {
+		if p := runtimeProcess(f); p != nil {
+			return aws.ToString(p.ExecutableSha256)
+		}
+		return ""
+	},
+	"ProcessPid": func(f types.Finding) string {
+		if p := runtimeProcess(f); p != nil {
+			return formatInt32(p.Pid)
+		}
+		return ""
+	},
+	"ProcessUser": func(f types.Finding) string {
+		if p := runtimeProcess(f); p != nil {
+			return aws.ToString(p.User)
+		}
+		return ""
+	},
+	"ProcessCommandLine": func(f types.Finding) string {
+		if c := runtimeContext(f); c != nil {
+			return aws.ToString(c.CommandLineExample)
+		}
+		return ""
+	},
+	"ParentProcessName": func(f types.Finding) string {
+		if p := parentProcess(f); p != nil {
+			return aws.ToString(p.Name)
+		}
+		return ""
+	},
+	"ParentProcessPath": func(f types.Finding) string {
+		if p := parentProcess(f); p != nil {
+			return aws.ToString(p.ExecutablePath)
+		}
+		return ""
+	},
+	"ParentProcessPid": func(f types.Finding) string {
+		if p := parentProcess(f); p != nil {
+			return formatInt32(p.Pid)
+		}
+		return ""
+	},
+	"ProcessLineage": processLineage,
+	"ContainerId": func(f types.Finding) string {
+		return containerField(f, func(c types.Container) *string { return c.Id })
+	},
+	"ContainerName": func(f types.Finding) string {
+		return containerField(f, func(c types.Container) *string { return c.Name })
+	},
+	"ContainerImage": func(f types.Finding) string {
+		return containerField(f, func(c types.Container) *string { return c.Image })
+	},
+	"WorkloadName": func(f types.Finding) string {
+		if w := workload(f); w != nil {
+			return aws.ToString(w.Name)
+		}
+		return ""
+	},
+	"WorkloadType": func(f types.Finding) string {
+		if w := workload(f); w != nil {
+			return aws.ToString(w.Type)
+		}
+		return ""
+	},
+	"WorkloadNamespace": func(f types.Finding) string {
+		if w := workload(f); w != nil {
+			return aws.ToString(w.Namespace)
+		}
+		return ""
+	},
+	"WorkloadUid": func(f types.Finding) string {
+		if w := workload(f); w != nil {
+			return aws.ToString(w.Uid)
+		}
+		return ""
+	},
+	"ConnectionDirection": func(f types.Finding) string {
+		if c := networkConnection(f); c != nil {
+			return aws.ToString(c.ConnectionDirection)
+		}
+		return ""
+	},
+	"Protocol": func(f types.Finding) string {
+		if c := networkConnection(f); c != nil {
+			return aws.ToString(c.Protocol)
+		}
+		return ""
+	},
+	"LocalIp": func(f types.Finding) string {
+		c := networkConnection(f)
+		if c == nil || c.LocalIpDetails == nil {
+			return ""
+		}
+		if v4 := aws.ToString(c.LocalIpDetails.IpAddressV4); v4 != "" {
+			return v4
+		}
+		return aws.ToString(c.LocalIpDetails.IpAddressV6)
+	},
+	"LocalPort": func(f types.Finding) string {
+		if c := networkConnection(f); c != nil && c.LocalPortDetails != nil {
+			return formatInt32(c.LocalPortDetails.Port)
+		}
+		return ""
+	},
+	"RemotePort": func(f types.Finding) string {
+		if c := networkConnection(f); c != nil && c.RemotePortDetails != nil {
+			return formatInt32(c.RemotePortDetails.Port)
+		}
+		return ""
+	},
+	// The bucket, API call, and access key details of S3 and IAM findings
+	"BucketName": func(f types.Finding) string {
+		return bucketField(f, func(b types.S3BucketDetail) string { return aws.ToString(b.Name) })
+	},
+	// BucketPublicAccess is PUBLIC or NOT_PUBLIC, as GuardDuty evaluated it
+	"BucketPublicAccess": func(f types.Finding) string {
+		return bucketField(f, func(b types.S3BucketDetail) string {
+			if b.PublicAccess == nil {
+				return ""
+			}
+			return aws.ToString(b.PublicAccess.EffectivePermission)
+		})
+	},
+	"BucketPublicGrants": func(f types.Finding) string { return bucketField(f, publicGrants) },
+	"BlockPublicAccess":  func(f types.Finding) string { return bucketField(f, blockPublicAccess) },
+	"ApiCallName": func(f types.Finding) string {
+		if a := apiCall(f); a != nil {
+			return aws.ToString(a.Api)
+		}
+		return ""
+	},
+	"ApiServiceName": func(f types.Finding) string {
+		if a := apiCall(f); a != nil {
+			return aws.ToString(a.ServiceName)
+		}
+		return ""
+	},
+	"CallerType": func(f types.Finding) string {
+		if a := apiCall(f); a != nil {
+			return aws.ToString(a.CallerType)
+		}
+		return ""
+	},
+	"ApiErrorCode": func(f types.Finding) string {
+		if a := apiCall(f); a != nil {
+			return aws.ToString(a.ErrorCode)
+		}
+		return ""
+	},
+	"AccessKeyId": func(f types.Finding) string {
+		if k := accessKey(f); k != nil {
+			return aws.ToString(k.AccessKeyId)
+		}
+		return ""
+	},
+	"PrincipalId": func(f types.Finding) string {
+		if k := accessKey(f); k != nil {
+			return aws.ToString(k.PrincipalId)
+		}
+		return ""
+	},
+	"UserName": func(f types.Finding) string {
+		if k := accessKey(f); k != nil {
+			return aws.ToString(k.UserName)
+		}
+		return ""
+	},
+	"UserType": func(f types.Finding) string {
+		if k := accessKey(f); k != nil {
+			return aws.ToString(k.UserType)
+		}
+		return ""
+	},
+	// The cluster, user, and API request of EKS findings, whose workload
+	// and containers are in the Workload and Container columns
+	"ClusterName": func(f types.Finding) string { return aws.ToString(clusterName(f)) },
+	// KubernetesNamespace is the namespace of the API request, or else of
+	// the workload
+	"KubernetesNamespace": func(f types.Finding) string {
+		if a := kubernetesAPICall(f); a != nil && aws.ToString(a.Namespace) != "" {
+			return aws.ToString(a.Namespace)
+		}
+		if w := workload(f); w != nil {
+			return aws.ToString(w.Namespace)
+		}
+		return ""
+	},
+	"ServiceAccountName": func(f types.Finding) string {
+		if w := workload(f); w != nil {
+			return aws.ToString(w.ServiceAccountName)
+		}
+		return ""
+	},
+	"KubernetesUser": func(f types.Finding) string {
+		if u := kubernetesUser(f); u != nil {
+			return aws.ToString(u.Username)
+		}
+		return ""
+	},
+	"KubernetesGroups": func(f types.Finding) string {
+		if u := kubernetesUser(f); u != nil {
+			return strings.Join(u.Groups, "; ")
+		}
+		return ""
+	},
+	"ImpersonatedUser": func(f types.Finding) string {
+		if u := kubernetesUser(f); u != nil && u.ImpersonatedUser != nil {
+			return aws.ToString(u.ImpersonatedUser.Username)
+		}
+		return ""
+	},
+	"KubernetesVerb": func(f types.Finding) string {
+		if a := kubernetesAPICall(f); a != nil {
+			return aws.ToString(a.Verb)
+		}
+		return ""
+	},
+	// KubernetesResource is the resource type requested, with its
+	// subresource, such as pods/exec
+	"KubernetesResource": func(f types.Finding) string {
+		a := kubernetesAPICall(f)
+		if a == nil {
+			return ""
+		}
+		if sub := aws.ToString(a.Subresource); sub != "" {
+			return aws.ToString(a.Resource) + "/" + sub
+		}
+		return aws.ToString(a.Resource)
+	},
+	"KubernetesResourceName": func(f types.Finding) string {
+		if a := kubernetesAPICall(f); a != nil {
+			return aws.ToString(a.ResourceName)
+		}
+		return ""
+	},
+	"KubernetesRequestUri": func(f types.Finding) string {
+		if a := kubernetesAPICall(f); a != nil {
+			return aws.ToString(a.RequestUri)
+		}
+		return ""
+	},
+	"KubernetesStatusCode": func(f types.Finding) string {
+		if a := kubernetesAPICall(f); a != nil {
+			return formatInt32(a.StatusCode)
+		}
+		return ""
+	},
+}
+
+// RegisterColumn adds a named export column computed from each finding, or
+// replaces the one of the same name, such as from what a gd.Enricher
+// learned about the finding. It must be called before any export starts.
+func RegisterColumn(name string, field func(finding types.Finding) string) {
+	findingFields[name] = field
+}
+
+// Column returns the field of a named export column, such as to keep
+// computing it from a column registered in its place
+func Column(name string) (func(finding types.Finding) string, bool) {
+	field, ok := findingFields[name]
+	return field, ok
+}
+
+// DefaultColumns is the default header of the tabular exports. Columns after
+// UpdatedAt were added later and are kept at the end so existing consumers
+// of the first eight columns are not affected.
+var DefaultColumns = []string{
+	"Region", "AccountId", "FindingId", "Title", "Description", "Severity", "CreatedAt", "UpdatedAt",
+	"FindingType", "ResourceType", "ResourceId", "ActorIp", "ActorCountry", "ActionType", "Count", "Archived",
+	"SeverityLabel", "ConsoleURL",
+}
+
+// requiredFields are the fields GuardDuty sets on every finding. A finding
+// missing one is still exported, with an empty cell, and the gap is logged.
+var requiredFields = []string{
+	"Region", "AccountId", "FindingId", "Title", "Description", "Severity", "CreatedAt", "UpdatedAt", "FindingType",
+}
+
+// missingFields counts the required fields missing from the findings of a
+// region, so the gaps are logged once per region instead of once per cell
+type missingFields struct {
+	byField  map[string]int
+	findings int
+}
+
+// check records the required fields finding lacks
+func (m *missingFields) check(ctx context.Context, finding types.Finding) {
+	var missing []string
+	for _, name := range requiredFields {
+		if findingFields[name](finding) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	telemetry.Logger(ctx).Debug("Finding is missing fields", "finding_id", aws.ToString(finding.Id), "fields", strings.Join(missing, ","))
+	if m.byField == nil {
+		m.byField = make(map[string]int)
+	}
+	for _, name := range missing {
+		m.byField[name]++
+	}
+	m.findings++
+}
+
+// log reports the fields missing from the region's findings, if any
+func (m *missingFields) log(ctx context.Context, region *gd.RegionStream) {
+	if m.findings == 0 {
+		return
+	}
+	var fields []string
+	for _, name := range requiredFields {
+		if n := m.byField[name]; n > 0 {
+			fields = append(fields, fmt.Sprintf("%s=%d", name, n))
+		}
+	}
+	telemetry.Logger(ctx).Warn("Findings were missing fields", "region", gd.TargetLabel(region.Account, region.Region), "findings", m.findings, "fields", strings.Join(fields, ","))
+}
+
+// Fields are named export columns of an export's own, such as those a
+// server computes from its config, besides the registered ones. A field
+// takes the place of the registered column of the same name.
+type Fields map[string]func(finding types.Finding) string
+
+// FieldNames returns the registered column names in sorted order
+func FieldNames() []string {
+	return Fields(nil).Names()
+}
+
+// Names returns the names of the fields and the registered columns in
+// sorted order
+func (f Fields) Names() []string {
+	names := make([]string, 0, len(findingFields)+len(f))
+	for name := range findingFields {
+		names = append(names, name)
+	}
+	for name := range f {
+		if _, ok := findingFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseColumns reads the columns query parameter, which may be repeated or
+// comma-separated, falling back to defaults when it is absent
+func ParseColumns(query url.Values, defaults []string) ([]string, error) {
+	return Fields(nil).ParseColumns(query, defaults)
+}
+
+// ParseColumns reads the columns query parameter like the package's
+// ParseColumns, accepting the fields as columns too
+func (f Fields) ParseColumns(query url.Values, defaults []string) ([]string, error) {
+	columns := gd.SplitList(query["columns"])
+	if len(columns) == 0 {
+		return defaults, nil
+	}
+	for _, column := range columns {
+		if err := f.ValidColumn(column); err != nil {
+			return nil, fmt.Errorf("Invalid column %q: %v", column, err)
+		}
+	}
+	return columns, nil
+}
+
+// ValidColumn reports why column is neither a registered field nor a path
+// to a field of types.Finding
+func ValidColumn(column string) error {
+	return Fields(nil).ValidColumn(column)
+}
+
+// ValidColumn reports why column is neither one of the fields, a
+// registered field, nor a path to a field of types.Finding
+func (f Fields) ValidColumn(column string) error {
+	if _, ok := f[column]; ok {
+		return nil
+	}
+	if _, ok := findingFields[column]; ok {
+		return nil
+	}
+	if !strings.Contains(column, ".") {
+		return fmt.Errorf("unknown column; use one of %s or a dotted path such as Service.Action.ActionType", strings.Join(f.Names(), ", "))
+	}
+
+	t := reflect.TypeOf(types.Finding{})
+	for _, name := range strings.Split(column, ".") {
+		for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+			if t.Kind() == reflect.Slice {
+				if _, err := strconv.Atoi(name); err == nil {
+					break
+				}
+			}
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Slice:
+			// A numeric segment selects one element of the slice
+			t = t.Elem()
+		case reflect.Map:
+			t = t.Elem()
+		case reflect.Struct:
+			field, ok := t.FieldByNameFunc(func(field string) bool { return strings.EqualFold(field, name) })
+			if !ok || !field.IsExported() {
+				return fmt.Errorf("%s has no field %s", t.Name(), name)
+			}
+			t = field.Type
+		default:
+			return fmt.Errorf("%s has no field %s", t.Kind(), name)
+		}
+	}
+	return nil
+}
+
+// columnValuer computes the value of a column for a finding, as an export's
+// WriteOptions.ColumnValue does
+type columnValuer func(finding types.Finding, column string) string
+
+// stateColumns compute the resource state columns from the states an export
+// looked up
+var stateColumns = map[string]func(*gd.StateCache, types.Finding) string{
+	"ResourceExists": (*gd.StateCache).Exists,
+	"ResourceState":  (*gd.StateCache).State,
+}
+
+// ColumnValue returns the value of column for a finding in the export of
+// opts: that of its own fields, or of the resource states it looked up for
+// the resource state columns
+func (o WriteOptions) ColumnValue(finding types.Finding, column string) string {
+	if field, ok := o.Fields[column]; ok {
+		return field(finding)
+	}
+	if field, ok := stateColumns[column]; ok && o.States != nil {
+		return field(o.States, finding)
+	}
+	return ColumnValue(finding, column)
+}
+
+// ColumnValue returns the value of column for a finding
+func ColumnValue(finding types.Finding, column string) string {
+	if field, ok := findingFields[column]; ok {
+		return field(finding)
+	}
+	return pathValue(reflect.ValueOf(finding), strings.Split(column, "."))
+}
+
+// FindingRows returns the header and rows that a CSV export with opts
+// writes for the findings of results, such as to preview them: the
+// export's columns, or every field present when it is flattened, under its
+// headers
+func FindingRows(results []gd.RegionResult, opts WriteOptions) ([]string, [][]string) {
+	if opts.Flatten {
+		opts.Columns = flattenedColumns(results)
+	}
+	rows := [][]string{}
+	for _, result := range results {
+		for _, finding := range result.Findings {
+			rows = append(rows, findingRow(finding, opts.Columns, opts.ColumnValue))
+		}
+	}
+	return opts.header(), rows
+}
+
+// findingRow returns the values of columns for a finding, as value of the
+// export computes them
+func findingRow(finding types.Finding, columns []string, value columnValuer) []string {
+	row := make([]string, len(columns))
+	for i, column := range columns {
+		row[i] = value(finding, column)
+	}
+	return row
+}
+
+// pathValue follows a dotted path through v. Field names match without
+// regard to case, numeric segments index slices, and a slice reached without
+// an index yields the values of all its elements joined with "; ".
+func pathValue(v reflect.Value, path []string) string {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if len(path) == 0 {
+		return formatValue(v)
+	}
+
+	name := path[0]
+	switch v.Kind() {
+	case reflect.Struct:
+		field, ok := v.Type().FieldByNameFunc(func(field string) bool { return strings.EqualFold(field, name) })
+		if !ok || !field.IsExported() {
+			return ""
+		}
+		return pathValue(v.FieldByIndex(field.Index), path[1:])
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return ""
+		}
+		value := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+		if !value.IsValid() {
+			return ""
+		}
+		return pathValue(value, path[1:])
+	case reflect.Slice:
+		if i, err := strconv.Atoi(name); err == nil {
+			if i < 0 || i >= v.Len() {
+				return ""
+			}
+			return pathValue(v.Index(i), path[1:])
+		}
+		var values []string
+		for i := 0; i < v.Len(); i++ {
+			if value := pathValue(v.Index(i), path); value != "" {
+				values = append(values, value)
+			}
+		}
+		return strings.Join(values, "; ")
+	}
+	return ""
+}
+
+// formatValue renders the value at the end of a path; structures are
+// written as JSON
+func formatValue(v reflect.Value) string {
+	if !v.CanInterface() {
+		return ""
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.UTC().Format(time.RFC3339)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	case reflect.Slice, reflect.Map:
+		if v.Len() == 0 {
+			return ""
+		}
+	}
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// resourceID returns the identifier of the affected resource for its type:
+// an instance ID, access key ID, bucket names, cluster or function name
+func resourceID(r *types.Resource) string {
+	switch aws.ToString(r.ResourceType) {
+	case "Instance":
+		if r.InstanceDetails != nil {
+			return aws.ToString(r.InstanceDetails.InstanceId)
+		}
+	case "AccessKey":
+		if r.AccessKeyDetails != nil {
+			return aws.ToString(r.AccessKeyDetails.AccessKeyId)
+		}
+	case "S3Bucket":
+		var names []string
+		for _, bucket := range r.S3BucketDetails {
+			names = append(names, aws.ToString(bucket.Name))
+		}
+		return strings.Join(names, ", ")
+	case "EKSCluster":
+		if r.EksClusterDetails != nil {
+			return aws.ToString(r.EksClusterDetails.Name)
+		}
+	case "ECSCluster":
+		if r.EcsClusterDetails != nil {
+			return aws.ToString(r.EcsClusterDetails.Name)
+		}
+	case "Container":
+		if r.ContainerDetails != nil {
+			return aws.ToString(r.ContainerDetails.Id)
+		}
+	case "Lambda":
+		if r.LambdaDetails != nil {
+			return aws.ToString(r.LambdaDetails.FunctionName)
+		}
+	case "RDSDBInstance":
+		if r.RdsDbInstanceDetails != nil {
+			return aws.ToString(r.RdsDbInstanceDetails.DbInstanceIdentifier)
+		}
+	}
+	return ""
+}
+
+// resourceTag returns the value of the affected resource's tag key, matched
+// without regard to case, or the distinct values of the buckets of an S3
+// finding joined with "; "
+func resourceTag(r *types.Resource, key string) string {
+	if r == nil {
+		return ""
+	}
+	var tags [][]types.Tag
+	switch {
+	case r.InstanceDetails != nil:
+		tags = append(tags, r.InstanceDetails.Tags)
+	case r.EksClusterDetails != nil:
+		tags = append(tags, r.EksClusterDetails.Tags)
+	case r.EcsClusterDetails != nil:
+		tags = append(tags, r.EcsClusterDetails.Tags)
+	case r.LambdaDetails != nil:
+		tags = append(tags, r.LambdaDetails.Tags)
+	case r.RdsDbInstanceDetails != nil:
+		tags = append(tags, r.RdsDbInstanceDetails.Tags)
+	}
+	for _, bucket := range r.S3BucketDetails {
+		tags = append(tags, bucket.Tags)
+	}
+	var values []string
+	for _, resourceTags := range tags {
+		for _, tag := range resourceTags {
+			if value := aws.ToString(tag.Value); strings.EqualFold(aws.ToString(tag.Key), key) && !slices.Contains(values, value) {
+				values = append(values, value)
+				break
+			}
+		}
+	}
+	return strings.Join(values, "; ")
+}
+
+// actorIP returns the remote address involved in a finding's action, if the
+// action type records one
+func actorIP(f types.Finding) *types.RemoteIpDetails {
+	if f.Service == nil || f.Service.Action == nil {
+		return nil
+	}
+	action := f.Service.Action
+	switch {
+	case action.AwsApiCallAction != nil:
+		return action.AwsApiCallAction.RemoteIpDetails
+	case action.NetworkConnectionAction != nil:
+		return action.NetworkConnectionAction.RemoteIpDetails
+	case action.KubernetesApiCallAction != nil:
+		return action.KubernetesApiCallAction.RemoteIpDetails
+	case action.RdsLoginAttemptAction != nil:
+		return action.RdsLoginAttemptAction.RemoteIpDetails
+	case action.PortProbeAction != nil:
+		for _, probe := range action.PortProbeAction.PortProbeDetails {
+			if probe.RemoteIpDetails != nil {
+				return probe.RemoteIpDetails
+			}
+		}
+	}
+	return nil
+}
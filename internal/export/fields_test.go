@@ -0,0 +1,52 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+func TestWriteFields(t *testing.T) {
+	fake := gd.NewFake("123456789012")
+	fake.AddFindings(types.Finding{Id: aws.String("finding-1"), Region: aws.String("us-east-1"), Type: aws.String("Recon:EC2/PortProbeUnprotectedPort"), Severity: aws.Float64(5)})
+	opts := gd.FetchOptions{
+		Regions:     []string{"us-east-1"},
+		AWSConfig:   aws.Config{Region: "us-east-1"},
+		Clients:     fake,
+		Concurrency: 1,
+		BatchSize:   gd.MaxGetFindingsBatch,
+	}
+	fields := Fields{
+		"Ticket":      func(f types.Finding) string { return "SEC-" + aws.ToString(f.Id) },
+		"Environment": func(types.Finding) string { return "prod" },
+	}
+	columns, err := fields.ParseColumns(url.Values{"columns": {"FindingId,Ticket,Environment"}}, DefaultColumns)
+	if err != nil {
+		t.Fatalf("error parsing the fields as columns: %v", err)
+	}
+
+	stream := gd.StreamRegions(context.Background(), opts, nil)
+	defer stream.Close()
+	var out bytes.Buffer
+	if _, err := Write(context.Background(), &out, WriteOptions{Format: "csv", Columns: columns, Fields: fields}, "export.csv", stream); err != nil {
+		t.Fatalf("error writing export: %v", err)
+	}
+	want := "FindingId,Ticket,Environment\nfinding-1,SEC-finding-1,prod\n"
+	if got := out.String(); got != want {
+		t.Errorf("got export\n%s\nwant\n%s", got, want)
+	}
+
+	// The fields are the export's own, not registered columns
+	if err := ValidColumn("Ticket"); err == nil {
+		t.Errorf("an export's field is valid as a column of every export")
+	}
+	if got := ColumnValue(types.Finding{}, "Environment"); got != "" {
+		t.Errorf("got Environment %q outside the export, want the resource tag's empty value", got)
+	}
+}
@@ -0,0 +1,95 @@
+package export
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// flattenedColumns returns the dotted path of every value present in any of
+// the results' findings, so a flattened export drops nothing. Paths use the
+// field names of the finding's JSON form, with list elements numbered.
+func flattenedColumns(results []gd.RegionResult) []string {
+	seen := make(map[string]bool)
+	add := func(finding types.Finding) {
+		for _, path := range findingPaths(finding) {
+			seen[path] = true
+		}
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			add(errorFinding(result))
+		}
+		for _, finding := range result.Findings {
+			add(finding)
+		}
+	}
+
+	columns := make([]string, 0, len(seen))
+	for path := range seen {
+		columns = append(columns, path)
+	}
+	sort.Slice(columns, func(i, j int) bool { return lessPath(columns[i], columns[j]) })
+	return columns
+}
+
+// findingPaths returns the dotted paths of the values set in a finding
+func findingPaths(finding types.Finding) []string {
+	data, err := json.Marshal(finding)
+	if err != nil {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil
+	}
+	var paths []string
+	collectPaths("", v, &paths)
+	return paths
+}
+
+// collectPaths appends the path of each scalar value beneath v
+func collectPaths(prefix string, v any, paths *[]string) {
+	join := func(name string) string {
+		if prefix == "" {
+			return name
+		}
+		return prefix + "." + name
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for name, child := range v {
+			collectPaths(join(name), child, paths)
+		}
+	case []any:
+		for i, child := range v {
+			collectPaths(join(strconv.Itoa(i)), child, paths)
+		}
+	case nil:
+	default:
+		*paths = append(*paths, prefix)
+	}
+}
+
+// lessPath orders dotted paths segment by segment, comparing list indexes
+// numerically so element 10 follows element 9
+func lessPath(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		ai, aErr := strconv.Atoi(as[i])
+		bi, bErr := strconv.Atoi(bs[i])
+		if aErr == nil && bErr == nil {
+			return ai < bi
+		}
+		return as[i] < bs[i]
+	}
+	return len(as) < len(bs)
+}
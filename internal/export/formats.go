@@ -0,0 +1,412 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// FindingWriter writes the findings of an export in one format. The export
+// loop calls WriteHeader once, WriteFinding for each finding in account and
+// region order as it is fetched, and Close to complete the output. Writers
+// should write or spool each finding rather than keep it, so an export's
+// memory doesn't grow with its findings. Close is also called after a write
+// fails, so the writer can release what it holds.
+type FindingWriter interface {
+	WriteHeader() error
+	WriteFinding(finding types.Finding) error
+	Close() error
+}
+
+// RegionWriter is implemented by FindingWriters that record the outcome of
+// each account and region. WriteRegion is called after a region's findings,
+// or alone for a region that failed or was skipped; writers without it leave
+// failed regions out of the export.
+type RegionWriter interface {
+	WriteRegion(result gd.RegionResult) error
+}
+
+// FormatInfo describes how an export format is served, named, and written.
+// NewWriter returns the format's writer to out; opts.Columns already holds
+// the columns of a flattened export.
+type FormatInfo struct {
+	ContentType string
+	Extension   string
+	NewWriter   func(out io.Writer, opts WriteOptions) FindingWriter
+}
+
+// Formats lists the export formats accepted by the format setting
+var Formats = map[string]FormatInfo{
+	"csv":      {ContentType: "text/csv", Extension: "csv", NewWriter: newCSVWriter},
+	"json":     {ContentType: "application/json", Extension: "json", NewWriter: newJSONWriter},
+	"ndjson":   {ContentType: "application/x-ndjson", Extension: "ndjson", NewWriter: newNDJSONWriter},
+	"xlsx":     {ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Extension: "xlsx", NewWriter: newXLSXWriter},
+	"ocsf":     {ContentType: "application/x-ndjson", Extension: "ocsf.ndjson", NewWriter: newOCSFWriter},
+	"asff":     {ContentType: "application/json", Extension: "asff.json", NewWriter: newASFFWriter},
+	"parquet":  {ContentType: "application/vnd.apache.parquet", Extension: "parquet", NewWriter: newParquetWriter},
+	"sqlite":   {ContentType: "application/vnd.sqlite3", Extension: "sqlite", NewWriter: newSQLiteWriter},
+	"html":     {ContentType: "text/html", Extension: "html", NewWriter: newHTMLWriter},
+	"pdf":      {ContentType: "application/pdf", Extension: "pdf", NewWriter: newPDFWriter},
+	"markdown": {ContentType: "text/markdown", Extension: "md", NewWriter: newMarkdownWriter},
+	"cef":      {ContentType: "text/plain", Extension: "cef", NewWriter: newCEFWriter},
+	"leef":     {ContentType: "text/plain", Extension: "leef", NewWriter: newLEEFWriter},
+	"template": {ContentType: "text/plain", Extension: "txt", NewWriter: newTemplateWriter},
+}
+
+// RegisterFormat adds an export format, or replaces the one of the same
+// name. It must be called before any export starts, such as from an init
+// function.
+func RegisterFormat(name string, format FormatInfo) {
+	Formats[name] = format
+}
+
+// WriteOptions selects how an export's findings are written
+type WriteOptions struct {
+	Format      string
+	Pretty      bool
+	Columns     []string
+	Flatten     bool
+	ProductARN  string
+	Compression string
+	Split       bool
+	// Sanitize escapes CSV cells that spreadsheets would evaluate as
+	// formulas and normalizes their line breaks, and BOM starts CSV files
+	// with a UTF-8 byte order mark so Excel detects the encoding
+	Sanitize bool
+	BOM      bool
+	// CSV is the delimiter, line ending, quoting, and timestamp format of
+	// CSV exports
+	CSV CSVDialect
+	// TopFindings is the number of most severe findings that Markdown
+	// reports list, 20 when zero, and GroupBy groups them by type or
+	// affected resource
+	TopFindings int
+	GroupBy     string
+	// Template writes the findings of the template format
+	Template *Template
+	// Headers, when set, name the columns in the header of CSV, XLSX, and
+	// HTML exports in place of the column names, one per column
+	Headers []string
+	// Locale is the language and date layout of the headings, labels, and
+	// statuses of HTML, PDF, and Markdown reports, DefaultLocale when empty
+	Locale string
+	// States, when set, holds the resource states the export looked up,
+	// which fill its ResourceExists and ResourceState columns
+	States *gd.StateCache
+	// Fields are the export's own named columns
+	Fields Fields
+}
+
+// header returns the header cells of the columns
+func (o WriteOptions) header() []string {
+	if len(o.Headers) == len(o.Columns) {
+		return o.Headers
+	}
+	return o.Columns
+}
+
+// ValidFormat reports whether format names a supported export format
+func ValidFormat(format string) bool {
+	_, ok := Formats[format]
+	return ok
+}
+
+// Filename returns the download name of an export started at t
+func Filename(t time.Time, format string) string {
+	return fmt.Sprintf("guardduty_findings_%s.%s", t.Format("20060102_150405"), Formats[format].Extension)
+}
+
+// writeExport writes the stream in the format selected by opts and returns
+// the number of findings written. A flattened export needs the columns of
+// every finding before its header, so its findings are collected first.
+func writeExport(ctx context.Context, out io.Writer, opts WriteOptions, stream *gd.Stream) (int, error) {
+	if opts.Flatten {
+		results := stream.Collect()
+		opts.Columns = flattenedColumns(results)
+		stream = gd.StreamResults(results)
+		defer stream.Close()
+	}
+	w := Formats[opts.Format].NewWriter(out, opts)
+	totalFindings, err := writeFindings(ctx, w, stream)
+	if err != nil {
+		w.Close()
+		return totalFindings, err
+	}
+	return totalFindings, w.Close()
+}
+
+// WriteFindings writes the stream to a writer of the caller's own, such as
+// one that sends findings to a service rather than to a file, closes it,
+// and returns the number of findings written
+func WriteFindings(ctx context.Context, w FindingWriter, stream *gd.Stream) (int, error) {
+	totalFindings, err := writeFindings(ctx, w, stream)
+	if err != nil {
+		w.Close()
+		return totalFindings, err
+	}
+	return totalFindings, w.Close()
+}
+
+// writeFindings passes each region of the stream to w, up to but not
+// including Close
+func writeFindings(ctx context.Context, w FindingWriter, stream *gd.Stream) (int, error) {
+	if err := w.WriteHeader(); err != nil {
+		return 0, err
+	}
+	totalFindings := 0
+	for region, ok := stream.Next(); ok; region, ok = stream.Next() {
+		n, err := writeRegion(ctx, w, region)
+		totalFindings += n
+		if err != nil {
+			return totalFindings, err
+		}
+	}
+	return totalFindings, nil
+}
+
+// writeRegion passes a region's findings to w as they arrive, then its
+// outcome if w is a RegionWriter. A region that fails part way keeps the
+// findings fetched before the error. Required fields missing from the
+// region's findings are logged once the region is written.
+func writeRegion(ctx context.Context, w FindingWriter, region *gd.RegionStream) (int, error) {
+	var missing missingFields
+	defer missing.log(ctx, region)
+
+	n := 0
+	for finding := range region.Findings {
+		missing.check(ctx, finding)
+		written, err := writeFinding(ctx, w, finding)
+		if err != nil {
+			return n, err
+		}
+		if written {
+			n++
+		}
+	}
+	if regions, ok := w.(RegionWriter); ok {
+		return n, regions.WriteRegion(region.Result())
+	}
+	return n, nil
+}
+
+// writeFinding passes one finding to w. A finding that makes the writer
+// panic, such as one missing a field the writer relies on, is logged and
+// left out rather than ending the export.
+func writeFinding(ctx context.Context, w FindingWriter, finding types.Finding) (written bool, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			telemetry.Logger(ctx).Error("Skipping finding that could not be written", "finding_id", aws.ToString(finding.Id), "error", fmt.Sprint(p))
+			written, err = false, nil
+		}
+	}()
+	if err := w.WriteFinding(finding); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// csvWriter writes the header and one row per finding with the export's
+// columns. Regions that failed are written as error rows.
+type csvWriter struct {
+	out      io.Writer
+	writer   csvRecordWriter
+	columns  []string
+	value    columnValuer
+	header   []string
+	sanitize bool
+	bom      bool
+	dialect  CSVDialect
+}
+
+func newCSVWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	return &csvWriter{out: out, writer: newRecordWriter(out, opts.CSV), columns: opts.Columns, value: opts.ColumnValue, header: opts.header(), sanitize: opts.Sanitize, bom: opts.BOM, dialect: opts.CSV}
+}
+
+func (w *csvWriter) WriteHeader() error {
+	// Nothing has been buffered yet, so the mark goes straight to out
+	if w.bom {
+		if _, err := io.WriteString(w.out, utf8BOM); err != nil {
+			return fmt.Errorf("error writing CSV byte order mark: %v", err)
+		}
+	}
+	if err := w.writer.Write(w.header); err != nil {
+		return fmt.Errorf("error writing CSV header: %v", err)
+	}
+	return nil
+}
+
+func (w *csvWriter) WriteFinding(finding types.Finding) error {
+	if err := w.writer.Write(w.row(finding)); err != nil {
+		return fmt.Errorf("error writing finding to CSV: %v", err)
+	}
+	return nil
+}
+
+func (w *csvWriter) WriteRegion(result gd.RegionResult) error {
+	if result.Err == nil {
+		return nil
+	}
+	if err := w.writer.Write(w.row(errorFinding(result))); err != nil {
+		return fmt.Errorf("error writing error row to CSV: %v", err)
+	}
+	return nil
+}
+
+func (w *csvWriter) Close() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+// row returns the cells of a finding, with the timestamps in the dialect's
+// format and sanitized when requested
+func (w *csvWriter) row(finding types.Finding) []string {
+	row := findingRow(finding, w.columns, w.value)
+	if w.dialect.rewritesTimes() {
+		for i, column := range w.columns {
+			if csvTimeColumns[column] {
+				row[i] = w.dialect.formatTime(row[i])
+			}
+		}
+	}
+	if w.sanitize {
+		for i, cell := range row {
+			row[i] = sanitizeCell(cell)
+		}
+	}
+	return row
+}
+
+// utf8BOM is the byte order mark Excel needs to read a CSV file as UTF-8
+// rather than the system code page
+const utf8BOM = "\uFEFF"
+
+// sanitizeCell makes a CSV cell safe to open in a spreadsheet. Line breaks
+// become \n, which Excel shows within the cell, and a cell starting with a
+// character that makes spreadsheets evaluate it as a formula, such as
+// "=HYPERLINK(...)" in an attacker-chosen title, is prefixed with a single
+// quote so it is shown as text. Numbers such as -1.5 are left unchanged.
+func sanitizeCell(cell string) string {
+	cell = strings.ReplaceAll(cell, "\r\n", "\n")
+	cell = strings.ReplaceAll(cell, "\r", "\n")
+	if cell == "" || !strings.ContainsRune("=+-@\t", rune(cell[0])) {
+		return cell
+	}
+	if _, err := strconv.ParseFloat(cell, 64); err == nil {
+		return cell
+	}
+	return "'" + cell
+}
+
+// errorFinding builds the record written in place of a failed region's
+// findings, with ERROR as its ID and the error as its description
+func errorFinding(result gd.RegionResult) types.Finding {
+	finding := types.Finding{
+		Id:          aws.String("ERROR"),
+		Region:      aws.String(result.Region),
+		Description: aws.String(result.Err.Error()),
+	}
+	if result.Account != "" {
+		finding.AccountId = aws.String(result.Account)
+	}
+	return finding
+}
+
+// jsonWriter writes the complete findings as a single JSON array, indented
+// when pretty is set. Regions that failed are written as error records.
+type jsonWriter struct {
+	bw     *bufio.Writer
+	pretty bool
+	first  bool
+}
+
+func newJSONWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	return &jsonWriter{bw: bufio.NewWriter(out), pretty: opts.Pretty, first: true}
+}
+
+func (w *jsonWriter) WriteHeader() error {
+	_, err := w.bw.WriteString("[")
+	return err
+}
+
+func (w *jsonWriter) WriteFinding(finding types.Finding) error {
+	var data []byte
+	var err error
+	if w.pretty {
+		data, err = json.MarshalIndent(finding, "  ", "  ")
+	} else {
+		data, err = json.Marshal(finding)
+	}
+	if err != nil {
+		return fmt.Errorf("error encoding finding: %v", err)
+	}
+
+	if !w.first {
+		w.bw.WriteString(",")
+	}
+	w.first = false
+	if w.pretty {
+		w.bw.WriteString("\n  ")
+	}
+	_, err = w.bw.Write(data)
+	return err
+}
+
+func (w *jsonWriter) WriteRegion(result gd.RegionResult) error {
+	if result.Err == nil {
+		return nil
+	}
+	return w.WriteFinding(errorFinding(result))
+}
+
+func (w *jsonWriter) Close() error {
+	if w.pretty && !w.first {
+		w.bw.WriteString("\n")
+	}
+	w.bw.WriteString("]\n")
+	return w.bw.Flush()
+}
+
+// ndjsonWriter writes one complete finding per line. Regions that failed
+// are written as error records.
+type ndjsonWriter struct {
+	bw      *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newNDJSONWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	bw := bufio.NewWriter(out)
+	return &ndjsonWriter{bw: bw, encoder: json.NewEncoder(bw)}
+}
+
+func (w *ndjsonWriter) WriteHeader() error {
+	return nil
+}
+
+func (w *ndjsonWriter) WriteFinding(finding types.Finding) error {
+	if err := w.encoder.Encode(finding); err != nil {
+		return fmt.Errorf("error encoding finding: %v", err)
+	}
+	return nil
+}
+
+func (w *ndjsonWriter) WriteRegion(result gd.RegionResult) error {
+	if result.Err == nil {
+		return nil
+	}
+	return w.WriteFinding(errorFinding(result))
+}
+
+func (w *ndjsonWriter) Close() error {
+	return w.bw.Flush()
+}
@@ -0,0 +1,155 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// failingRegion is a Fake whose GuardDuty clients of one region fail to
+// list findings
+type failingRegion struct {
+	*gd.Fake
+	region string
+	err    error
+}
+
+func (c failingRegion) GuardDuty(cfg aws.Config, account string, optFns ...func(*guardduty.Options)) gd.GuardDutyAPI {
+	client := c.Fake.GuardDuty(cfg, account, optFns...)
+	if cfg.Region != c.region {
+		return client
+	}
+	return failingClient{GuardDutyAPI: client, err: c.err}
+}
+
+type failingClient struct {
+	gd.GuardDutyAPI
+	err error
+}
+
+func (c failingClient) ListFindings(context.Context, *guardduty.ListFindingsInput, ...func(*guardduty.Options)) (*guardduty.ListFindingsOutput, error) {
+	return nil, c.err
+}
+
+// record is a finding or error record of an export, as written
+type record struct {
+	id, region, description string
+}
+
+func TestWriteReportedErrors(t *testing.T) {
+	tests := []struct {
+		format string
+		// parse reads the records of the export
+		parse func(t *testing.T, data []byte) []record
+	}{
+		{format: "csv", parse: csvRecords},
+		{format: "json", parse: func(t *testing.T, data []byte) []record {
+			var findings []types.Finding
+			if err := json.Unmarshal(data, &findings); err != nil {
+				t.Fatalf("invalid JSON export: %v", err)
+			}
+			return findingRecords(findings)
+		}},
+		{format: "ndjson", parse: func(t *testing.T, data []byte) []record {
+			var findings []types.Finding
+			for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+				var finding types.Finding
+				if err := json.Unmarshal(line, &finding); err != nil {
+					t.Fatalf("invalid NDJSON line %s: %v", line, err)
+				}
+				findings = append(findings, finding)
+			}
+			return findingRecords(findings)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			fake := gd.NewFake("123456789012")
+			fake.AddFindings(types.Finding{
+				Id:       aws.String("finding-1"),
+				Region:   aws.String("us-east-1"),
+				Type:     aws.String("Recon:EC2/PortProbeUnprotectedPort"),
+				Severity: aws.Float64(5),
+			})
+			fake.AddDetector("", "eu-west-1")
+			opts := gd.FetchOptions{
+				Regions:      []string{"us-east-1", "eu-west-1"},
+				AWSConfig:    aws.Config{Region: "us-east-1"},
+				Clients:      failingRegion{Fake: fake, region: "eu-west-1", err: errors.New("throttled")},
+				ReportErrors: true,
+				Concurrency:  1,
+				BatchSize:    gd.MaxGetFindingsBatch,
+			}
+
+			stream := gd.StreamRegions(context.Background(), opts, nil)
+			defer stream.Close()
+			var out bytes.Buffer
+			findings, err := Write(context.Background(), &out, WriteOptions{Format: tt.format, Columns: DefaultColumns}, "export."+tt.format, stream)
+			if err != nil {
+				t.Fatalf("error writing export: %v", err)
+			}
+			if _, failed := stream.Failed(); failed {
+				t.Fatalf("export failed although errors are reported")
+			}
+			if findings != 1 {
+				t.Errorf("got %d findings, want 1", findings)
+			}
+
+			records := tt.parse(t, out.Bytes())
+			i := slices.IndexFunc(records, func(r record) bool { return r.id == "ERROR" })
+			if i < 0 {
+				t.Fatalf("no ERROR record in %v", records)
+			}
+			if records[i].region != "eu-west-1" {
+				t.Errorf("got ERROR record for region %q, want eu-west-1", records[i].region)
+			}
+			if !strings.Contains(records[i].description, "throttled") {
+				t.Errorf("got ERROR description %q, want the region's error", records[i].description)
+			}
+			if !slices.ContainsFunc(records, func(r record) bool { return r.id == "finding-1" }) {
+				t.Errorf("finding of the region that succeeded is missing from %v", records)
+			}
+		})
+	}
+}
+
+// csvRecords reads the records of a CSV export by its FindingId, Region,
+// and Description columns
+func csvRecords(t *testing.T, data []byte) []record {
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV export: %v", err)
+	}
+	if len(rows) == 0 {
+		t.Fatalf("empty CSV export")
+	}
+	header := rows[0]
+	id, region, description := slices.Index(header, "FindingId"), slices.Index(header, "Region"), slices.Index(header, "Description")
+	if id < 0 || region < 0 || description < 0 {
+		t.Fatalf("missing columns in CSV header %v", header)
+	}
+	var records []record
+	for _, row := range rows[1:] {
+		records = append(records, record{id: row[id], region: row[region], description: row[description]})
+	}
+	return records
+}
+
+func findingRecords(findings []types.Finding) []record {
+	var records []record
+	for _, finding := range findings {
+		records = append(records, record{id: aws.ToString(finding.Id), region: aws.ToString(finding.Region), description: aws.ToString(finding.Description)})
+	}
+	return records
+}
@@ -0,0 +1,219 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// severityColors are the colors of the severity bands in reports
+var severityColors = map[string]string{
+	"Critical": "#7d2105",
+	"High":     "#d13212",
+	"Medium":   "#ff9900",
+	"Low":      "#879596",
+}
+
+// htmlWriter writes a standalone HTML report: an executive summary with
+// counts by severity, type, account and region, and affected resource,
+// charts drawn as inline SVG, the outcome of each region, and the findings
+// in a collapsible table with the export's columns. The summary comes
+// first but needs every finding, so the table rows are spooled to a
+// temporary file and copied in on Close.
+type htmlWriter struct {
+	out     io.Writer
+	columns []string
+	value   columnValuer
+	header  []string
+	locale  reportLocale
+	summary *exportSummary
+	spool   *os.File
+	rows    *bufio.Writer
+}
+
+func newHTMLWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	return &htmlWriter{out: out, columns: opts.Columns, value: opts.ColumnValue, header: opts.header(), locale: localeOf(opts.Locale), summary: newExportSummary(0)}
+}
+
+func (w *htmlWriter) WriteHeader() error {
+	spool, err := os.CreateTemp("", "guardduty_findings_*.html")
+	if err != nil {
+		return fmt.Errorf("error creating report: %v", err)
+	}
+	w.spool = spool
+	w.rows = bufio.NewWriter(spool)
+	return nil
+}
+
+func (w *htmlWriter) WriteFinding(finding types.Finding) error {
+	w.summary.add(finding)
+	label := gd.SeverityLabel(aws.ToFloat64(finding.Severity))
+	fmt.Fprintf(w.rows, `<tr class="%s">`, strings.ToLower(label))
+	for _, column := range w.columns {
+		value := w.value(finding, column)
+		if column == "ConsoleURL" && value != "" {
+			fmt.Fprintf(w.rows, `<td><a href="%s">%s</a></td>`, html.EscapeString(value), html.EscapeString(w.locale.text("Open")))
+			continue
+		}
+		fmt.Fprintf(w.rows, `<td>%s</td>`, html.EscapeString(value))
+	}
+	_, err := w.rows.WriteString("</tr>\n")
+	if err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	return nil
+}
+
+func (w *htmlWriter) WriteRegion(result gd.RegionResult) error {
+	w.summary.addRegion(result)
+	return nil
+}
+
+// Close writes the report to out and removes the spooled rows
+func (w *htmlWriter) Close() error {
+	if w.spool == nil {
+		return nil
+	}
+	defer os.Remove(w.spool.Name())
+	defer w.spool.Close()
+	if err := w.rows.Flush(); err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error reading report: %v", err)
+	}
+
+	bw := bufio.NewWriter(w.out)
+	s, l := w.summary, w.locale
+	title := l.text("GuardDuty Findings Report")
+	bw.WriteString(htmlHeader(l, title))
+	fmt.Fprintf(bw, "<h1>%s</h1>\n<p class=\"generated\">%s</p>\n", html.EscapeString(title), html.EscapeString(l.sprintf("Generated %s", l.generated())))
+
+	bw.WriteString(`<section class="totals">`)
+	fmt.Fprintf(bw, `<div class="total"><span>%d</span>%s</div>`, s.Total, html.EscapeString(l.text("Findings")))
+	for _, label := range gd.SeverityLabels {
+		fmt.Fprintf(bw, `<div class="total %s"><span>%d</span>%s</div>`, strings.ToLower(label), s.BySeverity[label], html.EscapeString(l.text(label)))
+	}
+	fmt.Fprintf(bw, `<div class="total"><span>%d</span>%s</div>`, len(s.Regions), html.EscapeString(l.text("Regions")))
+	if failed := s.Failed(); failed > 0 {
+		fmt.Fprintf(bw, `<div class="total failed"><span>%d</span>%s</div>`, failed, html.EscapeString(l.text("Failed")))
+	}
+	bw.WriteString("</section>\n")
+
+	// The bars of the severity chart are named in the locale and colored by
+	// their severity
+	severities := make([]summaryCount, 0, len(gd.SeverityLabels))
+	colors := make(map[string]string, len(gd.SeverityLabels))
+	for _, label := range gd.SeverityLabels {
+		severities = append(severities, summaryCount{l.text(label), s.BySeverity[label]})
+		colors[l.text(label)] = severityColors[label]
+	}
+	writeBarChart(bw, l.text("By Severity"), severities, func(name string) string { return colors[name] })
+	writeBarChart(bw, l.text("By Account and Region"), s.ByRegion(), nil)
+	writeBarChart(bw, l.sprintf("Top %d Finding Types", summaryTopN), s.TopTypes(summaryTopN), nil)
+	writeBarChart(bw, l.sprintf("Top %d Affected Resources", summaryTopN), s.TopResources(summaryTopN), nil)
+
+	fmt.Fprintf(bw, "<h2>%s</h2>\n<table><tr><th>%s</th><th>%s</th><th>%s</th></tr>\n",
+		html.EscapeString(l.text("Regions")), html.EscapeString(l.text("Region")), html.EscapeString(l.text("Status")), html.EscapeString(l.text("Findings")))
+	for _, region := range s.Regions {
+		fmt.Fprintf(bw, "<tr><td>%s</td><td>%s</td><td>%d</td></tr>\n",
+			html.EscapeString(summaryRegion(region.Account, region.Region)), html.EscapeString(l.regionStatus(region)), region.Count)
+	}
+	bw.WriteString("</table>\n")
+
+	fmt.Fprintf(bw, "<details>\n<summary>%s</summary>\n<table class=\"findings\"><tr>", html.EscapeString(l.sprintf("Findings (%d)", s.Total)))
+	for _, column := range w.header {
+		fmt.Fprintf(bw, "<th>%s</th>", html.EscapeString(column))
+	}
+	bw.WriteString("</tr>\n")
+	if _, err := io.Copy(bw, w.spool); err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	bw.WriteString("</table>\n</details>\n</body>\n</html>\n")
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	return nil
+}
+
+// writeBarChart writes a horizontal bar chart as inline SVG under a
+// heading, with each bar in color(name) or the default color. Charts
+// without any findings are left out.
+func writeBarChart(bw *bufio.Writer, title string, bars []summaryCount, color func(name string) string) {
+	most := 0
+	for _, bar := range bars {
+		most = max(most, bar.Findings)
+	}
+	if most == 0 {
+		return
+	}
+	const labelWidth, barWidth, rowHeight = 300, 400, 24
+	fmt.Fprintf(bw, "<h2>%s</h2>\n", html.EscapeString(title))
+	fmt.Fprintf(bw, `<svg width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="%s">`,
+		labelWidth+barWidth+60, len(bars)*rowHeight, labelWidth+barWidth+60, len(bars)*rowHeight, html.EscapeString(title))
+	for i, bar := range bars {
+		y := i * rowHeight
+		fill := "#0073bb"
+		if color != nil {
+			fill = color(bar.Name)
+		}
+		label := bar.Name
+		if utf8.RuneCountInString(label) > 45 {
+			label = string([]rune(label)[:44]) + "…"
+		}
+		width := bar.Findings * barWidth / most
+		fmt.Fprintf(bw, `<text x="%d" y="%d" text-anchor="end"><title>%s</title>%s</text>`,
+			labelWidth-8, y+16, html.EscapeString(bar.Name), html.EscapeString(label))
+		fmt.Fprintf(bw, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"/>`, labelWidth, y+4, max(width, 1), rowHeight-8, fill)
+		fmt.Fprintf(bw, `<text x="%d" y="%d">%d</text>`, labelWidth+width+6, y+16, bar.Findings)
+	}
+	bw.WriteString("</svg>\n")
+}
+
+// htmlHeader starts a report titled in a locale
+func htmlHeader(l reportLocale, title string) string {
+	return strings.NewReplacer(`<html lang="en">`, `<html lang="`+l.code+`">`,
+		"<title>GuardDuty Findings Report</title>", "<title>"+html.EscapeString(title)+"</title>").Replace(htmlHead)
+}
+
+// htmlHead starts a report with its styles, so the file needs nothing else
+// to display
+const htmlHead = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>GuardDuty Findings Report</title>
+<style>
+body { font-family: Arial, sans-serif; margin: 24px; color: #16191f; }
+h1 { margin-bottom: 0; }
+.generated { color: #545b64; margin-top: 4px; }
+.totals { display: flex; flex-wrap: wrap; gap: 12px; margin: 16px 0; }
+.total { border: 1px solid #d5dbdb; border-radius: 4px; padding: 8px 16px; min-width: 90px; text-align: center; }
+.total span { display: block; font-size: 28px; font-weight: bold; }
+.total.critical span { color: #7d2105; }
+.total.high span { color: #d13212; }
+.total.medium span { color: #ff9900; }
+.total.low span { color: #879596; }
+.total.failed span { color: #d13212; }
+svg text { font-size: 13px; fill: #16191f; }
+table { border-collapse: collapse; margin-bottom: 16px; }
+th, td { border: 1px solid #d5dbdb; padding: 4px 8px; text-align: left; vertical-align: top; font-size: 13px; }
+th { background: #f2f3f3; }
+details summary { cursor: pointer; font-size: 20px; font-weight: bold; margin: 16px 0; }
+tr.critical td:first-child { border-left: 4px solid #7d2105; }
+tr.high td:first-child { border-left: 4px solid #d13212; }
+tr.medium td:first-child { border-left: 4px solid #ff9900; }
+tr.low td:first-child { border-left: 4px solid #879596; }
+</style>
+</head>
+<body>
+`
@@ -0,0 +1,37 @@
+package export
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// kubernetesUser returns the Kubernetes user or service account that a
+// finding's activity was made by
+func kubernetesUser(f types.Finding) *types.KubernetesUserDetails {
+	if f.Resource == nil || f.Resource.KubernetesDetails == nil {
+		return nil
+	}
+	return f.Resource.KubernetesDetails.KubernetesUserDetails
+}
+
+// kubernetesAPICall returns the Kubernetes API request of a finding whose
+// action is one, as of EKS audit log findings
+func kubernetesAPICall(f types.Finding) *types.KubernetesApiCallAction {
+	if f.Service == nil || f.Service.Action == nil {
+		return nil
+	}
+	return f.Service.Action.KubernetesApiCallAction
+}
+
+// clusterName returns the name of the EKS or ECS cluster of the affected
+// resource
+func clusterName(f types.Finding) *string {
+	switch r := f.Resource; {
+	case r == nil:
+		return nil
+	case r.EksClusterDetails != nil:
+		return r.EksClusterDetails.Name
+	case r.EcsClusterDetails != nil:
+		return r.EcsClusterDetails.Name
+	}
+	return nil
+}
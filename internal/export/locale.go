@@ -0,0 +1,251 @@
+package export
+
+import (
+	"fmt"
+	"time"
+
+	"guardduty/internal/gd"
+)
+
+// DefaultLocale is the locale of reports that choose none
+const DefaultLocale = "en"
+
+// Locales lists the locales of HTML, PDF, and Markdown reports. Their text
+// is limited to Latin-1, which the standard fonts of PDF reports cover.
+var Locales = []string{"en", "de", "fr", "es"}
+
+// reportLocale is the language and date layouts of a report. Messages are
+// keyed by their English text, which a locale without a translation keeps.
+type reportLocale struct {
+	code           string
+	dateLayout     string
+	dateTimeLayout string
+	messages       map[string]string
+}
+
+// reportLocales are the supported locales by code
+var reportLocales = map[string]reportLocale{
+	"en": {code: "en", dateLayout: time.DateOnly, dateTimeLayout: "2006-01-02 15:04 MST"},
+	"de": {code: "de", dateLayout: "02.01.2006", dateTimeLayout: "02.01.2006 15:04 MST", messages: map[string]string{
+		"Critical":                             "Kritisch",
+		"High":                                 "Hoch",
+		"Medium":                               "Mittel",
+		"Low":                                  "Niedrig",
+		"GuardDuty Findings Report":            "GuardDuty-Befundbericht",
+		"GuardDuty Findings Executive Summary": "GuardDuty-Befunde: Management-Zusammenfassung",
+		"GuardDuty Findings Trends":            "GuardDuty-Befundtrends",
+		"Generated %s":                         "Erstellt am %s",
+		"%s to %s, generated %s":               "%s bis %s, erstellt am %s",
+		"%s - page %d of %d":                   "%s - Seite %d von %d",
+		"%d findings":                          "%d Befunde",
+		"in %d accounts and regions":           "in %d Konten und Regionen",
+		"%d failed":                            "%d fehlgeschlagen",
+		"%d accounts and regions exported, %d skipped, %d failed": "%d Konten und Regionen exportiert, %d übersprungen, %d fehlgeschlagen",
+		"Findings":                    "Befunde",
+		"Findings (%d)":               "Befunde (%d)",
+		"Regions":                     "Regionen",
+		"Region":                      "Region",
+		"Failed":                      "Fehlgeschlagen",
+		"Status":                      "Status",
+		"Severity":                    "Schweregrad",
+		"Title":                       "Titel",
+		"Type":                        "Typ",
+		"Resource":                    "Ressource",
+		"Updated":                     "Aktualisiert",
+		"Open":                        "Öffnen",
+		"No resource":                 "Keine Ressource",
+		"Finding type":                "Befundtyp",
+		"Account and region":          "Konto und Region",
+		"Accounts and Regions":        "Konten und Regionen",
+		"By Severity":                 "Nach Schweregrad",
+		"By Account and Region":       "Nach Konto und Region",
+		"Findings by Severity":        "Befunde nach Schweregrad",
+		"New Findings by Severity":    "Neue Befunde nach Schweregrad",
+		"Top %d Finding Types":        "Die %d häufigsten Befundtypen",
+		"Top %d Affected Resources":   "Die %d am häufigsten betroffenen Ressourcen",
+		"%d Most Severe Findings":     "Die %d schwerwiegendsten Befunde",
+		"OK":                          "OK",
+		"Error: %s":                   "Fehler: %s",
+		"Skipped: %s":                 "Übersprungen: %s",
+		"Truncated":                   "Gekürzt",
+		"New":                         "Neu",
+		"Resolved":                    "Behoben",
+		"Mean days active":            "Durchschnittlich aktive Tage",
+		"MeanActiveDays":              "Durchschnittlich aktive Tage",
+		"New and Resolved Findings":   "Neue und behobene Befunde",
+		"Top Recurring Finding Types": "Häufigste wiederkehrende Befundtypen",
+		"Weeks":                       "Wochen",
+		"Week":                        "Woche",
+	}},
+	"fr": {code: "fr", dateLayout: "02/01/2006", dateTimeLayout: "02/01/2006 15:04 MST", messages: map[string]string{
+		"Critical":                             "Critique",
+		"High":                                 "Élevée",
+		"Medium":                               "Moyenne",
+		"Low":                                  "Faible",
+		"GuardDuty Findings Report":            "Rapport des résultats GuardDuty",
+		"GuardDuty Findings Executive Summary": "Synthèse des résultats GuardDuty",
+		"GuardDuty Findings Trends":            "Tendances des résultats GuardDuty",
+		"Generated %s":                         "Généré le %s",
+		"%s to %s, generated %s":               "Du %s au %s, généré le %s",
+		"%s - page %d of %d":                   "%s - page %d sur %d",
+		"%d findings":                          "%d résultats",
+		"in %d accounts and regions":           "dans %d comptes et régions",
+		"%d failed":                            "%d en échec",
+		"%d accounts and regions exported, %d skipped, %d failed": "%d comptes et régions exportés, %d ignorés, %d en échec",
+		"Findings":                    "Résultats",
+		"Findings (%d)":               "Résultats (%d)",
+		"Regions":                     "Régions",
+		"Region":                      "Région",
+		"Failed":                      "En échec",
+		"Status":                      "Statut",
+		"Severity":                    "Gravité",
+		"Title":                       "Titre",
+		"Type":                        "Type",
+		"Resource":                    "Ressource",
+		"Updated":                     "Mis à jour",
+		"Open":                        "Ouvrir",
+		"No resource":                 "Aucune ressource",
+		"Finding type":                "Type de résultat",
+		"Account and region":          "Compte et région",
+		"Accounts and Regions":        "Comptes et régions",
+		"By Severity":                 "Par gravité",
+		"By Account and Region":       "Par compte et région",
+		"Findings by Severity":        "Résultats par gravité",
+		"New Findings by Severity":    "Nouveaux résultats par gravité",
+		"Top %d Finding Types":        "Les %d principaux types de résultats",
+		"Top %d Affected Resources":   "Les %d ressources les plus affectées",
+		"%d Most Severe Findings":     "Les %d résultats les plus graves",
+		"OK":                          "OK",
+		"Error: %s":                   "Erreur : %s",
+		"Skipped: %s":                 "Ignoré : %s",
+		"Truncated":                   "Tronqué",
+		"New":                         "Nouveaux",
+		"Resolved":                    "Résolus",
+		"Mean days active":            "Jours actifs en moyenne",
+		"MeanActiveDays":              "Jours actifs en moyenne",
+		"New and Resolved Findings":   "Résultats nouveaux et résolus",
+		"Top Recurring Finding Types": "Types de résultats les plus récurrents",
+		"Weeks":                       "Semaines",
+		"Week":                        "Semaine",
+	}},
+	"es": {code: "es", dateLayout: "02/01/2006", dateTimeLayout: "02/01/2006 15:04 MST", messages: map[string]string{
+		"Critical":                             "Crítica",
+		"High":                                 "Alta",
+		"Medium":                               "Media",
+		"Low":                                  "Baja",
+		"GuardDuty Findings Report":            "Informe de hallazgos de GuardDuty",
+		"GuardDuty Findings Executive Summary": "Resumen ejecutivo de hallazgos de GuardDuty",
+		"GuardDuty Findings Trends":            "Tendencias de hallazgos de GuardDuty",
+		"Generated %s":                         "Generado el %s",
+		"%s to %s, generated %s":               "Del %s al %s, generado el %s",
+		"%s - page %d of %d":                   "%s - página %d de %d",
+		"%d findings":                          "%d hallazgos",
+		"in %d accounts and regions":           "en %d cuentas y regiones",
+		"%d failed":                            "%d con error",
+		"%d accounts and regions exported, %d skipped, %d failed": "%d cuentas y regiones exportadas, %d omitidas, %d con error",
+		"Findings":                    "Hallazgos",
+		"Findings (%d)":               "Hallazgos (%d)",
+		"Regions":                     "Regiones",
+		"Region":                      "Región",
+		"Failed":                      "Con error",
+		"Status":                      "Estado",
+		"Severity":                    "Gravedad",
+		"Title":                       "Título",
+		"Type":                        "Tipo",
+		"Resource":                    "Recurso",
+		"Updated":                     "Actualizado",
+		"Open":                        "Abrir",
+		"No resource":                 "Sin recurso",
+		"Finding type":                "Tipo de hallazgo",
+		"Account and region":          "Cuenta y región",
+		"Accounts and Regions":        "Cuentas y regiones",
+		"By Severity":                 "Por gravedad",
+		"By Account and Region":       "Por cuenta y región",
+		"Findings by Severity":        "Hallazgos por gravedad",
+		"New Findings by Severity":    "Nuevos hallazgos por gravedad",
+		"Top %d Finding Types":        "Los %d tipos de hallazgos principales",
+		"Top %d Affected Resources":   "Los %d recursos más afectados",
+		"%d Most Severe Findings":     "Los %d hallazgos más graves",
+		"OK":                          "Correcto",
+		"Error: %s":                   "Error: %s",
+		"Skipped: %s":                 "Omitido: %s",
+		"Truncated":                   "Truncado",
+		"New":                         "Nuevos",
+		"Resolved":                    "Resueltos",
+		"Mean days active":            "Días activos de media",
+		"MeanActiveDays":              "Días activos de media",
+		"New and Resolved Findings":   "Hallazgos nuevos y resueltos",
+		"Top Recurring Finding Types": "Tipos de hallazgos más recurrentes",
+		"Weeks":                       "Semanas",
+		"Week":                        "Semana",
+	}},
+}
+
+// ValidLocale reports whether l names a supported locale, or is empty for
+// the default one
+func ValidLocale(l string) bool {
+	_, ok := reportLocales[l]
+	return l == "" || ok
+}
+
+// localeOf returns the locale of a code, or the default locale
+func localeOf(code string) reportLocale {
+	if l, ok := reportLocales[code]; ok {
+		return l
+	}
+	return reportLocales[DefaultLocale]
+}
+
+// text translates a message
+func (l reportLocale) text(s string) string {
+	if t, ok := l.messages[s]; ok {
+		return t
+	}
+	return s
+}
+
+// sprintf formats the translation of a message
+func (l reportLocale) sprintf(format string, args ...any) string {
+	return fmt.Sprintf(l.text(format), args...)
+}
+
+// date and dateTime format t in the layouts of the locale
+func (l reportLocale) date(t time.Time) string {
+	return t.Format(l.dateLayout)
+}
+
+func (l reportLocale) dateTime(t time.Time) string {
+	return t.Format(l.dateTimeLayout)
+}
+
+// dateOf formats the date that a timestamp such as 2024-05-01T10:00:00Z
+// starts with, or returns s when it starts with none
+func (l reportLocale) dateOf(s string) string {
+	if len(s) < len(time.DateOnly) {
+		return s
+	}
+	t, err := time.Parse(time.DateOnly, s[:len(time.DateOnly)])
+	if err != nil {
+		return s
+	}
+	return l.date(t)
+}
+
+// generated is the time a report is written at
+func (l reportLocale) generated() string {
+	return l.dateTime(time.Now().UTC())
+}
+
+// regionStatus describes the outcome of an account and region. Errors and
+// reasons for skipping come from AWS and the exporter and stay in English.
+func (l reportLocale) regionStatus(region gd.RegionResult) string {
+	switch {
+	case region.Err != nil:
+		return l.sprintf("Error: %s", region.Err.Error())
+	case region.Skipped != "":
+		return l.sprintf("Skipped: %s", region.Skipped)
+	case region.Truncated:
+		return l.text("Truncated")
+	}
+	return l.text("OK")
+}
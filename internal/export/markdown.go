@@ -0,0 +1,181 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// Groupings of the findings of Markdown reports
+const (
+	GroupByType     = "type"
+	GroupByResource = "resource"
+)
+
+// ValidGroupBy reports whether g names a grouping, or is empty for none
+func ValidGroupBy(g string) bool {
+	return g == "" || g == GroupByType || g == GroupByResource
+}
+
+// markdownWriter writes a GitHub Flavored Markdown report to paste into an
+// issue, a wiki page, or a chat message: the totals, the findings by
+// severity, the top finding types, the outcome of each account and region,
+// and a table of the most severe findings, in one table or a table per
+// finding type or affected resource. Like the other reports it keeps counts
+// and the most severe findings only, and writes everything on Close.
+type markdownWriter struct {
+	out     io.Writer
+	groupBy string
+	locale  reportLocale
+	summary *exportSummary
+}
+
+func newMarkdownWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	top := opts.TopFindings
+	if top == 0 {
+		top = summaryTopFindings
+	}
+	return &markdownWriter{out: out, groupBy: opts.GroupBy, locale: localeOf(opts.Locale), summary: newExportSummary(top)}
+}
+
+func (w *markdownWriter) WriteHeader() error {
+	return nil
+}
+
+func (w *markdownWriter) WriteFinding(finding types.Finding) error {
+	w.summary.add(finding)
+	return nil
+}
+
+func (w *markdownWriter) WriteRegion(result gd.RegionResult) error {
+	w.summary.addRegion(result)
+	return nil
+}
+
+func (w *markdownWriter) Close() error {
+	bw := bufio.NewWriter(w.out)
+	s, l := w.summary, w.locale
+	fmt.Fprintf(bw, "# %s\n\n%s\n\n", l.text("GuardDuty Findings Report"), l.sprintf("Generated %s", l.generated()))
+
+	counts := make([]string, 0, len(gd.SeverityLabels))
+	for _, label := range gd.SeverityLabels {
+		counts = append(counts, fmt.Sprintf("%d %s", s.BySeverity[label], l.text(label)))
+	}
+	fmt.Fprintf(bw, "**%s**: %s, %s", l.sprintf("%d findings", s.Total), strings.Join(counts, ", "), l.sprintf("in %d accounts and regions", len(s.Regions)))
+	if failed := s.Failed(); failed > 0 {
+		fmt.Fprintf(bw, ", %s", l.sprintf("%d failed", failed))
+	}
+	fmt.Fprintf(bw, "\n\n| %s | %s |\n| --- | ---: |\n", l.text("Severity"), l.text("Findings"))
+	for _, label := range gd.SeverityLabels {
+		fmt.Fprintf(bw, "| %s | %d |\n", l.text(label), s.BySeverity[label])
+	}
+
+	if ranked := s.TopTypes(summaryTopN); len(ranked) > 0 {
+		fmt.Fprintf(bw, "\n## %s\n\n| %s | %s |\n| --- | ---: |\n", l.sprintf("Top %d Finding Types", summaryTopN), l.text("Finding type"), l.text("Findings"))
+		for _, t := range ranked {
+			fmt.Fprintf(bw, "| %s | %d |\n", markdownCell(t.Name), t.Findings)
+		}
+	}
+
+	fmt.Fprintf(bw, "\n## %s\n\n| %s | %s | %s |\n| --- | --- | ---: |\n",
+		l.text("Accounts and Regions"), l.text("Account and region"), l.text("Status"), l.text("Findings"))
+	for _, region := range s.Regions {
+		fmt.Fprintf(bw, "| %s | %s | %d |\n", markdownCell(summaryRegion(region.Account, region.Region)), markdownCell(l.regionStatus(region)), region.Count)
+	}
+
+	top := s.TopFindings()
+	if len(top) > 0 {
+		fmt.Fprintf(bw, "\n## %s\n", l.sprintf("%d Most Severe Findings", len(top)))
+	}
+	switch w.groupBy {
+	case GroupByType, GroupByResource:
+		// Groups come in the order of their most severe finding
+		var names []string
+		groups := make(map[string][]summaryFinding)
+		for _, f := range top {
+			name := f.Type
+			if w.groupBy == GroupByResource {
+				name = f.Resource
+			}
+			if _, ok := groups[name]; !ok {
+				names = append(names, name)
+			}
+			groups[name] = append(groups[name], f)
+		}
+		for _, name := range names {
+			title := name
+			if title == "" {
+				title = l.text("No resource")
+			}
+			fmt.Fprintf(bw, "\n### %s (%d)\n\n", markdownCell(title), len(groups[name]))
+			writeMarkdownFindings(bw, l, groups[name], w.groupBy)
+		}
+	default:
+		if len(top) > 0 {
+			bw.WriteString("\n")
+			writeMarkdownFindings(bw, l, top, "")
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	return nil
+}
+
+// writeMarkdownFindings writes a table of findings, leaving out the column
+// they are grouped by. Titles link to the console.
+func writeMarkdownFindings(bw *bufio.Writer, l reportLocale, findings []summaryFinding, groupBy string) {
+	fmt.Fprintf(bw, "| %s | %s |", l.text("Severity"), l.text("Title"))
+	if groupBy != GroupByType {
+		fmt.Fprintf(bw, " %s |", l.text("Type"))
+	}
+	if groupBy != GroupByResource {
+		fmt.Fprintf(bw, " %s |", l.text("Resource"))
+	}
+	fmt.Fprintf(bw, " %s | %s |\n| ---: | --- |", l.text("Account and region"), l.text("Updated"))
+	if groupBy != GroupByType {
+		bw.WriteString(" --- |")
+	}
+	if groupBy != GroupByResource {
+		bw.WriteString(" --- |")
+	}
+	bw.WriteString(" --- | --- |\n")
+	for _, f := range findings {
+		title := markdownCell(f.Title)
+		if f.ConsoleURL != "" {
+			title = fmt.Sprintf("[%s](%s)", title, f.ConsoleURL)
+		}
+		fmt.Fprintf(bw, "| %.1f %s | %s |", f.Severity, l.text(gd.SeverityLabel(f.Severity)), title)
+		if groupBy != GroupByType {
+			fmt.Fprintf(bw, " %s |", markdownCell(f.Type))
+		}
+		if groupBy != GroupByResource {
+			fmt.Fprintf(bw, " %s |", markdownCell(f.Resource))
+		}
+		fmt.Fprintf(bw, " %s | %s |\n", markdownCell(f.Region), markdownCell(f.UpdatedAt))
+	}
+}
+
+// markdownCell escapes s for a table cell: the characters that Markdown
+// would read as formatting, a link, or HTML are escaped with a backslash,
+// the pipes that would end the cell included, and line breaks become spaces
+func markdownCell(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\', '`', '*', '_', '[', ']', '<', '>', '|', '~', '#':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n', '\r', '\t':
+			b.WriteByte(' ')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
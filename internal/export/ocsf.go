@@ -0,0 +1,239 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"guardduty/internal/gd"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// OCSF Detection Finding identifiers, from schema version 1.1.0
+const (
+	ocsfVersion          = "1.1.0"
+	ocsfCategoryUID      = 2    // Findings
+	ocsfClassUID         = 2004 // Detection Finding
+	ocsfActivityCreate   = 1
+	ocsfStatusNew        = 1
+	ocsfStatusSuppressed = 3
+)
+
+// ocsfFinding is a GuardDuty finding as an OCSF Detection Finding event
+type ocsfFinding struct {
+	ActivityID      int             `json:"activity_id"`
+	Activity        string          `json:"activity_name"`
+	CategoryUID     int             `json:"category_uid"`
+	Category        string          `json:"category_name"`
+	ClassUID        int             `json:"class_uid"`
+	Class           string          `json:"class_name"`
+	TypeUID         int             `json:"type_uid"`
+	Time            int64           `json:"time"`
+	Message         string          `json:"message,omitempty"`
+	SeverityID      int             `json:"severity_id"`
+	Severity        string          `json:"severity"`
+	StatusID        int             `json:"status_id"`
+	Status          string          `json:"status"`
+	ConfidenceScore *int            `json:"confidence_score,omitempty"`
+	Count           int32           `json:"count,omitempty"`
+	Metadata        ocsfMetadata    `json:"metadata"`
+	FindingInfo     ocsfFindingInfo `json:"finding_info"`
+	Cloud           ocsfCloud       `json:"cloud"`
+	Resources       []ocsfResource  `json:"resources,omitempty"`
+	SrcEndpoint     *ocsfEndpoint   `json:"src_endpoint,omitempty"`
+	Unmapped        map[string]any  `json:"unmapped,omitempty"`
+}
+
+type ocsfMetadata struct {
+	Version  string      `json:"version"`
+	Product  ocsfProduct `json:"product"`
+	Profiles []string    `json:"profiles"`
+}
+
+type ocsfProduct struct {
+	Name       string `json:"name"`
+	VendorName string `json:"vendor_name"`
+}
+
+type ocsfFindingInfo struct {
+	UID           string   `json:"uid"`
+	Title         string   `json:"title,omitempty"`
+	Desc          string   `json:"desc,omitempty"`
+	Types         []string `json:"types,omitempty"`
+	CreatedTime   int64    `json:"created_time,omitempty"`
+	ModifiedTime  int64    `json:"modified_time,omitempty"`
+	FirstSeenTime int64    `json:"first_seen_time,omitempty"`
+	LastSeenTime  int64    `json:"last_seen_time,omitempty"`
+}
+
+type ocsfCloud struct {
+	Provider string      `json:"provider"`
+	Region   string      `json:"region,omitempty"`
+	Account  ocsfAccount `json:"account"`
+}
+
+type ocsfAccount struct {
+	UID string `json:"uid"`
+}
+
+type ocsfResource struct {
+	Type           string `json:"type,omitempty"`
+	UID            string `json:"uid,omitempty"`
+	Region         string `json:"region,omitempty"`
+	CloudPartition string `json:"cloud_partition,omitempty"`
+}
+
+type ocsfEndpoint struct {
+	IP       string        `json:"ip,omitempty"`
+	Location *ocsfLocation `json:"location,omitempty"`
+}
+
+type ocsfLocation struct {
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+}
+
+// ocsfSeverity maps a GuardDuty severity to an OCSF severity ID and name
+func ocsfSeverity(severity float64) (int, string) {
+	switch gd.SeverityLabel(severity) {
+	case "Critical":
+		return 5, "Critical"
+	case "High":
+		return 4, "High"
+	case "Medium":
+		return 3, "Medium"
+	default:
+		return 2, "Low"
+	}
+}
+
+// ocsfTime converts a GuardDuty timestamp to OCSF epoch milliseconds, or 0
+// if it is missing or malformed
+func ocsfTime(s *string) int64 {
+	t, err := time.Parse(time.RFC3339, aws.ToString(s))
+	if err != nil {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// toOCSF maps a GuardDuty finding to an OCSF Detection Finding
+func toOCSF(f types.Finding) ocsfFinding {
+	severityID, severity := ocsfSeverity(aws.ToFloat64(f.Severity))
+	event := ocsfFinding{
+		ActivityID:  ocsfActivityCreate,
+		Activity:    "Create",
+		CategoryUID: ocsfCategoryUID,
+		Category:    "Findings",
+		ClassUID:    ocsfClassUID,
+		Class:       "Detection Finding",
+		TypeUID:     ocsfClassUID*100 + ocsfActivityCreate,
+		Time:        ocsfTime(f.UpdatedAt),
+		Message:     aws.ToString(f.Title),
+		SeverityID:  severityID,
+		Severity:    severity,
+		StatusID:    ocsfStatusNew,
+		Status:      "New",
+		Metadata: ocsfMetadata{
+			Version:  ocsfVersion,
+			Product:  ocsfProduct{Name: "Amazon GuardDuty", VendorName: "AWS"},
+			Profiles: []string{"cloud"},
+		},
+		FindingInfo: ocsfFindingInfo{
+			UID:          aws.ToString(f.Arn),
+			Title:        aws.ToString(f.Title),
+			Desc:         aws.ToString(f.Description),
+			CreatedTime:  ocsfTime(f.CreatedAt),
+			ModifiedTime: ocsfTime(f.UpdatedAt),
+		},
+		Cloud: ocsfCloud{
+			Provider: "AWS",
+			Region:   aws.ToString(f.Region),
+			Account:  ocsfAccount{UID: aws.ToString(f.AccountId)},
+		},
+		Unmapped: map[string]any{"guardduty_finding_id": aws.ToString(f.Id)},
+	}
+	if event.FindingInfo.UID == "" {
+		event.FindingInfo.UID = aws.ToString(f.Id)
+	}
+	if f.Type != nil {
+		event.FindingInfo.Types = []string{*f.Type}
+	}
+	if f.Confidence != nil {
+		score := int(*f.Confidence * 10)
+		event.ConfidenceScore = &score
+	}
+
+	if f.Resource != nil {
+		event.Resources = []ocsfResource{{
+			Type:           aws.ToString(f.Resource.ResourceType),
+			UID:            resourceID(f.Resource),
+			Region:         aws.ToString(f.Region),
+			CloudPartition: aws.ToString(f.Partition),
+		}}
+	}
+
+	if s := f.Service; s != nil {
+		if s.Archived != nil && *s.Archived {
+			event.StatusID = ocsfStatusSuppressed
+			event.Status = "Suppressed"
+		}
+		event.Count = aws.ToInt32(s.Count)
+		event.FindingInfo.FirstSeenTime = ocsfTime(s.EventFirstSeen)
+		event.FindingInfo.LastSeenTime = ocsfTime(s.EventLastSeen)
+		if s.Action != nil && s.Action.ActionType != nil {
+			event.Unmapped["action_type"] = *s.Action.ActionType
+		}
+		if s.DetectorId != nil {
+			event.Unmapped["detector_id"] = *s.DetectorId
+		}
+	}
+
+	if ip := actorIP(f); ip != nil {
+		endpoint := &ocsfEndpoint{IP: aws.ToString(ip.IpAddressV4)}
+		if endpoint.IP == "" {
+			endpoint.IP = aws.ToString(ip.IpAddressV6)
+		}
+		if ip.Country != nil || ip.City != nil {
+			endpoint.Location = &ocsfLocation{}
+			if ip.Country != nil {
+				endpoint.Location.Country = aws.ToString(ip.Country.CountryCode)
+			}
+			if ip.City != nil {
+				endpoint.Location.City = aws.ToString(ip.City.CityName)
+			}
+		}
+		event.SrcEndpoint = endpoint
+	}
+	return event
+}
+
+// ocsfWriter writes one OCSF Detection Finding per line. Failed regions are
+// logged but not written, since they are not detections.
+type ocsfWriter struct {
+	bw      *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newOCSFWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	bw := bufio.NewWriter(out)
+	return &ocsfWriter{bw: bw, encoder: json.NewEncoder(bw)}
+}
+
+func (w *ocsfWriter) WriteHeader() error {
+	return nil
+}
+
+func (w *ocsfWriter) WriteFinding(finding types.Finding) error {
+	if err := w.encoder.Encode(toOCSF(finding)); err != nil {
+		return fmt.Errorf("error encoding finding: %v", err)
+	}
+	return nil
+}
+
+func (w *ocsfWriter) Close() error {
+	return w.bw.Flush()
+}
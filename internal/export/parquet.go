@@ -0,0 +1,527 @@
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// Parquet physical types, converted types, and other enum values from the
+// parquet-format Thrift definitions
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetOptional = 1
+
+	parquetPlain    = 0
+	parquetRLE      = 3
+	parquetGzip     = 2
+	parquetDataPage = 0
+)
+
+// parquetRowGroupSize is the number of findings in each row group
+const parquetRowGroupSize = 50000
+
+// parquetColumn is one column of the Parquet schema. value returns nil when
+// the finding has no value for the column.
+type parquetColumn struct {
+	name      string
+	kind      int32
+	converted int32 // -1 for none
+	value     func(f types.Finding) any
+}
+
+// parquetColumns is the schema of Parquet exports. The finding column holds
+// the complete finding as JSON for fields without a column of their own.
+var parquetColumns = []parquetColumn{
+	{"region", parquetByteArray, parquetUTF8, parquetString(findingFields["Region"])},
+	{"account_id", parquetByteArray, parquetUTF8, parquetString(findingFields["AccountId"])},
+	{"finding_id", parquetByteArray, parquetUTF8, parquetString(findingFields["FindingId"])},
+	{"arn", parquetByteArray, parquetUTF8, func(f types.Finding) any { return optionalString(f.Arn) }},
+	{"type", parquetByteArray, parquetUTF8, parquetString(findingFields["FindingType"])},
+	{"title", parquetByteArray, parquetUTF8, parquetString(findingFields["Title"])},
+	{"description", parquetByteArray, parquetUTF8, parquetString(findingFields["Description"])},
+	{"severity", parquetDouble, -1, func(f types.Finding) any {
+		if f.Severity == nil {
+			return nil
+		}
+		return *f.Severity
+	}},
+	{"created_at", parquetInt64, parquetTimestampMillis, func(f types.Finding) any { return parquetTime(f.CreatedAt) }},
+	{"updated_at", parquetInt64, parquetTimestampMillis, func(f types.Finding) any { return parquetTime(f.UpdatedAt) }},
+	{"resource_type", parquetByteArray, parquetUTF8, parquetString(findingFields["ResourceType"])},
+	{"resource_id", parquetByteArray, parquetUTF8, parquetString(findingFields["ResourceId"])},
+	{"action_type", parquetByteArray, parquetUTF8, parquetString(findingFields["ActionType"])},
+	{"actor_ip", parquetByteArray, parquetUTF8, parquetString(findingFields["ActorIp"])},
+	{"actor_country", parquetByteArray, parquetUTF8, parquetString(findingFields["ActorCountry"])},
+	{"count", parquetInt32, -1, func(f types.Finding) any {
+		if f.Service == nil || f.Service.Count == nil {
+			return nil
+		}
+		return *f.Service.Count
+	}},
+	{"archived", parquetBoolean, -1, func(f types.Finding) any {
+		if f.Service == nil || f.Service.Archived == nil {
+			return nil
+		}
+		return *f.Service.Archived
+	}},
+	{"finding", parquetByteArray, parquetUTF8, func(f types.Finding) any {
+		data, err := json.Marshal(f)
+		if err != nil {
+			return nil
+		}
+		return string(data)
+	}},
+}
+
+// parquetString adapts a column field, treating an empty value as null
+func parquetString(field findingField) func(f types.Finding) any {
+	return func(f types.Finding) any {
+		if v := field(f); v != "" {
+			return v
+		}
+		return nil
+	}
+}
+
+// optionalString returns the value of s, or nil if it is unset or empty
+func optionalString(s *string) any {
+	if aws.ToString(s) == "" {
+		return nil
+	}
+	return *s
+}
+
+// parquetTime converts a GuardDuty timestamp to epoch milliseconds, or nil
+// if it is missing or malformed
+func parquetTime(s *string) any {
+	t, err := time.Parse(time.RFC3339, aws.ToString(s))
+	if err != nil {
+		return nil
+	}
+	return t.UnixMilli()
+}
+
+// parquetWriter writes the findings as a GZIP-compressed Parquet file with
+// the parquetColumns schema, a row group at a time, and the footer
+// describing the row groups on Close. Failed regions are logged but not
+// written, since an error record does not fit the schema.
+type parquetWriter struct {
+	out       *countingWriter
+	pending   []types.Finding
+	rows      int64
+	rowGroups []parquetRowGroup
+}
+
+func newParquetWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	return &parquetWriter{out: &countingWriter{w: out}}
+}
+
+func (w *parquetWriter) WriteHeader() error {
+	if _, err := w.out.Write([]byte("PAR1")); err != nil {
+		return fmt.Errorf("error writing Parquet file: %v", err)
+	}
+	return nil
+}
+
+func (w *parquetWriter) WriteFinding(finding types.Finding) error {
+	w.pending = append(w.pending, finding)
+	if len(w.pending) < parquetRowGroupSize {
+		return nil
+	}
+	return w.flush()
+}
+
+// flush writes the pending findings as a row group
+func (w *parquetWriter) flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	group, err := writeParquetRowGroup(w.out, w.pending)
+	if err != nil {
+		return fmt.Errorf("error writing Parquet row group: %v", err)
+	}
+	w.rowGroups = append(w.rowGroups, group)
+	w.rows += group.rows
+	w.pending = w.pending[:0]
+	return nil
+}
+
+func (w *parquetWriter) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	footer := parquetFooter(w.rows, w.rowGroups)
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(footer)))
+	footer = append(footer, "PAR1"...)
+	if _, err := w.out.Write(footer); err != nil {
+		return fmt.Errorf("error writing Parquet footer: %v", err)
+	}
+	return nil
+}
+
+// writeParquet writes findings to out as a Parquet file
+func writeParquet(out io.Writer, findings []types.Finding) error {
+	w := newParquetWriter(out, WriteOptions{})
+	if err := w.WriteHeader(); err != nil {
+		return err
+	}
+	for _, finding := range findings {
+		if err := w.WriteFinding(finding); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// countingWriter tracks the file offset for the Parquet footer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// parquetChunk records where a column chunk was written
+type parquetChunk struct {
+	offset           int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+// parquetRowGroup records the column chunks of one row group
+type parquetRowGroup struct {
+	rows   int64
+	chunks []parquetChunk
+}
+
+// writeParquetRowGroup writes one data page per column for the findings
+func writeParquetRowGroup(w *countingWriter, findings []types.Finding) (parquetRowGroup, error) {
+	group := parquetRowGroup{rows: int64(len(findings))}
+	for _, column := range parquetColumns {
+		values := make([]any, len(findings))
+		for i, finding := range findings {
+			values[i] = column.value(finding)
+		}
+		page := parquetPage(column.kind, values)
+
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(page)
+		if err := zw.Close(); err != nil {
+			return group, err
+		}
+
+		var header thriftWriter
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(compressed.Len()))
+		header.beginStruct(5)
+		header.i32(1, int32(len(values)))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.endStruct()
+		header.stop()
+
+		chunk := parquetChunk{
+			offset:           w.n,
+			uncompressedSize: int64(header.buf.Len() + len(page)),
+			compressedSize:   int64(header.buf.Len() + compressed.Len()),
+		}
+		if _, err := w.Write(header.buf.Bytes()); err != nil {
+			return group, err
+		}
+		if _, err := w.Write(compressed.Bytes()); err != nil {
+			return group, err
+		}
+		group.chunks = append(group.chunks, chunk)
+	}
+	return group, nil
+}
+
+// parquetPage encodes the definition levels and PLAIN values of a data page.
+// Every column is optional, so each null is a definition level of 0.
+func parquetPage(kind int32, values []any) []byte {
+	// Definition levels use the RLE hybrid encoding with a bit width of 1,
+	// written as one RLE run per stretch of equal levels
+	var levels []byte
+	for i := 0; i < len(values); {
+		j := i
+		for j < len(values) && (values[j] == nil) == (values[i] == nil) {
+			j++
+		}
+		levels = binary.AppendUvarint(levels, uint64(j-i)<<1)
+		if values[i] == nil {
+			levels = append(levels, 0)
+		} else {
+			levels = append(levels, 1)
+		}
+		i = j
+	}
+	page := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+	page = append(page, levels...)
+
+	var bits []byte
+	n := 0
+	for _, value := range values {
+		switch v := value.(type) {
+		case string:
+			page = binary.LittleEndian.AppendUint32(page, uint32(len(v)))
+			page = append(page, v...)
+		case float64:
+			page = binary.LittleEndian.AppendUint64(page, math.Float64bits(v))
+		case int64:
+			page = binary.LittleEndian.AppendUint64(page, uint64(v))
+		case int32:
+			page = binary.LittleEndian.AppendUint32(page, uint32(v))
+		case bool:
+			// Booleans are bit-packed, least significant bit first
+			if n%8 == 0 {
+				bits = append(bits, 0)
+			}
+			if v {
+				bits[n/8] |= 1 << (n % 8)
+			}
+			n++
+		}
+	}
+	if kind == parquetBoolean {
+		page = append(page, bits...)
+	}
+	return page
+}
+
+// parquetFooter encodes the FileMetaData of the file
+func parquetFooter(rows int64, rowGroups []parquetRowGroup) []byte {
+	var t thriftWriter
+	t.i32(1, 1)
+
+	t.beginList(2, thriftStruct, len(parquetColumns)+1)
+	t.beginElement()
+	t.binary(4, "schema")
+	t.i32(5, int32(len(parquetColumns)))
+	t.endStruct()
+	for _, column := range parquetColumns {
+		t.beginElement()
+		t.i32(1, column.kind)
+		t.i32(3, parquetOptional)
+		t.binary(4, column.name)
+		if column.converted >= 0 {
+			t.i32(6, column.converted)
+		}
+		t.endStruct()
+	}
+
+	t.i64(3, rows)
+
+	t.beginList(4, thriftStruct, len(rowGroups))
+	for _, group := range rowGroups {
+		t.beginElement()
+		t.beginList(1, thriftStruct, len(group.chunks))
+		var total int64
+		for i, chunk := range group.chunks {
+			column := parquetColumns[i]
+			t.beginElement()
+			t.i64(2, chunk.offset)
+			t.beginStruct(3)
+			t.i32(1, column.kind)
+			t.beginList(2, thriftI32, 2)
+			t.varint(parquetPlain)
+			t.varint(parquetRLE)
+			t.beginList(3, thriftBinary, 1)
+			t.rawBinary(column.name)
+			t.i32(4, parquetGzip)
+			t.i64(5, group.rows)
+			t.i64(6, chunk.uncompressedSize)
+			t.i64(7, chunk.compressedSize)
+			t.i64(9, chunk.offset)
+			t.endStruct()
+			t.endStruct()
+			total += chunk.uncompressedSize
+		}
+		t.i64(2, total)
+		t.i64(3, group.rows)
+		t.endStruct()
+	}
+	t.binary(6, "guardduty-export")
+	t.stop()
+	return t.buf.Bytes()
+}
+
+// Thrift compact protocol type codes
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs in the Thrift compact protocol used by the
+// Parquet metadata. Fields must be written in increasing ID order.
+type thriftWriter struct {
+	buf     bytes.Buffer
+	lastID  int16
+	parents []int16
+}
+
+func (t *thriftWriter) field(id int16, kind byte) {
+	if delta := id - t.lastID; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.buf.WriteByte(kind)
+		t.varint(int64(id))
+	}
+	t.lastID = id
+}
+
+// varint writes a zigzag-encoded integer, the compact encoding of i16, i32,
+// and i64 values
+func (t *thriftWriter) varint(v int64) {
+	t.buf.Write(binary.AppendVarint(nil, v))
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.rawBinary(s)
+}
+
+func (t *thriftWriter) rawBinary(s string) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64(len(s))))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) beginList(id int16, elem byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		t.buf.Write(binary.AppendUvarint(nil, uint64(size)))
+	}
+}
+
+// beginStruct starts a struct field, and beginElement a struct in a list
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.beginElement()
+}
+
+func (t *thriftWriter) beginElement() {
+	t.parents = append(t.parents, t.lastID)
+	t.lastID = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.stop()
+	t.lastID = t.parents[len(t.parents)-1]
+	t.parents = t.parents[:len(t.parents)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
+
+// WritePartitions writes one Parquet or CSV file named filename for each
+// region and day of UpdatedAt, in Hive-style region=.../dt=... directories
+// beneath dir, and returns the paths of the files relative to dir. Every
+// account writes to the same partitions, so the findings are grouped in
+// memory before any file is written.
+func WritePartitions(dir, filename string, opts WriteOptions, stream *gd.Stream) ([]string, int, error) {
+	partitions := make(map[string][]types.Finding)
+	for region, ok := stream.Next(); ok; region, ok = stream.Next() {
+		for finding := range region.Findings {
+			day := "unknown"
+			if t, err := time.Parse(time.RFC3339, aws.ToString(finding.UpdatedAt)); err == nil {
+				day = t.UTC().Format(time.DateOnly)
+			}
+			key := filepath.Join("region="+region.Region, "dt="+day)
+			partitions[key] = append(partitions[key], finding)
+		}
+	}
+
+	keys := make([]string, 0, len(partitions))
+	for key := range partitions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var files []string
+	totalFindings := 0
+	for _, key := range keys {
+		if err := os.MkdirAll(filepath.Join(dir, key), 0o755); err != nil {
+			return files, totalFindings, fmt.Errorf("error creating partition %s: %v", key, err)
+		}
+		file := filepath.Join(key, filename)
+		f, err := os.Create(filepath.Join(dir, file))
+		if err != nil {
+			return files, totalFindings, fmt.Errorf("error creating file: %v", err)
+		}
+		err = writePartition(f, opts, partitions[key])
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return files, totalFindings, err
+		}
+		files = append(files, file)
+		totalFindings += len(partitions[key])
+	}
+	return files, totalFindings, nil
+}
+
+// writePartition writes the findings of a partition in the format of opts.
+// CSV partitions carry a header of the partition columns, without a byte
+// order mark, for the table to skip.
+func writePartition(out io.Writer, opts WriteOptions, findings []types.Finding) error {
+	if opts.Format != "csv" {
+		return writeParquet(out, findings)
+	}
+	opts.Columns, opts.Headers, opts.BOM = partitionColumns(opts.Columns), nil, false
+	w := newCSVWriter(out, opts)
+	if err := w.WriteHeader(); err != nil {
+		return err
+	}
+	for _, finding := range findings {
+		if err := w.WriteFinding(finding); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
@@ -0,0 +1,353 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// Page geometry of PDF reports, in points: A4 with even margins
+const (
+	pdfWidth   = 595
+	pdfHeight  = 842
+	pdfMargin  = 50
+	pdfContent = pdfWidth - 2*pdfMargin
+)
+
+// pdfWriter writes an executive summary as a paginated PDF document: the
+// totals, a chart of the findings by severity, the trend of new findings
+// by severity, the top finding types, the outcome of each account and
+// region, and the most severe findings. It shares the aggregation of the
+// HTML report and keeps no findings beyond the most severe, so the
+// document is laid out on Close.
+type pdfWriter struct {
+	out     io.Writer
+	locale  reportLocale
+	summary *exportSummary
+}
+
+func newPDFWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	return &pdfWriter{out: out, locale: localeOf(opts.Locale), summary: newExportSummary(summaryTopFindings)}
+}
+
+func (w *pdfWriter) WriteHeader() error {
+	return nil
+}
+
+func (w *pdfWriter) WriteFinding(finding types.Finding) error {
+	w.summary.add(finding)
+	return nil
+}
+
+func (w *pdfWriter) WriteRegion(result gd.RegionResult) error {
+	w.summary.addRegion(result)
+	return nil
+}
+
+func (w *pdfWriter) Close() error {
+	s, l := w.summary, w.locale
+	title := l.text("GuardDuty Findings Executive Summary")
+	doc := pdfDocument{locale: l}
+	doc.newPage()
+	doc.line(20, true, title)
+	doc.line(10, false, l.sprintf("Generated %s", l.generated()))
+	doc.gap(8)
+
+	counts := make([]string, 0, len(gd.SeverityLabels))
+	for _, label := range gd.SeverityLabels {
+		counts = append(counts, fmt.Sprintf("%d %s", s.BySeverity[label], l.text(label)))
+	}
+	doc.line(12, true, l.sprintf("%d findings", s.Total)+": "+strings.Join(counts, ", "))
+	skipped := 0
+	for _, region := range s.Regions {
+		if region.Skipped != "" {
+			skipped++
+		}
+	}
+	doc.line(11, false, l.sprintf("%d accounts and regions exported, %d skipped, %d failed", len(s.Regions)-skipped-s.Failed(), skipped, s.Failed()))
+
+	doc.heading(l.text("Findings by Severity"))
+	most := 0
+	for _, label := range gd.SeverityLabels {
+		most = max(most, s.BySeverity[label])
+	}
+	for _, label := range gd.SeverityLabels {
+		doc.space(18)
+		doc.y -= 18
+		doc.text(pdfMargin, doc.y, 10, false, l.text(label))
+		width := 0.0
+		if most > 0 {
+			width = float64(s.BySeverity[label]) * 340 / float64(most)
+		}
+		doc.rect(pdfMargin+70, doc.y-2, max(width, 1), 12, severityColors[label])
+		doc.text(pdfMargin+76+width, doc.y, 10, false, strconv.Itoa(s.BySeverity[label]))
+	}
+
+	if trend := s.Trend(); len(trend) > 0 {
+		doc.heading(l.text("New Findings by Severity"))
+		doc.trendChart(trend)
+	}
+
+	if ranked := s.TopTypes(summaryTopN); len(ranked) > 0 {
+		doc.heading(l.sprintf("Top %d Finding Types", summaryTopN))
+		rows := make([][]string, 0, len(ranked))
+		for _, t := range ranked {
+			rows = append(rows, []string{t.Name, strconv.Itoa(t.Findings)})
+		}
+		doc.table([]pdfColumn{{l.text("Finding type"), 420}, {l.text("Findings"), 75}}, rows)
+	}
+
+	doc.heading(l.text("Accounts and Regions"))
+	rows := make([][]string, 0, len(s.Regions))
+	for _, region := range s.Regions {
+		rows = append(rows, []string{summaryRegion(region.Account, region.Region), l.regionStatus(region), strconv.Itoa(region.Count)})
+	}
+	doc.table([]pdfColumn{{l.text("Account and region"), 170}, {l.text("Status"), 255}, {l.text("Findings"), 70}}, rows)
+
+	if top := s.TopFindings(); len(top) > 0 {
+		doc.heading(l.sprintf("%d Most Severe Findings", len(top)))
+		rows := make([][]string, 0, len(top))
+		for _, f := range top {
+			rows = append(rows, []string{fmt.Sprintf("%.1f", f.Severity), f.Title, f.Type, f.Region, l.dateOf(f.UpdatedAt)})
+		}
+		doc.table([]pdfColumn{{l.text("Severity"), 45}, {l.text("Title"), 165}, {l.text("Type"), 125}, {l.text("Account and region"), 105}, {l.text("Updated"), 55}}, rows)
+	}
+
+	return doc.write(w.out, title)
+}
+
+// pdfColumn is a column of a PDF table, with its width in points
+type pdfColumn struct {
+	title string
+	width float64
+}
+
+// pdfDocument lays out text, tables, and charts top to bottom on A4 pages
+// in the standard Helvetica fonts, starting a page when one is full. Its
+// legends and footers are in locale.
+type pdfDocument struct {
+	locale reportLocale
+	pages  []*bytes.Buffer
+	page   *bytes.Buffer
+	// y is the top of the space left on the page, from its bottom edge
+	y float64
+}
+
+func (d *pdfDocument) newPage() {
+	d.page = new(bytes.Buffer)
+	d.pages = append(d.pages, d.page)
+	d.y = pdfHeight - pdfMargin
+}
+
+// space starts a new page unless height points fit on this one above the
+// footer
+func (d *pdfDocument) space(height float64) {
+	if d.y-height < pdfMargin+20 {
+		d.newPage()
+	}
+}
+
+// gap leaves height points blank
+func (d *pdfDocument) gap(height float64) {
+	d.space(height)
+	d.y -= height
+}
+
+// line writes a line of text at the left margin and moves below it
+func (d *pdfDocument) line(size float64, bold bool, s string) {
+	d.space(size * 1.5)
+	d.y -= size * 1.5
+	d.text(pdfMargin, d.y, size, bold, pdfFit(s, pdfContent, size))
+}
+
+// heading starts a section, on a new page when not even the lines after it
+// would fit
+func (d *pdfDocument) heading(s string) {
+	d.space(80)
+	d.gap(10)
+	d.line(14, true, s)
+	d.gap(4)
+}
+
+// text writes s with its baseline at x, y
+func (d *pdfDocument) text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.page, "BT /%s %g Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, pdfString(s))
+}
+
+// rect fills a rectangle whose lower left corner is x, y with a #rrggbb
+// color
+func (d *pdfDocument) rect(x, y, width, height float64, color string) {
+	rgb, _ := strconv.ParseUint(strings.TrimPrefix(color, "#"), 16, 32)
+	fmt.Fprintf(d.page, "%.3f %.3f %.3f rg %.2f %.2f %.2f %.2f re f 0 g\n",
+		float64(rgb>>16&0xff)/255, float64(rgb>>8&0xff)/255, float64(rgb&0xff)/255, x, y, width, height)
+}
+
+// table writes rows under a header row, which is repeated on each page the
+// table continues on. Cells too long for their column are cut short.
+func (d *pdfDocument) table(columns []pdfColumn, rows [][]string) {
+	const size, height = 9, 15
+	header := func() {
+		d.space(2 * height)
+		d.y -= height
+		d.rect(pdfMargin, d.y-4, pdfContent, height, "#e9ebed")
+		x := pdfMargin + 3.0
+		for _, column := range columns {
+			d.text(x, d.y, size, true, pdfFit(column.title, column.width-6, size))
+			x += column.width
+		}
+	}
+	header()
+	for _, row := range rows {
+		if d.y-height < pdfMargin+20 {
+			d.newPage()
+			header()
+		}
+		d.y -= height
+		x := pdfMargin + 3.0
+		for i, column := range columns {
+			if i < len(row) {
+				d.text(x, d.y, size, false, pdfFit(row[i], column.width-6, size))
+			}
+			x += column.width
+		}
+	}
+}
+
+// trendChart writes a column chart of the findings of each period with a
+// stacked segment per severity, the start of the first, middle, and last
+// periods under it, and a legend
+func (d *pdfDocument) trendChart(trend []summaryPeriod) {
+	const chartHeight, axis = 140, 30
+	d.space(chartHeight + 40)
+	most := 0
+	for _, period := range trend {
+		total := 0
+		for _, n := range period.BySeverity {
+			total += n
+		}
+		most = max(most, total)
+	}
+	bottom := d.y - chartHeight
+	d.text(pdfMargin, d.y-8, 8, false, strconv.Itoa(most))
+	d.text(pdfMargin, bottom, 8, false, "0")
+	d.rect(pdfMargin+axis, bottom, pdfContent-axis, 0.5, "#879596")
+	width := float64(pdfContent-axis) / float64(len(trend))
+	for i, period := range trend {
+		x := pdfMargin + axis + float64(i)*width
+		y := bottom
+		// The least severe at the bottom, as in the console
+		for j := len(gd.SeverityLabels) - 1; j >= 0; j-- {
+			n := period.BySeverity[gd.SeverityLabels[j]]
+			if n == 0 || most == 0 {
+				continue
+			}
+			height := float64(n) * (chartHeight - 12) / float64(most)
+			d.rect(x+width*0.15, y, width*0.7, height, severityColors[gd.SeverityLabels[j]])
+			y += height
+		}
+		if i == 0 || i == len(trend)-1 || i == len(trend)/2 {
+			d.text(x, bottom-10, 7, false, d.locale.dateOf(period.Start))
+		}
+	}
+	d.y = bottom - 24
+	x := pdfMargin + axis + 0.0
+	for _, label := range gd.SeverityLabels {
+		d.rect(x, d.y, 8, 8, severityColors[label])
+		d.text(x+11, d.y+1, 8, false, d.locale.text(label))
+		x += 70
+	}
+	d.y -= 6
+}
+
+// write writes the document with a footer numbering each page
+func (d *pdfDocument) write(out io.Writer, title string) error {
+	for i, page := range d.pages {
+		fmt.Fprintf(page, "BT /F1 8 Tf %d %d Td (%s) Tj ET\n", pdfMargin, pdfMargin-20,
+			pdfString(d.locale.sprintf("%s - page %d of %d", title, i+1, len(d.pages))))
+	}
+
+	bw := bufio.NewWriter(out)
+	var offsets []int
+	written := 0
+	object := func(body string) {
+		offsets = append(offsets, written)
+		n, _ := fmt.Fprintf(bw, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+		written += n
+	}
+	n, _ := bw.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	written += n
+
+	// Objects 1 to 4 are the catalog, the page tree, and the two fonts;
+	// each page is followed by its content stream
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 6+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	object(fmt.Sprintf("<< /Title (%s) /Producer (guardduty-export) >>", pdfString(title)))
+	for i, page := range d.pages {
+		var content bytes.Buffer
+		zw := zlib.NewWriter(&content)
+		zw.Write(page.Bytes())
+		zw.Close()
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfWidth, pdfHeight, 7+2*i))
+		object(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", content.Len(), content.Bytes()))
+	}
+
+	fmt.Fprintf(bw, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(bw, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(bw, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, written)
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing PDF: %v", err)
+	}
+	return nil
+}
+
+// pdfFit cuts s short with an ellipsis to fit width points at size, by
+// Helvetica's average character width
+func pdfFit(s string, width, size float64) string {
+	limit := int(width / (size * 0.52))
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return s
+	}
+	return string(runes[:max(limit-3, 0)]) + "..."
+}
+
+// pdfString escapes s as the text of a PDF string in WinAnsiEncoding.
+// Characters outside Latin-1 are replaced with a question mark.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(byte(r))
+		case r == '\n' || r == '\r' || r == '\t':
+			b.WriteByte(' ')
+		case r < 0x20 || r >= 0x7f && r < 0xa0 || r > 0xff:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,119 @@
+package export
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// runtimeProcess returns the process a Runtime Monitoring finding observed
+func runtimeProcess(f types.Finding) *types.ProcessDetails {
+	if f.Service == nil || f.Service.RuntimeDetails == nil {
+		return nil
+	}
+	return f.Service.RuntimeDetails.Process
+}
+
+// runtimeContext returns the details of the suspicious activity of a
+// Runtime Monitoring finding
+func runtimeContext(f types.Finding) *types.RuntimeContext {
+	if f.Service == nil || f.Service.RuntimeDetails == nil {
+		return nil
+	}
+	return f.Service.RuntimeDetails.Context
+}
+
+// parentProcess returns the lineage entry of the parent of the observed
+// process: the one with its ParentUuid, or else the first, which GuardDuty
+// lists first
+func parentProcess(f types.Finding) *types.LineageObject {
+	process := runtimeProcess(f)
+	if process == nil || len(process.Lineage) == 0 {
+		return nil
+	}
+	for i, ancestor := range process.Lineage {
+		if parent := aws.ToString(process.ParentUuid); parent != "" && aws.ToString(ancestor.Uuid) == parent {
+			return &process.Lineage[i]
+		}
+	}
+	return &process.Lineage[0]
+}
+
+// processLineage returns the names of the ancestors of the observed
+// process, from its parent up, joined with "; "
+func processLineage(f types.Finding) string {
+	process := runtimeProcess(f)
+	if process == nil {
+		return ""
+	}
+	names := make([]string, 0, len(process.Lineage))
+	for _, ancestor := range process.Lineage {
+		name := aws.ToString(ancestor.Name)
+		if name == "" {
+			name = aws.ToString(ancestor.ExecutablePath)
+		}
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "; ")
+}
+
+// findingContainers returns the containers of the affected resource: the
+// container of the finding, or else those of its Kubernetes workload or ECS
+// task
+func findingContainers(f types.Finding) []types.Container {
+	r := f.Resource
+	switch {
+	case r == nil:
+		return nil
+	case r.ContainerDetails != nil:
+		return []types.Container{*r.ContainerDetails}
+	case r.KubernetesDetails != nil && r.KubernetesDetails.KubernetesWorkloadDetails != nil:
+		return r.KubernetesDetails.KubernetesWorkloadDetails.Containers
+	case r.EcsClusterDetails != nil && r.EcsClusterDetails.TaskDetails != nil:
+		return r.EcsClusterDetails.TaskDetails.Containers
+	}
+	return nil
+}
+
+// containerField returns a field of the containers of the affected
+// resource, joined with "; " when there are several
+func containerField(f types.Finding, field func(types.Container) *string) string {
+	var values []string
+	for _, container := range findingContainers(f) {
+		if value := aws.ToString(field(container)); value != "" {
+			values = append(values, value)
+		}
+	}
+	return strings.Join(values, "; ")
+}
+
+// workload returns the Kubernetes workload of the affected resource, the pod
+// of EKS Runtime Monitoring findings
+func workload(f types.Finding) *types.KubernetesWorkloadDetails {
+	if f.Resource == nil || f.Resource.KubernetesDetails == nil {
+		return nil
+	}
+	return f.Resource.KubernetesDetails.KubernetesWorkloadDetails
+}
+
+// networkConnection returns the connection of a finding whose action is a
+// network connection, as of Runtime Monitoring findings of processes
+// reaching out
+func networkConnection(f types.Finding) *types.NetworkConnectionAction {
+	if f.Service == nil || f.Service.Action == nil {
+		return nil
+	}
+	return f.Service.Action.NetworkConnectionAction
+}
+
+// formatInt32 formats an optional number, or returns "" for none
+func formatInt32(n *int32) string {
+	if n == nil {
+		return ""
+	}
+	return strconv.Itoa(int(*n))
+}
@@ -0,0 +1,195 @@
+package export
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// splitManifest is the manifest.json of a split export, describing each file
+// in the archive
+type splitManifest struct {
+	ExportedAt    time.Time       `json:"exportedAt"`
+	Format        string          `json:"format"`
+	TotalFindings int             `json:"totalFindings"`
+	Earliest      string          `json:"earliest,omitempty"`
+	Latest        string          `json:"latest,omitempty"`
+	Files         []manifestFile  `json:"files"`
+	Errors        []manifestError `json:"errors,omitempty"`
+	// Truncated is set when the export's limits stopped it before every
+	// region was exported
+	Truncated *gd.Truncation `json:"truncated,omitempty"`
+	// Summary is the end-of-run report of the export
+	Summary gd.ExportSummary `json:"summary"`
+}
+
+// manifestFile describes one file of a split export. Earliest and Latest
+// are the earliest creation and latest update times of its findings.
+type manifestFile struct {
+	Name     string `json:"name"`
+	Account  string `json:"account,omitempty"`
+	Region   string `json:"region"`
+	Findings int    `json:"findings"`
+	Bytes    int64  `json:"bytes"`
+	SHA256   string `json:"sha256"`
+	Earliest string `json:"earliest,omitempty"`
+	Latest   string `json:"latest,omitempty"`
+	// Truncated is set on the file of the region the export's limits cut
+	// off part way
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// manifestError records a region that failed in an export with reportErrors
+type manifestError struct {
+	Account string `json:"account,omitempty"`
+	Region  string `json:"region"`
+	Error   string `json:"error"`
+}
+
+// spanWriter tracks the earliest CreatedAt and latest UpdatedAt of the
+// findings passed to the writer it wraps
+type spanWriter struct {
+	FindingWriter
+	earliest, latest time.Time
+}
+
+func (w *spanWriter) WriteFinding(finding types.Finding) error {
+	if t, err := time.Parse(time.RFC3339, aws.ToString(finding.CreatedAt)); err == nil && (w.earliest.IsZero() || t.Before(w.earliest)) {
+		w.earliest = t
+	}
+	if t, err := time.Parse(time.RFC3339, aws.ToString(finding.UpdatedAt)); err == nil && t.After(w.latest) {
+		w.latest = t
+	}
+	return w.FindingWriter.WriteFinding(finding)
+}
+
+func (w *spanWriter) WriteRegion(result gd.RegionResult) error {
+	if regions, ok := w.FindingWriter.(RegionWriter); ok {
+		return regions.WriteRegion(result)
+	}
+	return nil
+}
+
+// span returns the earliest and latest times as RFC 3339 timestamps
+func (w *spanWriter) span() (string, string) {
+	return formatSpanTime(w.earliest), formatSpanTime(w.latest)
+}
+
+func formatSpanTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// writeSplitExport writes a zip archive with one export file per account and
+// region, named account/region.ext or region.ext, and a manifest.json
+// listing the files with their finding counts, time ranges, and checksums
+func writeSplitExport(ctx context.Context, out io.Writer, opts WriteOptions, stream *gd.Stream) (int, error) {
+	source := stream
+	// Every file of a flattened export shares the columns of the whole export
+	if opts.Flatten {
+		results := stream.Collect()
+		opts.Columns = flattenedColumns(results)
+		opts.Flatten = false
+		stream = gd.StreamResults(results)
+		defer stream.Close()
+	}
+
+	manifest := splitManifest{ExportedAt: time.Now().UTC(), Format: opts.Format, Files: []manifestFile{}}
+	zw := zip.NewWriter(out)
+	for region, ok := stream.Next(); ok; region, ok = stream.Next() {
+		// A skipped region has no file, which is only known once its first
+		// finding or its outcome arrives
+		first, more := <-region.Findings
+		if !more && region.Result().Skipped != "" {
+			continue
+		}
+
+		file := manifestFile{
+			Name:    gd.TargetLabel(region.Account, region.Region) + "." + Formats[opts.Format].Extension,
+			Account: region.Account,
+			Region:  region.Region,
+		}
+		entry, err := zw.CreateHeader(&zip.FileHeader{Name: file.Name, Method: zip.Deflate, Modified: manifest.ExportedAt})
+		if err != nil {
+			return manifest.TotalFindings, fmt.Errorf("error creating archive: %v", err)
+		}
+		hash := sha256.New()
+		counter := &countingWriter{w: io.MultiWriter(entry, hash)}
+		w := &spanWriter{FindingWriter: Formats[opts.Format].NewWriter(counter, opts)}
+		n, err := writeSplitFile(ctx, w, region, first, more)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return manifest.TotalFindings, err
+		}
+		result := region.Result()
+		if result.Err != nil {
+			manifest.Errors = append(manifest.Errors, manifestError{Account: result.Account, Region: result.Region, Error: result.Err.Error()})
+		}
+		file.Truncated = result.Truncated
+		file.Findings = n
+		file.Bytes = counter.n
+		file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		file.Earliest, file.Latest = w.span()
+		manifest.Files = append(manifest.Files, file)
+
+		manifest.TotalFindings += n
+		if file.Earliest != "" && (manifest.Earliest == "" || file.Earliest < manifest.Earliest) {
+			manifest.Earliest = file.Earliest
+		}
+		if file.Latest > manifest.Latest {
+			manifest.Latest = file.Latest
+		}
+	}
+	if truncation, ok := source.Truncated(); ok {
+		manifest.Truncated = &truncation
+	}
+	manifest.Summary = source.Summary()
+
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: manifest.ExportedAt})
+	if err != nil {
+		return manifest.TotalFindings, fmt.Errorf("error creating archive: %v", err)
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return manifest.TotalFindings, fmt.Errorf("error writing manifest: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return manifest.TotalFindings, fmt.Errorf("error compressing export: %v", err)
+	}
+	return manifest.TotalFindings, nil
+}
+
+// writeSplitFile writes one region's file of a split export to w, starting
+// with the first finding already read from the region when more is set
+func writeSplitFile(ctx context.Context, w FindingWriter, region *gd.RegionStream, first types.Finding, more bool) (int, error) {
+	if err := w.WriteHeader(); err != nil {
+		return 0, err
+	}
+	n := 0
+	if more {
+		written, err := writeFinding(ctx, w, first)
+		if err != nil {
+			return 0, err
+		}
+		if written {
+			n++
+		}
+	}
+	rest, err := writeRegion(ctx, w, region)
+	return n + rest, err
+}
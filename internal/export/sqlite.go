@@ -0,0 +1,333 @@
+package export
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+	_ "modernc.org/sqlite"
+
+	"guardduty/internal/gd"
+)
+
+// sqliteSchema creates the tables of SQLite exports. Each finding has one
+// row in findings, a row in resources per affected resource, and a row in
+// network per remote address or domain its action involved.
+const sqliteSchema = `
+CREATE TABLE findings (
+	id INTEGER PRIMARY KEY,
+	finding_id TEXT NOT NULL,
+	arn TEXT,
+	account_id TEXT,
+	region TEXT,
+	partition TEXT,
+	type TEXT,
+	title TEXT,
+	description TEXT,
+	severity REAL,
+	confidence REAL,
+	created_at TEXT,
+	updated_at TEXT,
+	first_seen TEXT,
+	last_seen TEXT,
+	count INTEGER,
+	archived INTEGER,
+	action_type TEXT,
+	detector_id TEXT,
+	finding TEXT NOT NULL
+);
+CREATE TABLE resources (
+	finding INTEGER NOT NULL REFERENCES findings(id),
+	resource_type TEXT,
+	resource_id TEXT,
+	arn TEXT,
+	instance_type TEXT,
+	image_id TEXT,
+	availability_zone TEXT,
+	access_key_id TEXT,
+	principal_id TEXT,
+	user_name TEXT
+);
+CREATE TABLE network (
+	finding INTEGER NOT NULL REFERENCES findings(id),
+	action_type TEXT,
+	direction TEXT,
+	protocol TEXT,
+	remote_ip TEXT,
+	remote_country TEXT,
+	remote_city TEXT,
+	remote_org TEXT,
+	remote_port INTEGER,
+	local_port INTEGER,
+	domain TEXT,
+	api TEXT,
+	service_name TEXT,
+	blocked INTEGER
+);
+CREATE TABLE export_errors (
+	account_id TEXT,
+	region TEXT NOT NULL,
+	error TEXT NOT NULL
+);
+CREATE INDEX findings_type ON findings(type);
+CREATE INDEX findings_severity ON findings(severity);
+CREATE INDEX findings_account_region ON findings(account_id, region);
+CREATE INDEX findings_updated_at ON findings(updated_at);
+CREATE INDEX resources_finding ON resources(finding);
+CREATE INDEX resources_resource_id ON resources(resource_id);
+CREATE INDEX network_finding ON network(finding);
+CREATE INDEX network_remote_ip ON network(remote_ip);
+`
+
+// sqliteWriter builds a SQLite database of the findings in a temporary file
+// and copies it to out on Close. Failed regions are recorded in the
+// export_errors table.
+type sqliteWriter struct {
+	out  io.Writer
+	path string
+	db   *sql.DB
+	tx   *sql.Tx
+	// failed is set once an insert fails, so Close discards the database
+	failed bool
+}
+
+func newSQLiteWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	return &sqliteWriter{out: out}
+}
+
+// WriteHeader creates the schema in a temporary database and starts the
+// transaction every row is inserted in
+func (w *sqliteWriter) WriteHeader() error {
+	file, err := os.CreateTemp("", "guardduty_findings_*.sqlite")
+	if err != nil {
+		return fmt.Errorf("error creating database: %v", err)
+	}
+	w.path = file.Name()
+	file.Close()
+
+	w.db, err = sql.Open("sqlite", w.path)
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := w.db.ExecContext(ctx, sqliteSchema); err != nil {
+		return fmt.Errorf("error creating tables: %v", err)
+	}
+	w.tx, err = w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	return nil
+}
+
+func (w *sqliteWriter) WriteFinding(finding types.Finding) error {
+	if err := insertFinding(context.Background(), w.tx, finding); err != nil {
+		w.failed = true
+		return fmt.Errorf("error writing finding to database: %v", err)
+	}
+	return nil
+}
+
+func (w *sqliteWriter) WriteRegion(result gd.RegionResult) error {
+	if result.Err == nil {
+		return nil
+	}
+	if _, err := w.tx.ExecContext(context.Background(), `INSERT INTO export_errors VALUES (?, ?, ?)`,
+		nullString(result.Account), result.Region, result.Err.Error()); err != nil {
+		w.failed = true
+		return fmt.Errorf("error writing error row to database: %v", err)
+	}
+	return nil
+}
+
+// Close commits the database, copies it to out, and removes the temporary
+// file. After a failed write it only removes the file.
+func (w *sqliteWriter) Close() error {
+	if w.path == "" {
+		return nil
+	}
+	defer os.Remove(w.path)
+	if w.db == nil {
+		return nil
+	}
+	if w.tx == nil || w.failed {
+		w.db.Close()
+		return nil
+	}
+	if err := w.tx.Commit(); err != nil {
+		w.db.Close()
+		return fmt.Errorf("error committing database: %v", err)
+	}
+	if err := w.db.Close(); err != nil {
+		return fmt.Errorf("error closing database: %v", err)
+	}
+
+	db, err := os.Open(w.path)
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+	if _, err := io.Copy(w.out, db); err != nil {
+		return fmt.Errorf("error writing database: %v", err)
+	}
+	return nil
+}
+
+// nullString returns nil for an empty string so it is stored as NULL
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// insertFinding inserts a finding and its resource and network rows
+func insertFinding(ctx context.Context, tx *sql.Tx, f types.Finding) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	var firstSeen, lastSeen, detectorID *string
+	var count *int32
+	var archived *bool
+	var action *types.Action
+	if s := f.Service; s != nil {
+		firstSeen, lastSeen, detectorID = s.EventFirstSeen, s.EventLastSeen, s.DetectorId
+		count, archived, action = s.Count, s.Archived, s.Action
+	}
+	var actionType *string
+	if action != nil {
+		actionType = action.ActionType
+	}
+
+	row, err := tx.ExecContext(ctx, `INSERT INTO findings (finding_id, arn, account_id, region, partition, type,
+		title, description, severity, confidence, created_at, updated_at, first_seen, last_seen, count, archived,
+		action_type, detector_id, finding) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		aws.ToString(f.Id), f.Arn, f.AccountId, f.Region, f.Partition, f.Type,
+		f.Title, f.Description, f.Severity, f.Confidence, f.CreatedAt, f.UpdatedAt, firstSeen, lastSeen, count, archived,
+		actionType, detectorID, string(data))
+	if err != nil {
+		return err
+	}
+	id, err := row.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if r := f.Resource; r != nil {
+		resource := []any{id, r.ResourceType, nullString(resourceID(r)), nil, nil, nil, nil, nil, nil, nil}
+		if d := r.InstanceDetails; d != nil {
+			resource[4], resource[5], resource[6] = d.InstanceType, d.ImageId, d.AvailabilityZone
+		}
+		if d := r.AccessKeyDetails; d != nil {
+			resource[7], resource[8], resource[9] = d.AccessKeyId, d.PrincipalId, d.UserName
+		}
+		rows := [][]any{resource}
+		// A finding about several buckets has a row for each
+		if len(r.S3BucketDetails) > 0 {
+			rows = nil
+			for _, bucket := range r.S3BucketDetails {
+				row := append([]any(nil), resource...)
+				row[2], row[3] = bucket.Name, bucket.Arn
+				rows = append(rows, row)
+			}
+		}
+		for _, row := range rows {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO resources VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, row...); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, n := range networkRows(action) {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO network VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, actionType, n.direction, n.protocol, n.remoteIP, n.country, n.city, n.org,
+			n.remotePort, n.localPort, n.domain, n.api, n.serviceName, n.blocked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// networkRow is one row of the network table
+type networkRow struct {
+	direction, protocol, domain, api, serviceName *string
+	remoteIP, country, city, org                  *string
+	remotePort, localPort                         *int32
+	blocked                                       *bool
+}
+
+// setRemote fills the remote address columns from ip
+func (n *networkRow) setRemote(ip *types.RemoteIpDetails) {
+	if ip == nil {
+		return
+	}
+	n.remoteIP = ip.IpAddressV4
+	if n.remoteIP == nil {
+		n.remoteIP = ip.IpAddressV6
+	}
+	if ip.Country != nil {
+		n.country = ip.Country.CountryName
+	}
+	if ip.City != nil {
+		n.city = ip.City.CityName
+	}
+	if ip.Organization != nil {
+		n.org = ip.Organization.AsnOrg
+	}
+}
+
+// networkRows returns the network details of an action: a row per probe of
+// a port probe, and one row for other actions that involve a remote party
+func networkRows(action *types.Action) []networkRow {
+	if action == nil {
+		return nil
+	}
+	var rows []networkRow
+	if a := action.NetworkConnectionAction; a != nil {
+		n := networkRow{direction: a.ConnectionDirection, protocol: a.Protocol, blocked: a.Blocked}
+		n.setRemote(a.RemoteIpDetails)
+		if a.RemotePortDetails != nil {
+			n.remotePort = a.RemotePortDetails.Port
+		}
+		if a.LocalPortDetails != nil {
+			n.localPort = a.LocalPortDetails.Port
+		}
+		rows = append(rows, n)
+	}
+	if a := action.PortProbeAction; a != nil {
+		for _, probe := range a.PortProbeDetails {
+			n := networkRow{direction: aws.String("INBOUND"), blocked: a.Blocked}
+			n.setRemote(probe.RemoteIpDetails)
+			if probe.LocalPortDetails != nil {
+				n.localPort = probe.LocalPortDetails.Port
+			}
+			rows = append(rows, n)
+		}
+	}
+	if a := action.AwsApiCallAction; a != nil {
+		n := networkRow{api: a.Api, serviceName: a.ServiceName}
+		n.setRemote(a.RemoteIpDetails)
+		rows = append(rows, n)
+	}
+	if a := action.DnsRequestAction; a != nil {
+		rows = append(rows, networkRow{direction: aws.String("OUTBOUND"), protocol: a.Protocol, domain: a.Domain, blocked: a.Blocked})
+	}
+	if a := action.KubernetesApiCallAction; a != nil {
+		n := networkRow{}
+		n.setRemote(a.RemoteIpDetails)
+		rows = append(rows, n)
+	}
+	if a := action.RdsLoginAttemptAction; a != nil {
+		n := networkRow{direction: aws.String("INBOUND")}
+		n.setRemote(a.RemoteIpDetails)
+		rows = append(rows, n)
+	}
+	return rows
+}
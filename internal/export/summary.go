@@ -0,0 +1,263 @@
+package export
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// summaryTopN is the number of finding types and resources a report
+// summary lists
+const summaryTopN = 10
+
+// summaryTopFindings is the number of most severe findings a report
+// summary keeps unless the report asks for another number, and
+// MaxTopFindings the most it can ask for
+const (
+	summaryTopFindings = 20
+	MaxTopFindings     = 1000
+)
+
+// summaryTrendBuckets is the most columns of a severity trend. A trend of
+// more days than this counts findings by week, and one of more weeks by
+// month.
+const summaryTrendBuckets = 31
+
+// exportSummary aggregates the findings of an export for the report
+// formats: counts by severity, type, account and region, and affected
+// resource, findings created each day by severity, the most severe
+// findings, and the outcome of each account and region. It keeps counts and
+// a few findings rather than every finding, so its memory grows with the
+// distinct types, regions, resources, and days only.
+type exportSummary struct {
+	Total      int
+	BySeverity map[string]int
+	byType     map[string]int
+	byRegion   map[string]int
+	byResource map[string]int
+	byDay      map[string]map[string]int
+	// top holds up to topLimit of the most severe findings, most severe
+	// first
+	top      []summaryFinding
+	topLimit int
+	// Regions lists the outcome of each account and region in export order
+	Regions []gd.RegionResult
+	// found counts the findings of the region being written, which
+	// addRegion records as its count
+	found int
+}
+
+// summaryCount is one row of a summary's ranking
+type summaryCount struct {
+	Name     string
+	Findings int
+}
+
+// summaryFinding is a finding listed by a summary
+type summaryFinding struct {
+	Severity   float64
+	Type       string
+	Title      string
+	Region     string
+	Resource   string
+	UpdatedAt  string
+	ConsoleURL string
+}
+
+// summaryPeriod is one column of a severity trend: the findings created in
+// the period starting on Start, by severity
+type summaryPeriod struct {
+	Start      string
+	BySeverity map[string]int
+}
+
+// newExportSummary returns an empty summary that keeps the top most severe
+// findings
+func newExportSummary(top int) *exportSummary {
+	return &exportSummary{
+		topLimit:   top,
+		BySeverity: make(map[string]int),
+		byType:     make(map[string]int),
+		byRegion:   make(map[string]int),
+		byResource: make(map[string]int),
+		byDay:      make(map[string]map[string]int),
+	}
+}
+
+// add counts a finding
+func (s *exportSummary) add(f types.Finding) {
+	s.Total++
+	s.found++
+	severity := aws.ToFloat64(f.Severity)
+	label := gd.SeverityLabel(severity)
+	s.BySeverity[label]++
+	s.byType[aws.ToString(f.Type)]++
+	region := summaryRegion(aws.ToString(f.AccountId), aws.ToString(f.Region))
+	s.byRegion[region]++
+	resource := findingResource(f)
+	if resource != "" {
+		s.byResource[resource]++
+	}
+	if created := aws.ToString(f.CreatedAt); len(created) >= len(time.DateOnly) {
+		day := created[:len(time.DateOnly)]
+		if s.byDay[day] == nil {
+			s.byDay[day] = make(map[string]int)
+		}
+		s.byDay[day][label]++
+	}
+
+	if s.topLimit == 0 {
+		return
+	}
+	updated := aws.ToString(f.UpdatedAt)
+	if len(s.top) == s.topLimit {
+		last := s.top[len(s.top)-1]
+		if severity < last.Severity || severity == last.Severity && updated <= last.UpdatedAt {
+			return
+		}
+		s.top = s.top[:len(s.top)-1]
+	}
+	finding := summaryFinding{
+		Severity:   severity,
+		Type:       aws.ToString(f.Type),
+		Title:      aws.ToString(f.Title),
+		Region:     region,
+		Resource:   resource,
+		UpdatedAt:  updated,
+		ConsoleURL: gd.ConsoleURL(aws.ToString(f.Partition), aws.ToString(f.Region), aws.ToString(f.Id)),
+	}
+	// The most severe come first, and the most recently updated of equal
+	// severity
+	i, _ := slices.BinarySearchFunc(s.top, finding, func(a, b summaryFinding) int {
+		if c := cmp.Compare(b.Severity, a.Severity); c != 0 {
+			return c
+		}
+		return strings.Compare(b.UpdatedAt, a.UpdatedAt)
+	})
+	s.top = slices.Insert(s.top, i, finding)
+}
+
+// addRegion records the outcome of an account and region, with the number
+// of findings added since the region before
+func (s *exportSummary) addRegion(result gd.RegionResult) {
+	result.Count = s.found
+	result.Findings = nil
+	s.found = 0
+	s.Regions = append(s.Regions, result)
+}
+
+// TopTypes ranks the finding types with the most findings
+func (s *exportSummary) TopTypes(n int) []summaryCount {
+	return topCounts(s.byType, n)
+}
+
+// TopResources ranks the affected resources with the most findings
+func (s *exportSummary) TopResources(n int) []summaryCount {
+	return topCounts(s.byResource, n)
+}
+
+// ByRegion ranks every account and region with findings
+func (s *exportSummary) ByRegion() []summaryCount {
+	return topCounts(s.byRegion, len(s.byRegion))
+}
+
+// TopFindings returns the most severe findings, most severe and then most
+// recently updated first
+func (s *exportSummary) TopFindings() []summaryFinding {
+	return s.top
+}
+
+// Trend returns the findings created each day by severity, from the first
+// day with findings to the last, or each week or month when there are too
+// many days to show
+func (s *exportSummary) Trend() []summaryPeriod {
+	if len(s.byDay) == 0 {
+		return nil
+	}
+	days := make([]time.Time, 0, len(s.byDay))
+	for day := range s.byDay {
+		if t, err := time.Parse(time.DateOnly, day); err == nil {
+			days = append(days, t)
+		}
+	}
+	if len(days) == 0 {
+		return nil
+	}
+	slices.SortFunc(days, func(a, b time.Time) int { return a.Compare(b) })
+	first, last := days[0], days[len(days)-1]
+
+	// period returns the start of the period a day falls in
+	period := func(t time.Time) time.Time { return t }
+	step := func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	if int(last.Sub(first).Hours()/24)+1 > summaryTrendBuckets {
+		period = func(t time.Time) time.Time { return t.AddDate(0, 0, -(int(t.Weekday())+6)%7) }
+		step = func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }
+		if int(period(last).Sub(period(first)).Hours()/24/7)+1 > summaryTrendBuckets {
+			period = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC) }
+			step = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+		}
+	}
+
+	var trend []summaryPeriod
+	index := make(map[time.Time]int)
+	for t := period(first); !t.After(last); t = step(t) {
+		index[t] = len(trend)
+		trend = append(trend, summaryPeriod{Start: t.Format(time.DateOnly), BySeverity: make(map[string]int)})
+	}
+	for _, day := range days {
+		for label, n := range s.byDay[day.Format(time.DateOnly)] {
+			trend[index[period(day)]].BySeverity[label] += n
+		}
+	}
+	return trend
+}
+
+// Failed counts the accounts and regions that could not be exported
+func (s *exportSummary) Failed() int {
+	failed := 0
+	for _, region := range s.Regions {
+		if region.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// topCounts returns the n names with the highest counts, most first and
+// then by name
+func topCounts(counts map[string]int, n int) []summaryCount {
+	ranked := make([]summaryCount, 0, len(counts))
+	for name, findings := range counts {
+		ranked = append(ranked, summaryCount{name, findings})
+	}
+	slices.SortFunc(ranked, func(a, b summaryCount) int {
+		if c := cmp.Compare(b.Findings, a.Findings); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return ranked[:min(n, len(ranked))]
+}
+
+// findingResource names the resource affected by f with gd.ResourceName, or
+// returns "" for a finding without one
+func findingResource(f types.Finding) string {
+	if f.Resource == nil {
+		return ""
+	}
+	return gd.ResourceName(aws.ToString(f.Resource.ResourceType), resourceID(f.Resource))
+}
+
+// summaryRegion labels an account and region of a summary
+func summaryRegion(account, region string) string {
+	if account == "" {
+		return region
+	}
+	return account + "/" + region
+}
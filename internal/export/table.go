@@ -0,0 +1,97 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+// Table is a report other than findings, such as GuardDuty usage, as rows
+// of cells under named columns. Each cell is a string or a float64.
+type Table struct {
+	// Name names the worksheet of an Excel workbook
+	Name    string
+	Columns []string
+	Rows    [][]any
+}
+
+// TableFormats are the export formats that tables are written in. Reports
+// are written as JSON from their own types rather than as tables.
+var TableFormats = []string{"csv", "ndjson", "xlsx"}
+
+// ValidTableFormat reports whether format is one of TableFormats
+func ValidTableFormat(format string) bool {
+	return slices.Contains(TableFormats, format)
+}
+
+// WriteTable writes table as CSV, honoring the sanitize, byte order mark,
+// and dialect options, as NDJSON with an object per row keyed by column, or as an Excel
+// workbook with a single sheet
+func WriteTable(out io.Writer, opts WriteOptions, table Table) error {
+	switch opts.Format {
+	case "csv":
+		return writeCSVTable(out, opts, table)
+	case "ndjson":
+		bw := bufio.NewWriter(out)
+		encoder := json.NewEncoder(bw)
+		for _, row := range table.Rows {
+			record := make(map[string]any, len(table.Columns))
+			for i, column := range table.Columns {
+				record[column] = row[i]
+			}
+			if err := encoder.Encode(record); err != nil {
+				return fmt.Errorf("error encoding row: %v", err)
+			}
+		}
+		return bw.Flush()
+	case "xlsx":
+		sheet := xlsxSheet{name: table.Name, rows: make([][]xlsxCell, 0, len(table.Rows)+1)}
+		header := make([]xlsxCell, len(table.Columns))
+		for i, column := range table.Columns {
+			header[i] = textCell(column)
+		}
+		sheet.rows = append(sheet.rows, header)
+		for _, row := range table.Rows {
+			cells := make([]xlsxCell, len(row))
+			for i, cell := range row {
+				if f, ok := cell.(float64); ok {
+					cells[i] = numberCell(f)
+				} else {
+					cells[i] = textCell(fmt.Sprint(cell))
+				}
+			}
+			sheet.rows = append(sheet.rows, cells)
+		}
+		return writeWorkbook(out, []xlsxSheet{sheet})
+	}
+	return fmt.Errorf("unsupported table format %q", opts.Format)
+}
+
+func writeCSVTable(out io.Writer, opts WriteOptions, table Table) error {
+	if opts.BOM {
+		if _, err := io.WriteString(out, utf8BOM); err != nil {
+			return fmt.Errorf("error writing CSV byte order mark: %v", err)
+		}
+	}
+	w := newRecordWriter(out, opts.CSV)
+	w.Write(table.Columns)
+	for _, row := range table.Rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			if f, ok := cell.(float64); ok {
+				cells[i] = strconv.FormatFloat(f, 'f', -1, 64)
+			} else {
+				cells[i] = fmt.Sprint(cell)
+			}
+			if opts.Sanitize {
+				cells[i] = sanitizeCell(cells[i])
+			}
+		}
+		w.Write(cells)
+	}
+	w.Flush()
+	return w.Error()
+}
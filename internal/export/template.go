@@ -0,0 +1,148 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// The templates a template file defines: finding is executed for each
+// finding, and header and footer, when defined, before the first and after
+// the last
+const (
+	templateHeader  = "header"
+	templateFinding = "finding"
+	templateFooter  = "footer"
+)
+
+// Template is a Go text/template that writes the findings of a template
+// export, for layouts no built-in format has, such as a proprietary ingest
+// format. The finding template is executed with each finding, as returned by
+// GuardDuty, and the header and footer templates with a TemplateSummary.
+type Template struct {
+	tmpl *template.Template
+}
+
+// TemplateSummary is what the header and footer templates are executed
+// with. Count and Regions are only known to the footer.
+type TemplateSummary struct {
+	GeneratedAt time.Time
+	Count       int
+	Regions     []gd.RegionResult
+}
+
+// templateFuncs are the functions templates may call besides the built-in
+// ones: column for the value of an export column, and json, xml, and csv to
+// escape a value for those formats
+var templateFuncs = template.FuncMap{
+	"column": ColumnValue,
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"xml": func(s string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	},
+	"csv": func(cells ...string) (string, error) {
+		var b strings.Builder
+		w := csv.NewWriter(&b)
+		w.Write(cells)
+		w.Flush()
+		return strings.TrimSuffix(b.String(), "\n"), w.Error()
+	},
+}
+
+// ParseTemplate parses the text of a template file, which defines the
+// finding template and optionally the header and footer ones, such as
+// {{define "finding"}}{{.Id}},{{column . "SeverityLabel"}}{{"\n"}}{{end}}.
+// Text outside the definitions is ignored.
+func ParseTemplate(name, text string) (*Template, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template %s: %v", name, err)
+	}
+	if tmpl.Lookup(templateFinding) == nil {
+		return nil, fmt.Errorf("template %s does not define %q", name, templateFinding)
+	}
+	return &Template{tmpl: tmpl}, nil
+}
+
+// LoadTemplate reads and parses the template file at path
+func LoadTemplate(path string) (*Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading template: %v", err)
+	}
+	return ParseTemplate(path, string(data))
+}
+
+// templateWriter executes the export's template for each finding, between
+// its header and footer. Failed regions are passed to the footer rather
+// than written as findings.
+type templateWriter struct {
+	bw      *bufio.Writer
+	tmpl    *template.Template
+	summary TemplateSummary
+}
+
+func newTemplateWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	w := &templateWriter{bw: bufio.NewWriter(out), summary: TemplateSummary{GeneratedAt: time.Now().UTC()}}
+	if opts.Template != nil {
+		// The export's copy of the template computes its own columns too
+		w.tmpl = opts.Template.tmpl
+		if tmpl, err := w.tmpl.Clone(); err == nil {
+			w.tmpl = tmpl.Funcs(template.FuncMap{"column": opts.ColumnValue})
+		}
+	}
+	return w
+}
+
+func (w *templateWriter) WriteHeader() error {
+	if w.tmpl == nil {
+		return fmt.Errorf("the template format requires a template")
+	}
+	return w.execute(templateHeader, w.summary)
+}
+
+func (w *templateWriter) WriteFinding(finding types.Finding) error {
+	w.summary.Count++
+	return w.execute(templateFinding, finding)
+}
+
+func (w *templateWriter) WriteRegion(result gd.RegionResult) error {
+	w.summary.Regions = append(w.summary.Regions, result)
+	return nil
+}
+
+func (w *templateWriter) Close() error {
+	if w.tmpl != nil {
+		if err := w.execute(templateFooter, w.summary); err != nil {
+			return err
+		}
+	}
+	return w.bw.Flush()
+}
+
+// execute runs one of the template's definitions, if it has it
+func (w *templateWriter) execute(name string, data any) error {
+	if w.tmpl.Lookup(name) == nil {
+		return nil
+	}
+	if err := w.tmpl.ExecuteTemplate(w.bw, name, data); err != nil {
+		return fmt.Errorf("error executing %s template: %v", name, err)
+	}
+	return nil
+}
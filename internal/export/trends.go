@@ -0,0 +1,183 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"time"
+
+	"guardduty/internal/gd"
+)
+
+// Trends describes how findings developed over a number of weeks, from the
+// findings kept across export runs
+type Trends struct {
+	From  time.Time    `json:"from"`
+	To    time.Time    `json:"to"`
+	Weeks []TrendsWeek `json:"weeks"`
+	// MeanActiveDays is how long the findings resolved in the period were
+	// active on average, from creation until archived
+	MeanActiveDays float64 `json:"meanActiveDays"`
+	// TopTypes are the finding types that recurred most in the period
+	TopTypes []RecurringType `json:"topTypes"`
+}
+
+// TrendsWeek counts the findings created and resolved in a week starting on
+// a Monday, UTC. BySeverity counts the new findings by SeverityLabel.
+type TrendsWeek struct {
+	Week           string         `json:"week"`
+	New            int            `json:"new"`
+	Resolved       int            `json:"resolved"`
+	BySeverity     map[string]int `json:"bySeverity"`
+	MeanActiveDays float64        `json:"meanActiveDays"`
+}
+
+// RecurringType is a finding type with its findings and the times GuardDuty
+// saw them occur in total
+type RecurringType struct {
+	Type        string `json:"type"`
+	Findings    int    `json:"findings"`
+	Occurrences int    `json:"occurrences"`
+}
+
+// TrendsTable returns the weeks of a trends report as a table
+func TrendsTable(trends Trends) Table {
+	table := Table{Name: "Trends", Columns: []string{"Week", "New", "Resolved"}}
+	table.Columns = append(table.Columns, gd.SeverityLabels...)
+	table.Columns = append(table.Columns, "MeanActiveDays")
+	for _, week := range trends.Weeks {
+		row := []any{week.Week, float64(week.New), float64(week.Resolved)}
+		for _, label := range gd.SeverityLabels {
+			row = append(row, float64(week.BySeverity[label]))
+		}
+		table.Rows = append(table.Rows, append(row, week.MeanActiveDays))
+	}
+	return table
+}
+
+// WriteTrendsHTML writes a trends report as a standalone HTML page in a
+// locale, with charts drawn as inline SVG of the new findings of each week by
+// severity, the findings created and resolved each week, and the top
+// recurring types
+func WriteTrendsHTML(out io.Writer, trends Trends, locale string) error {
+	l := localeOf(locale)
+	bw := bufio.NewWriter(out)
+	title := l.text("GuardDuty Findings Trends")
+	bw.WriteString(htmlHeader(l, title))
+	fmt.Fprintf(bw, "<h1>%s</h1>\n<p class=\"generated\">%s</p>\n", html.EscapeString(title),
+		html.EscapeString(l.sprintf("%s to %s, generated %s", l.date(trends.From), l.date(trends.To), l.generated())))
+
+	var created, resolved int
+	for _, week := range trends.Weeks {
+		created += week.New
+		resolved += week.Resolved
+	}
+	bw.WriteString(`<section class="totals">`)
+	fmt.Fprintf(bw, `<div class="total"><span>%d</span>%s</div>`, created, html.EscapeString(l.text("New")))
+	fmt.Fprintf(bw, `<div class="total"><span>%d</span>%s</div>`, resolved, html.EscapeString(l.text("Resolved")))
+	fmt.Fprintf(bw, `<div class="total"><span>%.1f</span>%s</div>`, trends.MeanActiveDays, html.EscapeString(l.text("Mean days active")))
+	bw.WriteString("</section>\n")
+
+	writeWeeklyChart(bw, l, l.text("New Findings by Severity"), trends.Weeks, gd.SeverityLabels, severityColors, true,
+		func(week TrendsWeek, series string) int { return week.BySeverity[series] })
+	writeWeeklyChart(bw, l, l.text("New and Resolved Findings"), trends.Weeks, []string{"New", "Resolved"},
+		map[string]string{"New": "#d13212", "Resolved": "#1d8102"}, false,
+		func(week TrendsWeek, series string) int {
+			if series == "New" {
+				return week.New
+			}
+			return week.Resolved
+		})
+	types := make([]summaryCount, len(trends.TopTypes))
+	for i, t := range trends.TopTypes {
+		types[i] = summaryCount{t.Type, t.Occurrences}
+	}
+	writeBarChart(bw, l.text("Top Recurring Finding Types"), types, nil)
+
+	table := TrendsTable(trends)
+	fmt.Fprintf(bw, "<h2>%s</h2>\n<table><tr>", html.EscapeString(l.text("Weeks")))
+	for _, column := range table.Columns {
+		fmt.Fprintf(bw, "<th>%s</th>", html.EscapeString(l.text(column)))
+	}
+	bw.WriteString("</tr>\n")
+	for _, row := range table.Rows {
+		bw.WriteString("<tr>")
+		for _, cell := range row {
+			if f, ok := cell.(float64); ok {
+				cell = strconv.FormatFloat(f, 'f', -1, 64)
+			}
+			fmt.Fprintf(bw, "<td>%s</td>", html.EscapeString(fmt.Sprint(cell)))
+		}
+		bw.WriteString("</tr>\n")
+	}
+	bw.WriteString("</table>\n</body>\n</html>\n")
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	return nil
+}
+
+// writeWeeklyChart writes a column chart as inline SVG under a heading, with
+// the series of each week in their colors, stacked in one column or side by
+// side, and a legend naming them in a locale. Charts without any findings
+// are left out.
+func writeWeeklyChart(bw *bufio.Writer, l reportLocale, title string, weeks []TrendsWeek, series []string, colors map[string]string, stacked bool, value func(week TrendsWeek, series string) int) {
+	most := 0
+	for _, week := range weeks {
+		total := 0
+		for _, s := range series {
+			if stacked {
+				total += value(week, s)
+			} else {
+				total = max(total, value(week, s))
+			}
+		}
+		most = max(most, total)
+	}
+	if most == 0 {
+		return
+	}
+	const columnWidth, chartHeight, labelHeight, legendHeight = 48, 200, 40, 24
+	width := max(len(weeks)*columnWidth, 300)
+	height := legendHeight + chartHeight + labelHeight
+	fmt.Fprintf(bw, "<h2>%s</h2>\n", html.EscapeString(title))
+	fmt.Fprintf(bw, `<svg width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="%s">`,
+		width, height, width, height, html.EscapeString(title))
+	for i, s := range series {
+		x := i * 110
+		fmt.Fprintf(bw, `<rect x="%d" y="4" width="12" height="12" fill="%s"/><text x="%d" y="15">%s</text>`,
+			x, colors[s], x+16, html.EscapeString(l.text(s)))
+	}
+	const barsWidth = columnWidth - 16
+	for i, week := range weeks {
+		x := i*columnWidth + 8
+		bottom := legendHeight + chartHeight
+		y, total := bottom, 0
+		for j, s := range series {
+			n := value(week, s)
+			if n == 0 {
+				continue
+			}
+			h := max(n*chartHeight/most, 1)
+			barX, barY, barWidth := x, bottom-h, barsWidth
+			if stacked {
+				y -= h
+				barY = y
+				total += n
+			} else {
+				barWidth = barsWidth / len(series)
+				barX = x + j*barWidth
+			}
+			fmt.Fprintf(bw, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"><title>%s %s: %d</title></rect>`,
+				barX, barY, barWidth, h, colors[s], week.Week, html.EscapeString(l.text(s)), n)
+		}
+		if stacked && total > 0 {
+			fmt.Fprintf(bw, `<text x="%d" y="%d" text-anchor="middle">%d</text>`, x+barsWidth/2, y-4, total)
+		}
+		fmt.Fprintf(bw, `<text x="%d" y="%d" text-anchor="middle">%s</text>`,
+			x+barsWidth/2, bottom+16, week.Week[5:])
+	}
+	bw.WriteString("</svg>\n")
+}
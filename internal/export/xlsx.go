@@ -0,0 +1,338 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+// xlsxCell is a single worksheet cell holding either text or a number
+type xlsxCell struct {
+	text   string
+	number *float64
+}
+
+func textCell(s string) xlsxCell { return xlsxCell{text: s} }
+
+func numberCell(f float64) xlsxCell { return xlsxCell{number: &f} }
+
+// xlsxSheet is a worksheet whose first row is a frozen, bold header
+type xlsxSheet struct {
+	name string
+	rows [][]xlsxCell
+}
+
+// xlsxWriter writes an Excel workbook with a summary sheet of per-severity
+// counts, pages, API calls, and time for each account and region, ending
+// with the export's totals, followed by one sheet per region.
+// Text is stored as inline strings so long IDs and timestamps are not
+// reinterpreted by Excel. The regions of every account share a sheet, so
+// the rows are kept in memory until the workbook is written on Close.
+type xlsxWriter struct {
+	out     io.Writer
+	columns []string
+	value   columnValuer
+	headers []string
+	summary xlsxSheet
+	header  []xlsxCell
+	// Findings from every account share their region's sheet
+	sheets       []*xlsxSheet
+	regionSheets map[string]*xlsxSheet
+	// counts and accountID describe the findings written since the last
+	// region, which WriteRegion adds to the summary
+	counts    map[string]int
+	found     int
+	accountID string
+	// totals sums the regions for the summary's last row
+	totals gd.RegionResult
+}
+
+func newXLSXWriter(out io.Writer, opts WriteOptions) FindingWriter {
+	return &xlsxWriter{out: out, columns: opts.Columns, value: opts.ColumnValue, headers: opts.header(), regionSheets: make(map[string]*xlsxSheet), counts: make(map[string]int)}
+}
+
+func (w *xlsxWriter) WriteHeader() error {
+	w.summary = xlsxSheet{name: "Summary", rows: [][]xlsxCell{{
+		textCell("Region"), textCell("AccountId"), textCell("Status"), textCell("Total"),
+		textCell("Critical"), textCell("High"), textCell("Medium"), textCell("Low"),
+		textCell("Pages"), textCell("ApiCalls"), textCell("Seconds"),
+	}}}
+	w.totals = gd.RegionResult{BySeverity: make(map[string]int)}
+	w.header = make([]xlsxCell, 0, len(w.headers))
+	for _, column := range w.headers {
+		w.header = append(w.header, textCell(column))
+	}
+	return nil
+}
+
+// sheetFor returns the sheet of region, adding it after the existing ones
+func (w *xlsxWriter) sheetFor(region string) *xlsxSheet {
+	sheet, ok := w.regionSheets[region]
+	if !ok {
+		sheet = &xlsxSheet{name: region, rows: [][]xlsxCell{w.header}}
+		w.regionSheets[region] = sheet
+		w.sheets = append(w.sheets, sheet)
+	}
+	return sheet
+}
+
+func (w *xlsxWriter) WriteFinding(finding types.Finding) error {
+	w.counts[gd.SeverityLabel(aws.ToFloat64(finding.Severity))]++
+	w.found++
+	w.accountID = aws.ToString(finding.AccountId)
+	sheet := w.sheetFor(aws.ToString(finding.Region))
+	sheet.rows = append(sheet.rows, xlsxRow(finding, w.columns, w.value))
+	return nil
+}
+
+func (w *xlsxWriter) WriteRegion(result gd.RegionResult) error {
+	// A region that was not exported has no counts, but still its calls
+	noCounts := []xlsxCell{textCell(""), textCell(""), textCell(""), textCell(""), textCell("")}
+	calls := []xlsxCell{
+		numberCell(float64(result.Pages)), numberCell(float64(result.Calls)),
+		numberCell(float64(result.Duration.Milliseconds()) / 1000),
+	}
+	w.totals.Pages += result.Pages
+	w.totals.Calls += result.Calls
+	switch {
+	case result.Skipped != "":
+		w.summary.rows = append(w.summary.rows, slices.Concat([]xlsxCell{
+			textCell(result.Region), textCell(result.Account), textCell("Skipped: " + result.Skipped),
+		}, noCounts, calls))
+	case result.Err != nil:
+		w.summary.rows = append(w.summary.rows, slices.Concat([]xlsxCell{
+			textCell(result.Region), textCell(result.Account), textCell("Error: " + result.Err.Error()),
+		}, noCounts, calls))
+		sheet := w.sheetFor(result.Region)
+		sheet.rows = append(sheet.rows, xlsxRow(errorFinding(result), w.columns, w.value))
+	default:
+		w.sheetFor(result.Region)
+		accountID := result.Account
+		if w.found > 0 {
+			accountID = w.accountID
+		}
+		w.summary.rows = append(w.summary.rows, append([]xlsxCell{
+			textCell(result.Region), textCell(accountID), textCell("OK"), numberCell(float64(w.found)),
+			numberCell(float64(w.counts["Critical"])), numberCell(float64(w.counts["High"])),
+			numberCell(float64(w.counts["Medium"])), numberCell(float64(w.counts["Low"])),
+		}, calls...))
+	}
+	w.totals.Count += w.found
+	for severity, n := range w.counts {
+		w.totals.BySeverity[severity] += n
+	}
+	w.counts = make(map[string]int)
+	w.found = 0
+	return nil
+}
+
+// Close ends the summary with a row of the export's totals and writes the
+// workbook
+func (w *xlsxWriter) Close() error {
+	if len(w.summary.rows) > 1 {
+		w.summary.rows = append(w.summary.rows, []xlsxCell{
+			textCell("Total"), textCell(""), textCell(""), numberCell(float64(w.totals.Count)),
+			numberCell(float64(w.totals.BySeverity["Critical"])), numberCell(float64(w.totals.BySeverity["High"])),
+			numberCell(float64(w.totals.BySeverity["Medium"])), numberCell(float64(w.totals.BySeverity["Low"])),
+			numberCell(float64(w.totals.Pages)), numberCell(float64(w.totals.Calls)),
+		})
+	}
+	all := []xlsxSheet{w.summary}
+	for _, sheet := range w.sheets {
+		all = append(all, *sheet)
+	}
+	return writeWorkbook(w.out, all)
+}
+
+// xlsxRow returns the cells of columns for a finding, as value of the export
+// computes them. Severity and Count are stored as numbers so they can
+// be sorted and summed.
+func xlsxRow(finding types.Finding, columns []string, value columnValuer) []xlsxCell {
+	row := make([]xlsxCell, len(columns))
+	for i, column := range columns {
+		cell := value(finding, column)
+		row[i] = textCell(cell)
+		if column == "Severity" || column == "Count" {
+			if f, err := strconv.ParseFloat(cell, 64); err == nil {
+				row[i] = numberCell(f)
+			}
+		}
+	}
+	return row
+}
+
+// writeWorkbook writes sheets as a minimal Office Open XML workbook
+func writeWorkbook(out io.Writer, sheets []xlsxSheet) error {
+	zw := zip.NewWriter(out)
+
+	var contentTypes, workbook, workbookRels strings.Builder
+	contentTypes.WriteString(xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	workbook.WriteString(xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	workbookRels.WriteString(xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+
+	names := make(map[string]bool)
+	for i, sheet := range sheets {
+		n := i + 1
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(uniqueSheetName(sheet.name, names)), n, n)
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+	}
+	fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, len(sheets)+1)
+	contentTypes.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets></workbook>`)
+	workbookRels.WriteString(`</Relationships>`)
+
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", contentTypes.String()},
+		{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", workbook.String()},
+		{"xl/_rels/workbook.xml.rels", workbookRels.String()},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, part := range parts {
+		w, err := zw.Create(part.name)
+		if err != nil {
+			return fmt.Errorf("error writing %s: %v", part.name, err)
+		}
+		if _, err := io.WriteString(w, part.body); err != nil {
+			return fmt.Errorf("error writing %s: %v", part.name, err)
+		}
+	}
+
+	for i, sheet := range sheets {
+		w, err := zw.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1))
+		if err != nil {
+			return fmt.Errorf("error writing sheet %s: %v", sheet.name, err)
+		}
+		if err := writeSheet(w, sheet); err != nil {
+			return fmt.Errorf("error writing sheet %s: %v", sheet.name, err)
+		}
+	}
+	return zw.Close()
+}
+
+// writeSheet writes one worksheet with a frozen header row and columns sized
+// to their longest value
+func writeSheet(out io.Writer, sheet xlsxSheet) error {
+	bw := bufio.NewWriter(out)
+	bw.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	bw.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+
+	widths := columnWidths(sheet.rows)
+	if len(widths) > 0 {
+		bw.WriteString(`<cols>`)
+		for i, width := range widths {
+			fmt.Fprintf(bw, `<col min="%d" max="%d" width="%d" customWidth="1"/>`, i+1, i+1, width)
+		}
+		bw.WriteString(`</cols>`)
+	}
+
+	bw.WriteString(`<sheetData>`)
+	for r, row := range sheet.rows {
+		fmt.Fprintf(bw, `<row r="%d">`, r+1)
+		style := ""
+		if r == 0 {
+			style = ` s="1"`
+		}
+		for c, cell := range row {
+			ref := columnName(c) + strconv.Itoa(r+1)
+			if cell.number != nil {
+				fmt.Fprintf(bw, `<c r="%s"%s><v>%s</v></c>`, ref, style, strconv.FormatFloat(*cell.number, 'f', -1, 64))
+			} else {
+				fmt.Fprintf(bw, `<c r="%s"%s t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, style, xmlEscape(cell.text))
+			}
+		}
+		bw.WriteString(`</row>`)
+	}
+	bw.WriteString(`</sheetData></worksheet>`)
+	return bw.Flush()
+}
+
+// columnWidths returns a width for each column based on its longest value,
+// capped so long descriptions don't produce unusably wide columns
+func columnWidths(rows [][]xlsxCell) []int {
+	var widths []int
+	for _, row := range rows {
+		for c, cell := range row {
+			text := cell.text
+			if cell.number != nil {
+				text = strconv.FormatFloat(*cell.number, 'f', -1, 64)
+			}
+			width := min(max(utf8.RuneCountInString(text)+2, 8), 80)
+			if c >= len(widths) {
+				widths = append(widths, width)
+			} else if width > widths[c] {
+				widths[c] = width
+			}
+		}
+	}
+	return widths
+}
+
+// columnName converts a zero-based column index to its letters (A, B, ..., AA)
+func columnName(index int) string {
+	name := ""
+	for index >= 0 {
+		name = string(rune('A'+index%26)) + name
+		index = index/26 - 1
+	}
+	return name
+}
+
+// uniqueSheetName trims name to Excel's 31-character limit, replaces
+// characters Excel forbids, and de-duplicates it against used
+func uniqueSheetName(name string, used map[string]bool) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if utf8.RuneCountInString(name) > 31 {
+		name = string([]rune(name)[:31])
+	}
+
+	candidate := name
+	for n := 2; used[strings.ToLower(candidate)]; n++ {
+		suffix := fmt.Sprintf(" (%d)", n)
+		candidate = string([]rune(name)[:min(utf8.RuneCountInString(name), 31-len(suffix))]) + suffix
+	}
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// xmlEscape escapes s for use in XML text and attribute values
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// xlsxStyles defines the default cell style and a bold style for header rows
+const xlsxStyles = xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+	`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>` +
+	`</styleSheet>`
@@ -0,0 +1,149 @@
+package gd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// RoleSessionName identifies the exporter's sessions in CloudTrail
+const RoleSessionName = "guardduty-exporter"
+
+// Role is an IAM role in another account that the exporter assumes to
+// read that account's findings
+type Role struct {
+	ARN        string `yaml:"arn"`
+	ExternalID string `yaml:"externalId"`
+	// selfAccount is set instead of ARN for a discovered account that is the
+	// exporter's own, which is read with the exporter's credentials
+	selfAccount string
+}
+
+// accountID returns the account the role belongs to
+func (r Role) accountID() string {
+	if r.selfAccount != "" {
+		return r.selfAccount
+	}
+	return accountIDFromARN(r.ARN)
+}
+
+// Validate reports whether the role ARN is well formed
+func (r Role) Validate() error {
+	parsed, err := arn.Parse(r.ARN)
+	if err != nil || parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+		return fmt.Errorf("invalid role ARN %q", r.ARN)
+	}
+	return nil
+}
+
+// accountConfig is the AWS configuration used for one account in an export
+type accountConfig struct {
+	// accountID is empty when the exporter's own credentials are used
+	accountID string
+	roleARN   string
+	cfg       aws.Config
+	clients   Clients
+	// regions holds the configurations of the regions the credential map
+	// gives other credentials
+	regions map[string]aws.Config
+}
+
+// name identifies the account in log messages
+func (a accountConfig) name() string {
+	if a.accountID == "" {
+		return "the default account"
+	}
+	return "account " + a.accountID
+}
+
+// regionConfig returns a copy of the account's configuration for region,
+// or of the one the credential map gives the region. The account's
+// configuration is shared by every target of an export, and of concurrent
+// exports, so it is never changed: each target builds its clients from its
+// own copy.
+func (a accountConfig) regionConfig(region string) aws.Config {
+	cfg, ok := a.regions[region]
+	if !ok {
+		cfg = a.cfg
+	}
+	cfg = cfg.Copy()
+	cfg.Region = region
+	return cfg
+}
+
+// guardDuty returns a GuardDuty client for the account in region whose
+// calls are paced by limiter
+func (a accountConfig) guardDuty(region string, limiter *rateLimiter) GuardDutyAPI {
+	return a.clients.GuardDuty(a.regionConfig(region), a.accountID, withRateLimit(limiter))
+}
+
+// accountConfigs returns the configuration for each account in the export:
+// the credentials of the export's profile when no roles are given, with the
+// credential map's rules for its account once ResolveAccounts has looked it
+// up, otherwise
+// one assumed-role configuration per role, with those of the credential map
+// in the regions it covers
+func accountConfigs(opts FetchOptions) []accountConfig {
+	clients := opts.clients()
+	if len(opts.Roles) == 0 {
+		return []accountConfig{{cfg: opts.AWSConfig, clients: clients, regions: opts.mappedConfigs(opts.ownAccount)}}
+	}
+
+	accounts := make([]accountConfig, 0, len(opts.Roles))
+	for _, role := range opts.Roles {
+		if role.selfAccount != "" {
+			accounts = append(accounts, accountConfig{accountID: role.selfAccount, cfg: opts.AWSConfig, clients: clients, regions: opts.mappedConfigs(role.selfAccount)})
+			continue
+		}
+		accounts = append(accounts, accountConfig{
+			accountID: role.accountID(),
+			roleARN:   role.ARN,
+			cfg:       assumeRoleConfig(opts.AWSConfig, role),
+			clients:   clients,
+			regions:   opts.mappedConfigs(role.accountID()),
+		})
+	}
+	return accounts
+}
+
+// AccountKeys identifies each account of the export as RateLimiters do: by
+// its account ID, or by the export's profile when its own credentials are
+// used without roles
+func (o FetchOptions) AccountKeys() []string {
+	if len(o.Roles) == 0 {
+		return []string{"profile " + o.Profile}
+	}
+	keys := make([]string, 0, len(o.Roles))
+	for _, role := range o.Roles {
+		keys = append(keys, role.accountID())
+	}
+	return keys
+}
+
+// assumeRoleConfig returns a copy of base whose credentials come from
+// assuming role. Credentials are cached and refreshed before they expire.
+func assumeRoleConfig(base aws.Config, role Role) aws.Config {
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(base), role.ARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = RoleSessionName
+		if role.ExternalID != "" {
+			o.ExternalID = aws.String(role.ExternalID)
+		}
+	})
+
+	cfg := base.Copy()
+	cfg.Credentials = aws.NewCredentialsCache(provider)
+	return cfg
+}
+
+// accountIDFromARN returns the account ID of an ARN, or "" if it can't be parsed
+func accountIDFromARN(roleARN string) string {
+	parsed, err := arn.Parse(roleARN)
+	if err != nil {
+		return ""
+	}
+	return parsed.AccountID
+}
@@ -0,0 +1,122 @@
+package gd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+
+	"guardduty/internal/telemetry"
+)
+
+// maxArchiveFindingsBatch is the most finding IDs ArchiveFindings accepts in one call
+const maxArchiveFindingsBatch = 50
+
+// ArchiveReport is the outcome of archiving an export's findings
+type ArchiveReport struct {
+	DryRun bool `json:"dryRun,omitempty"`
+	// Findings is the number of findings archived, or that would be in a dry run
+	Findings  int               `json:"findings"`
+	Detectors []ArchiveDetector `json:"detectors"`
+	Errors    []string          `json:"errors,omitempty"`
+}
+
+// ArchiveDetector counts the findings archived for one detector
+type ArchiveDetector struct {
+	Account    string `json:"account,omitempty"`
+	Region     string `json:"region"`
+	DetectorID string `json:"detectorId"`
+	Findings   int    `json:"findings"`
+}
+
+// archiveGroup is the active findings of one detector in an export
+type archiveGroup struct {
+	account    accountConfig
+	region     string
+	detectorID string
+	ids        []string
+}
+
+// archiveGroups collects the exported findings that are still active by
+// account, region, and detector, in export order and then detector order.
+// The results must come from an export with FetchOptions.Archiving set.
+func archiveGroups(opts FetchOptions, results []RegionResult) []*archiveGroup {
+	accounts := make(map[string]accountConfig)
+	for _, account := range accountConfigs(opts) {
+		accounts[account.accountID] = account
+	}
+	var groups []*archiveGroup
+	for _, result := range results {
+		detectorIDs := make([]string, 0, len(result.Active))
+		for detectorID := range result.Active {
+			detectorIDs = append(detectorIDs, detectorID)
+		}
+		sort.Strings(detectorIDs)
+		for _, detectorID := range detectorIDs {
+			groups = append(groups, &archiveGroup{account: accounts[result.Account], region: result.Region, detectorID: detectorID, ids: result.Active[detectorID]})
+		}
+	}
+	return groups
+}
+
+// Archive archives the active findings of a stored export through
+// ArchiveFindings, in batches of maxArchiveFindingsBatch. The export has
+// already succeeded, so a failed batch is recorded in the report and the
+// remaining batches are still archived. A dry run only logs the findings.
+func Archive(ctx context.Context, opts FetchOptions, dryRun bool, results []RegionResult) *ArchiveReport {
+	log := telemetry.Logger(ctx)
+	report := &ArchiveReport{DryRun: dryRun, Detectors: []ArchiveDetector{}}
+	for _, group := range archiveGroups(opts, results) {
+		label := TargetLabel(group.account.accountID, group.region)
+		detector := ArchiveDetector{Account: group.account.accountID, Region: group.region, DetectorID: group.detectorID}
+		if report.DryRun {
+			log.Info("Dry run: would archive findings", "region", label, "detector", group.detectorID, "findings", len(group.ids))
+			for start := 0; start < len(group.ids); start += maxArchiveFindingsBatch {
+				log.Info("Would archive", "region", label, "detector", group.detectorID,
+					"finding_ids", strings.Join(group.ids[start:min(start+maxArchiveFindingsBatch, len(group.ids))], ","))
+			}
+			detector.Findings = len(group.ids)
+			report.Findings += detector.Findings
+			report.Detectors = append(report.Detectors, detector)
+			continue
+		}
+
+		client := group.account.guardDuty(group.region, opts.Limiters.get(opts.Profile, group.account.accountID, group.region))
+		var errs []string
+		detector.Findings, errs = archiveDetector(ctx, client, group, opts)
+		report.Errors = append(report.Errors, errs...)
+		log.Info("Archived findings", "region", label, "detector", group.detectorID, "archived", detector.Findings, "findings", len(group.ids))
+		report.Findings += detector.Findings
+		report.Detectors = append(report.Detectors, detector)
+	}
+	return report
+}
+
+// archiveDetector archives the findings of group in batches and returns
+// how many were archived and the errors of the batches that failed
+func archiveDetector(ctx context.Context, client ArchiveAPI, group *archiveGroup, opts FetchOptions) (int, []string) {
+	log := telemetry.Logger(ctx)
+	label := TargetLabel(group.account.accountID, group.region)
+	var archived int
+	var errs []string
+	for start := 0; start < len(group.ids); start += maxArchiveFindingsBatch {
+		batch := group.ids[start:min(start+maxArchiveFindingsBatch, len(group.ids))]
+		callCtx, cancel := callContext(ctx, opts.CallTimeout)
+		_, err := client.ArchiveFindings(callCtx, &guardduty.ArchiveFindingsInput{
+			DetectorId: aws.String(group.detectorID),
+			FindingIds: batch,
+		})
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("error archiving %d findings for detector %s in region %s: %v", len(batch), group.detectorID, label, err)
+			log.Error("Error archiving findings", "region", label, "detector", group.detectorID, "findings", len(batch), "error", err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		archived += len(batch)
+	}
+	return archived, errs
+}
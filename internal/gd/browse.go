@@ -0,0 +1,95 @@
+package gd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// MaxFindingsPage is the most findings a page of BrowseFindings holds, the
+// most that ListFindings returns at once
+const MaxFindingsPage = 50
+
+// FindingsPage is a page of the findings of one account and region that
+// match an export's filter, in the export's order. NextToken continues with
+// the next page, and is empty on the last.
+type FindingsPage struct {
+	Region     string
+	DetectorID string
+	Findings   []types.Finding
+	NextToken  string
+}
+
+// BrowseFindings returns a page of up to size findings of the one account
+// and region of opts that match opts.Filter, sorted by opts.Sort, to browse
+// them before an export: the first page, or the one that token, the
+// NextToken of the page before, continues with. A page may hold fewer
+// findings when the filter leaves out some of those GuardDuty listed, even
+// none before the last.
+func BrowseFindings(ctx context.Context, opts FetchOptions, size int, token string) (FindingsPage, error) {
+	client, detectorID, err := targetDetector(ctx, opts)
+	if err != nil {
+		return FindingsPage{}, err
+	}
+	page := FindingsPage{Region: opts.Regions[0], DetectorID: detectorID, Findings: []types.Finding{}}
+	input := &guardduty.ListFindingsInput{
+		DetectorId:      aws.String(detectorID),
+		FindingCriteria: opts.Filter.criteria(),
+		SortCriteria:    opts.Sort.criteria(),
+		MaxResults:      aws.Int32(int32(min(max(size, 1), MaxFindingsPage))),
+	}
+	if token != "" {
+		input.NextToken = aws.String(token)
+	}
+	listCtx, cancel := callContext(ctx, opts.CallTimeout)
+	output, err := client.ListFindings(listCtx, input)
+	cancel()
+	if err != nil {
+		return page, callError(err, "error listing findings for detector %s", detectorID)
+	}
+	page.NextToken = aws.ToString(output.NextToken)
+	findings, err := getFindingsInBatches(ctx, client, detectorID, output.FindingIds, opts)
+	if err != nil {
+		return page, callError(err, "error getting detailed findings for detector %s", detectorID)
+	}
+	// GetFindings does not keep the order of the IDs it is given
+	order := make(map[string]int, len(output.FindingIds))
+	for i, id := range output.FindingIds {
+		order[id] = i
+	}
+	ordered := make([]types.Finding, len(output.FindingIds))
+	for _, finding := range findings {
+		ordered[order[aws.ToString(finding.Id)]] = finding
+	}
+	for _, finding := range ordered {
+		if finding.Id != nil && opts.Filter.matches(finding) {
+			page.Findings = append(page.Findings, finding)
+		}
+	}
+	return page, nil
+}
+
+// GetFinding returns the complete finding with the given ID from a detector
+// of the one account and region of opts
+func GetFinding(ctx context.Context, opts FetchOptions, detectorID, id string) (types.Finding, error) {
+	client, err := targetClient(opts)
+	if err != nil {
+		return types.Finding{}, err
+	}
+	callCtx, cancel := callContext(ctx, opts.CallTimeout)
+	output, err := client.GetFindings(callCtx, &guardduty.GetFindingsInput{
+		DetectorId: aws.String(detectorID),
+		FindingIds: []string{id},
+	})
+	cancel()
+	if err != nil {
+		return types.Finding{}, callError(err, "error getting finding %s for detector %s", id, detectorID)
+	}
+	if len(output.Findings) == 0 {
+		return types.Finding{}, &CallError{Message: fmt.Sprintf("finding %s not found in detector %s", id, detectorID), NotFound: true}
+	}
+	return output.Findings[0], nil
+}
@@ -0,0 +1,63 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/smithy-go"
+)
+
+// CallError is a GuardDuty call made for a request in one account and
+// region that failed. Rejected is set when the request itself was at fault,
+// such as a filter name that is taken, an unknown finding ID, or a region
+// without GuardDuty, rather than credentials or the service. NotFound is
+// set when what the request names does not exist.
+type CallError struct {
+	Message  string
+	Rejected bool
+	NotFound bool
+}
+
+func (e *CallError) Error() string {
+	return e.Message
+}
+
+// callError describes a failed GuardDuty call
+func callError(err error, format string, args ...any) error {
+	var apiErr smithy.APIError
+	rejected := errors.As(err, &apiErr) && apiErr.ErrorCode() == "BadRequestException"
+	return &CallError{Message: fmt.Sprintf(format+": %v", append(args, err)...), Rejected: rejected}
+}
+
+// targetClient returns a client for the one account and region of opts,
+// which requests that act on a single detector select
+func targetClient(opts FetchOptions) (GuardDutyAPI, error) {
+	accounts := accountConfigs(opts)
+	if len(accounts) != 1 || len(opts.Regions) != 1 {
+		return nil, fmt.Errorf("exactly one account and region must be selected")
+	}
+	account, region := accounts[0], opts.Regions[0]
+	return account.guardDuty(region, opts.Limiters.get(opts.Profile, account.accountID, region)), nil
+}
+
+// targetDetector returns a client for the one account and region of opts
+// and the ID of its detector
+func targetDetector(ctx context.Context, opts FetchOptions) (GuardDutyAPI, string, error) {
+	client, err := targetClient(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	region := opts.Regions[0]
+	listCtx, cancel := callContext(ctx, opts.CallTimeout)
+	detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+	cancel()
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing detectors in region %s: %v", region, err)
+	}
+	if len(detectors.DetectorIds) == 0 {
+		return nil, "", &CallError{Message: fmt.Sprintf("GuardDuty is not enabled in region %s", region), Rejected: true}
+	}
+	return client, detectors.DetectorIds[0], nil
+}
@@ -0,0 +1,273 @@
+package gd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// checkpointStateFile is the file of a checkpoint's directory recording the
+// progress of each account and region; the findings fetched from each are
+// kept beside it in <account>_<region>.ndjson
+const checkpointStateFile = "checkpoint.json"
+
+// Checkpoint records the progress of an export in a directory as it is
+// fetched: the findings of each account and region, and the detectors and
+// ListFindings pages they came from. An export that fails part way, such as
+// when its credentials expire, can be run again with the same checkpoint to
+// resume where it stopped: the findings already fetched are read back
+// instead of fetched again, each detector continues from the page after the
+// last one checkpointed, and accounts and regions that finished are not
+// queried at all. A Checkpoint is safe for concurrent use by the fetches of
+// one export.
+type Checkpoint struct {
+	dir   string
+	mu    sync.Mutex
+	state checkpointState
+}
+
+type checkpointState struct {
+	Targets map[string]*targetCheckpoint `json:"targets"`
+}
+
+// targetCheckpoint is the progress of one account and region
+type targetCheckpoint struct {
+	// Done is set once every detector has been fetched, and Skipped when
+	// the region was skipped for lack of a detector
+	Done    bool   `json:"done,omitempty"`
+	Skipped string `json:"skipped,omitempty"`
+	// Findings is the number of findings in the spool file as of the last
+	// checkpoint; any after them are discarded on resume
+	Findings  int                            `json:"findings"`
+	Detectors map[string]*detectorCheckpoint `json:"detectors,omitempty"`
+}
+
+// detectorCheckpoint is the progress of one detector: the NextToken of the
+// first page not yet checkpointed, or Done once its last page was
+type detectorCheckpoint struct {
+	Done      bool   `json:"done,omitempty"`
+	NextToken string `json:"nextToken,omitempty"`
+}
+
+// OpenCheckpoint opens the checkpoint in dir, creating an empty one when dir
+// holds none
+func OpenCheckpoint(dir string) (*Checkpoint, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating checkpoint: %v", err)
+	}
+	c := &Checkpoint{dir: dir}
+	data, err := os.ReadFile(filepath.Join(dir, checkpointStateFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("error reading checkpoint: %v", err)
+	default:
+		if err := json.Unmarshal(data, &c.state); err != nil {
+			return nil, fmt.Errorf("error reading checkpoint %s: %v", dir, err)
+		}
+	}
+	if c.state.Targets == nil {
+		c.state.Targets = make(map[string]*targetCheckpoint)
+	}
+	return c, nil
+}
+
+// Dir returns the checkpoint's directory
+func (c *Checkpoint) Dir() string {
+	return c.dir
+}
+
+// Progress returns the number of accounts and regions the checkpoint has
+// finished and the number of findings it holds
+func (c *Checkpoint) Progress() (targets, findings int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, target := range c.state.Targets {
+		if target.Done || target.Skipped != "" {
+			targets++
+		}
+		findings += target.Findings
+	}
+	return targets, findings
+}
+
+// Remove deletes the checkpoint and the findings it holds
+func (c *Checkpoint) Remove() error {
+	return os.RemoveAll(c.dir)
+}
+
+// spoolPath returns the file holding the findings of target
+func (c *Checkpoint) spoolPath(target exportTarget) string {
+	return filepath.Join(c.dir, strings.ReplaceAll(target.label(), "/", "_")+".ndjson")
+}
+
+// resume reads back the findings of target fetched before, passing them to
+// emit a page at a time and reporting them to progress, and returns whether
+// the target was done, or the reason it was skipped. The findings spooled
+// after the last checkpoint are discarded, so the fetch continues after the
+// findings read back. A nil Checkpoint resumes nothing.
+func (c *Checkpoint) resume(target exportTarget, emit func([]types.Finding) error, progress ProgressFunc) (done bool, skipped string, err error) {
+	if c == nil {
+		return false, "", nil
+	}
+	c.mu.Lock()
+	state := c.state.Targets[target.label()]
+	c.mu.Unlock()
+	if state == nil {
+		// Findings spooled before the first checkpoint of the target are
+		// fetched again
+		if err := os.Remove(c.spoolPath(target)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, "", fmt.Errorf("error truncating checkpoint: %v", err)
+		}
+		return false, "", nil
+	}
+	if state.Skipped != "" {
+		return true, state.Skipped, nil
+	}
+
+	file, err := os.OpenFile(c.spoolPath(target), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return false, "", fmt.Errorf("error opening checkpoint: %v", err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var offset int64
+	page := make([]types.Finding, 0, MaxGetFindingsBatch)
+	flush := func() error {
+		if len(page) == 0 {
+			return nil
+		}
+		progress.emit(Event{Type: EventPageFetched, Account: target.account.accountID, Region: target.region, PageFindings: len(page)})
+		err := emit(page)
+		page = make([]types.Finding, 0, MaxGetFindingsBatch)
+		return err
+	}
+	for range state.Findings {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return false, "", fmt.Errorf("error reading checkpoint: %v", err)
+		}
+		offset += int64(len(line))
+		var finding types.Finding
+		if err := json.Unmarshal(line, &finding); err != nil {
+			return false, "", fmt.Errorf("error reading checkpoint: %v", err)
+		}
+		page = append(page, finding)
+		if len(page) == cap(page) {
+			if err := flush(); err != nil {
+				return false, "", err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return false, "", err
+	}
+	if err := file.Truncate(offset); err != nil {
+		return false, "", fmt.Errorf("error truncating checkpoint: %v", err)
+	}
+	return state.Done, "", nil
+}
+
+// detector returns where the fetch of a detector of target resumes: whether
+// it is done, or the NextToken of its next page, empty for the first
+func (c *Checkpoint) detector(target exportTarget, detectorID string) (done bool, nextToken string) {
+	if c == nil {
+		return false, ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := c.state.Targets[target.label()]
+	if state == nil || state.Detectors[detectorID] == nil {
+		return false, ""
+	}
+	return state.Detectors[detectorID].Done, state.Detectors[detectorID].NextToken
+}
+
+// page checkpoints a page of a detector of target whose findings have been
+// exported, recording where the detector continues: the NextToken of its
+// next page, or empty after its last
+func (c *Checkpoint) page(target exportTarget, detectorID string, findings []types.Finding, nextToken string) error {
+	if c == nil {
+		return nil
+	}
+	if len(findings) > 0 {
+		file, err := os.OpenFile(c.spoolPath(target), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return fmt.Errorf("error writing checkpoint: %v", err)
+		}
+		w := bufio.NewWriter(file)
+		enc := json.NewEncoder(w)
+		for _, finding := range findings {
+			if err := enc.Encode(finding); err != nil {
+				file.Close()
+				return fmt.Errorf("error writing checkpoint: %v", err)
+			}
+		}
+		err = w.Flush()
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("error writing checkpoint: %v", err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := c.targetState(target)
+	if state.Detectors == nil {
+		state.Detectors = make(map[string]*detectorCheckpoint)
+	}
+	state.Findings += len(findings)
+	state.Detectors[detectorID] = &detectorCheckpoint{Done: nextToken == "", NextToken: nextToken}
+	return c.save()
+}
+
+// finish checkpoints a target whose every detector has been fetched, or
+// that was skipped for the reason skipped
+func (c *Checkpoint) finish(target exportTarget, skipped string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := c.targetState(target)
+	state.Done = true
+	state.Skipped = skipped
+	return c.save()
+}
+
+// targetState returns the progress of target, adding it when it has none.
+// c.mu must be held.
+func (c *Checkpoint) targetState(target exportTarget) *targetCheckpoint {
+	state := c.state.Targets[target.label()]
+	if state == nil {
+		state = &targetCheckpoint{}
+		c.state.Targets[target.label()] = state
+	}
+	return state
+}
+
+// save writes the progress of every target, replacing the previous state
+// file only once the new one is complete. c.mu must be held.
+func (c *Checkpoint) save() error {
+	data, err := json.Marshal(c.state)
+	if err != nil {
+		return fmt.Errorf("error writing checkpoint: %v", err)
+	}
+	path := filepath.Join(c.dir, checkpointStateFile)
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return fmt.Errorf("error writing checkpoint: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("error writing checkpoint: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package gd
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// DetectorsAPI finds and describes the detector of an account and region
+type DetectorsAPI interface {
+	ListDetectors(ctx context.Context, params *guardduty.ListDetectorsInput, optFns ...func(*guardduty.Options)) (*guardduty.ListDetectorsOutput, error)
+	GetDetector(ctx context.Context, params *guardduty.GetDetectorInput, optFns ...func(*guardduty.Options)) (*guardduty.GetDetectorOutput, error)
+}
+
+// FindingsAPI is the part of the GuardDuty API that exports, counts,
+// browsing, digests, and preflights read findings through
+type FindingsAPI interface {
+	DetectorsAPI
+	ListFindings(ctx context.Context, params *guardduty.ListFindingsInput, optFns ...func(*guardduty.Options)) (*guardduty.ListFindingsOutput, error)
+	GetFindings(ctx context.Context, params *guardduty.GetFindingsInput, optFns ...func(*guardduty.Options)) (*guardduty.GetFindingsOutput, error)
+}
+
+// StatisticsAPI counts findings for the findings statistics and metrics
+type StatisticsAPI interface {
+	DetectorsAPI
+	GetFindingsStatistics(ctx context.Context, params *guardduty.GetFindingsStatisticsInput, optFns ...func(*guardduty.Options)) (*guardduty.GetFindingsStatisticsOutput, error)
+}
+
+// ArchiveAPI archives the findings of an export
+type ArchiveAPI interface {
+	ArchiveFindings(ctx context.Context, params *guardduty.ArchiveFindingsInput, optFns ...func(*guardduty.Options)) (*guardduty.ArchiveFindingsOutput, error)
+}
+
+// FeedbackAPI marks findings useful or not useful
+type FeedbackAPI interface {
+	DetectorsAPI
+	UpdateFindingsFeedback(ctx context.Context, params *guardduty.UpdateFindingsFeedbackInput, optFns ...func(*guardduty.Options)) (*guardduty.UpdateFindingsFeedbackOutput, error)
+}
+
+// FiltersAPI lists and changes the saved filters of a detector
+type FiltersAPI interface {
+	DetectorsAPI
+	ListFilters(ctx context.Context, params *guardduty.ListFiltersInput, optFns ...func(*guardduty.Options)) (*guardduty.ListFiltersOutput, error)
+	GetFilter(ctx context.Context, params *guardduty.GetFilterInput, optFns ...func(*guardduty.Options)) (*guardduty.GetFilterOutput, error)
+	CreateFilter(ctx context.Context, params *guardduty.CreateFilterInput, optFns ...func(*guardduty.Options)) (*guardduty.CreateFilterOutput, error)
+	UpdateFilter(ctx context.Context, params *guardduty.UpdateFilterInput, optFns ...func(*guardduty.Options)) (*guardduty.UpdateFilterOutput, error)
+	DeleteFilter(ctx context.Context, params *guardduty.DeleteFilterInput, optFns ...func(*guardduty.Options)) (*guardduty.DeleteFilterOutput, error)
+}
+
+// EnableDetectorAPI closes coverage gaps by creating detectors or
+// enabling suspended ones
+type EnableDetectorAPI interface {
+	DetectorsAPI
+	CreateDetector(ctx context.Context, params *guardduty.CreateDetectorInput, optFns ...func(*guardduty.Options)) (*guardduty.CreateDetectorOutput, error)
+	UpdateDetector(ctx context.Context, params *guardduty.UpdateDetectorInput, optFns ...func(*guardduty.Options)) (*guardduty.UpdateDetectorOutput, error)
+}
+
+// IPSetsAPI reads the trusted IP lists and threat lists of a detector
+type IPSetsAPI interface {
+	ListIPSets(ctx context.Context, params *guardduty.ListIPSetsInput, optFns ...func(*guardduty.Options)) (*guardduty.ListIPSetsOutput, error)
+	GetIPSet(ctx context.Context, params *guardduty.GetIPSetInput, optFns ...func(*guardduty.Options)) (*guardduty.GetIPSetOutput, error)
+	ListThreatIntelSets(ctx context.Context, params *guardduty.ListThreatIntelSetsInput, optFns ...func(*guardduty.Options)) (*guardduty.ListThreatIntelSetsOutput, error)
+	GetThreatIntelSet(ctx context.Context, params *guardduty.GetThreatIntelSetInput, optFns ...func(*guardduty.Options)) (*guardduty.GetThreatIntelSetOutput, error)
+}
+
+// MalwareScansAPI lists the malware scans of a detector and the findings
+// of the threats they detected
+type MalwareScansAPI interface {
+	FindingsAPI
+	DescribeMalwareScans(ctx context.Context, params *guardduty.DescribeMalwareScansInput, optFns ...func(*guardduty.Options)) (*guardduty.DescribeMalwareScansOutput, error)
+}
+
+// UsageAPI reads the usage costs of a detector
+type UsageAPI interface {
+	GetUsageStatistics(ctx context.Context, params *guardduty.GetUsageStatisticsInput, optFns ...func(*guardduty.Options)) (*guardduty.GetUsageStatisticsOutput, error)
+}
+
+// CoverageAPI lists the Runtime Monitoring coverage of a detector
+type CoverageAPI interface {
+	ListCoverage(ctx context.Context, params *guardduty.ListCoverageInput, optFns ...func(*guardduty.Options)) (*guardduty.ListCoverageOutput, error)
+}
+
+// MembersAPI lists the member accounts and the administrator of a
+// detector, for reports and account discovery
+type MembersAPI interface {
+	DetectorsAPI
+	ListMembers(ctx context.Context, params *guardduty.ListMembersInput, optFns ...func(*guardduty.Options)) (*guardduty.ListMembersOutput, error)
+	GetAdministratorAccount(ctx context.Context, params *guardduty.GetAdministratorAccountInput, optFns ...func(*guardduty.Options)) (*guardduty.GetAdministratorAccountOutput, error)
+}
+
+// PostureAPI describes the organization configuration of a detector
+type PostureAPI interface {
+	DescribeOrganizationConfiguration(ctx context.Context, params *guardduty.DescribeOrganizationConfigurationInput, optFns ...func(*guardduty.Options)) (*guardduty.DescribeOrganizationConfigurationOutput, error)
+}
+
+// PublishingAPI lists the publishing destinations of a detector
+type PublishingAPI interface {
+	ListPublishingDestinations(ctx context.Context, params *guardduty.ListPublishingDestinationsInput, optFns ...func(*guardduty.Options)) (*guardduty.ListPublishingDestinationsOutput, error)
+	DescribePublishingDestination(ctx context.Context, params *guardduty.DescribePublishingDestinationInput, optFns ...func(*guardduty.Options)) (*guardduty.DescribePublishingDestinationOutput, error)
+}
+
+// GuardDutyAPI is every GuardDuty operation the exporter calls, the
+// interfaces above together, which each part of the exporter narrows to
+// what it calls. *guardduty.Client implements it, and so do the clients of
+// a Fake.
+type GuardDutyAPI interface {
+	FindingsAPI
+	StatisticsAPI
+	ArchiveAPI
+	FeedbackAPI
+	FiltersAPI
+	EnableDetectorAPI
+	IPSetsAPI
+	MalwareScansAPI
+	UsageAPI
+	CoverageAPI
+	MembersAPI
+	PostureAPI
+	PublishingAPI
+}
+
+// EC2API is the EC2 operation exports list the enabled regions with
+type EC2API interface {
+	DescribeRegions(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error)
+}
+
+// STSAPI is the STS operation that identifies the account of an export's
+// credentials
+type STSAPI interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+// Clients builds the AWS clients of an export. Each is built from the
+// configuration of one account, whose ID is empty for the export's own
+// credentials, and one region, cfg.Region. GuardDuty clients are passed the
+// options that pace their calls, which clients that don't call AWS may
+// ignore.
+type Clients interface {
+	GuardDuty(cfg aws.Config, account string, optFns ...func(*guardduty.Options)) GuardDutyAPI
+	EC2(cfg aws.Config, account string) EC2API
+	STS(cfg aws.Config) STSAPI
+}
+
+// SDKClients builds the SDK's clients, which call AWS. It is what exports
+// use unless FetchOptions.Clients is set.
+type SDKClients struct{}
+
+func (SDKClients) GuardDuty(cfg aws.Config, _ string, optFns ...func(*guardduty.Options)) GuardDutyAPI {
+	return guardduty.NewFromConfig(cfg, optFns...)
+}
+
+func (SDKClients) EC2(cfg aws.Config, _ string) EC2API {
+	return ec2.NewFromConfig(cfg)
+}
+
+func (SDKClients) STS(cfg aws.Config) STSAPI {
+	return sts.NewFromConfig(cfg)
+}
+
+// clients returns the Clients of the export
+func (o FetchOptions) clients() Clients {
+	if o.Clients == nil {
+		return SDKClients{}
+	}
+	return o.Clients
+}
@@ -0,0 +1,154 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+
+	"guardduty/internal/telemetry"
+)
+
+// CountReport is the outcome of a dry run, which lists the IDs of the
+// findings an export would fetch without getting the findings themselves
+type CountReport struct {
+	Findings int `json:"findings"`
+	// Pages is the number of ListFindings pages, each of which an export
+	// follows with GetFindings calls of up to BatchSize findings
+	Pages int `json:"pages"`
+	// Approximate is set when the filter has parts that are applied to the
+	// detailed findings, a fractional minimum severity or a finding type
+	// prefix, so the export may hold fewer findings than counted
+	Approximate     bool          `json:"approximate,omitempty"`
+	DurationSeconds float64       `json:"durationSeconds"`
+	Regions         []RegionCount `json:"regions"`
+}
+
+// RegionCount is the outcome of a dry run for one account and region. A
+// region that fails reports its error without stopping the others.
+type RegionCount struct {
+	Account         string          `json:"account,omitempty"`
+	Region          string          `json:"region"`
+	Findings        int             `json:"findings"`
+	Pages           int             `json:"pages"`
+	DurationSeconds float64         `json:"durationSeconds"`
+	Detectors       []DetectorCount `json:"detectors"`
+	Skipped         string          `json:"skipped,omitempty"`
+	Error           string          `json:"error,omitempty"`
+}
+
+// DetectorCount is the number of findings of one detector in a dry run
+type DetectorCount struct {
+	DetectorID string `json:"detectorId"`
+	Findings   int    `json:"findings"`
+	Pages      int    `json:"pages"`
+}
+
+// CountFindings pages through ListFindings for every account and region in
+// opts, with the same criteria and watermarks as an export, and counts the
+// finding IDs without calling GetFindings. The per-region timeout applies
+// as in an export.
+func CountFindings(ctx context.Context, opts FetchOptions) CountReport {
+	start := time.Now()
+	targets := exportTargets(ctx, opts)
+	report := CountReport{
+		Approximate: opts.Filter.MinSeverity != math.Floor(opts.Filter.MinSeverity) || opts.Filter.hasTypePrefix() || opts.Filter.HasTaxonomy(),
+		Regions:     make([]RegionCount, len(targets)),
+	}
+	eachTarget(targets, opts.Concurrency, func(i int) {
+		report.Regions[i] = countRegion(ctx, opts, targets[i])
+	})
+	for _, region := range report.Regions {
+		report.Findings += region.Findings
+		report.Pages += region.Pages
+	}
+	report.DurationSeconds = time.Since(start).Seconds()
+	return report
+}
+
+// countRegion counts the findings of one target
+func countRegion(ctx context.Context, opts FetchOptions, target exportTarget) RegionCount {
+	account, region := target.account.accountID, target.region
+	count := RegionCount{Account: account, Region: region, Detectors: []DetectorCount{}}
+	if target.disabled {
+		count.Skipped = "region is not enabled for this account"
+		return count
+	}
+	start := time.Now()
+	ctx, deadline := withRegionTimeout(ctx, opts.Timeout)
+	defer deadline.stop()
+	log := telemetry.Logger(ctx).With("region", target.label())
+
+	client := target.client()
+	err := func() error {
+		listCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error listing detectors in region %s: %v", region, err)
+		}
+		detectorIDs, err := opts.selectDetectors(detectors.DetectorIds)
+		if err != nil {
+			return err
+		}
+		for _, detectorID := range detectorIDs {
+			detector, err := countDetector(ctx, client, region, detectorID, opts)
+			count.Findings += detector.Findings
+			count.Pages += detector.Pages
+			count.Detectors = append(count.Detectors, detector)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	count.DurationSeconds = time.Since(start).Seconds()
+	switch {
+	case errors.Is(err, errGuardDutyNotEnabled), errors.Is(err, errNoSelectedDetector):
+		count.Skipped = err.Error()
+	case err != nil:
+		if deadline.expired() {
+			err = fmt.Errorf("timed out after %s: %v", opts.Timeout, err)
+		}
+		if account != "" {
+			err = fmt.Errorf("account %s: %v", account, err)
+		}
+		log.Error("Error counting findings", "error", err)
+		count.Error = err.Error()
+	default:
+		log.Info("Counted findings", "findings", count.Findings, "pages", count.Pages, "duration", time.Since(start))
+	}
+	return count
+}
+
+// countDetector pages through the finding IDs of one detector, returning
+// what it counted before any error
+func countDetector(ctx context.Context, client FindingsAPI, region, detectorID string, opts FetchOptions) (DetectorCount, error) {
+	count := DetectorCount{DetectorID: detectorID}
+	criteria := opts.Filter.criteria()
+	if watermark, ok := opts.Watermarks[watermarkKey(region, detectorID)]; ok {
+		criteria = updatedSince(criteria, watermark)
+	}
+	paginator := guardduty.NewListFindingsPaginator(client, &guardduty.ListFindingsInput{
+		DetectorId:      aws.String(detectorID),
+		FindingCriteria: criteria,
+	})
+	for paginator.HasMorePages() {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		pageCtx, cancel := callContext(ctx, opts.CallTimeout)
+		output, err := paginator.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return count, fmt.Errorf("error listing findings for detector %s: %v", detectorID, err)
+		}
+		count.Pages++
+		count.Findings += len(output.FindingIds)
+	}
+	return count, nil
+}
@@ -0,0 +1,212 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/telemetry"
+)
+
+// CoverageReport lists the resources that Runtime Monitoring covers in every
+// account and region of an export, from ListCoverage, with a summary of the
+// accounts they belong to
+type CoverageReport struct {
+	Resources []CoveredResource `json:"resources"`
+	// Accounts counts the healthy and unhealthy resources of each account,
+	// including the member accounts that an administrator's detectors cover
+	Accounts []AccountCoverage `json:"accounts"`
+	Regions  []RegionCoverage  `json:"regions"`
+}
+
+// CoveredResource is the Runtime Monitoring coverage of one EKS cluster,
+// EC2 instance, or ECS cluster. Its status is HEALTHY when the agent is
+// reporting, and UNHEALTHY with an Issue otherwise.
+type CoveredResource struct {
+	AccountID    string `json:"accountId"`
+	Region       string `json:"region"`
+	DetectorID   string `json:"detectorId"`
+	ResourceID   string `json:"resourceId"`
+	ResourceType string `json:"resourceType"`
+	Status       string `json:"coverageStatus"`
+	Issue        string `json:"issue,omitempty"`
+	ClusterName  string `json:"clusterName,omitempty"`
+	InstanceType string `json:"instanceType,omitempty"`
+	// ManagementType is AUTO_MANAGED when GuardDuty deploys the agent, and
+	// MANUAL otherwise
+	ManagementType string `json:"managementType,omitempty"`
+	// AgentVersion is the version of the EC2 agent or EKS add-on, and
+	// AddonStatus the status of the EKS add-on
+	AgentVersion string `json:"agentVersion,omitempty"`
+	AddonStatus  string `json:"addonStatus,omitempty"`
+	// Covered and Compatible count the nodes of an EKS cluster, or the
+	// container instances of an ECS cluster, that the agent runs on
+	Covered    *int64     `json:"covered,omitempty"`
+	Compatible *int64     `json:"compatible,omitempty"`
+	UpdatedAt  *time.Time `json:"updatedAt,omitempty"`
+}
+
+// AccountCoverage counts the covered resources of one account
+type AccountCoverage struct {
+	AccountID string `json:"accountId"`
+	Healthy   int    `json:"healthy"`
+	Unhealthy int    `json:"unhealthy"`
+	// ByType counts the resources of each type: EKS, EC2, and ECS
+	ByType map[string]CoverageCount `json:"byType"`
+}
+
+// CoverageCount is a number of healthy and unhealthy resources
+type CoverageCount struct {
+	Healthy   int `json:"healthy"`
+	Unhealthy int `json:"unhealthy"`
+}
+
+// RegionCoverage is the outcome of listing the coverage of one account and
+// region. A region without GuardDuty is skipped, and one that could not be
+// queried reports its error without failing the others.
+type RegionCoverage struct {
+	Account   string `json:"account,omitempty"`
+	Region    string `json:"region"`
+	Resources int    `json:"resources"`
+	Skipped   string `json:"skipped,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ListCoverage lists the coverage of every detector in every account and
+// region in opts, using opts.Concurrency workers
+func ListCoverage(ctx context.Context, opts FetchOptions) CoverageReport {
+	targets := exportTargets(ctx, opts)
+	report := CoverageReport{Resources: []CoveredResource{}, Accounts: []AccountCoverage{}, Regions: make([]RegionCoverage, len(targets))}
+	resources := make([][]CoveredResource, len(targets))
+	eachTarget(targets, opts.Concurrency, func(i int) {
+		report.Regions[i], resources[i] = regionCoverage(ctx, opts, targets[i])
+	})
+
+	accounts := make(map[string]*AccountCoverage)
+	for _, list := range resources {
+		report.Resources = append(report.Resources, list...)
+		for _, resource := range list {
+			account, ok := accounts[resource.AccountID]
+			if !ok {
+				account = &AccountCoverage{AccountID: resource.AccountID, ByType: make(map[string]CoverageCount)}
+				accounts[resource.AccountID] = account
+			}
+			count := account.ByType[resource.ResourceType]
+			if resource.Status == string(types.CoverageStatusHealthy) {
+				account.Healthy++
+				count.Healthy++
+			} else {
+				account.Unhealthy++
+				count.Unhealthy++
+			}
+			account.ByType[resource.ResourceType] = count
+		}
+	}
+	for _, account := range accounts {
+		report.Accounts = append(report.Accounts, *account)
+	}
+	sort.Slice(report.Accounts, func(i, j int) bool {
+		return report.Accounts[i].AccountID < report.Accounts[j].AccountID
+	})
+	return report
+}
+
+// regionCoverage lists the coverage of one target
+func regionCoverage(ctx context.Context, opts FetchOptions, target exportTarget) (RegionCoverage, []CoveredResource) {
+	account, region := target.account.accountID, target.region
+	coverage := RegionCoverage{Account: account, Region: region}
+	if target.disabled {
+		coverage.Skipped = "region is not enabled for this account"
+		return coverage, nil
+	}
+	log := telemetry.Logger(ctx).With("region", target.label())
+
+	client := target.client()
+	var resources []CoveredResource
+	err := func() error {
+		listCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error listing detectors in region %s: %v", region, err)
+		}
+		if len(detectors.DetectorIds) == 0 {
+			return errGuardDutyNotEnabled
+		}
+		for _, detectorID := range detectors.DetectorIds {
+			paginator := guardduty.NewListCoveragePaginator(client, &guardduty.ListCoverageInput{DetectorId: aws.String(detectorID)})
+			for paginator.HasMorePages() {
+				pageCtx, cancel := callContext(ctx, opts.CallTimeout)
+				output, err := paginator.NextPage(pageCtx)
+				cancel()
+				if err != nil {
+					return fmt.Errorf("error listing coverage for detector %s: %v", detectorID, err)
+				}
+				for _, r := range output.Resources {
+					resources = append(resources, coveredResource(region, r))
+				}
+			}
+		}
+		return nil
+	}()
+	coverage.Resources = len(resources)
+	switch {
+	case errors.Is(err, errGuardDutyNotEnabled):
+		coverage.Skipped = err.Error()
+	case err != nil:
+		if account != "" {
+			err = fmt.Errorf("account %s: %v", account, err)
+		}
+		log.Error("Error listing coverage", "error", err)
+		coverage.Error = err.Error()
+	}
+	return coverage, resources
+}
+
+// coveredResource converts a ListCoverage resource
+func coveredResource(region string, r types.CoverageResource) CoveredResource {
+	resource := CoveredResource{
+		AccountID:  aws.ToString(r.AccountId),
+		Region:     region,
+		DetectorID: aws.ToString(r.DetectorId),
+		ResourceID: aws.ToString(r.ResourceId),
+		Status:     string(r.CoverageStatus),
+		Issue:      aws.ToString(r.Issue),
+		UpdatedAt:  r.UpdatedAt,
+	}
+	if r.ResourceDetails == nil {
+		return resource
+	}
+	details := r.ResourceDetails
+	resource.ResourceType = string(details.ResourceType)
+	if eks := details.EksClusterDetails; eks != nil {
+		resource.ClusterName = aws.ToString(eks.ClusterName)
+		resource.ManagementType = string(eks.ManagementType)
+		resource.Covered, resource.Compatible = eks.CoveredNodes, eks.CompatibleNodes
+		if eks.AddonDetails != nil {
+			resource.AgentVersion = aws.ToString(eks.AddonDetails.AddonVersion)
+			resource.AddonStatus = aws.ToString(eks.AddonDetails.AddonStatus)
+		}
+	}
+	if ec2 := details.Ec2InstanceDetails; ec2 != nil {
+		resource.ClusterName = aws.ToString(ec2.ClusterArn)
+		resource.InstanceType = aws.ToString(ec2.InstanceType)
+		resource.ManagementType = string(ec2.ManagementType)
+		if ec2.AgentDetails != nil {
+			resource.AgentVersion = aws.ToString(ec2.AgentDetails.Version)
+		}
+	}
+	if ecs := details.EcsClusterDetails; ecs != nil {
+		resource.ClusterName = aws.ToString(ecs.ClusterName)
+		if instances := ecs.ContainerInstanceDetails; instances != nil {
+			resource.Covered, resource.Compatible = instances.CoveredContainerInstances, instances.CompatibleContainerInstances
+		}
+	}
+	return resource
+}
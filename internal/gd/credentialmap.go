@@ -0,0 +1,155 @@
+package gd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// CredentialRule gives the clients of an account, of a region, or of one
+// region of an account other credentials than the export's: those of a
+// shared config profile, of a role assumed with the export's credentials,
+// or of a role assumed with a profile's. It serves environments whose
+// accounts are reached differently, such as one whose security account
+// requires its own role, or regions of another partition.
+type CredentialRule struct {
+	// Account is the account the rule applies to, or empty for every
+	// account of the export, its own among them
+	Account string `yaml:"account"`
+	// Region is the region the rule applies to, or empty for every region
+	Region string `yaml:"region"`
+	// Profile is the profile whose credentials are used, or that RoleARN is
+	// assumed with
+	Profile    string `yaml:"profile"`
+	RoleARN    string `yaml:"roleArn"`
+	ExternalID string `yaml:"externalId"`
+}
+
+// label identifies the rule in errors
+func (r CredentialRule) label() string {
+	switch {
+	case r.Account != "" && r.Region != "":
+		return fmt.Sprintf("account %s in %s", r.Account, r.Region)
+	case r.Account != "":
+		return "account " + r.Account
+	case r.Region != "":
+		return "region " + r.Region
+	}
+	return "every account and region"
+}
+
+// Validate reports whether the rule names a well-formed account, a profile
+// or role, and a well-formed role ARN
+func (r CredentialRule) Validate() error {
+	if r.Account != "" && (len(r.Account) != 12 || strings.Trim(r.Account, "0123456789") != "") {
+		return fmt.Errorf("invalid credential rule for %s: account must be 12 digits", r.label())
+	}
+	if r.Account == "" && r.Region == "" {
+		return fmt.Errorf("invalid credential rule: must set an account, a region, or both")
+	}
+	if r.Profile == "" && r.RoleARN == "" {
+		return fmt.Errorf("invalid credential rule for %s: must set a profile, a roleArn, or both", r.label())
+	}
+	if r.RoleARN != "" {
+		if err := (Role{ARN: r.RoleARN}).Validate(); err != nil {
+			return fmt.Errorf("invalid credential rule for %s: %v", r.label(), err)
+		}
+	}
+	if r.ExternalID != "" && r.RoleARN == "" {
+		return fmt.Errorf("invalid credential rule for %s: externalId requires a roleArn", r.label())
+	}
+	return nil
+}
+
+// ValidateCredentialMap validates each rule of a credential map and reports
+// two rules for the same account and region, of which only one could apply
+func ValidateCredentialMap(rules []CredentialRule) error {
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		key := rule.Account + "/" + rule.Region
+		if seen[key] {
+			return fmt.Errorf("invalid credential rule for %s: another rule applies to it", rule.label())
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// CredentialProfileNames returns the profiles a credential map names, in
+// order and without repeats, whose configurations an export needs in
+// FetchOptions.CredentialProfiles
+func CredentialProfileNames(rules []CredentialRule) []string {
+	var names []string
+	for _, rule := range rules {
+		if rule.Profile != "" && !slices.Contains(names, rule.Profile) {
+			names = append(names, rule.Profile)
+		}
+	}
+	return names
+}
+
+// credentialRule returns the rule of the credential map that applies to an
+// account, empty for the export's own, in region: the one for the account
+// in that region, else the one for the account, else the one for the region
+func (o FetchOptions) credentialRule(account, region string) (CredentialRule, bool) {
+	best, bestScore := CredentialRule{}, 0
+	for _, rule := range o.CredentialMap {
+		if (rule.Account != "" && rule.Account != account) || (rule.Region != "" && rule.Region != region) {
+			continue
+		}
+		score := 1
+		if rule.Account != "" {
+			score = 2
+		}
+		if rule.Account != "" && rule.Region != "" {
+			score = 3
+		}
+		if score > bestScore {
+			best, bestScore = rule, score
+		}
+	}
+	return best, bestScore > 0
+}
+
+// config returns the configuration with the rule's credentials: those of
+// its profile, or of its role assumed with them or with base
+func (r CredentialRule) config(base aws.Config, profiles map[string]aws.Config) aws.Config {
+	if r.Profile != "" {
+		if cfg, ok := profiles[r.Profile]; ok {
+			base = cfg
+		}
+	}
+	if r.RoleARN == "" {
+		return base
+	}
+	return assumeRoleConfig(base, Role{ARN: r.RoleARN, ExternalID: r.ExternalID})
+}
+
+// mappedConfigs returns the configuration of each region of the export in
+// which the credential map gives an account other credentials. Regions of
+// the same rule share a configuration, and so its cached credentials.
+func (o FetchOptions) mappedConfigs(account string) map[string]aws.Config {
+	if len(o.CredentialMap) == 0 {
+		return nil
+	}
+	configs := make(map[string]aws.Config)
+	built := make(map[CredentialRule]aws.Config)
+	for _, region := range o.Regions {
+		rule, ok := o.credentialRule(account, region)
+		if !ok {
+			continue
+		}
+		cfg, ok := built[rule]
+		if !ok {
+			cfg = rule.config(o.AWSConfig, o.CredentialProfiles)
+			built[rule] = cfg
+		}
+		configs[region] = cfg
+	}
+	return configs
+}
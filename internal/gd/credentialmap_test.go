@@ -0,0 +1,67 @@
+package gd
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+)
+
+// recordingClients is a Fake that records the AppID of the configuration
+// each GuardDuty client is made with, which tells the credentials apart
+type recordingClients struct {
+	*Fake
+	mu     *sync.Mutex
+	appIDs *[]string
+}
+
+func (c recordingClients) GuardDuty(cfg aws.Config, account string, optFns ...func(*guardduty.Options)) GuardDutyAPI {
+	c.mu.Lock()
+	*c.appIDs = append(*c.appIDs, cfg.AppID)
+	c.mu.Unlock()
+	return c.Fake.GuardDuty(cfg, account, optFns...)
+}
+
+func TestCredentialMapOwnAccount(t *testing.T) {
+	tests := []struct {
+		name    string
+		account string
+		// want is the AppID the export's GuardDuty clients are made with
+		want string
+		// calls is the number of GetCallerIdentity calls
+		calls int
+	}{
+		{name: "own account", account: testAccount, want: "security", calls: 1},
+		{name: "other account", account: "210987654321", want: "export", calls: 1},
+		{name: "every account", want: "security", calls: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := NewFake(testAccount)
+			fake.AddFindings(testFindings(2)...)
+			var appIDs []string
+			opts := testFetchOptions(fake)
+			opts.AWSConfig.AppID = "export"
+			opts.Clients = recordingClients{Fake: fake, mu: &sync.Mutex{}, appIDs: &appIDs}
+			opts.CredentialMap = []CredentialRule{{Account: tt.account, Profile: "security"}}
+			opts.CredentialProfiles = map[string]aws.Config{"security": {Region: "us-east-1", AppID: "security"}}
+
+			if err := ResolveAccounts(context.Background(), &opts); err != nil {
+				t.Fatalf("error resolving accounts: %v", err)
+			}
+			results := StreamRegions(context.Background(), opts, nil).Collect()
+			if len(results) != 1 || results[0].Err != nil || results[0].Count != 2 {
+				t.Fatalf("got results %+v, want the region's 2 findings", results)
+			}
+			if len(appIDs) == 0 || slices.ContainsFunc(appIDs, func(id string) bool { return id != tt.want }) {
+				t.Errorf("got GuardDuty clients with %v, want %s", appIDs, tt.want)
+			}
+			if got := fake.Calls("GetCallerIdentity"); got != tt.calls {
+				t.Errorf("got %d GetCallerIdentity calls, want %d", got, tt.calls)
+			}
+		})
+	}
+}
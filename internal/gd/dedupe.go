@@ -0,0 +1,165 @@
+package gd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// What identifies duplicate findings: their ID, or also their content, for
+// copies of one event under different IDs such as the findings of a global
+// resource raised in each region
+const (
+	DedupeByID      = "id"
+	DedupeByContent = "content"
+)
+
+// Which copy of a duplicated finding is exported: the first in account and
+// region order, or the one fetched from the finding's own account when
+// that account and region are exported too, rather than the copy an
+// administrator account holds of a member's finding
+const (
+	KeepFirst = "first"
+	KeepOwn   = "own"
+)
+
+// Dedupe collapses the findings that an export fetches more than once,
+// such as from an administrator account and its members. An empty Key
+// exports every copy.
+type Dedupe struct {
+	Key  string
+	Keep string
+}
+
+// ParseDedupe reads the dedupe and dedupeKeep options
+func ParseDedupe(by, keep string) (Dedupe, error) {
+	switch by {
+	case "", DedupeByID, DedupeByContent:
+	default:
+		return Dedupe{}, fmt.Errorf("Invalid dedupe %q: must be %s or %s", by, DedupeByID, DedupeByContent)
+	}
+	switch keep {
+	case "":
+		keep = KeepFirst
+	case KeepFirst, KeepOwn:
+	default:
+		return Dedupe{}, fmt.Errorf("Invalid dedupeKeep %q: must be %s or %s", keep, KeepFirst, KeepOwn)
+	}
+	if by == "" {
+		if keep != KeepFirst {
+			return Dedupe{}, fmt.Errorf("The dedupeKeep option requires dedupe")
+		}
+		return Dedupe{}, nil
+	}
+	return Dedupe{Key: by, Keep: keep}, nil
+}
+
+// deduper drops the duplicates of a stream as its regions are read. Regions
+// are read one at a time in order, so its keys need no lock, and which copy
+// is kept doesn't depend on the order the fetches finish in.
+type deduper struct {
+	ctx    context.Context
+	dedupe Dedupe
+	seen   map[string]bool
+	// targets holds the accounts and regions of the export fetched
+	// through an account of their own
+	targets map[string]bool
+}
+
+func newDeduper(ctx context.Context, dedupe Dedupe, targets []exportTarget) *deduper {
+	d := &deduper{ctx: ctx, dedupe: dedupe, seen: make(map[string]bool), targets: make(map[string]bool)}
+	for _, target := range targets {
+		if target.account.accountID != "" && !target.disabled {
+			d.targets[TargetLabel(target.account.accountID, target.region)] = true
+		}
+	}
+	return d
+}
+
+// filter hands region to the reader through a channel of its own that
+// leaves out the duplicates, counting them in the region's result
+func (d *deduper) filter(region *RegionStream) {
+	source := region.Findings
+	findings := make(chan types.Finding)
+	region.Findings = findings
+	region.deduped = make(chan struct{})
+	go func() {
+		defer close(region.deduped)
+		defer close(findings)
+		for finding := range source {
+			if d.duplicate(region, finding) {
+				region.duplicates++
+				if region.duplicateSeverities == nil {
+					region.duplicateSeverities = make(map[string]int)
+				}
+				region.duplicateSeverities[SeverityLabel(aws.ToFloat64(finding.Severity))]++
+				continue
+			}
+			select {
+			case findings <- finding:
+			case <-d.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// duplicate reports whether the finding was already exported, or is
+// another account's copy of a finding whose own account is exported, and
+// otherwise remembers it
+func (d *deduper) duplicate(region *RegionStream, finding types.Finding) bool {
+	if d.dedupe.Keep == KeepOwn {
+		account, findingRegion := aws.ToString(finding.AccountId), aws.ToString(finding.Region)
+		if findingRegion == "" {
+			findingRegion = region.Region
+		}
+		if account != region.Account && d.targets[TargetLabel(account, findingRegion)] {
+			return true
+		}
+	}
+	keys := []string{"id:" + aws.ToString(finding.Id)}
+	if d.dedupe.Key == DedupeByContent {
+		keys = append(keys, "content:"+contentHash(finding))
+	}
+	duplicate := false
+	for _, key := range keys {
+		duplicate = duplicate || d.seen[key]
+		d.seen[key] = true
+	}
+	return duplicate
+}
+
+// contentHash identifies what a finding reports, apart from where and when
+// it was raised: its type, account, affected resource, and action
+func contentHash(finding types.Finding) string {
+	content := struct {
+		Type      *string
+		AccountID *string
+		Resource  *types.Resource
+		Action    *types.Action
+	}{Type: finding.Type, AccountID: finding.AccountId, Resource: finding.Resource}
+	if finding.Service != nil {
+		content.Action = finding.Service.Action
+	}
+	data, _ := json.Marshal(content)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// dedupedResult is the outcome of a region without its duplicates, which
+// are counted instead
+func dedupedResult(result RegionResult, duplicates int, severities map[string]int) RegionResult {
+	result.Duplicates = duplicates
+	result.Count -= duplicates
+	bySeverity := make(map[string]int, len(result.BySeverity))
+	for label, n := range result.BySeverity {
+		bySeverity[label] = n - severities[label]
+	}
+	result.BySeverity = bySeverity
+	return result
+}
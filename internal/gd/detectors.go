@@ -0,0 +1,172 @@
+package gd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/telemetry"
+)
+
+// ProtectionFeatures are the detector features that turn on GuardDuty's
+// protection plans, in the order the inventory lists them: S3 Protection,
+// EKS Protection, Malware Protection for EC2, RDS Protection, Lambda
+// Protection, and Runtime Monitoring with the EKS Runtime Monitoring it
+// replaces
+var ProtectionFeatures = []types.DetectorFeatureResult{
+	types.DetectorFeatureResultS3DataEvents,
+	types.DetectorFeatureResultEksAuditLogs,
+	types.DetectorFeatureResultEbsMalwareProtection,
+	types.DetectorFeatureResultRdsLoginEvents,
+	types.DetectorFeatureResultLambdaNetworkLogs,
+	types.DetectorFeatureResultRuntimeMonitoring,
+	types.DetectorFeatureResultEksRuntimeMonitoring,
+}
+
+// Inventory lists the GuardDuty detectors of every account and region of
+// an export
+type Inventory struct {
+	Regions []RegionDetectors `json:"regions"`
+	// Gaps lists the accounts and regions that GuardDuty does not monitor,
+	// without a detector or with only suspended ones
+	Gaps []string `json:"gaps"`
+}
+
+// RegionDetectors lists the detectors of one account and region. A region
+// that is not enabled for the account is skipped, and one that could not
+// be queried reports its error without failing the others.
+type RegionDetectors struct {
+	Account   string         `json:"account,omitempty"`
+	Region    string         `json:"region"`
+	Detectors []DetectorInfo `json:"detectors"`
+	Skipped   string         `json:"skipped,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// DetectorInfo describes one detector and the features enabled on it
+type DetectorInfo struct {
+	DetectorID                 string            `json:"detectorId"`
+	Status                     string            `json:"status"`
+	FindingPublishingFrequency string            `json:"findingPublishingFrequency"`
+	ServiceRole                string            `json:"serviceRole,omitempty"`
+	CreatedAt                  string            `json:"createdAt,omitempty"`
+	UpdatedAt                  string            `json:"updatedAt,omitempty"`
+	Features                   []DetectorFeature `json:"features"`
+}
+
+// DetectorFeature is the status of a detector feature, ENABLED or
+// DISABLED, with that of its additional configurations such as the
+// automated agent of Runtime Monitoring
+type DetectorFeature struct {
+	Name       string           `json:"name"`
+	Status     string           `json:"status"`
+	UpdatedAt  *time.Time       `json:"updatedAt,omitempty"`
+	Additional []FeatureSetting `json:"additionalConfiguration,omitempty"`
+}
+
+// FeatureSetting is the status of an additional configuration of a feature
+type FeatureSetting struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// FeatureStatus returns the status of the named feature, or "" when the
+// detector does not report it
+func (d DetectorInfo) FeatureStatus(name types.DetectorFeatureResult) string {
+	for _, feature := range d.Features {
+		if feature.Name == string(name) {
+			return feature.Status
+		}
+	}
+	return ""
+}
+
+// DetectorInventory describes the detectors in every account and region in
+// opts, using opts.Concurrency workers
+func DetectorInventory(ctx context.Context, opts FetchOptions) Inventory {
+	targets := exportTargets(ctx, opts)
+	inventory := Inventory{Regions: make([]RegionDetectors, len(targets)), Gaps: []string{}}
+	eachTarget(targets, opts.Concurrency, func(i int) {
+		inventory.Regions[i] = regionDetectors(ctx, opts, targets[i])
+	})
+
+	for _, region := range inventory.Regions {
+		if region.Skipped != "" || region.Error != "" {
+			continue
+		}
+		monitored := false
+		for _, detector := range region.Detectors {
+			monitored = monitored || detector.Status == string(types.DetectorStatusEnabled)
+		}
+		if !monitored {
+			inventory.Gaps = append(inventory.Gaps, TargetLabel(region.Account, region.Region))
+		}
+	}
+	sort.Strings(inventory.Gaps)
+	return inventory
+}
+
+// regionDetectors describes the detectors of one target
+func regionDetectors(ctx context.Context, opts FetchOptions, target exportTarget) RegionDetectors {
+	account, region := target.account.accountID, target.region
+	inventory := RegionDetectors{Account: account, Region: region, Detectors: []DetectorInfo{}}
+	if target.disabled {
+		inventory.Skipped = "region is not enabled for this account"
+		return inventory
+	}
+	log := telemetry.Logger(ctx).With("region", target.label())
+
+	client := target.client()
+	err := func() error {
+		listCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error listing detectors in region %s: %v", region, err)
+		}
+		for _, detectorID := range detectors.DetectorIds {
+			getCtx, cancel := callContext(ctx, opts.CallTimeout)
+			detector, err := client.GetDetector(getCtx, &guardduty.GetDetectorInput{DetectorId: aws.String(detectorID)})
+			cancel()
+			if err != nil {
+				return fmt.Errorf("error getting detector %s: %v", detectorID, err)
+			}
+			inventory.Detectors = append(inventory.Detectors, detectorInfo(detectorID, detector))
+		}
+		return nil
+	}()
+	if err != nil {
+		if account != "" {
+			err = fmt.Errorf("account %s: %v", account, err)
+		}
+		log.Error("Error describing detectors", "error", err)
+		inventory.Error = err.Error()
+	}
+	return inventory
+}
+
+// detectorInfo converts a GetDetector response
+func detectorInfo(detectorID string, detector *guardduty.GetDetectorOutput) DetectorInfo {
+	info := DetectorInfo{
+		DetectorID:                 detectorID,
+		Status:                     string(detector.Status),
+		FindingPublishingFrequency: string(detector.FindingPublishingFrequency),
+		ServiceRole:                aws.ToString(detector.ServiceRole),
+		CreatedAt:                  aws.ToString(detector.CreatedAt),
+		UpdatedAt:                  aws.ToString(detector.UpdatedAt),
+		Features:                   []DetectorFeature{},
+	}
+	for _, f := range detector.Features {
+		feature := DetectorFeature{Name: string(f.Name), Status: string(f.Status), UpdatedAt: f.UpdatedAt}
+		for _, c := range f.AdditionalConfiguration {
+			feature.Additional = append(feature.Additional, FeatureSetting{Name: string(c.Name), Status: string(c.Status)})
+		}
+		info.Features = append(info.Features, feature)
+	}
+	return info
+}
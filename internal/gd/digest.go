@@ -0,0 +1,133 @@
+package gd
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/telemetry"
+)
+
+// MaxDigestFindings is the most findings a digest holds, a page of
+// ListFindings for each detector
+const MaxDigestFindings = MaxFindingsPage
+
+// maxDigestPages is the most ListFindings pages read from a detector for a
+// digest when the filter leaves out findings GuardDuty listed
+const maxDigestPages = 10
+
+// TopFindings returns the n most severe findings matching opts.Filter
+// across every account and region in opts, most severe first, with the
+// outcome of each region. Each detector lists its findings by severity, so
+// only the first of them are fetched, however many a region has.
+func TopFindings(ctx context.Context, opts FetchOptions, n int) ([]types.Finding, []RegionResult) {
+	n = min(max(n, 1), MaxDigestFindings)
+	targets := exportTargets(ctx, opts)
+	results := make([]RegionResult, len(targets))
+	eachTarget(targets, opts.Concurrency, func(i int) {
+		results[i] = topRegionFindings(ctx, opts, targets[i], n)
+	})
+
+	var findings []types.Finding
+	for i := range results {
+		findings = append(findings, results[i].Findings...)
+		results[i].Findings = nil
+	}
+	// The most severe come first, and the most recently updated of equal
+	// severity
+	slices.SortFunc(findings, func(a, b types.Finding) int {
+		if c := cmp.Compare(aws.ToFloat64(b.Severity), aws.ToFloat64(a.Severity)); c != 0 {
+			return c
+		}
+		if c := strings.Compare(aws.ToString(b.UpdatedAt), aws.ToString(a.UpdatedAt)); c != 0 {
+			return c
+		}
+		return strings.Compare(aws.ToString(a.Id), aws.ToString(b.Id))
+	})
+	if len(findings) > n {
+		findings = findings[:n]
+	}
+	return findings, results
+}
+
+// topRegionFindings returns the n most severe findings of each detector of
+// one target
+func topRegionFindings(ctx context.Context, opts FetchOptions, target exportTarget, n int) RegionResult {
+	account, region := target.account.accountID, target.region
+	result := RegionResult{Account: account, Region: region}
+	if target.disabled {
+		result.Skipped = "region is not enabled for this account"
+		return result
+	}
+
+	client := target.client()
+	err := func() error {
+		listCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error listing detectors in region %s: %v", region, err)
+		}
+		detectorIDs, err := opts.selectDetectors(detectors.DetectorIds)
+		if err != nil {
+			return err
+		}
+		for _, detectorID := range detectorIDs {
+			findings, err := topDetectorFindings(ctx, client, detectorID, opts, n)
+			if err != nil {
+				return err
+			}
+			result.Findings = append(result.Findings, findings...)
+		}
+		return nil
+	}()
+	switch {
+	case errors.Is(err, errGuardDutyNotEnabled), errors.Is(err, errNoSelectedDetector):
+		result.Skipped = err.Error()
+	case err != nil:
+		if account != "" {
+			err = fmt.Errorf("account %s: %v", account, err)
+		}
+		telemetry.Logger(ctx).With("region", target.label()).Error("Error getting top findings", "error", err)
+		result.Err = err
+	}
+	result.Count = len(result.Findings)
+	return result
+}
+
+// topDetectorFindings lists the findings of a detector most severe first
+// until n of them match the filter
+func topDetectorFindings(ctx context.Context, client FindingsAPI, detectorID string, opts FetchOptions, n int) ([]types.Finding, error) {
+	input := &guardduty.ListFindingsInput{
+		DetectorId:      aws.String(detectorID),
+		FindingCriteria: opts.Filter.criteria(),
+		SortCriteria:    Order{By: "severity", Descending: true}.criteria(),
+		MaxResults:      aws.Int32(int32(n)),
+	}
+	var findings []types.Finding
+	for range maxDigestPages {
+		listCtx, cancel := callContext(ctx, opts.CallTimeout)
+		output, err := client.ListFindings(listCtx, input)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("error listing findings for detector %s: %v", detectorID, err)
+		}
+		page, err := getFindingsInBatches(ctx, client, detectorID, output.FindingIds, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error getting detailed findings for detector %s: %v", detectorID, err)
+		}
+		findings = append(findings, slices.DeleteFunc(page, func(f types.Finding) bool { return !opts.Filter.matches(f) })...)
+		if len(findings) >= n || aws.ToString(output.NextToken) == "" {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+	return findings, nil
+}
@@ -0,0 +1,324 @@
+package gd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/organizations"
+	orgtypes "github.com/aws/aws-sdk-go-v2/service/organizations/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"guardduty/internal/telemetry"
+)
+
+// Account discovery sources
+const (
+	discoverOrganizations = "organizations"
+	discoverGuardDuty     = "guardduty"
+)
+
+// defaultDiscoveryRole is the role AWS Organizations creates in member accounts
+const defaultDiscoveryRole = "OrganizationAccountAccessRole"
+
+// Discovery selects the accounts of an organization to export without
+// listing their role ARNs. Each discovered account is exported by assuming
+// RoleName in it, except the exporter's own account which uses its own
+// credentials.
+type Discovery struct {
+	// Source is "organizations" to use Organizations ListAccounts or
+	// "guardduty" to use the members of the GuardDuty administrator account
+	Source          string   `yaml:"source"`
+	RoleName        string   `yaml:"roleName"`
+	ExternalID      string   `yaml:"externalId"`
+	IncludeAccounts []string `yaml:"includeAccounts"`
+	ExcludeAccounts []string `yaml:"excludeAccounts"`
+	// IncludeOUs and ExcludeOUs match accounts anywhere beneath the given
+	// organizational units, which always requires Organizations access
+	IncludeOUs []string `yaml:"includeOUs"`
+	ExcludeOUs []string `yaml:"excludeOUs"`
+}
+
+// Validate reports the first invalid discovery setting
+func (d Discovery) Validate() error {
+	switch d.Source {
+	case "", discoverOrganizations, discoverGuardDuty:
+	default:
+		return fmt.Errorf("invalid account discovery source %q: must be %s or %s", d.Source, discoverOrganizations, discoverGuardDuty)
+	}
+	if strings.Contains(d.RoleName, ":") {
+		return fmt.Errorf("invalid discovery role name %q: use a role name, not an ARN", d.RoleName)
+	}
+	return nil
+}
+
+// ParseDiscovery reads the account discovery query parameters over the
+// configured defaults
+func ParseDiscovery(query url.Values, d Discovery) (Discovery, error) {
+	if v := query.Get("discoverAccounts"); v != "" {
+		if v != discoverOrganizations && v != discoverGuardDuty {
+			return d, fmt.Errorf("Invalid discoverAccounts %q: must be %s or %s", v, discoverOrganizations, discoverGuardDuty)
+		}
+		d.Source = v
+	}
+	if v := query.Get("roleName"); v != "" {
+		if strings.Contains(v, ":") {
+			return d, fmt.Errorf("Invalid roleName %q: use a role name, not an ARN", v)
+		}
+		d.RoleName = v
+	}
+	if v := query.Get("externalId"); v != "" {
+		d.ExternalID = v
+	}
+	lists := []struct {
+		param string
+		dest  *[]string
+	}{
+		{"includeAccounts", &d.IncludeAccounts},
+		{"excludeAccounts", &d.ExcludeAccounts},
+		{"includeOUs", &d.IncludeOUs},
+		{"excludeOUs", &d.ExcludeOUs},
+	}
+	for _, list := range lists {
+		if values := SplitList(query[list.param]); len(values) > 0 {
+			*list.dest = values
+		}
+	}
+	return d, nil
+}
+
+// resolveOwnAccount sets opts.ownAccount to the account of the export's
+// credentials when it runs without roles and the credential map has rules
+// for accounts, which name the export's own by its ID
+func resolveOwnAccount(ctx context.Context, opts *FetchOptions) error {
+	if len(opts.Roles) > 0 || !slices.ContainsFunc(opts.CredentialMap, func(r CredentialRule) bool { return r.Account != "" }) {
+		return nil
+	}
+	identity, err := opts.clients().STS(opts.AWSConfig).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("error getting caller identity: %v", err)
+	}
+	opts.ownAccount = aws.ToString(identity.Account)
+	return nil
+}
+
+// SplitList flattens repeated and comma-separated query values
+func SplitList(values []string) []string {
+	var items []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// ResolveAccounts discovers the accounts selected by opts.Discovery and adds
+// a role for each one to opts.Roles. Without discovery or roles, it looks up
+// the export's own account when the credential map has rules for accounts.
+func ResolveAccounts(ctx context.Context, opts *FetchOptions) error {
+	d := opts.Discovery
+	if d.Source == "" {
+		return resolveOwnAccount(ctx, opts)
+	}
+
+	identity, err := opts.clients().STS(opts.AWSConfig).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("error getting caller identity: %v", err)
+	}
+	self := aws.ToString(identity.Account)
+	partition := RegionPartition(opts.AWSConfig.Region)
+	if parsed, err := arn.Parse(aws.ToString(identity.Arn)); err == nil {
+		partition = parsed.Partition
+	}
+
+	var accounts []string
+	switch d.Source {
+	case discoverOrganizations:
+		accounts, err = listOrganizationAccounts(ctx, opts.AWSConfig)
+	case discoverGuardDuty:
+		accounts, err = listGuardDutyMembers(ctx, opts.clients().GuardDuty(opts.AWSConfig, ""))
+		accounts = append([]string{self}, accounts...)
+	}
+	if err != nil {
+		return fmt.Errorf("error discovering accounts: %v", err)
+	}
+
+	accounts, err = filterAccounts(ctx, opts.AWSConfig, accounts, d)
+	if err != nil {
+		return fmt.Errorf("error filtering accounts: %v", err)
+	}
+	telemetry.Logger(ctx).Info("Discovered accounts", "accounts", len(accounts), "source", d.Source)
+
+	roleName := d.RoleName
+	if roleName == "" {
+		roleName = defaultDiscoveryRole
+	}
+	// Copy the roles so the configured defaults are never appended to
+	opts.Roles = append([]Role(nil), opts.Roles...)
+	known := make(map[string]bool)
+	for _, role := range opts.Roles {
+		known[role.accountID()] = true
+	}
+	for _, account := range accounts {
+		if known[account] {
+			continue
+		}
+		known[account] = true
+		if account == self {
+			opts.Roles = append(opts.Roles, Role{selfAccount: account})
+			continue
+		}
+		opts.Roles = append(opts.Roles, Role{
+			ARN:        fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, account, roleName),
+			ExternalID: d.ExternalID,
+		})
+	}
+	if len(opts.Roles) == 0 {
+		return fmt.Errorf("no accounts matched the discovery filters")
+	}
+	return nil
+}
+
+// listOrganizationAccounts returns the IDs of the organization's active accounts
+func listOrganizationAccounts(ctx context.Context, cfg aws.Config) ([]string, error) {
+	client := organizations.NewFromConfig(cfg)
+	paginator := organizations.NewListAccountsPaginator(client, &organizations.ListAccountsInput{})
+
+	var accounts []string
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, account := range page.Accounts {
+			if account.Status == orgtypes.AccountStatusActive {
+				accounts = append(accounts, aws.ToString(account.Id))
+			}
+		}
+	}
+	return accounts, nil
+}
+
+// listGuardDutyMembers returns the member accounts with an enabled
+// relationship to the GuardDuty administrator in the configured region
+func listGuardDutyMembers(ctx context.Context, client MembersAPI) ([]string, error) {
+	detectors, err := client.ListDetectors(ctx, &guardduty.ListDetectorsInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []string
+	for _, detectorID := range detectors.DetectorIds {
+		paginator := guardduty.NewListMembersPaginator(client, &guardduty.ListMembersInput{
+			DetectorId:     aws.String(detectorID),
+			OnlyAssociated: aws.String("true"),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, member := range page.Members {
+				if strings.EqualFold(aws.ToString(member.RelationshipStatus), "Enabled") {
+					accounts = append(accounts, aws.ToString(member.AccountId))
+				}
+			}
+		}
+	}
+	return accounts, nil
+}
+
+// filterAccounts applies the include and exclude lists of d to accounts
+func filterAccounts(ctx context.Context, cfg aws.Config, accounts []string, d Discovery) ([]string, error) {
+	include := toSet(d.IncludeAccounts)
+	exclude := toSet(d.ExcludeAccounts)
+
+	if len(d.IncludeOUs) > 0 || len(d.ExcludeOUs) > 0 {
+		client := organizations.NewFromConfig(cfg)
+		if len(d.IncludeOUs) > 0 {
+			inOUs, err := accountsUnderOUs(ctx, client, d.IncludeOUs)
+			if err != nil {
+				return nil, err
+			}
+			if len(include) == 0 {
+				include = inOUs
+			} else {
+				for account := range inOUs {
+					include[account] = true
+				}
+			}
+		}
+		if len(d.ExcludeOUs) > 0 {
+			outOUs, err := accountsUnderOUs(ctx, client, d.ExcludeOUs)
+			if err != nil {
+				return nil, err
+			}
+			for account := range outOUs {
+				exclude[account] = true
+			}
+		}
+	}
+
+	var filtered []string
+	for _, account := range accounts {
+		if len(include) > 0 && !include[account] {
+			continue
+		}
+		if exclude[account] {
+			continue
+		}
+		filtered = append(filtered, account)
+	}
+	return filtered, nil
+}
+
+// accountsUnderOUs returns the accounts in the given organizational units and
+// all of their child units
+func accountsUnderOUs(ctx context.Context, client *organizations.Client, ous []string) (map[string]bool, error) {
+	accounts := make(map[string]bool)
+	queue := append([]string(nil), ous...)
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+
+		accountPages := organizations.NewListAccountsForParentPaginator(client, &organizations.ListAccountsForParentInput{ParentId: aws.String(parent)})
+		for accountPages.HasMorePages() {
+			page, err := accountPages.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error listing accounts in %s: %v", parent, err)
+			}
+			for _, account := range page.Accounts {
+				accounts[aws.ToString(account.Id)] = true
+			}
+		}
+
+		ouPages := organizations.NewListOrganizationalUnitsForParentPaginator(client, &organizations.ListOrganizationalUnitsForParentInput{ParentId: aws.String(parent)})
+		for ouPages.HasMorePages() {
+			page, err := ouPages.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error listing organizational units in %s: %v", parent, err)
+			}
+			for _, ou := range page.OrganizationalUnits {
+				queue = append(queue, aws.ToString(ou.Id))
+			}
+		}
+	}
+	return accounts, nil
+}
+
+// toSet returns the items as a set
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
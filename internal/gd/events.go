@@ -0,0 +1,63 @@
+package gd
+
+import "time"
+
+// Progress event types, in the order they occur during an export
+const (
+	EventRegionStarted   = "region_started"
+	EventDetectorStarted = "detector_started"
+	EventPageFetched     = "page_fetched"
+	EventThrottled       = "throttled"
+	EventRegionDone      = "region_done"
+	EventTruncated       = "truncated"
+	EventDone            = "done"
+)
+
+// EventQueued is sent by a job waiting in the server's job queue whenever
+// its place in line changes, before the events of its export
+const EventQueued = "queued"
+
+// Event describes one step of an export. Account, Region, Detector,
+// Page, PageFindings, and for throttled events Operation and the error code
+// in Error are set by the fetcher, with the PageLatency of pages fetched from
+// GuardDuty; the job fills in the running totals and its pace before the
+// event is sent to subscribers. A truncated event, sent when a limit stops
+// the export, describes the limit in Skipped. A queued event has the job's
+// QueuePosition.
+type Event struct {
+	Type         string `json:"type"`
+	Account      string `json:"account,omitempty"`
+	Region       string `json:"region,omitempty"`
+	Detector     string `json:"detector,omitempty"`
+	Page         int    `json:"page,omitempty"`
+	PageFindings int    `json:"pageFindings,omitempty"`
+	// PageLatency is how long the page took to fetch, in milliseconds
+	PageLatency  int64  `json:"pageLatencyMs,omitempty"`
+	Operation    string `json:"operation,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Skipped      string `json:"skipped,omitempty"`
+	Status       string `json:"status,omitempty"`
+	Findings     int    `json:"findings"`
+	RegionsDone  int    `json:"regionsDone"`
+	RegionsTotal int    `json:"regionsTotal"`
+	Throttles    int    `json:"throttles,omitempty"`
+	// QueuePosition is 1 for the next job to start
+	QueuePosition int `json:"queuePosition,omitempty"`
+	// FindingsPerSecond is the job's recent throughput; EstimatedFindings
+	// is the number of findings its export is expected to have, once they
+	// are counted, and EstimatedCompletion when it should finish at that
+	// pace
+	FindingsPerSecond   float64    `json:"findingsPerSecond,omitempty"`
+	EstimatedFindings   int        `json:"estimatedFindings,omitempty"`
+	EstimatedCompletion *time.Time `json:"estimatedCompletion,omitempty"`
+}
+
+// ProgressFunc receives progress events from a running export; a nil
+// ProgressFunc discards them
+type ProgressFunc func(event Event)
+
+func (p ProgressFunc) emit(event Event) {
+	if p != nil {
+		p(event)
+	}
+}
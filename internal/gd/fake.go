@@ -0,0 +1,879 @@
+package gd
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+)
+
+// defaultFakeRegion is the region of the findings added to a Fake without one
+const defaultFakeRegion = "us-east-1"
+
+// maxFakeListings is the number of filtered and sorted listings a detector
+// of a Fake keeps for paging through them
+const maxFakeListings = 16
+
+// Fake is an in-memory AWS for exports. It implements Clients, and its
+// GuardDuty, EC2, and STS clients answer from the findings added to it, so
+// fetching, paging, filtering, and archiving can be exercised without AWS,
+// or against the findings of an earlier export loaded as a fixture. Each
+// account and region with findings, or added with AddDetector or
+// SuspendDetector, has one detector. Listings apply the criteria on IDs,
+// account, region, type, severity, times, archival, and resource type and
+// sort as asked; other criteria are ignored. The options that pace
+// GuardDuty calls are ignored too, but calls are counted in the summary of
+// the export that makes them. A Fake is made with NewFake and is safe for
+// concurrent use.
+type Fake struct {
+	// AccountID is the account of the export's own credentials, and of
+	// findings added without an account
+	AccountID string
+	// PageSize, when set, caps the finding IDs of a ListFindings page below
+	// its MaxResults, so paging can be exercised with a few findings
+	PageSize int
+	// Latency delays every call, as a round trip to AWS would
+	Latency time.Duration
+
+	mu        sync.Mutex
+	detectors map[string]*fakeDetector
+	failures  map[string]error
+	calls     map[string]int
+}
+
+// fakeDetector holds the findings and saved filters of a detector, in the
+// order they were added, and whether it is suspended. The services of held
+// findings are replaced rather than changed, so a finding taken from
+// findings can be copied without holding the Fake's lock.
+type fakeDetector struct {
+	id       string
+	findings []types.Finding
+	index    map[string]int
+	filters  map[string]*guardduty.GetFilterOutput
+	disabled bool
+	// listings are the positions in findings of the findings of each
+	// listing asked for, in its order, kept until the findings change so
+	// paging through one doesn't match every finding on each page
+	listings map[string][]int
+}
+
+// NewFake returns a Fake without findings whose own credentials belong to
+// accountID, or to DefaultSyntheticAccount when it is empty
+func NewFake(accountID string) *Fake {
+	if accountID == "" {
+		accountID = DefaultSyntheticAccount
+	}
+	return &Fake{
+		AccountID: accountID,
+		detectors: make(map[string]*fakeDetector),
+		failures:  make(map[string]error),
+		calls:     make(map[string]int),
+	}
+}
+
+// AddDetector adds a detector without findings to an account and region,
+// the Fake's own account when account is empty, and returns its ID
+func (f *Fake) AddDetector(account, region string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.detector(f.account(account), region, true).id
+}
+
+// SuspendDetector suspends the detector of an account and region, adding
+// it when it is missing, and returns its ID. Its findings can still be
+// listed, and UpdateDetector enables it again.
+func (f *Fake) SuspendDetector(account, region string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.detector(f.account(account), region, true)
+	d.disabled = true
+	return d.id
+}
+
+// AddFindings adds findings to the detectors of their accounts and regions,
+// whose IDs they are given, replacing those with the same ID
+func (f *Fake) AddFindings(findings ...types.Finding) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, finding := range findings {
+		f.addFinding(copyFinding(finding))
+	}
+}
+
+// addFinding adds a finding that shares nothing with the caller to the
+// detector of its account and region. f.mu must be held.
+func (f *Fake) addFinding(finding types.Finding) {
+	account := f.account(aws.ToString(finding.AccountId))
+	region := cmp.Or(aws.ToString(finding.Region), defaultFakeRegion)
+	finding.AccountId, finding.Region = aws.String(account), aws.String(region)
+	d := f.detector(account, region, true)
+	if finding.Service == nil {
+		finding.Service = &types.Service{}
+	}
+	finding.Service.DetectorId = aws.String(d.id)
+	clear(d.listings)
+	id := aws.ToString(finding.Id)
+	if i, ok := d.index[id]; ok {
+		d.findings[i] = finding
+		return
+	}
+	d.index[id] = len(d.findings)
+	d.findings = append(d.findings, finding)
+}
+
+// Load adds the findings of a JSON fixture: a JSON export, which is an
+// array of findings, or the output of GetFindings, such as that of aws
+// guardduty get-findings, which holds them under Findings
+func (f *Fake) Load(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("error reading findings: %v", err)
+	}
+	var findings []types.Finding
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var output struct{ Findings []types.Finding }
+		err = json.Unmarshal(data, &output)
+		findings = output.Findings
+	} else {
+		err = json.Unmarshal(data, &findings)
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing findings: %v", err)
+	}
+	f.AddFindings(findings...)
+	return nil
+}
+
+// Findings returns the findings of an account and region as they are held,
+// such as to check which were archived
+func (f *Fake) Findings(account, region string) []types.Finding {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.detector(f.account(account), region, false)
+	if d == nil {
+		return nil
+	}
+	findings := make([]types.Finding, len(d.findings))
+	for i := range d.findings {
+		findings[i] = copyFinding(d.findings[i])
+	}
+	return findings
+}
+
+// Fail makes every call of operation, such as "ListFindings", fail with err
+// until it is called again with a nil err
+func (f *Fake) Fail(operation string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.failures, operation)
+		return
+	}
+	f.failures[operation] = err
+}
+
+// Calls returns the number of calls of operation so far, those that failed
+// among them
+func (f *Fake) Calls(operation string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[operation]
+}
+
+// GuardDuty returns a GuardDuty client of the detector of account in
+// cfg.Region
+func (f *Fake) GuardDuty(cfg aws.Config, account string, _ ...func(*guardduty.Options)) GuardDutyAPI {
+	return &fakeGuardDuty{fake: f, account: f.account(account), region: cfg.Region}
+}
+
+// EC2 returns an EC2 client listing the regions of the Fake's detectors
+func (f *Fake) EC2(_ aws.Config, _ string) EC2API {
+	return fakeEC2{fake: f}
+}
+
+// STS returns an STS client identifying the Fake's own account
+func (f *Fake) STS(_ aws.Config) STSAPI {
+	return fakeSTS{fake: f}
+}
+
+// account returns the account a call or finding without one belongs to
+func (f *Fake) account(account string) string {
+	return cmp.Or(account, f.AccountID)
+}
+
+// detector returns the detector of an account and region, adding it when
+// create is set and it is missing. f.mu must be held.
+func (f *Fake) detector(account, region string, create bool) *fakeDetector {
+	key := account + "/" + region
+	d, ok := f.detectors[key]
+	if !ok && create {
+		sum := sha256.Sum256([]byte(key))
+		d = &fakeDetector{
+			id:       hex.EncodeToString(sum[:16]),
+			index:    make(map[string]int),
+			filters:  make(map[string]*guardduty.GetFilterOutput),
+			listings: make(map[string][]int),
+		}
+		f.detectors[key] = d
+	}
+	return d
+}
+
+// call waits out the Fake's latency, counts a call of operation, also in the
+// call counts of ctx, and returns the error it fails with
+func (f *Fake) call(ctx context.Context, operation string) error {
+	if f.Latency > 0 {
+		timer := time.NewTimer(f.Latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	if counts, ok := ctx.Value(callCountsKey{}).(*callCounts); ok {
+		counts.calls.Add(1)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[operation]++
+	return f.failures[operation]
+}
+
+// regions returns the regions of the Fake's detectors, sorted
+func (f *Fake) regions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var regions []string
+	for key := range f.detectors {
+		_, region, _ := strings.Cut(key, "/")
+		if !slices.Contains(regions, region) {
+			regions = append(regions, region)
+		}
+	}
+	slices.Sort(regions)
+	return regions
+}
+
+// copyFinding returns a copy of a finding that shares nothing with it, so
+// the enrichers and rules of an export can't change the findings held
+func copyFinding(finding types.Finding) types.Finding {
+	data, err := json.Marshal(finding)
+	if err != nil {
+		return finding
+	}
+	var c types.Finding
+	if err := json.Unmarshal(data, &c); err != nil {
+		return finding
+	}
+	return c
+}
+
+// fakeError returns the error GuardDuty answers a bad request with
+func fakeError(format string, args ...any) error {
+	return &smithy.GenericAPIError{Code: "BadRequestException", Message: fmt.Sprintf(format, args...), Fault: smithy.FaultClient}
+}
+
+// fakeGuardDuty is the GuardDuty client of a Fake for one account and
+// region
+type fakeGuardDuty struct {
+	fake            *Fake
+	account, region string
+}
+
+// detector returns the detector with id, locking the Fake until unlock is
+// called
+func (c *fakeGuardDuty) detector(id *string) (d *fakeDetector, unlock func(), err error) {
+	c.fake.mu.Lock()
+	d = c.fake.detector(c.account, c.region, false)
+	if d == nil || d.id != aws.ToString(id) {
+		c.fake.mu.Unlock()
+		return nil, nil, fakeError("The request is rejected because the input detectorId is not owned by the current account.")
+	}
+	return d, c.fake.mu.Unlock, nil
+}
+
+func (c *fakeGuardDuty) ListDetectors(ctx context.Context, _ *guardduty.ListDetectorsInput, _ ...func(*guardduty.Options)) (*guardduty.ListDetectorsOutput, error) {
+	if err := c.fake.call(ctx, "ListDetectors"); err != nil {
+		return nil, err
+	}
+	c.fake.mu.Lock()
+	defer c.fake.mu.Unlock()
+	output := &guardduty.ListDetectorsOutput{DetectorIds: []string{}}
+	if d := c.fake.detector(c.account, c.region, false); d != nil {
+		output.DetectorIds = append(output.DetectorIds, d.id)
+	}
+	return output, nil
+}
+
+func (c *fakeGuardDuty) GetDetector(ctx context.Context, params *guardduty.GetDetectorInput, _ ...func(*guardduty.Options)) (*guardduty.GetDetectorOutput, error) {
+	if err := c.fake.call(ctx, "GetDetector"); err != nil {
+		return nil, err
+	}
+	d, unlock, err := c.detector(params.DetectorId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	status := types.DetectorStatusEnabled
+	if d.disabled {
+		status = types.DetectorStatusDisabled
+	}
+	return &guardduty.GetDetectorOutput{
+		Status:                     status,
+		ServiceRole:                aws.String(fmt.Sprintf("arn:aws:iam::%s:role/aws-service-role/guardduty.amazonaws.com/AWSServiceRoleForAmazonGuardDuty", c.account)),
+		FindingPublishingFrequency: types.FindingPublishingFrequencySixHours,
+	}, nil
+}
+
+func (c *fakeGuardDuty) ListFindings(ctx context.Context, params *guardduty.ListFindingsInput, _ ...func(*guardduty.Options)) (*guardduty.ListFindingsOutput, error) {
+	if err := c.fake.call(ctx, "ListFindings"); err != nil {
+		return nil, err
+	}
+	d, unlock, err := c.detector(params.DetectorId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	offset := 0
+	if token := aws.ToString(params.NextToken); token != "" {
+		if offset, err = strconv.Atoi(token); err != nil || offset < 0 {
+			return nil, fakeError("The request is rejected because the input nextToken is not valid.")
+		}
+	}
+	size := int(aws.ToInt32(params.MaxResults))
+	if size <= 0 || size > MaxFindingsPage {
+		size = MaxFindingsPage
+	}
+	if c.fake.PageSize > 0 {
+		size = min(size, c.fake.PageSize)
+	}
+
+	listed := d.listing(params.FindingCriteria, params.SortCriteria)
+	output := &guardduty.ListFindingsOutput{FindingIds: []string{}}
+	for _, i := range listed[min(offset, len(listed)):min(offset+size, len(listed))] {
+		output.FindingIds = append(output.FindingIds, aws.ToString(d.findings[i].Id))
+	}
+	if offset+size < len(listed) {
+		output.NextToken = aws.String(strconv.Itoa(offset + size))
+	}
+	return output, nil
+}
+
+func (c *fakeGuardDuty) GetFindings(ctx context.Context, params *guardduty.GetFindingsInput, _ ...func(*guardduty.Options)) (*guardduty.GetFindingsOutput, error) {
+	if err := c.fake.call(ctx, "GetFindings"); err != nil {
+		return nil, err
+	}
+	if len(params.FindingIds) > MaxGetFindingsBatch {
+		return nil, fakeError("The request is rejected because the findingIds list has more than %d items.", MaxGetFindingsBatch)
+	}
+	d, unlock, err := c.detector(params.DetectorId)
+	if err != nil {
+		return nil, err
+	}
+	output := &guardduty.GetFindingsOutput{Findings: []types.Finding{}}
+	for _, id := range params.FindingIds {
+		if i, ok := d.index[id]; ok {
+			output.Findings = append(output.Findings, d.findings[i])
+		}
+	}
+	unlock()
+	for i := range output.Findings {
+		output.Findings[i] = copyFinding(output.Findings[i])
+	}
+	return output, nil
+}
+
+func (c *fakeGuardDuty) GetFindingsStatistics(ctx context.Context, params *guardduty.GetFindingsStatisticsInput, _ ...func(*guardduty.Options)) (*guardduty.GetFindingsStatisticsOutput, error) {
+	if err := c.fake.call(ctx, "GetFindingsStatistics"); err != nil {
+		return nil, err
+	}
+	d, unlock, err := c.detector(params.DetectorId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	var listed []types.Finding
+	for _, i := range d.listing(params.FindingCriteria, nil) {
+		listed = append(listed, d.findings[i])
+	}
+	stats := &types.FindingStatistics{}
+	switch params.GroupBy {
+	case types.GroupByTypeSeverity:
+		counts := make(map[float64]int32)
+		for _, finding := range listed {
+			counts[aws.ToFloat64(finding.Severity)]++
+		}
+		for _, severity := range slices.Sorted(maps.Keys(counts)) {
+			stats.GroupedBySeverity = append(stats.GroupedBySeverity, types.SeverityStatistics{Severity: aws.Float64(severity), TotalFindings: aws.Int32(counts[severity])})
+		}
+	case types.GroupByTypeFindingType:
+		counts := make(map[string]int32)
+		for _, finding := range listed {
+			counts[aws.ToString(finding.Type)]++
+		}
+		for _, findingType := range fakeMostCommon(counts, params.MaxResults) {
+			stats.GroupedByFindingType = append(stats.GroupedByFindingType, types.FindingTypeStatistics{FindingType: aws.String(findingType), TotalFindings: aws.Int32(counts[findingType])})
+		}
+	case types.GroupByTypeResource:
+		counts := make(map[string]int32)
+		for _, finding := range listed {
+			resourceType, resourceID := fakeResource(finding)
+			counts[resourceType+"\x00"+resourceID]++
+		}
+		for _, key := range fakeMostCommon(counts, params.MaxResults) {
+			resourceType, resourceID, _ := strings.Cut(key, "\x00")
+			stats.GroupedByResource = append(stats.GroupedByResource, types.ResourceStatistics{
+				AccountId: aws.String(c.account), ResourceType: aws.String(resourceType), ResourceId: aws.String(resourceID), TotalFindings: aws.Int32(counts[key]),
+			})
+		}
+	case "":
+		stats.CountBySeverity = make(map[string]int32)
+		for _, finding := range listed {
+			stats.CountBySeverity[strconv.FormatFloat(aws.ToFloat64(finding.Severity), 'f', 1, 64)]++
+		}
+	default:
+		return nil, fakeError("The request is rejected because groupBy %s is not supported by the fake.", params.GroupBy)
+	}
+	return &guardduty.GetFindingsStatisticsOutput{FindingStatistics: stats}, nil
+}
+
+// fakeMostCommon returns the keys of counts, the most common first, up to
+// limit when it is set
+func fakeMostCommon(counts map[string]int32, limit *int32) []string {
+	keys := slices.Sorted(maps.Keys(counts))
+	slices.SortStableFunc(keys, func(a, b string) int { return int(counts[b] - counts[a]) })
+	if n := int(aws.ToInt32(limit)); n > 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// fakeResource returns the type and identifier of the resource of a finding
+func fakeResource(finding types.Finding) (string, string) {
+	r := finding.Resource
+	if r == nil {
+		return "", ""
+	}
+	resourceType := aws.ToString(r.ResourceType)
+	switch {
+	case r.InstanceDetails != nil:
+		return resourceType, aws.ToString(r.InstanceDetails.InstanceId)
+	case r.AccessKeyDetails != nil:
+		return resourceType, aws.ToString(r.AccessKeyDetails.AccessKeyId)
+	case len(r.S3BucketDetails) > 0:
+		return resourceType, aws.ToString(r.S3BucketDetails[0].Name)
+	case r.EksClusterDetails != nil:
+		return resourceType, aws.ToString(r.EksClusterDetails.Name)
+	}
+	return resourceType, ""
+}
+
+// listing returns the positions of the findings of d that match criteria,
+// in the order of sortCriteria. f.mu must be held.
+func (d *fakeDetector) listing(criteria *types.FindingCriteria, sortCriteria *types.SortCriteria) []int {
+	key, _ := json.Marshal([]any{criteria, sortCriteria})
+	if listed, ok := d.listings[string(key)]; ok {
+		return listed
+	}
+	listed := []int{}
+	for i, finding := range d.findings {
+		if criteria == nil || fakeMatches(finding, criteria.Criterion) {
+			listed = append(listed, i)
+		}
+	}
+	if sortCriteria != nil {
+		if s, ok := findingSorts[aws.ToString(sortCriteria.AttributeName)]; ok {
+			slices.SortStableFunc(listed, func(a, b int) int {
+				if sortCriteria.OrderBy == types.OrderByDesc {
+					return s.compare(d.findings[b], d.findings[a])
+				}
+				return s.compare(d.findings[a], d.findings[b])
+			})
+		}
+	}
+	if len(d.listings) >= maxFakeListings {
+		clear(d.listings)
+	}
+	d.listings[string(key)] = listed
+	return listed
+}
+
+// fakeMatches reports whether a finding meets every condition on the
+// fields the Fake knows, as GuardDuty compares them: strings for equality,
+// and numbers, with times in milliseconds since the epoch, for bounds
+func fakeMatches(finding types.Finding, criterion map[string]types.Condition) bool {
+	for field, c := range criterion {
+		value, number, ok := fakeField(finding, field)
+		if !ok {
+			continue
+		}
+		if equals := slices.Concat(c.Eq, c.Equals); len(equals) > 0 && !slices.Contains(equals, value) {
+			return false
+		}
+		if slices.Contains(slices.Concat(c.Neq, c.NotEquals), value) {
+			return false
+		}
+		for _, bound := range []struct {
+			limit *int64
+			holds func(float64, float64) bool
+		}{
+			{c.GreaterThan, func(n, limit float64) bool { return n > limit }},
+			{fakeInt64(c.Gt), func(n, limit float64) bool { return n > limit }},
+			{c.GreaterThanOrEqual, func(n, limit float64) bool { return n >= limit }},
+			{fakeInt64(c.Gte), func(n, limit float64) bool { return n >= limit }},
+			{c.LessThan, func(n, limit float64) bool { return n < limit }},
+			{fakeInt64(c.Lt), func(n, limit float64) bool { return n < limit }},
+			{c.LessThanOrEqual, func(n, limit float64) bool { return n <= limit }},
+			{fakeInt64(c.Lte), func(n, limit float64) bool { return n <= limit }},
+		} {
+			if bound.limit != nil && !bound.holds(number, float64(*bound.limit)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fakeInt64 widens one of the deprecated 32-bit bounds of a condition
+func fakeInt64(n *int32) *int64 {
+	if n == nil {
+		return nil
+	}
+	return aws.Int64(int64(*n))
+}
+
+// fakeField returns the value of a criterion field of a finding as a string
+// and as a number, and false for a field the Fake doesn't know
+func fakeField(finding types.Finding, field string) (string, float64, bool) {
+	switch field {
+	case "id":
+		return aws.ToString(finding.Id), 0, true
+	case "accountId":
+		return aws.ToString(finding.AccountId), 0, true
+	case "region":
+		return aws.ToString(finding.Region), 0, true
+	case "type":
+		return aws.ToString(finding.Type), 0, true
+	case "severity":
+		severity := aws.ToFloat64(finding.Severity)
+		return strconv.FormatFloat(severity, 'f', -1, 64), severity, true
+	case "createdAt", "updatedAt":
+		value := finding.CreatedAt
+		if field == "updatedAt" {
+			value = finding.UpdatedAt
+		}
+		t, _ := time.Parse(time.RFC3339, aws.ToString(value))
+		return aws.ToString(value), float64(t.UnixMilli()), true
+	case "service.archived":
+		archived := finding.Service != nil && aws.ToBool(finding.Service.Archived)
+		return strconv.FormatBool(archived), 0, true
+	case "resource.resourceType":
+		resourceType, _ := fakeResource(finding)
+		return resourceType, 0, true
+	}
+	return "", 0, false
+}
+
+func (c *fakeGuardDuty) ArchiveFindings(ctx context.Context, params *guardduty.ArchiveFindingsInput, _ ...func(*guardduty.Options)) (*guardduty.ArchiveFindingsOutput, error) {
+	if err := c.fake.call(ctx, "ArchiveFindings"); err != nil {
+		return nil, err
+	}
+	d, unlock, err := c.detector(params.DetectorId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	c.updateFindings(d, params.FindingIds, func(s *types.Service) { s.Archived = aws.Bool(true) })
+	return &guardduty.ArchiveFindingsOutput{}, nil
+}
+
+func (c *fakeGuardDuty) UpdateFindingsFeedback(ctx context.Context, params *guardduty.UpdateFindingsFeedbackInput, _ ...func(*guardduty.Options)) (*guardduty.UpdateFindingsFeedbackOutput, error) {
+	if err := c.fake.call(ctx, "UpdateFindingsFeedback"); err != nil {
+		return nil, err
+	}
+	d, unlock, err := c.detector(params.DetectorId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	c.updateFindings(d, params.FindingIds, func(s *types.Service) { s.UserFeedback = aws.String(string(params.Feedback)) })
+	return &guardduty.UpdateFindingsFeedbackOutput{}, nil
+}
+
+// updateFindings replaces the service details of the findings of d with
+// ids with changed copies
+func (c *fakeGuardDuty) updateFindings(d *fakeDetector, ids []string, update func(*types.Service)) {
+	for _, id := range ids {
+		i, ok := d.index[id]
+		if !ok {
+			continue
+		}
+		var service types.Service
+		if d.findings[i].Service != nil {
+			service = *d.findings[i].Service
+		}
+		update(&service)
+		d.findings[i].Service = &service
+	}
+	clear(d.listings)
+}
+
+func (c *fakeGuardDuty) ListFilters(ctx context.Context, params *guardduty.ListFiltersInput, _ ...func(*guardduty.Options)) (*guardduty.ListFiltersOutput, error) {
+	if err := c.fake.call(ctx, "ListFilters"); err != nil {
+		return nil, err
+	}
+	d, unlock, err := c.detector(params.DetectorId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return &guardduty.ListFiltersOutput{FilterNames: slices.Sorted(maps.Keys(d.filters))}, nil
+}
+
+func (c *fakeGuardDuty) GetFilter(ctx context.Context, params *guardduty.GetFilterInput, _ ...func(*guardduty.Options)) (*guardduty.GetFilterOutput, error) {
+	if err := c.fake.call(ctx, "GetFilter"); err != nil {
+		return nil, err
+	}
+	d, unlock, err := c.detector(params.DetectorId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	filter, ok := d.filters[aws.ToString(params.FilterName)]
+	if !ok {
+		return nil, fakeError("The request is rejected because the filter %s does not exist.", aws.ToString(params.FilterName))
+	}
+	output := *filter
+	return &output, nil
+}
+
+func (c *fakeGuardDuty) CreateFilter(ctx context.Context, params *guardduty.CreateFilterInput, _ ...func(*guardduty.Options)) (*guardduty.CreateFilterOutput, error) {
+	if err := c.fake.call(ctx, "CreateFilter"); err != nil {
+		return nil, err
+	}
+	d, unlock, err := c.detector(params.DetectorId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	name := aws.ToString(params.Name)
+	if _, ok := d.filters[name]; ok {
+		return nil, fakeError("The request is rejected because a filter named %s already exists.", name)
+	}
+	d.filters[name] = &guardduty.GetFilterOutput{
+		Name: aws.String(name), Action: cmp.Or(params.Action, types.FilterActionNoop), Description: params.Description,
+		FindingCriteria: params.FindingCriteria, Rank: params.Rank, Tags: params.Tags,
+	}
+	return &guardduty.CreateFilterOutput{Name: aws.String(name)}, nil
+}
+
+func (c *fakeGuardDuty) UpdateFilter(ctx context.Context, params *guardduty.UpdateFilterInput, _ ...func(*guardduty.Options)) (*guardduty.UpdateFilterOutput, error) {
+	if err := c.fake.call(ctx, "UpdateFilter"); err != nil {
+		return nil, err
+	}
+	d, unlock, err := c.detector(params.DetectorId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	filter, ok := d.filters[aws.ToString(params.FilterName)]
+	if !ok {
+		return nil, fakeError("The request is rejected because the filter %s does not exist.", aws.ToString(params.FilterName))
+	}
+	if params.Action != "" {
+		filter.Action = params.Action
+	}
+	if params.Description != nil {
+		filter.Description = params.Description
+	}
+	if params.FindingCriteria != nil {
+		filter.FindingCriteria = params.FindingCriteria
+	}
+	if params.Rank != nil {
+		filter.Rank = params.Rank
+	}
+	return &guardduty.UpdateFilterOutput{Name: filter.Name}, nil
+}
+
+func (c *fakeGuardDuty) DeleteFilter(ctx context.Context, params *guardduty.DeleteFilterInput, _ ...func(*guardduty.Options)) (*guardduty.DeleteFilterOutput, error) {
+	if err := c.fake.call(ctx, "DeleteFilter"); err != nil {
+		return nil, err
+	}
+	d, unlock, err := c.detector(params.DetectorId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if _, ok := d.filters[aws.ToString(params.FilterName)]; !ok {
+		return nil, fakeError("The request is rejected because the filter %s does not exist.", aws.ToString(params.FilterName))
+	}
+	delete(d.filters, aws.ToString(params.FilterName))
+	return &guardduty.DeleteFilterOutput{}, nil
+}
+
+func (c *fakeGuardDuty) CreateDetector(ctx context.Context, params *guardduty.CreateDetectorInput, _ ...func(*guardduty.Options)) (*guardduty.CreateDetectorOutput, error) {
+	if err := c.fake.call(ctx, "CreateDetector"); err != nil {
+		return nil, err
+	}
+	c.fake.mu.Lock()
+	defer c.fake.mu.Unlock()
+	if c.fake.detector(c.account, c.region, false) != nil {
+		return nil, fakeError("The request is rejected because a detector already exists for the current account.")
+	}
+	d := c.fake.detector(c.account, c.region, true)
+	d.disabled = !aws.ToBool(params.Enable)
+	return &guardduty.CreateDetectorOutput{DetectorId: aws.String(d.id)}, nil
+}
+
+func (c *fakeGuardDuty) UpdateDetector(ctx context.Context, params *guardduty.UpdateDetectorInput, _ ...func(*guardduty.Options)) (*guardduty.UpdateDetectorOutput, error) {
+	if err := c.fake.call(ctx, "UpdateDetector"); err != nil {
+		return nil, err
+	}
+	d, unlock, err := c.detector(params.DetectorId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if params.Enable != nil {
+		d.disabled = !*params.Enable
+	}
+	return &guardduty.UpdateDetectorOutput{}, nil
+}
+
+// The detector reports of a Fake find nothing: no lists, scans, usage,
+// coverage, members, administrator, organization, or destinations
+
+func (c *fakeGuardDuty) ListIPSets(ctx context.Context, _ *guardduty.ListIPSetsInput, _ ...func(*guardduty.Options)) (*guardduty.ListIPSetsOutput, error) {
+	if err := c.fake.call(ctx, "ListIPSets"); err != nil {
+		return nil, err
+	}
+	return &guardduty.ListIPSetsOutput{IpSetIds: []string{}}, nil
+}
+
+func (c *fakeGuardDuty) GetIPSet(ctx context.Context, params *guardduty.GetIPSetInput, _ ...func(*guardduty.Options)) (*guardduty.GetIPSetOutput, error) {
+	if err := c.fake.call(ctx, "GetIPSet"); err != nil {
+		return nil, err
+	}
+	return nil, fakeError("The request is rejected because the IP set %s does not exist.", aws.ToString(params.IpSetId))
+}
+
+func (c *fakeGuardDuty) ListThreatIntelSets(ctx context.Context, _ *guardduty.ListThreatIntelSetsInput, _ ...func(*guardduty.Options)) (*guardduty.ListThreatIntelSetsOutput, error) {
+	if err := c.fake.call(ctx, "ListThreatIntelSets"); err != nil {
+		return nil, err
+	}
+	return &guardduty.ListThreatIntelSetsOutput{ThreatIntelSetIds: []string{}}, nil
+}
+
+func (c *fakeGuardDuty) GetThreatIntelSet(ctx context.Context, params *guardduty.GetThreatIntelSetInput, _ ...func(*guardduty.Options)) (*guardduty.GetThreatIntelSetOutput, error) {
+	if err := c.fake.call(ctx, "GetThreatIntelSet"); err != nil {
+		return nil, err
+	}
+	return nil, fakeError("The request is rejected because the threat intel set %s does not exist.", aws.ToString(params.ThreatIntelSetId))
+}
+
+func (c *fakeGuardDuty) DescribeMalwareScans(ctx context.Context, _ *guardduty.DescribeMalwareScansInput, _ ...func(*guardduty.Options)) (*guardduty.DescribeMalwareScansOutput, error) {
+	if err := c.fake.call(ctx, "DescribeMalwareScans"); err != nil {
+		return nil, err
+	}
+	return &guardduty.DescribeMalwareScansOutput{Scans: []types.Scan{}}, nil
+}
+
+func (c *fakeGuardDuty) GetUsageStatistics(ctx context.Context, _ *guardduty.GetUsageStatisticsInput, _ ...func(*guardduty.Options)) (*guardduty.GetUsageStatisticsOutput, error) {
+	if err := c.fake.call(ctx, "GetUsageStatistics"); err != nil {
+		return nil, err
+	}
+	return &guardduty.GetUsageStatisticsOutput{UsageStatistics: &types.UsageStatistics{}}, nil
+}
+
+func (c *fakeGuardDuty) ListCoverage(ctx context.Context, _ *guardduty.ListCoverageInput, _ ...func(*guardduty.Options)) (*guardduty.ListCoverageOutput, error) {
+	if err := c.fake.call(ctx, "ListCoverage"); err != nil {
+		return nil, err
+	}
+	return &guardduty.ListCoverageOutput{Resources: []types.CoverageResource{}}, nil
+}
+
+func (c *fakeGuardDuty) ListMembers(ctx context.Context, _ *guardduty.ListMembersInput, _ ...func(*guardduty.Options)) (*guardduty.ListMembersOutput, error) {
+	if err := c.fake.call(ctx, "ListMembers"); err != nil {
+		return nil, err
+	}
+	return &guardduty.ListMembersOutput{Members: []types.Member{}}, nil
+}
+
+func (c *fakeGuardDuty) GetAdministratorAccount(ctx context.Context, _ *guardduty.GetAdministratorAccountInput, _ ...func(*guardduty.Options)) (*guardduty.GetAdministratorAccountOutput, error) {
+	if err := c.fake.call(ctx, "GetAdministratorAccount"); err != nil {
+		return nil, err
+	}
+	return &guardduty.GetAdministratorAccountOutput{}, nil
+}
+
+func (c *fakeGuardDuty) DescribeOrganizationConfiguration(ctx context.Context, _ *guardduty.DescribeOrganizationConfigurationInput, _ ...func(*guardduty.Options)) (*guardduty.DescribeOrganizationConfigurationOutput, error) {
+	if err := c.fake.call(ctx, "DescribeOrganizationConfiguration"); err != nil {
+		return nil, err
+	}
+	return nil, fakeError("The request is rejected because the current account is not the GuardDuty delegated administrator account.")
+}
+
+func (c *fakeGuardDuty) ListPublishingDestinations(ctx context.Context, _ *guardduty.ListPublishingDestinationsInput, _ ...func(*guardduty.Options)) (*guardduty.ListPublishingDestinationsOutput, error) {
+	if err := c.fake.call(ctx, "ListPublishingDestinations"); err != nil {
+		return nil, err
+	}
+	return &guardduty.ListPublishingDestinationsOutput{Destinations: []types.Destination{}}, nil
+}
+
+func (c *fakeGuardDuty) DescribePublishingDestination(ctx context.Context, params *guardduty.DescribePublishingDestinationInput, _ ...func(*guardduty.Options)) (*guardduty.DescribePublishingDestinationOutput, error) {
+	if err := c.fake.call(ctx, "DescribePublishingDestination"); err != nil {
+		return nil, err
+	}
+	return nil, fakeError("The request is rejected because the destination %s does not exist.", aws.ToString(params.DestinationId))
+}
+
+// fakeEC2 is the EC2 client of a Fake
+type fakeEC2 struct {
+	fake *Fake
+}
+
+func (c fakeEC2) DescribeRegions(ctx context.Context, _ *ec2.DescribeRegionsInput, _ ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+	if err := c.fake.call(ctx, "DescribeRegions"); err != nil {
+		return nil, err
+	}
+	output := &ec2.DescribeRegionsOutput{}
+	for _, region := range c.fake.regions() {
+		output.Regions = append(output.Regions, ec2types.Region{RegionName: aws.String(region), OptInStatus: aws.String("opt-in-not-required")})
+	}
+	return output, nil
+}
+
+// fakeSTS is the STS client of a Fake
+type fakeSTS struct {
+	fake *Fake
+}
+
+func (c fakeSTS) GetCallerIdentity(ctx context.Context, _ *sts.GetCallerIdentityInput, _ ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	if err := c.fake.call(ctx, "GetCallerIdentity"); err != nil {
+		return nil, err
+	}
+	return &sts.GetCallerIdentityOutput{
+		Account: aws.String(c.fake.AccountID),
+		Arn:     aws.String(fmt.Sprintf("arn:aws:iam::%s:user/fake", c.fake.AccountID)),
+		UserId:  aws.String("AIDAFAKE"),
+	}, nil
+}
@@ -0,0 +1,53 @@
+package gd
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// maxFeedbackFindingsBatch is the most finding IDs UpdateFindingsFeedback
+// accepts in one call
+const maxFeedbackFindingsBatch = 50
+
+// ValidFeedback reports whether feedback is USEFUL or NOT_USEFUL
+func ValidFeedback(feedback string) bool {
+	switch types.Feedback(feedback) {
+	case types.FeedbackUseful, types.FeedbackNotUseful:
+		return true
+	}
+	return false
+}
+
+// SubmitFeedback marks findings of the one account and region of opts as
+// useful or not useful to GuardDuty, with optional comments, through
+// UpdateFindingsFeedback in batches of maxFeedbackFindingsBatch. It returns
+// the number of findings marked before a batch failed.
+func SubmitFeedback(ctx context.Context, opts FetchOptions, feedback, comments string, ids []string) (int, error) {
+	client, detectorID, err := targetDetector(ctx, opts)
+	if err != nil {
+		return 0, err
+	}
+	marked := 0
+	for start := 0; start < len(ids); start += maxFeedbackFindingsBatch {
+		batch := ids[start:min(start+maxFeedbackFindingsBatch, len(ids))]
+		input := &guardduty.UpdateFindingsFeedbackInput{
+			DetectorId: aws.String(detectorID),
+			Feedback:   types.Feedback(feedback),
+			FindingIds: batch,
+		}
+		if comments != "" {
+			input.Comments = aws.String(comments)
+		}
+		callCtx, cancel := callContext(ctx, opts.CallTimeout)
+		_, err := client.UpdateFindingsFeedback(callCtx, input)
+		cancel()
+		if err != nil {
+			return marked, callError(err, "error updating the feedback of %d findings for detector %s", len(batch), detectorID)
+		}
+		marked += len(batch)
+	}
+	return marked, nil
+}
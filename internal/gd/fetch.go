@@ -0,0 +1,692 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/telemetry"
+)
+
+// FetchOptions selects the findings an export fetches and how
+type FetchOptions struct {
+	Regions     []string
+	RegionGroup string
+	// Profile is the shared config profile whose credentials the export
+	// uses, and AWSConfig its SDK configuration
+	Profile      string
+	AWSConfig    aws.Config
+	Roles        []Role
+	Discovery    Discovery
+	ReportErrors bool
+	Concurrency  int
+	Timeout      time.Duration
+	CallTimeout  time.Duration
+	Filter       Filter
+	Sort         Order
+	// Detectors, when set, restricts the export to the detectors with these
+	// IDs, so that a region exports only those of them it has and is
+	// skipped if it has none
+	Detectors []string
+	// Watermarks restrict an incremental export to the findings of each
+	// detector updated since the previous run
+	Watermarks   map[string]time.Time
+	BatchSize    int
+	BatchRetries int
+	// Archiving keeps the IDs of the exported findings for Archive
+	Archiving bool
+	// Ticketing keeps the exported findings at or above TicketSeverity for
+	// filing as issues
+	Ticketing      bool
+	TicketSeverity float64
+	// ResourceTags, when set, looks up the current tags of the resources of
+	// the findings as they are fetched
+	ResourceTags *TagCache
+	// ResourceState, when set, looks up whether the resources of the
+	// findings still exist and their current state as they are fetched
+	ResourceState *StateCache
+	// SecurityHub, when set, looks up the workflow status and note of the
+	// Security Hub record of each finding as it is fetched
+	SecurityHub *WorkflowCache
+	// GeoIP, when set, resolves the remote addresses of the findings
+	// against local databases as they are fetched
+	GeoIP *GeoIP
+	// Suppressions, when set, leave the findings they match out as they are
+	// fetched, before the lookups and rules
+	Suppressions *SuppressionList
+	// Rules, when set, drop, change, tag, and route the findings as they
+	// are fetched, before Enrichers see them
+	Rules *RuleSet
+	// Enrichers add to each page of findings as it is fetched
+	Enrichers []Enricher
+	// Store, when set, is passed each page of findings as it is fetched,
+	// such as to keep them in a database beyond the export
+	Store func(ctx context.Context, findings []types.Finding)
+	// Dedupe collapses the findings fetched more than once
+	Dedupe Dedupe
+	// Limiters pace the GuardDuty calls of each account and region
+	Limiters *RateLimiters
+	// CredentialMap gives accounts and regions other credentials than the
+	// export's, with the configurations of the profiles it names in
+	// CredentialProfiles
+	CredentialMap      []CredentialRule
+	CredentialProfiles map[string]aws.Config
+	// ownAccount is the account of the export's credentials, which
+	// ResolveAccounts looks up so the credential map's rules for it apply
+	// when no roles are given
+	ownAccount string
+	// Clients, when set, builds the GuardDuty, EC2, and STS clients of the
+	// export instead of the SDK, such as a Fake that answers from memory
+	Clients Clients
+	// MaxFindings and MaxDuration stop a streamed export once it has
+	// delivered that many findings or run for that long, truncating it
+	// instead of failing it; zero means no limit
+	MaxFindings int
+	MaxDuration time.Duration
+	// Checkpoint, when set, records the export's progress so that it can be
+	// resumed if it fails, and resumes the progress it already holds
+	Checkpoint *Checkpoint
+}
+
+// Enricher adds to the findings of an export as they are fetched, such as
+// by looking up their addresses with a threat-intelligence service. Enrich
+// is passed each page of findings before it is written and may change them,
+// or keep what it learns for export columns registered with
+// export.RegisterColumn. It is called for several regions at once.
+type Enricher interface {
+	Enrich(ctx context.Context, findings []types.Finding)
+}
+
+// TargetCount returns the number of account and region combinations exported
+func (o FetchOptions) TargetCount() int {
+	return len(o.Regions) * max(1, len(o.Roles))
+}
+
+// exportTarget is one account and region to fetch findings from
+type exportTarget struct {
+	account  accountConfig
+	region   string
+	disabled bool
+	// limiter paces the target's GuardDuty calls; nil means no limit
+	limiter *rateLimiter
+}
+
+// label identifies the target in log messages and job progress
+func (t exportTarget) label() string {
+	return TargetLabel(t.account.accountID, t.region)
+}
+
+// config returns the AWS configuration of the target's account and region
+func (t exportTarget) config() aws.Config {
+	return t.account.regionConfig(t.region)
+}
+
+// client returns a GuardDuty client for the target whose calls are paced by
+// its limiter
+func (t exportTarget) client() GuardDutyAPI {
+	return t.account.guardDuty(t.region, t.limiter)
+}
+
+// TargetLabel returns "account/region", or just the region when the
+// exporter's own account is used
+func TargetLabel(account, region string) string {
+	if account == "" {
+		return region
+	}
+	return account + "/" + region
+}
+
+// RegionResult holds the outcome of fetching findings for one region of one
+// account. A region that could not be queried because GuardDuty or the region
+// itself is not enabled is skipped rather than failed.
+type RegionResult struct {
+	Account string
+	Region  string
+	// Findings holds the region's findings once a stream is collected; the
+	// result of a streamed region leaves it empty
+	Findings []types.Finding
+	// Count is the number of findings fetched, and Latest the latest update
+	// time of each detector's findings, keyed like the watermarks
+	Count  int
+	Latest map[string]time.Time
+	// BySeverity counts the findings fetched by SeverityLabel
+	BySeverity map[string]int
+	// Ticketed holds the findings at or above FetchOptions.TicketSeverity
+	// when FetchOptions.Ticketing is set
+	Ticketed []types.Finding
+	// Dropped is the number of findings FetchOptions.Rules left out, which
+	// Count does not include, and Routed holds the findings they routed,
+	// keyed by destination
+	Dropped int
+	Routed  map[string][]types.Finding
+	// Suppressed holds the findings FetchOptions.Suppressions left out,
+	// which Count does not include either
+	Suppressed []SuppressedFinding
+	// Detectors describes the detectors the findings were fetched from
+	Detectors []DetectorSummary
+	// Active lists the IDs of each detector's active findings when
+	// FetchOptions.Archiving is set
+	Active  map[string][]string
+	Skipped string
+	Err     error
+	// Gap is set when GuardDuty does not monitor the region: it has no
+	// detector, or only suspended ones
+	Gap *CoverageGap
+	// Truncated is set when the export's limits cut the region off part
+	// way; Count is then the number of findings delivered
+	Truncated bool
+	// Duplicates is the number of findings left out as duplicates of those
+	// already exported, which Count does not include
+	Duplicates int
+	// Pages counts the ListFindings pages fetched and Calls the attempts of
+	// every AWS API call made, and Duration is how long the region took
+	Pages    int
+	Calls    int
+	Duration time.Duration
+}
+
+// RegionSummary lists the outcome of each account and region of an export,
+// keyed by TargetLabel
+type RegionSummary struct {
+	Succeeded []string          `json:"succeeded"`
+	Failed    map[string]string `json:"failed,omitempty"`
+	Skipped   map[string]string `json:"skipped,omitempty"`
+	// Truncated lists the region cut off part way by the export's limits
+	Truncated []string `json:"truncated,omitempty"`
+}
+
+// SummarizeRegions returns which regions of results succeeded, failed with
+// their errors, were skipped with the reason, or were truncated
+func SummarizeRegions(results []RegionResult) RegionSummary {
+	summary := RegionSummary{Succeeded: []string{}}
+	for _, result := range results {
+		label := TargetLabel(result.Account, result.Region)
+		switch {
+		case result.Err != nil:
+			if summary.Failed == nil {
+				summary.Failed = make(map[string]string)
+			}
+			summary.Failed[label] = result.Err.Error()
+		case result.Skipped != "":
+			if summary.Skipped == nil {
+				summary.Skipped = make(map[string]string)
+			}
+			summary.Skipped[label] = result.Skipped
+		case result.Truncated:
+			summary.Truncated = append(summary.Truncated, label)
+		default:
+			summary.Succeeded = append(summary.Succeeded, label)
+		}
+	}
+	return summary
+}
+
+// LogFailures logs each failed region of an export that continued past them
+func (s RegionSummary) LogFailures(ctx context.Context) {
+	if len(s.Failed) == 0 {
+		return
+	}
+	log := telemetry.Logger(ctx)
+	log.Warn("Some regions failed", "succeeded", len(s.Succeeded), "failed", len(s.Failed))
+	labels := make([]string, 0, len(s.Failed))
+	for label := range s.Failed {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		log.Warn("Region failed", "region", label, "error", s.Failed[label])
+	}
+}
+
+// exportTargets returns every account and region combination in opts, in
+// account order and then region order
+func exportTargets(ctx context.Context, opts FetchOptions) []exportTarget {
+	var targets []exportTarget
+	for _, account := range accountConfigs(opts) {
+		// Opt-in regions that are not enabled would fail with an
+		// authentication error, so they are skipped up front
+		disabled, err := getDisabledRegions(ctx, account.clients.EC2(account.cfg, account.accountID), opts.CallTimeout)
+		if err != nil {
+			telemetry.Logger(ctx).Warn("Unable to check region opt-in status", "account", account.name(), "error", err)
+		}
+		for _, region := range opts.Regions {
+			targets = append(targets, exportTarget{
+				account:  account,
+				region:   region,
+				disabled: disabled[region],
+				limiter:  opts.Limiters.get(opts.Profile, account.accountID, region),
+			})
+		}
+	}
+	return targets
+}
+
+// eachTarget calls fn with the index of each of targets using up to
+// concurrency workers, and returns once every call has
+func eachTarget(targets []exportTarget, concurrency int, fn func(i int)) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(max(1, concurrency), len(targets)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := range targets {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// fetchRegion fetches the findings for one target and passes them to send,
+// applying the per-region timeout and reporting when the target starts and
+// finishes. Messages logged while fetching carry the region, and the finish
+// is logged with its duration. With opts.Sort set the region's findings are
+// collected and sorted before any are sent.
+func fetchRegion(ctx context.Context, opts FetchOptions, target exportTarget, send func(ctx context.Context, findings []types.Finding) error, progress ProgressFunc) RegionResult {
+	ctx, deadline := withRegionTimeout(ctx, opts.Timeout)
+	defer deadline.stop()
+	log := telemetry.Logger(ctx).With("region", target.label())
+	ctx = telemetry.WithLogger(ctx, log)
+
+	account, region := target.account.accountID, target.region
+	ctx, span := telemetry.StartSpan(ctx, "region", "cloud.region", region)
+	if account != "" {
+		span.Set("cloud.account.id", account)
+	}
+	start := time.Now()
+	ctx, counts := withCallCounts(ctx)
+	log.Info("Starting export for region")
+	ctx = withThrottleReporter(ctx, func(operation, code string) {
+		log.Info("Request throttled", "operation", operation, "error_code", code)
+		span.Set("throttled", operation+": "+code)
+		progress.emit(Event{Type: EventThrottled, Account: account, Region: region, Operation: operation, Error: code})
+	})
+	progress.emit(Event{Type: EventRegionStarted, Account: account, Region: region})
+
+	result := RegionResult{Account: account, Region: region, Latest: make(map[string]time.Time)}
+	if opts.Archiving {
+		result.Active = make(map[string][]string)
+	}
+	var sorted []types.Finding
+	emit := func(findings []types.Finding) error {
+		if opts.Suppressions != nil {
+			findings = opts.Suppressions.apply(findings, &result)
+		}
+		if opts.ResourceTags != nil {
+			opts.ResourceTags.tagFindings(ctx, target, findings, opts.CallTimeout)
+		}
+		if opts.ResourceState != nil {
+			opts.ResourceState.stateFindings(ctx, target, findings, opts.CallTimeout)
+		}
+		if opts.SecurityHub != nil {
+			opts.SecurityHub.workflowFindings(ctx, target, findings, opts.CallTimeout)
+		}
+		if opts.GeoIP != nil {
+			opts.GeoIP.resolveFindings(findings)
+		}
+		if opts.Rules != nil {
+			findings = opts.Rules.apply(findings, &result)
+		}
+		for _, enricher := range opts.Enrichers {
+			enricher.Enrich(ctx, findings)
+		}
+		if opts.Store != nil {
+			opts.Store(ctx, findings)
+		}
+		for _, finding := range findings {
+			result.record(finding)
+			if opts.Ticketing && aws.ToFloat64(finding.Severity) >= opts.TicketSeverity {
+				result.Ticketed = append(result.Ticketed, finding)
+			}
+		}
+		if opts.Sort.By != "" {
+			sorted = append(sorted, findings...)
+			return nil
+		}
+		// Time spent waiting for the writer doesn't count against the timeout
+		deadline.pause()
+		defer deadline.resume()
+		return send(ctx, findings)
+	}
+	resumed, skipped, err := opts.Checkpoint.resume(target, emit, progress)
+	if skipped != "" {
+		span.Set("skipped", skipped)
+		span.Finish(nil)
+		return skipRegion(ctx, target, skipped, progress)
+	}
+	if resumed {
+		log.Info("Resumed region from checkpoint", "findings", result.Count)
+	} else if err == nil {
+		if result.Count > 0 {
+			log.Info("Resuming region from checkpoint", "findings", result.Count)
+		}
+		result.Detectors, err = getGuardDutyFindings(ctx, target, opts, emit, progress)
+	}
+	if errors.Is(err, errGuardDutyNotEnabled) || errors.Is(err, errNoSelectedDetector) {
+		span.Set("skipped", err.Error())
+		span.Finish(nil)
+		if err := opts.Checkpoint.finish(target, err.Error()); err != nil {
+			log.Warn("Error checkpointing region", "error", err)
+		}
+		skipped := skipRegion(ctx, target, err.Error(), progress)
+		skipped.Calls, skipped.Duration = int(counts.calls.Load()), time.Since(start)
+		return skipped
+	}
+	if err == nil {
+		if result.Gap = suspendedGap(target, result.Detectors); result.Gap != nil {
+			log.Warn("GuardDuty detector is suspended", "detectors", result.Gap.Detectors)
+		}
+	}
+	if err == nil && !resumed {
+		err = opts.Checkpoint.finish(target, "")
+	}
+	if err == nil && len(sorted) > 0 {
+		sortFindings(sorted, opts.Sort)
+		err = send(ctx, sorted)
+	}
+	if err != nil && deadline.expired() {
+		err = fmt.Errorf("timed out after %s: %v", opts.Timeout, err)
+	}
+	if err != nil && account != "" {
+		err = fmt.Errorf("account %s: %v", account, err)
+	}
+	result.Err = err
+	result.Pages, result.Calls = int(counts.pages.Load()), int(counts.calls.Load())
+	result.Duration = time.Since(start)
+
+	done := Event{Type: EventRegionDone, Account: account, Region: region}
+	if err != nil {
+		done.Error = err.Error()
+		log.Error("Region failed", "duration", time.Since(start), "error", err)
+	} else {
+		log.Info("Finished region", "findings", result.Count, "dropped", result.Dropped, "suppressed", len(result.Suppressed), "duration", time.Since(start))
+	}
+	span.Set("findings", result.Count)
+	span.Finish(err)
+	progress.emit(done)
+	return result
+}
+
+// record counts a fetched finding, advances its detector's latest update
+// time, and notes its ID for archiving when it is active
+func (r *RegionResult) record(finding types.Finding) {
+	r.Count++
+	if r.BySeverity == nil {
+		r.BySeverity = make(map[string]int)
+	}
+	r.BySeverity[SeverityLabel(aws.ToFloat64(finding.Severity))]++
+	if finding.Service == nil || finding.Service.DetectorId == nil {
+		return
+	}
+	detectorID := *finding.Service.DetectorId
+	if updated, err := time.Parse(time.RFC3339, aws.ToString(finding.UpdatedAt)); err == nil {
+		key := watermarkKey(r.Region, detectorID)
+		if updated.After(r.Latest[key]) {
+			r.Latest[key] = updated
+		}
+	}
+	if r.Active != nil && !aws.ToBool(finding.Service.Archived) {
+		r.Active[detectorID] = append(r.Active[detectorID], aws.ToString(finding.Id))
+	}
+}
+
+// skipRegion records a target that was not queried and reports it as done.
+// A target skipped for lack of a detector, also when a checkpoint recorded
+// it, is a coverage gap.
+func skipRegion(ctx context.Context, target exportTarget, reason string, progress ProgressFunc) RegionResult {
+	telemetry.Logger(ctx).Info("Skipping region", "region", target.label(), "reason", reason)
+	progress.emit(Event{Type: EventRegionDone, Account: target.account.accountID, Region: target.region, Skipped: reason})
+	result := RegionResult{Account: target.account.accountID, Region: target.region, Skipped: reason}
+	if reason == errGuardDutyNotEnabled.Error() {
+		result.Gap = target.gap(GapNoDetector)
+	}
+	return result
+}
+
+// getGuardDutyFindings fetches the GuardDuty findings for a specific account
+// and region that match opts.Filter, passing each page of them to emit, and
+// returns the detectors it read. Each detector and page is reported to
+// progress, which may be nil.
+func getGuardDutyFindings(ctx context.Context, target exportTarget, opts FetchOptions, emit func([]types.Finding) error, progress ProgressFunc) ([]DetectorSummary, error) {
+	region := target.region
+	log := telemetry.Logger(ctx)
+
+	client := target.client()
+
+	listCtx, cancel := callContext(ctx, opts.CallTimeout)
+	detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("error listing detectors in region %s: %v", region, err)
+	}
+
+	log.Debug("Found detectors", "detectors", len(detectors.DetectorIds))
+	detectorIDs, err := opts.selectDetectors(detectors.DetectorIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var summaries []DetectorSummary
+	for _, detectorID := range detectorIDs {
+		summaries = append(summaries, describeDetector(ctx, client, detectorID, opts))
+		if done, _ := opts.Checkpoint.detector(target, detectorID); done {
+			continue
+		}
+		ctx, span := telemetry.StartSpan(ctx, "detector", "detector_id", detectorID)
+		findings, err := getDetectorFindings(ctx, client, target, detectorID, opts, emit, progress)
+		span.Set("findings", findings)
+		span.Finish(err)
+		if err != nil {
+			return summaries, err
+		}
+	}
+	return summaries, nil
+}
+
+// selectDetectors returns the detectors of a region that an export reads:
+// those of ids that opts.Detectors selects, or all of them when it selects
+// none
+func (o FetchOptions) selectDetectors(ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, errGuardDutyNotEnabled
+	}
+	if len(o.Detectors) == 0 {
+		return ids, nil
+	}
+	var selected []string
+	for _, id := range ids {
+		if slices.Contains(o.Detectors, id) {
+			selected = append(selected, id)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, errNoSelectedDetector
+	}
+	return selected, nil
+}
+
+// describeDetector returns the status and creation time of a detector for
+// the export summary. A detector that cannot be described, such as without
+// guardduty:GetDetector, is logged and summarized by its ID alone rather
+// than failing the region.
+func describeDetector(ctx context.Context, client DetectorsAPI, detectorID string, opts FetchOptions) DetectorSummary {
+	getCtx, cancel := callContext(ctx, opts.CallTimeout)
+	detector, err := client.GetDetector(getCtx, &guardduty.GetDetectorInput{DetectorId: aws.String(detectorID)})
+	cancel()
+	if err != nil {
+		telemetry.Logger(ctx).Warn("Error describing detector", "detector", detectorID, "error", err)
+		return DetectorSummary{DetectorID: detectorID}
+	}
+	return DetectorSummary{
+		DetectorID: detectorID,
+		Status:     string(detector.Status),
+		CreatedAt:  aws.ToString(detector.CreatedAt),
+		UpdatedAt:  aws.ToString(detector.UpdatedAt),
+	}
+}
+
+// getDetectorFindings pages through the findings of one detector that match
+// opts.Filter, starting from the detector's watermark in an incremental
+// export, and passes each page to emit, checkpointing it once emitted. A
+// detector with a checkpoint continues from the page after its last. It
+// returns the number of findings.
+func getDetectorFindings(ctx context.Context, client FindingsAPI, target exportTarget, detectorID string, opts FetchOptions, emit func([]types.Finding) error, progress ProgressFunc) (int, error) {
+	account, region := target.account.accountID, target.region
+	log := telemetry.Logger(ctx)
+
+	log.Debug("Processing detector", "detector", detectorID)
+	progress.emit(Event{Type: EventDetectorStarted, Account: account, Region: region, Detector: detectorID})
+	criteria := opts.Filter.criteria()
+	if watermark, ok := opts.Watermarks[watermarkKey(region, detectorID)]; ok {
+		log.Info("Exporting findings updated since watermark", "detector", detectorID, "watermark", watermark.Format(time.RFC3339))
+		criteria = updatedSince(criteria, watermark)
+	}
+	input := &guardduty.ListFindingsInput{
+		DetectorId:      aws.String(detectorID),
+		FindingCriteria: criteria,
+		SortCriteria:    opts.Sort.criteria(),
+	}
+	if _, nextToken := opts.Checkpoint.detector(target, detectorID); nextToken != "" {
+		log.Info("Resuming detector from checkpoint", "detector", detectorID)
+		input.NextToken = aws.String(nextToken)
+	}
+
+	total := 0
+	pageCount := 0
+	for {
+		// A canceled export stops between pages, without a call that
+		// would only fail
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		pageCount++
+		pageCtx, span := telemetry.StartSpan(ctx, "page", "page", pageCount)
+		pageStart := time.Now()
+		pageFindings, nextToken, err := getPageFindings(pageCtx, client, region, input, pageCount, opts)
+		latency := time.Since(pageStart)
+		span.Set("findings", len(pageFindings))
+		span.Finish(err)
+		if err != nil {
+			return total, err
+		}
+		countPage(ctx)
+		progress.emit(Event{Type: EventPageFetched, Account: account, Region: region, Detector: detectorID, Page: pageCount, PageFindings: len(pageFindings), PageLatency: latency.Milliseconds()})
+		if err := emit(pageFindings); err != nil {
+			return total, err
+		}
+		total += len(pageFindings)
+		// A token repeated by the service ends the pages, as the SDK's
+		// paginator does
+		if nextToken == aws.ToString(input.NextToken) {
+			nextToken = ""
+		}
+		if err := opts.Checkpoint.page(target, detectorID, pageFindings, nextToken); err != nil {
+			return total, err
+		}
+		if nextToken == "" {
+			break
+		}
+		input.NextToken = aws.String(nextToken)
+	}
+	log.Debug("Finished detector", "detector", detectorID, "pages", pageCount)
+	return total, nil
+}
+
+// getPageFindings fetches the page of finding IDs that input asks for and
+// the details of those that match opts.Filter, and returns the NextToken of
+// the following page, empty after the last
+func getPageFindings(ctx context.Context, client FindingsAPI, region string, input *guardduty.ListFindingsInput, page int, opts FetchOptions) ([]types.Finding, string, error) {
+	log := telemetry.Logger(ctx)
+	detectorID := aws.ToString(input.DetectorId)
+	pageCtx, cancel := callContext(ctx, opts.CallTimeout)
+	output, err := client.ListFindings(pageCtx, input)
+	cancel()
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing findings for detector %s: %v", detectorID, err)
+	}
+	telemetry.PagesFetched.Inc(region)
+	nextToken := aws.ToString(output.NextToken)
+
+	if len(output.FindingIds) == 0 {
+		log.Debug("Fetched empty page", "detector", detectorID, "page", page)
+		return nil, nextToken, nil
+	}
+	log.Debug("Fetched page", "detector", detectorID, "page", page, "findings", len(output.FindingIds))
+	findings, err := getFindingsInBatches(ctx, client, detectorID, output.FindingIds, opts)
+	if err != nil {
+		return nil, "", fmt.Errorf("error getting detailed findings for detector %s: %v", detectorID, err)
+	}
+	var matched []types.Finding
+	for _, finding := range findings {
+		if opts.Filter.matches(finding) {
+			matched = append(matched, finding)
+		}
+	}
+	return matched, nextToken, nil
+}
+
+// callContext bounds a single AWS API call, including the SDK's own retries,
+// by timeout so a wedged endpoint cannot stall an export; zero means no limit
+func callContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// MaxGetFindingsBatch is the most finding IDs GetFindings accepts in one call
+const MaxGetFindingsBatch = 50
+
+// getFindingsInBatches fetches the details of ids in batches of
+// opts.BatchSize. A batch that fails or exceeds opts.CallTimeout is retried up
+// to opts.BatchRetries times with exponential backoff, so a transient error
+// doesn't discard the batches already fetched.
+func getFindingsInBatches(ctx context.Context, client FindingsAPI, detectorID string, ids []string, opts FetchOptions) ([]types.Finding, error) {
+	batchSize, retries := opts.BatchSize, opts.BatchRetries
+	var findings []types.Finding
+	for start := 0; start < len(ids); start += batchSize {
+		batch := ids[start:min(start+batchSize, len(ids))]
+		batchCtx, span := telemetry.StartSpan(ctx, "GetFindings batch", "findings", len(batch))
+
+		var output *guardduty.GetFindingsOutput
+		var err error
+		for attempt := 0; ; attempt++ {
+			callCtx, cancel := callContext(batchCtx, opts.CallTimeout)
+			output, err = client.GetFindings(callCtx, &guardduty.GetFindingsInput{
+				DetectorId: aws.String(detectorID),
+				FindingIds: batch,
+			})
+			cancel()
+			if err == nil || attempt >= retries || ctx.Err() != nil {
+				span.Set("retries", attempt)
+				break
+			}
+
+			backoff := time.Duration(1<<attempt) * time.Second
+			telemetry.Logger(ctx).Warn("Retrying GetFindings batch", "detector", detectorID, "findings", len(batch), "backoff", backoff, "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+		}
+		span.Finish(err)
+		if err != nil {
+			return nil, fmt.Errorf("batch starting at finding %d: %v", start, err)
+		}
+		findings = append(findings, output.Findings...)
+	}
+	return findings, nil
+}
@@ -0,0 +1,351 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+const testAccount = "123456789012"
+
+// testFindings returns n findings in us-east-1, alternating between low and
+// high severity and between two types, the third of them archived, updated
+// a day apart from the start of 2024
+func testFindings(n int) []types.Finding {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	findings := make([]types.Finding, n)
+	for i := range findings {
+		severity, findingType := 2.0, "Recon:EC2/PortProbeUnprotectedPort"
+		if i%2 == 1 {
+			severity, findingType = 8.0, "UnauthorizedAccess:EC2/SSHBruteForce"
+		}
+		updated := start.AddDate(0, 0, i).Format(time.RFC3339)
+		findings[i] = types.Finding{
+			Id:            aws.String(fmt.Sprintf("finding-%02d", i)),
+			AccountId:     aws.String(testAccount),
+			Region:        aws.String("us-east-1"),
+			Type:          aws.String(findingType),
+			Severity:      aws.Float64(severity),
+			Title:         aws.String("Test finding"),
+			SchemaVersion: aws.String("2.0"),
+			CreatedAt:     aws.String(updated),
+			UpdatedAt:     aws.String(updated),
+			Resource:      &types.Resource{ResourceType: aws.String("Instance")},
+			Service:       &types.Service{Archived: aws.Bool(i%3 == 2)},
+		}
+	}
+	return findings
+}
+
+// testFetchOptions returns the options of an export of us-east-1 from fake
+func testFetchOptions(fake *Fake) FetchOptions {
+	return FetchOptions{
+		Regions:     []string{"us-east-1"},
+		AWSConfig:   aws.Config{Region: "us-east-1"},
+		Clients:     fake,
+		Concurrency: 1,
+		BatchSize:   MaxGetFindingsBatch,
+	}
+}
+
+// findingIDs returns the IDs of findings, sorted
+func findingIDs(findings []types.Finding) []string {
+	ids := make([]string, 0, len(findings))
+	for _, finding := range findings {
+		ids = append(ids, aws.ToString(finding.Id))
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestStreamRegionsFake(t *testing.T) {
+	archived, active := true, false
+	tests := []struct {
+		name      string
+		findings  int
+		pageSize  int
+		batchSize int
+		filter    Filter
+		want      []string
+		// pages and batches are the ListFindings and GetFindings calls
+		pages   int
+		batches int
+	}{
+		{
+			name:     "one page",
+			findings: 3,
+			want:     []string{"finding-00", "finding-01", "finding-02"},
+			pages:    1,
+			batches:  1,
+		},
+		{
+			name:     "pages",
+			findings: 5,
+			pageSize: 2,
+			want:     []string{"finding-00", "finding-01", "finding-02", "finding-03", "finding-04"},
+			pages:    3,
+			batches:  3,
+		},
+		{
+			name:      "batches",
+			findings:  5,
+			batchSize: 2,
+			want:      []string{"finding-00", "finding-01", "finding-02", "finding-03", "finding-04"},
+			pages:     1,
+			batches:   3,
+		},
+		{
+			name:     "no findings",
+			findings: 0,
+			want:     []string{},
+			pages:    1,
+		},
+		{
+			name:     "min severity",
+			findings: 5,
+			filter:   Filter{MinSeverity: 7},
+			want:     []string{"finding-01", "finding-03"},
+			pages:    1,
+			batches:  1,
+		},
+		{
+			name:     "finding type",
+			findings: 5,
+			filter:   Filter{FindingTypes: []string{"Recon:EC2/PortProbeUnprotectedPort"}},
+			want:     []string{"finding-00", "finding-02", "finding-04"},
+			pages:    1,
+			batches:  1,
+		},
+		{
+			name:     "finding type prefix",
+			findings: 5,
+			filter:   Filter{FindingTypes: []string{"UnauthorizedAccess:*"}},
+			want:     []string{"finding-01", "finding-03"},
+			pages:    1,
+			batches:  1,
+		},
+		{
+			name:     "updated window",
+			findings: 5,
+			filter:   Filter{UpdatedAfter: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), UpdatedBefore: time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)},
+			want:     []string{"finding-01", "finding-02"},
+			pages:    1,
+			batches:  1,
+		},
+		{
+			name:     "archived",
+			findings: 6,
+			filter:   Filter{Archived: &archived},
+			want:     []string{"finding-02", "finding-05"},
+			pages:    1,
+			batches:  1,
+		},
+		{
+			name:     "active",
+			findings: 6,
+			filter:   Filter{Archived: &active},
+			want:     []string{"finding-00", "finding-01", "finding-03", "finding-04"},
+			pages:    1,
+			batches:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := NewFake(testAccount)
+			fake.PageSize = tt.pageSize
+			fake.AddDetector("", "us-east-1")
+			fake.AddFindings(testFindings(tt.findings)...)
+			opts := testFetchOptions(fake)
+			opts.Filter = tt.filter
+			if tt.batchSize > 0 {
+				opts.BatchSize = tt.batchSize
+			}
+
+			results := StreamRegions(context.Background(), opts, nil).Collect()
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1", len(results))
+			}
+			result := results[0]
+			if result.Err != nil {
+				t.Fatalf("export failed: %v", result.Err)
+			}
+			if got := findingIDs(result.Findings); !slices.Equal(got, tt.want) {
+				t.Errorf("got findings %v, want %v", got, tt.want)
+			}
+			if result.Count != len(tt.want) {
+				t.Errorf("got count %d, want %d", result.Count, len(tt.want))
+			}
+			if got := fake.Calls("ListFindings"); got != tt.pages {
+				t.Errorf("got %d ListFindings calls, want %d", got, tt.pages)
+			}
+			if got := fake.Calls("GetFindings"); got != tt.batches {
+				t.Errorf("got %d GetFindings calls, want %d", got, tt.batches)
+			}
+		})
+	}
+}
+
+func TestStreamRegionsFakeFailures(t *testing.T) {
+	throttled := errors.New("throttled")
+	tests := []struct {
+		name string
+		// setup prepares the fake, which has findings in us-east-1
+		setup   func(fake *Fake)
+		wantErr string
+		skipped bool
+		gap     string
+	}{
+		{
+			name:    "list detectors",
+			setup:   func(fake *Fake) { fake.Fail("ListDetectors", throttled) },
+			wantErr: "error listing detectors in region us-east-1: throttled",
+		},
+		{
+			name:    "list findings",
+			setup:   func(fake *Fake) { fake.Fail("ListFindings", throttled) },
+			wantErr: "throttled",
+		},
+		{
+			name:    "get findings",
+			setup:   func(fake *Fake) { fake.Fail("GetFindings", throttled) },
+			wantErr: "throttled",
+		},
+		{
+			name: "get detector",
+			// A detector that cannot be described is summarized by its ID
+			setup: func(fake *Fake) { fake.Fail("GetDetector", throttled) },
+		},
+		{
+			name:  "suspended detector",
+			setup: func(fake *Fake) { fake.SuspendDetector("", "us-east-1") },
+			gap:   GapDetectorDisabled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := NewFake(testAccount)
+			fake.AddFindings(testFindings(3)...)
+			tt.setup(fake)
+
+			result := StreamRegions(context.Background(), testFetchOptions(fake), nil).Collect()[0]
+			switch {
+			case tt.wantErr == "" && result.Err != nil:
+				t.Fatalf("export failed: %v", result.Err)
+			case tt.wantErr != "" && result.Err == nil:
+				t.Fatalf("export succeeded, want error %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(result.Err.Error(), tt.wantErr):
+				t.Fatalf("got error %q, want %q", result.Err, tt.wantErr)
+			}
+			if tt.wantErr == "" && result.Count != 3 {
+				t.Errorf("got count %d, want 3", result.Count)
+			}
+			var gap string
+			if result.Gap != nil {
+				gap = result.Gap.Reason
+			}
+			if gap != tt.gap {
+				t.Errorf("got gap %q, want %q", gap, tt.gap)
+			}
+		})
+	}
+}
+
+func TestStreamRegionsFakeNoDetector(t *testing.T) {
+	fake := NewFake(testAccount)
+	fake.AddFindings(testFindings(2)...)
+	opts := testFetchOptions(fake)
+	opts.Regions = []string{"us-east-1", "eu-west-1"}
+
+	results := StreamRegions(context.Background(), opts, nil).Collect()
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Fatalf("region %s failed: %v", result.Region, result.Err)
+		}
+		if result.Region != "eu-west-1" {
+			continue
+		}
+		if result.Skipped == "" {
+			t.Errorf("region without a detector was not skipped")
+		}
+		if result.Gap == nil || result.Gap.Reason != GapNoDetector {
+			t.Errorf("got gap %+v, want %s", result.Gap, GapNoDetector)
+		}
+	}
+}
+
+func TestArchiveFake(t *testing.T) {
+	tests := []struct {
+		name   string
+		dryRun bool
+		fail   bool
+		// archived is the findings archived, and reported the count of the
+		// report
+		archived []string
+		reported int
+		errors   int
+	}{
+		{
+			name:     "archive",
+			archived: []string{"finding-00", "finding-01", "finding-02", "finding-03", "finding-04", "finding-05"},
+			reported: 4,
+		},
+		{
+			name:     "dry run",
+			dryRun:   true,
+			archived: []string{"finding-02", "finding-05"},
+			reported: 4,
+		},
+		{
+			name:     "failed batch",
+			fail:     true,
+			archived: []string{"finding-02", "finding-05"},
+			errors:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := NewFake(testAccount)
+			fake.AddFindings(testFindings(6)...)
+			if tt.fail {
+				fake.Fail("ArchiveFindings", errors.New("access denied"))
+			}
+			opts := testFetchOptions(fake)
+			opts.Archiving = true
+
+			results := StreamRegions(context.Background(), opts, nil).Collect()
+			report := Archive(context.Background(), opts, tt.dryRun, results)
+			if report.Findings != tt.reported {
+				t.Errorf("got %d findings archived, want %d", report.Findings, tt.reported)
+			}
+			if len(report.Errors) != tt.errors {
+				t.Errorf("got errors %v, want %d", report.Errors, tt.errors)
+			}
+			var archived []types.Finding
+			for _, finding := range fake.Findings("", "us-east-1") {
+				if aws.ToBool(finding.Service.Archived) {
+					archived = append(archived, finding)
+				}
+			}
+			if got := findingIDs(archived); !slices.Equal(got, tt.archived) {
+				t.Errorf("got archived findings %v, want %v", got, tt.archived)
+			}
+			wantCalls := 1
+			if tt.dryRun {
+				wantCalls = 0
+			}
+			if got := fake.Calls("ArchiveFindings"); got != wantCalls {
+				t.Errorf("got %d ArchiveFindings calls, want %d", got, wantCalls)
+			}
+		})
+	}
+}
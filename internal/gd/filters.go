@@ -0,0 +1,253 @@
+package gd
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// Filter selects which findings an export includes. Everything that
+// GuardDuty can evaluate is sent as FindingCriteria; severity fractions and
+// finding type prefixes are applied to the detailed findings afterwards.
+type Filter struct {
+	MinSeverity   float64
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	// FindingTypes holds exact finding types or prefixes ending in "*"
+	FindingTypes []string
+	// ThreatPurposes and ThreatResources select finding types by their
+	// threat purpose and affected resource type, and Tactics and Techniques
+	// by the MITRE ATT&CK tactics and techniques they map to, as IDs or
+	// names. GuardDuty cannot evaluate them, so they are applied to the
+	// detailed findings.
+	ThreatPurposes  []string
+	ThreatResources []string
+	Tactics         []string
+	Techniques      []string
+	// Archived restricts the export to archived (true) or active (false)
+	// findings; nil includes both
+	Archived *bool
+}
+
+// ParseFilter reads the filter query parameters. minSeverity is the
+// configured default used when the request doesn't set one.
+func ParseFilter(query url.Values, minSeverity float64) (Filter, error) {
+	filter := Filter{MinSeverity: minSeverity}
+
+	if v := query.Get("minSeverity"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 10 {
+			return filter, fmt.Errorf("Invalid minSeverity %q", v)
+		}
+		filter.MinSeverity = f
+	}
+
+	times := []struct {
+		param string
+		dest  *time.Time
+	}{
+		{"createdAfter", &filter.CreatedAfter},
+		{"createdBefore", &filter.CreatedBefore},
+		{"updatedAfter", &filter.UpdatedAfter},
+		{"updatedBefore", &filter.UpdatedBefore},
+	}
+	for _, t := range times {
+		if v := query.Get(t.param); v != "" {
+			parsed, err := parseFilterTime(v)
+			if err != nil {
+				return filter, fmt.Errorf("Invalid %s %q: use RFC 3339 or YYYY-MM-DD", t.param, v)
+			}
+			*t.dest = parsed
+		}
+	}
+
+	filter.FindingTypes = listParam(query, "type")
+	filter.ThreatPurposes = listParam(query, "threatPurpose")
+	filter.ThreatResources = listParam(query, "threatResource")
+	filter.Tactics = listParam(query, "mitreTactic")
+	filter.Techniques = listParam(query, "mitreTechnique")
+
+	// all is the default of active and archived findings, spelled out for
+	// callers that always send the parameter
+	switch v := query.Get("archived"); v {
+	case "", "all":
+	case "true", "false":
+		archived := v == "true"
+		filter.Archived = &archived
+	default:
+		return filter, fmt.Errorf("Invalid archived %q: must be true, false, or all", v)
+	}
+	return filter, nil
+}
+
+// listParam returns the values of a parameter that may be repeated or given
+// as a comma-separated list
+func listParam(query url.Values, name string) []string {
+	var values []string
+	for _, v := range query[name] {
+		for _, value := range strings.Split(v, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// parseFilterTime accepts an RFC 3339 timestamp or a UTC date
+func parseFilterTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// criteria returns the FindingCriteria for ListFindings, or nil when the
+// filter doesn't restrict the listing
+func (f Filter) criteria() *types.FindingCriteria {
+	criterion := make(map[string]types.Condition)
+
+	// The severity criterion only takes whole numbers, so it narrows the
+	// listing and the exact threshold is applied by matches
+	if f.MinSeverity > 0 {
+		criterion["severity"] = types.Condition{GreaterThanOrEqual: aws.Int64(int64(math.Floor(f.MinSeverity)))}
+	}
+	if c, ok := timeCondition(f.CreatedAfter, f.CreatedBefore); ok {
+		criterion["createdAt"] = c
+	}
+	if c, ok := timeCondition(f.UpdatedAfter, f.UpdatedBefore); ok {
+		criterion["updatedAt"] = c
+	}
+	// GuardDuty only matches exact types, so prefixes are left to matches
+	if len(f.FindingTypes) > 0 && !f.hasTypePrefix() {
+		criterion["type"] = types.Condition{Equals: f.FindingTypes}
+	}
+	if f.Archived != nil {
+		criterion["service.archived"] = types.Condition{Equals: []string{strconv.FormatBool(*f.Archived)}}
+	}
+
+	if len(criterion) == 0 {
+		return nil
+	}
+	return &types.FindingCriteria{Criterion: criterion}
+}
+
+// timeCondition builds a condition on a timestamp field, which GuardDuty
+// compares in milliseconds since the epoch
+func timeCondition(after, before time.Time) (types.Condition, bool) {
+	var c types.Condition
+	if !after.IsZero() {
+		c.GreaterThanOrEqual = aws.Int64(after.UnixMilli())
+	}
+	if !before.IsZero() {
+		c.LessThan = aws.Int64(before.UnixMilli())
+	}
+	return c, !after.IsZero() || !before.IsZero()
+}
+
+// hasTypePrefix reports whether any finding type pattern is a prefix
+func (f Filter) hasTypePrefix() bool {
+	for _, findingType := range f.FindingTypes {
+		if strings.HasSuffix(findingType, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// HasTaxonomy reports whether the filter selects finding types by their
+// parts or ATT&CK mapping
+func (f Filter) HasTaxonomy() bool {
+	return len(f.ThreatPurposes) > 0 || len(f.ThreatResources) > 0 || len(f.Tactics) > 0 || len(f.Techniques) > 0
+}
+
+// matches applies the parts of the filter GuardDuty cannot evaluate exactly
+func (f Filter) matches(finding types.Finding) bool {
+	if aws.ToFloat64(finding.Severity) < f.MinSeverity {
+		return false
+	}
+	return f.matchesType(aws.ToString(finding.Type))
+}
+
+// Matches applies the whole filter to a finding that did not come from a
+// GuardDuty listing, such as one delivered by an EventBridge event
+func (f Filter) Matches(finding types.Finding) bool {
+	if !f.matches(finding) {
+		return false
+	}
+	if f.Archived != nil && (finding.Service == nil || aws.ToBool(finding.Service.Archived) != *f.Archived) {
+		return false
+	}
+	return inRange(finding.CreatedAt, f.CreatedAfter, f.CreatedBefore) && inRange(finding.UpdatedAt, f.UpdatedAfter, f.UpdatedBefore)
+}
+
+// inRange reports whether the timestamp s is at or after after and before
+// before, either of which may be zero. A missing or malformed timestamp is
+// only in an open range.
+func inRange(s *string, after, before time.Time) bool {
+	if after.IsZero() && before.IsZero() {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339, aws.ToString(s))
+	if err != nil {
+		return false
+	}
+	return (after.IsZero() || !t.Before(after)) && (before.IsZero() || t.Before(before))
+}
+
+// matchesType reports whether findingType is one of the filter's finding
+// types or starts with one of its prefixes, and has the filter's parts and
+// ATT&CK mapping
+func (f Filter) matchesType(findingType string) bool {
+	return f.matchesTypePattern(findingType) && f.MatchesTaxonomy(findingType)
+}
+
+// MatchesTaxonomy reports whether the parts and ATT&CK mapping of
+// findingType are among those of the filter
+func (f Filter) MatchesTaxonomy(findingType string) bool {
+	if !f.HasTaxonomy() {
+		return true
+	}
+	parts := ParseFindingType(findingType)
+	if len(f.ThreatPurposes) > 0 && !slices.ContainsFunc(f.ThreatPurposes, func(p string) bool { return strings.EqualFold(p, parts.ThreatPurpose) }) {
+		return false
+	}
+	if len(f.ThreatResources) > 0 && !slices.ContainsFunc(f.ThreatResources, func(r string) bool { return strings.EqualFold(r, parts.ResourceType) }) {
+		return false
+	}
+	mapping := MitreAttack(findingType)
+	if len(f.Tactics) > 0 && !slices.ContainsFunc(f.Tactics, func(t string) bool { return matchesAttack(mapping.Tactics, t) }) {
+		return false
+	}
+	if len(f.Techniques) > 0 && !slices.ContainsFunc(f.Techniques, func(t string) bool { return matchesAttack(mapping.Techniques, t) }) {
+		return false
+	}
+	return true
+}
+
+// matchesTypePattern reports whether findingType is one of the filter's
+// finding types or starts with one of its prefixes
+func (f Filter) matchesTypePattern(findingType string) bool {
+	if len(f.FindingTypes) == 0 {
+		return true
+	}
+	for _, pattern := range f.FindingTypes {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(findingType, prefix) {
+				return true
+			}
+		} else if findingType == pattern {
+			return true
+		}
+	}
+	return false
+}
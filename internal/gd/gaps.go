@@ -0,0 +1,132 @@
+package gd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// The reasons GuardDuty does not monitor an account and region
+const (
+	GapNoDetector       = "noDetector"
+	GapDetectorDisabled = "detectorDisabled"
+)
+
+// CoverageGap is an account and region of an export that GuardDuty does not
+// monitor: one without a detector, which is skipped, or whose detectors are
+// suspended, whose earlier findings are still exported but which finds
+// nothing new. RoleARN is the role the export reached the account through,
+// so GuardDuty can be enabled there with EnableDetector.
+type CoverageGap struct {
+	Target  string `json:"target"`
+	Account string `json:"account,omitempty"`
+	Region  string `json:"region"`
+	RoleARN string `json:"roleArn,omitempty"`
+	Reason  string `json:"reason"`
+	// Detectors are the IDs of the suspended detectors
+	Detectors []string `json:"detectors,omitempty"`
+}
+
+// gap returns the coverage gap of the target for reason
+func (t exportTarget) gap(reason string) *CoverageGap {
+	return &CoverageGap{
+		Target:  t.label(),
+		Account: t.account.accountID,
+		Region:  t.region,
+		RoleARN: t.account.roleARN,
+		Reason:  reason,
+	}
+}
+
+// suspendedGap returns the coverage gap of a target whose detectors, as the
+// export described them, are all suspended, or nil when one is enabled or
+// could not be described
+func suspendedGap(target exportTarget, detectors []DetectorSummary) *CoverageGap {
+	if len(detectors) == 0 {
+		return nil
+	}
+	gap := target.gap(GapDetectorDisabled)
+	for _, detector := range detectors {
+		if detector.Status != string(types.DetectorStatusDisabled) {
+			return nil
+		}
+		gap.Detectors = append(gap.Detectors, detector.DetectorID)
+	}
+	return gap
+}
+
+// EnabledDetector is the detector EnableDetector created or resumed
+type EnabledDetector struct {
+	Account string `json:"account,omitempty"`
+	Region  string `json:"region"`
+	// Created is set when the region had no detector, and clear when a
+	// suspended one was enabled again
+	Created  bool         `json:"created"`
+	Detector DetectorInfo `json:"detector"`
+}
+
+// EnableDetector closes the coverage gap of the one account and region of
+// opts: it creates a detector with the default settings, where GuardDuty
+// starts its free trial for the account, or enables the suspended one. A
+// region whose detector is already enabled is rejected.
+func EnableDetector(ctx context.Context, opts FetchOptions) (EnabledDetector, error) {
+	client, err := targetClient(opts)
+	if err != nil {
+		return EnabledDetector{}, err
+	}
+	enabled := EnabledDetector{Account: accountConfigs(opts)[0].accountID, Region: opts.Regions[0]}
+	return enableDetector(ctx, client, enabled, opts)
+}
+
+// enableDetector creates or enables the detector of the account and region
+// of enabled, and fills in its detector
+func enableDetector(ctx context.Context, client EnableDetectorAPI, enabled EnabledDetector, opts FetchOptions) (EnabledDetector, error) {
+	region := enabled.Region
+	listCtx, cancel := callContext(ctx, opts.CallTimeout)
+	detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+	cancel()
+	if err != nil {
+		return enabled, fmt.Errorf("error listing detectors in region %s: %v", region, err)
+	}
+
+	var detectorID string
+	if len(detectors.DetectorIds) == 0 {
+		createCtx, cancel := callContext(ctx, opts.CallTimeout)
+		created, err := client.CreateDetector(createCtx, &guardduty.CreateDetectorInput{Enable: aws.Bool(true)})
+		cancel()
+		if err != nil {
+			return enabled, callError(err, "error creating detector in region %s", region)
+		}
+		detectorID, enabled.Created = aws.ToString(created.DetectorId), true
+	} else {
+		detectorID = detectors.DetectorIds[0]
+		getCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detector, err := client.GetDetector(getCtx, &guardduty.GetDetectorInput{DetectorId: aws.String(detectorID)})
+		cancel()
+		if err != nil {
+			return enabled, callError(err, "error getting detector %s", detectorID)
+		}
+		if detector.Status != types.DetectorStatusDisabled {
+			return enabled, &CallError{Message: fmt.Sprintf("GuardDuty is already enabled in region %s", region), Rejected: true}
+		}
+		updateCtx, cancel := callContext(ctx, opts.CallTimeout)
+		_, err = client.UpdateDetector(updateCtx, &guardduty.UpdateDetectorInput{DetectorId: aws.String(detectorID), Enable: aws.Bool(true)})
+		cancel()
+		if err != nil {
+			return enabled, callError(err, "error enabling detector %s", detectorID)
+		}
+	}
+	getCtx, cancel := callContext(ctx, opts.CallTimeout)
+	detector, err := client.GetDetector(getCtx, &guardduty.GetDetectorInput{DetectorId: aws.String(detectorID)})
+	cancel()
+	if err != nil {
+		// The detector is enabled even if it can't be described
+		enabled.Detector = DetectorInfo{DetectorID: detectorID, Status: string(types.DetectorStatusEnabled), Features: []DetectorFeature{}}
+		return enabled, nil
+	}
+	enabled.Detector = detectorInfo(detectorID, detector)
+	return enabled, nil
+}
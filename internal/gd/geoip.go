@@ -0,0 +1,129 @@
+package gd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP resolves the remote addresses of findings against local MaxMind
+// databases: GeoLite2 or GeoIP2 Country or City for the country, and ASN
+// for the autonomous system and the organization announcing it. Lookups
+// are safe for concurrent use.
+type GeoIP struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// geoRecord holds the fields read from either database
+type geoRecord struct {
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// OpenGeoIP opens the country and ASN databases at the given paths, either
+// of which may be empty
+func OpenGeoIP(countryPath, asnPath string) (*GeoIP, error) {
+	g := &GeoIP{}
+	for _, db := range []struct {
+		path   string
+		reader **maxminddb.Reader
+	}{{countryPath, &g.country}, {asnPath, &g.asn}} {
+		if db.path == "" {
+			continue
+		}
+		reader, err := maxminddb.Open(db.path)
+		if err != nil {
+			g.Close()
+			return nil, fmt.Errorf("error opening GeoIP database %s: %v", db.path, err)
+		}
+		*db.reader = reader
+	}
+	return g, nil
+}
+
+// Close releases the databases
+func (g *GeoIP) Close() {
+	for _, reader := range []*maxminddb.Reader{g.country, g.asn} {
+		if reader != nil {
+			reader.Close()
+		}
+	}
+}
+
+// resolveFindings sets the country and organization of each remote address
+// of a page of findings from the databases, replacing what GuardDuty
+// reported where the databases know the address
+func (g *GeoIP) resolveFindings(findings []types.Finding) {
+	for _, finding := range findings {
+		for _, details := range RemoteIPs(finding) {
+			g.resolve(details)
+		}
+	}
+}
+
+// resolve sets the fields of one remote address found in the databases
+func (g *GeoIP) resolve(details *types.RemoteIpDetails) {
+	ip := net.ParseIP(aws.ToString(details.IpAddressV4))
+	if ip == nil {
+		ip = net.ParseIP(aws.ToString(details.IpAddressV6))
+	}
+	if ip == nil {
+		return
+	}
+	var record geoRecord
+	if g.country != nil && g.country.Lookup(ip, &record) == nil && record.Country.ISOCode != "" {
+		details.Country = &types.Country{CountryCode: aws.String(record.Country.ISOCode), CountryName: aws.String(record.Country.ISOCode)}
+		if name := record.Country.Names["en"]; name != "" {
+			details.Country.CountryName = aws.String(name)
+		}
+	}
+	if g.asn != nil && g.asn.Lookup(ip, &record) == nil && record.ASN != 0 {
+		if details.Organization == nil {
+			details.Organization = &types.Organization{}
+		}
+		details.Organization.Asn = aws.String(strconv.FormatUint(uint64(record.ASN), 10))
+		details.Organization.AsnOrg = aws.String(record.ASOrg)
+	}
+}
+
+// RemoteIPs returns the remote addresses of a finding's action: the caller
+// of an API call or login, the peer of a connection, or each port prober
+func RemoteIPs(finding types.Finding) []*types.RemoteIpDetails {
+	if finding.Service == nil || finding.Service.Action == nil {
+		return nil
+	}
+	action := finding.Service.Action
+	var ips []*types.RemoteIpDetails
+	add := func(details *types.RemoteIpDetails) {
+		if details != nil {
+			ips = append(ips, details)
+		}
+	}
+	if action.AwsApiCallAction != nil {
+		add(action.AwsApiCallAction.RemoteIpDetails)
+	}
+	if action.NetworkConnectionAction != nil {
+		add(action.NetworkConnectionAction.RemoteIpDetails)
+	}
+	if action.KubernetesApiCallAction != nil {
+		add(action.KubernetesApiCallAction.RemoteIpDetails)
+	}
+	if action.RdsLoginAttemptAction != nil {
+		add(action.RdsLoginAttemptAction.RemoteIpDetails)
+	}
+	if action.PortProbeAction != nil {
+		for _, probe := range action.PortProbeAction.PortProbeDetails {
+			add(probe.RemoteIpDetails)
+		}
+	}
+	return ips
+}
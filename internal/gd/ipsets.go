@@ -0,0 +1,186 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+
+	"guardduty/internal/telemetry"
+)
+
+// Kinds of the lists of IP addresses and domains that detectors are
+// configured with: trusted IP lists, which GuardDuty does not generate
+// findings for, and threat lists, which it does
+const (
+	IPSetTrusted     = "TRUSTED_IP"
+	IPSetThreatIntel = "THREAT_INTEL"
+)
+
+// IPSetInventory lists the IPSets and ThreatIntelSets of every account and
+// region of an export
+type IPSetInventory struct {
+	Sets    []IPSet        `json:"sets"`
+	Regions []RegionIPSets `json:"regions"`
+}
+
+// IPSet describes one trusted IP list or threat list of a detector. The list
+// itself is the file at Location, usually in S3, which is not read.
+type IPSet struct {
+	Account    string            `json:"account,omitempty"`
+	Region     string            `json:"region"`
+	DetectorID string            `json:"detectorId"`
+	Kind       string            `json:"kind"`
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Format     string            `json:"format"`
+	Location   string            `json:"location"`
+	Status     string            `json:"status"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+// RegionIPSets counts the lists of one account and region. A region
+// without GuardDuty is skipped, and one that could not be queried reports
+// its error without failing the others.
+type RegionIPSets struct {
+	Account     string `json:"account,omitempty"`
+	Region      string `json:"region"`
+	TrustedIPs  int    `json:"trustedIpSets"`
+	ThreatIntel int    `json:"threatIntelSets"`
+	Skipped     string `json:"skipped,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// ListIPSets describes the IPSets and ThreatIntelSets of every detector in
+// every account and region in opts, using opts.Concurrency workers
+func ListIPSets(ctx context.Context, opts FetchOptions) IPSetInventory {
+	targets := exportTargets(ctx, opts)
+	inventory := IPSetInventory{Sets: []IPSet{}, Regions: make([]RegionIPSets, len(targets))}
+	sets := make([][]IPSet, len(targets))
+	eachTarget(targets, opts.Concurrency, func(i int) {
+		inventory.Regions[i], sets[i] = regionIPSets(ctx, opts, targets[i])
+	})
+	for _, list := range sets {
+		inventory.Sets = append(inventory.Sets, list...)
+	}
+	return inventory
+}
+
+// regionIPSets describes the lists of one target
+func regionIPSets(ctx context.Context, opts FetchOptions, target exportTarget) (RegionIPSets, []IPSet) {
+	account, region := target.account.accountID, target.region
+	result := RegionIPSets{Account: account, Region: region}
+	if target.disabled {
+		result.Skipped = "region is not enabled for this account"
+		return result, nil
+	}
+	log := telemetry.Logger(ctx).With("region", target.label())
+
+	client := target.client()
+	var sets []IPSet
+	err := func() error {
+		listCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error listing detectors in region %s: %v", region, err)
+		}
+		if len(detectors.DetectorIds) == 0 {
+			return errGuardDutyNotEnabled
+		}
+		for _, detectorID := range detectors.DetectorIds {
+			trusted, err := detectorIPSets(ctx, client, detectorID, opts)
+			if err != nil {
+				return err
+			}
+			threatIntel, err := detectorThreatIntelSets(ctx, client, detectorID, opts)
+			if err != nil {
+				return err
+			}
+			for _, set := range append(trusted, threatIntel...) {
+				set.Account, set.Region, set.DetectorID = account, region, detectorID
+				sets = append(sets, set)
+			}
+			result.TrustedIPs += len(trusted)
+			result.ThreatIntel += len(threatIntel)
+		}
+		return nil
+	}()
+	switch {
+	case errors.Is(err, errGuardDutyNotEnabled):
+		result.Skipped = err.Error()
+	case err != nil:
+		if account != "" {
+			err = fmt.Errorf("account %s: %v", account, err)
+		}
+		log.Error("Error listing IP sets", "error", err)
+		result.Error = err.Error()
+	}
+	return result, sets
+}
+
+// detectorIPSets describes the trusted IP lists of one detector
+func detectorIPSets(ctx context.Context, client IPSetsAPI, detectorID string, opts FetchOptions) ([]IPSet, error) {
+	var sets []IPSet
+	paginator := guardduty.NewListIPSetsPaginator(client, &guardduty.ListIPSetsInput{DetectorId: aws.String(detectorID)})
+	for paginator.HasMorePages() {
+		pageCtx, cancel := callContext(ctx, opts.CallTimeout)
+		output, err := paginator.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("error listing IP sets for detector %s: %v", detectorID, err)
+		}
+		for _, id := range output.IpSetIds {
+			getCtx, cancel := callContext(ctx, opts.CallTimeout)
+			set, err := client.GetIPSet(getCtx, &guardduty.GetIPSetInput{DetectorId: aws.String(detectorID), IpSetId: aws.String(id)})
+			cancel()
+			if err != nil {
+				return nil, fmt.Errorf("error getting IP set %s: %v", id, err)
+			}
+			sets = append(sets, IPSet{
+				Kind:     IPSetTrusted,
+				ID:       id,
+				Name:     aws.ToString(set.Name),
+				Format:   string(set.Format),
+				Location: aws.ToString(set.Location),
+				Status:   string(set.Status),
+				Tags:     set.Tags,
+			})
+		}
+	}
+	return sets, nil
+}
+
+// detectorThreatIntelSets describes the threat lists of one detector
+func detectorThreatIntelSets(ctx context.Context, client IPSetsAPI, detectorID string, opts FetchOptions) ([]IPSet, error) {
+	var sets []IPSet
+	paginator := guardduty.NewListThreatIntelSetsPaginator(client, &guardduty.ListThreatIntelSetsInput{DetectorId: aws.String(detectorID)})
+	for paginator.HasMorePages() {
+		pageCtx, cancel := callContext(ctx, opts.CallTimeout)
+		output, err := paginator.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("error listing threat intel sets for detector %s: %v", detectorID, err)
+		}
+		for _, id := range output.ThreatIntelSetIds {
+			getCtx, cancel := callContext(ctx, opts.CallTimeout)
+			set, err := client.GetThreatIntelSet(getCtx, &guardduty.GetThreatIntelSetInput{DetectorId: aws.String(detectorID), ThreatIntelSetId: aws.String(id)})
+			cancel()
+			if err != nil {
+				return nil, fmt.Errorf("error getting threat intel set %s: %v", id, err)
+			}
+			sets = append(sets, IPSet{
+				Kind:     IPSetThreatIntel,
+				ID:       id,
+				Name:     aws.ToString(set.Name),
+				Format:   string(set.Format),
+				Location: aws.ToString(set.Location),
+				Status:   string(set.Status),
+				Tags:     set.Tags,
+			})
+		}
+	}
+	return sets, nil
+}
@@ -0,0 +1,163 @@
+package gd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/telemetry"
+)
+
+// Reasons an export was truncated
+const (
+	TruncatedMaxFindings = "maxFindings"
+	TruncatedMaxDuration = "maxDuration"
+)
+
+// Truncation describes an export that was stopped by one of its limits. The
+// findings delivered before the limit are exported as usual; Region is cut
+// off part way, and the regions in Remaining are not exported at all.
+type Truncation struct {
+	Reason string `json:"reason"`
+	// Limit is the limit that was reached, a number of findings or a
+	// duration
+	Limit     string   `json:"limit"`
+	Findings  int      `json:"findings"`
+	Region    string   `json:"region,omitempty"`
+	Remaining []string `json:"remaining,omitempty"`
+}
+
+// String describes the limit that stopped the export
+func (t Truncation) String() string {
+	if t.Reason == TruncatedMaxDuration {
+		return fmt.Sprintf("export stopped after its time limit of %s", t.Limit)
+	}
+	return fmt.Sprintf("export stopped at its limit of %s findings", t.Limit)
+}
+
+// limited reports whether opts limit the size or duration of the export
+func (o FetchOptions) limited() bool {
+	return o.MaxFindings > 0 || o.MaxDuration > 0
+}
+
+// limit hands region to the reader through a channel of its own, which
+// stops once the export reaches opts.MaxFindings or is truncated by its
+// time limit. Only one region is read at a time, so the count of delivered
+// findings needs no lock.
+func (s *Stream) limit(region *RegionStream) {
+	source := region.Findings
+	findings := make(chan types.Finding)
+	region.Findings = findings
+	go func() {
+		defer close(findings)
+		for finding := range source {
+			if s.maxFindings > 0 && s.delivered == s.maxFindings {
+				s.truncate(TruncatedMaxFindings)
+			}
+			if s.truncated() {
+				region.cut = true
+				return
+			}
+			select {
+			case findings <- finding:
+				s.delivered++
+				region.delivered++
+			case <-s.stopped:
+				region.cut = true
+				return
+			}
+		}
+		// A fetch canceled by the truncation ends its region early too
+		region.cut = s.truncated() && region.result.Err != nil
+	}()
+}
+
+// truncate stops the export for reason, unless it is already stopped or has
+// been read to the end. The fetches still running are canceled, and their
+// regions are reported as skipped rather than failed.
+func (s *Stream) truncate(reason string) {
+	s.mu.Lock()
+	if s.truncation != nil || s.complete || s.failure.Load() != nil {
+		s.mu.Unlock()
+		return
+	}
+	truncation := Truncation{Reason: reason, Limit: strconv.Itoa(s.maxFindings)}
+	if reason == TruncatedMaxDuration {
+		truncation.Limit = s.maxDuration.String()
+	}
+	s.truncation = &truncation
+	close(s.stopped)
+	s.mu.Unlock()
+
+	s.cancel()
+	telemetry.Logger(s.ctx).Warn("Export truncated", "reason", reason, "limit", truncation.Limit)
+	s.progress.emit(Event{Type: EventTruncated, Skipped: truncation.String()})
+}
+
+// truncated reports whether the export was stopped by a limit
+func (s *Stream) truncated() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// limitProgress passes progress events on, except that the regions whose
+// fetch is canceled by a truncation are reported as skipped
+func (s *Stream) limitProgress(progress ProgressFunc) ProgressFunc {
+	return func(event Event) {
+		if event.Type == EventRegionDone && event.Error != "" && s.truncated() {
+			event.Error = ""
+			event.Skipped = s.truncationReason()
+		}
+		progress.emit(event)
+	}
+}
+
+func (s *Stream) truncationReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.truncation.String()
+}
+
+// Truncated returns how the export was truncated, once the stream has been
+// read, when one of its limits stopped it
+func (s *Stream) Truncated() (Truncation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.truncation == nil {
+		return Truncation{}, false
+	}
+	t := *s.truncation
+	t.Findings = s.delivered
+	t.Remaining = nil
+	for _, region := range s.regions[s.next:] {
+		t.Remaining = append(t.Remaining, TargetLabel(region.Account, region.Region))
+	}
+	if s.next > 0 {
+		if region := s.regions[s.next-1]; region.cut {
+			t.Region = TargetLabel(region.Account, region.Region)
+		}
+	}
+	// A time limit that passed after the last finding was read cut nothing
+	if t.Region == "" && len(t.Remaining) == 0 {
+		return Truncation{}, false
+	}
+	return t, true
+}
+
+// truncatedResult is the outcome of a region that a truncation cut off after
+// delivered findings. Its fetch was canceled rather than failed, and its
+// watermarks and active findings are dropped, so that the next incremental
+// export and archiving don't pass over the findings that were not exported.
+func truncatedResult(result RegionResult, delivered int) RegionResult {
+	result.Err = nil
+	result.Count = delivered
+	result.Latest = nil
+	result.Active = nil
+	result.Truncated = true
+	return result
+}
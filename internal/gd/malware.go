@@ -0,0 +1,289 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/telemetry"
+)
+
+// malwareFindingTypes are the finding types that a Malware Protection scan
+// of EBS volumes reports its threats in
+var malwareFindingTypes = []string{
+	"Execution:EC2/MaliciousFile",
+	"Execution:ECS/MaliciousFile",
+	"Execution:Kubernetes/MaliciousFile",
+	"Execution:Container/MaliciousFile",
+}
+
+// MalwareScanReport lists the Malware Protection scans of the EBS volumes
+// in every account and region of an export, from DescribeMalwareScans
+type MalwareScanReport struct {
+	Scans   []MalwareScan `json:"scans"`
+	Regions []RegionScans `json:"regions"`
+}
+
+// MalwareScan is one scan of the volumes attached to an EC2 instance.
+// GuardDuty-initiated scans are triggered by a finding, and on-demand
+// scans are started by a user. An infected scan lists the threats of the
+// malware findings it produced.
+type MalwareScan struct {
+	AccountID     string `json:"accountId"`
+	Region        string `json:"region"`
+	DetectorID    string `json:"detectorId"`
+	ScanID        string `json:"scanId"`
+	ScanType      string `json:"scanType"`
+	Status        string `json:"scanStatus"`
+	Result        string `json:"scanResult,omitempty"`
+	FailureReason string `json:"failureReason,omitempty"`
+	InstanceArn   string `json:"instanceArn,omitempty"`
+	// TriggerFindingID is the finding that started a GuardDuty-initiated
+	// scan, and FindingIDs the malware findings the scan produced
+	TriggerFindingID string           `json:"triggerFindingId,omitempty"`
+	FindingIDs       []string         `json:"findingIds,omitempty"`
+	FileCount        *int64           `json:"fileCount,omitempty"`
+	TotalBytes       *int64           `json:"totalBytes,omitempty"`
+	StartedAt        *time.Time       `json:"scanStartTime,omitempty"`
+	EndedAt          *time.Time       `json:"scanEndTime,omitempty"`
+	Volumes          []ScannedVolume  `json:"attachedVolumes"`
+	Threats          []ThreatDetected `json:"threats"`
+}
+
+// ScannedVolume is an EBS volume that a scan covered
+type ScannedVolume struct {
+	VolumeArn      string `json:"volumeArn"`
+	DeviceName     string `json:"deviceName,omitempty"`
+	VolumeType     string `json:"volumeType,omitempty"`
+	SizeGB         int32  `json:"volumeSizeInGB,omitempty"`
+	EncryptionType string `json:"encryptionType,omitempty"`
+	KmsKeyArn      string `json:"kmsKeyArn,omitempty"`
+	SnapshotArn    string `json:"snapshotArn,omitempty"`
+}
+
+// ThreatDetected is a threat that a scan found, with the infected files
+type ThreatDetected struct {
+	Name     string   `json:"name"`
+	Severity string   `json:"severity,omitempty"`
+	Items    int      `json:"itemCount"`
+	Files    []string `json:"files,omitempty"`
+}
+
+// RegionScans is the outcome of listing the scans of one account and
+// region. A region without GuardDuty is skipped, and one that could not be
+// queried reports its error without failing the others.
+type RegionScans struct {
+	Account  string `json:"account,omitempty"`
+	Region   string `json:"region"`
+	Scans    int    `json:"scans"`
+	Infected int    `json:"infected"`
+	Skipped  string `json:"skipped,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// MalwareScans lists the malware scans of every detector in every account
+// and region in opts, using opts.Concurrency workers. The filter's
+// creation times select scans by their start time.
+func MalwareScans(ctx context.Context, opts FetchOptions) MalwareScanReport {
+	targets := exportTargets(ctx, opts)
+	report := MalwareScanReport{Scans: []MalwareScan{}, Regions: make([]RegionScans, len(targets))}
+	scans := make([][]MalwareScan, len(targets))
+	eachTarget(targets, opts.Concurrency, func(i int) {
+		report.Regions[i], scans[i] = regionScans(ctx, opts, targets[i])
+	})
+	for _, list := range scans {
+		report.Scans = append(report.Scans, list...)
+	}
+	return report
+}
+
+// regionScans lists the malware scans of one target
+func regionScans(ctx context.Context, opts FetchOptions, target exportTarget) (RegionScans, []MalwareScan) {
+	account, region := target.account.accountID, target.region
+	result := RegionScans{Account: account, Region: region}
+	if target.disabled {
+		result.Skipped = "region is not enabled for this account"
+		return result, nil
+	}
+	log := telemetry.Logger(ctx).With("region", target.label())
+
+	client := target.client()
+	var scans []MalwareScan
+	err := func() error {
+		listCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error listing detectors in region %s: %v", region, err)
+		}
+		if len(detectors.DetectorIds) == 0 {
+			return errGuardDutyNotEnabled
+		}
+		for _, detectorID := range detectors.DetectorIds {
+			detectorScans, err := detectorMalwareScans(ctx, client, region, detectorID, opts)
+			if err != nil {
+				return err
+			}
+			scans = append(scans, detectorScans...)
+		}
+		return nil
+	}()
+	result.Scans = len(scans)
+	for _, scan := range scans {
+		if scan.Result == string(types.ScanResultInfected) {
+			result.Infected++
+		}
+	}
+	switch {
+	case errors.Is(err, errGuardDutyNotEnabled):
+		result.Skipped = err.Error()
+	case err != nil:
+		if account != "" {
+			err = fmt.Errorf("account %s: %v", account, err)
+		}
+		log.Error("Error listing malware scans", "error", err)
+		result.Error = err.Error()
+	}
+	return result, scans
+}
+
+// detectorMalwareScans lists the scans of one detector, started within the
+// filter's creation times, and adds the threats of the infected ones
+func detectorMalwareScans(ctx context.Context, client MalwareScansAPI, region, detectorID string, opts FetchOptions) ([]MalwareScan, error) {
+	input := &guardduty.DescribeMalwareScansInput{DetectorId: aws.String(detectorID)}
+	if after, before := opts.Filter.CreatedAfter, opts.Filter.CreatedBefore; !after.IsZero() || !before.IsZero() {
+		condition := &types.FilterCondition{}
+		if !after.IsZero() {
+			condition.GreaterThan = aws.Int64(after.UnixMilli() - 1)
+		}
+		if !before.IsZero() {
+			condition.LessThan = aws.Int64(before.UnixMilli())
+		}
+		input.FilterCriteria = &types.FilterCriteria{FilterCriterion: []types.FilterCriterion{
+			{CriterionKey: types.CriterionKeyScanStartTime, FilterCondition: condition},
+		}}
+	}
+
+	var scans []MalwareScan
+	var earliestInfected time.Time
+	paginator := guardduty.NewDescribeMalwareScansPaginator(client, input)
+	for paginator.HasMorePages() {
+		pageCtx, cancel := callContext(ctx, opts.CallTimeout)
+		output, err := paginator.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("error describing malware scans for detector %s: %v", detectorID, err)
+		}
+		for _, s := range output.Scans {
+			scan := malwareScan(region, detectorID, s)
+			if scan.Result == string(types.ScanResultInfected) && scan.StartedAt != nil && (earliestInfected.IsZero() || scan.StartedAt.Before(earliestInfected)) {
+				earliestInfected = *scan.StartedAt
+			}
+			scans = append(scans, scan)
+		}
+	}
+	if earliestInfected.IsZero() {
+		return scans, nil
+	}
+	if err := addScanThreats(ctx, client, detectorID, scans, earliestInfected, opts); err != nil {
+		return nil, err
+	}
+	return scans, nil
+}
+
+// addScanThreats adds to infected scans the threats of the malware findings
+// they produced, which are matched to the scans by ID. Only the findings
+// updated since the earliest infected scan started are fetched.
+func addScanThreats(ctx context.Context, client FindingsAPI, detectorID string, scans []MalwareScan, since time.Time, opts FetchOptions) error {
+	byID := make(map[string]*MalwareScan)
+	for i := range scans {
+		byID[scans[i].ScanID] = &scans[i]
+	}
+	updated, _ := timeCondition(since, time.Time{})
+	paginator := guardduty.NewListFindingsPaginator(client, &guardduty.ListFindingsInput{
+		DetectorId: aws.String(detectorID),
+		FindingCriteria: &types.FindingCriteria{Criterion: map[string]types.Condition{
+			"type":      {Equals: malwareFindingTypes},
+			"updatedAt": updated,
+		}},
+	})
+	for paginator.HasMorePages() {
+		pageCtx, cancel := callContext(ctx, opts.CallTimeout)
+		output, err := paginator.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error listing malware findings for detector %s: %v", detectorID, err)
+		}
+		findings, err := getFindingsInBatches(ctx, client, detectorID, output.FindingIds, opts)
+		if err != nil {
+			return fmt.Errorf("error getting malware findings for detector %s: %v", detectorID, err)
+		}
+		for _, finding := range findings {
+			if finding.Service == nil || finding.Service.EbsVolumeScanDetails == nil {
+				continue
+			}
+			details := finding.Service.EbsVolumeScanDetails
+			scan, ok := byID[aws.ToString(details.ScanId)]
+			if !ok {
+				continue
+			}
+			scan.FindingIDs = append(scan.FindingIDs, aws.ToString(finding.Id))
+			if details.ScanDetections == nil || details.ScanDetections.ThreatDetectedByName == nil {
+				continue
+			}
+			for _, threat := range details.ScanDetections.ThreatDetectedByName.ThreatNames {
+				detected := ThreatDetected{Name: aws.ToString(threat.Name), Severity: aws.ToString(threat.Severity), Items: int(aws.ToInt32(threat.ItemCount))}
+				for _, file := range threat.FilePaths {
+					detected.Files = append(detected.Files, aws.ToString(file.FilePath))
+				}
+				scan.Threats = append(scan.Threats, detected)
+			}
+		}
+	}
+	return nil
+}
+
+// malwareScan converts a DescribeMalwareScans scan
+func malwareScan(region, detectorID string, s types.Scan) MalwareScan {
+	scan := MalwareScan{
+		AccountID:     aws.ToString(s.AccountId),
+		Region:        region,
+		DetectorID:    detectorID,
+		ScanID:        aws.ToString(s.ScanId),
+		ScanType:      string(s.ScanType),
+		Status:        string(s.ScanStatus),
+		FailureReason: aws.ToString(s.FailureReason),
+		FileCount:     s.FileCount,
+		TotalBytes:    s.TotalBytes,
+		StartedAt:     s.ScanStartTime,
+		EndedAt:       s.ScanEndTime,
+		Volumes:       []ScannedVolume{},
+		Threats:       []ThreatDetected{},
+	}
+	if s.ScanResultDetails != nil {
+		scan.Result = string(s.ScanResultDetails.ScanResult)
+	}
+	if s.ResourceDetails != nil {
+		scan.InstanceArn = aws.ToString(s.ResourceDetails.InstanceArn)
+	}
+	if s.TriggerDetails != nil {
+		scan.TriggerFindingID = aws.ToString(s.TriggerDetails.GuardDutyFindingId)
+	}
+	for _, v := range s.AttachedVolumes {
+		scan.Volumes = append(scan.Volumes, ScannedVolume{
+			VolumeArn:      aws.ToString(v.VolumeArn),
+			DeviceName:     aws.ToString(v.DeviceName),
+			VolumeType:     aws.ToString(v.VolumeType),
+			SizeGB:         aws.ToInt32(v.VolumeSizeInGB),
+			EncryptionType: aws.ToString(v.EncryptionType),
+			KmsKeyArn:      aws.ToString(v.KmsKeyArn),
+			SnapshotArn:    aws.ToString(v.SnapshotArn),
+		})
+	}
+	return scan
+}
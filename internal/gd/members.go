@@ -0,0 +1,184 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+
+	"guardduty/internal/telemetry"
+)
+
+// MemberReport lists the GuardDuty member accounts of every administrator
+// account and region of an export, and the administrator each account and
+// region is itself a member of, to audit the enrollment of an organization
+type MemberReport struct {
+	Members []MemberAccount `json:"members"`
+	Regions []RegionMembers `json:"regions"`
+}
+
+// MemberAccount is one member of an administrator's detector, associated
+// or only invited. Times are as GuardDuty reports them.
+type MemberAccount struct {
+	Region             string `json:"region"`
+	AdministratorID    string `json:"administratorId"`
+	DetectorID         string `json:"detectorId"`
+	AccountID          string `json:"accountId"`
+	Email              string `json:"email,omitempty"`
+	RelationshipStatus string `json:"relationshipStatus"`
+	MemberDetectorID   string `json:"memberDetectorId,omitempty"`
+	InvitedAt          string `json:"invitedAt,omitempty"`
+	UpdatedAt          string `json:"updatedAt,omitempty"`
+}
+
+// MemberAdministrator is the administrator account that an account is a
+// member of in a region, and the state of its invitation
+type MemberAdministrator struct {
+	AccountID          string `json:"accountId"`
+	RelationshipStatus string `json:"relationshipStatus"`
+	InvitationID       string `json:"invitationId,omitempty"`
+	InvitedAt          string `json:"invitedAt,omitempty"`
+}
+
+// RegionMembers is the outcome of listing the members of one account and
+// region. A region without GuardDuty is skipped, and one that could not be
+// queried reports its error without failing the others.
+type RegionMembers struct {
+	Account       string               `json:"account,omitempty"`
+	Region        string               `json:"region"`
+	DetectorID    string               `json:"detectorId,omitempty"`
+	Administrator *MemberAdministrator `json:"administrator,omitempty"`
+	Members       int                  `json:"members"`
+	Enabled       int                  `json:"enabled"`
+	Skipped       string               `json:"skipped,omitempty"`
+	Error         string               `json:"error,omitempty"`
+}
+
+// ListMemberAccounts lists the members and administrators of every
+// detector in every account and region in opts, using opts.Concurrency
+// workers. Members that were invited but never associated are included.
+func ListMemberAccounts(ctx context.Context, opts FetchOptions) MemberReport {
+	targets := exportTargets(ctx, opts)
+	report := MemberReport{Members: []MemberAccount{}, Regions: make([]RegionMembers, len(targets))}
+	members := make([][]MemberAccount, len(targets))
+	eachTarget(targets, opts.Concurrency, func(i int) {
+		report.Regions[i], members[i] = regionMembers(ctx, opts, targets[i])
+	})
+	for _, list := range members {
+		report.Members = append(report.Members, list...)
+	}
+	return report
+}
+
+// regionMembers lists the members and administrator of one target
+func regionMembers(ctx context.Context, opts FetchOptions, target exportTarget) (RegionMembers, []MemberAccount) {
+	account, region := target.account.accountID, target.region
+	result := RegionMembers{Account: account, Region: region}
+	if target.disabled {
+		result.Skipped = "region is not enabled for this account"
+		return result, nil
+	}
+	log := telemetry.Logger(ctx).With("region", target.label())
+
+	client := target.client()
+	var members []MemberAccount
+	err := func() error {
+		listCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error listing detectors in region %s: %v", region, err)
+		}
+		if len(detectors.DetectorIds) == 0 {
+			return errGuardDutyNotEnabled
+		}
+		result.DetectorID = detectors.DetectorIds[0]
+		for _, detectorID := range detectors.DetectorIds {
+			admin, err := detectorAdministrator(ctx, client, detectorID, opts)
+			if err != nil {
+				return err
+			}
+			if admin != nil {
+				result.Administrator = admin
+			}
+			detectorMembers, err := detectorMemberAccounts(ctx, client, region, detectorID, opts)
+			if err != nil {
+				return err
+			}
+			members = append(members, detectorMembers...)
+		}
+		return nil
+	}()
+	result.Members = len(members)
+	for _, member := range members {
+		if strings.EqualFold(member.RelationshipStatus, "Enabled") {
+			result.Enabled++
+		}
+	}
+	switch {
+	case errors.Is(err, errGuardDutyNotEnabled):
+		result.Skipped = err.Error()
+	case err != nil:
+		if account != "" {
+			err = fmt.Errorf("account %s: %v", account, err)
+		}
+		log.Error("Error listing members", "error", err)
+		result.Error = err.Error()
+	}
+	return result, members
+}
+
+// detectorAdministrator returns the administrator that the account of one
+// detector is a member of, or nil when it has none
+func detectorAdministrator(ctx context.Context, client MembersAPI, detectorID string, opts FetchOptions) (*MemberAdministrator, error) {
+	adminCtx, cancel := callContext(ctx, opts.CallTimeout)
+	admin, err := client.GetAdministratorAccount(adminCtx, &guardduty.GetAdministratorAccountInput{DetectorId: aws.String(detectorID)})
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("error getting the administrator of detector %s: %v", detectorID, err)
+	}
+	a := admin.Administrator
+	if a == nil || aws.ToString(a.AccountId) == "" {
+		return nil, nil
+	}
+	return &MemberAdministrator{
+		AccountID:          aws.ToString(a.AccountId),
+		RelationshipStatus: aws.ToString(a.RelationshipStatus),
+		InvitationID:       aws.ToString(a.InvitationId),
+		InvitedAt:          aws.ToString(a.InvitedAt),
+	}, nil
+}
+
+// detectorMemberAccounts lists every member of one detector
+func detectorMemberAccounts(ctx context.Context, client MembersAPI, region, detectorID string, opts FetchOptions) ([]MemberAccount, error) {
+	var members []MemberAccount
+	paginator := guardduty.NewListMembersPaginator(client, &guardduty.ListMembersInput{
+		DetectorId:     aws.String(detectorID),
+		OnlyAssociated: aws.String("false"),
+	})
+	for paginator.HasMorePages() {
+		pageCtx, cancel := callContext(ctx, opts.CallTimeout)
+		output, err := paginator.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("error listing members of detector %s: %v", detectorID, err)
+		}
+		for _, m := range output.Members {
+			members = append(members, MemberAccount{
+				Region:             region,
+				AdministratorID:    aws.ToString(m.AdministratorId),
+				DetectorID:         detectorID,
+				AccountID:          aws.ToString(m.AccountId),
+				Email:              aws.ToString(m.Email),
+				RelationshipStatus: aws.ToString(m.RelationshipStatus),
+				MemberDetectorID:   aws.ToString(m.DetectorId),
+				InvitedAt:          aws.ToString(m.InvitedAt),
+				UpdatedAt:          aws.ToString(m.UpdatedAt),
+			})
+		}
+	}
+	return members, nil
+}
@@ -0,0 +1,120 @@
+package gd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// AWS partitions the exporter supports
+const (
+	PartitionAWS      = "aws"
+	PartitionGovCloud = "aws-us-gov"
+	PartitionChina    = "aws-cn"
+)
+
+// PartitionRegions maps each partition to the region used by profiles that
+// set none, which also serves the partition's region list and STS calls
+var PartitionRegions = map[string]string{
+	PartitionAWS:      "us-east-1",
+	PartitionGovCloud: "us-gov-west-1",
+	PartitionChina:    "cn-north-1",
+}
+
+// consoleHosts maps each partition to the host of its AWS console
+var consoleHosts = map[string]string{
+	PartitionAWS:      "console.aws.amazon.com",
+	PartitionGovCloud: "console.amazonaws-us-gov.com",
+	PartitionChina:    "console.amazonaws.cn",
+}
+
+// ConsoleURL returns the address of a finding in the GuardDuty console of
+// its region. The console shows the finding of that ID in the detector of
+// the signed-in account, which for a member account's finding is the
+// member's or its administrator's. An empty partition is that of the
+// region.
+func ConsoleURL(partition, region, findingID string) string {
+	if region == "" || findingID == "" {
+		return ""
+	}
+	if partition == "" {
+		partition = RegionPartition(region)
+	}
+	host, ok := consoleHosts[partition]
+	if !ok {
+		host = consoleHosts[PartitionAWS]
+	}
+	return fmt.Sprintf("https://%s/guardduty/home?region=%s#/findings?macros=current&fId=%s",
+		host, url.QueryEscape(region), url.QueryEscape(findingID))
+}
+
+// ValidPartition reports whether p names a supported partition
+func ValidPartition(p string) bool {
+	_, ok := PartitionRegions[p]
+	return ok
+}
+
+// RegionPartition returns the partition region belongs to
+func RegionPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "us-gov-"):
+		return PartitionGovCloud
+	case strings.HasPrefix(region, "cn-"):
+		return PartitionChina
+	}
+	return PartitionAWS
+}
+
+// CheckPartition reports the first region or role of opts outside the
+// partition of the credentials it is reached with, which AWS would reject
+// with a less helpful authentication error. Those are the export's unless
+// the credential map gives the account or region others.
+func CheckPartition(opts FetchOptions) error {
+	partition := RegionPartition(opts.AWSConfig.Region)
+	accounts := []string{opts.ownAccount}
+	if len(opts.Roles) > 0 {
+		accounts = nil
+		for _, role := range opts.Roles {
+			accounts = append(accounts, role.accountID())
+		}
+	}
+	for _, region := range opts.Regions {
+		for _, account := range accounts {
+			expected, source := partition, "the export's profile is"
+			if rule, ok := opts.credentialRule(account, region); ok {
+				expected, source = rule.partition(opts), "the credential rule for "+rule.label()+" is"
+			}
+			if RegionPartition(region) != expected {
+				return fmt.Errorf("Invalid region %q: %s in the %s partition", region, source, expected)
+			}
+		}
+	}
+	for _, role := range opts.Roles {
+		if role.ARN == "" {
+			continue
+		}
+		// A role the credential map replaces in every region is never
+		// assumed
+		if rule, ok := opts.credentialRule(role.accountID(), ""); ok && rule.Region == "" {
+			continue
+		}
+		if parsed, err := arn.Parse(role.ARN); err == nil && parsed.Partition != partition {
+			return fmt.Errorf("Invalid role ARN %q: the export's profile is in the %s partition", role.ARN, partition)
+		}
+	}
+	return nil
+}
+
+// partition returns the partition of the rule's credentials: that of its
+// role, else of its profile's region
+func (r CredentialRule) partition(opts FetchOptions) string {
+	if parsed, err := arn.Parse(r.RoleARN); err == nil {
+		return parsed.Partition
+	}
+	if cfg, ok := opts.CredentialProfiles[r.Profile]; ok {
+		return RegionPartition(cfg.Region)
+	}
+	return RegionPartition(opts.AWSConfig.Region)
+}
@@ -0,0 +1,223 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+	"github.com/aws/smithy-go"
+
+	"guardduty/internal/telemetry"
+)
+
+// PostureReport is the GuardDuty configuration of every account and region
+// of an export in one place: the detector and its protection plans, the
+// organization's auto-enable settings where the account is its delegated
+// administrator, and the enrollment of member accounts, with the gaps in
+// each flagged
+type PostureReport struct {
+	Regions []RegionPosture `json:"regions"`
+	// Flagged lists the accounts and regions with at least one flag
+	Flagged []string `json:"flagged"`
+}
+
+// RegionPosture is the configuration of one account and region. Flags
+// describe what leaves it less than fully monitored, such as a suspended
+// detector, a disabled protection plan, or auto-enable turned off for the
+// organization's accounts. A region that is not enabled for the account is
+// skipped, and one that could not be queried reports its error without
+// failing the others.
+type RegionPosture struct {
+	Account        string            `json:"account,omitempty"`
+	Region         string            `json:"region"`
+	DetectorID     string            `json:"detectorId,omitempty"`
+	DetectorStatus string            `json:"detectorStatus,omitempty"`
+	Features       []DetectorFeature `json:"features,omitempty"`
+	// Organization is set when the account is the delegated administrator
+	// of its organization in the region
+	Organization  *OrganizationPosture `json:"organization,omitempty"`
+	Administrator *MemberAdministrator `json:"administrator,omitempty"`
+	Members       int                  `json:"members"`
+	Enabled       int                  `json:"enabled"`
+	Flags         []string             `json:"flags"`
+	Skipped       string               `json:"skipped,omitempty"`
+	Error         string               `json:"error,omitempty"`
+}
+
+// OrganizationPosture is how a delegated administrator enables GuardDuty
+// for the accounts of its organization, from
+// DescribeOrganizationConfiguration: AutoEnableMembers and the AutoEnable of
+// each feature are NEW, ALL, or NONE
+type OrganizationPosture struct {
+	AutoEnableMembers         string                `json:"autoEnableMembers"`
+	MemberAccountLimitReached bool                  `json:"memberAccountLimitReached,omitempty"`
+	Features                  []OrganizationFeature `json:"features"`
+}
+
+// OrganizationFeature is the auto-enable setting of one feature for an
+// organization's accounts
+type OrganizationFeature struct {
+	Name       string           `json:"name"`
+	AutoEnable string           `json:"autoEnable"`
+	Additional []FeatureSetting `json:"additionalConfiguration,omitempty"`
+}
+
+// GuardDutyPosture describes the configuration of every account and region
+// in opts, using opts.Concurrency workers. Regions without a detector are
+// flagged rather than skipped, since they are the largest gap of all.
+func GuardDutyPosture(ctx context.Context, opts FetchOptions) PostureReport {
+	targets := exportTargets(ctx, opts)
+	report := PostureReport{Regions: make([]RegionPosture, len(targets)), Flagged: []string{}}
+	eachTarget(targets, opts.Concurrency, func(i int) {
+		report.Regions[i] = regionPosture(ctx, opts, targets[i])
+	})
+	for _, region := range report.Regions {
+		if len(region.Flags) > 0 {
+			report.Flagged = append(report.Flagged, TargetLabel(region.Account, region.Region))
+		}
+	}
+	sort.Strings(report.Flagged)
+	return report
+}
+
+// regionPosture describes the configuration of one target
+func regionPosture(ctx context.Context, opts FetchOptions, target exportTarget) RegionPosture {
+	account, region := target.account.accountID, target.region
+	posture := RegionPosture{Account: account, Region: region, Flags: []string{}}
+	if target.disabled {
+		posture.Skipped = "region is not enabled for this account"
+		return posture
+	}
+	log := telemetry.Logger(ctx).With("region", target.label())
+
+	client := target.client()
+	err := func() error {
+		listCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error listing detectors in region %s: %v", region, err)
+		}
+		if len(detectors.DetectorIds) == 0 {
+			posture.Flags = append(posture.Flags, errGuardDutyNotEnabled.Error())
+			return nil
+		}
+		// A region has at most one detector
+		detectorID := detectors.DetectorIds[0]
+		getCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detector, err := client.GetDetector(getCtx, &guardduty.GetDetectorInput{DetectorId: aws.String(detectorID)})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error getting detector %s: %v", detectorID, err)
+		}
+		info := detectorInfo(detectorID, detector)
+		posture.DetectorID, posture.DetectorStatus, posture.Features = detectorID, info.Status, info.Features
+
+		if posture.Administrator, err = detectorAdministrator(ctx, client, detectorID, opts); err != nil {
+			return err
+		}
+		members, err := detectorMemberAccounts(ctx, client, region, detectorID, opts)
+		if err != nil {
+			return err
+		}
+		posture.Members = len(members)
+		for _, member := range members {
+			if strings.EqualFold(member.RelationshipStatus, "Enabled") {
+				posture.Enabled++
+			}
+		}
+		posture.Organization, err = organizationPosture(ctx, client, detectorID, opts)
+		return err
+	}()
+	if err != nil {
+		if account != "" {
+			err = fmt.Errorf("account %s: %v", account, err)
+		}
+		log.Error("Error describing GuardDuty posture", "error", err)
+		posture.Error = err.Error()
+		return posture
+	}
+	posture.Flags = append(posture.Flags, postureFlags(posture)...)
+	return posture
+}
+
+// organizationPosture returns the organization configuration of a detector,
+// or nil when its account is not the organization's delegated
+// administrator, which GuardDuty rejects as a bad request
+func organizationPosture(ctx context.Context, client PostureAPI, detectorID string, opts FetchOptions) (*OrganizationPosture, error) {
+	callCtx, cancel := callContext(ctx, opts.CallTimeout)
+	config, err := client.DescribeOrganizationConfiguration(callCtx, &guardduty.DescribeOrganizationConfigurationInput{DetectorId: aws.String(detectorID)})
+	cancel()
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "BadRequestException" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error describing the organization configuration of detector %s: %v", detectorID, err)
+	}
+	posture := &OrganizationPosture{
+		AutoEnableMembers:         string(config.AutoEnableOrganizationMembers),
+		MemberAccountLimitReached: aws.ToBool(config.MemberAccountLimitReached),
+		Features:                  []OrganizationFeature{},
+	}
+	for _, f := range config.Features {
+		feature := OrganizationFeature{Name: string(f.Name), AutoEnable: string(f.AutoEnable)}
+		for _, c := range f.AdditionalConfiguration {
+			feature.Additional = append(feature.Additional, FeatureSetting{Name: string(c.Name), Status: string(c.AutoEnable)})
+		}
+		posture.Features = append(posture.Features, feature)
+	}
+	return posture, nil
+}
+
+// postureFlags lists the gaps in the configuration of a region with a
+// detector. EKS Runtime Monitoring is not flagged where Runtime Monitoring,
+// which replaces it, is on.
+func postureFlags(posture RegionPosture) []string {
+	var flags []string
+	if posture.DetectorStatus != string(types.DetectorStatusEnabled) {
+		flags = append(flags, fmt.Sprintf("detector is %s", posture.DetectorStatus))
+	}
+	detector := DetectorInfo{Features: posture.Features}
+	runtime := detector.FeatureStatus(types.DetectorFeatureResultRuntimeMonitoring) == string(types.FeatureStatusEnabled)
+	for _, feature := range ProtectionFeatures {
+		if feature == types.DetectorFeatureResultEksRuntimeMonitoring && runtime {
+			continue
+		}
+		if detector.FeatureStatus(feature) == string(types.FeatureStatusDisabled) {
+			flags = append(flags, fmt.Sprintf("%s is disabled", feature))
+		}
+	}
+	if disabled := posture.Members - posture.Enabled; disabled > 0 {
+		flags = append(flags, fmt.Sprintf("%d of %d member accounts are not enabled", disabled, posture.Members))
+	}
+
+	org := posture.Organization
+	if org == nil {
+		return flags
+	}
+	if org.AutoEnableMembers == string(types.AutoEnableMembersNone) {
+		flags = append(flags, "auto-enable is off for the organization's accounts")
+	}
+	if org.MemberAccountLimitReached {
+		flags = append(flags, "the organization has reached its member account limit")
+	}
+	orgRuntime := false
+	for _, feature := range org.Features {
+		orgRuntime = orgRuntime || feature.Name == string(types.OrgFeatureRuntimeMonitoring) && feature.AutoEnable != string(types.OrgFeatureStatusNone)
+	}
+	for _, feature := range org.Features {
+		if feature.Name == string(types.OrgFeatureEksRuntimeMonitoring) && orgRuntime {
+			continue
+		}
+		if feature.AutoEnable == string(types.OrgFeatureStatusNone) {
+			flags = append(flags, fmt.Sprintf("auto-enable of %s is off for the organization's accounts", feature.Name))
+		}
+	}
+	return flags
+}
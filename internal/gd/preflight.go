@@ -0,0 +1,183 @@
+package gd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+
+	"guardduty/internal/telemetry"
+)
+
+// The outcomes of a permission check: the call succeeded, it was refused
+// for lack of permission, it failed for another reason, or it wasn't made
+// because an earlier check of the target failed
+const (
+	CheckAllowed = "allowed"
+	CheckDenied  = "denied"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+// preflightFindingID is asked for when a detector has no finding to get,
+// which GetFindings answers with no findings when it is allowed
+const preflightFindingID = "00000000000000000000000000000000"
+
+// accessDeniedCodes are the error codes of calls refused by IAM, SCPs, or
+// the credentials themselves
+var accessDeniedCodes = map[string]bool{
+	"AccessDenied":                true,
+	"AccessDeniedException":       true,
+	"UnauthorizedOperation":       true,
+	"UnrecognizedClient":          true,
+	"InvalidClientTokenId":        true,
+	"ExpiredToken":                true,
+	"ExpiredTokenException":       true,
+	"SignatureDoesNotMatch":       true,
+	"UnrecognizedClientException": true,
+}
+
+// Preflight is the outcome of making, in every account and region of an
+// export, the calls the export would make, before running it
+type Preflight struct {
+	Targets []PreflightTarget `json:"targets"`
+	// Failures lists each check that did not pass, such as
+	// "123456789012/eu-west-1: guardduty:ListFindings denied"
+	Failures []string `json:"failures"`
+}
+
+// PreflightTarget holds the checks of one account and region. A region that
+// is not enabled for the account, or in which GuardDuty has no detector, is
+// skipped as the export would skip it.
+type PreflightTarget struct {
+	Account string            `json:"account,omitempty"`
+	Region  string            `json:"region"`
+	Checks  []PermissionCheck `json:"checks"`
+	Skipped string            `json:"skipped,omitempty"`
+}
+
+// PermissionCheck is the outcome of one call, named by its IAM action
+type PermissionCheck struct {
+	Action string `json:"action"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CheckStatus returns the outcome of a permission check whose call returned
+// err: allowed, denied when IAM or the credentials refused it, or failed
+func CheckStatus(err error) string {
+	switch {
+	case err == nil:
+		return CheckAllowed
+	case accessDeniedCodes[errorCode(err)]:
+		return CheckDenied
+	}
+	return CheckFailed
+}
+
+// Ready reports whether every check passed
+func (p Preflight) Ready() bool {
+	return len(p.Failures) == 0
+}
+
+// Err returns an error listing the failed checks, or nil when every check
+// passed
+func (p Preflight) Err() error {
+	if p.Ready() {
+		return nil
+	}
+	return fmt.Errorf("preflight failed: %s", strings.Join(p.Failures, "; "))
+}
+
+// RunPreflight checks that the credentials of every account in opts can
+// assume their role and call ListDetectors, ListFindings, and GetFindings
+// in every region, using opts.Concurrency workers. Each call fetches at most
+// one finding.
+func RunPreflight(ctx context.Context, opts FetchOptions) Preflight {
+	targets := exportTargets(ctx, opts)
+	preflight := Preflight{Targets: make([]PreflightTarget, len(targets)), Failures: []string{}}
+	eachTarget(targets, opts.Concurrency, func(i int) {
+		preflight.Targets[i] = preflightTarget(ctx, opts, targets[i])
+	})
+	for _, target := range preflight.Targets {
+		for _, check := range target.Checks {
+			if check.Status == CheckDenied || check.Status == CheckFailed {
+				preflight.Failures = append(preflight.Failures, fmt.Sprintf("%s: %s %s", TargetLabel(target.Account, target.Region), check.Action, check.Status))
+			}
+		}
+	}
+	sort.Strings(preflight.Failures)
+	return preflight
+}
+
+// preflightTarget makes the checks of one target in order, skipping those
+// after the first that fails
+func preflightTarget(ctx context.Context, opts FetchOptions, target exportTarget) PreflightTarget {
+	result := PreflightTarget{Account: target.account.accountID, Region: target.region, Checks: []PermissionCheck{}}
+	if target.disabled {
+		result.Skipped = "region is not enabled for this account"
+		return result
+	}
+	cfg := target.config()
+	client := target.client()
+
+	var detectorIDs, findingIDs []string
+	checks := []struct {
+		action string
+		call   func(ctx context.Context) error
+	}{
+		{"sts:AssumeRole", func(ctx context.Context) error {
+			_, err := cfg.Credentials.Retrieve(ctx)
+			return err
+		}},
+		{"guardduty:ListDetectors", func(ctx context.Context) error {
+			out, err := client.ListDetectors(ctx, &guardduty.ListDetectorsInput{})
+			if err == nil {
+				detectorIDs = out.DetectorIds
+			}
+			return err
+		}},
+		{"guardduty:ListFindings", func(ctx context.Context) error {
+			out, err := client.ListFindings(ctx, &guardduty.ListFindingsInput{DetectorId: aws.String(detectorIDs[0]), FindingCriteria: opts.Filter.criteria(), MaxResults: aws.Int32(1)})
+			if err == nil {
+				findingIDs = out.FindingIds
+			}
+			return err
+		}},
+		{"guardduty:GetFindings", func(ctx context.Context) error {
+			if len(findingIDs) == 0 {
+				findingIDs = []string{preflightFindingID}
+			}
+			_, err := client.GetFindings(ctx, &guardduty.GetFindingsInput{DetectorId: aws.String(detectorIDs[0]), FindingIds: findingIDs})
+			return err
+		}},
+	}
+	if target.account.roleARN == "" {
+		checks = checks[1:]
+	}
+	failed := false
+	for _, check := range checks {
+		if failed {
+			result.Checks = append(result.Checks, PermissionCheck{Action: check.action, Status: CheckSkipped})
+			continue
+		}
+		if check.action == "guardduty:ListFindings" && len(detectorIDs) == 0 {
+			result.Skipped = errGuardDutyNotEnabled.Error()
+			break
+		}
+		callCtx, cancel := callContext(ctx, opts.CallTimeout)
+		err := check.call(callCtx)
+		cancel()
+		c := PermissionCheck{Action: check.action, Status: CheckStatus(err)}
+		if err != nil {
+			failed = true
+			c.Error = err.Error()
+			telemetry.Logger(ctx).Warn("Preflight check did not pass", "region", target.label(), "action", check.action, "status", c.Status, "error", err)
+		}
+		result.Checks = append(result.Checks, c)
+	}
+	return result
+}
@@ -0,0 +1,172 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/telemetry"
+)
+
+// PublishingInventory lists the publishing destinations of every account and
+// region of an export: the S3 buckets GuardDuty exports its findings to on
+// its own, independently of this tool
+type PublishingInventory struct {
+	Destinations []PublishingDestination `json:"destinations"`
+	Regions      []RegionPublishing      `json:"regions"`
+	// Unpublished lists the accounts and regions whose findings are not
+	// being published to S3: those without a destination, or whose every
+	// destination is unhealthy
+	Unpublished []string `json:"unpublished"`
+}
+
+// PublishingDestination describes one publishing destination of a
+// detector. It is healthy while GuardDuty is publishing to it; a destination
+// GuardDuty cannot write to, such as when the bucket policy or KMS key
+// denies it, reports when publishing began failing.
+type PublishingDestination struct {
+	Account        string     `json:"account,omitempty"`
+	Region         string     `json:"region"`
+	DetectorID     string     `json:"detectorId"`
+	ID             string     `json:"id"`
+	Type           string     `json:"type"`
+	DestinationArn string     `json:"destinationArn"`
+	KmsKeyArn      string     `json:"kmsKeyArn,omitempty"`
+	Status         string     `json:"status"`
+	Healthy        bool       `json:"healthy"`
+	FailingSince   *time.Time `json:"failingSince,omitempty"`
+}
+
+// RegionPublishing is the publishing of one account and region. A region
+// without GuardDuty is skipped, and one that could not be queried reports
+// its error without failing the others.
+type RegionPublishing struct {
+	Account      string `json:"account,omitempty"`
+	Region       string `json:"region"`
+	Destinations int    `json:"destinations"`
+	// PublishesToS3 is set when the region has an S3 destination, and
+	// Healthy when one of them is being published to
+	PublishesToS3 bool   `json:"publishesToS3"`
+	Healthy       bool   `json:"healthy"`
+	Skipped       string `json:"skipped,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// ListPublishingDestinations describes the publishing destinations of every
+// detector in every account and region in opts, using opts.Concurrency
+// workers
+func ListPublishingDestinations(ctx context.Context, opts FetchOptions) PublishingInventory {
+	targets := exportTargets(ctx, opts)
+	inventory := PublishingInventory{Destinations: []PublishingDestination{}, Regions: make([]RegionPublishing, len(targets)), Unpublished: []string{}}
+	destinations := make([][]PublishingDestination, len(targets))
+	eachTarget(targets, opts.Concurrency, func(i int) {
+		inventory.Regions[i], destinations[i] = regionPublishing(ctx, opts, targets[i])
+	})
+	for i, region := range inventory.Regions {
+		inventory.Destinations = append(inventory.Destinations, destinations[i]...)
+		if region.Skipped == "" && region.Error == "" && !region.Healthy {
+			inventory.Unpublished = append(inventory.Unpublished, TargetLabel(region.Account, region.Region))
+		}
+	}
+	sort.Strings(inventory.Unpublished)
+	return inventory
+}
+
+// regionPublishing describes the publishing destinations of one target
+func regionPublishing(ctx context.Context, opts FetchOptions, target exportTarget) (RegionPublishing, []PublishingDestination) {
+	account, region := target.account.accountID, target.region
+	result := RegionPublishing{Account: account, Region: region}
+	if target.disabled {
+		result.Skipped = "region is not enabled for this account"
+		return result, nil
+	}
+	log := telemetry.Logger(ctx).With("region", target.label())
+
+	client := target.client()
+	var destinations []PublishingDestination
+	err := func() error {
+		listCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error listing detectors in region %s: %v", region, err)
+		}
+		if len(detectors.DetectorIds) == 0 {
+			return errGuardDutyNotEnabled
+		}
+		for _, detectorID := range detectors.DetectorIds {
+			list, err := detectorPublishingDestinations(ctx, client, detectorID, opts)
+			if err != nil {
+				return err
+			}
+			for _, destination := range list {
+				destination.Account, destination.Region, destination.DetectorID = account, region, detectorID
+				if destination.Type == string(types.DestinationTypeS3) {
+					result.PublishesToS3 = true
+				}
+				result.Healthy = result.Healthy || destination.Healthy
+				destinations = append(destinations, destination)
+			}
+			result.Destinations += len(list)
+		}
+		return nil
+	}()
+	switch {
+	case errors.Is(err, errGuardDutyNotEnabled):
+		result.Skipped = err.Error()
+	case err != nil:
+		if account != "" {
+			err = fmt.Errorf("account %s: %v", account, err)
+		}
+		log.Error("Error listing publishing destinations", "error", err)
+		result.Error = err.Error()
+	}
+	return result, destinations
+}
+
+// detectorPublishingDestinations describes the publishing destinations of
+// one detector
+func detectorPublishingDestinations(ctx context.Context, client PublishingAPI, detectorID string, opts FetchOptions) ([]PublishingDestination, error) {
+	var destinations []PublishingDestination
+	paginator := guardduty.NewListPublishingDestinationsPaginator(client, &guardduty.ListPublishingDestinationsInput{DetectorId: aws.String(detectorID)})
+	for paginator.HasMorePages() {
+		pageCtx, cancel := callContext(ctx, opts.CallTimeout)
+		output, err := paginator.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("error listing publishing destinations for detector %s: %v", detectorID, err)
+		}
+		for _, d := range output.Destinations {
+			id := aws.ToString(d.DestinationId)
+			describeCtx, cancel := callContext(ctx, opts.CallTimeout)
+			described, err := client.DescribePublishingDestination(describeCtx, &guardduty.DescribePublishingDestinationInput{DetectorId: aws.String(detectorID), DestinationId: aws.String(id)})
+			cancel()
+			if err != nil {
+				return nil, fmt.Errorf("error describing publishing destination %s: %v", id, err)
+			}
+			destination := PublishingDestination{
+				ID:      id,
+				Type:    string(described.DestinationType),
+				Status:  string(described.Status),
+				Healthy: described.Status == types.PublishingStatusPublishing,
+			}
+			if properties := described.DestinationProperties; properties != nil {
+				destination.DestinationArn = aws.ToString(properties.DestinationArn)
+				destination.KmsKeyArn = aws.ToString(properties.KmsKeyArn)
+			}
+			// GuardDuty reports zero for a destination that never failed
+			if failed := aws.ToInt64(described.PublishingFailureStartTimestamp); failed > 0 {
+				since := time.UnixMilli(failed).UTC()
+				destination.FailingSince = &since
+			}
+			destinations = append(destinations, destination)
+		}
+	}
+	return destinations, nil
+}
@@ -0,0 +1,135 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// RegionGroupNames lists the region group presets in display order
+var RegionGroupNames = []string{"all", "us", "eu", "apac", "gov", "cn"}
+
+// regionGroups maps each region group preset to the name prefixes of its
+// regions. The "all" group has no prefixes and matches every region. Only the
+// regions of the credentials' partition are listed, so the gov and cn groups
+// are for GovCloud and China profiles.
+var regionGroups = map[string][]string{
+	"all":  nil,
+	"us":   {"us-"},
+	"eu":   {"eu-"},
+	"apac": {"ap-"},
+	"gov":  {"us-gov-"},
+	"cn":   {"cn-"},
+}
+
+// errGuardDutyNotEnabled is returned when a region has no GuardDuty detector
+var errGuardDutyNotEnabled = errors.New("GuardDuty is not enabled in this region")
+
+// errNoSelectedDetector is returned when a region has detectors but none of
+// those FetchOptions.Detectors selects
+var errNoSelectedDetector = errors.New("none of the selected detectors is in this region")
+
+// ValidRegionGroup reports whether group names a region group preset
+func ValidRegionGroup(group string) bool {
+	_, ok := regionGroups[group]
+	return ok
+}
+
+// FilterRegionGroup returns the regions that belong to group
+func FilterRegionGroup(regions []string, group string) []string {
+	prefixes := regionGroups[group]
+	if len(prefixes) == 0 {
+		return regions
+	}
+
+	var matched []string
+	for _, region := range regions {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(region, prefix) {
+				matched = append(matched, region)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// AllRegions returns the regions enabled for the account of cfg, as the EC2
+// client of clients lists them. Opt-in regions that have not been enabled
+// are left out.
+func AllRegions(ctx context.Context, clients Clients, cfg aws.Config, callTimeout time.Duration) ([]string, error) {
+	return enabledRegions(ctx, clients.EC2(cfg, ""), callTimeout)
+}
+
+// enabledRegions returns the regions client lists as enabled
+func enabledRegions(ctx context.Context, client EC2API, callTimeout time.Duration) ([]string, error) {
+	ctx, cancel := callContext(ctx, callTimeout)
+	defer cancel()
+	resp, err := client.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	var regions []string
+	for _, region := range resp.Regions {
+		regions = append(regions, aws.ToString(region.RegionName))
+	}
+	return regions, nil
+}
+
+// getDisabledRegions returns the opt-in regions that have not been enabled
+// for the account, which GuardDuty cannot be queried in
+func getDisabledRegions(ctx context.Context, client EC2API, callTimeout time.Duration) (map[string]bool, error) {
+	ctx, cancel := callContext(ctx, callTimeout)
+	defer cancel()
+	resp, err := client.DescribeRegions(ctx, &ec2.DescribeRegionsInput{AllRegions: aws.Bool(true)})
+	if err != nil {
+		return nil, err
+	}
+
+	disabled := make(map[string]bool)
+	for _, region := range resp.Regions {
+		if isRegionDisabled(region) {
+			disabled[aws.ToString(region.RegionName)] = true
+		}
+	}
+	return disabled, nil
+}
+
+// isRegionDisabled reports whether an opt-in region has not been enabled
+func isRegionDisabled(region types.Region) bool {
+	return aws.ToString(region.OptInStatus) == "not-opted-in"
+}
+
+// ResolveRegions expands opts.RegionGroup into the enabled regions of that
+// group and adds them to the explicitly selected regions
+func ResolveRegions(ctx context.Context, opts *FetchOptions) error {
+	if opts.RegionGroup == "" {
+		return nil
+	}
+
+	regions, err := enabledRegions(ctx, opts.clients().EC2(opts.AWSConfig, ""), opts.CallTimeout)
+	if err != nil {
+		return fmt.Errorf("error listing regions: %v", err)
+	}
+
+	selected := make(map[string]bool)
+	for _, region := range opts.Regions {
+		selected[region] = true
+	}
+	for _, region := range FilterRegionGroup(regions, opts.RegionGroup) {
+		if !selected[region] {
+			opts.Regions = append(opts.Regions, region)
+		}
+	}
+	if len(opts.Regions) == 0 {
+		return fmt.Errorf("no enabled regions in group %s", opts.RegionGroup)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+
+	"guardduty/internal/telemetry"
+)
+
+// ResourceStateColumns are the columns for the current state of a finding's
+// resource: whether it still exists, and what it is doing now
+var ResourceStateColumns = []string{"ResourceExists", "ResourceState"}
+
+// The defaults of a StateCache: how long looked-up states are reused and
+// the number of calls in flight at once
+const (
+	DefaultStateCacheTTL    = 10 * time.Minute
+	DefaultStateConcurrency = 4
+	maxStateCacheEntries    = 100000
+	maxInstanceIDFilter     = 200
+)
+
+// stateNotFound is the state of a resource that no longer exists
+const stateNotFound = "not found"
+
+// StateCache looks up the current state of the resources of findings, such
+// as whether an instance is running or terminated, whether a bucket blocks
+// public access, and the status and version of an EKS cluster, and keeps them
+// for a while. It is shared by the exports of a server and safe for
+// concurrent use.
+type StateCache struct {
+	ttl       time.Duration
+	pathStyle bool
+	sem       chan struct{}
+	mu        sync.Mutex
+	states    map[string]cachedState
+}
+
+// cachedState is the state of a resource until expires
+type cachedState struct {
+	exists  bool
+	state   string
+	expires time.Time
+}
+
+// NewStateCache returns a StateCache keeping states for ttl with at most
+// concurrency calls in flight. pathStyle addresses buckets by path, as
+// S3-compatible endpoints such as LocalStack need.
+func NewStateCache(ttl time.Duration, concurrency int, pathStyle bool) *StateCache {
+	if ttl <= 0 {
+		ttl = DefaultStateCacheTTL
+	}
+	if concurrency < 1 {
+		concurrency = DefaultStateConcurrency
+	}
+	return &StateCache{ttl: ttl, pathStyle: pathStyle, sem: make(chan struct{}, concurrency), states: make(map[string]cachedState)}
+}
+
+// Exists returns whether the resources of a finding still exist, as
+// "true" or "false", or nothing when their state wasn't looked up
+func (c *StateCache) Exists(finding types.Finding) string {
+	return c.column(finding, func(s cachedState) string { return strconv.FormatBool(s.exists) })
+}
+
+// State returns the current state of the resources of a finding, or
+// nothing when it wasn't looked up
+func (c *StateCache) State(finding types.Finding) string {
+	return c.column(finding, func(s cachedState) string { return s.state })
+}
+
+// column joins the distinct values of the looked-up resources of a finding.
+// States are read whether or not they have expired since the finding was
+// fetched, so a long export keeps the values it looked up.
+func (c *StateCache) column(finding types.Finding, value func(cachedState) string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var values []string
+	for _, resourceARN := range stateResources(finding, "") {
+		if s, ok := c.states[resourceARN]; ok && !slices.Contains(values, value(s)) {
+			values = append(values, value(s))
+		}
+	}
+	return strings.Join(values, "; ")
+}
+
+// stateFindings looks up the current state of the resources of a page of
+// findings fetched from target. As with tags, resources of other accounts
+// are left alone, since the target's credentials can't describe them. A
+// failed lookup is logged and leaves the resources of that service without
+// a state.
+func (c *StateCache) stateFindings(ctx context.Context, target exportTarget, findings []types.Finding, callTimeout time.Duration) {
+	now := time.Now()
+	missing := make(map[string][]arn.ARN)
+	wanted := make(map[string]bool)
+	for _, finding := range findings {
+		if account := target.account.accountID; account != "" && aws.ToString(finding.AccountId) != account {
+			continue
+		}
+		for _, resourceARN := range stateResources(finding, target.region) {
+			if c.cached(resourceARN, now) || wanted[resourceARN] {
+				continue
+			}
+			wanted[resourceARN] = true
+			if parsed, err := arn.Parse(resourceARN); err == nil {
+				missing[parsed.Service] = append(missing[parsed.Service], parsed)
+			}
+		}
+	}
+	cfg := target.config()
+	for _, service := range []string{"ec2", "s3", "eks"} {
+		resources := missing[service]
+		if len(resources) == 0 {
+			continue
+		}
+		var err error
+		switch service {
+		case "ec2":
+			err = c.lookupInstances(ctx, cfg, resources, callTimeout)
+		case "s3":
+			err = c.lookupBuckets(ctx, cfg, resources, callTimeout)
+		case "eks":
+			err = c.lookupClusters(ctx, cfg, resources, callTimeout)
+		}
+		if err != nil {
+			telemetry.Logger(ctx).Warn("Error looking up resource state", "service", service, "resources", len(resources), "error", err)
+		}
+	}
+}
+
+// cached reports whether the state of a resource is cached and unexpired
+func (c *StateCache) cached(resourceARN string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.states[resourceARN]
+	return ok && !now.After(entry.expires)
+}
+
+// call makes one lookup call once fewer than the cache's concurrency are in
+// flight
+func (c *StateCache) call(ctx context.Context, callTimeout time.Duration, fn func(ctx context.Context) error) error {
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-c.sem }()
+	callCtx, cancel := callContext(ctx, callTimeout)
+	defer cancel()
+	return fn(callCtx)
+}
+
+// lookupInstances describes instances 200 at a time, filtering by ID rather
+// than naming them, so that one that is gone doesn't fail the call. Instances
+// EC2 doesn't return, those terminated over an hour ago among them, are
+// cached as not found.
+func (c *StateCache) lookupInstances(ctx context.Context, cfg aws.Config, resources []arn.ARN, callTimeout time.Duration) error {
+	client := ec2.NewFromConfig(cfg)
+	for start := 0; start < len(resources); start += maxInstanceIDFilter {
+		batch := resources[start:min(start+maxInstanceIDFilter, len(resources))]
+		ids := make([]string, len(batch))
+		for i, resource := range batch {
+			ids[i] = strings.TrimPrefix(resource.Resource, "instance/")
+		}
+		found := make(map[string]string, len(batch))
+		paginator := ec2.NewDescribeInstancesPaginator(client, &ec2.DescribeInstancesInput{
+			Filters: []ec2types.Filter{{Name: aws.String("instance-id"), Values: ids}},
+		})
+		for paginator.HasMorePages() {
+			var page *ec2.DescribeInstancesOutput
+			err := c.call(ctx, callTimeout, func(ctx context.Context) (err error) {
+				page, err = paginator.NextPage(ctx)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("error describing instances in region %s: %v", cfg.Region, err)
+			}
+			for _, reservation := range page.Reservations {
+				for _, instance := range reservation.Instances {
+					if instance.State != nil {
+						found[aws.ToString(instance.InstanceId)] = string(instance.State.Name)
+					}
+				}
+			}
+		}
+		states := make(map[string]cachedState, len(batch))
+		for i, resource := range batch {
+			states[resource.String()] = foundState(found[ids[i]])
+		}
+		c.store(states)
+	}
+	return nil
+}
+
+// lookupBuckets reads the public access block of each bucket. The block of
+// the bucket's account isn't read, so a bucket reported as not blocking
+// public access may still be covered by it.
+func (c *StateCache) lookupBuckets(ctx context.Context, cfg aws.Config, resources []arn.ARN, callTimeout time.Duration) error {
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = c.pathStyle
+	})
+	for _, resource := range resources {
+		var out *s3.GetPublicAccessBlockOutput
+		err := c.call(ctx, callTimeout, func(ctx context.Context) (err error) {
+			out, err = client.GetPublicAccessBlock(ctx, &s3.GetPublicAccessBlockInput{Bucket: aws.String(resource.Resource)})
+			return err
+		})
+		state := cachedState{exists: true, state: "public access not blocked"}
+		switch code := errorCode(err); {
+		case err == nil:
+			state.state = publicAccessState(out)
+		case code == "NoSuchBucket":
+			state = cachedState{state: stateNotFound}
+		case code != "NoSuchPublicAccessBlockConfiguration":
+			return fmt.Errorf("error getting public access block of bucket %s: %v", resource.Resource, err)
+		}
+		c.store(map[string]cachedState{resource.String(): state})
+	}
+	return nil
+}
+
+// publicAccessState describes how much of a bucket's public access is
+// blocked
+func publicAccessState(out *s3.GetPublicAccessBlockOutput) string {
+	conf := out.PublicAccessBlockConfiguration
+	if conf == nil {
+		return "public access not blocked"
+	}
+	settings := []*bool{conf.BlockPublicAcls, conf.IgnorePublicAcls, conf.BlockPublicPolicy, conf.RestrictPublicBuckets}
+	blocked := 0
+	for _, setting := range settings {
+		if aws.ToBool(setting) {
+			blocked++
+		}
+	}
+	switch blocked {
+	case len(settings):
+		return "public access blocked"
+	case 0:
+		return "public access not blocked"
+	}
+	return "public access partly blocked"
+}
+
+// lookupClusters describes each EKS cluster for its status and Kubernetes
+// version
+func (c *StateCache) lookupClusters(ctx context.Context, cfg aws.Config, resources []arn.ARN, callTimeout time.Duration) error {
+	client := eks.NewFromConfig(cfg)
+	for _, resource := range resources {
+		name := strings.TrimPrefix(resource.Resource, "cluster/")
+		var out *eks.DescribeClusterOutput
+		err := c.call(ctx, callTimeout, func(ctx context.Context) (err error) {
+			out, err = client.DescribeCluster(ctx, &eks.DescribeClusterInput{Name: aws.String(name)})
+			return err
+		})
+		state := cachedState{state: stateNotFound}
+		switch {
+		case err == nil && out.Cluster != nil:
+			state = cachedState{exists: true, state: strings.ToLower(string(out.Cluster.Status))}
+			if version := aws.ToString(out.Cluster.Version); version != "" {
+				state.state += ", version " + version
+			}
+		case err != nil && errorCode(err) != "ResourceNotFoundException":
+			return fmt.Errorf("error describing EKS cluster %s: %v", name, err)
+		}
+		c.store(map[string]cachedState{resource.String(): state})
+	}
+	return nil
+}
+
+// foundState returns the state of a resource, which is not found when empty
+func foundState(state string) cachedState {
+	if state == "" {
+		return cachedState{state: stateNotFound}
+	}
+	return cachedState{exists: true, state: state}
+}
+
+// errorCode returns the code of an AWS API error, or nothing
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// store caches the states of resources, dropping expired entries once the
+// cache is full
+func (c *StateCache) store(states map[string]cachedState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.states)+len(states) > maxStateCacheEntries {
+		for resourceARN, entry := range c.states {
+			if now.After(entry.expires) {
+				delete(c.states, resourceARN)
+			}
+		}
+		if len(c.states)+len(states) > maxStateCacheEntries {
+			c.states = make(map[string]cachedState)
+		}
+	}
+	expires := now.Add(c.ttl)
+	for resourceARN, state := range states {
+		state.expires = expires
+		c.states[resourceARN] = state
+	}
+}
+
+// stateResources returns the ARNs of the resources of a finding whose state
+// can be looked up: its instance, buckets, and EKS cluster
+func stateResources(finding types.Finding, region string) []string {
+	var resources []string
+	for _, resource := range taggedResources(finding, region) {
+		if parsed, err := arn.Parse(resource.arn); err == nil && slices.Contains([]string{"ec2", "s3", "eks"}, parsed.Service) {
+			resources = append(resources, resource.arn)
+		}
+	}
+	return resources
+}
@@ -0,0 +1,259 @@
+package gd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// maxRuleLabels bounds the findings whose rule tags a RuleSet keeps for the
+// export columns
+const maxRuleLabels = 100000
+
+// Rule post-processes the findings of an export that its Match selects as
+// they are fetched: it can drop them as known noise, replace their severity,
+// tag them, such as with the team owning them, and route them to further
+// destinations. A rule needs at least one action.
+type Rule struct {
+	Name  string    `yaml:"name"`
+	Match RuleMatch `yaml:"match"`
+	// Drop leaves the findings out of the export, once they are routed
+	Drop bool `yaml:"drop"`
+	// Severity replaces the severity of the findings; zero keeps it
+	Severity float64 `yaml:"severity"`
+	// Tags label the findings for the export columns of the same names
+	Tags map[string]string `yaml:"tags"`
+	// Route names the destinations the findings are also sent to
+	Route []string `yaml:"route"`
+}
+
+// RuleMatch selects the findings of a rule. Each condition that is set must
+// hold, and a list holds when the finding has one of its values; a rule
+// without conditions matches every finding.
+type RuleMatch struct {
+	// Types holds exact finding types or prefixes ending in "*"
+	Types    []string `yaml:"types"`
+	Accounts []string `yaml:"accounts"`
+	Regions  []string `yaml:"regions"`
+	// ResourceTypes are the types of the affected resource, such as
+	// Instance or AccessKey, and Severities the SeverityLabels of the
+	// findings, both regardless of case
+	ResourceTypes []string `yaml:"resourceTypes"`
+	Severities    []string `yaml:"severities"`
+	// ResourceTags are tags the affected resource must have, with a value
+	// of "*" for any value
+	ResourceTags map[string]string `yaml:"resourceTags"`
+}
+
+// RuleSet applies the rules setting to the findings of exports, in order, so
+// each rule sees a finding as the rules before it left it, and a dropped
+// finding is seen by no later rule. It keeps the tags it gave each finding
+// last for the columns that read them. A RuleSet is shared by the exports of
+// a server and safe for concurrent use.
+type RuleSet struct {
+	rules  []Rule
+	mu     sync.Mutex
+	labels map[string]map[string]string
+}
+
+// NewRuleSet checks rules and returns the RuleSet applying them
+func NewRuleSet(rules []Rule) (*RuleSet, error) {
+	names := make(map[string]bool)
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("invalid rules[%d]: name must be set", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("invalid rule %q: name is given twice", rule.Name)
+		}
+		names[rule.Name] = true
+		if !rule.Drop && rule.Severity == 0 && len(rule.Tags) == 0 && len(rule.Route) == 0 {
+			return nil, fmt.Errorf("invalid rule %q: must drop, set severity, tag, or route findings", rule.Name)
+		}
+		if rule.Severity < 0 || rule.Severity > 10 {
+			return nil, fmt.Errorf("invalid rule %q: severity %v must be between 0 and 10", rule.Name, rule.Severity)
+		}
+		for key := range rule.Tags {
+			if key == "" {
+				return nil, fmt.Errorf("invalid rule %q: tag names must not be empty", rule.Name)
+			}
+		}
+		for _, label := range rule.Match.Severities {
+			if !containsFold(SeverityLabels, label) {
+				return nil, fmt.Errorf("invalid rule %q: severity %q must be one of %s", rule.Name, label, strings.Join(SeverityLabels, ", "))
+			}
+		}
+	}
+	return &RuleSet{rules: rules, labels: make(map[string]map[string]string)}, nil
+}
+
+// Rules returns the rules of the set
+func (s *RuleSet) Rules() []Rule {
+	return s.rules
+}
+
+// TagNames returns the names of the tags the rules give findings, in the
+// order the rules first give them
+func (s *RuleSet) TagNames() []string {
+	var names []string
+	for _, rule := range s.rules {
+		var keys []string
+		for key := range rule.Tags {
+			if !slices.Contains(names, key) {
+				keys = append(keys, key)
+			}
+		}
+		slices.Sort(keys)
+		names = append(names, keys...)
+	}
+	return names
+}
+
+// Tag returns the value of the tag name that the rules gave a finding when
+// it was last fetched, or nothing
+func (s *RuleSet) Tag(finding types.Finding, name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.labels[ruleLabelKey(finding)][name]
+}
+
+// apply applies the rules to a page of findings and returns the findings
+// kept, counting those dropped in result and adding those routed to its
+// Routed
+func (s *RuleSet) apply(findings []types.Finding, result *RegionResult) []types.Finding {
+	kept := make([]types.Finding, 0, len(findings))
+	labels := make(map[string]map[string]string, len(findings))
+	for _, finding := range findings {
+		tags := make(map[string]string)
+		dropped := false
+		for _, rule := range s.rules {
+			if !rule.Match.matches(finding) {
+				continue
+			}
+			if rule.Severity > 0 {
+				finding.Severity = aws.Float64(rule.Severity)
+			}
+			for key, value := range rule.Tags {
+				tags[key] = value
+			}
+			for _, destination := range rule.Route {
+				if result.Routed == nil {
+					result.Routed = make(map[string][]types.Finding)
+				}
+				result.Routed[destination] = append(result.Routed[destination], finding)
+			}
+			if rule.Drop {
+				dropped = true
+				break
+			}
+		}
+		if len(tags) == 0 || dropped {
+			tags = nil
+		}
+		labels[ruleLabelKey(finding)] = tags
+		if dropped {
+			result.Dropped++
+			continue
+		}
+		kept = append(kept, finding)
+	}
+	s.store(labels)
+	return kept
+}
+
+// store keeps the tags of a page of findings, forgetting those of findings
+// that no longer have any, and every tag kept when there are too many
+func (s *RuleSet) store(labels map[string]map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.labels)+len(labels) > maxRuleLabels {
+		s.labels = make(map[string]map[string]string)
+	}
+	for key, tags := range labels {
+		if tags == nil {
+			delete(s.labels, key)
+		} else {
+			s.labels[key] = tags
+		}
+	}
+}
+
+// ruleLabelKey identifies a finding across the copies of it fetched from an
+// administrator and its member account
+func ruleLabelKey(finding types.Finding) string {
+	return aws.ToString(finding.AccountId) + "/" + aws.ToString(finding.Region) + "/" + aws.ToString(finding.Id)
+}
+
+// matches reports whether a finding meets every condition of the match
+func (m RuleMatch) matches(finding types.Finding) bool {
+	if !(Filter{FindingTypes: m.Types}).matchesTypePattern(aws.ToString(finding.Type)) {
+		return false
+	}
+	if len(m.Accounts) > 0 && !slices.Contains(m.Accounts, aws.ToString(finding.AccountId)) {
+		return false
+	}
+	if len(m.Regions) > 0 && !slices.Contains(m.Regions, aws.ToString(finding.Region)) {
+		return false
+	}
+	if len(m.ResourceTypes) > 0 {
+		var resourceType string
+		if finding.Resource != nil {
+			resourceType = aws.ToString(finding.Resource.ResourceType)
+		}
+		if !containsFold(m.ResourceTypes, resourceType) {
+			return false
+		}
+	}
+	if len(m.Severities) > 0 && !containsFold(m.Severities, SeverityLabel(aws.ToFloat64(finding.Severity))) {
+		return false
+	}
+	if len(m.ResourceTags) > 0 {
+		tags := findingResourceTags(finding)
+		for key, want := range m.ResourceTags {
+			if !slices.ContainsFunc(tags, func(tag types.Tag) bool {
+				return strings.EqualFold(aws.ToString(tag.Key), key) && (want == "*" || aws.ToString(tag.Value) == want)
+			}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// containsFold reports whether values holds v, ignoring case
+func containsFold(values []string, v string) bool {
+	return slices.ContainsFunc(values, func(value string) bool { return strings.EqualFold(value, v) })
+}
+
+// findingResourceTags returns the tags of the resources of a finding: its
+// instance, buckets, EKS or ECS cluster, Lambda function, or RDS instance
+func findingResourceTags(finding types.Finding) []types.Tag {
+	r := finding.Resource
+	if r == nil {
+		return nil
+	}
+	var tags []types.Tag
+	if r.InstanceDetails != nil {
+		tags = append(tags, r.InstanceDetails.Tags...)
+	}
+	for _, bucket := range r.S3BucketDetails {
+		tags = append(tags, bucket.Tags...)
+	}
+	if r.EksClusterDetails != nil {
+		tags = append(tags, r.EksClusterDetails.Tags...)
+	}
+	if r.EcsClusterDetails != nil {
+		tags = append(tags, r.EcsClusterDetails.Tags...)
+	}
+	if r.LambdaDetails != nil {
+		tags = append(tags, r.LambdaDetails.Tags...)
+	}
+	if r.RdsDbInstanceDetails != nil {
+		tags = append(tags, r.RdsDbInstanceDetails.Tags...)
+	}
+	return tags
+}
@@ -0,0 +1,325 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/telemetry"
+)
+
+// filterNamePattern is what GuardDuty accepts as the name of a filter
+var filterNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,64}$`)
+
+// SavedFilterInventory lists the saved filters of every account and region
+// of an export
+type SavedFilterInventory struct {
+	Filters []SavedFilter   `json:"filters"`
+	Regions []RegionFilters `json:"regions"`
+}
+
+// SavedFilter is a filter saved on a detector. With the ARCHIVE action it is
+// a suppression rule, which archives new findings that match its criteria
+// as they are generated; with NOOP it only names a view in the console.
+// Filters are applied in the order of their rank.
+type SavedFilter struct {
+	Account     string                     `json:"account,omitempty"`
+	Region      string                     `json:"region,omitempty"`
+	DetectorID  string                     `json:"detectorId,omitempty"`
+	Name        string                     `json:"name"`
+	Description string                     `json:"description,omitempty"`
+	Action      string                     `json:"action"`
+	Rank        int32                      `json:"rank,omitempty"`
+	Criteria    map[string]FilterCondition `json:"criteria"`
+	Tags        map[string]string          `json:"tags,omitempty"`
+}
+
+// FilterCondition is the condition a saved filter sets on one finding
+// field, such as severity or resource.instanceDetails.instanceId. Times
+// are compared in milliseconds since the epoch.
+type FilterCondition struct {
+	Equals             []string `json:"equals,omitempty"`
+	NotEquals          []string `json:"notEquals,omitempty"`
+	GreaterThan        *int64   `json:"greaterThan,omitempty"`
+	GreaterThanOrEqual *int64   `json:"greaterThanOrEqual,omitempty"`
+	LessThan           *int64   `json:"lessThan,omitempty"`
+	LessThanOrEqual    *int64   `json:"lessThanOrEqual,omitempty"`
+}
+
+// RegionFilters is the outcome of listing the saved filters of one account
+// and region. A region without GuardDuty is skipped, and one that could not
+// be queried reports its error without failing the others.
+type RegionFilters struct {
+	Account string `json:"account,omitempty"`
+	Region  string `json:"region"`
+	Filters int    `json:"filters"`
+	Skipped string `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Validate reports whether GuardDuty would accept the filter. An empty
+// action is NOOP, and a zero rank places a new filter last.
+func (f SavedFilter) Validate() error {
+	if !filterNamePattern.MatchString(f.Name) {
+		return fmt.Errorf("invalid name %q: use 3 to 64 letters, digits, periods, hyphens, or underscores", f.Name)
+	}
+	switch types.FilterAction(f.Action) {
+	case "", types.FilterActionNoop, types.FilterActionArchive:
+	default:
+		return fmt.Errorf("invalid action %q: must be NOOP or ARCHIVE", f.Action)
+	}
+	if f.Rank < 0 || f.Rank > 100 {
+		return fmt.Errorf("invalid rank %d: must be between 1 and 100", f.Rank)
+	}
+	if len(f.Description) > 512 {
+		return fmt.Errorf("the description is longer than 512 characters")
+	}
+	if len(f.Criteria) == 0 {
+		return fmt.Errorf("the filter has no criteria")
+	}
+	for field, c := range f.Criteria {
+		if len(c.Equals) == 0 && len(c.NotEquals) == 0 && c.GreaterThan == nil && c.GreaterThanOrEqual == nil && c.LessThan == nil && c.LessThanOrEqual == nil {
+			return fmt.Errorf("the condition on %q is empty", field)
+		}
+	}
+	return nil
+}
+
+// ListSavedFilters lists the saved filters of every detector in every
+// account and region in opts, using opts.Concurrency workers. Each region's
+// filters are in the order of their rank.
+func ListSavedFilters(ctx context.Context, opts FetchOptions) SavedFilterInventory {
+	targets := exportTargets(ctx, opts)
+	inventory := SavedFilterInventory{Filters: []SavedFilter{}, Regions: make([]RegionFilters, len(targets))}
+	filters := make([][]SavedFilter, len(targets))
+	eachTarget(targets, opts.Concurrency, func(i int) {
+		inventory.Regions[i], filters[i] = regionFilters(ctx, opts, targets[i])
+	})
+	for _, list := range filters {
+		inventory.Filters = append(inventory.Filters, list...)
+	}
+	return inventory
+}
+
+// regionFilters lists the saved filters of one target
+func regionFilters(ctx context.Context, opts FetchOptions, target exportTarget) (RegionFilters, []SavedFilter) {
+	account, region := target.account.accountID, target.region
+	result := RegionFilters{Account: account, Region: region}
+	if target.disabled {
+		result.Skipped = "region is not enabled for this account"
+		return result, nil
+	}
+	log := telemetry.Logger(ctx).With("region", target.label())
+
+	client := target.client()
+	var filters []SavedFilter
+	err := func() error {
+		listCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error listing detectors in region %s: %v", region, err)
+		}
+		if len(detectors.DetectorIds) == 0 {
+			return errGuardDutyNotEnabled
+		}
+		for _, detectorID := range detectors.DetectorIds {
+			paginator := guardduty.NewListFiltersPaginator(client, &guardduty.ListFiltersInput{DetectorId: aws.String(detectorID)})
+			for paginator.HasMorePages() {
+				pageCtx, cancel := callContext(ctx, opts.CallTimeout)
+				output, err := paginator.NextPage(pageCtx)
+				cancel()
+				if err != nil {
+					return fmt.Errorf("error listing filters for detector %s: %v", detectorID, err)
+				}
+				for _, name := range output.FilterNames {
+					filter, err := getSavedFilter(ctx, client, detectorID, name, opts)
+					if err != nil {
+						return err
+					}
+					filter.Account, filter.Region = account, region
+					filters = append(filters, filter)
+				}
+			}
+		}
+		return nil
+	}()
+	sort.SliceStable(filters, func(i, j int) bool { return filters[i].Rank < filters[j].Rank })
+	result.Filters = len(filters)
+	switch {
+	case errors.Is(err, errGuardDutyNotEnabled):
+		result.Skipped = err.Error()
+	case err != nil:
+		if account != "" {
+			err = fmt.Errorf("account %s: %v", account, err)
+		}
+		log.Error("Error listing filters", "error", err)
+		result.Error = err.Error()
+	}
+	return result, filters
+}
+
+// getSavedFilter describes one filter of a detector
+func getSavedFilter(ctx context.Context, client FiltersAPI, detectorID, name string, opts FetchOptions) (SavedFilter, error) {
+	getCtx, cancel := callContext(ctx, opts.CallTimeout)
+	output, err := client.GetFilter(getCtx, &guardduty.GetFilterInput{DetectorId: aws.String(detectorID), FilterName: aws.String(name)})
+	cancel()
+	if err != nil {
+		return SavedFilter{}, fmt.Errorf("error getting filter %s: %v", name, err)
+	}
+	filter := SavedFilter{
+		DetectorID:  detectorID,
+		Name:        aws.ToString(output.Name),
+		Description: aws.ToString(output.Description),
+		Action:      string(output.Action),
+		Rank:        aws.ToInt32(output.Rank),
+		Criteria:    map[string]FilterCondition{},
+		Tags:        output.Tags,
+	}
+	if output.FindingCriteria != nil {
+		for field, c := range output.FindingCriteria.Criterion {
+			filter.Criteria[field] = filterCondition(c)
+		}
+	}
+	return filter, nil
+}
+
+// filterCondition converts a GuardDuty condition, falling back to the
+// deprecated operators that older filters may only have set
+func filterCondition(c types.Condition) FilterCondition {
+	wide := func(n *int32) *int64 {
+		if n == nil {
+			return nil
+		}
+		return aws.Int64(int64(*n))
+	}
+	condition := FilterCondition{
+		Equals:             c.Equals,
+		NotEquals:          c.NotEquals,
+		GreaterThan:        c.GreaterThan,
+		GreaterThanOrEqual: c.GreaterThanOrEqual,
+		LessThan:           c.LessThan,
+		LessThanOrEqual:    c.LessThanOrEqual,
+	}
+	if condition.Equals == nil {
+		condition.Equals = c.Eq
+	}
+	if condition.NotEquals == nil {
+		condition.NotEquals = c.Neq
+	}
+	if condition.GreaterThan == nil {
+		condition.GreaterThan = wide(c.Gt)
+	}
+	if condition.GreaterThanOrEqual == nil {
+		condition.GreaterThanOrEqual = wide(c.Gte)
+	}
+	if condition.LessThan == nil {
+		condition.LessThan = wide(c.Lt)
+	}
+	if condition.LessThanOrEqual == nil {
+		condition.LessThanOrEqual = wide(c.Lte)
+	}
+	return condition
+}
+
+// findingCriteria converts the criteria of a saved filter for GuardDuty
+func (f SavedFilter) findingCriteria() *types.FindingCriteria {
+	criterion := make(map[string]types.Condition, len(f.Criteria))
+	for field, c := range f.Criteria {
+		criterion[field] = types.Condition{
+			Equals:             c.Equals,
+			NotEquals:          c.NotEquals,
+			GreaterThan:        c.GreaterThan,
+			GreaterThanOrEqual: c.GreaterThanOrEqual,
+			LessThan:           c.LessThan,
+			LessThanOrEqual:    c.LessThanOrEqual,
+		}
+	}
+	return &types.FindingCriteria{Criterion: criterion}
+}
+
+// CreateSavedFilter saves a new filter on the detector of the one account
+// and region of opts, and returns it as GuardDuty stored it
+func CreateSavedFilter(ctx context.Context, opts FetchOptions, filter SavedFilter) (SavedFilter, error) {
+	client, detectorID, err := targetDetector(ctx, opts)
+	if err != nil {
+		return SavedFilter{}, err
+	}
+	input := &guardduty.CreateFilterInput{
+		DetectorId:      aws.String(detectorID),
+		Name:            aws.String(filter.Name),
+		Action:          types.FilterAction(filter.Action),
+		FindingCriteria: filter.findingCriteria(),
+	}
+	if filter.Description != "" {
+		input.Description = aws.String(filter.Description)
+	}
+	if filter.Rank > 0 {
+		input.Rank = aws.Int32(filter.Rank)
+	}
+	if len(filter.Tags) > 0 {
+		input.Tags = filter.Tags
+	}
+	createCtx, cancel := callContext(ctx, opts.CallTimeout)
+	_, err = client.CreateFilter(createCtx, input)
+	cancel()
+	if err != nil {
+		return SavedFilter{}, callError(err, "error creating filter %s", filter.Name)
+	}
+	return getChangedFilter(ctx, client, detectorID, filter.Name, opts)
+}
+
+// UpdateSavedFilter replaces the description, action, rank, and criteria
+// of a filter of the one account and region of opts. Its tags are kept.
+func UpdateSavedFilter(ctx context.Context, opts FetchOptions, filter SavedFilter) (SavedFilter, error) {
+	client, detectorID, err := targetDetector(ctx, opts)
+	if err != nil {
+		return SavedFilter{}, err
+	}
+	input := &guardduty.UpdateFilterInput{
+		DetectorId:      aws.String(detectorID),
+		FilterName:      aws.String(filter.Name),
+		Action:          types.FilterAction(filter.Action),
+		Description:     aws.String(filter.Description),
+		FindingCriteria: filter.findingCriteria(),
+	}
+	if filter.Rank > 0 {
+		input.Rank = aws.Int32(filter.Rank)
+	}
+	updateCtx, cancel := callContext(ctx, opts.CallTimeout)
+	_, err = client.UpdateFilter(updateCtx, input)
+	cancel()
+	if err != nil {
+		return SavedFilter{}, callError(err, "error updating filter %s", filter.Name)
+	}
+	return getChangedFilter(ctx, client, detectorID, filter.Name, opts)
+}
+
+// getChangedFilter describes a filter just created or updated in the one
+// account and region of opts
+func getChangedFilter(ctx context.Context, client FiltersAPI, detectorID, name string, opts FetchOptions) (SavedFilter, error) {
+	filter, err := getSavedFilter(ctx, client, detectorID, name, opts)
+	filter.Account, filter.Region = accountConfigs(opts)[0].accountID, opts.Regions[0]
+	return filter, err
+}
+
+// DeleteSavedFilter deletes a filter of the one account and region of opts
+func DeleteSavedFilter(ctx context.Context, opts FetchOptions, name string) error {
+	client, detectorID, err := targetDetector(ctx, opts)
+	if err != nil {
+		return err
+	}
+	deleteCtx, cancel := callContext(ctx, opts.CallTimeout)
+	_, err = client.DeleteFilter(deleteCtx, &guardduty.DeleteFilterInput{DetectorId: aws.String(detectorID), FilterName: aws.String(name)})
+	cancel()
+	if err != nil {
+		return callError(err, "error deleting filter %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package gd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/telemetry"
+)
+
+// SecurityHubColumns are the columns for the triage state Security Hub
+// tracks for a finding: the workflow status of its ASFF record and the note
+// on it, with who last updated the note
+var SecurityHubColumns = []string{"WorkflowStatus", "WorkflowNote", "WorkflowNoteUpdatedBy"}
+
+// The defaults of a WorkflowCache: how long looked-up records are reused and
+// the number of GetFindings calls in flight at once
+const (
+	DefaultWorkflowCacheTTL    = 5 * time.Minute
+	DefaultWorkflowConcurrency = 4
+	maxWorkflowCacheEntries    = 100000
+	maxSecurityHubIDFilter     = 20
+	maxSecurityHubResponse     = 16 << 20
+)
+
+// WorkflowCache looks up the Security Hub record of each finding, whose ID
+// is the finding's ARN, for its workflow status and note, and keeps them for
+// a while. It is shared by the exports of a server and safe for concurrent
+// use.
+type WorkflowCache struct {
+	ttl       time.Duration
+	sem       chan struct{}
+	mu        sync.Mutex
+	workflows map[string]cachedWorkflow
+}
+
+// cachedWorkflow is the triage state of a finding until expires; a finding
+// without a Security Hub record has none
+type cachedWorkflow struct {
+	status    string
+	note      string
+	updatedBy string
+	expires   time.Time
+}
+
+// NewWorkflowCache returns a WorkflowCache keeping records for ttl with at
+// most concurrency GetFindings calls in flight
+func NewWorkflowCache(ttl time.Duration, concurrency int) *WorkflowCache {
+	if ttl <= 0 {
+		ttl = DefaultWorkflowCacheTTL
+	}
+	if concurrency < 1 {
+		concurrency = DefaultWorkflowConcurrency
+	}
+	return &WorkflowCache{ttl: ttl, sem: make(chan struct{}, concurrency), workflows: make(map[string]cachedWorkflow)}
+}
+
+// Status returns the workflow status of a finding's Security Hub record,
+// such as NEW, NOTIFIED, RESOLVED, or SUPPRESSED, or nothing when it has no
+// record or it wasn't looked up
+func (c *WorkflowCache) Status(finding types.Finding) string {
+	return c.column(finding, func(w cachedWorkflow) string { return w.status })
+}
+
+// Note returns the text of the note on a finding's Security Hub record
+func (c *WorkflowCache) Note(finding types.Finding) string {
+	return c.column(finding, func(w cachedWorkflow) string { return w.note })
+}
+
+// NoteUpdatedBy returns who last updated the note on a finding's Security
+// Hub record
+func (c *WorkflowCache) NoteUpdatedBy(finding types.Finding) string {
+	return c.column(finding, func(w cachedWorkflow) string { return w.updatedBy })
+}
+
+// column returns a value of the record of a finding. Records are read
+// whether or not they have expired since the finding was fetched, so a long
+// export keeps the values it looked up.
+func (c *WorkflowCache) column(finding types.Finding, value func(cachedWorkflow) string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if w, ok := c.workflows[aws.ToString(finding.Arn)]; ok {
+		return value(w)
+	}
+	return ""
+}
+
+// workflowFindings looks up the Security Hub records of a page of findings
+// fetched from target, with the target's credentials in its region. A
+// Security Hub administrator sees the records of its member accounts, so
+// the findings of other accounts are looked up too. A failed lookup is
+// logged and leaves the findings without a workflow status.
+func (c *WorkflowCache) workflowFindings(ctx context.Context, target exportTarget, findings []types.Finding, callTimeout time.Duration) {
+	now := time.Now()
+	var missing []string
+	wanted := make(map[string]bool)
+	for _, finding := range findings {
+		id := aws.ToString(finding.Arn)
+		if id == "" || c.cached(id, now) || wanted[id] {
+			continue
+		}
+		wanted[id] = true
+		missing = append(missing, id)
+	}
+	if len(missing) == 0 {
+		return
+	}
+	if err := c.lookup(ctx, target.config(), missing, callTimeout); err != nil {
+		telemetry.Logger(ctx).Warn("Error looking up Security Hub findings", "findings", len(missing), "error", err)
+	}
+}
+
+// cached reports whether the record of a finding is cached and unexpired
+func (c *WorkflowCache) cached(id string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.workflows[id]
+	return ok && !now.After(entry.expires)
+}
+
+// securityHubFinding is the part of an ASFF record that the columns read
+type securityHubFinding struct {
+	ID       string `json:"Id"`
+	Workflow *struct {
+		Status string `json:"Status"`
+	} `json:"Workflow"`
+	Note *struct {
+		Text      string `json:"Text"`
+		UpdatedBy string `json:"UpdatedBy"`
+	} `json:"Note"`
+}
+
+// lookup fetches the records of findings 20 IDs at a time. Findings
+// Security Hub doesn't return, such as those of a region it isn't enabled
+// in, are cached without a record.
+func (c *WorkflowCache) lookup(ctx context.Context, cfg aws.Config, ids []string, callTimeout time.Duration) error {
+	for start := 0; start < len(ids); start += maxSecurityHubIDFilter {
+		batch := ids[start:min(start+maxSecurityHubIDFilter, len(ids))]
+		filter := make([]map[string]string, len(batch))
+		for i, id := range batch {
+			filter[i] = map[string]string{"Value": id, "Comparison": "EQUALS"}
+		}
+		workflows := make(map[string]cachedWorkflow, len(batch))
+		for _, id := range batch {
+			workflows[id] = cachedWorkflow{}
+		}
+		input := map[string]any{"Filters": map[string]any{"Id": filter}, "MaxResults": 100}
+		for {
+			var page struct {
+				Findings  []securityHubFinding `json:"Findings"`
+				NextToken string               `json:"NextToken"`
+			}
+			err := c.call(ctx, callTimeout, func(ctx context.Context) error {
+				return securityHubRequest(ctx, cfg, "/findings", input, &page)
+			})
+			if err != nil {
+				return fmt.Errorf("error getting Security Hub findings in region %s: %v", cfg.Region, err)
+			}
+			for _, record := range page.Findings {
+				var w cachedWorkflow
+				if record.Workflow != nil {
+					w.status = record.Workflow.Status
+				}
+				if record.Note != nil {
+					w.note, w.updatedBy = record.Note.Text, record.Note.UpdatedBy
+				}
+				workflows[record.ID] = w
+			}
+			if page.NextToken == "" {
+				break
+			}
+			input["NextToken"] = page.NextToken
+		}
+		c.store(workflows)
+	}
+	return nil
+}
+
+// call makes one GetFindings call once fewer than the cache's concurrency
+// are in flight
+func (c *WorkflowCache) call(ctx context.Context, callTimeout time.Duration, fn func(ctx context.Context) error) error {
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-c.sem }()
+	callCtx, cancel := callContext(ctx, callTimeout)
+	defer cancel()
+	return fn(callCtx)
+}
+
+// store caches the records of findings, dropping expired entries once the
+// cache is full
+func (c *WorkflowCache) store(workflows map[string]cachedWorkflow) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.workflows)+len(workflows) > maxWorkflowCacheEntries {
+		for id, entry := range c.workflows {
+			if now.After(entry.expires) {
+				delete(c.workflows, id)
+			}
+		}
+		if len(c.workflows)+len(workflows) > maxWorkflowCacheEntries {
+			c.workflows = make(map[string]cachedWorkflow)
+		}
+	}
+	expires := now.Add(c.ttl)
+	for id, w := range workflows {
+		w.expires = expires
+		c.workflows[id] = w
+	}
+}
+
+// securityHubRequest calls the Security Hub REST API at path with input,
+// signed with the credentials of cfg, and decodes its response into out.
+// There is no Security Hub client among the SDK modules the exporter uses,
+// so the endpoint is resolved as the SDK would: from the securityhub
+// service endpoint, the base endpoint, or the region, with FIPS if enabled.
+func securityHubRequest(ctx context.Context, cfg aws.Config, path string, input, out any) error {
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, securityHubEndpoint(ctx, cfg)+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(payload)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), "securityhub", cfg.Region, time.Now()); err != nil {
+		return err
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxSecurityHubResponse))
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Code    string `json:"Code"`
+			Message string `json:"Message"`
+		}
+		message := strings.TrimSpace(string(body))
+		if json.Unmarshal(body, &failure) == nil && failure.Message != "" {
+			message = failure.Message
+			if failure.Code != "" {
+				message = failure.Code + ": " + message
+			}
+		}
+		return fmt.Errorf("%s: %s", resp.Status, message)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("unexpected response %q", body)
+	}
+	return nil
+}
+
+// securityHubEndpoint returns the base URL of the Security Hub API for cfg
+func securityHubEndpoint(ctx context.Context, cfg aws.Config) string {
+	for _, source := range cfg.ConfigSources {
+		if s, ok := source.(interface {
+			GetServiceBaseEndpoint(ctx context.Context, sdkID string) (string, bool, error)
+		}); ok {
+			if endpoint, found, err := s.GetServiceBaseEndpoint(ctx, "SecurityHub"); err == nil && found {
+				return strings.TrimSuffix(endpoint, "/")
+			}
+		}
+	}
+	if cfg.BaseEndpoint != nil {
+		return strings.TrimSuffix(*cfg.BaseEndpoint, "/")
+	}
+	host := "securityhub"
+	for _, source := range cfg.ConfigSources {
+		if s, ok := source.(interface {
+			GetUseFIPSEndpoint(ctx context.Context) (aws.FIPSEndpointState, bool, error)
+		}); ok {
+			if state, found, err := s.GetUseFIPSEndpoint(ctx); err == nil && found {
+				if state == aws.FIPSEndpointStateEnabled {
+					host = "securityhub-fips"
+				}
+				break
+			}
+		}
+	}
+	suffix := "amazonaws.com"
+	if strings.HasPrefix(cfg.Region, "cn-") {
+		suffix = "amazonaws.com.cn"
+	}
+	return fmt.Sprintf("https://%s.%s.%s", host, cfg.Region, suffix)
+}
@@ -0,0 +1,268 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/telemetry"
+)
+
+// maxStatisticsTypes is the most finding types GetFindingsStatistics
+// returns for a detector
+const maxStatisticsTypes = 100
+
+// TopResourcesN is the number of most affected resources statistics and
+// aggregates list
+const TopResourcesN = 10
+
+// Statistics counts the findings an export with the same options would
+// fetch, from GetFindingsStatistics instead of listing the findings
+type Statistics struct {
+	Findings int `json:"findings"`
+	// BySeverity counts the findings by console label: Low, Medium, High,
+	// and Critical
+	BySeverity map[string]int `json:"bySeverity"`
+	// ByType counts the findings of each finding type, most common first
+	ByType []TypeCount `json:"byType"`
+	// TopResources are the affected resources with the most findings, from
+	// the TopResourcesN most affected of each detector
+	TopResources []ResourceCount `json:"topResources"`
+	// Approximate is set when the filter has parts GuardDuty cannot
+	// evaluate, a fractional minimum severity or a finding type prefix, so
+	// the export may hold fewer findings than counted
+	Approximate bool               `json:"approximate,omitempty"`
+	Regions     []RegionStatistics `json:"regions"`
+}
+
+// RegionStatistics counts the findings of one account and region. A region
+// without GuardDuty is skipped, and one that could not be queried reports
+// its error without failing the others.
+type RegionStatistics struct {
+	Account    string         `json:"account,omitempty"`
+	Region     string         `json:"region"`
+	Findings   int            `json:"findings"`
+	BySeverity map[string]int `json:"bySeverity"`
+	ByType     []TypeCount    `json:"byType"`
+	Skipped    string         `json:"skipped,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	// resources counts the findings of the region's most affected
+	// resources, by ResourceName
+	resources map[string]int
+}
+
+// TypeCount is the number of findings of one finding type
+type TypeCount struct {
+	Type     string `json:"type"`
+	Findings int    `json:"findings"`
+}
+
+// ResourceCount is the number of findings of one affected resource, named
+// by ResourceName
+type ResourceCount struct {
+	Resource string `json:"resource"`
+	Findings int    `json:"findings"`
+}
+
+// ResourceName names an affected resource by its type and ID, such as
+// "Instance i-0abc", or returns the type alone when it has no ID
+func ResourceName(resourceType, resourceID string) string {
+	return strings.TrimSpace(resourceType + " " + resourceID)
+}
+
+// SeverityLabels are the console's severity bands, most severe first
+var SeverityLabels = []string{"Critical", "High", "Medium", "Low"}
+
+// SeverityLabel maps a GuardDuty severity score to its console label
+func SeverityLabel(severity float64) string {
+	switch {
+	case severity >= 9:
+		return "Critical"
+	case severity >= 7:
+		return "High"
+	case severity >= 4:
+		return "Medium"
+	default:
+		return "Low"
+	}
+}
+
+// FindingStatistics counts the findings matching opts.Filter in every
+// account and region in opts, using opts.Concurrency workers. Each detector
+// is asked for its counts by severity and by finding type; the types of a
+// detector are limited to its maxStatisticsTypes most common.
+func FindingStatistics(ctx context.Context, opts FetchOptions) Statistics {
+	targets := exportTargets(ctx, opts)
+	stats := Statistics{
+		BySeverity:  make(map[string]int),
+		ByType:      []TypeCount{},
+		Approximate: opts.Filter.MinSeverity != math.Floor(opts.Filter.MinSeverity) || opts.Filter.hasTypePrefix() || opts.Filter.HasTaxonomy(),
+		Regions:     make([]RegionStatistics, len(targets)),
+	}
+
+	eachTarget(targets, opts.Concurrency, func(i int) {
+		stats.Regions[i] = regionStatistics(ctx, opts, targets[i])
+	})
+
+	typeCounts, resourceCounts := make(map[string]int), make(map[string]int)
+	for _, region := range stats.Regions {
+		stats.Findings += region.Findings
+		for label, count := range region.BySeverity {
+			stats.BySeverity[label] += count
+		}
+		for _, t := range region.ByType {
+			typeCounts[t.Type] += t.Findings
+		}
+		for resource, count := range region.resources {
+			resourceCounts[resource] += count
+		}
+	}
+	stats.ByType = sortedTypeCounts(typeCounts)
+	stats.TopResources = TopResources(resourceCounts, TopResourcesN)
+	return stats
+}
+
+// regionStatistics counts the findings of one target
+func regionStatistics(ctx context.Context, opts FetchOptions, target exportTarget) RegionStatistics {
+	account, region := target.account.accountID, target.region
+	stats := RegionStatistics{Account: account, Region: region, BySeverity: make(map[string]int), ByType: []TypeCount{}, resources: make(map[string]int)}
+	log := telemetry.Logger(ctx).With("region", target.label())
+	if target.disabled {
+		stats.Skipped = "region is not enabled for this account"
+		return stats
+	}
+
+	client := target.client()
+	err := func() error {
+		listCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error listing detectors in region %s: %v", region, err)
+		}
+		detectorIDs, err := opts.selectDetectors(detectors.DetectorIds)
+		if err != nil {
+			return err
+		}
+
+		criteria := opts.Filter.criteria()
+		typeCounts := make(map[string]int)
+		for _, detectorID := range detectorIDs {
+			bySeverity, err := detectorStatistics(ctx, client, detectorID, criteria, opts, typeCounts, stats.resources)
+			if err != nil {
+				return err
+			}
+			for _, s := range bySeverity {
+				// The criteria only hold the whole part of the threshold
+				if aws.ToFloat64(s.Severity) < opts.Filter.MinSeverity {
+					continue
+				}
+				count := int(aws.ToInt32(s.TotalFindings))
+				stats.Findings += count
+				stats.BySeverity[SeverityLabel(aws.ToFloat64(s.Severity))] += count
+			}
+		}
+		stats.ByType = sortedTypeCounts(typeCounts)
+		return nil
+	}()
+	switch {
+	case errors.Is(err, errGuardDutyNotEnabled), errors.Is(err, errNoSelectedDetector):
+		stats.Skipped = err.Error()
+	case err != nil:
+		if account != "" {
+			err = fmt.Errorf("account %s: %v", account, err)
+		}
+		log.Error("Error getting findings statistics", "error", err)
+		stats.Error = err.Error()
+	}
+	return stats
+}
+
+// detectorStatistics returns the counts of one detector by severity, adds
+// its counts by finding type to counts, and those of its TopResourcesN most
+// affected resources to resources. Only the types that match the filter are
+// added, as GuardDuty cannot filter on type prefixes.
+func detectorStatistics(ctx context.Context, client StatisticsAPI, detectorID string, criteria *types.FindingCriteria, opts FetchOptions, counts, resources map[string]int) ([]types.SeverityStatistics, error) {
+	callCtx, cancel := callContext(ctx, opts.CallTimeout)
+	bySeverity, err := client.GetFindingsStatistics(callCtx, &guardduty.GetFindingsStatisticsInput{
+		DetectorId:      aws.String(detectorID),
+		FindingCriteria: criteria,
+		GroupBy:         types.GroupByTypeSeverity,
+	})
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("error getting findings statistics for detector %s: %v", detectorID, err)
+	}
+
+	callCtx, cancel = callContext(ctx, opts.CallTimeout)
+	byType, err := client.GetFindingsStatistics(callCtx, &guardduty.GetFindingsStatisticsInput{
+		DetectorId:      aws.String(detectorID),
+		FindingCriteria: criteria,
+		GroupBy:         types.GroupByTypeFindingType,
+		MaxResults:      aws.Int32(maxStatisticsTypes),
+	})
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("error getting findings statistics for detector %s: %v", detectorID, err)
+	}
+	for _, t := range byType.FindingStatistics.GroupedByFindingType {
+		findingType := aws.ToString(t.FindingType)
+		if opts.Filter.matchesType(findingType) {
+			counts[findingType] += int(aws.ToInt32(t.TotalFindings))
+		}
+	}
+
+	callCtx, cancel = callContext(ctx, opts.CallTimeout)
+	byResource, err := client.GetFindingsStatistics(callCtx, &guardduty.GetFindingsStatisticsInput{
+		DetectorId:      aws.String(detectorID),
+		FindingCriteria: criteria,
+		GroupBy:         types.GroupByTypeResource,
+		MaxResults:      aws.Int32(TopResourcesN),
+	})
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("error getting findings statistics for detector %s: %v", detectorID, err)
+	}
+	for _, r := range byResource.FindingStatistics.GroupedByResource {
+		resources[ResourceName(aws.ToString(r.ResourceType), aws.ToString(r.ResourceId))] += int(aws.ToInt32(r.TotalFindings))
+	}
+	return bySeverity.FindingStatistics.GroupedBySeverity, nil
+}
+
+// sortedTypeCounts lists counts by finding type, most common first
+func sortedTypeCounts(counts map[string]int) []TypeCount {
+	list := make([]TypeCount, 0, len(counts))
+	for findingType, count := range counts {
+		list = append(list, TypeCount{Type: findingType, Findings: count})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Findings != list[j].Findings {
+			return list[i].Findings > list[j].Findings
+		}
+		return list[i].Type < list[j].Type
+	})
+	return list
+}
+
+// TopResources returns the n resources of counts with the most findings,
+// most first and then by name
+func TopResources(counts map[string]int, n int) []ResourceCount {
+	list := make([]ResourceCount, 0, len(counts))
+	for resource, count := range counts {
+		list = append(list, ResourceCount{Resource: resource, Findings: count})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Findings != list[j].Findings {
+			return list[i].Findings > list[j].Findings
+		}
+		return list[i].Resource < list[j].Resource
+	})
+	return list[:min(n, len(list))]
+}
@@ -0,0 +1,318 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// regionBuffer is the number of findings a region fetches ahead of the
+// writer, two pages of ListFindings, so memory use depends on the
+// concurrency rather than on the number of findings
+const regionBuffer = 2 * MaxGetFindingsBatch
+
+// RegionStream is one account and region of a streamed export
+type RegionStream struct {
+	Account string
+	Region  string
+	// Findings delivers the region's findings in export order and is closed
+	// once the region is done
+	Findings <-chan types.Finding
+
+	findings chan types.Finding
+	done     chan struct{}
+	result   RegionResult
+	// cut and delivered are set when the export's limits hand the region
+	// to the reader, once Findings is closed
+	cut       bool
+	delivered int
+	// duplicates counts the findings a deduper left out, by severity too,
+	// and deduped is closed once it has read the region
+	duplicates          int
+	duplicateSeverities map[string]int
+	deduped             chan struct{}
+}
+
+func newRegionStream(account, region string) *RegionStream {
+	findings := make(chan types.Finding, regionBuffer)
+	return &RegionStream{Account: account, Region: region, Findings: findings, findings: findings, done: make(chan struct{})}
+}
+
+// send passes findings to the reader, waiting while its buffer is full
+func (r *RegionStream) send(ctx context.Context, findings []types.Finding) error {
+	for _, finding := range findings {
+		select {
+		case r.findings <- finding:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (r *RegionStream) finish(result RegionResult) {
+	r.result = result
+	close(r.findings)
+	close(r.done)
+}
+
+// Result returns the outcome of the region once Findings has been read to
+// the end. Its Findings is empty, since they were delivered on the stream.
+func (r *RegionStream) Result() RegionResult {
+	<-r.done
+	if r.deduped != nil {
+		<-r.deduped
+	}
+	result := r.result
+	if r.duplicates > 0 {
+		result = dedupedResult(result, r.duplicates, r.duplicateSeverities)
+	}
+	if r.cut {
+		return truncatedResult(result, r.delivered)
+	}
+	return result
+}
+
+// Stream delivers the findings of an export region by region as they are
+// fetched, instead of collecting every finding before anything is written.
+// Regions are read in account and region order with Next.
+type Stream struct {
+	regions []*RegionStream
+	next    int
+	results []RegionResult
+	failure atomic.Pointer[RegionResult]
+	cancel  context.CancelFunc
+	started time.Time
+
+	// The export's limits: stopped is closed when one of them truncates
+	// the export, and delivered counts the findings handed to the reader
+	ctx         context.Context
+	progress    ProgressFunc
+	maxFindings int
+	maxDuration time.Duration
+	timer       *time.Timer
+	delivered   int
+	stopped     chan struct{}
+	mu          sync.Mutex
+	truncation  *Truncation
+	complete    bool
+	// dedupe leaves out duplicate findings when the export collapses them
+	dedupe *deduper
+}
+
+// StreamRegions starts fetching findings for every account and region in
+// opts using a pool of opts.Concurrency workers. Each worker fetches at most
+// regionBuffer findings ahead of the reader, so a slow writer holds back the
+// fetch instead of the findings piling up. Unless errors are being reported,
+// the first failure cancels the remaining fetches and ends the stream.
+// With opts.Dedupe set, the findings already read are left out of the
+// regions that follow. Once opts.MaxFindings findings have been read or
+// opts.MaxDuration has passed, the export is truncated: the fetches are
+// canceled and the stream ends as though every region had been read.
+// Progress is reported to progress, which may be nil. The caller must Close
+// the stream.
+func StreamRegions(ctx context.Context, opts FetchOptions, progress ProgressFunc) *Stream {
+	ctx, cancel := context.WithCancel(ctx)
+	targets := exportTargets(ctx, opts)
+	s := &Stream{regions: make([]*RegionStream, len(targets)), cancel: cancel, started: time.Now()}
+	for i, target := range targets {
+		s.regions[i] = newRegionStream(target.account.accountID, target.region)
+	}
+	if opts.Dedupe.Key != "" {
+		s.dedupe = newDeduper(ctx, opts.Dedupe, targets)
+	}
+	if opts.limited() {
+		s.ctx, s.progress = ctx, progress
+		s.maxFindings, s.maxDuration = opts.MaxFindings, opts.MaxDuration
+		s.stopped = make(chan struct{})
+		progress = s.limitProgress(progress)
+		if opts.MaxDuration > 0 {
+			s.timer = time.AfterFunc(opts.MaxDuration, func() { s.truncate(TruncatedMaxDuration) })
+		}
+	}
+
+	// Targets are handed out in order, so the region being read is always
+	// one a worker has started
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(opts.Concurrency, len(targets)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				target, region := targets[i], s.regions[i]
+				if err := ctx.Err(); err != nil {
+					region.finish(RegionResult{Account: target.account.accountID, Region: target.region, Err: err})
+					continue
+				}
+				if target.disabled {
+					region.finish(skipRegion(ctx, target, "region is not enabled for this account", progress))
+					continue
+				}
+				result := fetchRegion(ctx, opts, target, region.send, progress)
+				if result.Err != nil && !opts.ReportErrors && !s.truncated() && s.failure.CompareAndSwap(nil, &result) {
+					cancel()
+				}
+				region.finish(result)
+			}
+		}()
+	}
+	go func() {
+		for i := range targets {
+			indexes <- i
+		}
+		close(indexes)
+		wg.Wait()
+	}()
+	return s
+}
+
+// StreamResults returns a stream of results that were already collected,
+// delivering the findings of each
+func StreamResults(results []RegionResult) *Stream {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Stream{regions: make([]*RegionStream, len(results)), cancel: cancel, started: time.Now()}
+	for i, result := range results {
+		s.regions[i] = newRegionStream(result.Account, result.Region)
+	}
+	go func() {
+		for i, result := range results {
+			s.regions[i].send(ctx, result.Findings)
+			result.Findings = nil
+			s.regions[i].finish(result)
+		}
+	}()
+	return s
+}
+
+// Next returns the next account and region, discarding any findings of the
+// previous one that were not read. It returns false once every region has
+// been read, when a region failed and errors are not being reported, or
+// when the export was truncated.
+func (s *Stream) Next() (*RegionStream, bool) {
+	if s.next > 0 {
+		previous := s.regions[s.next-1]
+		for range previous.Findings {
+		}
+		s.results = append(s.results, previous.Result())
+	}
+	if s.next == len(s.regions) {
+		s.mu.Lock()
+		s.complete = true
+		s.mu.Unlock()
+		return nil, false
+	}
+	if s.failure.Load() != nil || s.truncated() {
+		return nil, false
+	}
+	s.next++
+	region := s.regions[s.next-1]
+	if s.dedupe != nil {
+		s.dedupe.filter(region)
+	}
+	if s.stopped != nil {
+		s.limit(region)
+	}
+	return region, true
+}
+
+// Collect reads the rest of the stream, keeping the findings of each region
+// in its result
+func (s *Stream) Collect() []RegionResult {
+	var results []RegionResult
+	for region, ok := s.Next(); ok; region, ok = s.Next() {
+		var findings []types.Finding
+		for finding := range region.Findings {
+			findings = append(findings, finding)
+		}
+		result := region.Result()
+		result.Findings = findings
+		results = append(results, result)
+	}
+	return results
+}
+
+// Results returns the outcome of each region read so far, without its
+// findings
+func (s *Stream) Results() []RegionResult {
+	return s.results
+}
+
+// Failed returns the region whose failure ended the stream, when errors are
+// not being reported
+func (s *Stream) Failed() (RegionResult, bool) {
+	if failure := s.failure.Load(); failure != nil {
+		return *failure, true
+	}
+	return RegionResult{}, false
+}
+
+// Close stops the fetches still in progress
+func (s *Stream) Close() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.cancel()
+}
+
+// errRegionTimeout cancels a region that used up its time limit
+var errRegionTimeout = errors.New("region timed out")
+
+// regionDeadline cancels a region once it has spent its time limit
+// fetching. The clock stops while the region waits for the writer, which
+// may still be busy with earlier regions.
+type regionDeadline struct {
+	timer     *time.Timer
+	remaining time.Duration
+	started   time.Time
+	paused    bool
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+}
+
+// withRegionTimeout returns a copy of ctx canceled once timeout has been
+// spent fetching; zero means no limit and a nil deadline
+func withRegionTimeout(ctx context.Context, timeout time.Duration) (context.Context, *regionDeadline) {
+	if timeout <= 0 {
+		return ctx, nil
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	d := &regionDeadline{remaining: timeout, started: time.Now(), ctx: ctx, cancel: cancel}
+	d.timer = time.AfterFunc(timeout, func() { cancel(errRegionTimeout) })
+	return ctx, d
+}
+
+func (d *regionDeadline) pause() {
+	if d == nil || d.paused {
+		return
+	}
+	if d.timer.Stop() {
+		d.remaining -= time.Since(d.started)
+		d.paused = true
+	}
+}
+
+func (d *regionDeadline) resume() {
+	if d == nil || !d.paused {
+		return
+	}
+	d.paused = false
+	d.started = time.Now()
+	d.timer.Reset(d.remaining)
+}
+
+// expired reports whether the region was canceled for running out of time
+func (d *regionDeadline) expired() bool {
+	return d != nil && errors.Is(context.Cause(d.ctx), errRegionTimeout)
+}
+
+func (d *regionDeadline) stop() {
+	if d != nil {
+		d.timer.Stop()
+		d.cancel(nil)
+	}
+}
@@ -0,0 +1,162 @@
+package gd
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/smithy-go/middleware"
+)
+
+// The statuses of an account and region in an export summary
+const (
+	RegionSucceeded = "succeeded"
+	RegionFailed    = "failed"
+	RegionSkipped   = "skipped"
+	RegionTruncated = "truncated"
+)
+
+// ExportSummary is the end-of-run report of an export: its findings by
+// severity, how long it took, the ListFindings pages it fetched and the AWS
+// API calls it made, the outcome of each account and region, and those
+// GuardDuty does not monitor
+type ExportSummary struct {
+	Findings        int            `json:"findings"`
+	BySeverity      map[string]int `json:"bySeverity"`
+	DurationSeconds float64        `json:"durationSeconds"`
+	Pages           int            `json:"pages"`
+	APICalls        int            `json:"apiCalls"`
+	// Errors counts the regions that failed, and Skipped those that were
+	// not queried
+	Errors     int `json:"errors"`
+	Skipped    int `json:"skipped"`
+	Duplicates int `json:"duplicates,omitempty"`
+	// Dropped counts the findings the rules left out, and Suppressed those
+	// the suppression file did
+	Dropped    int `json:"dropped,omitempty"`
+	Suppressed int `json:"suppressed,omitempty"`
+	// Regions are in account and region order
+	Regions []RegionOutcome `json:"regions"`
+	// CoverageGaps lists the accounts and regions GuardDuty does not
+	// monitor, in the same order
+	CoverageGaps []CoverageGap `json:"coverageGaps,omitempty"`
+}
+
+// RegionOutcome is the end-of-run report of one account and region.
+// Error is the error of a failed region or the reason a region was skipped.
+type RegionOutcome struct {
+	Target          string         `json:"target"`
+	Account         string         `json:"account,omitempty"`
+	Region          string         `json:"region"`
+	Status          string         `json:"status"`
+	Findings        int            `json:"findings"`
+	BySeverity      map[string]int `json:"bySeverity,omitempty"`
+	Pages           int            `json:"pages"`
+	APICalls        int            `json:"apiCalls"`
+	DurationSeconds float64        `json:"durationSeconds"`
+	Error           string         `json:"error,omitempty"`
+	// Detectors are the detectors the findings were fetched from
+	Detectors []DetectorSummary `json:"detectors,omitempty"`
+}
+
+// DetectorSummary describes a detector an export read, with its status and
+// creation and update times as GetDetector reported them
+type DetectorSummary struct {
+	DetectorID string `json:"detectorId"`
+	Status     string `json:"status,omitempty"`
+	CreatedAt  string `json:"createdAt,omitempty"`
+	UpdatedAt  string `json:"updatedAt,omitempty"`
+}
+
+// SummarizeExport returns the summary of an export with results that took
+// duration
+func SummarizeExport(results []RegionResult, duration time.Duration) ExportSummary {
+	summary := ExportSummary{
+		BySeverity:      make(map[string]int),
+		DurationSeconds: duration.Seconds(),
+		Regions:         make([]RegionOutcome, 0, len(results)),
+	}
+	for _, result := range results {
+		region := RegionOutcome{
+			Target:          TargetLabel(result.Account, result.Region),
+			Account:         result.Account,
+			Region:          result.Region,
+			Status:          RegionSucceeded,
+			Findings:        result.Count,
+			BySeverity:      result.BySeverity,
+			Pages:           result.Pages,
+			APICalls:        result.Calls,
+			DurationSeconds: result.Duration.Seconds(),
+			Detectors:       result.Detectors,
+		}
+		switch {
+		case result.Err != nil:
+			region.Status, region.Error = RegionFailed, result.Err.Error()
+			summary.Errors++
+		case result.Skipped != "":
+			region.Status, region.Error = RegionSkipped, result.Skipped
+			summary.Skipped++
+		case result.Truncated:
+			region.Status = RegionTruncated
+		}
+		summary.Findings += result.Count
+		for severity, n := range result.BySeverity {
+			summary.BySeverity[severity] += n
+		}
+		summary.Pages += result.Pages
+		summary.APICalls += result.Calls
+		summary.Duplicates += result.Duplicates
+		summary.Dropped += result.Dropped
+		summary.Suppressed += len(result.Suppressed)
+		summary.Regions = append(summary.Regions, region)
+		if result.Gap != nil {
+			summary.CoverageGaps = append(summary.CoverageGaps, *result.Gap)
+		}
+	}
+	return summary
+}
+
+// Summary returns the summary of the regions read from the stream so far,
+// timed from the start of the stream
+func (s *Stream) Summary() ExportSummary {
+	return SummarizeExport(s.results, time.Since(s.started))
+}
+
+// callCounts counts the API call attempts and ListFindings pages of one
+// account and region
+type callCounts struct {
+	calls atomic.Int64
+	pages atomic.Int64
+}
+
+type callCountsKey struct{}
+
+// withCallCounts returns a copy of ctx whose AWS API calls and pages are
+// counted in the returned counts
+func withCallCounts(ctx context.Context) (context.Context, *callCounts) {
+	counts := &callCounts{}
+	return context.WithValue(ctx, callCountsKey{}, counts), counts
+}
+
+// countPage counts a ListFindings page fetched with ctx
+func countPage(ctx context.Context) {
+	if counts, ok := ctx.Value(callCountsKey{}).(*callCounts); ok {
+		counts.pages.Add(1)
+	}
+}
+
+// CountCalls is an SDK middleware counting each attempt of an API call in
+// the counts of the context's account and region, for export summaries
+func CountCalls(stack *middleware.Stack) error {
+	// Presigned requests are not sent, so they have no retry loop
+	if _, ok := stack.Finalize.Get("Retry"); !ok {
+		return nil
+	}
+	return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("CountCalls",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			if counts, ok := ctx.Value(callCountsKey{}).(*callCounts); ok {
+				counts.calls.Add(1)
+			}
+			return next.HandleFinalize(ctx, in)
+		}), "Retry", middleware.After)
+}
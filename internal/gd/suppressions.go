@@ -0,0 +1,153 @@
+package gd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// Suppression leaves the findings it matches out of exports without
+// archiving them in GuardDuty, such as those of an accepted risk. Each
+// condition that is set must hold, and a list holds when the finding has one
+// of its values; a suppression needs at least one condition.
+type Suppression struct {
+	// IDs are finding IDs
+	IDs []string `yaml:"ids"`
+	// Types holds exact finding types or prefixes ending in "*"
+	Types []string `yaml:"types"`
+	// Resources holds the IDs or ARNs of affected resources, such as an
+	// instance ID, access key ID, user name, or bucket name, or prefixes
+	// ending in "*"
+	Resources []string `yaml:"resources"`
+	// Reason is recorded with each finding suppressed
+	Reason string `yaml:"reason"`
+	// Expires, when set, is when the suppression stops applying
+	Expires time.Time `yaml:"expires"`
+}
+
+// SuppressedFinding is a finding a suppression left out of an export, with
+// the reason of the suppression
+type SuppressedFinding struct {
+	Finding types.Finding
+	Reason  string
+}
+
+// SuppressionList applies the suppressions of a suppression file to the
+// findings of an export, the first that matches a finding suppressing it
+type SuppressionList struct {
+	suppressions []Suppression
+}
+
+// NewSuppressionList checks suppressions and returns the list applying the
+// ones that have not expired by now
+func NewSuppressionList(suppressions []Suppression, now time.Time) (*SuppressionList, error) {
+	list := &SuppressionList{}
+	for i, s := range suppressions {
+		if len(s.IDs) == 0 && len(s.Types) == 0 && len(s.Resources) == 0 {
+			return nil, fmt.Errorf("invalid suppressions[%d]: must set ids, types, or resources", i)
+		}
+		if s.Expires.IsZero() || now.Before(s.Expires) {
+			list.suppressions = append(list.suppressions, s)
+		}
+	}
+	return list, nil
+}
+
+// Len returns the number of suppressions that apply
+func (l *SuppressionList) Len() int {
+	return len(l.suppressions)
+}
+
+// apply returns the findings of a page that no suppression matches, adding
+// the others to result's Suppressed
+func (l *SuppressionList) apply(findings []types.Finding, result *RegionResult) []types.Finding {
+	kept := make([]types.Finding, 0, len(findings))
+	for _, finding := range findings {
+		suppression, ok := l.match(finding)
+		if !ok {
+			kept = append(kept, finding)
+			continue
+		}
+		result.Suppressed = append(result.Suppressed, SuppressedFinding{Finding: finding, Reason: suppression.Reason})
+	}
+	return kept
+}
+
+// match returns the first suppression that matches a finding
+func (l *SuppressionList) match(finding types.Finding) (Suppression, bool) {
+	for _, s := range l.suppressions {
+		if s.matches(finding) {
+			return s, true
+		}
+	}
+	return Suppression{}, false
+}
+
+// matches reports whether a finding meets every condition of the
+// suppression
+func (s Suppression) matches(finding types.Finding) bool {
+	if len(s.IDs) > 0 && !slices.Contains(s.IDs, aws.ToString(finding.Id)) {
+		return false
+	}
+	if !(Filter{FindingTypes: s.Types}).matchesTypePattern(aws.ToString(finding.Type)) {
+		return false
+	}
+	if len(s.Resources) > 0 && !slices.ContainsFunc(resourceIdentifiers(finding), func(id string) bool {
+		return slices.ContainsFunc(s.Resources, func(pattern string) bool { return matchesPattern(pattern, id) })
+	}) {
+		return false
+	}
+	return true
+}
+
+// matchesPattern reports whether v is pattern, or starts with pattern
+// without its "*" when it ends in one
+func matchesPattern(pattern, v string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(v, prefix)
+	}
+	return v == pattern
+}
+
+// resourceIdentifiers returns the IDs, names, and ARNs of the resources of
+// a finding: its instance, access key and user, buckets, EKS or ECS
+// cluster, Lambda function, or RDS instance
+func resourceIdentifiers(finding types.Finding) []string {
+	r := finding.Resource
+	if r == nil {
+		return nil
+	}
+	var ids []*string
+	if d := r.InstanceDetails; d != nil {
+		ids = append(ids, d.InstanceId)
+	}
+	if d := r.AccessKeyDetails; d != nil {
+		ids = append(ids, d.AccessKeyId, d.UserName, d.PrincipalId)
+	}
+	for _, bucket := range r.S3BucketDetails {
+		ids = append(ids, bucket.Name, bucket.Arn)
+	}
+	if d := r.EksClusterDetails; d != nil {
+		ids = append(ids, d.Name, d.Arn)
+	}
+	if d := r.EcsClusterDetails; d != nil {
+		ids = append(ids, d.Name, d.Arn)
+	}
+	if d := r.LambdaDetails; d != nil {
+		ids = append(ids, d.FunctionName, d.FunctionArn)
+	}
+	if d := r.RdsDbInstanceDetails; d != nil {
+		ids = append(ids, d.DbInstanceIdentifier, d.DbInstanceArn)
+	}
+	var identifiers []string
+	for _, id := range ids {
+		if v := aws.ToString(id); v != "" {
+			identifiers = append(identifiers, v)
+		}
+	}
+	return identifiers
+}
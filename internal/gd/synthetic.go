@@ -0,0 +1,382 @@
+package gd
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// DefaultSyntheticAccount is the account synthetic findings belong to unless
+// another is set
+const DefaultSyntheticAccount = "123456789012"
+
+// syntheticAge is how long before it was created the oldest synthetic
+// finding was first seen, the 90 days GuardDuty keeps findings for
+const syntheticAge = 90 * 24 * time.Hour
+
+// syntheticTime is the layout of GuardDuty's finding timestamps
+const syntheticTime = "2006-01-02T15:04:05.000Z"
+
+// SyntheticRegions are the regions a Synthetic has detectors in, which
+// DescribeRegions lists
+var SyntheticRegions = []string{
+	"us-east-1", "us-east-2", "us-west-1", "us-west-2", "ca-central-1", "sa-east-1",
+	"eu-west-1", "eu-west-2", "eu-west-3", "eu-central-1", "eu-north-1",
+	"ap-south-1", "ap-northeast-1", "ap-northeast-2", "ap-southeast-1", "ap-southeast-2",
+}
+
+// SyntheticOptions describe the findings a Synthetic generates
+type SyntheticOptions struct {
+	// Findings is the number of findings of each region's detector
+	Findings int
+	// Seed selects the findings: the same seed generates the same findings,
+	// with times relative to the day the Synthetic was created
+	Seed uint64
+	// Latency delays every call, as a round trip to AWS would
+	Latency time.Duration
+	// AccountID owns the findings and is the identity of the caller
+	AccountID string
+}
+
+// syntheticType is a finding type synthetic findings are generated with:
+// its resource, its severity, and the title and description of a finding
+// of it, which name its resource
+type syntheticType struct {
+	findingType string
+	resource    string
+	severity    float64
+	title       string
+	description string
+}
+
+// syntheticTypes are weighted towards the low-severity findings that are
+// the most common in practice, by listing them more than once
+var syntheticTypes = []syntheticType{
+	{"Recon:EC2/PortProbeUnprotectedPort", "Instance", 2, "Unprotected port on EC2 instance %s is being probed.", "EC2 instance %s has an unprotected port which is being probed by a known malicious host."},
+	{"Recon:EC2/PortProbeUnprotectedPort", "Instance", 2, "Unprotected port on EC2 instance %s is being probed.", "EC2 instance %s has an unprotected port which is being probed by a known malicious host."},
+	{"UnauthorizedAccess:EC2/SSHBruteForce", "Instance", 2, "SSH brute force attacks against %s.", "Instance %s has been involved in SSH brute force attacks."},
+	{"UnauthorizedAccess:EC2/SSHBruteForce", "Instance", 2, "SSH brute force attacks against %s.", "Instance %s has been involved in SSH brute force attacks."},
+	{"Policy:IAMUser/RootCredentialUsage", "AccessKey", 2, "API ListBuckets was invoked using root credentials by %s.", "API ListBuckets was invoked using root credentials from a remote host by %s."},
+	{"Policy:S3/BucketBlockPublicAccessDisabled", "S3Bucket", 2, "Amazon S3 Block Public Access was disabled for S3 bucket %s.", "Amazon S3 Block Public Access was disabled for S3 bucket %s by an IAM entity."},
+	{"Discovery:IAMUser/AnomalousBehavior", "AccessKey", 2, "The user %s is anomalously invoking APIs commonly used in Discovery tactics.", "APIs commonly used in Discovery tactics were invoked by user %s under unusual circumstances."},
+	{"Recon:IAMUser/MaliciousIPCaller", "AccessKey", 5, "Reconnaissance API GetCallerIdentity was invoked from a known malicious IP address by %s.", "API GetCallerIdentity, commonly used in reconnaissance attacks, was invoked by %s from a known malicious IP address."},
+	{"PenTest:IAMUser/KaliLinux", "AccessKey", 5, "API DescribeInstances was invoked from a Kali Linux computer by %s.", "API DescribeInstances was invoked by %s from a Kali Linux computer."},
+	{"Discovery:S3/MaliciousIPCaller", "S3Bucket", 5, "S3 API ListObjects was invoked from a known malicious IP address on bucket %s.", "An API commonly used to discover data in S3 was invoked on bucket %s from a known malicious IP address."},
+	{"Discovery:Kubernetes/SuccessfulAnonymousAccess", "EKSCluster", 5, "Anonymous access granted to Kubernetes API on EKS cluster %s.", "An anonymous user was granted access to the Kubernetes API of EKS cluster %s."},
+	{"PrivilegeEscalation:Kubernetes/PrivilegedContainer", "EKSCluster", 5, "Privileged container with root level access launched on EKS cluster %s.", "A privileged container with root level access was launched on EKS cluster %s."},
+	{"Execution:Runtime/NewBinaryExecuted", "Instance", 5, "A newly created or recently modified binary file was executed on %s.", "A newly created or recently modified binary file was executed in a process on EC2 instance %s."},
+	{"Backdoor:EC2/C&CActivity.B!DNS", "Instance", 8, "Command and Control server domain name queried by EC2 instance %s.", "EC2 instance %s is querying a domain name associated with a known Command & Control server."},
+	{"CryptoCurrency:EC2/BitcoinTool.B!DNS", "Instance", 8, "Bitcoin-related domain name queried by EC2 instance %s.", "EC2 instance %s is querying a domain name that is associated with Bitcoin-related activity."},
+	{"CryptoCurrency:Runtime/BitcoinTool.B", "Instance", 8, "A process is querying a Bitcoin-related IP address on %s.", "A process on EC2 instance %s is communicating with an IP address associated with cryptocurrency-related activity."},
+	{"Trojan:EC2/DNSDataExfiltration", "Instance", 8, "Data exfiltration through DNS queries from EC2 instance %s.", "EC2 instance %s is attempting to exfiltrate data by encoding it within outbound DNS queries."},
+	{"UnauthorizedAccess:EC2/TorClient", "Instance", 8, "EC2 instance %s is communicating with Tor Entry nodes.", "EC2 instance %s is communicating with IP addresses that are known Tor Entry nodes."},
+	{"UnauthorizedAccess:IAMUser/InstanceCredentialExfiltration.OutsideAWS", "AccessKey", 8, "Credentials for instance role %s used from external IP address.", "Credentials that were created exclusively for an EC2 instance through instance role %s are being used from an external IP address."},
+	{"Exfiltration:S3/AnomalousBehavior", "S3Bucket", 8, "Anomalous data access on S3 bucket %s.", "An IAM entity invoked an S3 API in a suspicious way on bucket %s."},
+	{"AttackSequence:S3/CompromisedData", "S3Bucket", 9, "Potential data compromise of S3 bucket %s.", "A sequence of actions involving multiple signals indicates a potential data compromise of S3 bucket %s."},
+}
+
+// syntheticRemote is a remote host of synthetic findings
+type syntheticRemote struct {
+	countryCode, countryName, city, asn, org string
+	lat, lon                                 float64
+}
+
+// syntheticRemotes are where the remote addresses of synthetic findings are
+var syntheticRemotes = []syntheticRemote{
+	{"RU", "Russia", "Moscow", "12389", "Rostelecom", 55.75, 37.62},
+	{"CN", "China", "Beijing", "4134", "Chinanet", 39.9, 116.4},
+	{"NL", "Netherlands", "Amsterdam", "60781", "LeaseWeb Netherlands", 52.37, 4.9},
+	{"US", "United States", "Ashburn", "14061", "DigitalOcean", 39.04, -77.49},
+	{"BR", "Brazil", "Sao Paulo", "28573", "Claro", -23.55, -46.63},
+	{"DE", "Germany", "Frankfurt am Main", "24940", "Hetzner Online", 50.11, 8.68},
+	{"KP", "North Korea", "Pyongyang", "131279", "Star Joint Venture", 39.03, 125.75},
+	{"IR", "Iran", "Tehran", "58224", "Iran Telecommunication", 35.69, 51.39},
+}
+
+// Synthetic is a Fake whose own account has a detector in each of
+// SyntheticRegions holding opts.Findings generated findings, so the whole
+// export pipeline can be run at any volume to size hardware or measure a
+// change without AWS. The findings of a region are generated the first time
+// one of its GuardDuty clients is built, and are held in memory from then
+// on. It is safe for concurrent use.
+type Synthetic struct {
+	*Fake
+	opts SyntheticOptions
+	// base is when the findings were generated: each was created in the
+	// syntheticAge before it
+	base time.Time
+	// generated generates the findings of each region once
+	generated map[string]*sync.Once
+}
+
+// NewSynthetic returns a Synthetic generating the findings of opts
+func NewSynthetic(opts SyntheticOptions) *Synthetic {
+	s := &Synthetic{
+		Fake:      NewFake(opts.AccountID),
+		opts:      opts,
+		base:      time.Now().UTC().Truncate(24 * time.Hour),
+		generated: make(map[string]*sync.Once, len(SyntheticRegions)),
+	}
+	s.opts.AccountID = s.AccountID
+	s.Latency = opts.Latency
+	for _, region := range SyntheticRegions {
+		s.AddDetector("", region)
+		s.generated[region] = new(sync.Once)
+	}
+	return s
+}
+
+// GuardDuty returns a GuardDuty client of the detector of account in
+// cfg.Region, generating the findings of the region first
+func (s *Synthetic) GuardDuty(cfg aws.Config, account string, optFns ...func(*guardduty.Options)) GuardDutyAPI {
+	if once, ok := s.generated[cfg.Region]; ok && s.account(account) == s.AccountID {
+		once.Do(func() { s.generate(cfg.Region) })
+	}
+	return s.Fake.GuardDuty(cfg, account, optFns...)
+}
+
+// generate adds the findings of region to its detector
+func (s *Synthetic) generate(region string) {
+	detectorID := s.AddDetector("", region)
+	findings := make([]types.Finding, s.opts.Findings)
+	for i := range findings {
+		findings[i] = s.finding(region, detectorID, i)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, finding := range findings {
+		s.addFinding(finding)
+	}
+}
+
+// hash returns a hash of the seed and parts
+func (s *Synthetic) hash(parts ...string) uint64 {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, s.opts.Seed)
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// hexID returns a stable hexadecimal ID of n digits for the parts
+func (s *Synthetic) hexID(n int, parts ...string) string {
+	seed := make([]byte, 8)
+	binary.LittleEndian.PutUint64(seed, s.opts.Seed)
+	sum := sha256.Sum256(append(seed, strings.Join(parts, "\x00")...))
+	return hex.EncodeToString(sum[:])[:n]
+}
+
+// resourceID returns the ID of the resource of a kind that findings of
+// region pick with resource
+func (s *Synthetic) resourceID(region string, kind *syntheticType, resource int) string {
+	n := strconv.Itoa(resource)
+	switch kind.resource {
+	case "AccessKey":
+		return "ASIA" + strings.ToUpper(s.hexID(16, "accessKey", region, n))
+	case "S3Bucket":
+		return fmt.Sprintf("synthetic-%s-data-%s", region, n)
+	case "EKSCluster":
+		return "synthetic-cluster-" + n
+	}
+	return "i-0" + s.hexID(16, "instance", region, n)
+}
+
+// finding returns the finding i of the detector of region, drawn from the
+// seed, region, and index alone
+func (s *Synthetic) finding(region, detectorID string, i int) types.Finding {
+	r := rand.New(rand.NewPCG(s.opts.Seed, s.hash("finding", region)+uint64(i)))
+	kind := &syntheticTypes[r.IntN(len(syntheticTypes))]
+	severity := min(kind.severity+0.5*float64(r.IntN(3)), 10)
+	createdAt := s.base.Add(-time.Duration(r.Int64N(int64(syntheticAge))))
+	updatedAt := createdAt.Add(time.Duration(r.Int64N(int64(s.base.Sub(createdAt)) + 1))).Truncate(time.Millisecond)
+	createdAt = createdAt.Truncate(time.Millisecond)
+	count := 1 + r.IntN(20)
+	if r.IntN(10) == 0 {
+		count += r.IntN(1000)
+	}
+	// Findings repeat on the same resources of their kind
+	resource := r.IntN(max(s.opts.Findings/20, 1))
+	n := strconv.Itoa(resource)
+	account := s.opts.AccountID
+	id := s.hexID(24, "finding", region) + fmt.Sprintf("%08x", i)
+	resourceID := s.resourceID(region, kind, resource)
+	environment := []string{"prod", "staging", "dev"}[resource%3]
+
+	remote := syntheticRemotes[r.IntN(len(syntheticRemotes))]
+	remoteIP := &types.RemoteIpDetails{
+		IpAddressV4:  aws.String(fmt.Sprintf("%d.%d.%d.%d", 1+r.IntN(222), r.IntN(256), r.IntN(256), 1+r.IntN(254))),
+		Country:      &types.Country{CountryCode: aws.String(remote.countryCode), CountryName: aws.String(remote.countryName)},
+		City:         &types.City{CityName: aws.String(remote.city)},
+		Organization: &types.Organization{Asn: aws.String(remote.asn), AsnOrg: aws.String(remote.org), Isp: aws.String(remote.org), Org: aws.String(remote.org)},
+		GeoLocation:  &types.GeoLocation{Lat: aws.Float64(remote.lat), Lon: aws.Float64(remote.lon)},
+	}
+	privateIP := &types.LocalIpDetails{IpAddressV4: aws.String(fmt.Sprintf("10.%d.%d.%d", resource>>16&255, resource>>8&255, resource&255))}
+	accessKey := &types.AccessKeyDetails{
+		AccessKeyId: aws.String("ASIA" + strings.ToUpper(s.hexID(16, "accessKey", region, n))),
+		PrincipalId: aws.String("AIDA" + strings.ToUpper(s.hexID(17, "principal", region, n))),
+		UserName:    aws.String("synthetic-user-" + n),
+		UserType:    aws.String("IAMUser"),
+	}
+	vpcID := aws.String("vpc-0" + s.hexID(16, "vpc", region, strconv.Itoa(resource%2)))
+
+	res := &types.Resource{ResourceType: aws.String(kind.resource)}
+	name := resourceID
+	service := &types.Service{
+		ServiceName:    aws.String("guardduty"),
+		Archived:       aws.Bool(r.IntN(10) == 0),
+		Count:          aws.Int32(int32(count)),
+		EventFirstSeen: aws.String(createdAt.Format(syntheticTime)),
+		EventLastSeen:  aws.String(updatedAt.Format(syntheticTime)),
+		ResourceRole:   aws.String("TARGET"),
+	}
+	switch kind.resource {
+	case "Instance":
+		group := strconv.Itoa(resource % 5)
+		instance := &types.InstanceDetails{
+			InstanceId:       aws.String(resourceID),
+			InstanceType:     aws.String([]string{"t3.medium", "m5.large", "c6i.xlarge", "r6g.2xlarge"}[resource%4]),
+			ImageId:          aws.String("ami-0" + s.hexID(16, "image", region, strconv.Itoa(resource%8))),
+			AvailabilityZone: aws.String(region + string(rune('a'+resource%3))),
+			InstanceState:    aws.String("running"),
+			LaunchTime:       aws.String(s.base.Add(-syntheticAge - time.Duration(resource)*time.Hour).Format(syntheticTime)),
+			IamInstanceProfile: &types.IamInstanceProfile{
+				Arn: aws.String(fmt.Sprintf("arn:aws:iam::%s:instance-profile/synthetic-app-%d", account, resource%8)),
+				Id:  aws.String("AIPA" + strings.ToUpper(s.hexID(17, "profile", region, strconv.Itoa(resource%8)))),
+			},
+			NetworkInterfaces: []types.NetworkInterface{{
+				NetworkInterfaceId: aws.String("eni-0" + s.hexID(16, "eni", region, n)),
+				PrivateIpAddress:   privateIP.IpAddressV4,
+				PublicIp:           aws.String(fmt.Sprintf("54.%d.%d.%d", resource>>8&255, resource&255, 10+resource%200)),
+				SubnetId:           aws.String("subnet-0" + s.hexID(16, "subnet", region, strconv.Itoa(resource%6))),
+				VpcId:              vpcID,
+				SecurityGroups:     []types.SecurityGroup{{GroupId: aws.String("sg-0" + s.hexID(16, "sg", region, group)), GroupName: aws.String([]string{"web", "app", "db", "bastion", "default"}[resource%5])}},
+			}},
+			Tags: []types.Tag{
+				{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("synthetic-%s-%d", []string{"web", "app", "db", "bastion", "worker"}[resource%5], resource))},
+				{Key: aws.String("Environment"), Value: aws.String(environment)},
+			},
+		}
+		if resource%10 == 9 {
+			instance.Platform = aws.String("windows")
+		}
+		res.InstanceDetails = instance
+		switch {
+		case strings.HasSuffix(kind.findingType, "!DNS") || strings.Contains(kind.findingType, "DNSDataExfiltration"):
+			service.FeatureName = aws.String("DnsLogs")
+			service.Action = &types.Action{ActionType: aws.String("DNS_REQUEST"), DnsRequestAction: &types.DnsRequestAction{
+				Domain: aws.String(fmt.Sprintf("%s.synthetic-threat.example", s.hexID(12, "domain", region, strconv.Itoa(r.IntN(64))))), Protocol: aws.String("UDP"), Blocked: aws.Bool(false),
+			}}
+		case strings.HasPrefix(kind.findingType, "Recon:EC2/PortProbe"):
+			service.FeatureName = aws.String("FlowLogs")
+			port := []int32{22, 3389, 80, 443, 3306}[r.IntN(5)]
+			service.Action = &types.Action{ActionType: aws.String("PORT_PROBE"), PortProbeAction: &types.PortProbeAction{Blocked: aws.Bool(false), PortProbeDetails: []types.PortProbeDetail{{
+				LocalPortDetails: &types.LocalPortDetails{Port: aws.Int32(port), PortName: aws.String(portName(port))},
+				LocalIpDetails:   privateIP,
+				RemoteIpDetails:  remoteIP,
+			}}}}
+		case strings.Contains(kind.findingType, ":Runtime/"):
+			service.FeatureName = aws.String("RuntimeMonitoring")
+			process := []string{"xmrig", "kworkerds", "nc", "curl", "python3"}[r.IntN(5)]
+			service.RuntimeDetails = &types.RuntimeDetails{Process: &types.ProcessDetails{
+				Name: aws.String(process), ExecutablePath: aws.String("/tmp/" + process), ExecutableSha256: aws.String(s.hexID(64, "binary", process)),
+				Pid: aws.Int32(int32(1000 + r.IntN(30000))), User: aws.String([]string{"root", "ec2-user", "www-data"}[r.IntN(3)]), UserId: aws.Int32(0),
+			}}
+		default:
+			service.FeatureName = aws.String("FlowLogs")
+			direction, port := "INBOUND", int32(22)
+			if kind.severity >= 8 {
+				direction, port = "OUTBOUND", []int32{443, 9001, 4444, 8333}[r.IntN(4)]
+			}
+			service.Action = &types.Action{ActionType: aws.String("NETWORK_CONNECTION"), NetworkConnectionAction: &types.NetworkConnectionAction{
+				ConnectionDirection: aws.String(direction), Protocol: aws.String("TCP"), Blocked: aws.Bool(false),
+				LocalPortDetails:  &types.LocalPortDetails{Port: aws.Int32(port), PortName: aws.String(portName(port))},
+				RemotePortDetails: &types.RemotePortDetails{Port: aws.Int32(int32(1024 + r.IntN(64000))), PortName: aws.String("Unknown")},
+				LocalIpDetails:    privateIP,
+				RemoteIpDetails:   remoteIP,
+			}}
+		}
+	case "AccessKey", "S3Bucket":
+		res.AccessKeyDetails = accessKey
+		name = aws.ToString(accessKey.UserName)
+		service.FeatureName = aws.String("CloudTrail")
+		api, apiService := []string{"GetCallerIdentity", "DescribeInstances", "ListBuckets", "GetSecretValue"}[r.IntN(4)], "sts.amazonaws.com"
+		if kind.resource == "S3Bucket" {
+			name = resourceID
+			service.FeatureName = aws.String("S3DataEvents")
+			api, apiService = []string{"ListObjects", "GetObject", "PutBucketPublicAccessBlock"}[r.IntN(3)], "s3.amazonaws.com"
+			permission := "NOT_PUBLIC"
+			if resource%7 == 0 {
+				permission = "PUBLIC"
+			}
+			res.S3BucketDetails = []types.S3BucketDetail{{
+				Arn: aws.String("arn:aws:s3:::" + resourceID), Name: aws.String(resourceID), Type: aws.String("Destination"),
+				CreatedAt:    aws.Time(s.base.Add(-2 * syntheticAge)),
+				Owner:        &types.Owner{Id: aws.String(s.hexID(64, "owner", account))},
+				PublicAccess: &types.PublicAccess{EffectivePermission: aws.String(permission)},
+				Tags:         []types.Tag{{Key: aws.String("Environment"), Value: aws.String(environment)}},
+			}}
+		}
+		service.Action = &types.Action{ActionType: aws.String("AWS_API_CALL"), AwsApiCallAction: &types.AwsApiCallAction{
+			Api: aws.String(api), ServiceName: aws.String(apiService), CallerType: aws.String("Remote IP"), RemoteIpDetails: remoteIP,
+		}}
+	case "EKSCluster":
+		service.FeatureName = aws.String("Kubernetes")
+		res.EksClusterDetails = &types.EksClusterDetails{
+			Name: aws.String(resourceID), Arn: aws.String(fmt.Sprintf("arn:aws:eks:%s:%s:cluster/%s", region, account, resourceID)),
+			VpcId: vpcID, Status: aws.String("ACTIVE"),
+			CreatedAt: aws.Time(s.base.Add(-2 * syntheticAge)),
+		}
+		res.KubernetesDetails = &types.KubernetesDetails{KubernetesUserDetails: &types.KubernetesUserDetails{Username: aws.String("system:anonymous"), Uid: aws.String(""), Groups: []string{"system:unauthenticated"}}}
+		service.Action = &types.Action{ActionType: aws.String("KUBERNETES_API_CALL"), KubernetesApiCallAction: &types.KubernetesApiCallAction{
+			RequestUri: aws.String("/api/v1/namespaces/default/secrets"), Verb: aws.String("list"), UserAgent: aws.String("kubectl/v1.29.0"), StatusCode: aws.Int32(200), RemoteIpDetails: remoteIP,
+		}}
+	}
+
+	return types.Finding{
+		AccountId:     aws.String(account),
+		Arn:           aws.String(fmt.Sprintf("arn:aws:guardduty:%s:%s:detector/%s/finding/%s", region, account, detectorID, id)),
+		Id:            aws.String(id),
+		Partition:     aws.String(PartitionAWS),
+		Region:        aws.String(region),
+		SchemaVersion: aws.String("2.0"),
+		Type:          aws.String(kind.findingType),
+		Severity:      aws.Float64(severity),
+		Confidence:    aws.Float64(float64(5 + r.IntN(5))),
+		Title:         aws.String(fmt.Sprintf(kind.title, name)),
+		Description:   aws.String(fmt.Sprintf(kind.description, name)),
+		CreatedAt:     aws.String(createdAt.Format(syntheticTime)),
+		UpdatedAt:     aws.String(updatedAt.Format(syntheticTime)),
+		Resource:      res,
+		Service:       service,
+	}
+}
+
+// portName returns the service name GuardDuty gives a port
+func portName(port int32) string {
+	switch port {
+	case 22:
+		return "SSH"
+	case 80:
+		return "HTTP"
+	case 443:
+		return "HTTPS"
+	case 3306:
+		return "MYSQL"
+	case 3389:
+		return "RDP"
+	}
+	return "Unknown"
+}
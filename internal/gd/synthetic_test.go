@@ -0,0 +1,46 @@
+package gd
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestSynthetic(t *testing.T) {
+	export := func(seed uint64) []RegionResult {
+		synthetic := NewSynthetic(SyntheticOptions{Findings: 120, Seed: seed})
+		opts := testFetchOptions(synthetic.Fake)
+		opts.Clients = synthetic
+		regions, err := AllRegions(context.Background(), synthetic, opts.AWSConfig, 0)
+		if err != nil {
+			t.Fatalf("error listing regions: %v", err)
+		}
+		if !slices.Equal(regions, slices.Sorted(slices.Values(SyntheticRegions))) {
+			t.Errorf("got regions %v, want SyntheticRegions", regions)
+		}
+		return StreamRegions(context.Background(), opts, nil).Collect()
+	}
+
+	first, again, other := export(1)[0], export(1)[0], export(2)[0]
+	if first.Err != nil {
+		t.Fatalf("export failed: %v", first.Err)
+	}
+	if first.Count != 120 {
+		t.Errorf("got %d findings, want 120", first.Count)
+	}
+	sameAs := func(a, b RegionResult) bool {
+		x, _ := json.Marshal(a.Findings)
+		y, _ := json.Marshal(b.Findings)
+		return string(x) == string(y)
+	}
+	if !sameAs(first, again) {
+		t.Errorf("the same seed generated different findings")
+	}
+	if sameAs(first, other) {
+		t.Errorf("another seed generated the same findings")
+	}
+	if first.Calls == 0 {
+		t.Errorf("the calls of the export were not counted")
+	}
+}
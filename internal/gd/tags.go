@@ -0,0 +1,229 @@
+package gd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+	tagging "github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+
+	"guardduty/internal/telemetry"
+)
+
+// ResourceTagKeys are the tags that route a finding to the team owning its
+// resource, exported as columns of the same names
+var ResourceTagKeys = []string{"Owner", "Team", "Environment", "CostCenter"}
+
+// The defaults of a TagCache: how long looked-up tags are reused and the
+// number of GetResources calls in flight at once
+const (
+	DefaultTagCacheTTL     = time.Hour
+	DefaultTagConcurrency  = 4
+	maxTagCacheEntries     = 100000
+	maxGetResourcesARNList = 100
+)
+
+// TagCache looks up the current tags of the resources of findings through
+// the Resource Groups Tagging API and keeps them for a while, so the many
+// findings of one instance or bucket, and later exports of them, cost one
+// call. It is shared by the exports of a server and safe for concurrent use.
+type TagCache struct {
+	ttl  time.Duration
+	sem  chan struct{}
+	mu   sync.Mutex
+	tags map[string]cachedTags
+}
+
+// cachedTags are the tags of a resource, empty when it has none or the
+// Tagging API doesn't know it, until expires
+type cachedTags struct {
+	tags    []types.Tag
+	expires time.Time
+}
+
+// NewTagCache returns a TagCache keeping tags for ttl with at most
+// concurrency GetResources calls in flight
+func NewTagCache(ttl time.Duration, concurrency int) *TagCache {
+	if ttl <= 0 {
+		ttl = DefaultTagCacheTTL
+	}
+	if concurrency < 1 {
+		concurrency = DefaultTagConcurrency
+	}
+	return &TagCache{ttl: ttl, sem: make(chan struct{}, concurrency), tags: make(map[string]cachedTags)}
+}
+
+// tagFindings sets the current tags on the resources of a page of findings
+// fetched from target, over the tags GuardDuty recorded when the finding was
+// raised. Tags are looked up with the target's credentials, so resources of
+// other accounts, such as those of an administrator's member findings, keep
+// the tags in the finding. A failed lookup is logged and leaves the findings
+// as they are.
+func (c *TagCache) tagFindings(ctx context.Context, target exportTarget, findings []types.Finding, callTimeout time.Duration) {
+	now := time.Now()
+	var missing []string
+	wanted := make(map[string]bool)
+	for _, finding := range findings {
+		if account := target.account.accountID; account != "" && aws.ToString(finding.AccountId) != account {
+			continue
+		}
+		for _, resource := range taggedResources(finding, target.region) {
+			if _, ok := c.cached(resource.arn, now); !ok && !wanted[resource.arn] {
+				wanted[resource.arn] = true
+				missing = append(missing, resource.arn)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		if err := c.lookup(ctx, target, missing, callTimeout); err != nil {
+			telemetry.Logger(ctx).Warn("Error looking up resource tags", "resources", len(missing), "error", err)
+		}
+	}
+	for i := range findings {
+		for _, resource := range taggedResources(findings[i], target.region) {
+			if tags, ok := c.cached(resource.arn, now); ok && len(tags) > 0 {
+				*resource.tags = mergeTags(*resource.tags, tags)
+			}
+		}
+	}
+}
+
+// cached returns the unexpired tags of a resource
+func (c *TagCache) cached(resourceARN string, now time.Time) ([]types.Tag, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.tags[resourceARN]
+	if !ok || now.After(entry.expires) {
+		return nil, false
+	}
+	return entry.tags, true
+}
+
+// lookup fetches the tags of resources in the target's region, 100 at a
+// time, caching resources the Tagging API doesn't return as untagged
+func (c *TagCache) lookup(ctx context.Context, target exportTarget, resources []string, callTimeout time.Duration) error {
+	client := tagging.NewFromConfig(target.config())
+	for start := 0; start < len(resources); start += maxGetResourcesARNList {
+		batch := resources[start:min(start+maxGetResourcesARNList, len(resources))]
+		found := make(map[string][]types.Tag, len(batch))
+		paginator := tagging.NewGetResourcesPaginator(client, &tagging.GetResourcesInput{ResourceARNList: batch})
+		for paginator.HasMorePages() {
+			select {
+			case c.sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			callCtx, cancel := callContext(ctx, callTimeout)
+			page, err := paginator.NextPage(callCtx)
+			cancel()
+			<-c.sem
+			if err != nil {
+				return fmt.Errorf("error getting tags of resources in region %s: %v", target.region, err)
+			}
+			for _, mapping := range page.ResourceTagMappingList {
+				tags := make([]types.Tag, len(mapping.Tags))
+				for i, tag := range mapping.Tags {
+					tags[i] = types.Tag{Key: tag.Key, Value: tag.Value}
+				}
+				found[aws.ToString(mapping.ResourceARN)] = tags
+			}
+		}
+		c.store(batch, found)
+	}
+	return nil
+}
+
+// store caches the tags of a batch of resources, dropping expired entries
+// once the cache is full
+func (c *TagCache) store(resources []string, found map[string][]types.Tag) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.tags)+len(resources) > maxTagCacheEntries {
+		for resourceARN, entry := range c.tags {
+			if now.After(entry.expires) {
+				delete(c.tags, resourceARN)
+			}
+		}
+		if len(c.tags)+len(resources) > maxTagCacheEntries {
+			c.tags = make(map[string]cachedTags)
+		}
+	}
+	expires := now.Add(c.ttl)
+	for _, resourceARN := range resources {
+		c.tags[resourceARN] = cachedTags{tags: found[resourceARN], expires: expires}
+	}
+}
+
+// taggedResource is a resource of a finding with the tags the finding
+// records for it
+type taggedResource struct {
+	arn  string
+	tags *[]types.Tag
+}
+
+// taggedResources returns the resources of a finding that the Tagging API
+// can look up: its instance, buckets, EKS or ECS cluster, Lambda function,
+// or RDS database instance. Access keys and containers have none.
+func taggedResources(finding types.Finding, region string) []taggedResource {
+	r := finding.Resource
+	if r == nil {
+		return nil
+	}
+	partition, account := aws.ToString(finding.Partition), aws.ToString(finding.AccountId)
+	if partition == "" {
+		partition = PartitionAWS
+	}
+	if v := aws.ToString(finding.Region); v != "" {
+		region = v
+	}
+	var resources []taggedResource
+	add := func(resourceARN string, tags *[]types.Tag) {
+		if resourceARN != "" {
+			resources = append(resources, taggedResource{resourceARN, tags})
+		}
+	}
+	if r.InstanceDetails != nil && r.InstanceDetails.InstanceId != nil && account != "" {
+		add(fmt.Sprintf("arn:%s:ec2:%s:%s:instance/%s", partition, region, account, *r.InstanceDetails.InstanceId), &r.InstanceDetails.Tags)
+	}
+	for i := range r.S3BucketDetails {
+		bucket := &r.S3BucketDetails[i]
+		if bucket.Arn != nil {
+			add(*bucket.Arn, &bucket.Tags)
+		} else if bucket.Name != nil {
+			add(fmt.Sprintf("arn:%s:s3:::%s", partition, *bucket.Name), &bucket.Tags)
+		}
+	}
+	if r.EksClusterDetails != nil {
+		add(aws.ToString(r.EksClusterDetails.Arn), &r.EksClusterDetails.Tags)
+	}
+	if r.EcsClusterDetails != nil {
+		add(aws.ToString(r.EcsClusterDetails.Arn), &r.EcsClusterDetails.Tags)
+	}
+	if r.LambdaDetails != nil {
+		add(aws.ToString(r.LambdaDetails.FunctionArn), &r.LambdaDetails.Tags)
+	}
+	if r.RdsDbInstanceDetails != nil {
+		add(aws.ToString(r.RdsDbInstanceDetails.DbInstanceArn), &r.RdsDbInstanceDetails.Tags)
+	}
+	return resources
+}
+
+// mergeTags returns existing with tags added, replacing the values of keys
+// it already has
+func mergeTags(existing, tags []types.Tag) []types.Tag {
+	current := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		current[aws.ToString(tag.Key)] = true
+	}
+	merged := make([]types.Tag, 0, len(existing)+len(tags))
+	for _, tag := range existing {
+		if !current[aws.ToString(tag.Key)] {
+			merged = append(merged, tag)
+		}
+	}
+	return append(merged, tags...)
+}
@@ -0,0 +1,107 @@
+package gd
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// mitreAttackCSV maps finding types to MITRE ATT&CK tactics and techniques.
+// Each row names a finding type without its detection mechanism and
+// artifact, such as Backdoor:EC2/C&CActivity for Backdoor:EC2/C&CActivity.B!DNS,
+// or a threat purpose alone for the tactics of the types it has no row for.
+// Tactics and techniques are separated by semicolons, each an ATT&CK ID and
+// its name.
+//
+//go:embed mitre_attack.csv
+var mitreAttackCSV string
+
+// FindingTypeParts are the parts of a GuardDuty finding type, which is named
+// ThreatPurpose:ResourceTypeAffected/ThreatFamilyName.DetectionMechanism!Artifact,
+// such as CryptoCurrency:EC2/BitcoinTool.B!DNS. Parts a type lacks are
+// empty.
+type FindingTypeParts struct {
+	ThreatPurpose      string
+	ResourceType       string
+	ThreatFamily       string
+	DetectionMechanism string
+	Artifact           string
+}
+
+// ParseFindingType splits a finding type into its parts
+func ParseFindingType(findingType string) FindingTypeParts {
+	var parts FindingTypeParts
+	rest, artifact, _ := strings.Cut(findingType, "!")
+	parts.Artifact = artifact
+	purpose, rest, ok := strings.Cut(rest, ":")
+	parts.ThreatPurpose = purpose
+	if !ok {
+		return parts
+	}
+	resource, rest, ok := strings.Cut(rest, "/")
+	parts.ResourceType = resource
+	if !ok {
+		return parts
+	}
+	parts.ThreatFamily, parts.DetectionMechanism, _ = strings.Cut(rest, ".")
+	return parts
+}
+
+// AttackMapping is the MITRE ATT&CK tactics and techniques of a finding
+// type, each such as "TA0006 Credential Access" or "T1110 Brute Force"
+type AttackMapping struct {
+	Tactics    []string
+	Techniques []string
+}
+
+// mitreAttack parses mitreAttackCSV once, by finding type or threat purpose
+var mitreAttack = sync.OnceValue(func() map[string]AttackMapping {
+	rows, err := csv.NewReader(strings.NewReader(mitreAttackCSV)).ReadAll()
+	if err != nil {
+		panic(fmt.Sprintf("invalid MITRE ATT&CK mapping: %v", err))
+	}
+	mappings := make(map[string]AttackMapping, len(rows))
+	for _, row := range rows[1:] {
+		mappings[row[0]] = AttackMapping{Tactics: splitAttack(row[1]), Techniques: splitAttack(row[2])}
+	}
+	return mappings
+})
+
+// splitAttack splits a cell of the mapping table
+func splitAttack(cell string) []string {
+	if cell == "" {
+		return nil
+	}
+	return strings.Split(cell, ";")
+}
+
+// MitreAttack returns the ATT&CK tactics and techniques of a finding type:
+// those of the type itself, else of the type without its detection
+// mechanism and artifact, else the tactics of its threat purpose without
+// techniques. A type of an unknown purpose maps to nothing.
+func MitreAttack(findingType string) AttackMapping {
+	mappings := mitreAttack()
+	if mapping, ok := mappings[findingType]; ok {
+		return mapping
+	}
+	parts := ParseFindingType(findingType)
+	if mapping, ok := mappings[parts.ThreatPurpose+":"+parts.ResourceType+"/"+parts.ThreatFamily]; ok {
+		return mapping
+	}
+	return mappings[parts.ThreatPurpose]
+}
+
+// matchesAttack reports whether one of entries is named by pattern: its ID,
+// such as TA0006 or T1110, which also matches the sub-techniques of a
+// technique such as T1110.001, or its name, ignoring case
+func matchesAttack(entries []string, pattern string) bool {
+	for _, entry := range entries {
+		id, name, _ := strings.Cut(entry, " ")
+		if strings.EqualFold(id, pattern) || strings.EqualFold(name, pattern) || strings.HasPrefix(strings.ToUpper(id), strings.ToUpper(pattern)+".") {
+			return true
+		}
+	}
+	return false
+}
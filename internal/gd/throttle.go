@@ -0,0 +1,201 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+
+	"guardduty/internal/telemetry"
+)
+
+// Retry modes of the SDK retryer
+const (
+	// RetryStandard retries with exponential backoff and jitter
+	RetryStandard = "standard"
+	// RetryAdaptive also slows down the client's request rate after
+	// throttling errors, so busy accounts recover instead of failing
+	RetryAdaptive = "adaptive"
+)
+
+// NewRetryer returns the SDK retryer of the given mode, making at most
+// maxAttempts attempts and waiting at most maxBackoff between them when it is
+// set. Each client gets its own retryer, so adaptive mode tracks the request
+// rate of each region.
+func NewRetryer(mode string, maxAttempts int, maxBackoff time.Duration) func() aws.Retryer {
+	standard := func(o *retry.StandardOptions) {
+		o.MaxAttempts = maxAttempts
+		if maxBackoff > 0 {
+			o.MaxBackoff = maxBackoff
+		}
+	}
+	return func() aws.Retryer {
+		if mode == RetryAdaptive {
+			return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+				o.StandardOptions = append(o.StandardOptions, standard)
+			})
+		}
+		return retry.NewStandard(standard)
+	}
+}
+
+// rateLimiter is a token bucket allowing rate requests per second on
+// average and bursts of up to burst requests
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait takes a token, waiting until one is available or ctx is done. Tokens
+// are reserved in arrival order, so waiting callers are served fairly.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Limiter paces the calls to a service other than GuardDuty, such as a
+// threat-intelligence API, with the same token bucket
+type Limiter struct {
+	bucket *rateLimiter
+}
+
+// NewLimiter returns a Limiter allowing rate calls per second on average
+// and bursts of up to burst calls
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{bucket: newRateLimiter(rate, burst)}
+}
+
+// Wait blocks until a call is allowed or ctx is done
+func (l *Limiter) Wait(ctx context.Context) error {
+	return l.bucket.wait(ctx)
+}
+
+// RateLimiters holds a limiter for each account and region, shared by every
+// export so concurrent exports of the same account stay within its limit
+type RateLimiters struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    int
+	limiters map[string]*rateLimiter
+}
+
+// NewRateLimiters returns limiters allowing rate GuardDuty requests per
+// second to each account and region, in bursts of up to burst; a rate of 0
+// leaves requests unlimited
+func NewRateLimiters(rate float64, burst int) *RateLimiters {
+	return &RateLimiters{rate: rate, burst: burst, limiters: make(map[string]*rateLimiter)}
+}
+
+// get returns the limiter of an account and region, or nil when requests
+// are not limited, as they are by nil RateLimiters. An empty account is the
+// export profile's own.
+func (r *RateLimiters) get(profile, account, region string) *rateLimiter {
+	if r == nil || r.rate <= 0 {
+		return nil
+	}
+	key := TargetLabel(account, region)
+	if account == "" {
+		key = "profile " + profile + "/" + region
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l, ok := r.limiters[key]
+	if !ok {
+		l = newRateLimiter(r.rate, r.burst)
+		r.limiters[key] = l
+	}
+	return l
+}
+
+// withRateLimit makes a GuardDuty client wait for l before each attempt of
+// an API call, including the SDK's retries. A nil l leaves calls unlimited.
+func withRateLimit(l *rateLimiter) func(*guardduty.Options) {
+	return func(o *guardduty.Options) {
+		if l == nil {
+			return
+		}
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("RateLimit",
+				func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+					if err := l.wait(ctx); err != nil {
+						return middleware.FinalizeOutput{}, middleware.Metadata{}, err
+					}
+					return next.HandleFinalize(ctx, in)
+				}), "Retry", middleware.After)
+		})
+	}
+}
+
+type throttleKey struct{}
+
+// withThrottleReporter returns a copy of ctx whose AWS API calls pass each
+// throttling error to report, with the operation and error code
+func withThrottleReporter(ctx context.Context, report func(operation, code string)) context.Context {
+	return context.WithValue(ctx, throttleKey{}, report)
+}
+
+// isThrottle reports whether err is one of the throttling errors the SDK
+// retries, such as ThrottlingException or TooManyRequestsException
+var isThrottle = retry.IsErrorThrottles(retry.DefaultThrottles)
+
+// ReportThrottles is an SDK middleware counting each attempt of an API call
+// that was throttled and passing it to the context's throttle reporter
+func ReportThrottles(stack *middleware.Stack) error {
+	// Presigned requests are not sent, so they have no retry loop
+	if _, ok := stack.Finalize.Get("Retry"); !ok {
+		return nil
+	}
+	return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("ReportThrottles",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			out, metadata, err := next.HandleFinalize(ctx, in)
+			if err == nil || isThrottle.IsErrorThrottle(err) != aws.TrueTernary {
+				return out, metadata, err
+			}
+			service, operation := awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx)
+			telemetry.APIThrottles.Inc(service, operation)
+			if report, ok := ctx.Value(throttleKey{}).(func(operation, code string)); ok {
+				code := "Throttled"
+				var apiErr smithy.APIError
+				if errors.As(err, &apiErr) {
+					code = apiErr.ErrorCode()
+				}
+				report(operation, code)
+			}
+			return out, metadata, err
+		}), "Retry", middleware.After)
+}
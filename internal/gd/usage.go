@@ -0,0 +1,226 @@
+package gd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/telemetry"
+)
+
+// UsageUnit is the currency GuardDuty reports usage costs in
+const UsageUnit = "USD"
+
+// usagePeriod is the time GetUsageStatistics reports usage over, ending
+// when it is called
+const usagePeriod = 30 * 24 * time.Hour
+
+// UsageFeatures are the features GuardDuty bills for, in the order usage
+// reports list them: the foundational data sources followed by the
+// protection plans
+var UsageFeatures = []types.UsageFeature{
+	types.UsageFeatureCloudTrail,
+	types.UsageFeatureFlowLogs,
+	types.UsageFeatureDnsLogs,
+	types.UsageFeatureS3DataEvents,
+	types.UsageFeatureEksAuditLogs,
+	types.UsageFeatureEbsMalwareProtection,
+	types.UsageFeatureRdsLoginEvents,
+	types.UsageFeatureLambdaNetworkLogs,
+	types.UsageFeatureEksRuntimeMonitoring,
+	types.UsageFeatureFargateRuntimeMonitoring,
+	types.UsageFeatureEc2RuntimeMonitoring,
+	types.UsageFeatureRdsDbiProtectionProvisioned,
+	types.UsageFeatureRdsDbiProtectionServerless,
+}
+
+// UsageReport breaks down what GuardDuty cost over the last 30 days by
+// feature and account, from GetUsageStatistics. Costs are in UsageUnit.
+type UsageReport struct {
+	// Start and End bound the period GuardDuty reported usage for; a
+	// detector enabled during it reports its usage since then
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Unit  string    `json:"unit"`
+	Total float64   `json:"total"`
+	// ByFeature and ByAccount total the costs, most expensive first
+	ByFeature []UsageTotal  `json:"byFeature"`
+	ByAccount []UsageTotal  `json:"byAccount"`
+	Costs     []UsageCost   `json:"costs"`
+	Regions   []RegionUsage `json:"regions"`
+}
+
+// UsageCost is what one feature cost one account in one region. Features
+// without usage are left out.
+type UsageCost struct {
+	AccountID  string  `json:"accountId"`
+	Region     string  `json:"region"`
+	DetectorID string  `json:"detectorId"`
+	Feature    string  `json:"feature"`
+	Amount     float64 `json:"amount"`
+}
+
+// UsageTotal is the cost of a feature or account across the report
+type UsageTotal struct {
+	Name   string  `json:"name"`
+	Amount float64 `json:"amount"`
+}
+
+// RegionUsage is the outcome of getting the usage of one account and
+// region. A region without GuardDuty is skipped, and one that could not be
+// queried reports its error without failing the others.
+type RegionUsage struct {
+	Account string  `json:"account,omitempty"`
+	Region  string  `json:"region"`
+	Total   float64 `json:"total"`
+	Skipped string  `json:"skipped,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// UsageStatistics gets the usage costs of every detector in every account
+// and region in opts, using opts.Concurrency workers. Each detector is
+// asked for the cost of each of UsageFeatures by account, which includes
+// the member accounts of an administrator.
+func UsageStatistics(ctx context.Context, opts FetchOptions) UsageReport {
+	end := time.Now().UTC().Truncate(time.Second)
+	targets := exportTargets(ctx, opts)
+	report := UsageReport{
+		Start:     end.Add(-usagePeriod),
+		End:       end,
+		Unit:      UsageUnit,
+		ByFeature: []UsageTotal{},
+		ByAccount: []UsageTotal{},
+		Costs:     []UsageCost{},
+		Regions:   make([]RegionUsage, len(targets)),
+	}
+	costs := make([][]UsageCost, len(targets))
+	eachTarget(targets, opts.Concurrency, func(i int) {
+		report.Regions[i], costs[i] = regionUsage(ctx, opts, targets[i])
+	})
+
+	byFeature, byAccount := make(map[string]float64), make(map[string]float64)
+	for _, list := range costs {
+		report.Costs = append(report.Costs, list...)
+		for _, cost := range list {
+			report.Total += cost.Amount
+			byFeature[cost.Feature] += cost.Amount
+			byAccount[cost.AccountID] += cost.Amount
+		}
+	}
+	report.ByFeature = sortedUsage(byFeature)
+	report.ByAccount = sortedUsage(byAccount)
+	return report
+}
+
+// regionUsage gets the usage costs of one target
+func regionUsage(ctx context.Context, opts FetchOptions, target exportTarget) (RegionUsage, []UsageCost) {
+	account, region := target.account.accountID, target.region
+	usage := RegionUsage{Account: account, Region: region}
+	if target.disabled {
+		usage.Skipped = "region is not enabled for this account"
+		return usage, nil
+	}
+	log := telemetry.Logger(ctx).With("region", target.label())
+
+	client := target.client()
+	var costs []UsageCost
+	err := func() error {
+		listCtx, cancel := callContext(ctx, opts.CallTimeout)
+		detectors, err := client.ListDetectors(listCtx, &guardduty.ListDetectorsInput{})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error listing detectors in region %s: %v", region, err)
+		}
+		if len(detectors.DetectorIds) == 0 {
+			return errGuardDutyNotEnabled
+		}
+		for _, detectorID := range detectors.DetectorIds {
+			for _, feature := range UsageFeatures {
+				featureCosts, err := featureUsage(ctx, client, region, detectorID, feature, opts)
+				if err != nil {
+					return err
+				}
+				costs = append(costs, featureCosts...)
+			}
+		}
+		return nil
+	}()
+	for _, cost := range costs {
+		usage.Total += cost.Amount
+	}
+	switch {
+	case errors.Is(err, errGuardDutyNotEnabled):
+		usage.Skipped = err.Error()
+	case err != nil:
+		if account != "" {
+			err = fmt.Errorf("account %s: %v", account, err)
+		}
+		log.Error("Error getting usage statistics", "error", err)
+		usage.Error = err.Error()
+	}
+	return usage, costs
+}
+
+// featureUsage returns what one feature of a detector cost each account
+func featureUsage(ctx context.Context, client UsageAPI, region, detectorID string, feature types.UsageFeature, opts FetchOptions) ([]UsageCost, error) {
+	var costs []UsageCost
+	paginator := guardduty.NewGetUsageStatisticsPaginator(client, &guardduty.GetUsageStatisticsInput{
+		DetectorId:         aws.String(detectorID),
+		UsageCriteria:      &types.UsageCriteria{Features: []types.UsageFeature{feature}},
+		UsageStatisticType: types.UsageStatisticTypeSumByAccount,
+		Unit:               aws.String(UsageUnit),
+	})
+	for paginator.HasMorePages() {
+		pageCtx, cancel := callContext(ctx, opts.CallTimeout)
+		output, err := paginator.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("error getting %s usage for detector %s: %v", feature, detectorID, err)
+		}
+		if output.UsageStatistics == nil {
+			continue
+		}
+		for _, result := range output.UsageStatistics.SumByAccount {
+			if result.Total == nil {
+				continue
+			}
+			amount, err := strconv.ParseFloat(aws.ToString(result.Total.Amount), 64)
+			if err != nil {
+				return nil, fmt.Errorf("error reading %s usage for detector %s: invalid amount %q", feature, detectorID, aws.ToString(result.Total.Amount))
+			}
+			if amount == 0 {
+				continue
+			}
+			costs = append(costs, UsageCost{
+				AccountID:  aws.ToString(result.AccountId),
+				Region:     region,
+				DetectorID: detectorID,
+				Feature:    string(feature),
+				Amount:     amount,
+			})
+		}
+	}
+	return costs, nil
+}
+
+// sortedUsage lists costs by name, most expensive first
+func sortedUsage(costs map[string]float64) []UsageTotal {
+	list := make([]UsageTotal, 0, len(costs))
+	for name, amount := range costs {
+		list = append(list, UsageTotal{Name: name, Amount: amount})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Amount != list[j].Amount {
+			return list[i].Amount > list[j].Amount
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
@@ -0,0 +1,47 @@
+package gd
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// watermarkKey identifies the findings of one detector. Detector IDs are
+// unique to an account and region.
+func watermarkKey(region, detectorID string) string {
+	return region + "/" + detectorID
+}
+
+// ExportedWatermarks returns the latest UpdatedAt of the exported findings
+// of each region and detector
+func ExportedWatermarks(results []RegionResult) map[string]time.Time {
+	marks := make(map[string]time.Time)
+	for _, result := range results {
+		for key, updated := range result.Latest {
+			if updated.After(marks[key]) {
+				marks[key] = updated
+			}
+		}
+	}
+	return marks
+}
+
+// updatedSince restricts criteria to findings updated at or after the
+// watermark, in addition to any updatedAt bounds already set. The bound is
+// inclusive so a finding updated in the same millisecond as the watermark
+// is not missed, at the cost of exporting the last finding again.
+func updatedSince(criteria *types.FindingCriteria, watermark time.Time) *types.FindingCriteria {
+	criterion := make(map[string]types.Condition)
+	if criteria != nil {
+		for field, condition := range criteria.Criterion {
+			criterion[field] = condition
+		}
+	}
+	condition := criterion["updatedAt"]
+	if since := watermark.UnixMilli(); condition.GreaterThanOrEqual == nil || *condition.GreaterThanOrEqual < since {
+		condition.GreaterThanOrEqual = aws.Int64(since)
+	}
+	criterion["updatedAt"] = condition
+	return &types.FindingCriteria{Criterion: criterion}
+}
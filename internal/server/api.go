@@ -0,0 +1,432 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+)
+
+// apiV1Prefix is where the versioned API is served. Its routes are those of
+// /api, with JSON errors, checked query parameters, and paged collections.
+const apiV1Prefix = "/api/v1"
+
+// Page sizes of the v1 collections
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// apiRoute is one operation of the API, served under /api and /api/v1 and
+// described in the OpenAPI document
+type apiRoute struct {
+	method string
+	// path is relative to the API's prefix, such as /jobs/{id}
+	path    string
+	handler http.HandlerFunc
+	summary string
+	// status is the status of a successful response, 200 by default
+	status int
+	// params are the route's own query parameters, and exportParams
+	// whether it also takes the export options
+	params       []apiParam
+	exportParams bool
+	// body and response are values of the types of the JSON request and
+	// response bodies; produces is the content type of other responses
+	body, response any
+	produces       string
+	// page serves a collection on /api/v1 a page at a time
+	page http.HandlerFunc
+	// role is the least role that may call the route: viewer, who may
+	// read, by default
+	role role
+	// audit is the action the route's requests are recorded as in the
+	// audit log, such as job.create; routes without one aren't recorded
+	audit string
+	// sameOrigin rejects cross-site browser requests to a GET route that
+	// changes state, as those of other methods always are
+	sameOrigin bool
+}
+
+// apiParam is a query parameter of an API route. Its kind is the OpenAPI
+// type of its value: string, integer, number, or boolean.
+type apiParam struct {
+	name, kind, description string
+}
+
+// pageParams are the query parameters of the paged v1 collections
+var pageParams = []apiParam{
+	{"limit", "integer", fmt.Sprintf("most items in the page, up to %d (default %d)", maxPageLimit, defaultPageLimit)},
+	{"nextToken", "string", "the nextToken of the previous page"},
+}
+
+// serverParams are the export options that the export command takes as
+// config flags rather than as flags of its own
+var serverParams = []apiParam{
+	{"format", "string", "export format, such as csv, json, ndjson, xlsx, ocsf, asff, parquet, sqlite, html, pdf, markdown, cef, or leef"},
+	{"minSeverity", "number", "skip findings below this severity"},
+	{"locale", "string", "language and date layout of html, pdf, and markdown reports: en, de, fr, or es"},
+	{"destination", "string", "where the export is stored: local, s3, both, splunk, elasticsearch, syslog, or http"},
+	{"profile", "string", "shared config profile whose credentials the export uses"},
+	{"notify", "string", "comma-separated webhooks posted to when a job finishes"},
+	{"concurrency", "integer", "maximum number of regions fetched at the same time"},
+	{"timeout", "string", "longest time spent fetching each region, such as 10m"},
+	{"callTimeout", "string", "longest time of each GuardDuty call, such as 30s"},
+	{"batchSize", "integer", "findings fetched per GetFindings call"},
+	{"maxFindings", "integer", "stop the export once it has written this many findings"},
+	{"maxDuration", "string", "stop the export after this long, such as 30m"},
+}
+
+// repeatableParams are the export options that may be given more than once
+var repeatableParams = []string{"regions", "roleArn", "type", "threatPurpose", "threatResource", "mitreTactic", "mitreTechnique", "columns", "includeAccounts", "excludeAccounts", "includeOUs", "excludeOUs"}
+
+// exportParams returns the export options, which the export endpoints,
+// presets, and schedules share with the export command
+func exportParams() []apiParam {
+	params := slices.Clone(serverParams)
+	for _, p := range cliParams {
+		params = append(params, apiParam{p.param, "string", p.usage})
+	}
+	for _, p := range cliBoolParams {
+		params = append(params, apiParam{p.param, "boolean", p.usage})
+	}
+	return params
+}
+
+// apiRoutes returns the operations of the API
+func (a *App) apiRoutes() []apiRoute {
+	findingsParams := []apiParam{
+		{"limit", "integer", fmt.Sprintf("most findings in the page, up to %d", gd.MaxFindingsPage)},
+		{"nextToken", "string", "the nextToken of the previous page"},
+	}
+	diffParams := []apiParam{
+		{"oldJob", "string", "job whose export is compared against"},
+		{"old", "string", "saved export compared against"},
+		{"newJob", "string", "job whose export is compared"},
+		{"new", "string", "saved export compared"},
+	}
+	return []apiRoute{
+		{method: "GET", path: "/regions", handler: a.handleRegions, summary: "List the enabled regions", response: []string{},
+			params: []apiParam{{"scope", "string", "region group: all, us, eu, apac, gov, or cn"}, {"profile", "string", "profile whose account's regions are listed"}}},
+		{method: "GET", path: "/profiles", handler: a.handleProfiles, summary: "List the profiles of the shared config files", response: map[string]any{}},
+		{method: "POST", path: "/sso/login", audit: "sso.login", role: roleAdmin, handler: a.handleStartSSOLogin, summary: "Start signing in to IAM Identity Center", status: http.StatusAccepted, response: ssoLoginView{},
+			params: []apiParam{{"profile", "string", "SSO profile signed in"}}},
+		{method: "GET", path: "/sso/login/{id}", handler: a.handleGetSSOLogin, summary: "Get an IAM Identity Center sign-in", response: ssoLoginView{}},
+		{method: "GET", path: "/columns", handler: a.handleColumns, summary: "List the CSV and XLSX columns", response: map[string][]string{}},
+		{method: "GET", path: "/export", audit: "export.request", role: roleOperator, sameOrigin: true, handler: a.handleExport, summary: "Run an export and wait for it to finish", exportParams: true, produces: "application/octet-stream",
+			params: []apiParam{{"stream", "boolean", "send the export as the response body"}}},
+		{method: "POST", path: "/export", audit: "job.create", role: roleOperator, handler: a.handleCreateJob, summary: "Start an export job", status: http.StatusAccepted, exportParams: true, response: jobView{}},
+		{method: "GET", path: "/export/{id}/events", handler: a.handleJobEvents, summary: "Follow the progress of a job as Server-Sent Events", produces: "text/event-stream"},
+		{method: "GET", path: "/export/{id}/socket", handler: a.handleJobSocket, summary: "Follow or cancel a job over a WebSocket", status: http.StatusSwitchingProtocols},
+		{method: "GET", path: "/preflight", handler: a.handlePreflight, summary: "Check the permissions of an export in every account and region without running it", exportParams: true, response: preflightView{}},
+		{method: "GET", path: "/statistics", handler: a.handleStatistics, summary: "Count the findings of an export by severity and type", exportParams: true, response: gd.Statistics{}},
+		{method: "GET", path: "/detectors", handler: a.handleDetectors, summary: "List the detectors of each account and region", exportParams: true, response: gd.Inventory{}},
+		{method: "POST", path: "/detectors", audit: "detector.enable", role: roleAdmin, handler: a.handleEnableDetector, summary: "Enable GuardDuty in an account and region without a detector or with a suspended one", exportParams: true, response: gd.EnabledDetector{}},
+		{method: "GET", path: "/ipsets", handler: a.handleIPSets, summary: "List the trusted IP lists and threat lists of the detectors", exportParams: true, produces: "application/octet-stream"},
+		{method: "GET", path: "/filters", handler: a.handleListFilters, summary: "List the saved filters of the detectors", exportParams: true, produces: "application/octet-stream"},
+		{method: "POST", path: "/filters", audit: "filter.create", role: roleAdmin, handler: a.handleCreateFilter, summary: "Create a filter", status: http.StatusCreated, exportParams: true, body: gd.SavedFilter{}, response: gd.SavedFilter{}},
+		{method: "PUT", path: "/filters/{name}", audit: "filter.update", role: roleAdmin, handler: a.handleUpdateFilter, summary: "Update a filter", exportParams: true, body: gd.SavedFilter{}, response: gd.SavedFilter{}},
+		{method: "DELETE", path: "/filters/{name}", audit: "filter.delete", role: roleAdmin, handler: a.handleDeleteFilter, summary: "Delete a filter", status: http.StatusNoContent, exportParams: true},
+		{method: "GET", path: "/preview", handler: a.handlePreview, summary: "Preview the first findings an export would write, in its columns", exportParams: true, response: previewView{},
+			params: []apiParam{{"limit", "integer", fmt.Sprintf("findings in the preview, up to %d (default %d)", maxPreviewLimit, defaultPreviewLimit)}}},
+		{method: "GET", path: "/digest", handler: a.handleDigest, summary: "List the most severe findings with console links, as JSON or, with format=markdown, Markdown", exportParams: true, response: digestView{},
+			params: []apiParam{{"limit", "integer", fmt.Sprintf("findings in the digest, up to %d (default %d)", gd.MaxDigestFindings, defaultDigestLimit)}}},
+		{method: "GET", path: "/findings", handler: a.handleFindings, summary: "Browse a page of the findings an export would write", exportParams: true, params: findingsParams, response: findingsPage{}},
+		{method: "POST", path: "/findings/feedback", audit: "findings.feedback", role: roleOperator, handler: a.handleFindingsFeedback, summary: "Mark findings as useful or not useful", exportParams: true, body: feedbackRequest{}, response: map[string]any{}},
+		{method: "GET", path: "/findings/{region}/{detectorId}/{findingId}", handler: a.handleFinding, summary: "Get a finding", exportParams: true, response: types.Finding{}},
+		{method: "GET", path: "/jobs/{id}", handler: a.handleGetJob, summary: "Get an export job", response: jobView{}},
+		{method: "GET", path: "/jobs/{id}/aggregates", handler: a.handleJobAggregates, summary: "Count the findings of an export job by severity, type, region, and resource", response: export.Aggregates{}},
+		{method: "GET", path: "/jobs/{id}/download", audit: "job.download", handler: a.handleDownloadJob, summary: "Download the export of a job", produces: "application/octet-stream"},
+		{method: "GET", path: "/jobs/{id}/signature", audit: "job.download", handler: a.handleJobSignature, summary: "Download the detached signature of the export of a job", produces: "application/octet-stream"},
+		{method: "POST", path: "/jobs/{id}/resume", audit: "job.resume", role: roleOperator, handler: a.handleResumeJob, summary: "Resume a failed job from its checkpoint", status: http.StatusAccepted, response: jobView{}},
+		{method: "DELETE", path: "/jobs/{id}", audit: "job.delete", role: roleOperator, handler: a.handleDeleteJob, summary: "Cancel a running job, or remove a finished one", status: http.StatusNoContent},
+		{method: "GET", path: "/downloads", handler: a.handleListDownloads, summary: "List the exports saved on the server", response: []downloadView{},
+			page: pageOf(a.downloadViews)},
+		{method: "GET", path: "/downloads/{name}", audit: "download.get", handler: a.handleDownload, summary: "Download a saved export", produces: "application/octet-stream"},
+		{method: "POST", path: "/retention/purge", audit: "retention.purge", role: roleAdmin, handler: a.handlePurgeRetention, summary: "Apply the retention policy now and purge the data it soft-deleted", response: retentionView{}},
+		{method: "POST", path: "/retention/restore", audit: "retention.restore", role: roleAdmin, handler: a.handleRestoreRetention, summary: "Restore the data the retention policy soft-deleted and has not purged", response: retentionView{}},
+		{method: "GET", path: "/diff", handler: a.handleDiff, summary: "Compare the exports of two jobs or saved exports", params: diffParams, response: diffReport{}},
+		{method: "POST", path: "/diff", handler: a.handleDiff, summary: "Compare two exports, uploaded as old and new files of a multipart form", params: diffParams, response: diffReport{}},
+		{method: "POST", path: "/merge", handler: a.handleMerge, summary: "Merge exports, uploaded as file fields of a multipart form, into one export without duplicates", produces: "application/octet-stream",
+			params: []apiParam{
+				{"format", "string", "format of the merged export (default the format setting)"},
+				{"columns", "string", "comma-separated CSV and XLSX columns (default the columns setting)"},
+				{"pretty", "boolean", "indent JSON output"},
+			}},
+		{method: "GET", path: "/schedules", handler: a.handleListSchedules, summary: "List the schedules", response: []scheduleView{},
+			page: pageOf(func() ([]scheduleView, error) { return a.scheduleViews(), nil })},
+		{method: "POST", path: "/schedules", audit: "schedule.create", role: roleAdmin, handler: a.handleCreateSchedule, summary: "Create a schedule", status: http.StatusCreated, body: scheduleConfig{}, response: scheduleView{}},
+		{method: "GET", path: "/schedules/{id}", handler: a.handleGetSchedule, summary: "Get a schedule", response: scheduleView{}},
+		{method: "PUT", path: "/schedules/{id}", audit: "schedule.update", role: roleAdmin, handler: a.handleUpdateSchedule, summary: "Update a schedule", body: scheduleConfig{}, response: scheduleView{}},
+		{method: "DELETE", path: "/schedules/{id}", audit: "schedule.delete", role: roleAdmin, handler: a.handleDeleteSchedule, summary: "Delete a schedule", status: http.StatusNoContent},
+		{method: "POST", path: "/config/reload", audit: auditConfigReload, role: roleAdmin, handler: a.handleReloadConfig, summary: "Reload the config file, applying the settings that need no restart", response: reloadView{}},
+		{method: "GET", path: "/presets", handler: a.handleListPresets, summary: "List the presets", response: []presetConfig{},
+			page: pageOf(a.presets.list)},
+		{method: "POST", path: "/presets", audit: "preset.create", role: roleAdmin, handler: a.handleCreatePreset, summary: "Create a preset", status: http.StatusCreated, body: presetConfig{}, response: presetConfig{}},
+		{method: "GET", path: "/presets/{name}", handler: a.handleGetPreset, summary: "Get a preset", response: presetConfig{}},
+		{method: "PUT", path: "/presets/{name}", audit: "preset.update", role: roleAdmin, handler: a.handleUpdatePreset, summary: "Update a preset", body: presetConfig{}, response: presetConfig{}},
+		{method: "DELETE", path: "/presets/{name}", audit: "preset.delete", role: roleAdmin, handler: a.handleDeletePreset, summary: "Delete a preset", status: http.StatusNoContent},
+		{method: "GET", path: "/history", handler: a.handleListHistory, summary: "List the export runs, newest first", response: []historyRun{},
+			page: pageOf(func() ([]historyRun, error) { return a.history.list(0) })},
+		{method: "GET", path: "/history/{id}", handler: a.handleGetHistory, summary: "Get an export run", response: historyRun{}},
+		{method: "POST", path: "/history/{id}/rerun", audit: "history.rerun", role: roleOperator, handler: a.handleRerun, summary: "Start a job repeating an export run", status: http.StatusAccepted, response: jobView{}},
+		{method: "GET", path: "/store/findings", handler: a.handleStoreFindings, summary: "Search the findings kept by the findings store, most recently updated first", response: storePage{},
+			params: []apiParam{
+				{"q", "string", "words the title or description contains, all of them; end a word with * to match it as a prefix"},
+				{"accountId", "string", "account of the findings; repeat for several"},
+				{"region", "string", "region of the findings; repeat for several"},
+				{"type", "string", "finding type, or prefix ending in *; repeat for several"},
+				{"threatPurpose", "string", "threat purpose of the finding type, such as Recon; repeat for several"},
+				{"threatResource", "string", "affected resource type of the finding type, such as EC2; repeat for several"},
+				{"mitreTactic", "string", "MITRE ATT&CK tactic the finding type maps to, by ID or name; repeat for several"},
+				{"mitreTechnique", "string", "MITRE ATT&CK technique the finding type maps to, by ID or name; repeat for several"},
+				{"minSeverity", "number", "lowest severity"},
+				{"archived", "string", "true, false, or all (default)"},
+				{"createdAfter", "string", "RFC 3339 time or YYYY-MM-DD"},
+				{"createdBefore", "string", "RFC 3339 time or YYYY-MM-DD"},
+				{"updatedAfter", "string", "RFC 3339 time or YYYY-MM-DD"},
+				{"updatedBefore", "string", "RFC 3339 time or YYYY-MM-DD"},
+				{"limit", "integer", fmt.Sprintf("most findings in the page, up to %d (default %d)", maxPageLimit, defaultPageLimit)},
+				{"nextToken", "string", "the nextToken of the previous page"},
+			}},
+		{method: "POST", path: "/store/import", audit: "store.import", role: roleOperator, handler: a.handleStoreImport, summary: "Keep the findings of exports, uploaded as file fields of a multipart form, in the findings store", response: importReport{}},
+		{method: "GET", path: "/store/trends", handler: a.handleStoreTrends, summary: "Report the weekly trends of the findings kept by the findings store", response: export.Trends{},
+			params: []apiParam{
+				{"weeks", "integer", fmt.Sprintf("weeks covered, up to and including the current one, 1 to %d (default %d)", maxTrendsWeeks, defaultTrendsWeeks)},
+				{"format", "string", "json (default), csv of the weeks, or html with charts"},
+				{"locale", "string", "language and date layout of html reports: en, de, fr, or es (default the locale setting)"},
+				{"accountId", "string", "account of the findings; repeat for several"},
+				{"region", "string", "region of the findings; repeat for several"},
+				{"type", "string", "finding type, or prefix ending in *; repeat for several"},
+				{"threatPurpose", "string", "threat purpose of the finding type, such as Recon; repeat for several"},
+				{"threatResource", "string", "affected resource type of the finding type, such as EC2; repeat for several"},
+				{"mitreTactic", "string", "MITRE ATT&CK tactic the finding type maps to, by ID or name; repeat for several"},
+				{"mitreTechnique", "string", "MITRE ATT&CK technique the finding type maps to, by ID or name; repeat for several"},
+				{"minSeverity", "number", "lowest severity"},
+			}},
+		{method: "GET", path: "/grafana", handler: a.handleGrafanaTest, summary: "Test the connection of a Grafana JSON datasource", produces: "text/plain"},
+		{method: "POST", path: "/grafana/search", handler: a.handleGrafanaSearch, summary: "List the queries of the Grafana datasource", response: []string{}},
+		{method: "POST", path: "/grafana/metrics", handler: a.handleGrafanaMetrics, summary: "List the queries of the Grafana datasource with their labels", response: []grafanaMetric{}},
+		{method: "POST", path: "/grafana/query", handler: a.handleGrafanaQuery, summary: "Answer the queries of a Grafana panel with timeseries and tables of findings", body: grafanaQuery{}, response: []any{}},
+		{method: "POST", path: "/grafana/tag-keys", handler: a.handleGrafanaTagKeys, summary: "List the ad hoc filters of the Grafana datasource", response: []grafanaTag{}},
+		{method: "POST", path: "/grafana/tag-values", handler: a.handleGrafanaTagValues, summary: "List the values of an ad hoc filter of the Grafana datasource", response: []grafanaTag{}},
+		{method: "GET", path: "/me", handler: a.handleMe, summary: "Get the signed-in user", response: map[string]any{}},
+		{method: "GET", path: "/whoami", handler: a.handleWhoami, summary: "Get the AWS identity exports run as", response: whoamiView{},
+			params: []apiParam{{"profile", "string", "profile whose identity is returned"}}},
+		{method: "GET", path: "/audit", audit: "audit.read", role: roleAdmin, handler: a.handleAudit, summary: "Read the audit log, oldest first", response: auditPage{},
+			params: []apiParam{
+				{"user", "string", "principal that acted, such as user alice"},
+				{"action", "string", "action, such as job.create, or prefix ending in *"},
+				{"after", "string", "RFC 3339 time or YYYY-MM-DD"},
+				{"before", "string", "RFC 3339 time or YYYY-MM-DD"},
+				{"limit", "integer", fmt.Sprintf("most entries in the page, up to %d (default %d)", maxPageLimit, defaultPageLimit)},
+				{"nextToken", "string", "the nextToken of the previous page"},
+			}},
+	}
+}
+
+// handleAPI registers the routes of the API under /api and /api/v1, each
+// authorizing the principal's role, rejecting cross-site requests that
+// change state, and recording audited requests, with the
+// OpenAPI document and the optional Swagger UI
+func (a *App) handleAPI(mux *http.ServeMux) {
+	routes := a.apiRoutes()
+	for _, route := range routes {
+		mux.Handle(route.method+" /api"+route.path, a.auditRoute(route, a.requireSameOrigin(route, a.authorize(route, route.handler))))
+		var handler http.Handler = route.handler
+		if route.page != nil {
+			handler = route.page
+		}
+		mux.Handle(route.method+" "+apiV1Prefix+route.path, a.auditRoute(route, a.requireSameOrigin(route, a.authorize(route, checkParams(route, handler)))))
+	}
+	document, err := json.Marshal(a.openAPI(routes))
+	if err != nil {
+		panic(fmt.Sprintf("error encoding the OpenAPI document: %v", err))
+	}
+	mux.HandleFunc("GET "+apiV1Prefix+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(document)
+	})
+	if a.config().APIDocs {
+		mux.HandleFunc("GET "+apiV1Prefix+"/docs", a.handleAPIDocs)
+	}
+	// Other v1 paths are not found, rather than served the web interface
+	mux.HandleFunc(apiV1Prefix+"/", http.NotFound)
+}
+
+// checkParams rejects v1 requests with query parameters that the route does
+// not take, such as a misspelled export option that would be ignored
+func checkParams(route apiRoute, next http.Handler) http.Handler {
+	allowed := make(map[string]bool)
+	params := route.params
+	if route.page != nil {
+		params = pageParams
+	}
+	if route.exportParams {
+		params = append(slices.Clone(params), exportParams()...)
+	}
+	for _, p := range params {
+		allowed[p.name] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name := range r.URL.Query() {
+			if !allowed[name] {
+				http.Error(w, fmt.Sprintf("Unknown parameter %q", name), http.StatusBadRequest)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// page is a page of a v1 collection. NextToken requests the next page, and
+// is left out on the last.
+type page[T any] struct {
+	Items     []T    `json:"items"`
+	NextToken string `json:"nextToken,omitempty"`
+}
+
+// pageOf serves the items that list returns a page at a time. The token of
+// a page is the position of its first item, so items added or removed
+// between requests can shift the pages that follow.
+func pageOf[T any](list func() ([]T, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultPageLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxPageLimit {
+				http.Error(w, fmt.Sprintf("Invalid limit %q: must be 1 to %d", v, maxPageLimit), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		start := 0
+		if v := r.URL.Query().Get("nextToken"); v != "" {
+			position, err := base64.RawURLEncoding.DecodeString(v)
+			n, convErr := strconv.Atoi(string(position))
+			if err != nil || convErr != nil || n < 0 {
+				http.Error(w, fmt.Sprintf("Invalid nextToken %q", v), http.StatusBadRequest)
+				return
+			}
+			start = n
+		}
+		items, err := list()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result := page[T]{Items: []T{}}
+		if start < len(items) {
+			end := min(start+limit, len(items))
+			result.Items = items[start:end]
+			if end < len(items) {
+				result.NextToken = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(end)))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// apiError is the body of the v1 API's error responses
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	// Code names the status, such as NotFound
+	Code    string `json:"code"`
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// apiErrors answers the errors of v1 requests, written as plain text by the
+// handlers, authentication, and routing, with a JSON apiError instead, and
+// points the Location of created resources at their v1 routes
+func apiErrors(base string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, apiV1Prefix+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writer := &errorWriter{ResponseWriter: w, base: base}
+		next.ServeHTTP(writer, r)
+		if writer.status == 0 {
+			return
+		}
+		message := strings.TrimSpace(writer.message.String())
+		header := w.Header()
+		header.Del("Content-Length")
+		header.Set("Content-Type", "application/json")
+		w.WriteHeader(writer.status)
+		json.NewEncoder(w).Encode(apiError{Error: apiErrorDetail{
+			Code:    strings.ReplaceAll(http.StatusText(writer.status), " ", ""),
+			Status:  writer.status,
+			Message: message,
+		}})
+	})
+}
+
+// errorWriter holds back a plain-text error response, whose status and
+// message apiErrors writes as JSON once the handler returns
+type errorWriter struct {
+	http.ResponseWriter
+	base    string
+	wrote   bool
+	status  int
+	message bytes.Buffer
+}
+
+func (e *errorWriter) WriteHeader(status int) {
+	if e.wrote {
+		return
+	}
+	e.wrote = true
+	header := e.Header()
+	if status >= 400 && strings.HasPrefix(header.Get("Content-Type"), "text/plain") {
+		e.status = status
+		return
+	}
+	if location, ok := strings.CutPrefix(header.Get("Location"), e.base+"/api/"); ok && !strings.HasPrefix(location, "v1/") {
+		header.Set("Location", e.base+apiV1Prefix+"/"+location)
+	}
+	e.ResponseWriter.WriteHeader(status)
+}
+
+func (e *errorWriter) Write(b []byte) (int, error) {
+	if !e.wrote {
+		e.WriteHeader(http.StatusOK)
+	}
+	if e.status != 0 {
+		return e.message.Write(b)
+	}
+	return e.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes through for Server-Sent Events
+func (e *errorWriter) Flush() {
+	if flusher, ok := e.ResponseWriter.(http.Flusher); ok && e.status == 0 {
+		flusher.Flush()
+	}
+}
+
+// Hijack passes the connection through for WebSockets
+func (e *errorWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(e.ResponseWriter).Hijack()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (e *errorWriter) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
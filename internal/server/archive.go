@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+
+	"guardduty/internal/gd"
+)
+
+// Archiving after export: archive archives the exported findings, and
+// dryRun only reports what would be archived
+const (
+	archiveFindings = "true"
+	archiveDryRun   = "dryRun"
+)
+
+// validArchive reports whether v is an archive option
+func validArchive(v string) bool {
+	return v == archiveFindings || v == archiveDryRun
+}
+
+// finishExport runs the steps that follow a stored export: counting it as
+// completed, recording the suppressed findings, advancing the watermarks of
+// an incremental export, filing Jira issues for the most severe findings,
+// pushing the findings rules routed, and archiving the exported findings.
+// It returns the archive report, or nil when archiving was not requested.
+func (a *App) finishExport(ctx context.Context, opts exportOptions, results []gd.RegionResult) *gd.ArchiveReport {
+	recordExportCompleted(results)
+	a.recordSuppressed(ctx, results)
+	a.commitWatermarks(ctx, opts, results)
+	if opts.jira {
+		a.fileIssues(ctx, results)
+	}
+	a.routeFindings(ctx, results)
+	if opts.archive == "" {
+		return nil
+	}
+	return gd.Archive(ctx, opts.FetchOptions, opts.archive == archiveDryRun, results)
+}
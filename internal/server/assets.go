@@ -0,0 +1,29 @@
+package server
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"os"
+)
+
+// embeddedTemplates holds the web interface, built into the binary so it is
+// served wherever the binary runs
+//
+//go:embed index.html
+var embeddedTemplates embed.FS
+
+// templateFS returns the files of the web interface: the templatesDir when
+// one is configured, for customizing the interface, or the embedded copy
+func (a *App) templateFS() fs.FS {
+	if a.config().TemplatesDir != "" {
+		return os.DirFS(a.config().TemplatesDir)
+	}
+	return embeddedTemplates
+}
+
+// indexTemplate parses the main page. A templatesDir is read on every request
+// so edits show up without restarting the server.
+func (a *App) indexTemplate() (*template.Template, error) {
+	return template.ParseFS(a.templateFS(), "index.html")
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+
+	"guardduty/internal/export"
+	"guardduty/internal/telemetry"
+)
+
+// glueBatchSize is the most partitions BatchCreatePartition adds at once
+const glueBatchSize = 100
+
+// validGlueName matches the database names Athena and the Glue Data
+// Catalog both accept
+var validGlueName = regexp.MustCompile(`^[a-z0-9_]{1,255}$`)
+
+// athenaConfig makes partitioned exports queryable in Athena as soon as
+// they are uploaded. With a Database, each export uploads the DDL of its
+// table and partitions beside the table, and with Glue the table and
+// partitions are also created in the Glue Data Catalog, so that neither
+// the DDL nor MSCK REPAIR TABLE has to be run.
+type athenaConfig struct {
+	Database string `yaml:"database"`
+	Glue     bool   `yaml:"glue"`
+	// Region is the region of the Data Catalog, by default that of the
+	// bucket
+	Region string `yaml:"region"`
+}
+
+// enabled reports whether partitioned exports register their table
+func (c athenaConfig) enabled() bool {
+	return c.Database != ""
+}
+
+func (c athenaConfig) validate() error {
+	if !c.enabled() {
+		if c.Glue || c.Region != "" {
+			return fmt.Errorf("athena.glue and athena.region require athena.database")
+		}
+		return nil
+	}
+	if !validGlueName.MatchString(c.Database) {
+		return fmt.Errorf("invalid athena.database %q: must be lowercase letters, digits, and underscores", c.Database)
+	}
+	return nil
+}
+
+// partitionTable returns the table of partitioned exports of a format,
+// which is also the prefix beneath the configured prefix that they are
+// uploaded to: Parquet and CSV files cannot share a table
+func partitionTable(format string) string {
+	if format == "csv" {
+		return "guardduty_findings_csv"
+	}
+	return "guardduty_findings"
+}
+
+// registerPartitions makes the partitions of an export that were uploaded
+// to location queryable: it uploads the export's DDL beside the table, and
+// creates the table and partitions in Glue when configured. The data is in
+// place by then, so a failure is logged without failing the export.
+func (a *App) registerPartitions(ctx context.Context, opts export.WriteOptions, filename, location string, files []string) {
+	conf := a.config().Athena
+	if !conf.enabled() {
+		return
+	}
+	log := telemetry.Logger(ctx)
+	table := partitionTable(opts.Format)
+	schema := export.NewTableSchema(opts)
+	partitions := export.FilePartitions(files)
+
+	ddl := schema.TableDDL(conf.Database, table, location, partitions)
+	key := path.Join(a.config().S3.Prefix, "athena", table, strings.TrimSuffix(filename, path.Ext(filename))+".sql")
+	if err := a.putObjectBody(ctx, strings.NewReader(ddl), key, "application/sql"); err != nil {
+		log.Error("Error uploading table DDL", "object", fmt.Sprintf("s3://%s/%s", a.config().S3.Bucket, key), "error", err)
+	} else {
+		log.Info("Uploaded table DDL", "object", fmt.Sprintf("s3://%s/%s", a.config().S3.Bucket, key))
+	}
+
+	if !conf.Glue {
+		return
+	}
+	if err := a.createGlueTable(ctx, conf.Database, table, location, schema, partitions); err != nil {
+		log.Error("Error creating Glue table", "table", conf.Database+"."+table, "error", err)
+		return
+	}
+	log.Info("Created Glue partitions", "table", conf.Database+"."+table, "partitions", len(partitions))
+}
+
+// glueStorage is the StorageDescriptor of a Glue table or partition
+type glueStorage struct {
+	Columns      []glueColumn `json:"Columns"`
+	Location     string       `json:"Location"`
+	InputFormat  string       `json:"InputFormat"`
+	OutputFormat string       `json:"OutputFormat"`
+	SerdeInfo    struct {
+		SerializationLibrary string            `json:"SerializationLibrary"`
+		Parameters           map[string]string `json:"Parameters,omitempty"`
+	} `json:"SerdeInfo"`
+}
+
+type glueColumn struct {
+	Name string `json:"Name"`
+	Type string `json:"Type"`
+}
+
+// glueColumns converts table columns to those of the Glue API
+func glueColumns(columns []export.TableColumn) []glueColumn {
+	converted := make([]glueColumn, len(columns))
+	for i, column := range columns {
+		converted[i] = glueColumn{column.Name, column.Type}
+	}
+	return converted
+}
+
+// glueStorageOf returns the storage of schema's files at location
+func glueStorageOf(schema export.TableSchema, location string) glueStorage {
+	storage := glueStorage{Columns: glueColumns(schema.Columns), Location: location, InputFormat: schema.InputFormat, OutputFormat: schema.OutputFormat}
+	storage.SerdeInfo.SerializationLibrary = schema.SerDe
+	storage.SerdeInfo.Parameters = schema.SerDeParameters
+	return storage
+}
+
+// createGlueTable creates the database and the table over location unless
+// they exist, and adds the partitions that are missing. A table that
+// exists is left as it is.
+func (a *App) createGlueTable(ctx context.Context, database, table, location string, schema export.TableSchema, partitions []export.Partition) error {
+	err := a.glueRequest(ctx, "CreateDatabase", map[string]any{"DatabaseInput": map[string]any{"Name": database}}, nil)
+	if err != nil && !isGlueError(err, "AlreadyExistsException") {
+		return err
+	}
+
+	parameters := map[string]string{"EXTERNAL": "TRUE"}
+	for name, value := range schema.Parameters {
+		parameters[name] = value
+	}
+	err = a.glueRequest(ctx, "CreateTable", map[string]any{
+		"DatabaseName": database,
+		"TableInput": map[string]any{
+			"Name":              table,
+			"TableType":         "EXTERNAL_TABLE",
+			"Parameters":        parameters,
+			"PartitionKeys":     glueColumns(export.PartitionKeys),
+			"StorageDescriptor": glueStorageOf(schema, location),
+		},
+	}, nil)
+	if err != nil && !isGlueError(err, "AlreadyExistsException") {
+		return err
+	}
+
+	for start := 0; start < len(partitions); start += glueBatchSize {
+		batch := partitions[start:min(start+glueBatchSize, len(partitions))]
+		inputs := make([]map[string]any, len(batch))
+		for i, partition := range batch {
+			inputs[i] = map[string]any{"Values": partition.Values, "StorageDescriptor": glueStorageOf(schema, location+partition.Dir+"/")}
+		}
+		var out struct {
+			Errors []struct {
+				PartitionValues []string `json:"PartitionValues"`
+				ErrorDetail     struct {
+					ErrorCode    string `json:"ErrorCode"`
+					ErrorMessage string `json:"ErrorMessage"`
+				} `json:"ErrorDetail"`
+			} `json:"Errors"`
+		}
+		if err := a.glueRequest(ctx, "BatchCreatePartition", map[string]any{"DatabaseName": database, "TableName": table, "PartitionInputList": inputs}, &out); err != nil {
+			return err
+		}
+		for _, failure := range out.Errors {
+			if failure.ErrorDetail.ErrorCode != "AlreadyExistsException" {
+				return fmt.Errorf("error creating partition %s: %s: %s", strings.Join(failure.PartitionValues, "/"), failure.ErrorDetail.ErrorCode, failure.ErrorDetail.ErrorMessage)
+			}
+		}
+	}
+	return nil
+}
+
+// glueError is a failure the Glue API described with its error code
+type glueError struct {
+	action  string
+	status  string
+	code    string
+	message string
+}
+
+func (e *glueError) Error() string {
+	return fmt.Sprintf("error calling Glue %s: %s: %s", e.action, e.status, strings.TrimSpace(e.code+": "+e.message))
+}
+
+// isGlueError reports whether err is a Glue failure with code
+func isGlueError(err error, code string) bool {
+	var failure *glueError
+	return errors.As(err, &failure) && failure.code == code
+}
+
+// glueRequest calls a Glue action with the JSON protocol, signed with the
+// server's AWS credentials, and decodes its response into out unless it is
+// nil
+func (a *App) glueRequest(ctx context.Context, action string, input, out any) error {
+	region := a.glueRegion()
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("error calling Glue %s: %v", action, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.glueEndpoint(region)+"/", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("error calling Glue %s: %v", action, err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AWSGlue."+action)
+	creds, err := a.awsCfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("error calling Glue %s: %v", action, err)
+	}
+	hash := sha256.Sum256(payload)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), "glue", region, time.Now()); err != nil {
+		return fmt.Errorf("error calling Glue %s: %v", action, err)
+	}
+	resp, err := a.awsCfg.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling Glue %s: %v", action, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, siemMaxResponseLength))
+	if resp.StatusCode != http.StatusOK {
+		// Glue describes failures as {"__type": ..., "Message": ...}
+		var failure struct {
+			Type    string `json:"__type"`
+			Message string `json:"Message"`
+		}
+		e := &glueError{action: action, status: resp.Status, message: strings.TrimSpace(string(data))}
+		if json.Unmarshal(data, &failure) == nil && failure.Type != "" {
+			_, code, found := strings.Cut(failure.Type, "#")
+			if !found {
+				code = failure.Type
+			}
+			e.code, e.message = code, failure.Message
+		}
+		return e
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("error reading Glue %s response: %v", action, err)
+	}
+	return nil
+}
+
+// glueRegion returns the region of the Data Catalog: athena.region, or the
+// region of the bucket
+func (a *App) glueRegion() string {
+	conf := a.config()
+	switch {
+	case conf.Athena.Region != "":
+		return conf.Athena.Region
+	case conf.S3.Region != "":
+		return conf.S3.Region
+	}
+	return a.awsCfg.Region
+}
+
+// glueEndpoint returns the base URL of the Glue API in region: the glue
+// endpoint or the endpoint replacing every service when one is set
+func (a *App) glueEndpoint(region string) string {
+	if endpoint := a.config().Endpoints["glue"]; endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	if a.config().EndpointURL != "" {
+		return strings.TrimSuffix(a.config().EndpointURL, "/")
+	}
+	host := "glue"
+	if a.config().UseFIPS {
+		host = "glue-fips"
+	}
+	suffix := "amazonaws.com"
+	if strings.HasPrefix(region, "cn-") {
+		suffix = "amazonaws.com.cn"
+	}
+	return fmt.Sprintf("https://%s.%s.%s", host, region, suffix)
+}
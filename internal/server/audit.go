@@ -0,0 +1,478 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwltypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+
+	"guardduty/internal/telemetry"
+)
+
+// defaultAuditStream is the CloudWatch Logs stream of the audit log when no
+// logStream is configured
+const defaultAuditStream = "guardduty-export"
+
+// maxAuditBody is the largest request body recorded with an entry, enough
+// for any schedule, preset, or filter
+const maxAuditBody = 64 << 10
+
+// The actions of audit entries that aren't API requests
+const (
+	auditServerStart = "server.start"
+	auditExportRun   = "export.run"
+	auditJobCancel   = "job.cancel"
+)
+
+// auditConfig sends an append-only record of who exported what, who
+// downloaded which exports, and who changed schedules, presets, and filters
+// to a file, CloudWatch Logs, or both. Nothing in the server changes an
+// entry once written, and only the retention policy's auditMaxAge removes
+// entries from the file.
+type auditConfig struct {
+	// File is appended one JSON entry per line
+	File string `yaml:"file"`
+	// LogGroup is the CloudWatch Logs group the entries are put in, in
+	// LogStream, which is created if it doesn't exist
+	LogGroup  string `yaml:"logGroup"`
+	LogStream string `yaml:"logStream"`
+}
+
+func (c auditConfig) enabled() bool {
+	return c.File != "" || c.LogGroup != ""
+}
+
+// validate reports an invalid stream
+func (c auditConfig) validate() error {
+	if c.LogStream != "" && c.LogGroup == "" {
+		return fmt.Errorf("invalid audit.logStream %q: requires audit.logGroup", c.LogStream)
+	}
+	if strings.ContainsAny(c.LogStream, ":*") {
+		return fmt.Errorf("invalid audit.logStream %q: must not contain : or *", c.LogStream)
+	}
+	return nil
+}
+
+// auditEntry is one action in the audit log. Entries of API requests have
+// their method, path, status, and parameters; those of export runs the run,
+// the accounts and regions it touched, and its outcome.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user,omitempty"`
+	Action string    `json:"action"`
+
+	Method     string              `json:"method,omitempty"`
+	Path       string              `json:"path,omitempty"`
+	Status     int                 `json:"status,omitempty"`
+	RemoteAddr string              `json:"remoteAddr,omitempty"`
+	Params     map[string][]string `json:"params,omitempty"`
+	// Body is the JSON body of a request that changes a schedule, preset,
+	// or filter
+	Body json.RawMessage `json:"body,omitempty"`
+
+	RunID    string    `json:"runId,omitempty"`
+	JobID    string    `json:"jobId,omitempty"`
+	Schedule string    `json:"schedule,omitempty"`
+	Source   string    `json:"source,omitempty"`
+	Targets  []string  `json:"targets,omitempty"`
+	Findings int       `json:"findings,omitempty"`
+	Outcome  jobStatus `json:"outcome,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// auditLog writes the entries of the audit log. Entries are written one at
+// a time, so each is stored before the request it records is answered.
+type auditLog struct {
+	mu     sync.Mutex
+	path   string
+	logs   *cloudwatchlogs.Client
+	group  string
+	stream string
+	// streamReady is set once the stream is known to exist
+	streamReady bool
+}
+
+// newAuditLog returns the audit log of c, or nil when it is off
+func newAuditLog(c auditConfig, cfg aws.Config) *auditLog {
+	if !c.enabled() {
+		return nil
+	}
+	l := &auditLog{path: c.File, group: c.LogGroup, stream: c.LogStream}
+	if l.stream == "" {
+		l.stream = defaultAuditStream
+	}
+	if c.LogGroup != "" {
+		l.logs = cloudwatchlogs.NewFromConfig(cfg)
+	}
+	return l
+}
+
+// add writes an entry to the file and to CloudWatch Logs
+func (l *auditLog) add(ctx context.Context, entry auditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding audit entry: %v", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path != "" {
+		file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("error writing audit file %s: %v", l.path, err)
+		}
+		_, err = file.Write(append(data, '\n'))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("error writing audit file %s: %v", l.path, err)
+		}
+	}
+	if l.logs == nil {
+		return nil
+	}
+	if !l.streamReady {
+		_, err := l.logs.CreateLogStream(ctx, &cloudwatchlogs.CreateLogStreamInput{LogGroupName: aws.String(l.group), LogStreamName: aws.String(l.stream)})
+		var exists *cwltypes.ResourceAlreadyExistsException
+		if err != nil && !errors.As(err, &exists) {
+			return fmt.Errorf("error creating audit log stream %s: %v", l.stream, err)
+		}
+		l.streamReady = true
+	}
+	_, err = l.logs.PutLogEvents(ctx, &cloudwatchlogs.PutLogEventsInput{
+		LogGroupName:  aws.String(l.group),
+		LogStreamName: aws.String(l.stream),
+		LogEvents:     []cwltypes.InputLogEvent{{Message: aws.String(string(data)), Timestamp: aws.Int64(entry.Time.UnixMilli())}},
+	})
+	if err != nil {
+		return fmt.Errorf("error putting audit entry in log group %s: %v", l.group, err)
+	}
+	return nil
+}
+
+// purge removes the entries of the file written before cutoff, returning
+// how many. The rest of the file is kept as it was, lines that cannot be
+// parsed among them.
+func (l *auditLog) purge(cutoff time.Time) (int, error) {
+	if l.path == "" {
+		return 0, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading audit file %s: %v", l.path, err)
+	}
+	var kept bytes.Buffer
+	n := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry struct {
+			Time time.Time `json:"time"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.Time.Before(cutoff) {
+			n++
+			continue
+		}
+		kept.Write(scanner.Bytes())
+		kept.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("error reading audit file %s: %v", l.path, err)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := writeFileAtomic(l.path, kept.Bytes()); err != nil {
+		return 0, fmt.Errorf("error writing audit file %s: %v", l.path, err)
+	}
+	return n, nil
+}
+
+// auditQuery selects entries of the audit log
+type auditQuery struct {
+	user, action  string
+	after, before time.Time
+	limit         int
+	token         string
+}
+
+// matches reports whether an entry is selected. An action ending in *
+// matches as a prefix, such as preset.*.
+func (q auditQuery) matches(entry auditEntry) bool {
+	if q.user != "" && entry.User != q.user {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(q.action, "*"); ok {
+		if !strings.HasPrefix(entry.Action, prefix) {
+			return false
+		}
+	} else if q.action != "" && entry.Action != q.action {
+		return false
+	}
+	return (q.after.IsZero() || !entry.Time.Before(q.after)) && (q.before.IsZero() || entry.Time.Before(q.before))
+}
+
+// list returns a page of the selected entries, oldest first, and the token
+// of the next page. The file is read when there is one, and CloudWatch Logs
+// otherwise.
+func (l *auditLog) list(ctx context.Context, q auditQuery) ([]auditEntry, string, error) {
+	if l.path != "" {
+		return l.listFile(q)
+	}
+	return l.listLogs(ctx, q)
+}
+
+// listFile reads a page of entries from the file. Its token is the number
+// of lines read before the page.
+func (l *auditLog) listFile(q auditQuery) ([]auditEntry, string, error) {
+	offset := 0
+	if q.token != "" {
+		n, err := strconv.Atoi(q.token)
+		if err != nil || n < 0 {
+			return nil, "", errInvalidToken
+		}
+		offset = n
+	}
+	file, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading audit file %s: %v", l.path, err)
+	}
+	defer file.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for line := 0; scanner.Scan(); line++ {
+		if line < offset {
+			continue
+		}
+		var entry auditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil || !q.matches(entry) {
+			continue
+		}
+		if len(entries) == q.limit {
+			return entries, strconv.Itoa(line), nil
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", fmt.Errorf("error reading audit file %s: %v", l.path, err)
+	}
+	return entries, "", nil
+}
+
+// listLogs reads a page of entries from the stream. Each call asks for no
+// more events than the page still needs, so no event is skipped between
+// pages, and its token is CloudWatch Logs' own.
+func (l *auditLog) listLogs(ctx context.Context, q auditQuery) ([]auditEntry, string, error) {
+	input := &cloudwatchlogs.FilterLogEventsInput{LogGroupName: aws.String(l.group), LogStreamNames: []string{l.stream}}
+	if !q.after.IsZero() {
+		input.StartTime = aws.Int64(q.after.UnixMilli())
+	}
+	if !q.before.IsZero() {
+		input.EndTime = aws.Int64(q.before.UnixMilli() - 1)
+	}
+	if q.token != "" {
+		input.NextToken = aws.String(q.token)
+	}
+	var entries []auditEntry
+	for {
+		input.Limit = aws.Int32(int32(q.limit - len(entries)))
+		out, err := l.logs.FilterLogEvents(ctx, input)
+		if err != nil {
+			return nil, "", fmt.Errorf("error reading audit log group %s: %v", l.group, err)
+		}
+		for _, event := range out.Events {
+			var entry auditEntry
+			if json.Unmarshal([]byte(aws.ToString(event.Message)), &entry) == nil && q.matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		token := aws.ToString(out.NextToken)
+		if token == "" || len(entries) == q.limit {
+			return entries, token, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// errInvalidToken is the error of a nextToken that no page returned
+var errInvalidToken = errors.New("invalid nextToken")
+
+// recordAudit adds an entry to the audit log, if there is one, even once
+// ctx is canceled, as that of a canceled job is. A failure is logged as an
+// error, as the action is already done.
+func (a *App) recordAudit(ctx context.Context, entry auditEntry) {
+	if a.audit == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	if err := a.audit.add(context.WithoutCancel(ctx), entry); err != nil {
+		telemetry.Logger(ctx).Error("Error recording audit entry", "action", entry.Action, "error", err)
+	}
+}
+
+// auditRun records a finished export run with the accounts and regions it
+// touched
+func (a *App) auditRun(ctx context.Context, run historyRun) {
+	entry := auditEntry{
+		User:     run.User,
+		Action:   auditExportRun,
+		Params:   run.Params,
+		RunID:    run.ID,
+		JobID:    run.JobID,
+		Schedule: run.Schedule,
+		Source:   run.Source,
+		Findings: run.Findings,
+		Outcome:  run.Status,
+		Error:    run.Error,
+	}
+	for _, region := range run.Regions {
+		entry.Targets = append(entry.Targets, region.Target)
+	}
+	a.recordAudit(ctx, entry)
+}
+
+// auditStart records the server starting with its config file, whose hash
+// shows whether the config changed since the last start
+func (a *App) auditStart(ctx context.Context, configPath string) {
+	entry := auditEntry{Action: auditServerStart}
+	if configPath != "" {
+		entry.Params = map[string][]string{"config": {configPath}}
+		if data, err := os.ReadFile(configPath); err == nil {
+			sum := sha256.Sum256(data)
+			entry.Params["sha256"] = []string{hex.EncodeToString(sum[:])}
+		}
+	}
+	a.recordAudit(ctx, entry)
+}
+
+// auditRoute records the requests of a route that has an audit action,
+// rejected ones among them, once they have been answered. The job a
+// request started is read from its Location.
+func (a *App) auditRoute(route apiRoute, next http.Handler) http.Handler {
+	if a.audit == nil || route.audit == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := auditEntry{
+			User:       requestUser(r.Context()),
+			Action:     route.audit,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			RemoteAddr: r.RemoteAddr,
+			Params:     r.URL.Query(),
+		}
+		if route.body != nil && r.Body != nil {
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxAuditBody+1))
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			if err == nil && len(body) <= maxAuditBody && json.Valid(body) {
+				entry.Body = body
+			}
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now().UTC()
+		next.ServeHTTP(recorder, r)
+		entry.Time = start
+		entry.Status = recorder.status
+		if id, ok := strings.CutPrefix(recorder.Header().Get("Location"), a.path("/api/jobs/")); ok {
+			entry.JobID = id
+		}
+		a.recordAudit(r.Context(), entry)
+	})
+}
+
+// auditPage is a page of the audit log
+type auditPage struct {
+	Items []auditEntry `json:"items"`
+	// NextToken requests the next page, and is left out on the last
+	NextToken string `json:"nextToken,omitempty"`
+}
+
+// handleAudit returns a page of the audit log, oldest first
+func (a *App) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if a.audit == nil {
+		http.Error(w, "The audit log is not enabled: set audit.file or audit.logGroup", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	q := auditQuery{user: query.Get("user"), action: query.Get("action"), limit: defaultPageLimit}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit %q: must be 1 to %d", v, maxPageLimit), http.StatusBadRequest)
+			return
+		}
+		q.limit = n
+	}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"after", &q.after}, {"before", &q.before}} {
+		v := query.Get(bound.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			if t, err = time.Parse("2006-01-02", v); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s %q: must be an RFC 3339 time or YYYY-MM-DD", bound.name, v), http.StatusBadRequest)
+				return
+			}
+		}
+		*bound.t = t
+	}
+	if v := query.Get("nextToken"); v != "" {
+		token, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid nextToken %q", v), http.StatusBadRequest)
+			return
+		}
+		q.token = string(token)
+	}
+
+	entries, token, err := a.audit.list(r.Context(), q)
+	if errors.Is(err, errInvalidToken) {
+		http.Error(w, fmt.Sprintf("Invalid nextToken %q", query.Get("nextToken")), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		telemetry.Logger(r.Context()).Error("Error reading audit log", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := auditPage{Items: entries}
+	if result.Items == nil {
+		result.Items = []auditEntry{}
+	}
+	if token != "" {
+		result.NextToken = base64.RawURLEncoding.EncodeToString([]byte(token))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"guardduty/internal/telemetry"
+)
+
+// minAPIKeyLength is the shortest API key accepted, so keys cannot be
+// guessed by trying every short string
+const minAPIKeyLength = 16
+
+// authConfig protects the /api endpoints. With no users, API keys, or OIDC
+// provider, the endpoints are open to anyone who can reach the server.
+type authConfig struct {
+	// Users sign in with HTTP basic authentication, as the web interface's
+	// browser prompt does
+	Users []authUser `yaml:"users"`
+	// APIKeys are sent by scripts in an X-API-Key header or as an
+	// Authorization bearer token
+	APIKeys []apiKey `yaml:"apiKeys"`
+	// OIDC signs users in to the web interface through an OpenID Connect
+	// identity provider such as Okta, Entra ID, or Cognito
+	OIDC oidcConfig `yaml:"oidc"`
+}
+
+type authUser struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"`
+	// Role is viewer, operator, or admin, the default
+	Role string `yaml:"role"`
+}
+
+// apiKey is a static key. Its name identifies the key's holder in the
+// audit log without the key itself being logged.
+type apiKey struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+	// Role is viewer, operator, or admin, the default
+	Role string `yaml:"role"`
+}
+
+// enabled reports whether requests must authenticate
+func (c authConfig) enabled() bool {
+	return len(c.Users) > 0 || len(c.APIKeys) > 0 || c.OIDC.enabled()
+}
+
+// validate reports the first invalid user or key
+func (c authConfig) validate(basePath string) error {
+	names := make(map[string]bool)
+	for _, user := range c.Users {
+		if user.Name == "" || strings.Contains(user.Name, ":") {
+			return fmt.Errorf("invalid auth user %q: name must be set and must not contain a colon", user.Name)
+		}
+		if user.Password == "" {
+			return fmt.Errorf("invalid auth user %q: password must be set", user.Name)
+		}
+		if _, err := parseRole(user.Role); err != nil {
+			return fmt.Errorf("invalid auth user %q: %v", user.Name, err)
+		}
+		if names["user "+user.Name] {
+			return fmt.Errorf("invalid auth user %q: listed more than once", user.Name)
+		}
+		names["user "+user.Name] = true
+	}
+	for _, key := range c.APIKeys {
+		if key.Name == "" {
+			return fmt.Errorf("invalid auth API key: name must be set")
+		}
+		if len(key.Key) < minAPIKeyLength {
+			return fmt.Errorf("invalid auth API key %q: key must be at least %d characters", key.Name, minAPIKeyLength)
+		}
+		if _, err := parseRole(key.Role); err != nil {
+			return fmt.Errorf("invalid auth API key %q: %v", key.Name, err)
+		}
+		if names["key "+key.Name] {
+			return fmt.Errorf("invalid auth API key %q: listed more than once", key.Name)
+		}
+		names["key "+key.Name] = true
+	}
+	return c.OIDC.validate(basePath)
+}
+
+// secretsEqual compares secrets in constant time. Both are hashed first, so
+// the time taken does not reveal the length of the expected secret either.
+func secretsEqual(given, expected string) bool {
+	g, e := sha256.Sum256([]byte(given)), sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(g[:], e[:]) == 1
+}
+
+// principal is who a request authenticated as
+type principal struct {
+	// name identifies the principal in the audit log and on export jobs,
+	// such as "user alice", "key ci", or "oidc alice@example.com"
+	name string
+	// groups are the identity provider groups of an OIDC user
+	groups []string
+	// role is what the principal may do
+	role role
+}
+
+type principalKey struct{}
+
+// requestUser returns the name of the principal that made the request ctx
+// belongs to, or an empty string when authentication is off
+func requestUser(ctx context.Context) string {
+	p, _ := ctx.Value(principalKey{}).(principal)
+	return p.name
+}
+
+// authenticate returns the user or API key that a request's credentials
+// match. Every user and key is compared, so the time taken does not depend
+// on which of them matched.
+func (c authConfig) authenticate(r *http.Request) (principal, bool) {
+	var matched principal
+	if key := requestAPIKey(r); key != "" {
+		for _, k := range c.APIKeys {
+			if secretsEqual(key, k.Key) && matched.name == "" {
+				matched.name = "key " + k.Name
+				matched.role, _ = parseRole(k.Role)
+			}
+		}
+	} else if name, password, ok := r.BasicAuth(); ok {
+		for _, user := range c.Users {
+			if secretsEqual(name, user.Name) && secretsEqual(password, user.Password) && matched.name == "" {
+				matched.name = "user " + user.Name
+				matched.role, _ = parseRole(user.Role)
+			}
+		}
+	}
+	return matched, matched.name != ""
+}
+
+// requestAPIKey returns the API key in an X-API-Key header or an
+// Authorization bearer token
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// requireAuth rejects /api requests that do not authenticate as one of the
+// configured users or API keys or with an OIDC session, and logs every
+// authenticated request with its principal for auditing. Messages logged
+// while handling the request carry the principal too. With OIDC, the web
+// interface redirects to the identity provider to sign in; otherwise it
+// stays open, and /metrics always does. Requests that change state are
+// rejected when a browser sent them from another site, so a page there
+// cannot act with the user's credentials; GET routes that change state
+// reject them through requireSameOrigin. Each route then authorizes the
+// principal's role.
+func (a *App) requireAuth(next http.Handler) http.Handler {
+	c := a.config().Auth
+	if !c.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api := strings.HasPrefix(r.URL.Path, "/api/")
+		if !api && (a.oidc == nil || r.URL.Path != "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		l := telemetry.Logger(r.Context())
+		if api && r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions && rejectCrossSite(w, r) {
+			return
+		}
+		p, ok := c.authenticate(r)
+		if !ok && a.oidc != nil {
+			p, ok = a.oidc.session(r)
+		}
+		if !ok {
+			if !api {
+				http.Redirect(w, r, a.path(oidcLoginPath)+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			l.Warn("Rejected unauthenticated request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			if len(c.Users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="guardduty-export", charset="UTF-8"`)
+			}
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		l = l.With("principal", p.name)
+		l.Info("Authenticated request", "method", r.Method, "path", r.URL.Path, "role", p.role.String(), "remote_addr", r.RemoteAddr)
+		ctx := context.WithValue(telemetry.WithLogger(r.Context(), l), principalKey{}, p)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireSameOrigin rejects the requests that browsers sent from pages of
+// other sites to a GET route that changes state, such as GET /api/export,
+// which writes files and pushes findings to destinations
+func (a *App) requireSameOrigin(route apiRoute, next http.Handler) http.Handler {
+	if !a.config().Auth.enabled() || !route.sameOrigin {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rejectCrossSite(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// rejectCrossSite answers a request that checkSameOrigin rejects with 403
+// Forbidden, reporting whether it did
+func rejectCrossSite(w http.ResponseWriter, r *http.Request) bool {
+	err := checkSameOrigin(r)
+	if err == nil {
+		return false
+	}
+	telemetry.Logger(r.Context()).Warn("Rejected cross-site request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr, "error", err)
+	http.Error(w, "Cross-site requests are not allowed", http.StatusForbidden)
+	return true
+}
+
+// checkSameOrigin rejects requests that browsers sent from pages of other
+// sites, which carry the user's basic authentication or session cookie
+// along. Clients other than browsers send neither Origin nor
+// Sec-Fetch-Site and are allowed.
+func checkSameOrigin(r *http.Request) error {
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return errors.New("cross-site request")
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return fmt.Errorf("cross-origin request from %s", origin)
+	}
+	return nil
+}
+
+// handleMe returns who the request authenticated as, for the web interface
+// to show the signed-in user and what their role allows
+func (a *App) handleMe(w http.ResponseWriter, r *http.Request) {
+	p, ok := r.Context().Value(principalKey{}).(principal)
+	if !ok {
+		p.role = roleAdmin
+	}
+	var signOut string
+	if a.oidc != nil && strings.HasPrefix(p.name, oidcPrincipalPrefix) {
+		signOut = a.path(oidcLogoutPath)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		User      string   `json:"user,omitempty"`
+		Groups    []string `json:"groups,omitempty"`
+		Role      string   `json:"role"`
+		CanExport bool     `json:"canExport"`
+		CanAdmin  bool     `json:"canAdmin"`
+		// SignOut is set for OIDC sessions, which sign out by posting to it
+		SignOut string `json:"signOut,omitempty"`
+	}{p.name, p.groups, p.role.String(), p.role >= roleOperator, p.role >= roleAdmin, signOut})
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// tlsVersions are the TLS versions that awsHttp.tlsMinVersion takes
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+// awsHTTPConfig is the HTTP client of every AWS call, including the SES, KMS,
+// and SQS requests the exporter signs itself. Settings left empty keep the
+// SDK's defaults, which read the proxy from HTTPS_PROXY and NO_PROXY.
+type awsHTTPConfig struct {
+	// ProxyURL is the proxy AWS requests go through, an http, https, or
+	// socks5 URL that may hold credentials; NoProxy lists the hosts, domains
+	// such as .internal, and CIDR ranges reached directly instead
+	ProxyURL string   `yaml:"proxyUrl"`
+	NoProxy  []string `yaml:"noProxy"`
+	// CABundle is a PEM file of certificates trusted besides the system's,
+	// such as the private CA of a proxy that inspects TLS
+	CABundle string `yaml:"caBundle"`
+	// ClientCert and ClientKey are a PEM certificate and key presented to
+	// proxies and endpoints that require one
+	ClientCert string `yaml:"clientCert"`
+	ClientKey  string `yaml:"clientKey"`
+	// TLSMinVersion is the oldest TLS version accepted: 1.2 or 1.3
+	TLSMinVersion string `yaml:"tlsMinVersion"`
+	// ConnectTimeout bounds opening a connection, and ReadTimeout waiting
+	// for the response headers of a request once it is sent; zero keeps the
+	// SDK's 30 seconds and no limit
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	ReadTimeout    time.Duration `yaml:"readTimeout"`
+}
+
+func (c awsHTTPConfig) validate() error {
+	if c.ProxyURL != "" {
+		u, err := url.Parse(c.ProxyURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+			return fmt.Errorf("invalid awsHttp.proxyUrl: must be an http, https, or socks5 URL")
+		}
+	}
+	if len(c.NoProxy) > 0 && c.ProxyURL == "" {
+		return fmt.Errorf("invalid awsHttp.noProxy: requires proxyUrl")
+	}
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		return fmt.Errorf("invalid awsHttp: clientCert and clientKey must be set together")
+	}
+	if _, ok := tlsVersions[c.TLSMinVersion]; c.TLSMinVersion != "" && !ok {
+		return fmt.Errorf("invalid awsHttp.tlsMinVersion %q: must be 1.2 or 1.3", c.TLSMinVersion)
+	}
+	if c.ConnectTimeout < 0 {
+		return fmt.Errorf("invalid awsHttp.connectTimeout %v: must not be negative", c.ConnectTimeout)
+	}
+	if c.ReadTimeout < 0 {
+		return fmt.Errorf("invalid awsHttp.readTimeout %v: must not be negative", c.ReadTimeout)
+	}
+	return nil
+}
+
+// configured reports whether any setting replaces an SDK default
+func (c awsHTTPConfig) configured() bool {
+	return c.ProxyURL != "" || c.CABundle != "" || c.ClientCert != "" || c.TLSMinVersion != "" || c.ConnectTimeout > 0 || c.ReadTimeout > 0
+}
+
+// newAWSHTTPClient builds the SDK HTTP client of the awsHttp setting. The
+// files it names are read here, so a bundle or key that cannot be used stops
+// the server from starting rather than failing its AWS calls.
+func newAWSHTTPClient(c awsHTTPConfig) (aws.HTTPClient, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if v, ok := tlsVersions[c.TLSMinVersion]; ok {
+		tlsConfig.MinVersion = v
+	}
+	if c.CABundle != "" {
+		pem, err := os.ReadFile(c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("invalid awsHttp.caBundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid awsHttp.caBundle %s: holds no PEM certificates", c.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid awsHttp.clientCert: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	client := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.TLSClientConfig = tlsConfig
+		if c.ProxyURL != "" {
+			// The proxy is used for both schemes, as HTTPS_PROXY and
+			// HTTP_PROXY together would be, so custom http endpoints
+			// go through it too
+			proxy := (&httpproxy.Config{HTTPProxy: c.ProxyURL, HTTPSProxy: c.ProxyURL, NoProxy: strings.Join(c.NoProxy, ",")}).ProxyFunc()
+			tr.Proxy = func(req *http.Request) (*url.URL, error) { return proxy(req.URL) }
+		}
+		if c.ReadTimeout > 0 {
+			tr.ResponseHeaderTimeout = c.ReadTimeout
+		}
+	})
+	if c.ConnectTimeout > 0 {
+		client = client.WithDialerOptions(func(d *net.Dialer) {
+			d.Timeout = c.ConnectTimeout
+		})
+	}
+	return client, nil
+}
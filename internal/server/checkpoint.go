@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// openCheckpoint opens the checkpoint of a new job in a directory of
+// CheckpointDir named by its ID, or returns nil when checkpointing is off.
+// A job whose checkpoint cannot be opened runs without one.
+func (a *App) openCheckpoint(jobID string) *gd.Checkpoint {
+	if a.config().CheckpointDir == "" {
+		return nil
+	}
+	checkpoint, err := gd.OpenCheckpoint(filepath.Join(a.config().CheckpointDir, jobID))
+	if err != nil {
+		slog.Warn("Error opening checkpoint", "job_id", jobID, "error", err)
+		return nil
+	}
+	return checkpoint
+}
+
+// removeCheckpoint deletes a job's checkpoint, if it has one
+func (a *App) removeCheckpoint(ctx context.Context, checkpoint *gd.Checkpoint) {
+	if checkpoint == nil {
+		return
+	}
+	if err := checkpoint.Remove(); err != nil {
+		telemetry.Logger(ctx).Error("Error removing checkpoint", "dir", checkpoint.Dir(), "error", err)
+	}
+}
+
+// removeStaleCheckpoints deletes the checkpoints left in CheckpointDir by a
+// previous run of the server, whose jobs are gone
+func (a *App) removeStaleCheckpoints() {
+	if a.config().CheckpointDir == "" {
+		return
+	}
+	entries, err := os.ReadDir(a.config().CheckpointDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Error reading checkpoint directory", "dir", a.config().CheckpointDir, "error", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(a.config().CheckpointDir, entry.Name())); err != nil {
+			slog.Warn("Error removing stale checkpoint", "job_id", entry.Name(), "error", err)
+		}
+	}
+}
+
+// handleResumeJob starts a job that resumes a failed one from its
+// checkpoint, with the same accounts, regions, and options. The findings
+// checkpointed before the failure are read back rather than fetched again,
+// and the checkpoint moves to the new job, so a job is resumed only once.
+func (a *App) handleResumeJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.lookupJob(w, r)
+	if !ok {
+		return
+	}
+
+	job.mu.Lock()
+	switch {
+	case job.status != jobFailed:
+		job.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Job is %s; only failed jobs can be resumed", job.status), http.StatusConflict)
+		return
+	case job.resumedBy != "":
+		job.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Job was already resumed by job %s", job.resumedBy), http.StatusConflict)
+		return
+	case job.opts.Checkpoint == nil:
+		job.mu.Unlock()
+		http.Error(w, "Job has no checkpoint to resume from", http.StatusConflict)
+		return
+	}
+	opts := job.opts
+	job.opts.Checkpoint = nil
+	job.mu.Unlock()
+	opts.user = requestUser(r.Context())
+	opts.resumeOf = job.id
+
+	resumed := a.startJob(opts, "")
+	job.mu.Lock()
+	job.resumedBy = resumed.id
+	job.mu.Unlock()
+	targets, findings := opts.Checkpoint.Progress()
+	telemetry.Logger(r.Context()).Info("Resuming export job", "job_id", job.id, "resumed_by", resumed.id, "regions_done", targets, "findings", findings)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", a.path("/api/jobs/"+resumed.id))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resumed.view())
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// cliParams maps the export command's flags to the export query parameters
+// they set, so the command accepts the same options as /api/export
+var cliParams = []struct {
+	flag, param, usage string
+}{
+	{"preset", "preset", "saved preset whose export options are used unless other flags override them"},
+	{"regions", "regions", "comma-separated regions to export"},
+	{"region-group", "regionGroup", "export every enabled region in a group: all, us, eu, apac, gov, or cn"},
+	{"role-arn", "roleArn", "IAM role to assume in another account (repeatable)"},
+	{"external-id", "externalId", "external ID passed when assuming roles"},
+	{"discover-accounts", "discoverAccounts", "discover accounts through organizations or guardduty"},
+	{"role-name", "roleName", "role assumed in each discovered account"},
+	{"include-accounts", "includeAccounts", "comma-separated account IDs to restrict discovery to"},
+	{"exclude-accounts", "excludeAccounts", "comma-separated account IDs to leave out of discovery"},
+	{"include-ous", "includeOUs", "comma-separated organizational units to restrict discovery to"},
+	{"exclude-ous", "excludeOUs", "comma-separated organizational units to leave out of discovery"},
+	{"detectors", "detectors", "comma-separated detector IDs to export; regions without any of them are skipped"},
+	{"type", "type", "finding types to export, with a trailing * for a prefix (repeatable)"},
+	{"threat-purpose", "threatPurpose", "comma-separated threat purposes of the finding types to export, such as Recon or CryptoCurrency"},
+	{"threat-resource", "threatResource", "comma-separated affected resource types of the finding types to export, such as EC2 or IAMUser"},
+	{"mitre-tactic", "mitreTactic", "comma-separated MITRE ATT&CK tactics, by ID or name, that exported finding types map to"},
+	{"mitre-technique", "mitreTechnique", "comma-separated MITRE ATT&CK techniques, by ID or name, that exported finding types map to"},
+	{"created-after", "createdAfter", "export findings created at or after this time"},
+	{"created-before", "createdBefore", "export findings created before this time"},
+	{"updated-after", "updatedAfter", "export findings updated at or after this time"},
+	{"updated-before", "updatedBefore", "export findings updated before this time"},
+	{"archived", "archived", "export only archived (true) or active (false) findings, or all"},
+	{"columns", "columns", "comma-separated CSV and XLSX columns"},
+	{"column-mapping", "columnMapping", "mapping of the columnMappings setting that names and orders the CSV and XLSX columns"},
+	{"incremental", "incremental", "name of an incremental export; only findings updated since its last run are exported"},
+	{"dedupe", "dedupe", "leave out findings already exported with the same id, or the same id or content"},
+	{"dedupe-keep", "dedupeKeep", "copy of a duplicate exported: first, or own for the one of its own account"},
+	{"sort", "sort", "order each region's findings by severity, createdAt, updatedAt, or type"},
+	{"sort-order", "sortOrder", "sort order, asc or desc"},
+	{"product-arn", "productArn", "Security Hub product ARN for ASFF findings"},
+	{"csv-delimiter", "csvDelimiter", "CSV delimiter: comma, semicolon, or tab"},
+	{"csv-line-ending", "csvLineEnding", "CSV line ending: lf or crlf"},
+	{"csv-quote", "csvQuote", "quote CSV cells where needed (minimal), all of them (all), or all but numbers (nonnumeric)"},
+	{"csv-time-format", "csvTimeFormat", "CreatedAt and UpdatedAt in CSV as rfc3339, epoch, epochms, or a Go time layout"},
+	{"csv-timezone", "csvTimezone", "time zone of CreatedAt and UpdatedAt in CSV, such as Europe/Berlin"},
+	{"template", "template", "template from the templates setting that the template format writes findings with"},
+	{"top-findings", "topFindings", "number of most severe findings in Markdown reports"},
+	{"group-by", "groupBy", "group the findings of Markdown reports by type or resource"},
+	{"compress", "compress", "compress the export with gzip or zip"},
+	{"archive", "archive", "archive the exported findings (true), or list them without archiving (dryRun)"},
+}
+
+// cliBoolParams are the boolean query parameters set by export command flags
+var cliBoolParams = []struct {
+	flag, param, usage string
+}{
+	{"pretty", "pretty", "indent JSON output"},
+	{"flatten", "flatten", "write every finding field as a CSV or XLSX column"},
+	{"sanitize", "sanitize", "escape CSV cells that spreadsheets would evaluate as formulas"},
+	{"bom", "bom", "start CSV output with a UTF-8 byte order mark"},
+	{"partition", "partition", "upload Parquet or CSV files partitioned by region and date to S3"},
+	{"split", "split", "write a zip with a file per account and region and a manifest"},
+	{"resource-tags", "resourceTags", "look up the Owner, Team, Environment, and CostCenter tags of each finding's resource"},
+	{"resource-state", "resourceState", "look up whether each finding's instance, bucket, or EKS cluster still exists and its current state"},
+	{"security-hub", "securityHub", "look up the Security Hub workflow status and note of each finding"},
+	{"threat-intel", "threatIntel", "look up the reputation of each finding's remote address, domain, and file hashes"},
+	{"rules", "rules", "apply the rules of the config to the findings, unless false"},
+	{"suppress", "suppress", "leave out the findings of the suppressions file, unless false"},
+	{"report-errors", "reportErrors", "record failing regions in the output and continue"},
+	{"email", "email", "email the stored export to the configured recipients"},
+	{"jira", "jira", "file Jira issues for the exported findings at or above the configured severity"},
+	{"dry-run", "dryRun", "count the matching findings per region and detector instead of exporting them"},
+	{"preflight", "preflight", "check the export's permissions in every account and region and that its destination can take it, and fail before fetching if any check does not pass"},
+	{"coverage", "coverage", "write the Runtime Monitoring coverage of each account and region instead of findings"},
+	{"usage", "usage", "write what GuardDuty cost over the last 30 days by feature and account instead of findings"},
+	{"malware-scans", "malwareScans", "write the Malware Protection scans and the threats they found instead of findings"},
+	{"ip-sets", "ipSets", "write the trusted IP lists and threat lists of the detectors instead of findings"},
+	{"members", "members", "write the member accounts and administrator of each account and region instead of findings"},
+	{"filters", "filters", "write the saved filters and suppression rules of the detectors instead of findings"},
+	{"publishing-destinations", "publishingDestinations", "write the finding publishing destinations of each account and region and whether they are healthy instead of findings"},
+	{"posture", "posture", "write the detector, protection plans, organization auto-enable settings, and member enrollment of each account and region, with their gaps flagged, instead of findings"},
+}
+
+// runExportCommand runs a single export from the command line, for CI
+// pipelines and cron jobs, and returns the process exit code
+func runExportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	query := url.Values{}
+	for _, p := range cliParams {
+		fs.Func(p.flag, p.usage, func(v string) error {
+			query[p.param] = append(query[p.param], v)
+			return nil
+		})
+	}
+	for _, p := range cliBoolParams {
+		fs.BoolFunc(p.flag, p.usage, func(v string) error {
+			query[p.param] = []string{v}
+			return nil
+		})
+	}
+	out := fs.String("out", "", "output path, or - for standard output (default a timestamped file in the output directory)")
+
+	app, err := loadApp(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %v\n", fs.Args())
+		return 2
+	}
+	// Regions may be given as a comma-separated list
+	query["regions"] = gd.SplitList(query["regions"])
+
+	opts, err := app.parseExportValues(query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *out == "-" && usesS3(opts.destination) {
+		fmt.Fprintln(os.Stderr, "Standard output cannot be combined with an S3 destination")
+		return 2
+	}
+	if *out != "" && pushesToSIEM(opts.destination) {
+		fmt.Fprintf(os.Stderr, "Exports to the %s destination are not written to a file, so -out cannot be used\n", opts.destination)
+		return 2
+	}
+	if *out == "-" && opts.email {
+		fmt.Fprintln(os.Stderr, "Exports written to standard output cannot be emailed")
+		return 2
+	}
+
+	// Progress messages go to standard error when the export or the report
+	// of a dry run is written to standard output
+	dataOut := os.Stdout
+	if *out == "-" || opts.dryRun {
+		os.Stdout = os.Stderr
+		slog.SetDefault(telemetry.NewLogger(os.Stderr, app.config().LogFormat, app.config().LogLevel))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, span := telemetry.StartSpan(ctx, "export", "regions", len(opts.Regions), "format", opts.Format)
+	err = app.runExport(ctx, opts, *out, dataOut)
+	span.Finish(err)
+	// Send the trace before exiting, without holding up the exit for long
+	flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	telemetry.StopTracing(flushCtx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runExport fetches and writes one export for the command line. The export
+// is written to path, to stdout when path is "-", or to a timestamped file.
+// Findings are written as they are fetched, and a file left by a failed
+// export is removed.
+func (a *App) runExport(ctx context.Context, opts exportOptions, path string, stdout io.Writer) (err error) {
+	if err := gd.ResolveRegions(ctx, &opts.FetchOptions); err != nil {
+		return err
+	}
+	if err := gd.ResolveAccounts(ctx, &opts.FetchOptions); err != nil {
+		return err
+	}
+	log := telemetry.Logger(ctx)
+	if opts.dryRun {
+		return a.runDryRun(ctx, opts, stdout)
+	}
+	if opts.report != "" {
+		return a.runReport(ctx, opts, path, stdout)
+	}
+	if err := a.checkPreflight(ctx, &opts, a.cliDestination(opts, path)); err != nil {
+		return err
+	}
+	log.Info("Export started", "regions", opts.Regions)
+
+	stream := gd.StreamRegions(ctx, opts.FetchOptions, nil)
+	defer stream.Close()
+	run := newRun(runSourceCLI, opts)
+	defer func() {
+		var message string
+		if err != nil {
+			message = err.Error()
+		}
+		run.finish(runOutcome(ctx, err == nil), message, stream.Results())
+		run.Truncation = streamTruncation(stream)
+		a.recordRun(ctx, run)
+	}()
+
+	filename := export.Filename(time.Now(), opts.Format)
+	if opts.partition {
+		upload, totalFindings, err := a.uploadPartitions(ctx, opts.WriteOptions, filename, stream)
+		if failure := fetchFailure(ctx, stream); failure != nil {
+			return failure
+		}
+		if err != nil {
+			return err
+		}
+		a.completeExport(ctx, opts, stream)
+		log.Info("Export completed", "findings", totalFindings, "table", upload.uri())
+		return nil
+	}
+	if pushesToSIEM(opts.destination) {
+		target, totalFindings, err := a.pushFindings(ctx, opts.destination, stream)
+		if failure := fetchFailure(ctx, stream); failure != nil {
+			return failure
+		}
+		if err != nil {
+			return err
+		}
+		a.completeExport(ctx, opts, stream)
+		log.Info("Export completed", "findings", totalFindings, "pushed_to", target)
+		return nil
+	}
+	if path == "-" {
+		totalFindings, err := export.Write(ctx, stdout, opts.WriteOptions, filename, stream)
+		if failure := fetchFailure(ctx, stream); failure != nil {
+			return failure
+		}
+		if err != nil {
+			return fmt.Errorf("error writing export: %v", err)
+		}
+		a.completeExport(ctx, opts, stream)
+		log.Info("Export completed", "findings", totalFindings)
+		return nil
+	}
+	name := a.storedName(filename, opts.Compression)
+	// Only timestamped exports in the output directory are listed as
+	// downloads and subject to the retention policy
+	saved := path == ""
+	if saved {
+		path = filepath.Join(a.config().OutputDir, name)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer file.Close()
+	out, err := a.encryptExport(ctx, file)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	// A half-written export is removed rather than left for a reader
+	totalFindings, err := export.Write(ctx, out, opts.WriteOptions, filename, stream)
+	if err == nil {
+		err = out.Close()
+	}
+	if failure := fetchFailure(ctx, stream); failure != nil {
+		file.Close()
+		os.Remove(path)
+		return failure
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("error writing export: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("error writing export: %v", err)
+	}
+	seal, err := a.sealExport(ctx, path, filepath.Base(path))
+	if err != nil {
+		removeExportFile(path)
+		return err
+	}
+
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	var upload s3Upload
+	if usesS3(opts.destination) {
+		upload, err = a.uploadExport(ctx, path, name, a.storedContentType(opts.Format, opts.Compression))
+		if err != nil {
+			return err
+		}
+		log.Info("Download URL", "url", upload.url)
+		if opts.destination == destinationS3 {
+			removeExportFile(path)
+			path = ""
+		}
+	}
+	a.completeExport(ctx, opts, stream)
+	if path == "" {
+		log.Info("Export completed", "findings", totalFindings, "object", upload.uri())
+	} else {
+		if saved {
+			a.recordSavedExport(ctx, name, opts, totalFindings, stream, seal)
+		}
+		log.Info("Export completed", "findings", totalFindings, "file", path, "sha256", seal.SHA256)
+	}
+
+	if opts.email {
+		// The export is attached under the name it was written to
+		filename := name
+		if path != "" {
+			filename = filepath.Base(path)
+		}
+		err := a.emailExport(ctx, emailedExport{
+			filename:    filename,
+			contentType: a.storedContentType(opts.Format, opts.Compression),
+			path:        path,
+			upload:      upload,
+			size:        size,
+			findings:    totalFindings,
+			results:     stream.Results(),
+			truncation:  streamTruncation(stream),
+			startedAt:   run.StartedAt,
+		})
+		if err != nil {
+			return fmt.Errorf("error emailing export: %v", err)
+		}
+	}
+	return nil
+}
+
+// cliDestination returns where a command-line export is written: the
+// output directory for a timestamped file, which may be compressed to fit,
+// or the directory of path. Exports written to stdout are stored nowhere.
+func (a *App) cliDestination(opts exportOptions, path string) preflightDestination {
+	switch {
+	case opts.partition, pushesToSIEM(opts.destination):
+		return a.storedDestination(opts, "")
+	case path == "-":
+		return preflightDestination{}
+	case path == "":
+		return preflightDestination{dirs: []string{a.config().OutputDir}, s3: usesS3(opts.destination), compress: true}
+	}
+	return preflightDestination{dirs: []string{filepath.Dir(path)}, s3: usesS3(opts.destination)}
+}
+
+// runDryRun writes the report of a dry run to stdout as JSON. A region that
+// could not be counted fails the command once every region is reported.
+func (a *App) runDryRun(ctx context.Context, opts exportOptions, stdout io.Writer) error {
+	report := gd.CountFindings(ctx, opts.FetchOptions)
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	telemetry.Logger(ctx).Info("Dry run completed", "findings", report.Findings, "pages", report.Pages)
+	var failed int
+	for _, region := range report.Regions {
+		if region.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("error counting findings in %d of %d regions", failed, len(report.Regions))
+	}
+	return nil
+}
+
+// fetchFailure returns why a streamed export ended early: its cancellation,
+// or the failure of a region when errors are not being reported
+func fetchFailure(ctx context.Context, stream *gd.Stream) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("export canceled: %v", ctx.Err())
+	}
+	if result, failed := stream.Failed(); failed {
+		return fmt.Errorf("error getting findings for region %s: %v", gd.TargetLabel(result.Account, result.Region), result.Err)
+	}
+	return nil
+}
+
+// completeExport logs the regions that failed in a command-line export that
+// reported them, and what a truncated export left out, and runs the steps
+// that follow a stored export
+func (a *App) completeExport(ctx context.Context, opts exportOptions, stream *gd.Stream) {
+	gd.SummarizeRegions(stream.Results()).LogFailures(ctx)
+	if duplicates := countDuplicates(stream.Results()); duplicates > 0 {
+		telemetry.Logger(ctx).Info("Collapsed duplicate findings", "duplicates", duplicates, "dedupe", opts.Dedupe.Key, "keep", opts.Dedupe.Keep)
+	}
+	if truncation, ok := stream.Truncated(); ok {
+		telemetry.Logger(ctx).Warn("Export is incomplete", "reason", truncation.Reason, "limit", truncation.Limit, "findings", truncation.Findings, "cut_region", truncation.Region, "remaining_regions", truncation.Remaining)
+	}
+	a.finishExport(ctx, opts, stream.Results())
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"guardduty/internal/export"
+)
+
+// columnMapping is one column of a downstream schema: the export column,
+// a registered name or dotted path, and the name its header cell is given
+type columnMapping struct {
+	Column string `yaml:"column"`
+	Name   string `yaml:"name"`
+}
+
+// validateColumnMappings reports the first mapping, in name order, that
+// can't be selected as an export option, is empty, or names a column that
+// is neither known nor one of fields, or a header twice
+func validateColumnMappings(mappings map[string][]columnMapping, fields export.Fields) error {
+	for _, name := range sortedNames(mappings) {
+		if !presetNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid columnMappings name %q: must be letters, digits, '.', '_', or '-'", name)
+		}
+		if len(mappings[name]) == 0 {
+			return fmt.Errorf("invalid columnMappings.%s: at least one column is required", name)
+		}
+		headers := make(map[string]bool)
+		for _, mapping := range mappings[name] {
+			if err := fields.ValidColumn(mapping.Column); err != nil {
+				return fmt.Errorf("invalid columnMappings.%s column %q: %v", name, mapping.Column, err)
+			}
+			header := mapping.header()
+			if headers[header] {
+				return fmt.Errorf("invalid columnMappings.%s: header %q is given twice", name, header)
+			}
+			headers[header] = true
+		}
+	}
+	return nil
+}
+
+// header is the name of the mapped column's header cell, the column's own
+// name when the mapping doesn't rename it
+func (m columnMapping) header() string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return m.Column
+}
+
+// parseColumnMapping reads the columnMapping export option, which replaces
+// the columns of the export with those of a mapping of the columnMappings
+// setting, in its order and under its header names
+func (a *App) parseColumnMapping(query url.Values, opts *exportOptions) error {
+	name := query.Get("columnMapping")
+	if name == "" {
+		return nil
+	}
+	mappings, ok := a.config().ColumnMappings[name]
+	if !ok {
+		if len(a.config().ColumnMappings) == 0 {
+			return fmt.Errorf("Unknown columnMapping %q: the server config has no columnMappings", name)
+		}
+		return fmt.Errorf("Unknown columnMapping %q: must be one of %s", name, strings.Join(sortedNames(a.config().ColumnMappings), ", "))
+	}
+	if len(query["columns"]) > 0 {
+		return fmt.Errorf("The columnMapping option cannot be combined with columns")
+	}
+	if opts.Flatten {
+		return fmt.Errorf("The columnMapping option cannot be combined with flatten")
+	}
+	opts.Columns = make([]string, len(mappings))
+	opts.Headers = make([]string, len(mappings))
+	for i, mapping := range mappings {
+		opts.Columns[i] = mapping.Column
+		opts.Headers[i] = mapping.header()
+	}
+	return nil
+}
@@ -0,0 +1,1036 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// Config holds the tunable defaults for the exporter. Values come from the
+// built-in defaults, then an optional -config file, then environment
+// variables, then command-line flags. Export requests can further override
+// most of them with query parameters.
+type Config struct {
+	// Listen is the address the HTTP server listens on
+	Listen string `yaml:"listen"`
+	// GRPCListen is the address the gRPC service listens on; empty serves
+	// no gRPC
+	GRPCListen string `yaml:"grpcListen"`
+	// BasePath is the URL prefix the server is reached under, such as
+	// /guardduty behind a reverse proxy or load balancer routing by path
+	BasePath string `yaml:"basePath"`
+	// Profile is the AWS shared config profile; empty uses the SDK default
+	Profile string `yaml:"profile"`
+	// Credentials sets the sources of the server's credentials and the
+	// order they are tried in, instead of the SDK's chain
+	Credentials credentialsConfig `yaml:"credentials"`
+	// Synthetic answers GuardDuty calls with generated findings instead of
+	// calling AWS, for load tests
+	Synthetic syntheticConfig `yaml:"synthetic"`
+	// AWSPartition is the AWS partition of profiles that set no region:
+	// aws, aws-us-gov, or aws-cn
+	AWSPartition string `yaml:"awsPartition"`
+	// Regions are exported when a request selects no regions or region group
+	Regions []string `yaml:"regions"`
+	// OutputDir is where exports saved on the server are written
+	OutputDir string `yaml:"outputDir"`
+	// Retention deletes the exports saved in OutputDir, the runs of the
+	// history, the stored findings, and the audit entries once they are too
+	// old, and saved exports once they take up too much space
+	Retention retentionConfig `yaml:"retention"`
+	// RegionScope selects the region group offered by /api/regions
+	RegionScope string `yaml:"regionScope"`
+	// Concurrency is the maximum number of regions fetched at the same time
+	Concurrency int `yaml:"concurrency"`
+	// RetryAttempts is the maximum number of attempts for each AWS API call
+	RetryAttempts int `yaml:"retryAttempts"`
+	// RetryMode is the SDK retry mode: standard, or adaptive to also slow
+	// down after throttling errors
+	RetryMode string `yaml:"retryMode"`
+	// RetryMaxBackoff is the longest wait between attempts of an API call
+	RetryMaxBackoff time.Duration `yaml:"retryMaxBackoff"`
+	// EndpointURL replaces the endpoint of every AWS service, such as a
+	// LocalStack container; empty uses the SDK's endpoints
+	EndpointURL string `yaml:"endpointUrl"`
+	// Endpoints replace the endpoint of individual services, keyed by
+	// service name, and take precedence over EndpointURL
+	Endpoints map[string]string `yaml:"endpoints"`
+	// UseFIPS selects the FIPS endpoints of each service
+	UseFIPS bool `yaml:"useFips"`
+	// AWSHTTP is the proxy, TLS, and timeouts of the HTTP client that AWS
+	// calls are sent with
+	AWSHTTP awsHTTPConfig `yaml:"awsHttp"`
+	// RateLimit is the most GuardDuty requests per second sent to each
+	// account and region; zero means no limit
+	RateLimit float64 `yaml:"rateLimit"`
+	// RateBurst is the number of requests allowed at once above RateLimit;
+	// zero allows one second's worth
+	RateBurst int `yaml:"rateBurst"`
+	// Timeout bounds the time spent fetching a single region; zero means no limit
+	Timeout time.Duration `yaml:"timeout"`
+	// CallTimeout bounds each GuardDuty and EC2 API call; zero means no limit
+	CallTimeout time.Duration `yaml:"callTimeout"`
+	// ShutdownTimeout is how long the server waits on SIGINT or SIGTERM for
+	// requests and jobs in progress before canceling them
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	// MaxConcurrentJobs is the most export jobs run at once, and
+	// MaxJobsPerAccount the most of them that export the same account;
+	// further jobs wait in a queue. Zero means no limit.
+	MaxConcurrentJobs int `yaml:"maxConcurrentJobs"`
+	MaxJobsPerAccount int `yaml:"maxJobsPerAccount"`
+	// CheckpointDir is where export jobs checkpoint their progress, so a
+	// job that fails can be resumed; empty turns checkpointing off
+	CheckpointDir string `yaml:"checkpointDir"`
+	// MinSeverity excludes findings with a lower severity
+	MinSeverity float64 `yaml:"minSeverity"`
+	// Format is the output format of an export
+	Format string `yaml:"format"`
+	// Columns are the columns of CSV and XLSX exports: registered names or
+	// dotted paths into the finding
+	Columns []string `yaml:"columns"`
+	// CSVSanitize escapes CSV cells that spreadsheets would evaluate as
+	// formulas and normalizes their line breaks
+	CSVSanitize bool `yaml:"csvSanitize"`
+	// CSVBOM starts CSV exports with a UTF-8 byte order mark for Excel
+	CSVBOM bool `yaml:"csvBom"`
+	// Locale is the language and date layout of HTML, PDF, and Markdown
+	// reports and of trends reports in HTML: en, de, fr, or es
+	Locale string `yaml:"locale"`
+	// Templates are the Go template files that the template format writes
+	// findings with, keyed by the name the template export option takes
+	Templates map[string]string `yaml:"templates"`
+	// ColumnMappings rename and reorder the columns of CSV, XLSX, and HTML
+	// exports for downstream schemas, keyed by the name the columnMapping
+	// export option takes
+	ColumnMappings map[string][]columnMapping `yaml:"columnMappings"`
+	// BatchSize is the number of finding IDs sent in each GetFindings call
+	BatchSize int `yaml:"batchSize"`
+	// BatchRetries is the number of times a failed GetFindings batch is retried
+	BatchRetries int `yaml:"batchRetries"`
+	// MaxFindings and MaxDuration stop an export once it has written that
+	// many findings or run for that long, keeping what was written as a
+	// truncated export; zero means no limit. Export requests can lower them
+	// but not raise them.
+	MaxFindings int           `yaml:"maxFindings"`
+	MaxDuration time.Duration `yaml:"maxDuration"`
+	// Roles are assumed to export findings from other accounts; when empty the
+	// exporter's own account is used
+	Roles []gd.Role `yaml:"roles"`
+	// Discovery finds the accounts to export through AWS Organizations or
+	// GuardDuty membership in addition to Roles
+	Discovery gd.Discovery `yaml:"discovery"`
+	// CredentialMap gives accounts and regions the credentials of another
+	// profile or role than the export's, so one export can span accounts
+	// reached differently or another partition
+	CredentialMap []gd.CredentialRule `yaml:"credentialMap"`
+	// Destination is where finished exports are stored: local, s3, or both
+	Destination string `yaml:"destination"`
+	// S3 is the bucket used by the s3 and both destinations
+	S3 s3Config `yaml:"s3"`
+	// Athena makes partitioned exports queryable in Athena once they are
+	// uploaded
+	Athena athenaConfig `yaml:"athena"`
+	// Splunk and Elasticsearch are the services of the splunk and
+	// elasticsearch destinations
+	Splunk        splunkConfig        `yaml:"splunk"`
+	Elasticsearch elasticsearchConfig `yaml:"elasticsearch"`
+	// Syslog is the collector of the syslog destination
+	Syslog syslogConfig `yaml:"syslog"`
+	// HTTP is the endpoint of the http destination
+	HTTP httpConfig `yaml:"http"`
+	// Email sends the exports that ask for it to fixed recipients
+	Email emailConfig `yaml:"email"`
+	// Jira is the project that exports asking for it file issues in for
+	// their most severe findings
+	Jira jiraConfig `yaml:"jira"`
+	// Signing signs the exports the server stores with a detached
+	// signature, beside the checksum every stored export gets
+	Signing signingConfig `yaml:"signing"`
+	// Encryption encrypts the exports the server stores before they are
+	// written
+	Encryption encryptionConfig `yaml:"encryption"`
+	// Watch is the queue of GuardDuty events that the watch command reads
+	Watch watchConfig `yaml:"watch"`
+	// Webhooks are the Slack and Teams channels that jobs naming them in
+	// their notify parameter post their outcome to
+	Webhooks []webhookConfig `yaml:"webhooks"`
+	// PublicURL is the address users reach the web interface at, including
+	// BasePath, which notifications link downloads to
+	PublicURL string `yaml:"publicUrl"`
+	// StateFile holds the watermarks of incremental exports; by default it
+	// is .guardduty_export_state.json in OutputDir
+	StateFile string `yaml:"stateFile"`
+	// PresetsFile holds the saved export presets; by default it is
+	// .guardduty_export_presets.json in OutputDir
+	PresetsFile string `yaml:"presetsFile"`
+	// SchedulesFile holds the schedules created through the API and the
+	// recent runs of every schedule; by default it is
+	// .guardduty_export_schedules.json in OutputDir
+	SchedulesFile string `yaml:"schedulesFile"`
+	// HistoryFile holds the history of export runs; by default it is
+	// .guardduty_export_history.ndjson in OutputDir
+	HistoryFile string `yaml:"historyFile"`
+	// HistoryLimit is the number of runs kept in the history; zero turns
+	// the history off
+	HistoryLimit int `yaml:"historyLimit"`
+	// ResourceTags looks up the current tags of the resources of findings
+	// for the columns that route them to their owners
+	ResourceTags resourceTagsConfig `yaml:"resourceTags"`
+	// ResourceState looks up whether the resources of findings still exist
+	// and their current state, to prioritize remediation
+	ResourceState resourceStateConfig `yaml:"resourceState"`
+	// SecurityHub looks up the workflow status and note that Security Hub
+	// tracks for findings, so exports reflect their triage
+	SecurityHub securityHubConfig `yaml:"securityHub"`
+	// GeoIP resolves the remote addresses of findings against local MaxMind
+	// databases for their country, ASN, and organization
+	GeoIP geoIPConfig `yaml:"geoip"`
+	// ThreatIntel looks up the addresses, domains, and file hashes of
+	// findings with VirusTotal and AbuseIPDB for their reputations
+	ThreatIntel threatIntelConfig `yaml:"threatIntel"`
+	// Rules drop, change, tag, and route the findings of exports as they
+	// are fetched, in order
+	Rules []gd.Rule `yaml:"rules"`
+	// SuppressionsFile is a YAML or JSON list of suppressions, leaving the
+	// findings they match out of exports without archiving them; it is
+	// read at each export
+	SuppressionsFile string `yaml:"suppressionsFile"`
+	// SuppressedFile is the CSV file the suppressed findings are recorded
+	// in; by default it is suppressed.csv in OutputDir
+	SuppressedFile string `yaml:"suppressedFile"`
+	// StoreFile is a SQLite database keeping every finding the exports
+	// fetch, searched through /api/store/findings; empty turns the store off
+	StoreFile string `yaml:"storeFile"`
+	// LogFormat is the format of log messages: text or json
+	LogFormat string `yaml:"logFormat"`
+	// LogLevel is the least severe level logged: debug, info, warn, or error
+	LogLevel string `yaml:"logLevel"`
+	// TemplatesDir holds an index.html that replaces the built-in web
+	// interface; empty serves the embedded one
+	TemplatesDir string `yaml:"templatesDir"`
+	// APIDocs serves Swagger UI for the OpenAPI document of the v1 API at
+	// /api/v1/docs
+	APIDocs bool `yaml:"apiDocs"`
+	// TLS serves HTTPS with a certificate from files or Let's Encrypt
+	TLS tlsConfig `yaml:"tls"`
+	// Auth requires the /api endpoints to authenticate with basic
+	// authentication or an API key
+	Auth authConfig `yaml:"auth"`
+	// Audit records exports, downloads, and changes to schedules, presets,
+	// and filters in an append-only file or CloudWatch Logs stream
+	Audit auditConfig `yaml:"audit"`
+	// SSOLogin lets the web interface start an AWS SSO sign-in whose token
+	// is saved for the server's user
+	SSOLogin bool `yaml:"ssoLogin"`
+	// EnableDetectors lets admins enable GuardDuty in the accounts and
+	// regions an export found without a detector or with a suspended one
+	EnableDetectors bool `yaml:"enableDetectors"`
+	// Tracing sends OpenTelemetry traces of exports to an OTLP endpoint
+	Tracing telemetry.TracingConfig `yaml:"tracing"`
+	// FindingsMetrics counts findings periodically for /metrics/findings
+	FindingsMetrics findingsMetricsConfig `yaml:"findingsMetrics"`
+	// Schedules are recurring exports run by the server
+	Schedules []scheduleConfig `yaml:"schedules"`
+}
+
+// defaultConfig returns the configuration used when nothing is overridden
+func defaultConfig() Config {
+	return Config{
+		Listen:            ":8080",
+		AWSPartition:      gd.PartitionAWS,
+		OutputDir:         ".",
+		RegionScope:       "all",
+		Concurrency:       4,
+		RetryAttempts:     3,
+		RetryMode:         gd.RetryStandard,
+		RetryMaxBackoff:   20 * time.Second,
+		CallTimeout:       time.Minute,
+		ShutdownTimeout:   30 * time.Second,
+		MaxConcurrentJobs: 4,
+		Format:            "csv",
+		Columns:           export.DefaultColumns,
+		BatchSize:         gd.MaxGetFindingsBatch,
+		BatchRetries:      2,
+		Destination:       destinationLocal,
+		HistoryLimit:      500,
+		LogFormat:         telemetry.LogText,
+		LogLevel:          "info",
+		S3:                s3Config{URLExpiry: time.Hour},
+		Splunk:            splunkConfig{SourceType: defaultSplunkSourceType, BatchSize: defaultSIEMBatchSize, Retries: defaultSIEMRetries},
+		Elasticsearch:     elasticsearchConfig{Index: defaultElasticIndex, BatchSize: defaultSIEMBatchSize, Retries: defaultSIEMRetries},
+		Syslog:            syslogConfig{Network: syslogTCP, Format: syslogCEF, Header: syslogRFC3164, Facility: "local0", Retries: defaultSIEMRetries},
+		HTTP:              httpConfig{Mode: httpModeBatch, BatchSize: defaultSIEMBatchSize, Retries: defaultSIEMRetries},
+		Email:             emailConfig{MaxAttachmentMB: 10, SMTP: smtpConfig{Port: 587}},
+		Watch:             watchConfig{Rotate: defaultWatchRotate, MaxFindings: defaultWatchMaxFindings},
+		ResourceTags:      resourceTagsConfig{Concurrency: gd.DefaultTagConcurrency, CacheTTL: gd.DefaultTagCacheTTL},
+		ResourceState:     resourceStateConfig{Concurrency: gd.DefaultStateConcurrency, CacheTTL: gd.DefaultStateCacheTTL},
+		SecurityHub:       securityHubConfig{Concurrency: gd.DefaultWorkflowConcurrency, CacheTTL: gd.DefaultWorkflowCacheTTL},
+		ThreatIntel: threatIntelConfig{
+			CacheTTL:   defaultThreatIntelCacheTTL,
+			VirusTotal: virusTotalConfig{URL: defaultVirusTotalURL, RateLimit: defaultVirusTotalRate},
+			AbuseIPDB:  abuseIPDBConfig{URL: defaultAbuseIPDBURL, RateLimit: defaultAbuseIPDBRate, MaxAgeDays: defaultAbuseIPDBMaxAge},
+		},
+		Jira: jiraConfig{
+			IssueType:   defaultJiraIssueType,
+			MinSeverity: defaultJiraMinSeverity,
+			Priorities:  map[string]string{"Critical": "Highest", "High": "High", "Medium": "Medium", "Low": "Low"},
+			Retries:     defaultSIEMRetries,
+		},
+		Signing: signingConfig{KMSAlgorithm: defaultKMSSigningAlgorithm},
+		Auth: authConfig{OIDC: oidcConfig{
+			Scopes:          []string{"openid", "email", "profile"},
+			UsernameClaim:   "email",
+			GroupsClaim:     "groups",
+			SessionDuration: 8 * time.Hour,
+		}},
+		Tracing: telemetry.TracingConfig{ServiceName: "guardduty-export"},
+	}
+}
+
+// loadConfigFile reads a YAML or JSON config file into c. Keys missing from
+// the file keep their current value; unknown keys are reported as an error.
+func loadConfigFile(path string, c *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file %s: %v", path, err)
+	}
+
+	// JSON is valid YAML, so a single strict decoder handles both formats
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// registerFlags defines the command-line flags that override config values
+func registerFlags(fs *flag.FlagSet, c *Config) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address the HTTP server listens on")
+	fs.StringVar(&c.GRPCListen, "grpc-listen", c.GRPCListen, "address the gRPC service listens on, such as :9090")
+	fs.StringVar(&c.BasePath, "base-path", c.BasePath, "URL prefix the server is reached under, such as /guardduty")
+	fs.StringVar(&c.Profile, "profile", c.Profile, "AWS shared config profile")
+	fs.Func("credential-providers", "comma-separated sources of the server's credentials, tried in order: environment, webIdentity, sharedConfig, container, ec2", func(v string) error {
+		c.Credentials.Providers = gd.SplitList([]string{v})
+		return nil
+	})
+	fs.StringVar(&c.AWSPartition, "aws-partition", c.AWSPartition, "AWS partition of profiles that set no region: aws, aws-us-gov, or aws-cn")
+	fs.IntVar(&c.Synthetic.Findings, "synthetic-findings", c.Synthetic.Findings, "export this many generated findings per region instead of calling GuardDuty, for load tests (0 to call GuardDuty)")
+	fs.Uint64Var(&c.Synthetic.Seed, "synthetic-seed", c.Synthetic.Seed, "seed of the generated findings; the same seed generates the same findings")
+	fs.DurationVar(&c.Synthetic.Latency, "synthetic-latency", c.Synthetic.Latency, "delay of every call of the generated findings, such as 50ms")
+	fs.Func("default-regions", "comma-separated regions exported when a request selects none", func(v string) error {
+		c.Regions = gd.SplitList([]string{v})
+		return nil
+	})
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "TLS certificate file, to serve HTTPS")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "TLS private key file")
+	fs.Func("autocert-host", "comma-separated host names to get Let's Encrypt certificates for, to serve HTTPS", func(v string) error {
+		c.TLS.Autocert.Hosts = gd.SplitList([]string{v})
+		return nil
+	})
+	fs.StringVar(&c.TLS.Autocert.CacheDir, "autocert-cache-dir", c.TLS.Autocert.CacheDir, "directory keeping Let's Encrypt certificates (default .autocert in the output directory)")
+	fs.StringVar(&c.TLS.Autocert.Email, "autocert-email", c.TLS.Autocert.Email, "contact address for Let's Encrypt expiry notices")
+	fs.StringVar(&c.TLS.RedirectHTTP, "http-redirect", c.TLS.RedirectHTTP, "address of an HTTP listener redirecting to HTTPS, such as :80")
+	fs.StringVar(&c.OutputDir, "output-dir", c.OutputDir, "directory that exports saved on the server are written to")
+	fs.DurationVar(&c.Retention.MaxAge, "retention-max-age", c.Retention.MaxAge, "delete saved exports older than this, such as 720h for 30 days (0 to keep them)")
+	fs.Int64Var(&c.Retention.MaxSizeMB, "retention-max-size-mb", c.Retention.MaxSizeMB, "delete the oldest saved exports beyond this many megabytes (0 for no limit)")
+	fs.DurationVar(&c.Retention.HistoryMaxAge, "retention-history-max-age", c.Retention.HistoryMaxAge, "delete export runs from the history after this long (0 to keep them)")
+	fs.DurationVar(&c.Retention.StoreMaxAge, "retention-store-max-age", c.Retention.StoreMaxAge, "delete stored findings no export has fetched for this long (0 to keep them)")
+	fs.DurationVar(&c.Retention.AuditMaxAge, "retention-audit-max-age", c.Retention.AuditMaxAge, "purge audit file entries older than this (0 to keep them)")
+	fs.DurationVar(&c.Retention.JobMaxAge, "retention-job-max-age", c.Retention.JobMaxAge, "remove finished jobs and their artifacts after this long (0 to keep them)")
+	fs.DurationVar(&c.Retention.PurgeDelay, "retention-purge-delay", c.Retention.PurgeDelay, "keep deleted exports, runs, and findings restorable for this long before purging them (0 to purge right away)")
+	fs.DurationVar(&c.FindingsMetrics.Interval, "findings-metrics-interval", c.FindingsMetrics.Interval, "count findings this often for /metrics/findings, such as 5m (0 to turn it off)")
+	fs.StringVar(&c.RegionScope, "region-scope", c.RegionScope, "region group offered in the UI: all, us, eu, apac, gov, or cn")
+	fs.IntVar(&c.Concurrency, "concurrency", c.Concurrency, "maximum number of regions fetched at the same time")
+	fs.IntVar(&c.RetryAttempts, "retry-attempts", c.RetryAttempts, "maximum attempts for each AWS API call")
+	fs.StringVar(&c.RetryMode, "retry-mode", c.RetryMode, "SDK retry mode: standard or adaptive")
+	fs.DurationVar(&c.RetryMaxBackoff, "retry-max-backoff", c.RetryMaxBackoff, "longest wait between attempts of an AWS API call")
+	fs.StringVar(&c.EndpointURL, "endpoint-url", c.EndpointURL, "endpoint replacing that of every AWS service")
+	fs.Func("endpoint", "comma-separated service=url endpoints of individual services", func(v string) error {
+		if c.Endpoints == nil {
+			c.Endpoints = make(map[string]string)
+		}
+		for _, pair := range gd.SplitList([]string{v}) {
+			service, endpoint, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%q must be service=url", pair)
+			}
+			c.Endpoints[strings.TrimSpace(service)] = strings.TrimSpace(endpoint)
+		}
+		return nil
+	})
+	fs.BoolVar(&c.UseFIPS, "use-fips", c.UseFIPS, "use the FIPS endpoints of each AWS service")
+	fs.StringVar(&c.AWSHTTP.ProxyURL, "aws-http-proxy-url", c.AWSHTTP.ProxyURL, "proxy that AWS calls go through (default $HTTPS_PROXY)")
+	fs.Func("aws-http-no-proxy", "comma-separated hosts, domains, and CIDR ranges that AWS calls reach without the proxy", func(v string) error {
+		c.AWSHTTP.NoProxy = gd.SplitList([]string{v})
+		return nil
+	})
+	fs.StringVar(&c.AWSHTTP.CABundle, "aws-http-ca-bundle", c.AWSHTTP.CABundle, "PEM file of CA certificates trusted for AWS calls besides the system's")
+	fs.StringVar(&c.AWSHTTP.ClientCert, "aws-http-client-cert", c.AWSHTTP.ClientCert, "PEM client certificate presented by AWS calls")
+	fs.StringVar(&c.AWSHTTP.ClientKey, "aws-http-client-key", c.AWSHTTP.ClientKey, "PEM private key of the client certificate")
+	fs.StringVar(&c.AWSHTTP.TLSMinVersion, "aws-http-tls-min-version", c.AWSHTTP.TLSMinVersion, "oldest TLS version of AWS calls: 1.2 or 1.3 (default 1.2)")
+	fs.DurationVar(&c.AWSHTTP.ConnectTimeout, "aws-http-connect-timeout", c.AWSHTTP.ConnectTimeout, "time limit for opening a connection to AWS (default 30s)")
+	fs.DurationVar(&c.AWSHTTP.ReadTimeout, "aws-http-read-timeout", c.AWSHTTP.ReadTimeout, "time limit for the response headers of each AWS request (0 for no limit)")
+	fs.Float64Var(&c.RateLimit, "rate-limit", c.RateLimit, "GuardDuty requests per second for each account and region (0 for no limit)")
+	fs.IntVar(&c.RateBurst, "rate-burst", c.RateBurst, "requests allowed at once above the rate limit (default one second's worth)")
+	fs.DurationVar(&c.Timeout, "timeout", c.Timeout, "time limit for fetching a single region (0 for no limit)")
+	fs.DurationVar(&c.CallTimeout, "call-timeout", c.CallTimeout, "time limit for each GuardDuty and EC2 API call (0 for no limit)")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "time allowed for requests and jobs to finish on shutdown")
+	fs.IntVar(&c.MaxConcurrentJobs, "max-concurrent-jobs", c.MaxConcurrentJobs, "most export jobs run at once, with the rest queued (0 for no limit)")
+	fs.IntVar(&c.MaxJobsPerAccount, "max-jobs-per-account", c.MaxJobsPerAccount, "most export jobs run at once for the same AWS account (0 for no limit)")
+	fs.StringVar(&c.CheckpointDir, "checkpoint-dir", c.CheckpointDir, "directory that export jobs checkpoint their progress in, so failed jobs can be resumed")
+	fs.Float64Var(&c.MinSeverity, "min-severity", c.MinSeverity, "exclude findings below this severity")
+	fs.StringVar(&c.Format, "format", c.Format, "output format")
+	fs.BoolVar(&c.CSVSanitize, "csv-sanitize", c.CSVSanitize, "escape CSV cells that spreadsheets would evaluate as formulas")
+	fs.BoolVar(&c.CSVBOM, "csv-bom", c.CSVBOM, "start CSV exports with a UTF-8 byte order mark for Excel")
+	fs.StringVar(&c.Locale, "locale", c.Locale, "language and date layout of reports: "+strings.Join(export.Locales, ", "))
+	fs.IntVar(&c.BatchSize, "batch-size", c.BatchSize, "finding IDs per GetFindings call (at most 50)")
+	fs.IntVar(&c.BatchRetries, "batch-retries", c.BatchRetries, "retries for a failed GetFindings batch")
+	fs.IntVar(&c.MaxFindings, "max-findings", c.MaxFindings, "most findings written by an export before it is truncated (0 for no limit)")
+	fs.DurationVar(&c.MaxDuration, "max-duration", c.MaxDuration, "longest an export runs before it is truncated (0 for no limit)")
+	fs.StringVar(&c.Destination, "destination", c.Destination, "where exports are stored: local, s3, both, splunk, elasticsearch, syslog, or http")
+	fs.StringVar(&c.S3.Bucket, "s3-bucket", c.S3.Bucket, "bucket that exports are uploaded to")
+	fs.StringVar(&c.S3.Prefix, "s3-prefix", c.S3.Prefix, "key prefix for uploaded exports")
+	fs.StringVar(&c.S3.KMSKeyID, "s3-kms-key", c.S3.KMSKeyID, "KMS key for uploaded exports (default the AWS managed key)")
+	fs.BoolVar(&c.S3.PathStyle, "s3-path-style", c.S3.PathStyle, "address the bucket in the URL path, as LocalStack requires")
+	fs.StringVar(&c.Athena.Database, "athena-database", c.Athena.Database, "Glue database of the tables over partitioned exports, which upload their DDL")
+	fs.BoolVar(&c.Athena.Glue, "athena-glue", c.Athena.Glue, "create the tables and partitions of partitioned exports through the Glue API")
+	fs.StringVar(&c.Splunk.URL, "splunk-url", c.Splunk.URL, "base URL of the Splunk HTTP Event Collector of the splunk destination")
+	fs.StringVar(&c.Splunk.Token, "splunk-token", c.Splunk.Token, "HTTP Event Collector token")
+	fs.StringVar(&c.Splunk.Index, "splunk-index", c.Splunk.Index, "Splunk index of pushed findings (default the token's)")
+	fs.StringVar(&c.Elasticsearch.URL, "elasticsearch-url", c.Elasticsearch.URL, "base URL of the Elasticsearch or OpenSearch cluster of the elasticsearch destination")
+	fs.StringVar(&c.Elasticsearch.Index, "elasticsearch-index", c.Elasticsearch.Index, "index that pushed findings are written to")
+	fs.StringVar(&c.Elasticsearch.Username, "elasticsearch-username", c.Elasticsearch.Username, "user name for the cluster")
+	fs.StringVar(&c.Elasticsearch.Password, "elasticsearch-password", c.Elasticsearch.Password, "password for the cluster")
+	fs.StringVar(&c.Elasticsearch.APIKey, "elasticsearch-api-key", c.Elasticsearch.APIKey, "Elasticsearch API key for the cluster")
+	fs.StringVar(&c.Syslog.Address, "syslog-address", c.Syslog.Address, "host:port of the syslog collector of the syslog destination")
+	fs.StringVar(&c.Syslog.Network, "syslog-network", c.Syslog.Network, "syslog transport: udp, tcp, or tls")
+	fs.StringVar(&c.Syslog.Format, "syslog-format", c.Syslog.Format, "events sent to the syslog collector: cef or leef")
+	fs.StringVar(&c.HTTP.URL, "http-url", c.HTTP.URL, "endpoint that the http destination POSTs findings to")
+	fs.StringVar(&c.HTTP.Mode, "http-mode", c.HTTP.Mode, "requests of the http destination: batch, NDJSON batches, or finding, one per finding")
+	fs.StringVar(&c.HTTP.Secret, "http-secret", c.HTTP.Secret, "secret that signs the requests of the http destination with HMAC-SHA256")
+	fs.StringVar(&c.Email.Transport, "email-transport", c.Email.Transport, "how exports are emailed: ses or smtp (default not at all)")
+	fs.StringVar(&c.Email.From, "email-from", c.Email.From, "sender address of emailed exports")
+	fs.Func("email-to", "comma-separated recipients of emailed exports", func(v string) error {
+		c.Email.To = gd.SplitList([]string{v})
+		return nil
+	})
+	fs.StringVar(&c.Email.SMTP.Host, "smtp-host", c.Email.SMTP.Host, "SMTP relay that exports are emailed through")
+	fs.IntVar(&c.Email.SMTP.Port, "smtp-port", c.Email.SMTP.Port, "port of the SMTP relay")
+	fs.StringVar(&c.Email.SMTP.Username, "smtp-username", c.Email.SMTP.Username, "user name for the SMTP relay")
+	fs.StringVar(&c.Email.SMTP.Password, "smtp-password", c.Email.SMTP.Password, "password for the SMTP relay")
+	fs.StringVar(&c.Jira.URL, "jira-url", c.Jira.URL, "base URL of the Jira site that exports file issues in")
+	fs.StringVar(&c.Jira.Username, "jira-username", c.Jira.Username, "Jira Cloud account email, used with -jira-token as its API token")
+	fs.StringVar(&c.Jira.Token, "jira-token", c.Jira.Token, "Jira API token, or a Data Center personal access token without -jira-username")
+	fs.StringVar(&c.Jira.Project, "jira-project", c.Jira.Project, "key of the Jira project that issues are filed in")
+	fs.StringVar(&c.Signing.GPGKeyFile, "signing-gpg-key-file", c.Signing.GPGKeyFile, "armored GPG private key that signs stored exports")
+	fs.StringVar(&c.Signing.GPGPassphrase, "signing-gpg-passphrase", c.Signing.GPGPassphrase, "passphrase of the GPG signing key")
+	fs.StringVar(&c.Signing.KMSKeyID, "signing-kms-key", c.Signing.KMSKeyID, "asymmetric KMS key that signs stored exports")
+	fs.StringVar(&c.Signing.KMSAlgorithm, "signing-kms-algorithm", c.Signing.KMSAlgorithm, "KMS signing algorithm: "+strings.Join(kmsSigningAlgorithms, ", "))
+	fs.StringVar(&c.Encryption.KMSKeyID, "encryption-kms-key", c.Encryption.KMSKeyID, "symmetric KMS key that encrypts the file keys of stored exports")
+	fs.Func("encryption-recipients", "comma-separated age public keys that stored exports are encrypted for", func(v string) error {
+		c.Encryption.Recipients = gd.SplitList([]string{v})
+		return nil
+	})
+	fs.StringVar(&c.Encryption.Passphrase, "encryption-passphrase", c.Encryption.Passphrase, "passphrase that stored exports are encrypted with, instead of keys")
+	fs.StringVar(&c.Watch.QueueURL, "watch-queue-url", c.Watch.QueueURL, "URL of the SQS queue of GuardDuty events that the watch command reads")
+	fs.DurationVar(&c.Watch.Rotate, "watch-rotate", c.Watch.Rotate, "how often the watch command stores the findings received as a new file")
+	fs.StringVar(&c.PublicURL, "public-url", c.PublicURL, "address of the web interface that notifications link downloads to")
+	fs.StringVar(&c.StateFile, "state-file", c.StateFile, "file holding the watermarks of incremental exports")
+	fs.StringVar(&c.PresetsFile, "presets-file", c.PresetsFile, "file holding the saved export presets")
+	fs.StringVar(&c.SchedulesFile, "schedules-file", c.SchedulesFile, "file holding the schedules created through the API and the runs of every schedule")
+	fs.StringVar(&c.HistoryFile, "history-file", c.HistoryFile, "file holding the history of export runs")
+	fs.IntVar(&c.HistoryLimit, "history-limit", c.HistoryLimit, "number of export runs kept in the history (0 to turn it off)")
+	fs.StringVar(&c.StoreFile, "store-file", c.StoreFile, "SQLite database keeping every fetched finding for searching")
+	fs.StringVar(&c.SuppressionsFile, "suppressions-file", c.SuppressionsFile, "YAML or JSON list of suppressions leaving findings out of exports")
+	fs.StringVar(&c.SuppressedFile, "suppressed-file", c.SuppressedFile, "CSV file recording the findings suppressions left out of exports")
+	fs.StringVar(&c.GeoIP.CountryDatabase, "geoip-country-db", c.GeoIP.CountryDatabase, "MaxMind Country or City database resolving the countries of remote addresses")
+	fs.StringVar(&c.GeoIP.ASNDatabase, "geoip-asn-db", c.GeoIP.ASNDatabase, "MaxMind ASN database resolving the networks of remote addresses")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log message format: text or json")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "least severe level logged: debug, info, warn, or error")
+	fs.StringVar(&c.TemplatesDir, "templates-dir", c.TemplatesDir, "directory with an index.html replacing the built-in web interface")
+	fs.BoolVar(&c.APIDocs, "api-docs", c.APIDocs, "serve Swagger UI for the v1 API at /api/v1/docs")
+	fs.StringVar(&c.Auth.OIDC.Issuer, "oidc-issuer", c.Auth.OIDC.Issuer, "OpenID Connect issuer URL that web interface users sign in with")
+	fs.StringVar(&c.Auth.OIDC.ClientID, "oidc-client-id", c.Auth.OIDC.ClientID, "OpenID Connect client ID")
+	fs.StringVar(&c.Auth.OIDC.ClientSecret, "oidc-client-secret", c.Auth.OIDC.ClientSecret, "OpenID Connect client secret")
+	fs.StringVar(&c.Auth.OIDC.RedirectURL, "oidc-redirect-url", c.Auth.OIDC.RedirectURL, "the server's /auth/callback URL registered with the identity provider")
+	fs.StringVar(&c.Auth.OIDC.SessionSecret, "oidc-session-secret", c.Auth.OIDC.SessionSecret, "secret signing session cookies (default random, ending sessions on restart)")
+	fs.BoolVar(&c.SSOLogin, "sso-login", c.SSOLogin, "allow starting AWS SSO sign-ins from the web interface")
+	fs.BoolVar(&c.EnableDetectors, "enable-detectors", c.EnableDetectors, "allow admins to enable GuardDuty in the coverage gaps of exports")
+	fs.StringVar(&c.Tracing.Endpoint, "tracing-endpoint", c.Tracing.Endpoint, "OTLP/HTTP endpoint that traces are sent to (default $OTEL_EXPORTER_OTLP_ENDPOINT)")
+	fs.StringVar(&c.Tracing.ServiceName, "tracing-service-name", c.Tracing.ServiceName, "service name of exported traces")
+}
+
+// applyFlagOverrides copies the flags that were set explicitly on the command
+// line from flags into c, so they take precedence over config file values
+func applyFlagOverrides(fs *flag.FlagSet, c *Config, flags *Config) {
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			c.Listen = flags.Listen
+		case "grpc-listen":
+			c.GRPCListen = flags.GRPCListen
+		case "base-path":
+			c.BasePath = flags.BasePath
+		case "profile":
+			c.Profile = flags.Profile
+		case "credential-providers":
+			c.Credentials.Providers = flags.Credentials.Providers
+		case "aws-partition":
+			c.AWSPartition = flags.AWSPartition
+		case "synthetic-findings":
+			c.Synthetic.Findings = flags.Synthetic.Findings
+		case "synthetic-seed":
+			c.Synthetic.Seed = flags.Synthetic.Seed
+		case "synthetic-latency":
+			c.Synthetic.Latency = flags.Synthetic.Latency
+		case "default-regions":
+			c.Regions = flags.Regions
+		case "tls-cert":
+			c.TLS.CertFile = flags.TLS.CertFile
+		case "tls-key":
+			c.TLS.KeyFile = flags.TLS.KeyFile
+		case "autocert-host":
+			c.TLS.Autocert.Hosts = flags.TLS.Autocert.Hosts
+		case "autocert-cache-dir":
+			c.TLS.Autocert.CacheDir = flags.TLS.Autocert.CacheDir
+		case "autocert-email":
+			c.TLS.Autocert.Email = flags.TLS.Autocert.Email
+		case "http-redirect":
+			c.TLS.RedirectHTTP = flags.TLS.RedirectHTTP
+		case "output-dir":
+			c.OutputDir = flags.OutputDir
+		case "retention-max-age":
+			c.Retention.MaxAge = flags.Retention.MaxAge
+		case "retention-max-size-mb":
+			c.Retention.MaxSizeMB = flags.Retention.MaxSizeMB
+		case "retention-history-max-age":
+			c.Retention.HistoryMaxAge = flags.Retention.HistoryMaxAge
+		case "retention-store-max-age":
+			c.Retention.StoreMaxAge = flags.Retention.StoreMaxAge
+		case "retention-audit-max-age":
+			c.Retention.AuditMaxAge = flags.Retention.AuditMaxAge
+		case "retention-job-max-age":
+			c.Retention.JobMaxAge = flags.Retention.JobMaxAge
+		case "retention-purge-delay":
+			c.Retention.PurgeDelay = flags.Retention.PurgeDelay
+		case "findings-metrics-interval":
+			c.FindingsMetrics.Interval = flags.FindingsMetrics.Interval
+		case "region-scope":
+			c.RegionScope = flags.RegionScope
+		case "concurrency":
+			c.Concurrency = flags.Concurrency
+		case "retry-attempts":
+			c.RetryAttempts = flags.RetryAttempts
+		case "retry-mode":
+			c.RetryMode = flags.RetryMode
+		case "retry-max-backoff":
+			c.RetryMaxBackoff = flags.RetryMaxBackoff
+		case "endpoint-url":
+			c.EndpointURL = flags.EndpointURL
+		case "endpoint":
+			if c.Endpoints == nil {
+				c.Endpoints = make(map[string]string)
+			}
+			for service, endpoint := range flags.Endpoints {
+				c.Endpoints[service] = endpoint
+			}
+		case "use-fips":
+			c.UseFIPS = flags.UseFIPS
+		case "aws-http-proxy-url":
+			c.AWSHTTP.ProxyURL = flags.AWSHTTP.ProxyURL
+		case "aws-http-no-proxy":
+			c.AWSHTTP.NoProxy = flags.AWSHTTP.NoProxy
+		case "aws-http-ca-bundle":
+			c.AWSHTTP.CABundle = flags.AWSHTTP.CABundle
+		case "aws-http-client-cert":
+			c.AWSHTTP.ClientCert = flags.AWSHTTP.ClientCert
+		case "aws-http-client-key":
+			c.AWSHTTP.ClientKey = flags.AWSHTTP.ClientKey
+		case "aws-http-tls-min-version":
+			c.AWSHTTP.TLSMinVersion = flags.AWSHTTP.TLSMinVersion
+		case "aws-http-connect-timeout":
+			c.AWSHTTP.ConnectTimeout = flags.AWSHTTP.ConnectTimeout
+		case "aws-http-read-timeout":
+			c.AWSHTTP.ReadTimeout = flags.AWSHTTP.ReadTimeout
+		case "rate-limit":
+			c.RateLimit = flags.RateLimit
+		case "rate-burst":
+			c.RateBurst = flags.RateBurst
+		case "timeout":
+			c.Timeout = flags.Timeout
+		case "call-timeout":
+			c.CallTimeout = flags.CallTimeout
+		case "shutdown-timeout":
+			c.ShutdownTimeout = flags.ShutdownTimeout
+		case "max-concurrent-jobs":
+			c.MaxConcurrentJobs = flags.MaxConcurrentJobs
+		case "max-jobs-per-account":
+			c.MaxJobsPerAccount = flags.MaxJobsPerAccount
+		case "checkpoint-dir":
+			c.CheckpointDir = flags.CheckpointDir
+		case "min-severity":
+			c.MinSeverity = flags.MinSeverity
+		case "format":
+			c.Format = flags.Format
+		case "csv-sanitize":
+			c.CSVSanitize = flags.CSVSanitize
+		case "csv-bom":
+			c.CSVBOM = flags.CSVBOM
+		case "locale":
+			c.Locale = flags.Locale
+		case "batch-size":
+			c.BatchSize = flags.BatchSize
+		case "batch-retries":
+			c.BatchRetries = flags.BatchRetries
+		case "max-findings":
+			c.MaxFindings = flags.MaxFindings
+		case "max-duration":
+			c.MaxDuration = flags.MaxDuration
+		case "destination":
+			c.Destination = flags.Destination
+		case "s3-bucket":
+			c.S3.Bucket = flags.S3.Bucket
+		case "s3-prefix":
+			c.S3.Prefix = flags.S3.Prefix
+		case "s3-kms-key":
+			c.S3.KMSKeyID = flags.S3.KMSKeyID
+		case "s3-path-style":
+			c.S3.PathStyle = flags.S3.PathStyle
+		case "athena-database":
+			c.Athena.Database = flags.Athena.Database
+		case "athena-glue":
+			c.Athena.Glue = flags.Athena.Glue
+		case "splunk-url":
+			c.Splunk.URL = flags.Splunk.URL
+		case "splunk-token":
+			c.Splunk.Token = flags.Splunk.Token
+		case "splunk-index":
+			c.Splunk.Index = flags.Splunk.Index
+		case "elasticsearch-url":
+			c.Elasticsearch.URL = flags.Elasticsearch.URL
+		case "elasticsearch-index":
+			c.Elasticsearch.Index = flags.Elasticsearch.Index
+		case "elasticsearch-username":
+			c.Elasticsearch.Username = flags.Elasticsearch.Username
+		case "elasticsearch-password":
+			c.Elasticsearch.Password = flags.Elasticsearch.Password
+		case "elasticsearch-api-key":
+			c.Elasticsearch.APIKey = flags.Elasticsearch.APIKey
+		case "syslog-address":
+			c.Syslog.Address = flags.Syslog.Address
+		case "syslog-network":
+			c.Syslog.Network = flags.Syslog.Network
+		case "syslog-format":
+			c.Syslog.Format = flags.Syslog.Format
+		case "jira-url":
+			c.Jira.URL = flags.Jira.URL
+		case "jira-username":
+			c.Jira.Username = flags.Jira.Username
+		case "jira-token":
+			c.Jira.Token = flags.Jira.Token
+		case "jira-project":
+			c.Jira.Project = flags.Jira.Project
+		case "signing-gpg-key-file":
+			c.Signing.GPGKeyFile = flags.Signing.GPGKeyFile
+		case "signing-gpg-passphrase":
+			c.Signing.GPGPassphrase = flags.Signing.GPGPassphrase
+		case "signing-kms-key":
+			c.Signing.KMSKeyID = flags.Signing.KMSKeyID
+		case "signing-kms-algorithm":
+			c.Signing.KMSAlgorithm = flags.Signing.KMSAlgorithm
+		case "encryption-kms-key":
+			c.Encryption.KMSKeyID = flags.Encryption.KMSKeyID
+		case "encryption-recipients":
+			c.Encryption.Recipients = flags.Encryption.Recipients
+		case "encryption-passphrase":
+			c.Encryption.Passphrase = flags.Encryption.Passphrase
+		case "http-url":
+			c.HTTP.URL = flags.HTTP.URL
+		case "http-mode":
+			c.HTTP.Mode = flags.HTTP.Mode
+		case "http-secret":
+			c.HTTP.Secret = flags.HTTP.Secret
+		case "watch-queue-url":
+			c.Watch.QueueURL = flags.Watch.QueueURL
+		case "watch-rotate":
+			c.Watch.Rotate = flags.Watch.Rotate
+		case "email-transport":
+			c.Email.Transport = flags.Email.Transport
+		case "email-from":
+			c.Email.From = flags.Email.From
+		case "email-to":
+			c.Email.To = flags.Email.To
+		case "smtp-host":
+			c.Email.SMTP.Host = flags.Email.SMTP.Host
+		case "smtp-port":
+			c.Email.SMTP.Port = flags.Email.SMTP.Port
+		case "smtp-username":
+			c.Email.SMTP.Username = flags.Email.SMTP.Username
+		case "smtp-password":
+			c.Email.SMTP.Password = flags.Email.SMTP.Password
+		case "public-url":
+			c.PublicURL = flags.PublicURL
+		case "state-file":
+			c.StateFile = flags.StateFile
+		case "presets-file":
+			c.PresetsFile = flags.PresetsFile
+		case "schedules-file":
+			c.SchedulesFile = flags.SchedulesFile
+		case "history-file":
+			c.HistoryFile = flags.HistoryFile
+		case "history-limit":
+			c.HistoryLimit = flags.HistoryLimit
+		case "store-file":
+			c.StoreFile = flags.StoreFile
+		case "suppressions-file":
+			c.SuppressionsFile = flags.SuppressionsFile
+		case "suppressed-file":
+			c.SuppressedFile = flags.SuppressedFile
+		case "geoip-country-db":
+			c.GeoIP.CountryDatabase = flags.GeoIP.CountryDatabase
+		case "geoip-asn-db":
+			c.GeoIP.ASNDatabase = flags.GeoIP.ASNDatabase
+		case "log-format":
+			c.LogFormat = flags.LogFormat
+		case "log-level":
+			c.LogLevel = flags.LogLevel
+		case "templates-dir":
+			c.TemplatesDir = flags.TemplatesDir
+		case "api-docs":
+			c.APIDocs = flags.APIDocs
+		case "sso-login":
+			c.SSOLogin = flags.SSOLogin
+		case "enable-detectors":
+			c.EnableDetectors = flags.EnableDetectors
+		case "oidc-issuer":
+			c.Auth.OIDC.Issuer = flags.Auth.OIDC.Issuer
+		case "oidc-client-id":
+			c.Auth.OIDC.ClientID = flags.Auth.OIDC.ClientID
+		case "oidc-client-secret":
+			c.Auth.OIDC.ClientSecret = flags.Auth.OIDC.ClientSecret
+		case "oidc-redirect-url":
+			c.Auth.OIDC.RedirectURL = flags.Auth.OIDC.RedirectURL
+		case "oidc-session-secret":
+			c.Auth.OIDC.SessionSecret = flags.Auth.OIDC.SessionSecret
+		case "tracing-endpoint":
+			c.Tracing.Endpoint = flags.Tracing.Endpoint
+		case "tracing-service-name":
+			c.Tracing.ServiceName = flags.Tracing.ServiceName
+		}
+	})
+}
+
+// envPrefix starts the environment variable for each flag, such as
+// GUARDDUTY_EXPORT_CONCURRENCY for -concurrency
+const envPrefix = "GUARDDUTY_EXPORT_"
+
+// applyEnvOverrides sets each flag that was not given on the command line
+// from its environment variable, if that is set. Flags set this way are
+// treated as explicitly set, so they override config file values.
+func applyEnvOverrides(fs *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(name); ok {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("invalid %s %q: %v", name, v, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// columnFields returns the columns that exports of the config compute, to
+// check the columns it names against; those of the App compute the values
+func (c Config) columnFields() export.Fields {
+	var intel *threatIntel
+	if c.ThreatIntel.configured() {
+		intel = &threatIntel{}
+	}
+	// Invalid rules are reported by validateRules
+	rules, _ := gd.NewRuleSet(c.Rules)
+	return exportFields(nil, intel, rules)
+}
+
+// validate reports the first invalid setting in c
+func (c Config) validate() error {
+	if c.Listen == "" {
+		return fmt.Errorf("invalid listen address: must not be empty")
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("invalid listen address %q: must be host:port or :port", c.Listen)
+	}
+	if c.GRPCListen != "" {
+		if _, _, err := net.SplitHostPort(c.GRPCListen); err != nil {
+			return fmt.Errorf("invalid grpcListen address %q: must be host:port or :port", c.GRPCListen)
+		}
+		if c.GRPCListen == c.Listen {
+			return fmt.Errorf("invalid grpcListen address %q: must differ from listen", c.GRPCListen)
+		}
+	}
+	if c.BasePath != "" && (!strings.HasPrefix(c.BasePath, "/") || strings.HasSuffix(c.BasePath, "/") || strings.ContainsAny(c.BasePath, "?#") || strings.Contains(c.BasePath, "//")) {
+		return fmt.Errorf("invalid basePath %q: must be a path such as /guardduty", c.BasePath)
+	}
+	if !gd.ValidPartition(c.AWSPartition) {
+		return fmt.Errorf("invalid awsPartition %q: must be aws, aws-us-gov, or aws-cn", c.AWSPartition)
+	}
+	if err := c.Credentials.validate(); err != nil {
+		return err
+	}
+	if err := c.Synthetic.validate(); err != nil {
+		return err
+	}
+	for _, region := range c.Regions {
+		if region == "" {
+			return fmt.Errorf("invalid regions: region names must not be empty")
+		}
+	}
+	if info, err := os.Stat(c.OutputDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("invalid outputDir %q: must be an existing directory", c.OutputDir)
+	}
+	if err := c.Retention.validate(); err != nil {
+		return err
+	}
+	if err := c.FindingsMetrics.validate(); err != nil {
+		return err
+	}
+	if err := c.ResourceTags.validate(); err != nil {
+		return err
+	}
+	if err := c.ResourceState.validate(); err != nil {
+		return err
+	}
+	if err := c.SecurityHub.validate(); err != nil {
+		return err
+	}
+	if err := c.ThreatIntel.validate(); err != nil {
+		return err
+	}
+	if err := validateRules(c); err != nil {
+		return err
+	}
+	// The columns the config names may be those its exports compute
+	fields := c.columnFields()
+	if c.SuppressionsFile != "" {
+		if _, err := loadSuppressions(c.SuppressionsFile); err != nil {
+			return fmt.Errorf("invalid suppressionsFile: %v", err)
+		}
+	}
+	if err := c.Audit.validate(); err != nil {
+		return err
+	}
+	if !gd.ValidRegionGroup(c.RegionScope) {
+		return fmt.Errorf("invalid regionScope %q: must be one of %s", c.RegionScope, strings.Join(gd.RegionGroupNames, ", "))
+	}
+	if c.Concurrency < 1 {
+		return fmt.Errorf("invalid concurrency %d: must be at least 1", c.Concurrency)
+	}
+	if c.RetryAttempts < 1 {
+		return fmt.Errorf("invalid retryAttempts %d: must be at least 1", c.RetryAttempts)
+	}
+	if c.RetryMode != gd.RetryStandard && c.RetryMode != gd.RetryAdaptive {
+		return fmt.Errorf("invalid retryMode %q: must be standard or adaptive", c.RetryMode)
+	}
+	if c.RetryMaxBackoff < 0 {
+		return fmt.Errorf("invalid retryMaxBackoff %v: must not be negative", c.RetryMaxBackoff)
+	}
+	if c.EndpointURL != "" {
+		if err := validateEndpoint("endpointUrl", c.EndpointURL); err != nil {
+			return err
+		}
+	}
+	if err := validateEndpoints(c.Endpoints); err != nil {
+		return err
+	}
+	if err := validateTemplates(c.Templates); err != nil {
+		return err
+	}
+	if err := validateColumnMappings(c.ColumnMappings, fields); err != nil {
+		return err
+	}
+	if c.UseFIPS && (c.EndpointURL != "" || len(c.Endpoints) > 0) {
+		return fmt.Errorf("invalid useFips: custom endpoints are used as given, so give the FIPS endpoint URLs instead")
+	}
+	if err := c.AWSHTTP.validate(); err != nil {
+		return err
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("invalid rateLimit %v: must not be negative", c.RateLimit)
+	}
+	if c.RateBurst < 0 {
+		return fmt.Errorf("invalid rateBurst %d: must not be negative", c.RateBurst)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %v: must not be negative", c.Timeout)
+	}
+	if c.CallTimeout < 0 {
+		return fmt.Errorf("invalid callTimeout %v: must not be negative", c.CallTimeout)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("invalid shutdownTimeout %v: must not be negative", c.ShutdownTimeout)
+	}
+	if c.MaxConcurrentJobs < 0 {
+		return fmt.Errorf("invalid maxConcurrentJobs %d: must not be negative", c.MaxConcurrentJobs)
+	}
+	if c.MaxJobsPerAccount < 0 {
+		return fmt.Errorf("invalid maxJobsPerAccount %d: must not be negative", c.MaxJobsPerAccount)
+	}
+	if c.MinSeverity < 0 || c.MinSeverity > 10 {
+		return fmt.Errorf("invalid minSeverity %v: must be between 0 and 10", c.MinSeverity)
+	}
+	if !export.ValidFormat(c.Format) {
+		return fmt.Errorf("invalid format %q", c.Format)
+	}
+	if !export.ValidLocale(c.Locale) {
+		return fmt.Errorf("invalid locale %q: must be one of %s", c.Locale, strings.Join(export.Locales, ", "))
+	}
+	if len(c.Columns) == 0 {
+		return fmt.Errorf("invalid columns: at least one column is required")
+	}
+	for _, column := range c.Columns {
+		if err := fields.ValidColumn(column); err != nil {
+			return fmt.Errorf("invalid column %q: %v", column, err)
+		}
+	}
+	if c.BatchSize < 1 || c.BatchSize > gd.MaxGetFindingsBatch {
+		return fmt.Errorf("invalid batchSize %d: must be between 1 and %d", c.BatchSize, gd.MaxGetFindingsBatch)
+	}
+	if c.BatchRetries < 0 {
+		return fmt.Errorf("invalid batchRetries %d: must not be negative", c.BatchRetries)
+	}
+	if c.MaxFindings < 0 {
+		return fmt.Errorf("invalid maxFindings %d: must not be negative", c.MaxFindings)
+	}
+	if c.MaxDuration < 0 {
+		return fmt.Errorf("invalid maxDuration %v: must not be negative", c.MaxDuration)
+	}
+	if !validDestination(c.Destination) {
+		return fmt.Errorf("invalid destination %q: must be local, s3, both, splunk, elasticsearch, syslog, or http", c.Destination)
+	}
+	if usesS3(c.Destination) && c.S3.Bucket == "" {
+		return fmt.Errorf("destination %s requires s3.bucket", c.Destination)
+	}
+	if err := c.Splunk.validate(); err != nil {
+		return err
+	}
+	if err := c.Elasticsearch.validate(); err != nil {
+		return err
+	}
+	if err := c.Syslog.validate(); err != nil {
+		return err
+	}
+	if err := c.HTTP.validate(); err != nil {
+		return err
+	}
+	if c.Destination == destinationSplunk && (c.Splunk.URL == "" || c.Splunk.Token == "") {
+		return fmt.Errorf("destination splunk requires splunk.url and splunk.token")
+	}
+	if c.Destination == destinationElasticsearch && c.Elasticsearch.URL == "" {
+		return fmt.Errorf("destination elasticsearch requires elasticsearch.url")
+	}
+	if c.Destination == destinationSyslog && c.Syslog.Address == "" {
+		return fmt.Errorf("destination syslog requires syslog.address")
+	}
+	if c.Destination == destinationHTTP && c.HTTP.URL == "" {
+		return fmt.Errorf("destination http requires http.url")
+	}
+	if c.HistoryLimit < 0 {
+		return fmt.Errorf("invalid historyLimit %d: must not be negative", c.HistoryLimit)
+	}
+	if c.LogFormat != telemetry.LogText && c.LogFormat != telemetry.LogJSON {
+		return fmt.Errorf("invalid logFormat %q: must be text or json", c.LogFormat)
+	}
+	if _, ok := telemetry.LogLevels[c.LogLevel]; !ok {
+		return fmt.Errorf("invalid logLevel %q: must be debug, info, warn, or error", c.LogLevel)
+	}
+	if c.TemplatesDir != "" {
+		if info, err := os.Stat(filepath.Join(c.TemplatesDir, "index.html")); err != nil || info.IsDir() {
+			return fmt.Errorf("invalid templatesDir %q: must contain index.html", c.TemplatesDir)
+		}
+	}
+	if c.S3.URLExpiry <= 0 || c.S3.URLExpiry > maxPresignExpiry {
+		return fmt.Errorf("invalid s3.urlExpiry %v: must be positive and at most %v", c.S3.URLExpiry, maxPresignExpiry)
+	}
+	if err := c.Athena.validate(); err != nil {
+		return err
+	}
+	if err := c.Email.validate(); err != nil {
+		return err
+	}
+	if err := c.Jira.validate(fields); err != nil {
+		return err
+	}
+	if err := c.Signing.validate(); err != nil {
+		return err
+	}
+	if err := c.Encryption.validate(); err != nil {
+		return err
+	}
+	if err := c.Watch.validate(); err != nil {
+		return err
+	}
+	if err := validateWebhooks(c.Webhooks); err != nil {
+		return err
+	}
+	if c.PublicURL != "" {
+		if err := validateEndpoint("publicUrl", c.PublicURL); err != nil {
+			return err
+		}
+	}
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+	if err := c.TLS.validate(); err != nil {
+		return err
+	}
+	if err := c.Auth.validate(c.BasePath); err != nil {
+		return err
+	}
+	for _, schedule := range c.Schedules {
+		if _, err := parseCron(schedule.Cron); err != nil {
+			return fmt.Errorf("invalid schedule %q: %v", schedule.Name, err)
+		}
+	}
+	for _, role := range c.Roles {
+		if err := role.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := gd.ValidateCredentialMap(c.CredentialMap); err != nil {
+		return err
+	}
+	return c.Discovery.Validate()
+}
+
+// sortedNames returns the keys of a setting keyed by name, in order
+func sortedNames[T any](named map[string]T) []string {
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
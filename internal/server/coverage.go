@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+)
+
+// coverageReport lists the Runtime Monitoring coverage of the accounts and
+// regions of an export
+func coverageReport(ctx context.Context, opts gd.FetchOptions) reportOutput {
+	report := gd.ListCoverage(ctx, opts)
+	out := reportOutput{value: report, table: coverageTable(report), regions: len(report.Regions)}
+	for _, region := range report.Regions {
+		if region.Error != "" {
+			out.failed++
+		}
+	}
+	return out
+}
+
+// coverageTable lays out a coverage report as one row per covered resource,
+// followed by a row for each region that was skipped or could not be listed
+func coverageTable(report gd.CoverageReport) export.Table {
+	table := export.Table{
+		Name:    "Coverage",
+		Columns: []string{"AccountId", "Region", "DetectorId", "ResourceType", "ResourceId", "ClusterName", "InstanceType", "CoverageStatus", "Issue", "ManagementType", "AgentVersion", "AddonStatus", "Covered", "Compatible", "UpdatedAt"},
+	}
+	for _, r := range report.Resources {
+		table.Rows = append(table.Rows, []any{r.AccountID, r.Region, r.DetectorID, r.ResourceType, r.ResourceID, r.ClusterName, r.InstanceType, r.Status, r.Issue, r.ManagementType, r.AgentVersion, r.AddonStatus, reportCell(r.Covered), reportCell(r.Compatible), reportTime(r.UpdatedAt)})
+	}
+	for _, region := range report.Regions {
+		switch {
+		case region.Error != "":
+			table.Rows = append(table.Rows, []any{region.Account, region.Region, "", "", "", "", "", inventoryError, region.Error, "", "", "", "", "", ""})
+		case region.Skipped != "":
+			table.Rows = append(table.Rows, []any{region.Account, region.Region, "", "", "", "", "", inventorySkipped, region.Skipped, "", "", "", "", "", ""})
+		}
+	}
+	return table
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"guardduty/internal/gd"
+)
+
+// The sources of the server's credentials that credentials.providers
+// orders
+const (
+	credentialsEnvironment  = "environment"
+	credentialsWebIdentity  = "webIdentity"
+	credentialsSharedConfig = "sharedConfig"
+	credentialsContainer    = "container"
+	credentialsEC2          = "ec2"
+)
+
+// defaultCredentialProviders are the sources in the order the SDK tries
+// them when no profile is selected
+var defaultCredentialProviders = []string{credentialsEnvironment, credentialsWebIdentity, credentialsSharedConfig, credentialsContainer, credentialsEC2}
+
+// Hosts of the ECS and EKS Pod Identity credential endpoints
+const (
+	ecsCredentialsHost     = "169.254.170.2"
+	eksPodIdentityHost     = "169.254.170.23"
+	eksPodIdentityIPv6Host = "fd00:ec2::23"
+)
+
+// irsaTokenDir is where EKS mounts the web identity token of IRSA, and
+// defaultWebIdentitySession the session name of its role without
+// AWS_ROLE_SESSION_NAME
+const (
+	irsaTokenDir              = "/var/run/secrets/eks.amazonaws.com/"
+	defaultWebIdentitySession = "guardduty-exporter"
+)
+
+// credentialHints suggest what to check when credentials of each kind cannot
+// be resolved
+var credentialHints = map[string]string{
+	"environment":    "check AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, and that AWS_SESSION_TOKEN is set and current for temporary keys",
+	"static":         "check the access keys of the profile in the shared credentials file",
+	"sso":            "sign in again with aws sso login, or from the web interface when ssoLogin is enabled",
+	"assumeRole":     "check the profile's source_profile or credential_source, and that the role's trust policy allows them",
+	"process":        "run the profile's credential_process by hand to see its error",
+	"webIdentity":    "check that the token file is readable and current, and that the role's trust policy allows its identity provider",
+	"irsa":           "check the service account's eks.amazonaws.com/role-arn annotation, and that the role's trust policy allows the cluster's OIDC provider and the service account",
+	"ecs":            "check the taskRoleArn of the task definition, and that the container can reach " + ecsCredentialsHost,
+	"eksPodIdentity": "check the pod identity association of the service account, and that the EKS Pod Identity Agent add-on is running",
+	"ec2":            "attach an instance profile with a role to the instance; in a container, IMDSv2 also needs a metadata hop limit of 2",
+}
+
+// credentialsConfig sets where the server's own credentials come from,
+// those of exports that select no profile. Without it the SDK resolves
+// them from the environment, the shared config profile, web identity
+// (including EKS IRSA), the ECS or EKS Pod Identity endpoint, or the EC2
+// instance profile, in that order.
+type credentialsConfig struct {
+	// Providers are the sources tried, in order, of environment,
+	// webIdentity, sharedConfig, container, and ec2. The first one set up
+	// in the server's environment provides the credentials, and one left
+	// out is never used, such as ec2 so that a misconfigured pod role
+	// doesn't fall back to the node's. Empty tries them all in the SDK's
+	// order.
+	Providers   []string                   `yaml:"providers"`
+	WebIdentity webIdentityConfig          `yaml:"webIdentity"`
+	Container   containerCredentialsConfig `yaml:"container"`
+	EC2         ec2CredentialsConfig       `yaml:"ec2"`
+}
+
+// webIdentityConfig replaces the AWS_ROLE_ARN, AWS_WEB_IDENTITY_TOKEN_FILE,
+// and AWS_ROLE_SESSION_NAME variables of web identity credentials
+type webIdentityConfig struct {
+	RoleARN     string `yaml:"roleArn"`
+	TokenFile   string `yaml:"tokenFile"`
+	SessionName string `yaml:"sessionName"`
+}
+
+// containerCredentialsConfig replaces the AWS_CONTAINER_CREDENTIALS_FULL_URI
+// and AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE variables of the ECS and EKS
+// Pod Identity credential endpoints
+type containerCredentialsConfig struct {
+	Endpoint  string `yaml:"endpoint"`
+	TokenFile string `yaml:"tokenFile"`
+}
+
+// ec2CredentialsConfig replaces the AWS_EC2_METADATA_SERVICE_ENDPOINT
+// variable of the instance metadata service
+type ec2CredentialsConfig struct {
+	Endpoint string `yaml:"endpoint"`
+}
+
+// configured reports whether the server resolves its credentials itself
+// rather than through the SDK's chain
+func (c credentialsConfig) configured() bool {
+	return len(c.Providers) > 0 || c.WebIdentity != (webIdentityConfig{}) || c.Container != (containerCredentialsConfig{}) || c.EC2 != (ec2CredentialsConfig{})
+}
+
+func (c credentialsConfig) validate() error {
+	for i, provider := range c.Providers {
+		if !slices.Contains(defaultCredentialProviders, provider) {
+			return fmt.Errorf("invalid credentials.providers %q: must be environment, webIdentity, sharedConfig, container, or ec2", provider)
+		}
+		if slices.Contains(c.Providers[:i], provider) {
+			return fmt.Errorf("invalid credentials.providers: %s is listed twice", provider)
+		}
+	}
+	if arn := c.WebIdentity.RoleARN; arn != "" {
+		if err := (gd.Role{ARN: arn}).Validate(); err != nil {
+			return fmt.Errorf("invalid credentials.webIdentity.roleArn %q: must be an IAM role ARN", arn)
+		}
+	}
+	for name, endpoint := range map[string]string{"container": c.Container.Endpoint, "ec2": c.EC2.Endpoint} {
+		if endpoint == "" {
+			continue
+		}
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid credentials.%s.endpoint %q: must be an http or https URL", name, endpoint)
+		}
+	}
+	return nil
+}
+
+// credentialsView describes the credentials of a profile, or of the
+// server's own when it is the configured one
+type credentialsView struct {
+	// Source is the kind of credentials: environment, static, sso,
+	// assumeRole, process, webIdentity, irsa, ecs, eksPodIdentity, or ec2
+	Source string `json:"source"`
+	// Providers are the sources of credentials.providers, when the server
+	// resolves its credentials itself
+	Providers []string `json:"providers,omitempty"`
+	// Unavailable explains why none of the sources is set up
+	Unavailable string `json:"unavailable,omitempty"`
+	Hint        string `json:"hint,omitempty"`
+}
+
+// chainSource is a source of credentials as set up in the server's
+// environment: its kind, or why it isn't set up
+type chainSource struct {
+	name        string
+	kind        string
+	unavailable string
+	// provider returns the source's credentials provider, using base for
+	// the STS and HTTP calls it makes
+	provider func(ctx context.Context, base aws.Config) (aws.CredentialsProvider, error)
+}
+
+// credentialSources returns the sources of the credentials of profile in
+// the order they are tried. A profile other than the configured one, which
+// an export selects, only has its own. Without credentials configured,
+// these are the sources the SDK tries, which for a selected profile are
+// the profile and then the container and instance roles.
+func credentialSources(conf Config, profile string) []chainSource {
+	c := conf.Credentials
+	if profile != conf.Profile {
+		return []chainSource{sharedConfigSource(profile)}
+	}
+	providers := c.Providers
+	switch {
+	case len(providers) > 0:
+	case !c.configured() && (profile != "" || os.Getenv("AWS_PROFILE") != ""):
+		providers = []string{credentialsSharedConfig, credentialsContainer, credentialsEC2}
+	default:
+		providers = defaultCredentialProviders
+	}
+	sources := make([]chainSource, len(providers))
+	for i, provider := range providers {
+		switch provider {
+		case credentialsEnvironment:
+			sources[i] = environmentSource()
+		case credentialsWebIdentity:
+			sources[i] = webIdentitySource(c.WebIdentity)
+		case credentialsSharedConfig:
+			sources[i] = sharedConfigSource(profile)
+		case credentialsContainer:
+			sources[i] = containerSource(c.Container)
+		case credentialsEC2:
+			sources[i] = ec2Source(c.EC2)
+		}
+	}
+	return sources
+}
+
+// selectCredentialSource returns the first source of sources that is set
+// up, or false with why none is
+func selectCredentialSource(sources []chainSource) (chainSource, string, bool) {
+	reasons := make([]string, 0, len(sources))
+	for _, source := range sources {
+		if source.unavailable == "" {
+			return source, "", true
+		}
+		reasons = append(reasons, source.name+": "+source.unavailable)
+	}
+	return chainSource{}, strings.Join(reasons, "; "), false
+}
+
+// describeCredentials returns the kind of the credentials of profile and a
+// hint for when they cannot be resolved, from the environment and shared
+// config files without resolving them
+func describeCredentials(conf Config, profile string) credentialsView {
+	source, unavailable, ok := selectCredentialSource(credentialSources(conf, profile))
+	view := credentialsView{Source: source.kind, Unavailable: unavailable, Hint: credentialHints[source.kind]}
+	if profile == conf.Profile && conf.Credentials.configured() {
+		view.Providers = conf.Credentials.Providers
+		if len(view.Providers) == 0 {
+			view.Providers = defaultCredentialProviders
+		}
+	}
+	if !ok {
+		view.Hint = "set up one of the sources, or change credentials.providers"
+	}
+	return view
+}
+
+// configuredCredentials returns the provider of the server's credentials
+// when credentials are configured: that of the first source set up, or one
+// failing with why none is. Its calls use base, which has the exporter's
+// HTTP client and retries.
+func configuredCredentials(ctx context.Context, conf Config, base aws.Config) (aws.CredentialsProvider, error) {
+	source, unavailable, ok := selectCredentialSource(credentialSources(conf, conf.Profile))
+	if !ok {
+		return aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{}, fmt.Errorf("no source of credentials.providers is set up: %s", unavailable)
+		}), nil
+	}
+	provider, err := source.provider(ctx, base)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up %s credentials: %v", source.name, err)
+	}
+	return provider, nil
+}
+
+// environmentSource reads access keys from the environment
+func environmentSource() chainSource {
+	source := chainSource{name: credentialsEnvironment, kind: "environment"}
+	env, err := config.NewEnvConfig()
+	if err != nil || !env.Credentials.HasKeys() {
+		source.unavailable = "AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are not set"
+		return source
+	}
+	source.provider = func(context.Context, aws.Config) (aws.CredentialsProvider, error) {
+		return credentials.StaticCredentialsProvider{Value: env.Credentials}, nil
+	}
+	return source
+}
+
+// webIdentitySource assumes a role with a web identity token file, as EKS
+// IRSA mounts in its pods
+func webIdentitySource(c webIdentityConfig) chainSource {
+	source := chainSource{name: credentialsWebIdentity, kind: "webIdentity"}
+	roleARN, tokenFile, session := c.RoleARN, c.TokenFile, c.SessionName
+	if roleARN == "" {
+		roleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if session == "" {
+		session = os.Getenv("AWS_ROLE_SESSION_NAME")
+	}
+	if session == "" {
+		session = defaultWebIdentitySession
+	}
+	if strings.HasPrefix(tokenFile, irsaTokenDir) {
+		source.kind = "irsa"
+	}
+	switch {
+	case tokenFile == "":
+		source.unavailable = "AWS_WEB_IDENTITY_TOKEN_FILE is not set"
+		return source
+	case roleARN == "":
+		source.unavailable = "AWS_ROLE_ARN is not set"
+		return source
+	}
+	source.provider = func(_ context.Context, base aws.Config) (aws.CredentialsProvider, error) {
+		return stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(base), roleARN, stscreds.IdentityTokenFile(tokenFile), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = session
+		}), nil
+	}
+	return source
+}
+
+// sharedConfigSource reads a profile of the shared config and credentials
+// files, the default one when profile is empty
+func sharedConfigSource(profile string) chainSource {
+	source := chainSource{name: credentialsSharedConfig}
+	name := profile
+	if name == "" {
+		name = os.Getenv("AWS_PROFILE")
+	}
+	if name == "" {
+		name = "default"
+	}
+	keys, err := profileKeys(name)
+	if err != nil {
+		source.unavailable = err.Error()
+		return source
+	}
+	if source.kind = credentialSource(keys); source.kind == "" {
+		source.unavailable = fmt.Sprintf("profile %q has no credentials", name)
+		return source
+	}
+	source.provider = func(ctx context.Context, base aws.Config) (aws.CredentialsProvider, error) {
+		options := []func(*config.LoadOptions) error{config.WithSharedConfigProfile(name), config.WithHTTPClient(base.HTTPClient)}
+		if base.Retryer != nil {
+			options = append(options, config.WithRetryer(base.Retryer))
+		}
+		cfg, err := config.LoadDefaultConfig(ctx, options...)
+		if err != nil {
+			return nil, err
+		}
+		return cfg.Credentials, nil
+	}
+	return source
+}
+
+// profileKeys returns the keys a profile sets in the shared config and
+// credentials files
+func profileKeys(profile string) (map[string]bool, error) {
+	configFile, credentialsFile := sharedFiles()
+	keys := make(map[string]map[string]bool)
+	if err := readProfileKeys(configFile, true, keys); err != nil {
+		return nil, err
+	}
+	if err := readProfileKeys(credentialsFile, false, keys); err != nil {
+		return nil, err
+	}
+	return keys[profile], nil
+}
+
+// containerSource gets credentials from the endpoint of an ECS task role or
+// an EKS Pod Identity association
+func containerSource(c containerCredentialsConfig) chainSource {
+	source := chainSource{name: credentialsContainer, kind: "ecs"}
+	endpoint, tokenFile := c.Endpoint, c.TokenFile
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	}
+	if endpoint == "" {
+		if path := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); path != "" {
+			endpoint = "http://" + ecsCredentialsHost + path
+		}
+	}
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE")
+	}
+	if endpoint == "" {
+		source.unavailable = "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI and AWS_CONTAINER_CREDENTIALS_FULL_URI are not set"
+		return source
+	}
+	if u, err := url.Parse(endpoint); err == nil && (u.Hostname() == eksPodIdentityHost || u.Hostname() == eksPodIdentityIPv6Host) {
+		source.kind = "eksPodIdentity"
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	source.provider = func(_ context.Context, base aws.Config) (aws.CredentialsProvider, error) {
+		return endpointcreds.New(endpoint, func(o *endpointcreds.Options) {
+			o.HTTPClient = base.HTTPClient
+			o.AuthorizationToken = token
+			if tokenFile != "" {
+				// The token is rotated, so it is read for each request
+				o.AuthorizationTokenProvider = endpointcreds.TokenProviderFunc(func() (string, error) {
+					data, err := os.ReadFile(tokenFile)
+					if err != nil {
+						return "", fmt.Errorf("error reading authorization token: %v", err)
+					}
+					return strings.TrimSpace(string(data)), nil
+				})
+			}
+		}), nil
+	}
+	return source
+}
+
+// ec2Source gets the credentials of the instance profile from the instance
+// metadata service. Whether there is one is only known by asking, so it is
+// always set up unless AWS_EC2_METADATA_DISABLED is.
+func ec2Source(c ec2CredentialsConfig) chainSource {
+	source := chainSource{name: credentialsEC2, kind: "ec2"}
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		source.unavailable = "AWS_EC2_METADATA_DISABLED is set"
+		return source
+	}
+	source.provider = func(_ context.Context, base aws.Config) (aws.CredentialsProvider, error) {
+		return ec2rolecreds.New(func(o *ec2rolecreds.Options) {
+			o.Client = imds.New(imds.Options{Endpoint: c.Endpoint, HTTPClient: base.HTTPClient})
+		}), nil
+	}
+	return source
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// Export destinations: the local filesystem, an S3 bucket, or both. The
+// SIEM destinations are in siem.go.
+const (
+	destinationLocal = "local"
+	destinationS3    = "s3"
+	destinationBoth  = "both"
+)
+
+// maxPresignExpiry is the longest lifetime of a SigV4 presigned URL
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// s3Config selects the bucket that exports are uploaded to. Objects are
+// encrypted with SSE-KMS, using the bucket's default AWS managed key when
+// KMSKeyID is empty.
+type s3Config struct {
+	Bucket   string `yaml:"bucket"`
+	Prefix   string `yaml:"prefix"`
+	Region   string `yaml:"region"`
+	KMSKeyID string `yaml:"kmsKeyId"`
+	// PathStyle addresses the bucket in the URL path instead of the host
+	// name, as LocalStack and some S3-compatible endpoints require
+	PathStyle bool `yaml:"pathStyle"`
+	// URLExpiry is the lifetime of the presigned download URLs
+	URLExpiry time.Duration `yaml:"urlExpiry"`
+}
+
+// validDestination reports whether d names an export destination
+func validDestination(d string) bool {
+	return d == destinationLocal || d == destinationS3 || d == destinationBoth || pushesToSIEM(d)
+}
+
+// usesS3 reports whether exports to destination d are uploaded to S3
+func usesS3(d string) bool {
+	return d == destinationS3 || d == destinationBoth
+}
+
+// s3Upload records where an export was uploaded and how to download it
+type s3Upload struct {
+	bucket    string
+	key       string
+	url       string
+	expiresAt time.Time
+}
+
+// uri returns the s3:// location of the upload
+func (u s3Upload) uri() string {
+	return fmt.Sprintf("s3://%s/%s", u.bucket, u.key)
+}
+
+// s3Client returns a client for the configured bucket's region
+func (a *App) s3Client() *s3.Client {
+	return s3.NewFromConfig(a.awsCfg, func(o *s3.Options) {
+		if a.config().S3.Region != "" {
+			o.Region = a.config().S3.Region
+		}
+		o.UsePathStyle = a.config().S3.PathStyle
+	})
+}
+
+// uploadExport uploads the export at filePath to the configured bucket under
+// filename, with the checksum and signature sealExport wrote beside it, and
+// presigns a URL to download it
+func (a *App) uploadExport(ctx context.Context, filePath, filename, contentType string) (s3Upload, error) {
+	upload := s3Upload{bucket: a.config().S3.Bucket, key: path.Join(a.config().S3.Prefix, filename)}
+	if err := a.putObject(ctx, filePath, upload.key, contentType); err != nil {
+		return s3Upload{}, err
+	}
+	for _, suffix := range sidecarSuffixes {
+		if _, err := os.Stat(filePath + suffix); err != nil {
+			continue
+		}
+		if err := a.putObject(ctx, filePath+suffix, upload.key+suffix, sidecarContentType(suffix)); err != nil {
+			return s3Upload{}, err
+		}
+	}
+
+	if err := a.presignUpload(ctx, &upload, filename); err != nil {
+		return s3Upload{}, err
+	}
+	telemetry.Logger(ctx).Info("Uploaded export", "object", upload.uri())
+	return upload, nil
+}
+
+// putObject uploads the file at filePath to key in the configured bucket
+func (a *App) putObject(ctx context.Context, filePath, key, contentType string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error opening export: %v", err)
+	}
+	defer file.Close()
+	if err := a.putObjectBody(ctx, file, key, contentType); err != nil {
+		return fmt.Errorf("error uploading export to s3://%s/%s: %v", a.config().S3.Bucket, key, err)
+	}
+	return nil
+}
+
+// putObjectBody uploads body to key in the configured bucket, encrypted as
+// exports are, and returns the error of the SDK as is
+func (a *App) putObjectBody(ctx context.Context, body io.Reader, key, contentType string) error {
+	conf := a.config().S3
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(conf.Bucket),
+		Key:                  aws.String(key),
+		Body:                 body,
+		ContentType:          aws.String(contentType),
+		ServerSideEncryption: s3types.ServerSideEncryptionAwsKms,
+	}
+	if conf.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(conf.KMSKeyID)
+	}
+	_, err := a.s3Client().PutObject(ctx, input)
+	return err
+}
+
+// uploadPartitions writes a Parquet or CSV file per region and day to a
+// temporary directory, uploads them beneath the partitioned table's prefix,
+// and registers the partitions for Athena when configured. The
+// returned upload names the table location and has no download URL. A region
+// that fails the export stops it before anything is uploaded, and the files
+// already uploaded are deleted if an upload fails or the export is canceled,
+// so the table does not show part of an export.
+func (a *App) uploadPartitions(ctx context.Context, opts export.WriteOptions, filename string, stream *gd.Stream) (s3Upload, int, error) {
+	dir, err := os.MkdirTemp("", "guardduty_partitions_*")
+	if err != nil {
+		return s3Upload{}, 0, fmt.Errorf("error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files, totalFindings, err := export.WritePartitions(dir, filename, opts, stream)
+	if result, failed := stream.Failed(); failed {
+		return s3Upload{}, totalFindings, result.Err
+	}
+	if err != nil {
+		return s3Upload{}, totalFindings, err
+	}
+	upload := s3Upload{bucket: a.config().S3.Bucket, key: path.Join(a.config().S3.Prefix, partitionTable(opts.Format)) + "/"}
+	var uploaded []string
+	for _, file := range files {
+		key := upload.key + filepath.ToSlash(file)
+		if err := a.putObject(ctx, filepath.Join(dir, file), key, export.Formats[opts.Format].ContentType); err != nil {
+			a.deleteObjects(ctx, uploaded)
+			return s3Upload{}, totalFindings, err
+		}
+		uploaded = append(uploaded, key)
+	}
+	telemetry.Logger(ctx).Info("Uploaded partition files", "files", len(files), "table", upload.uri())
+	a.registerPartitions(ctx, opts, filename, upload.uri(), files)
+	return upload, totalFindings, nil
+}
+
+// deleteObjects removes the objects uploaded by an export that did not
+// complete. The context may have been canceled, so the deletes get their own
+// time limit; objects that cannot be deleted are logged.
+func (a *App) deleteObjects(ctx context.Context, keys []string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	bucket := a.config().S3.Bucket
+	for _, key := range keys {
+		_, err := a.s3Client().DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		if err != nil {
+			telemetry.Logger(ctx).Error("Error deleting partial export", "object", fmt.Sprintf("s3://%s/%s", bucket, key), "error", err)
+		}
+	}
+}
+
+// presignUpload sets a fresh presigned download URL on upload
+func (a *App) presignUpload(ctx context.Context, upload *s3Upload, filename string) error {
+	expiry := a.config().S3.URLExpiry
+	presigned, err := s3.NewPresignClient(a.s3Client()).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket:                     aws.String(upload.bucket),
+		Key:                        aws.String(upload.key),
+		ResponseContentDisposition: aws.String(fmt.Sprintf("attachment; filename=%q", filename)),
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return fmt.Errorf("error presigning %s: %v", upload.uri(), err)
+	}
+	upload.url = presigned.URL
+	upload.expiresAt = time.Now().Add(expiry)
+	return nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// Statuses of inventory rows that describe a region rather than a detector
+const (
+	inventoryNoDetector = "NO_DETECTOR"
+	inventorySkipped    = "SKIPPED"
+	inventoryError      = "ERROR"
+)
+
+// handleDetectors lists the detectors of the accounts and regions selected
+// by the export parameters, with their status, publishing frequency, and
+// features, as JSON or, with format=csv, as a CSV download of one row per
+// detector
+func (a *App) handleDetectors(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, fmt.Sprintf("Invalid format %q: the detector inventory is json or csv", format), http.StatusBadRequest)
+		return
+	}
+	opts, err := a.parseExportOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := gd.ResolveRegions(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+	if err := gd.ResolveAccounts(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+
+	inventory := gd.DetectorInventory(r.Context(), opts.FetchOptions)
+	log := telemetry.Logger(r.Context())
+	log.Info("Listed detectors", "regions", opts.Regions, "gaps", len(inventory.Gaps))
+	if format != "csv" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(inventory)
+		return
+	}
+	filename := fmt.Sprintf("guardduty_detectors_%s.csv", time.Now().Format("20060102_150405"))
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if err := writeInventoryCSV(w, inventory); err != nil {
+		log.Error("Error writing detector inventory", "error", err)
+	}
+}
+
+// handleEnableDetector closes a coverage gap: it creates a detector in the
+// account and region the request selects, or enables its suspended one
+func (a *App) handleEnableDetector(w http.ResponseWriter, r *http.Request) {
+	if !a.config().EnableDetectors {
+		http.Error(w, "Enabling GuardDuty from the server is disabled", http.StatusForbidden)
+		return
+	}
+	opts, status, err := a.targetOptions(r, "GuardDuty is enabled")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	enabled, err := gd.EnableDetector(r.Context(), opts.FetchOptions)
+	if err != nil {
+		http.Error(w, err.Error(), a.callErrorStatus(opts, err))
+		return
+	}
+	telemetry.Logger(r.Context()).Info("Enabled detector", "region", gd.TargetLabel(enabled.Account, enabled.Region), "detector", enabled.Detector.DetectorID, "created", enabled.Created, "user", opts.user)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enabled)
+}
+
+// writeInventoryCSV writes one row per detector, with a column per
+// protection feature, and one row for each region without a detector, that
+// was skipped, or that could not be queried
+func writeInventoryCSV(out io.Writer, inventory gd.Inventory) error {
+	w := csv.NewWriter(out)
+	header := []string{"AccountId", "Region", "DetectorId", "Status", "FindingPublishingFrequency", "CreatedAt", "UpdatedAt"}
+	for _, feature := range gd.ProtectionFeatures {
+		header = append(header, string(feature))
+	}
+	w.Write(append(header, "Notes"))
+
+	regionRow := func(region gd.RegionDetectors, status, notes string) {
+		row := make([]string, len(header)+1)
+		row[0], row[1], row[3], row[len(header)] = region.Account, region.Region, status, notes
+		w.Write(row)
+	}
+	for _, region := range inventory.Regions {
+		switch {
+		case region.Error != "":
+			regionRow(region, inventoryError, region.Error)
+		case region.Skipped != "":
+			regionRow(region, inventorySkipped, region.Skipped)
+		case len(region.Detectors) == 0:
+			regionRow(region, inventoryNoDetector, "GuardDuty is not enabled in this region")
+		}
+		for _, detector := range region.Detectors {
+			row := []string{region.Account, region.Region, detector.DetectorID, detector.Status, detector.FindingPublishingFrequency, detector.CreatedAt, detector.UpdatedAt}
+			for _, feature := range gd.ProtectionFeatures {
+				row = append(row, detector.FeatureStatus(feature))
+			}
+			w.Write(append(row, ""))
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
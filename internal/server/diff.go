@@ -0,0 +1,416 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// diffFinding is the part of a finding compared between two exports
+type diffFinding struct {
+	AccountID string   `json:"accountId,omitempty"`
+	Region    string   `json:"region"`
+	FindingID string   `json:"findingId"`
+	Type      string   `json:"type,omitempty"`
+	Title     string   `json:"title,omitempty"`
+	Severity  *float64 `json:"severity,omitempty"`
+	Count     *int     `json:"count,omitempty"`
+	Archived  bool     `json:"archived"`
+}
+
+// key identifies a finding across exports; finding IDs are unique to an
+// account and region
+func (f diffFinding) key() string {
+	return f.AccountID + "/" + f.Region + "/" + f.FindingID
+}
+
+// resolvedFinding is a finding of the old export that is no longer active:
+// archived in the new export, or missing from it
+type resolvedFinding struct {
+	diffFinding
+	Reason string `json:"reason"`
+}
+
+// changedFinding is a finding whose severity or count differs between the
+// exports; the embedded fields are its new values
+type changedFinding struct {
+	diffFinding
+	OldSeverity *float64 `json:"oldSeverity,omitempty"`
+	OldCount    *int     `json:"oldCount,omitempty"`
+}
+
+// diffReport is the delta between an old and a new export
+type diffReport struct {
+	Old      string            `json:"old"`
+	New      string            `json:"new"`
+	Summary  diffSummary       `json:"summary"`
+	Added    []diffFinding     `json:"added"`
+	Resolved []resolvedFinding `json:"resolved"`
+	Changed  []changedFinding  `json:"changed"`
+}
+
+type diffSummary struct {
+	Added     int `json:"added"`
+	Resolved  int `json:"resolved"`
+	Changed   int `json:"changed"`
+	Unchanged int `json:"unchanged"`
+}
+
+// diffExports compares the findings of two exports. A finding is added when
+// it is new or was archived and is active again, resolved when it is
+// missing or newly archived, and changed when its severity or count differs.
+func diffExports(oldName string, old map[string]diffFinding, newName string, current map[string]diffFinding) diffReport {
+	report := diffReport{Old: oldName, New: newName, Added: []diffFinding{}, Resolved: []resolvedFinding{}, Changed: []changedFinding{}}
+	for _, key := range sortedKeys(current) {
+		finding := current[key]
+		previous, ok := old[key]
+		switch {
+		case !ok || previous.Archived && !finding.Archived:
+			if !finding.Archived {
+				report.Added = append(report.Added, finding)
+			}
+		case finding.Archived && !previous.Archived:
+			report.Resolved = append(report.Resolved, resolvedFinding{finding, "archived"})
+		case !equalPtr(previous.Severity, finding.Severity) || !equalPtr(previous.Count, finding.Count):
+			report.Changed = append(report.Changed, changedFinding{finding, previous.Severity, previous.Count})
+		default:
+			report.Summary.Unchanged++
+		}
+	}
+	for _, key := range sortedKeys(old) {
+		if finding := old[key]; !finding.Archived {
+			if _, ok := current[key]; !ok {
+				report.Resolved = append(report.Resolved, resolvedFinding{finding, "missing"})
+			}
+		}
+	}
+	report.Summary.Added = len(report.Added)
+	report.Summary.Resolved = len(report.Resolved)
+	report.Summary.Changed = len(report.Changed)
+	return report
+}
+
+func sortedKeys(findings map[string]diffFinding) []string {
+	keys := make([]string, 0, len(findings))
+	for key := range findings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func equalPtr[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// readExport reads the findings of an export artifact, choosing the format
+// from name. CSV, JSON, and NDJSON exports can be read, compressed or not,
+// and zip archives including split exports are read entry by entry.
+func readExport(r io.Reader, name string) (map[string]diffFinding, error) {
+	findings := make(map[string]diffFinding)
+	return findings, readExportInto(findings, r, name)
+}
+
+func readExportInto(findings map[string]diffFinding, r io.Reader, name string) error {
+	switch {
+	case strings.HasSuffix(name, encryptedSuffix):
+		return fmt.Errorf("error reading %s: encrypted exports must be decrypted first, with guardduty decrypt", name)
+	case strings.HasSuffix(name, ".gz"):
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("error decompressing %s: %v", name, err)
+		}
+		defer zr.Close()
+		return readExportInto(findings, zr, strings.TrimSuffix(name, ".gz"))
+	case strings.HasSuffix(name, ".zip"):
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", name, err)
+		}
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", name, err)
+		}
+		for _, entry := range archive.File {
+			if entry.Name == "manifest.json" || entry.Name == "summary.json" || entry.FileInfo().IsDir() {
+				continue
+			}
+			f, err := entry.Open()
+			if err != nil {
+				return fmt.Errorf("error reading %s in %s: %v", entry.Name, name, err)
+			}
+			err = readExportInto(findings, f, entry.Name)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case strings.HasSuffix(name, ".ocsf.ndjson"), strings.HasSuffix(name, ".asff.json"):
+		// These name the findings differently, so they are not compared
+	case strings.HasSuffix(name, ".csv"):
+		return readCSVExport(findings, r, name)
+	case strings.HasSuffix(name, ".json"):
+		var records []exportRecord
+		if err := json.NewDecoder(r).Decode(&records); err != nil {
+			return fmt.Errorf("error parsing %s: %v", name, err)
+		}
+		for _, record := range records {
+			record.add(findings)
+		}
+		return nil
+	case strings.HasSuffix(name, ".ndjson"):
+		decoder := json.NewDecoder(bufio.NewReader(r))
+		for {
+			var record exportRecord
+			err := decoder.Decode(&record)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error parsing %s: %v", name, err)
+			}
+			record.add(findings)
+		}
+	}
+	return fmt.Errorf("cannot compare %s: only csv, json, and ndjson exports can be compared", name)
+}
+
+// exportRecord is the part of a finding read from a JSON or NDJSON export
+type exportRecord struct {
+	AccountId *string
+	Region    *string
+	Id        *string
+	Type      *string
+	Title     *string
+	Severity  *float64
+	Service   *struct {
+		Count    *int
+		Archived *bool
+	}
+}
+
+// add records the finding unless it is the error record of a failed region
+func (r exportRecord) add(findings map[string]diffFinding) {
+	finding := diffFinding{
+		AccountID: derefString(r.AccountId),
+		Region:    derefString(r.Region),
+		FindingID: derefString(r.Id),
+		Type:      derefString(r.Type),
+		Title:     derefString(r.Title),
+		Severity:  r.Severity,
+	}
+	if finding.FindingID == "" || finding.FindingID == "ERROR" {
+		return
+	}
+	if r.Service != nil {
+		finding.Count = r.Service.Count
+		finding.Archived = r.Service.Archived != nil && *r.Service.Archived
+	}
+	findings[finding.key()] = finding
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// readCSVExport reads a CSV export, which must have the FindingId and Region
+// columns. The AccountId, FindingType, Title, Severity, Count, and Archived
+// columns are used when present.
+func readCSVExport(findings map[string]diffFinding, r io.Reader, name string) error {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", name, err)
+	}
+	columns := make(map[string]int)
+	for i, column := range header {
+		columns[column] = i
+	}
+	for _, required := range []string{"FindingId", "Region"} {
+		if _, ok := columns[required]; !ok {
+			return fmt.Errorf("cannot compare %s: it has no %s column", name, required)
+		}
+	}
+
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", name, err)
+		}
+		value := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		finding := diffFinding{
+			AccountID: value("AccountId"),
+			Region:    value("Region"),
+			FindingID: value("FindingId"),
+			Type:      value("FindingType"),
+			Title:     value("Title"),
+			Archived:  value("Archived") == "true",
+		}
+		if finding.FindingID == "" || finding.FindingID == "ERROR" {
+			continue
+		}
+		if severity, err := strconv.ParseFloat(value("Severity"), 64); err == nil {
+			finding.Severity = &severity
+		}
+		if count, err := strconv.Atoi(value("Count")); err == nil {
+			finding.Count = &count
+		}
+		findings[finding.key()] = finding
+	}
+}
+
+// readExportFile reads the findings of the export artifact at path
+func readExportFile(path, name string) (map[string]diffFinding, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %v", name, err)
+	}
+	defer file.Close()
+	return readExport(file, name)
+}
+
+// diffSource reads one side of a diff request: the artifact of the job
+// named by the <side>Job parameter, the export named by <side> in the output
+// directory, or a file uploaded as the <side> form field
+func (a *App) diffSource(r *http.Request, side string) (string, map[string]diffFinding, error) {
+	if r.MultipartForm != nil {
+		if files := r.MultipartForm.File[side]; len(files) > 0 {
+			file, err := files[0].Open()
+			if err != nil {
+				return "", nil, err
+			}
+			defer file.Close()
+			findings, err := readExport(file, files[0].Filename)
+			return files[0].Filename, findings, err
+		}
+	}
+	if id := r.FormValue(side + "Job"); id != "" {
+		job, ok := a.jobs.get(id)
+		if !ok {
+			return "", nil, fmt.Errorf("Job %s not found", id)
+		}
+		job.mu.Lock()
+		status, path, filename := job.status, job.path, job.filename
+		job.mu.Unlock()
+		if status != jobSucceeded {
+			return "", nil, fmt.Errorf("Job %s is %s", id, status)
+		}
+		if path == "" {
+			return "", nil, fmt.Errorf("Job %s has no artifact on the server", id)
+		}
+		findings, err := readExportFile(path, filename)
+		return filename, findings, err
+	}
+	if name := r.FormValue(side); name != "" {
+		// Only saved exports can be named, not the history, state, and
+		// sidecar files beside them
+		if !validSavedExportName(name) || isSidecar(name) {
+			return "", nil, fmt.Errorf("Invalid %s %q: must be the name of an export in the output directory", side, name)
+		}
+		findings, err := readExportFile(filepath.Join(a.config().OutputDir, name), name)
+		return name, findings, err
+	}
+	return "", nil, fmt.Errorf("Missing %s: give %sJob, %s, or upload a %s file", side, side, side, side)
+}
+
+// handleDiff compares two exports and returns the delta report as JSON.
+// Exports are named by job ID, by file name in the output directory, or
+// uploaded as a multipart form.
+func (a *App) handleDiff(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	oldName, old, err := a.diffSource(r, "old")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	newName, current, err := a.diffSource(r, "new")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffExports(oldName, old, newName, current))
+}
+
+// runDiffCommand compares two export files from the command line and writes
+// the delta report as JSON, returning the process exit code
+func runDiffCommand(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: guardduty diff [-out report.json] OLD NEW")
+		fs.PrintDefaults()
+	}
+	out := fs.String("out", "-", "report path, or - for standard output")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	oldPath, newPath := fs.Arg(0), fs.Arg(1)
+	old, err := readExportFile(oldPath, filepath.Base(oldPath))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	current, err := readExportFile(newPath, filepath.Base(newPath))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report := diffExports(oldPath, old, newPath, current)
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error creating report: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing report: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%d added, %d resolved, %d changed, %d unchanged\n",
+		report.Summary.Added, report.Summary.Resolved, report.Summary.Changed, report.Summary.Unchanged)
+	return 0
+}
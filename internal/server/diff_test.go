@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffSourceNames(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"guardduty_findings_20240101_000000.ndjson":        `{"Id":"a","Severity":5}` + "\n",
+		"guardduty_findings_20240101_000000.ndjson.sha256": "",
+		".guardduty_export_history.ndjson":                 `{"Id":"job"}` + "\n",
+		".guardduty_findings_20240101_000000.ndjson.json":  `{}`,
+		"suppressed.csv": "FindingId\na\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &App{}
+	a.current.Store(&Config{OutputDir: dir})
+
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "guardduty_findings_20240101_000000.ndjson", valid: true},
+		{name: ".guardduty_export_history.ndjson"},
+		{name: ".guardduty_findings_20240101_000000.ndjson.json"},
+		{name: "guardduty_findings_20240101_000000.ndjson.sha256"},
+		{name: "suppressed.csv"},
+		{name: "../guardduty_findings_20240101_000000.ndjson"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/diff?"+url.Values{"old": {tt.name}}.Encode(), nil)
+			_, findings, err := a.diffSource(r, "old")
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("read %s, want it rejected", tt.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error reading %s: %v", tt.name, err)
+			}
+			if len(findings) != 1 {
+				t.Errorf("got %d findings, want the export's 1", len(findings))
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// defaultDigestLimit is the number of findings of a digest unless it asks
+// for another
+const defaultDigestLimit = 10
+
+// digestView is the JSON form of a digest
+type digestView struct {
+	Findings  []export.DigestFinding `json:"findings"`
+	Regions   gd.RegionSummary       `json:"regions"`
+	Generated string                 `json:"generated"`
+}
+
+// handleDigest answers with the limit most severe findings an export with
+// the same parameters would fetch, across its accounts and regions, in a
+// compact JSON or Markdown form with console links, for chat bots and
+// scripts that post them somewhere. Only the first findings of each
+// detector by severity are fetched, so a digest is quick however many
+// findings there are.
+func (a *App) handleDigest(w http.ResponseWriter, r *http.Request) {
+	opts, err := a.parseExportOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.Form.Get("format")
+	if format != "" && format != "json" && format != "markdown" {
+		http.Error(w, fmt.Sprintf("Invalid format %q: a digest is json or markdown", format), http.StatusBadRequest)
+		return
+	}
+	limit := defaultDigestLimit
+	if v := r.Form.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > gd.MaxDigestFindings {
+			http.Error(w, fmt.Sprintf("Invalid limit %q: a digest holds 1 to %d findings", v, gd.MaxDigestFindings), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if err := gd.ResolveRegions(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+	if err := gd.ResolveAccounts(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+
+	findings, results := gd.TopFindings(r.Context(), opts.FetchOptions, limit)
+	view := digestView{Findings: export.NewDigestFindings(findings), Regions: gd.SummarizeRegions(results), Generated: time.Now().UTC().Format(time.RFC3339)}
+	telemetry.Logger(r.Context()).Info("Sent findings digest", "regions", opts.Regions, "findings", len(view.Findings), "failed", len(view.Regions.Failed))
+	if format == "markdown" {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		export.WriteDigestMarkdown(w, view.Findings, view.Regions)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// savedExportPrefix starts the name of every export saved in OutputDir
+const savedExportPrefix = "guardduty_findings_"
+
+// savedExportMeta describes a saved export. It is kept beside the export in
+// a hidden .<name>.json file, as the export itself would have to be read to
+// count its findings.
+type savedExportMeta struct {
+	Findings int      `json:"findings"`
+	Format   string   `json:"format"`
+	Regions  []string `json:"regions"`
+	// FailedRegions were written as error records, with reportErrors
+	FailedRegions []string  `json:"failedRegions,omitempty"`
+	User          string    `json:"user,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	// Truncated is set when the export's limits stopped it early
+	Truncated *gd.Truncation `json:"truncated,omitempty"`
+	// SHA256 is the checksum of the export, and Signature the file of its
+	// detached signature when signing was on
+	SHA256    string `json:"sha256,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// savedExport is an export file in OutputDir. meta is nil for exports saved
+// by earlier versions, whose creation time is their modification time.
+type savedExport struct {
+	name      string
+	size      int64
+	createdAt time.Time
+	meta      *savedExportMeta
+}
+
+// metaPath returns the path of the metadata file of the saved export name
+func metaPath(dir, name string) string {
+	return filepath.Join(dir, "."+name+".json")
+}
+
+// validSavedExportName reports whether name names an export in the output
+// directory itself, rather than another file or one outside it
+func validSavedExportName(name string) bool {
+	return filepath.Base(name) == name && strings.HasPrefix(name, savedExportPrefix)
+}
+
+// listSavedExports returns the exports in dir, newest first
+func listSavedExports(dir string) ([]savedExport, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading output directory %s: %v", dir, err)
+	}
+	var exports []savedExport
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !validSavedExportName(entry.Name()) || isSidecar(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Deleted since the directory was read
+			continue
+		}
+		saved := savedExport{name: entry.Name(), size: info.Size(), createdAt: info.ModTime()}
+		if data, err := os.ReadFile(metaPath(dir, saved.name)); err == nil {
+			var meta savedExportMeta
+			if json.Unmarshal(data, &meta) == nil {
+				saved.meta = &meta
+				saved.createdAt = meta.CreatedAt
+			}
+		}
+		exports = append(exports, saved)
+	}
+	sort.Slice(exports, func(i, j int) bool {
+		return exports[i].createdAt.After(exports[j].createdAt)
+	})
+	return exports, nil
+}
+
+// removeSavedExport deletes a saved export, its checksum and signature, and
+// its metadata
+func removeSavedExport(dir, name string) error {
+	if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, suffix := range sidecarSuffixes {
+		if err := os.Remove(filepath.Join(dir, name+suffix)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Remove(metaPath(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// recordSavedExport writes the metadata of an export just saved in the
+// output directory as name and sealed as seal, then applies the retention
+// policy. A failure is only logged: the export is listed without its
+// findings and regions.
+func (a *App) recordSavedExport(ctx context.Context, name string, opts exportOptions, findings int, stream *gd.Stream, seal artifactSeal) {
+	summary := gd.SummarizeRegions(stream.Results())
+	meta := savedExportMeta{
+		Findings:  findings,
+		Format:    opts.Format,
+		Regions:   append(summary.Succeeded, summary.Truncated...),
+		User:      opts.user,
+		CreatedAt: time.Now(),
+		SHA256:    seal.SHA256,
+		Signature: seal.Signature,
+	}
+	for label := range summary.Failed {
+		meta.FailedRegions = append(meta.FailedRegions, label)
+	}
+	sort.Strings(meta.FailedRegions)
+	meta.Truncated = streamTruncation(stream)
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err == nil {
+		err = os.WriteFile(metaPath(a.config().OutputDir, name), append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		telemetry.Logger(ctx).Error("Error recording saved export", "file", name, "error", err)
+	}
+	a.applyRetention(ctx)
+}
+
+// downloadView is the JSON representation of a saved export returned by the
+// API
+type downloadView struct {
+	Name string `json:"name"`
+	// URL downloads the export
+	URL  string `json:"url"`
+	Size int64  `json:"size"`
+	// Findings, Format, and the regions are missing for exports saved by
+	// earlier versions
+	Findings      *int           `json:"findings,omitempty"`
+	Format        string         `json:"format,omitempty"`
+	Regions       []string       `json:"regions,omitempty"`
+	FailedRegions []string       `json:"failedRegions,omitempty"`
+	Truncated     *gd.Truncation `json:"truncated,omitempty"`
+	User          string         `json:"user,omitempty"`
+	CreatedAt     time.Time      `json:"createdAt"`
+	AgeSeconds    int64          `json:"ageSeconds"`
+	// ExpiresAt is when the retention policy's maxAge deletes the export
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// SHA256 is the checksum of the export, which ChecksumURL downloads
+	// in the format of sha256sum, and SignatureURL downloads its detached
+	// signature when it was signed
+	SHA256       string `json:"sha256,omitempty"`
+	ChecksumURL  string `json:"checksumUrl,omitempty"`
+	SignatureURL string `json:"signatureUrl,omitempty"`
+	// ManifestURL downloads the decryption manifest of an encrypted export
+	ManifestURL string `json:"manifestUrl,omitempty"`
+}
+
+// handleListDownloads lists the exports saved in the output directory,
+// newest first
+func (a *App) handleListDownloads(w http.ResponseWriter, r *http.Request) {
+	views, err := a.downloadViews()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+// downloadViews describes the exports saved in the output directory
+func (a *App) downloadViews() ([]downloadView, error) {
+	exports, err := listSavedExports(a.config().OutputDir)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	views := make([]downloadView, 0, len(exports))
+	for _, saved := range exports {
+		v := downloadView{
+			Name:       saved.name,
+			URL:        a.path("/api/downloads/" + saved.name),
+			Size:       saved.size,
+			CreatedAt:  saved.createdAt,
+			AgeSeconds: int64(now.Sub(saved.createdAt).Seconds()),
+		}
+		if m := saved.meta; m != nil {
+			findings := m.Findings
+			v.Findings = &findings
+			v.Format = m.Format
+			v.Regions = m.Regions
+			v.FailedRegions = m.FailedRegions
+			v.Truncated = m.Truncated
+			v.User = m.User
+			if m.SHA256 != "" {
+				v.SHA256 = m.SHA256
+				v.ChecksumURL = a.path("/api/downloads/" + saved.name + checksumSuffix)
+			}
+			if m.Signature != "" {
+				v.SignatureURL = a.path("/api/downloads/" + m.Signature)
+			}
+		}
+		if strings.HasSuffix(saved.name, encryptedSuffix) {
+			v.ManifestURL = a.path("/api/downloads/" + saved.name + decryptionManifestSuffix)
+		}
+		if maxAge := a.config().Retention.MaxAge; maxAge > 0 {
+			expiresAt := saved.createdAt.Add(maxAge)
+			v.ExpiresAt = &expiresAt
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+// handleDownload serves an export saved in the output directory, or its
+// checksum or signature
+func (a *App) handleDownload(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !validSavedExportName(name) {
+		http.Error(w, fmt.Sprintf("Invalid export name %q", name), http.StatusBadRequest)
+		return
+	}
+	file, err := os.Open(filepath.Join(a.config().OutputDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", savedExportContentType(name))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+// savedExportContentType returns the media type of a saved export from its
+// file name. The longest matching extension wins, so a .asff.json file is
+// not taken for plain JSON.
+func savedExportContentType(name string) string {
+	switch {
+	case isSidecar(name):
+		return sidecarContentType(name)
+	case strings.HasSuffix(name, encryptedSuffix):
+		return "application/octet-stream"
+	case strings.HasSuffix(name, ".gz"):
+		return export.ContentType("", export.CompressGzip)
+	case strings.HasSuffix(name, ".zip"):
+		return export.ContentType("", export.CompressZip)
+	}
+	contentType, extension := "application/octet-stream", ""
+	for _, format := range export.Formats {
+		if strings.HasSuffix(name, "."+format.Extension) && len(format.Extension) > len(extension) {
+			contentType, extension = format.ContentType, format.Extension
+		}
+	}
+	return contentType
+}
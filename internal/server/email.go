@@ -0,0 +1,452 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// Email transports: the SES API with the server's AWS credentials, or an
+// SMTP relay
+const (
+	emailSES  = "ses"
+	emailSMTP = "smtp"
+)
+
+// maxSESAttachmentMB is the largest attachment SES accepts, whose messages
+// are limited to 40 MB once the attachment is base64 encoded
+const maxSESAttachmentMB = 28
+
+// emailConfig sends completed exports by email to fixed recipients, when
+// Transport is set
+type emailConfig struct {
+	// Transport is ses or smtp
+	Transport string   `yaml:"transport"`
+	From      string   `yaml:"from"`
+	To        []string `yaml:"to"`
+	// Region is the SES region, by default the SDK region
+	Region string     `yaml:"region"`
+	SMTP   smtpConfig `yaml:"smtp"`
+	// MaxAttachmentMB is the size of the largest export attached; larger
+	// exports are linked with a presigned S3 URL, being uploaded to the s3
+	// bucket if their destination is local
+	MaxAttachmentMB int `yaml:"maxAttachmentMb"`
+	// Subject and Body are text/template templates executed with the
+	// emailSummary of the export, defaultEmailSubject and defaultEmailBody
+	// when empty
+	Subject string `yaml:"subject"`
+	Body    string `yaml:"body"`
+}
+
+// smtpConfig is the relay that SMTP email is sent through. Port 465 is
+// connected to with TLS, and connections to other ports are upgraded with
+// STARTTLS when the relay offers it, as authenticating requires.
+type smtpConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// emailSummary is the data that email templates are executed with
+type emailSummary struct {
+	Filename string
+	Findings int
+	// Schedule is the ID of the schedule that ran the export, if any
+	Schedule string
+	// Succeeded lists the accounts and regions exported, and Failed maps
+	// those that failed to their errors
+	Succeeded []string
+	Failed    map[string]string
+	// Truncated is the limit that stopped the export early, if one did
+	Truncated string
+	// Size is the size of the export, such as "2.4 MB" or "120 KB"
+	Size       string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Duration   time.Duration
+	// Attached is set when the export is attached to the email; otherwise
+	// URL downloads it until URLExpiresAt, or is empty when the export is
+	// too large to attach and there is no bucket to link it from
+	Attached     bool
+	URL          string
+	URLExpiresAt time.Time
+}
+
+const defaultEmailSubject = `GuardDuty export: {{.Findings}} findings{{if .Failed}}, {{len .Failed}} regions failed{{end}}{{if .Schedule}} ({{.Schedule}}){{end}}`
+
+const defaultEmailBody = `The GuardDuty export {{.Filename}}{{if .Schedule}} of schedule {{.Schedule}}{{end}} finished at {{.FinishedAt.Format "2006-01-02 15:04 MST"}} after {{.Duration}}.
+
+Findings: {{.Findings}}
+Regions exported: {{len .Succeeded}}{{range .Succeeded}}
+  {{.}}{{end}}
+{{if .Failed}}Regions failed: {{len .Failed}}{{range $region, $err := .Failed}}
+  {{$region}}: {{$err}}{{end}}
+{{end}}{{if .Truncated}}
+The export stopped early at its {{.Truncated}} limit and is incomplete.
+{{end}}
+{{if .Attached}}The export is attached ({{.Size}}).{{else if .URL}}Download the export ({{.Size}}) until {{.URLExpiresAt.Format "2006-01-02 15:04 MST"}}:
+{{.URL}}{{else}}The export is too large to attach ({{.Size}}) and is kept on the server as {{.Filename}}.{{end}}
+`
+
+// enabled reports whether exports can be emailed
+func (c emailConfig) enabled() bool {
+	return c.Transport != ""
+}
+
+func (c emailConfig) validate() error {
+	switch c.Transport {
+	case "":
+		return nil
+	case emailSES, emailSMTP:
+	default:
+		return fmt.Errorf("invalid email.transport %q: must be ses or smtp", c.Transport)
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		return fmt.Errorf("invalid email.from %q: %v", c.From, err)
+	}
+	if len(c.To) == 0 {
+		return fmt.Errorf("invalid email.to: must list at least one recipient")
+	}
+	for _, to := range c.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("invalid email.to %q: %v", to, err)
+		}
+	}
+	if c.MaxAttachmentMB < 0 {
+		return fmt.Errorf("invalid email.maxAttachmentMb %d: must not be negative", c.MaxAttachmentMB)
+	}
+	if c.Transport == emailSES && c.MaxAttachmentMB > maxSESAttachmentMB {
+		return fmt.Errorf("invalid email.maxAttachmentMb %d: SES attaches at most %d MB", c.MaxAttachmentMB, maxSESAttachmentMB)
+	}
+	if c.Transport == emailSMTP {
+		if c.SMTP.Host == "" {
+			return fmt.Errorf("invalid email.smtp: host must be set for the smtp transport")
+		}
+		if c.SMTP.Port < 1 || c.SMTP.Port > 65535 {
+			return fmt.Errorf("invalid email.smtp.port %d", c.SMTP.Port)
+		}
+		if (c.SMTP.Username == "") != (c.SMTP.Password == "") {
+			return fmt.Errorf("invalid email.smtp: username and password must be set together")
+		}
+	}
+	if _, err := template.New("subject").Parse(c.Subject); err != nil {
+		return fmt.Errorf("invalid email.subject: %v", err)
+	}
+	if _, err := template.New("body").Parse(c.Body); err != nil {
+		return fmt.Errorf("invalid email.body: %v", err)
+	}
+	return nil
+}
+
+// emailedExport is a completed export to send by email
+type emailedExport struct {
+	filename    string
+	contentType string
+	// path is the local file of the export, empty when it is only in S3,
+	// and upload is set when it was uploaded
+	path     string
+	upload   s3Upload
+	size     int64
+	findings int
+	results  []gd.RegionResult
+	// truncation is set when the export's limits stopped it early
+	truncation *gd.Truncation
+	schedule   string
+	startedAt  time.Time
+}
+
+// emailExport sends a completed export to the configured recipients,
+// attached or as a download link
+func (a *App) emailExport(ctx context.Context, e emailedExport) error {
+	conf := a.config().Email
+	regions := gd.SummarizeRegions(e.results)
+	finishedAt := time.Now()
+	summary := emailSummary{
+		Filename:   e.filename,
+		Findings:   e.findings,
+		Schedule:   e.schedule,
+		Succeeded:  regions.Succeeded,
+		Failed:     regions.Failed,
+		Size:       emailSize(e.size),
+		StartedAt:  e.startedAt,
+		FinishedAt: finishedAt,
+		Duration:   finishedAt.Sub(e.startedAt).Round(time.Second),
+	}
+	if e.truncation != nil {
+		summary.Truncated = e.truncation.Reason
+	}
+
+	var attachment []byte
+	switch {
+	case e.path != "" && e.size <= int64(conf.MaxAttachmentMB)<<20:
+		data, err := os.ReadFile(e.path)
+		if err != nil {
+			return fmt.Errorf("error reading export: %v", err)
+		}
+		attachment = data
+		summary.Attached = true
+	case e.upload.key != "":
+		upload := e.upload
+		if err := a.presignUpload(ctx, &upload, e.filename); err != nil {
+			return err
+		}
+		summary.URL, summary.URLExpiresAt = upload.url, upload.expiresAt
+	case a.config().S3.Bucket != "":
+		upload, err := a.uploadExport(ctx, e.path, e.filename, e.contentType)
+		if err != nil {
+			return err
+		}
+		summary.URL, summary.URLExpiresAt = upload.url, upload.expiresAt
+	}
+
+	subject, err := executeEmailTemplate(conf.Subject, defaultEmailSubject, summary)
+	if err != nil {
+		return fmt.Errorf("error writing email subject: %v", err)
+	}
+	body, err := executeEmailTemplate(conf.Body, defaultEmailBody, summary)
+	if err != nil {
+		return fmt.Errorf("error writing email body: %v", err)
+	}
+	message, err := emailMessage(conf.From, conf.To, strings.TrimSpace(subject), body, e.filename, e.contentType, attachment)
+	if err != nil {
+		return fmt.Errorf("error writing email: %v", err)
+	}
+
+	if conf.Transport == emailSES {
+		err = a.sendSES(ctx, message)
+	} else {
+		err = conf.SMTP.send(ctx, conf.From, conf.To, message)
+	}
+	if err != nil {
+		return err
+	}
+	telemetry.Logger(ctx).Info("Emailed export", "file", e.filename, "recipients", len(conf.To), "attached", summary.Attached)
+	return nil
+}
+
+// emailSize formats a size in bytes for an email
+func emailSize(size int64) string {
+	if size < 1<<20 {
+		return fmt.Sprintf("%d KB", (size+1023)/1024)
+	}
+	return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+}
+
+// executeEmailTemplate executes text, or fallback when text is empty
+func executeEmailTemplate(text, fallback string, summary emailSummary) (string, error) {
+	if text == "" {
+		text = fallback
+	}
+	tmpl, err := template.New("email").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, summary); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// emailMessage writes a MIME message with a plain text body and, unless
+// attachment is nil, the export attached under filename
+func emailMessage(from string, to []string, subject, body, filename, contentType string, attachment []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n",
+		from, strings.Join(to, ", "), mime.QEncoding.Encode("utf-8", subject), time.Now().Format(time.RFC1123Z), mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := io.WriteString(qp, strings.ReplaceAll(body, "\n", "\r\n")); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	if attachment != nil {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(contentType, map[string]string{"name": filename})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Lines of base64 are kept to 76 characters
+		encoded := base64.StdEncoding.EncodeToString(attachment)
+		for len(encoded) > 76 {
+			io.WriteString(part, encoded[:76]+"\r\n")
+			encoded = encoded[76:]
+		}
+		io.WriteString(part, encoded+"\r\n")
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sendSES sends a message with the SES v2 SendEmail API, signed with the
+// server's credentials
+func (a *App) sendSES(ctx context.Context, message []byte) error {
+	region := a.config().Email.Region
+	if region == "" {
+		region = a.awsCfg.Region
+	}
+	payload, err := json.Marshal(map[string]any{
+		"Content": map[string]any{"Raw": map[string]any{"Data": message}},
+	})
+	if err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.sesEndpoint(region)+"/v2/email/outbound-emails", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	creds, err := a.awsCfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	hash := sha256.Sum256(payload)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), "ses", region, time.Now()); err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	resp, err := a.awsCfg.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending email with SES: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Message string `json:"message"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(body, &failure) != nil || failure.Message == "" {
+			failure.Message = strings.TrimSpace(string(body))
+		}
+		return fmt.Errorf("error sending email with SES: %s: %s", resp.Status, failure.Message)
+	}
+	return nil
+}
+
+// sesEndpoint returns the base URL of the SES API in region: the sesv2
+// endpoint or the endpoint replacing every service when one is set
+func (a *App) sesEndpoint(region string) string {
+	if endpoint := a.config().Endpoints["sesv2"]; endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	if a.config().EndpointURL != "" {
+		return strings.TrimSuffix(a.config().EndpointURL, "/")
+	}
+	host := "email"
+	if a.config().UseFIPS {
+		host = "email-fips"
+	}
+	suffix := "amazonaws.com"
+	if strings.HasPrefix(region, "cn-") {
+		suffix = "amazonaws.com.cn"
+	}
+	return fmt.Sprintf("https://%s.%s.%s", host, region, suffix)
+}
+
+// send delivers message through the relay
+func (c smtpConfig) send(ctx context.Context, from string, to []string, message []byte) error {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	tlsConfig := &tls.Config{ServerName: c.Host, MinVersion: tls.VersionTLS12}
+	var conn net.Conn
+	if c.Port == 465 {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %v", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error connecting to %s: %v", addr, err)
+	}
+	defer client.Close()
+
+	if c.Port != 465 {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return fmt.Errorf("error starting TLS with %s: %v", addr, err)
+			}
+		}
+	}
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return fmt.Errorf("error authenticating with %s: %v", addr, err)
+		}
+	}
+	if err := client.Mail(sender.Address); err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	for _, recipient := range to {
+		address, err := mail.ParseAddress(recipient)
+		if err != nil {
+			return fmt.Errorf("error sending email: %v", err)
+		}
+		if err := client.Rcpt(address.Address); err != nil {
+			return fmt.Errorf("error sending email to %s: %v", address.Address, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	if _, err := w.Write(message); err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	if err := client.Quit(); err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	return nil
+}
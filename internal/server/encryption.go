@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+
+	"guardduty/internal/export"
+)
+
+// encryptedSuffix ends the name of an encrypted export, an age file
+const encryptedSuffix = ".age"
+
+// decryptionManifestSuffix ends the name of the decryption manifest stored
+// beside an encrypted export
+const decryptionManifestSuffix = ".manifest.json"
+
+// kmsStanzaType is the type of the age stanzas holding file keys that KMS
+// encrypted
+const kmsStanzaType = "aws-kms"
+
+// kmsEncryptionContext binds the file keys KMS encrypts to exports, so a
+// ciphertext of another application is not decrypted as one
+var kmsEncryptionContext = map[string]string{"application": "guardduty-export"}
+
+// encryptionConfig encrypts the exports the server stores before they reach
+// disk or S3, in the age format. Each export has a random file key, which is
+// encrypted with the KMS key as envelope encryption and for each age
+// recipient, or with a passphrase alone.
+type encryptionConfig struct {
+	// KMSKeyID is the ID, ARN, or alias of a symmetric KMS key, in
+	// KMSRegion or by default the SDK region
+	KMSKeyID  string `yaml:"kmsKeyId"`
+	KMSRegion string `yaml:"kmsRegion"`
+	// Recipients are age public keys, age1..., whose identities decrypt
+	// the exports
+	Recipients []string `yaml:"recipients"`
+	// Passphrase encrypts the exports with scrypt instead
+	Passphrase string `yaml:"passphrase"`
+}
+
+// enabled reports whether stored exports are encrypted
+func (c encryptionConfig) enabled() bool {
+	return c.KMSKeyID != "" || len(c.Recipients) > 0 || c.Passphrase != ""
+}
+
+func (c encryptionConfig) validate() error {
+	if c.Passphrase != "" && (c.KMSKeyID != "" || len(c.Recipients) > 0) {
+		return fmt.Errorf("invalid encryption.passphrase: must not be combined with kmsKeyId or recipients")
+	}
+	for _, recipient := range c.Recipients {
+		if _, err := age.ParseX25519Recipient(recipient); err != nil {
+			return fmt.Errorf("invalid encryption.recipients %q: must be an age public key, age1...", recipient)
+		}
+	}
+	return nil
+}
+
+// storedName returns the name of an export file once compressed and, when
+// encryption is on, encrypted
+func (a *App) storedName(filename, compression string) string {
+	name := export.CompressedName(filename, compression)
+	if a.config().Encryption.enabled() {
+		name += encryptedSuffix
+	}
+	return name
+}
+
+// storedContentType returns the media type of a stored export file
+func (a *App) storedContentType(format, compression string) string {
+	if a.config().Encryption.enabled() {
+		return "application/octet-stream"
+	}
+	return export.ContentType(format, compression)
+}
+
+// encryptExport returns the writer that encrypts an export to out when
+// encryption is on, or else out itself. Closing it writes the end of the
+// export without closing out.
+func (a *App) encryptExport(ctx context.Context, out io.Writer) (io.WriteCloser, error) {
+	conf := a.config().Encryption
+	if !conf.enabled() {
+		return nopWriteCloser{out}, nil
+	}
+	var recipients []age.Recipient
+	if conf.KMSKeyID != "" {
+		recipients = append(recipients, kmsRecipient{ctx: ctx, app: a})
+	}
+	for _, r := range conf.Recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, fmt.Errorf("error encrypting export: %v", err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	if conf.Passphrase != "" {
+		recipient, err := age.NewScryptRecipient(conf.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("error encrypting export: %v", err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	w, err := age.Encrypt(out, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting export: %v", err)
+	}
+	return w, nil
+}
+
+// nopWriteCloser is a writer whose Close does nothing
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// kmsRecipient wraps the file key of an export by encrypting it with the KMS
+// key of the encryption setting
+type kmsRecipient struct {
+	ctx context.Context
+	app *App
+}
+
+func (r kmsRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	conf := r.app.config().Encryption
+	input := map[string]any{"KeyId": conf.KMSKeyID, "Plaintext": fileKey, "EncryptionContext": kmsEncryptionContext}
+	var output struct {
+		CiphertextBlob []byte `json:"CiphertextBlob"`
+		KeyID          string `json:"KeyId"`
+	}
+	if err := r.app.callKMS(r.ctx, conf.KMSRegion, "Encrypt", input, &output); err != nil {
+		return nil, fmt.Errorf("error encrypting file key with KMS: %v", err)
+	}
+	return []*age.Stanza{{Type: kmsStanzaType, Args: []string{output.KeyID}, Body: output.CiphertextBlob}}, nil
+}
+
+// kmsIdentity unwraps the file keys that KMS encrypted, calling KMS in the
+// region of the key that encrypted them
+type kmsIdentity struct {
+	ctx context.Context
+	app *App
+}
+
+func (i kmsIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	for _, stanza := range stanzas {
+		if stanza.Type != kmsStanzaType || len(stanza.Args) != 1 {
+			continue
+		}
+		keyID := stanza.Args[0]
+		region := i.app.config().Encryption.KMSRegion
+		// The key is named by its ARN, arn:aws:kms:<region>:<account>:key/<id>
+		if parts := strings.Split(keyID, ":"); len(parts) > 3 && parts[0] == "arn" {
+			region = parts[3]
+		}
+		input := map[string]any{"KeyId": keyID, "CiphertextBlob": stanza.Body, "EncryptionContext": kmsEncryptionContext}
+		var output struct {
+			Plaintext []byte `json:"Plaintext"`
+		}
+		if err := i.app.callKMS(i.ctx, region, "Decrypt", input, &output); err != nil {
+			return nil, fmt.Errorf("error decrypting file key with KMS key %s: %v", keyID, err)
+		}
+		return output.Plaintext, nil
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+// decryptionManifest is the <name>.manifest.json stored beside an encrypted
+// export, telling whoever holds the export what can decrypt it and how
+type decryptionManifest struct {
+	File       string   `json:"file"`
+	Encryption string   `json:"encryption"`
+	KMSKeyID   string   `json:"kmsKeyId,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+	Passphrase bool     `json:"passphrase,omitempty"`
+	// SHA256 is the checksum of the encrypted file
+	SHA256 string `json:"sha256"`
+	// Decrypt holds commands that decrypt the file, with either tool
+	Decrypt []string `json:"decrypt"`
+}
+
+// writeDecryptionManifest writes the decryption manifest of the encrypted
+// export at path, stored under name
+func (a *App) writeDecryptionManifest(path, name, sha256 string) error {
+	conf := a.config().Encryption
+	plain := strings.TrimSuffix(name, encryptedSuffix)
+	if plain == name {
+		plain += ".decrypted"
+	}
+	manifest := decryptionManifest{
+		File:       name,
+		Encryption: "age-encryption.org/v1",
+		KMSKeyID:   conf.KMSKeyID,
+		Recipients: conf.Recipients,
+		Passphrase: conf.Passphrase != "",
+		SHA256:     sha256,
+	}
+	switch {
+	case conf.Passphrase != "":
+		manifest.Decrypt = []string{
+			fmt.Sprintf("age -d -o %s %s", plain, name),
+			fmt.Sprintf("GUARDDUTY_EXPORT_ENCRYPTION_PASSPHRASE=<passphrase> guardduty decrypt -out %s %s", plain, name),
+		}
+	default:
+		if conf.KMSKeyID != "" {
+			manifest.Decrypt = append(manifest.Decrypt, fmt.Sprintf("guardduty decrypt -out %s %s  # with credentials allowed kms:Decrypt on %s", plain, name, conf.KMSKeyID))
+		}
+		if len(conf.Recipients) > 0 {
+			manifest.Decrypt = append(manifest.Decrypt,
+				fmt.Sprintf("age -d -i <identity file> -o %s %s", plain, name),
+				fmt.Sprintf("guardduty decrypt -identity <identity file> -out %s %s", plain, name))
+		}
+	}
+	// The commands are kept readable rather than escaped for HTML
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return fmt.Errorf("error writing decryption manifest: %v", err)
+	}
+	if err := os.WriteFile(path+decryptionManifestSuffix, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("error writing decryption manifest: %v", err)
+	}
+	return nil
+}
+
+// runDecryptCommand decrypts an encrypted export from the command line and
+// returns the process exit code. Exports encrypted with KMS are decrypted
+// with the AWS credentials of the config, those encrypted with a passphrase
+// with the passphrase of the encryption setting, and those encrypted for age
+// recipients with an identity file.
+func runDecryptCommand(args []string) int {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: guardduty decrypt [-identity key.txt] [-out file] FILE")
+		fs.PrintDefaults()
+	}
+	identityFile := fs.String("identity", "", "age identity file, as age-keygen writes, for exports encrypted for recipients")
+	out := fs.String("out", "", "decrypted file, or - for standard output (default FILE without .age)")
+	app, err := loadApp(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	in := fs.Arg(0)
+	if *out == "" {
+		if !strings.HasSuffix(in, encryptedSuffix) {
+			fmt.Fprintf(os.Stderr, "%s does not end with %s, so -out must name the decrypted file\n", in, encryptedSuffix)
+			return 2
+		}
+		*out = strings.TrimSuffix(in, encryptedSuffix)
+	}
+	if err := app.decryptFile(context.Background(), in, *out, *identityFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// decryptFile decrypts the export at in to out, or to stdout for "-". A
+// partly decrypted file is removed, so an altered export is not mistaken for
+// a whole one.
+func (a *App) decryptFile(ctx context.Context, in, out, identityFile string) error {
+	identities := []age.Identity{kmsIdentity{ctx: ctx, app: a}}
+	if identityFile != "" {
+		file, err := os.Open(identityFile)
+		if err != nil {
+			return fmt.Errorf("error opening identity file: %v", err)
+		}
+		parsed, err := age.ParseIdentities(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("error reading identity file %s: %v", identityFile, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	if passphrase := a.config().Encryption.Passphrase; passphrase != "" {
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return fmt.Errorf("error decrypting: %v", err)
+		}
+		identities = append(identities, identity)
+	}
+
+	src, err := os.Open(in)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", in, err)
+	}
+	defer src.Close()
+	plaintext, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return fmt.Errorf("error decrypting %s: %v", in, err)
+	}
+	if out == "-" {
+		if _, err := io.Copy(os.Stdout, plaintext); err != nil {
+			return fmt.Errorf("error decrypting %s: %v", in, err)
+		}
+		return nil
+	}
+	dst, err := os.Create(out)
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	_, err = io.Copy(dst, plaintext)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out)
+		return fmt.Errorf("error decrypting %s: %v", in, err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// endpointServices are the services whose endpoint can be overridden, named
+// as in the services section of the shared config file
+var endpointServices = []string{"cloudwatch_logs", "ec2", "eks", "glue", "guardduty", "kms", "organizations", "resource_groups_tagging_api", "s3", "securityhub", "sesv2", "sqs", "sso_oidc", "sts"}
+
+// serviceEndpoints maps a service name to the base URL its clients use, such
+// as a LocalStack container or a VPC interface endpoint. It is added to the
+// SDK configuration's sources, which each client reads when it is created.
+type serviceEndpoints map[string]string
+
+// GetServiceBaseEndpoint returns the endpoint of the service with the SDK ID
+// sdkID, such as GuardDuty or SSO OIDC
+func (e serviceEndpoints) GetServiceBaseEndpoint(ctx context.Context, sdkID string) (string, bool, error) {
+	endpoint, ok := e[strings.ToLower(strings.ReplaceAll(sdkID, " ", "_"))]
+	return endpoint, ok, nil
+}
+
+// validateEndpoint reports whether endpoint is an http or https URL
+func validateEndpoint(name, endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid %s %q: must be an http or https URL", name, endpoint)
+	}
+	return nil
+}
+
+// validateEndpoints reports the first unknown service or invalid URL in
+// endpoints, in service order
+func validateEndpoints(endpoints map[string]string) error {
+	services := make([]string, 0, len(endpoints))
+	for service := range endpoints {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		if !slices.Contains(endpointServices, service) {
+			return fmt.Errorf("invalid endpoints service %q: must be one of %s", service, strings.Join(endpointServices, ", "))
+		}
+		if err := validateEndpoint("endpoints."+service, endpoints[service]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
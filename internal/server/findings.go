@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// findingSummary is the row of a finding in the findings browser
+type findingSummary struct {
+	ID           string  `json:"id"`
+	AccountID    string  `json:"accountId"`
+	Type         string  `json:"type"`
+	Title        string  `json:"title"`
+	Severity     float64 `json:"severity"`
+	ResourceType string  `json:"resourceType"`
+	CreatedAt    string  `json:"createdAt"`
+	UpdatedAt    string  `json:"updatedAt"`
+	Count        int32   `json:"count"`
+	Archived     bool    `json:"archived"`
+	// Feedback is the USEFUL or NOT_USEFUL feedback last given on the
+	// finding, if any
+	Feedback   string `json:"feedback,omitempty"`
+	ConsoleURL string `json:"consoleUrl"`
+}
+
+// findingsPage is a page of the findings browser
+type findingsPage struct {
+	Region     string           `json:"region"`
+	DetectorID string           `json:"detectorId"`
+	Findings   []findingSummary `json:"findings"`
+	// NextToken requests the next page, and is left out on the last
+	NextToken string `json:"nextToken,omitempty"`
+}
+
+// feedbackRequest is the body of a finding feedback request
+type feedbackRequest struct {
+	FindingIDs []string `json:"findingIds"`
+	Feedback   string   `json:"feedback"`
+	Comments   string   `json:"comments"`
+}
+
+// handleFindings answers with a page of up to limit findings that an export
+// of one account and region with the same parameters would write: the
+// first, or the one the nextToken of the page before continues with
+func (a *App) handleFindings(w http.ResponseWriter, r *http.Request) {
+	opts, status, err := a.targetOptions(r, "Findings are browsed")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	limit := gd.MaxFindingsPage
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > gd.MaxFindingsPage {
+			http.Error(w, fmt.Sprintf("Invalid limit %q: a page holds 1 to %d findings", v, gd.MaxFindingsPage), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	found, err := gd.BrowseFindings(r.Context(), opts.FetchOptions, limit, r.URL.Query().Get("nextToken"))
+	if err != nil {
+		http.Error(w, err.Error(), a.callErrorStatus(opts, err))
+		return
+	}
+	page := findingsPage{Region: found.Region, DetectorID: found.DetectorID, Findings: make([]findingSummary, 0, len(found.Findings)), NextToken: found.NextToken}
+	for _, finding := range found.Findings {
+		page.Findings = append(page.Findings, summarizeFinding(finding))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// handleFinding answers with the complete finding a path names by its
+// region, detector, and ID, in the account the query selects, as JSON
+// exports write it
+func (a *App) handleFinding(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Form.Set("regions", r.PathValue("region"))
+	r.Form.Del("regionGroup")
+	opts, status, err := a.targetOptions(r, "Findings are read")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	finding, err := gd.GetFinding(r.Context(), opts.FetchOptions, r.PathValue("detectorId"), r.PathValue("findingId"))
+	if err != nil {
+		http.Error(w, err.Error(), a.callErrorStatus(opts, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finding)
+}
+
+// handleFindingsFeedback marks findings of the account and region the
+// request selects as useful or not useful
+func (a *App) handleFindingsFeedback(w http.ResponseWriter, r *http.Request) {
+	var req feedbackRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid feedback: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !gd.ValidFeedback(req.Feedback) {
+		http.Error(w, fmt.Sprintf("Invalid feedback %q: feedback is USEFUL or NOT_USEFUL", req.Feedback), http.StatusBadRequest)
+		return
+	}
+	if len(req.FindingIDs) == 0 {
+		http.Error(w, "Invalid feedback: findingIds lists no findings", http.StatusBadRequest)
+		return
+	}
+	opts, status, err := a.targetOptions(r, "Feedback is given")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	marked, err := gd.SubmitFeedback(r.Context(), opts.FetchOptions, req.Feedback, req.Comments, req.FindingIDs)
+	log := telemetry.Logger(r.Context())
+	if marked > 0 {
+		log.Info("Submitted finding feedback", "region", opts.Regions[0], "feedback", req.Feedback, "findings", marked, "user", opts.user)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), a.callErrorStatus(opts, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"feedback": req.Feedback, "findings": marked})
+}
+
+// summarizeFinding picks the fields of a finding that the browser shows
+func summarizeFinding(f types.Finding) findingSummary {
+	summary := findingSummary{
+		ID:         aws.ToString(f.Id),
+		AccountID:  aws.ToString(f.AccountId),
+		Type:       aws.ToString(f.Type),
+		Title:      aws.ToString(f.Title),
+		Severity:   aws.ToFloat64(f.Severity),
+		CreatedAt:  aws.ToString(f.CreatedAt),
+		UpdatedAt:  aws.ToString(f.UpdatedAt),
+		ConsoleURL: gd.ConsoleURL(aws.ToString(f.Partition), aws.ToString(f.Region), aws.ToString(f.Id)),
+	}
+	if f.Resource != nil {
+		summary.ResourceType = aws.ToString(f.Resource.ResourceType)
+	}
+	if f.Service != nil {
+		summary.Count = aws.ToInt32(f.Service.Count)
+		summary.Archived = aws.ToBool(f.Service.Archived)
+		summary.Feedback = aws.ToString(f.Service.UserFeedback)
+	}
+	return summary
+}
+
+// targetOptions reads the one account and region that a request acts on
+// from the export parameters of its query, which must select exactly one
+// of each; action starts the message that says so. It returns the status to
+// answer with on error.
+func (a *App) targetOptions(r *http.Request, action string) (exportOptions, int, error) {
+	opts, err := a.parseExportOptions(r)
+	if err != nil {
+		return opts, http.StatusBadRequest, err
+	}
+	if len(opts.Regions) != 1 || opts.RegionGroup != "" {
+		return opts, http.StatusBadRequest, fmt.Errorf("%s in one region at a time: select a single region", action)
+	}
+	if err := gd.ResolveAccounts(r.Context(), &opts.FetchOptions); err != nil {
+		return opts, a.exportErrorStatus(opts), err
+	}
+	if opts.TargetCount() != 1 {
+		return opts, http.StatusBadRequest, fmt.Errorf("%s in one account at a time: select a single roleArn or profile", action)
+	}
+	return opts, 0, nil
+}
+
+// callErrorStatus maps an error from a call on one account and region to a
+// status code
+func (a *App) callErrorStatus(opts exportOptions, err error) int {
+	var callErr *gd.CallError
+	switch {
+	case !errors.As(err, &callErr):
+	case callErr.NotFound:
+		return http.StatusNotFound
+	case callErr.Rejected:
+		return http.StatusBadRequest
+	}
+	return a.exportErrorStatus(opts)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// minFindingsMetricsInterval is the shortest refresh interval of the
+// findings metrics, so scrapes cannot turn into a steady load on GuardDuty
+const minFindingsMetricsInterval = time.Minute
+
+// findingsMetricsConfig counts GuardDuty findings periodically for
+// /metrics/findings, so Prometheus can scrape the posture of the accounts
+// from the exporter
+type findingsMetricsConfig struct {
+	// Interval is how often the findings are counted; zero turns the
+	// endpoint off
+	Interval time.Duration `yaml:"interval"`
+	// Preset and Params select the findings counted, as the export options
+	// of a schedule do, such as regions, roleArn, or archived
+	Preset string                 `yaml:"preset"`
+	Params map[string]paramValues `yaml:"params"`
+}
+
+// enabled reports whether the findings are counted
+func (c findingsMetricsConfig) enabled() bool {
+	return c.Interval > 0
+}
+
+func (c findingsMetricsConfig) validate() error {
+	if c.Interval < 0 || (c.Interval > 0 && c.Interval < minFindingsMetricsInterval) {
+		return fmt.Errorf("invalid findingsMetrics.interval %v: must be 0 or at least %v", c.Interval, minFindingsMetricsInterval)
+	}
+	return nil
+}
+
+// query returns the export parameters of the counts
+func (c findingsMetricsConfig) query() url.Values {
+	return scheduleConfig{Preset: c.Preset, Params: c.Params}.query()
+}
+
+// findingsMetrics holds the gauges of the last refresh of the findings
+// metrics, replaced as a whole so scrapes never see a refresh half done
+type findingsMetrics struct {
+	mu      sync.Mutex
+	metrics []*telemetry.Metric
+}
+
+func (m *findingsMetrics) set(metrics []*telemetry.Metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics = metrics
+}
+
+func (m *findingsMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	metrics := m.metrics
+	m.mu.Unlock()
+	for _, metric := range metrics {
+		metric.Write(w)
+	}
+}
+
+// runFindingsMetrics counts the findings every interval until ctx is done
+func (a *App) runFindingsMetrics(ctx context.Context) {
+	interval := a.config().FindingsMetrics.Interval
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		a.refreshFindingsMetrics(ctx, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshFindingsMetrics counts the findings of each account and region by
+// severity and finding type with GetFindingsStatistics. A refresh that
+// cannot start keeps the counts of the last one, whose time tells that
+// they are stale; a region that cannot be counted is reported down.
+func (a *App) refreshFindingsMetrics(ctx context.Context, timeout time.Duration) {
+	log := telemetry.Logger(ctx)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+
+	opts, err := a.parseExportValues(a.config().FindingsMetrics.query())
+	if err == nil {
+		err = gd.ResolveRegions(ctx, &opts.FetchOptions)
+	}
+	if err == nil {
+		err = gd.ResolveAccounts(ctx, &opts.FetchOptions)
+	}
+	if err != nil {
+		log.Error("Error refreshing findings metrics", "error", err)
+		return
+	}
+	stats := gd.FindingStatistics(ctx, opts.FetchOptions)
+
+	bySeverity := telemetry.NewGauge("guardduty_findings",
+		"GuardDuty findings by account, region, and severity.", "account", "region", "severity")
+	byType := telemetry.NewGauge("guardduty_findings_by_type",
+		"GuardDuty findings by account, region, and finding type.", "account", "region", "type")
+	up := telemetry.NewGauge("guardduty_findings_region_up",
+		"Whether the findings of the account and region were counted by the last refresh.", "account", "region")
+	var failed int
+	for _, region := range stats.Regions {
+		if region.Skipped != "" {
+			continue
+		}
+		if region.Error != "" {
+			failed++
+			up.Set(0, region.Account, region.Region)
+			continue
+		}
+		up.Set(1, region.Account, region.Region)
+		// Every severity is written, so alert rules see a band drop to zero
+		for _, label := range gd.SeverityLabels {
+			bySeverity.Set(float64(region.BySeverity[label]), region.Account, region.Region, label)
+		}
+		for _, t := range region.ByType {
+			byType.Set(float64(t.Findings), region.Account, region.Region, t.Type)
+		}
+	}
+	refreshed := telemetry.NewGauge("guardduty_findings_last_refresh_timestamp_seconds",
+		"Unix time the findings were last counted.")
+	refreshed.Set(float64(time.Now().Unix()))
+	duration := telemetry.NewGauge("guardduty_findings_refresh_duration_seconds",
+		"Time the last refresh of the findings counts took.")
+	duration.Set(time.Since(start).Seconds())
+
+	a.findingsMetrics.set([]*telemetry.Metric{bySeverity, byType, up, refreshed, duration})
+	log.Info("Refreshed findings metrics", "findings", stats.Findings, "regions", len(stats.Regions), "failed_regions", failed, "duration", time.Since(start))
+}
+
+// handleFindingsMetrics serves the finding counts of the last refresh for
+// Prometheus. Before the first refresh completes there are none.
+func (a *App) handleFindingsMetrics(w http.ResponseWriter, r *http.Request) {
+	if !a.config().FindingsMetrics.enabled() {
+		http.Error(w, "Findings metrics are not enabled: set findingsMetrics.interval", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	a.findingsMetrics.write(w)
+}
@@ -0,0 +1,19 @@
+package server
+
+// geoIPConfig resolves the remote addresses of findings against local
+// MaxMind databases, such as those geoipupdate keeps current
+type geoIPConfig struct {
+	// CountryDatabase is a GeoLite2 or GeoIP2 Country or City database
+	CountryDatabase string `yaml:"countryDatabase"`
+	// ASNDatabase is a GeoLite2 or GeoIP2 ASN database
+	ASNDatabase string `yaml:"asnDatabase"`
+}
+
+// geoIPColumns are added to the columns of exports that name none when
+// GeoIP is on, after ActorCountry among the defaults
+var geoIPColumns = []string{"ActorCountry", "ActorAsn", "ActorOrg"}
+
+// enabled reports whether either database is set
+func (c geoIPConfig) enabled() bool {
+	return c.CountryDatabase != "" || c.ASNDatabase != ""
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// The queries of the Grafana datasource: findings created each day by
+// severity, the findings of each type, and the findings themselves
+const (
+	grafanaFindingsPerDay = "findings_per_day"
+	grafanaFindingsByType = "findings_by_type"
+	grafanaFindings       = "findings"
+)
+
+// grafanaMaxRows is the most findings a findings table holds unless the
+// query sets maxFindings
+const grafanaMaxRows = 1000
+
+// grafanaTagKeys are the export options that dashboards can set as ad hoc
+// filters
+var grafanaTagKeys = []string{"regions", "type", "minSeverity", "archived", "roleArn", "includeAccounts"}
+
+// grafanaUnsupportedParams are the export options that Grafana queries do
+// not take: dry runs and reports, which are not findings
+var grafanaUnsupportedParams = []string{"dryRun", "coverage", "usage", "malwareScans", "ipSets", "members", "filters", "publishingDestinations", "posture"}
+
+// grafanaQuery is the body of a query of the Grafana JSON datasource. The
+// dashboard's time range selects the findings created in it.
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Targets      []grafanaTarget `json:"targets"`
+	AdhocFilters []grafanaFilter `json:"adhocFilters"`
+}
+
+// grafanaTarget is one query of a panel. Its payload holds export options,
+// such as regions or minSeverity, as a JSON object or a string of one.
+type grafanaTarget struct {
+	Target  string          `json:"target"`
+	RefID   string          `json:"refId"`
+	Hide    bool            `json:"hide"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type grafanaFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+// grafanaSeries is a timeseries: datapoints of a value and a Unix time in
+// milliseconds, oldest first
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	RefID   string          `json:"refId,omitempty"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]any         `json:"rows"`
+}
+
+// grafanaColumn is a column of a table and the type of its values: string,
+// number, or time
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// grafanaMetric is a query offered by the datasource's query editor
+type grafanaMetric struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+type grafanaTag struct {
+	Type string `json:"type,omitempty"`
+	Text string `json:"text"`
+}
+
+// handleGrafanaTest answers the datasource's connection test
+func (a *App) handleGrafanaTest(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK"))
+}
+
+// handleGrafanaSearch lists the queries for the datasource's query editor
+func (a *App) handleGrafanaSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode([]string{grafanaFindingsPerDay, grafanaFindingsByType, grafanaFindings})
+}
+
+// handleGrafanaMetrics lists the queries with their labels, as newer
+// versions of the datasource ask for them
+func (a *App) handleGrafanaMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode([]grafanaMetric{
+		{Label: "Findings per day by severity", Value: grafanaFindingsPerDay},
+		{Label: "Findings by type", Value: grafanaFindingsByType},
+		{Label: "Findings", Value: grafanaFindings},
+	})
+}
+
+// handleGrafanaTagKeys lists the keys of ad hoc filters
+func (a *App) handleGrafanaTagKeys(w http.ResponseWriter, r *http.Request) {
+	keys := make([]grafanaTag, len(grafanaTagKeys))
+	for i, key := range grafanaTagKeys {
+		keys[i] = grafanaTag{Type: "string", Text: key}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// handleGrafanaTagValues lists the values offered for an ad hoc filter's
+// key: the configured regions, the severity bands, or true and false
+func (a *App) handleGrafanaTagValues(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var values []string
+	switch body.Key {
+	case "regions":
+		values = a.config().Regions
+	case "minSeverity":
+		values = []string{"1", "4", "7", "9"}
+	case "archived":
+		values = []string{"true", "false", "all"}
+	}
+	tags := []grafanaTag{}
+	for _, value := range values {
+		tags = append(tags, grafanaTag{Text: value})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+// handleGrafanaQuery answers the queries of a panel, fetching the findings
+// of each target with its export options, the dashboard's ad hoc filters,
+// and the time range
+func (a *App) handleGrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	var query grafanaQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if query.Range.From.IsZero() || query.Range.To.IsZero() || !query.Range.From.Before(query.Range.To) {
+		http.Error(w, "Invalid range: from and to must be set, from before to", http.StatusBadRequest)
+		return
+	}
+	for _, filter := range query.AdhocFilters {
+		if filter.Operator != "=" {
+			http.Error(w, fmt.Sprintf("Invalid ad hoc filter %q: only = is supported", filter.Key), http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(grafanaTagKeys, filter.Key) {
+			http.Error(w, fmt.Sprintf("Invalid ad hoc filter %q: use one of %v", filter.Key, grafanaTagKeys), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results := []any{}
+	for _, target := range query.Targets {
+		if target.Hide || target.Target == "" {
+			continue
+		}
+		params, err := a.grafanaParams(query, target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts, err := a.parseExportValues(params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.user = requestUser(r.Context())
+		if err := gd.ResolveRegions(r.Context(), &opts.FetchOptions); err != nil {
+			http.Error(w, err.Error(), a.exportErrorStatus(opts))
+			return
+		}
+		if err := gd.ResolveAccounts(r.Context(), &opts.FetchOptions); err != nil {
+			http.Error(w, err.Error(), a.exportErrorStatus(opts))
+			return
+		}
+
+		var result []any
+		switch target.Target {
+		case grafanaFindingsPerDay:
+			result, err = findingsPerDay(r.Context(), opts, query.Range.From, query.Range.To)
+		case grafanaFindingsByType:
+			result, err = findingsByType(r.Context(), opts, target.RefID)
+		default:
+			result, err = findingsTable(r.Context(), opts, target.RefID)
+		}
+		if err != nil {
+			telemetry.Logger(r.Context()).Error("Grafana query failed", "target", target.Target, "error", err)
+			http.Error(w, err.Error(), a.exportErrorStatus(opts))
+			return
+		}
+		results = append(results, result...)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// grafanaParams returns the export options of a target: those of its
+// payload and the dashboard's ad hoc filters, with the time range unless
+// the payload sets creation times of its own
+func (a *App) grafanaParams(query grafanaQuery, target grafanaTarget) (url.Values, error) {
+	if !slices.Contains([]string{grafanaFindingsPerDay, grafanaFindingsByType, grafanaFindings}, target.Target) {
+		return nil, fmt.Errorf("Invalid target %q: use %s, %s, or %s", target.Target, grafanaFindingsPerDay, grafanaFindingsByType, grafanaFindings)
+	}
+	payload := target.Payload
+	// Older versions of the datasource send the payload as a string
+	var text string
+	if json.Unmarshal(payload, &text) == nil {
+		payload = json.RawMessage(text)
+	}
+	var params map[string]paramValues
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &params); err != nil {
+			return nil, fmt.Errorf("Invalid payload of target %q: must be a JSON object of export options", target.Target)
+		}
+	}
+
+	values := url.Values{}
+	known := exportParams()
+	for param, v := range params {
+		if !slices.ContainsFunc(known, func(p apiParam) bool { return p.name == param }) {
+			return nil, fmt.Errorf("Unknown parameter %q", param)
+		}
+		if slices.Contains(grafanaUnsupportedParams, param) {
+			return nil, fmt.Errorf("Parameter %q does not apply to Grafana queries", param)
+		}
+		values[param] = v
+	}
+	// Ad hoc filters replace the payload's values of their keys, and those
+	// of a repeatable option combine
+	filtered := map[string]bool{}
+	for _, filter := range query.AdhocFilters {
+		if filtered[filter.Key] && slices.Contains(repeatableParams, filter.Key) {
+			values.Add(filter.Key, filter.Value)
+		} else {
+			values.Set(filter.Key, filter.Value)
+		}
+		filtered[filter.Key] = true
+	}
+	if !values.Has("createdAfter") && !values.Has("createdBefore") {
+		values.Set("createdAfter", query.Range.From.UTC().Format(time.RFC3339))
+		values.Set("createdBefore", query.Range.To.UTC().Format(time.RFC3339))
+	}
+	if target.Target == grafanaFindings && !values.Has("maxFindings") {
+		values.Set("maxFindings", strconv.Itoa(grafanaMaxRows))
+	}
+	return values, nil
+}
+
+// eachFinding passes every finding of the export opts describes to fn, and
+// returns why the fetch failed
+func eachFinding(ctx context.Context, opts exportOptions, fn func(finding types.Finding)) error {
+	stream := gd.StreamRegions(ctx, opts.FetchOptions, nil)
+	defer stream.Close()
+	for region, ok := stream.Next(); ok; region, ok = stream.Next() {
+		for finding := range region.Findings {
+			fn(finding)
+		}
+	}
+	return fetchFailure(ctx, stream)
+}
+
+// findingsPerDay counts the findings created on each UTC day of the range
+// by severity, a series for each severity with every day of the range
+func findingsPerDay(ctx context.Context, opts exportOptions, from, to time.Time) ([]any, error) {
+	first := from.UTC().Truncate(24 * time.Hour)
+	days := int(to.Sub(first)/(24*time.Hour)) + 1
+	counts := make(map[string][]int, len(gd.SeverityLabels))
+	for _, label := range gd.SeverityLabels {
+		counts[label] = make([]int, days)
+	}
+	err := eachFinding(ctx, opts, func(finding types.Finding) {
+		created, err := time.Parse(time.RFC3339, aws.ToString(finding.CreatedAt))
+		if err != nil {
+			return
+		}
+		day := int(created.UTC().Sub(first) / (24 * time.Hour))
+		if day >= 0 && day < days {
+			counts[gd.SeverityLabel(aws.ToFloat64(finding.Severity))][day]++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	series := make([]any, 0, len(gd.SeverityLabels))
+	for _, label := range gd.SeverityLabels {
+		s := grafanaSeries{Target: label, Datapoints: make([][2]float64, days)}
+		for day, count := range counts[label] {
+			s.Datapoints[day] = [2]float64{float64(count), float64(first.Add(time.Duration(day) * 24 * time.Hour).UnixMilli())}
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// findingsByType counts the findings of each type by severity, most common
+// first
+func findingsByType(ctx context.Context, opts exportOptions, refID string) ([]any, error) {
+	counts := make(map[string]map[string]int)
+	err := eachFinding(ctx, opts, func(finding types.Finding) {
+		findingType := aws.ToString(finding.Type)
+		if counts[findingType] == nil {
+			counts[findingType] = make(map[string]int)
+		}
+		counts[findingType][gd.SeverityLabel(aws.ToFloat64(finding.Severity))]++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	table := grafanaTable{Type: "table", RefID: refID, Columns: []grafanaColumn{{Text: "Type", Type: "string"}}, Rows: [][]any{}}
+	for _, label := range gd.SeverityLabels {
+		table.Columns = append(table.Columns, grafanaColumn{Text: label, Type: "number"})
+	}
+	table.Columns = append(table.Columns, grafanaColumn{Text: "Total", Type: "number"})
+	for findingType, bySeverity := range counts {
+		row := []any{findingType}
+		total := 0
+		for _, label := range gd.SeverityLabels {
+			row = append(row, bySeverity[label])
+			total += bySeverity[label]
+		}
+		table.Rows = append(table.Rows, append(row, total))
+	}
+	totalColumn := len(table.Columns) - 1
+	sort.Slice(table.Rows, func(i, j int) bool {
+		ti, tj := table.Rows[i][totalColumn].(int), table.Rows[j][totalColumn].(int)
+		if ti != tj {
+			return ti > tj
+		}
+		return table.Rows[i][0].(string) < table.Rows[j][0].(string)
+	})
+	return []any{table}, nil
+}
+
+// findingsTable lists the findings with the export's columns. Severity is
+// a number and the creation and update times are times, so Grafana can
+// sort and color them.
+func findingsTable(ctx context.Context, opts exportOptions, refID string) ([]any, error) {
+	table := grafanaTable{Type: "table", RefID: refID, Rows: [][]any{}}
+	for _, column := range opts.Columns {
+		kind := "string"
+		switch column {
+		case "Severity":
+			kind = "number"
+		case "CreatedAt", "UpdatedAt":
+			kind = "time"
+		}
+		table.Columns = append(table.Columns, grafanaColumn{Text: column, Type: kind})
+	}
+	err := eachFinding(ctx, opts, func(finding types.Finding) {
+		row := make([]any, len(opts.Columns))
+		for i, column := range opts.Columns {
+			value := opts.ColumnValue(finding, column)
+			switch table.Columns[i].Type {
+			case "number":
+				row[i] = aws.ToFloat64(finding.Severity)
+			case "time":
+				if t, err := time.Parse(time.RFC3339, value); err == nil {
+					row[i] = t.UnixMilli()
+					continue
+				}
+				row[i] = nil
+			default:
+				row[i] = value
+			}
+		}
+		table.Rows = append(table.Rows, row)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []any{table}, nil
+}
@@ -0,0 +1,565 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// The gRPC service of exporter.proto. gRPC is served by net/http over
+// HTTP/2: a call is a POST to /package.Service/Method whose body and
+// response are length-prefixed protobuf messages, and whose status follows
+// the response in the trailers.
+const (
+	grpcExportFindings = "/guardduty.export.v1.Exporter/ExportFindings"
+	// grpcMaxRequest is the largest request message accepted
+	grpcMaxRequest = 1 << 20
+)
+
+// The gRPC status codes of failed calls
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnauthenticated    = 16
+)
+
+// grpcUnsupportedParams are the export options that ExportFindings does not
+// take: those of how an export is written and delivered, since the call
+// streams the findings themselves, and of dry runs and reports
+var grpcUnsupportedParams = []string{
+	"format", "destination", "compress", "pretty", "flatten", "sanitize", "bom", "columns",
+	"csvDelimiter", "csvLineEnding", "csvQuote", "csvTimeFormat", "csvTimezone", "template", "columnMapping",
+	"productArn", "topFindings", "groupBy", "locale", "partition", "split", "email", "notify",
+	"dryRun", "coverage", "usage", "malwareScans", "ipSets", "members", "filters", "publishingDestinations", "posture",
+}
+
+// grpcStatus is the status a call fails with
+type grpcStatus struct {
+	code    int
+	message string
+}
+
+func (s *grpcStatus) Error() string {
+	return s.message
+}
+
+// grpcService serves the calls of the gRPC service, and counts those in
+// progress so the server can wait for them when it shuts down
+type grpcService struct {
+	app   *App
+	calls sync.WaitGroup
+}
+
+func (s *grpcService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "The gRPC server only takes gRPC calls", http.StatusUnsupportedMediaType)
+		return
+	}
+	s.calls.Add(1)
+	defer s.calls.Done()
+
+	w.Header().Set("Content-Type", "application/grpc")
+	code, message := grpcOK, ""
+	if err := s.serveCall(w, r); err != nil {
+		var status *grpcStatus
+		if errors.As(err, &status) {
+			code, message = status.code, status.message
+		} else {
+			code, message = grpcUnknown, err.Error()
+		}
+	}
+	telemetry.Logger(r.Context()).Info("Call finished", "rpc", r.URL.Path, "grpc_status", code)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEncodeMessage(message))
+	}
+}
+
+// serveCall authenticates a call and runs its method within the call's
+// grpc-timeout
+func (s *grpcService) serveCall(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	if timeout := r.Header.Get("Grpc-Timeout"); timeout != "" {
+		d, err := parseGRPCTimeout(timeout)
+		if err != nil {
+			return &grpcStatus{grpcInvalidArgument, err.Error()}
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	if encoding := r.Header.Get("Grpc-Encoding"); encoding != "" && encoding != "identity" {
+		w.Header().Set("Grpc-Accept-Encoding", "identity")
+		return &grpcStatus{grpcUnimplemented, fmt.Sprintf("Compression %q is not supported", encoding)}
+	}
+	ctx, err := s.authenticate(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	switch r.URL.Path {
+	case grpcExportFindings:
+		message, err := readGRPCMessage(r.Body)
+		if err != nil {
+			return err
+		}
+		return s.app.exportFindings(ctx, &grpcStream{w: w}, message)
+	}
+	return &grpcStatus{grpcUnimplemented, fmt.Sprintf("Unknown method %s", r.URL.Path)}
+}
+
+// authenticate checks the credentials of a call, an API key in its
+// authorization or x-api-key metadata or a user's basic authentication, as
+// requireAuth does those of /api requests, and returns the call's context
+// with its principal. OIDC sessions are only for the web interface.
+func (s *grpcService) authenticate(r *http.Request) (context.Context, error) {
+	c := s.app.config().Auth
+	if !c.enabled() {
+		return r.Context(), nil
+	}
+	l := telemetry.Logger(r.Context())
+	p, ok := c.authenticate(r)
+	if !ok {
+		l.Warn("Rejected unauthenticated request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		return nil, &grpcStatus{grpcUnauthenticated, "Authentication required"}
+	}
+	l = l.With("principal", p.name)
+	if p.role < roleOperator {
+		l.Warn("Rejected request outside the principal's role", "method", r.Method, "path", r.URL.Path, "role", p.role.String(), "required_role", roleOperator.String())
+		return nil, &grpcStatus{grpcPermissionDenied, "Your role does not allow exporting"}
+	}
+	l.Info("Authenticated request", "method", r.Method, "path", r.URL.Path, "role", p.role.String(), "remote_addr", r.RemoteAddr)
+	return context.WithValue(telemetry.WithLogger(r.Context(), l), principalKey{}, p), nil
+}
+
+// wait waits for the calls in progress to finish, or for ctx to expire
+func (s *grpcService) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.calls.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// exportFindings serves ExportFindings. It runs the export that the
+// request's params describe, as /api/export takes them, and streams the
+// fetcher's progress and each finding as they arrive, then a summary of the
+// regions. Progress of one region may come between the findings of another,
+// since regions are fetched concurrently.
+func (a *App) exportFindings(ctx context.Context, stream *grpcStream, message []byte) error {
+	log := telemetry.Logger(ctx)
+	query, err := decodeExportRequest(message)
+	if err != nil {
+		return &grpcStatus{grpcInvalidArgument, fmt.Sprintf("Invalid request: %v", err)}
+	}
+	known := exportParams()
+	for param := range query {
+		if !slices.ContainsFunc(known, func(p apiParam) bool { return p.name == param }) {
+			return &grpcStatus{grpcInvalidArgument, fmt.Sprintf("Unknown parameter %q", param)}
+		}
+		if slices.Contains(grpcUnsupportedParams, param) {
+			return &grpcStatus{grpcInvalidArgument, fmt.Sprintf("Parameter %q does not apply to ExportFindings, which streams the findings themselves", param)}
+		}
+	}
+	opts, err := a.parseExportValues(query)
+	if err != nil {
+		return &grpcStatus{grpcInvalidArgument, err.Error()}
+	}
+	opts.user = requestUser(ctx)
+	if opts.dryRun || opts.report != "" {
+		return &grpcStatus{grpcInvalidArgument, "Dry runs and reports are not streamed: request them from /api/export"}
+	}
+	if err := gd.ResolveRegions(ctx, &opts.FetchOptions); err != nil {
+		return a.grpcExportStatus(ctx, opts, err)
+	}
+	if err := gd.ResolveAccounts(ctx, &opts.FetchOptions); err != nil {
+		return a.grpcExportStatus(ctx, opts, err)
+	}
+	// Streamed exports are stored nowhere, so only the permissions are
+	// checked
+	if err := a.checkPreflight(ctx, &opts, preflightDestination{}); err != nil {
+		log.Warn("Export stopped by its preflight", "error", err)
+		return &grpcStatus{grpcFailedPrecondition, err.Error()}
+	}
+
+	log.Info("Export started", "regions", opts.Regions)
+	ctx, span := telemetry.StartSpan(ctx, "export", "regions", len(opts.Regions))
+	telemetry.ExportsStarted.Inc()
+	completed := false
+	defer func() {
+		if !completed {
+			telemetry.ExportsFailed.Inc()
+			span.Finish(errors.New("export failed"))
+			return
+		}
+		span.Finish(nil)
+	}()
+
+	progress := &grpcProgress{stream: stream, total: opts.TargetCount()}
+	regions := gd.StreamRegions(ctx, opts.FetchOptions, progress.send)
+	defer regions.Close()
+	run := newRun(runSourceGRPC, opts)
+	var runErr error
+	defer func() {
+		var message string
+		if runErr != nil {
+			message = runErr.Error()
+		}
+		run.finish(runOutcome(ctx, completed), message, regions.Results())
+		run.Truncation = streamTruncation(regions)
+		a.recordRun(ctx, run)
+	}()
+
+	totalFindings, err := export.WriteFindings(ctx, &grpcFindingWriter{stream: stream}, regions)
+	if failure := fetchFailure(ctx, regions); failure != nil {
+		log.Error("Export failed", "error", failure)
+		return a.grpcExportStatus(ctx, opts, failure)
+	}
+	if err != nil {
+		// The client has gone away or stopped reading
+		log.Error("Error streaming export", "error", err)
+		runErr = err
+		return &grpcStatus{grpcUnknown, fmt.Sprintf("error streaming export: %v", err)}
+	}
+	a.completeExport(ctx, opts, regions)
+	completed = true
+	log.Info("Export completed", "findings", totalFindings)
+	return stream.send(appendMessage(nil, 3, encodeSummary(totalFindings, regions)))
+}
+
+// grpcExportStatus returns the status of a call whose export failed with
+// err: canceled or past its deadline, unauthenticated when the profile's SSO
+// credentials have expired, or otherwise internal
+func (a *App) grpcExportStatus(ctx context.Context, opts exportOptions, err error) error {
+	code := grpcInternal
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		code = grpcDeadlineExceeded
+	case ctx.Err() != nil:
+		code = grpcCanceled
+	case a.exportErrorStatus(opts) == http.StatusUnauthorized:
+		code = grpcUnauthenticated
+	}
+	return &grpcStatus{code, err.Error()}
+}
+
+// grpcStream sends the response messages of a server-streaming call. The
+// progress of an export is sent from the goroutines fetching its regions,
+// so sends are serialized.
+type grpcStream struct {
+	mu sync.Mutex
+	w  http.ResponseWriter
+	// err is the error of a failed send, after which nothing is sent
+	err error
+}
+
+// send writes message with its length prefix and flushes it to the client
+func (s *grpcStream) send(message []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	frame = append(frame, message...)
+	if _, err := s.w.Write(frame); err != nil {
+		s.err = err
+		return err
+	}
+	if err := http.NewResponseController(s.w).Flush(); err != nil {
+		s.err = err
+		return err
+	}
+	return nil
+}
+
+// grpcFindingWriter sends each finding of an export as a Finding message
+type grpcFindingWriter struct {
+	stream *grpcStream
+}
+
+func (w *grpcFindingWriter) WriteHeader() error {
+	return nil
+}
+
+func (w *grpcFindingWriter) WriteFinding(finding types.Finding) error {
+	data, err := json.Marshal(finding)
+	if err != nil {
+		return fmt.Errorf("error encoding finding: %v", err)
+	}
+	return w.stream.send(appendMessage(nil, 2, encodeFinding(finding, data)))
+}
+
+func (w *grpcFindingWriter) Close() error {
+	return nil
+}
+
+// grpcProgress sends the fetcher's events as Progress messages, with the
+// running totals that the events of jobs carry. A failed send is left to
+// the finding writer to report.
+type grpcProgress struct {
+	stream *grpcStream
+	mu     sync.Mutex
+	total  int
+
+	findings    int
+	regionsDone int
+	throttles   int
+}
+
+func (p *grpcProgress) send(event gd.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch event.Type {
+	case gd.EventPageFetched:
+		p.findings += event.PageFindings
+	case gd.EventThrottled:
+		p.throttles++
+	case gd.EventRegionDone:
+		p.regionsDone++
+	}
+	event.Findings = p.findings
+	event.RegionsDone = p.regionsDone
+	event.RegionsTotal = p.total
+	event.Throttles = p.throttles
+	p.stream.send(appendMessage(nil, 1, encodeProgress(event)))
+}
+
+// readGRPCMessage reads the single message of a unary request
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, &grpcStatus{grpcInternal, "The request has no message"}
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcStatus{grpcUnimplemented, "Compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxRequest {
+		return nil, &grpcStatus{grpcResourceExhausted, fmt.Sprintf("The request message of %d bytes is larger than %d bytes", size, grpcMaxRequest)}
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, &grpcStatus{grpcInternal, fmt.Sprintf("error reading request: %v", err)}
+	}
+	return message, nil
+}
+
+// parseGRPCTimeout parses a grpc-timeout header: up to eight digits and a
+// unit of H, M, S, m, u, or n
+func parseGRPCTimeout(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("Invalid grpc-timeout %q", s)
+	}
+	unit, ok := units[s[len(s)-1]]
+	n, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("Invalid grpc-timeout %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// grpcEncodeMessage percent-encodes the grpc-message trailer, which holds
+// only printable ASCII
+func grpcEncodeMessage(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// decodeExportRequest reads the params of an ExportRequest message
+func decodeExportRequest(b []byte) (url.Values, error) {
+	query := url.Values{}
+	err := consumeFields(b, func(num protowire.Number, entry []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var key string
+		var values []string
+		err := consumeFields(entry, func(num protowire.Number, value []byte) error {
+			switch num {
+			case 1:
+				key = string(value)
+			case 2:
+				return consumeFields(value, func(num protowire.Number, value []byte) error {
+					if num == 1 {
+						values = append(values, string(value))
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		query[key] = append(query[key], values...)
+		return err
+	})
+	return query, err
+}
+
+// consumeFields calls fn with the number and contents of each
+// length-delimited field of a message, the strings and messages of the
+// requests, skipping fields of other types
+func consumeFields(b []byte, fn func(num protowire.Number, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(num, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeProgress(event gd.Event) []byte {
+	var b []byte
+	b = appendString(b, 1, event.Type)
+	b = appendString(b, 2, event.Account)
+	b = appendString(b, 3, event.Region)
+	b = appendString(b, 4, event.Detector)
+	b = appendInt(b, 5, event.Page)
+	b = appendInt(b, 6, event.PageFindings)
+	b = appendString(b, 7, event.Operation)
+	b = appendString(b, 8, event.Error)
+	b = appendString(b, 9, event.Skipped)
+	b = appendInt(b, 10, event.Findings)
+	b = appendInt(b, 11, event.RegionsDone)
+	b = appendInt(b, 12, event.RegionsTotal)
+	b = appendInt(b, 13, event.Throttles)
+	return b
+}
+
+func encodeFinding(finding types.Finding, data []byte) []byte {
+	var b []byte
+	b = appendString(b, 1, aws.ToString(finding.Id))
+	b = appendString(b, 2, aws.ToString(finding.AccountId))
+	b = appendString(b, 3, aws.ToString(finding.Region))
+	b = appendString(b, 4, aws.ToString(finding.Type))
+	if severity := aws.ToFloat64(finding.Severity); severity != 0 {
+		b = protowire.AppendTag(b, 5, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(severity))
+	}
+	b = appendString(b, 6, aws.ToString(finding.Title))
+	b = appendString(b, 7, aws.ToString(finding.UpdatedAt))
+	return appendMessage(b, 8, data)
+}
+
+// encodeSummary encodes the outcome of a completed export, its regions
+// described as in its summary
+func encodeSummary(totalFindings int, stream *gd.Stream) []byte {
+	summary := stream.Summary()
+	b := appendInt(nil, 1, totalFindings)
+	for _, outcome := range summary.Regions {
+		var region []byte
+		region = appendString(region, 1, outcome.Target)
+		region = appendString(region, 2, outcome.Status)
+		region = appendInt(region, 3, outcome.Findings)
+		region = appendString(region, 4, outcome.Error)
+		region = appendInt(region, 5, outcome.Pages)
+		region = appendInt(region, 6, outcome.APICalls)
+		region = appendDouble(region, 7, outcome.DurationSeconds)
+		b = appendMessage(b, 2, region)
+	}
+	if truncation, ok := stream.Truncated(); ok {
+		var t []byte
+		t = appendString(t, 1, truncation.Reason)
+		t = appendString(t, 2, truncation.Limit)
+		t = appendInt(t, 3, truncation.Findings)
+		t = appendString(t, 4, truncation.Region)
+		for _, region := range truncation.Remaining {
+			t = appendMessage(t, 5, []byte(region))
+		}
+		b = appendMessage(b, 3, t)
+	}
+	b = appendInt(b, 4, summary.Pages)
+	b = appendInt(b, 5, summary.APICalls)
+	return appendDouble(b, 6, summary.DurationSeconds)
+}
+
+// appendString appends a string field, left out when empty as proto3 does
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendMessage(b, num, []byte(s))
+}
+
+// appendInt appends an int32 field, left out when zero as proto3 does
+func appendInt(b []byte, num protowire.Number, v int) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+// appendDouble appends a double field, left out when zero as proto3 does
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+// appendMessage appends a length-delimited field: a message, or the bytes
+// of a string
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// The readiness check's limit on resolving credentials and calling STS,
+// shorter than an orchestrator's probe timeout, and how long a successful
+// check is reused so frequent probes don't each call STS
+const (
+	readyTimeout  = 5 * time.Second
+	readyCacheTTL = 30 * time.Second
+)
+
+// readiness is the outcome of the last readiness check
+type readiness struct {
+	mu       sync.Mutex
+	identity *callerIdentity
+	checked  time.Time
+	// draining is set once the server is shutting down
+	draining bool
+}
+
+// callerIdentity is who the server's default credentials are
+type callerIdentity struct {
+	Account string `json:"account"`
+	ARN     string `json:"arn"`
+	UserID  string `json:"userId"`
+	Region  string `json:"region,omitempty"`
+	// Source is the provider the credentials came from, such as
+	// SharedConfigCredentials or EC2RoleProvider
+	Source  string     `json:"source,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// readyView is the body of /readyz
+type readyView struct {
+	Status string `json:"status"`
+	*callerIdentity
+	Error string `json:"error,omitempty"`
+	// Hint suggests what to check for the kind of credentials that failed
+	Hint string `json:"hint,omitempty"`
+}
+
+// handleHealth serves /healthz, which reports that the server is up without
+// calling AWS, for liveness probes
+func (a *App) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handleReady serves /readyz, which resolves the server's default
+// credentials and calls STS GetCallerIdentity with them, and reports the
+// identity exports use, or 503 Service Unavailable when either fails or the
+// server is shutting down
+func (a *App) handleReady(w http.ResponseWriter, r *http.Request) {
+	identity, err := a.ready.check(r.Context(), a.awsClients(), a.awsCfg)
+	view := readyView{Status: "ready", callerIdentity: identity}
+	status := http.StatusOK
+	if err != nil {
+		view = readyView{Status: "unavailable", Error: err.Error(), Hint: describeCredentials(*a.config(), a.config().Profile).Hint}
+		status = http.StatusServiceUnavailable
+		telemetry.Logger(r.Context()).Warn("Readiness check failed", "error", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(view)
+}
+
+// check returns the caller identity of cfg, reusing that of a check in the
+// last readyCacheTTL
+func (s *readiness) check(ctx context.Context, clients gd.Clients, cfg aws.Config) (*callerIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return nil, fmt.Errorf("server is shutting down")
+	}
+	if s.identity != nil && time.Since(s.checked) < readyCacheTTL {
+		return s.identity, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	identity, err := lookupIdentity(ctx, clients, cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.identity, s.checked = identity, time.Now()
+	return identity, nil
+}
+
+// lookupIdentity resolves the credentials of cfg and returns who they are
+// according to the STS GetCallerIdentity of clients
+func lookupIdentity(ctx context.Context, clients gd.Clients, cfg aws.Config) (*callerIdentity, error) {
+	if cfg.Credentials == nil {
+		return nil, fmt.Errorf("no AWS credentials are configured")
+	}
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving AWS credentials: %v", err)
+	}
+	out, err := clients.STS(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting caller identity: %v", err)
+	}
+	identity := &callerIdentity{
+		Account: aws.ToString(out.Account),
+		ARN:     aws.ToString(out.Arn),
+		UserID:  aws.ToString(out.UserId),
+		Region:  cfg.Region,
+		Source:  creds.Source,
+	}
+	if creds.CanExpire {
+		expires := creds.Expires.UTC()
+		identity.Expires = &expires
+	}
+	return identity, nil
+}
+
+// drain makes the readiness check fail from now on, so that orchestrators
+// stop sending requests while the server shuts down
+func (s *readiness) drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+}
@@ -0,0 +1,416 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// defaultHistoryFile is the name of the history file in the output directory
+// when no historyFile is configured
+const defaultHistoryFile = ".guardduty_export_history.ndjson"
+
+// Sources of export runs: the synchronous export endpoint, background jobs
+// started through the API or the web interface, schedules, the export
+// command, and calls of the gRPC service
+const (
+	runSourceExport   = "export"
+	runSourceJob      = "job"
+	runSourceSchedule = "schedule"
+	runSourceCLI      = "cli"
+	runSourceGRPC     = "grpc"
+)
+
+// historyRun is one export run in the history
+type historyRun struct {
+	ID     string `json:"id"`
+	Source string `json:"source"`
+	// JobID and Schedule identify the job of a background export and the
+	// schedule that started it
+	JobID    string `json:"jobId,omitempty"`
+	Schedule string `json:"schedule,omitempty"`
+	// RerunOf is the run that this one repeats
+	RerunOf string `json:"rerunOf,omitempty"`
+	// ResumeOf is the failed job whose checkpoint this run resumed
+	ResumeOf string `json:"resumeOf,omitempty"`
+	User     string `json:"user,omitempty"`
+	// Preset is the preset the export was filled in from; Params already
+	// include its options, so a re-run is not affected by later changes
+	Preset          string              `json:"preset,omitempty"`
+	Params          map[string][]string `json:"params"`
+	Status          jobStatus           `json:"status"`
+	Error           string              `json:"error,omitempty"`
+	StartedAt       time.Time           `json:"startedAt"`
+	FinishedAt      time.Time           `json:"finishedAt"`
+	DurationSeconds float64             `json:"durationSeconds"`
+	Findings        int                 `json:"findings"`
+	// Duplicates is the number of findings the run left out as duplicates
+	Duplicates int `json:"duplicates,omitempty"`
+	// Pages and APICalls count the ListFindings pages fetched and the AWS
+	// API call attempts made
+	Pages    int                  `json:"pages,omitempty"`
+	APICalls int                  `json:"apiCalls,omitempty"`
+	Regions  []historyRegionEntry `json:"regions"`
+	// Truncation is set when the export's limits stopped the run early
+	Truncation *gd.Truncation `json:"truncation,omitempty"`
+	// DeletedAt is when the retention policy soft-deleted the run, which
+	// is hidden until it is purged
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// historyRegionEntry is the outcome of one account and region of a run.
+// Error is the error of a failed region or the reason a region was skipped.
+type historyRegionEntry struct {
+	Target     string `json:"target"`
+	Status     string `json:"status"`
+	Findings   int    `json:"findings"`
+	Duplicates int    `json:"duplicates,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// newRun starts the history entry of an export run with opts
+func newRun(source string, opts exportOptions) historyRun {
+	return historyRun{
+		ID:        newJobID(),
+		Source:    source,
+		RerunOf:   opts.rerunOf,
+		ResumeOf:  opts.resumeOf,
+		User:      opts.user,
+		Preset:    opts.preset,
+		Params:    opts.params,
+		StartedAt: time.Now(),
+	}
+}
+
+// runOutcome returns the status of a synchronous export that completed, or
+// otherwise failed or was canceled through ctx
+func runOutcome(ctx context.Context, completed bool) jobStatus {
+	switch {
+	case completed:
+		return jobSucceeded
+	case ctx.Err() != nil:
+		return jobCanceled
+	}
+	return jobFailed
+}
+
+// finish completes the entry with the run's outcome and the results of its
+// regions. A run that failed reports errMessage, or the region that
+// stopped it.
+func (run *historyRun) finish(status jobStatus, errMessage string, results []gd.RegionResult) {
+	run.FinishedAt = time.Now()
+	run.DurationSeconds = run.FinishedAt.Sub(run.StartedAt).Seconds()
+	run.Status = status
+	run.Error = errMessage
+	run.Findings, run.Pages, run.APICalls = 0, 0, 0
+	run.Duplicates = countDuplicates(results)
+	run.Regions = make([]historyRegionEntry, 0, len(results))
+	for _, result := range results {
+		entry := regionEntry(result)
+		if result.Err != nil && run.Error == "" && status != jobSucceeded {
+			run.Error = fmt.Sprintf("error getting findings for region %s: %v", entry.Target, result.Err)
+		}
+		run.Findings += result.Count
+		run.Pages += result.Pages
+		run.APICalls += result.Calls
+		run.Regions = append(run.Regions, entry)
+	}
+	sort.Slice(run.Regions, func(i, j int) bool {
+		return run.Regions[i].Target < run.Regions[j].Target
+	})
+}
+
+// regionEntry returns the outcome of one account and region of a run
+func regionEntry(result gd.RegionResult) historyRegionEntry {
+	entry := historyRegionEntry{Target: gd.TargetLabel(result.Account, result.Region), Status: "succeeded", Findings: result.Count, Duplicates: result.Duplicates}
+	switch {
+	case result.Err != nil:
+		entry.Status, entry.Error = "failed", result.Err.Error()
+	case result.Skipped != "":
+		entry.Status, entry.Error = "skipped", result.Skipped
+	case result.Truncated:
+		entry.Status = "truncated"
+	}
+	return entry
+}
+
+// countDuplicates returns the number of findings the regions left out as
+// duplicates
+func countDuplicates(results []gd.RegionResult) int {
+	n := 0
+	for _, result := range results {
+		n += result.Duplicates
+	}
+	return n
+}
+
+// historyStore keeps the most recent runs in a file of one JSON run per
+// line. Runs are appended, so the server and export commands sharing the
+// file don't overwrite each other's, and the file is trimmed to the limit
+// once it holds twice as many.
+type historyStore struct {
+	mu    sync.Mutex
+	path  string
+	limit int
+}
+
+// load reads the runs in the history file, oldest first. A missing file is
+// an empty history, and a line that cannot be parsed, such as one cut off
+// by a crash, is skipped.
+func (s *historyStore) load() ([]historyRun, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading history file %s: %v", s.path, err)
+	}
+	var runs []historyRun
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var run historyRun
+		if json.Unmarshal(scanner.Bytes(), &run) == nil {
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
+
+// add appends run to the history
+func (s *historyStore) add(run historyRun) error {
+	if s.limit == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.Marshal(run)
+	if err != nil {
+		return fmt.Errorf("error encoding run: %v", err)
+	}
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("error writing history file %s: %v", s.path, err)
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing history file %s: %v", s.path, err)
+	}
+
+	runs, err := s.load()
+	if err != nil || len(runs) <= 2*s.limit {
+		return err
+	}
+	return s.rewrite(runs[len(runs)-s.limit:])
+}
+
+// rewrite replaces the history file with runs
+func (s *historyStore) rewrite(runs []historyRun) error {
+	var buf bytes.Buffer
+	for _, run := range runs {
+		data, _ := json.Marshal(run)
+		buf.Write(append(data, '\n'))
+	}
+	if err := writeFileAtomic(s.path, buf.Bytes()); err != nil {
+		return fmt.Errorf("error writing history file %s: %v", s.path, err)
+	}
+	return nil
+}
+
+// retire deletes the runs that started longer ago than the policy's
+// HistoryMaxAge, soft-deleting them with a purge delay, and purges the
+// soft-deleted runs past it, or all of them with purge
+func (s *historyStore) retire(now time.Time, policy retentionConfig, purge bool) (retentionCounts, error) {
+	var counts retentionCounts
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs, err := s.load()
+	if err != nil {
+		return counts, err
+	}
+	kept := runs[:0]
+	for _, run := range runs {
+		switch {
+		case run.DeletedAt != nil:
+			if policy.expired(now, *run.DeletedAt, purge) {
+				counts.Purged++
+				continue
+			}
+		case policy.HistoryMaxAge > 0 && now.Sub(run.StartedAt) > policy.HistoryMaxAge:
+			if !policy.soft(purge) {
+				counts.Purged++
+				continue
+			}
+			run.DeletedAt = &now
+			counts.Deleted++
+		}
+		kept = append(kept, run)
+	}
+	if counts == (retentionCounts{}) {
+		return counts, nil
+	}
+	return counts, s.rewrite(kept)
+}
+
+// restore brings back the soft-deleted runs, returning how many
+func (s *historyStore) restore() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs, err := s.load()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := range runs {
+		if runs[i].DeletedAt != nil {
+			runs[i].DeletedAt = nil
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.rewrite(runs)
+}
+
+// list returns up to limit of the most recent runs, newest first, leaving
+// out soft-deleted ones
+func (s *historyStore) list(limit int) ([]historyRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	runs = slices.DeleteFunc(runs, func(run historyRun) bool { return run.DeletedAt != nil })
+	if len(runs) > s.limit {
+		runs = runs[len(runs)-s.limit:]
+	}
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].StartedAt.After(runs[j].StartedAt)
+	})
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+// get returns the run with the given ID
+func (s *historyStore) get(id string) (historyRun, bool, error) {
+	runs, err := s.list(0)
+	if err != nil {
+		return historyRun{}, false, err
+	}
+	for _, run := range runs {
+		if run.ID == id {
+			return run, true, nil
+		}
+	}
+	return historyRun{}, false, nil
+}
+
+// recordRun adds a finished run to the history and the audit log. A
+// failure is only logged, as the export itself is done.
+func (a *App) recordRun(ctx context.Context, run historyRun) {
+	if err := a.history.add(run); err != nil {
+		telemetry.Logger(ctx).Error("Error recording export history", "run_id", run.ID, "error", err)
+	}
+	a.auditRun(ctx, run)
+	a.logSyntheticRun(ctx, run)
+}
+
+// handleListHistory returns the most recent runs, newest first, up to the
+// limit query parameter
+func (a *App) handleListHistory(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("Invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	runs, err := a.history.list(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if runs == nil {
+		runs = []historyRun{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+// lookupRun returns the run named by the id path value, writing an error if
+// there is none
+func (a *App) lookupRun(w http.ResponseWriter, r *http.Request) (historyRun, bool) {
+	run, ok, err := a.history.get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return run, false
+	}
+	if !ok {
+		http.Error(w, "Run not found", http.StatusNotFound)
+	}
+	return run, ok
+}
+
+// handleGetHistory returns one run
+func (a *App) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	run, ok := a.lookupRun(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// handleRerun starts a background job with the parameters of a previous
+// run, against the current defaults for anything it did not set
+func (a *App) handleRerun(w http.ResponseWriter, r *http.Request) {
+	run, ok := a.lookupRun(w, r)
+	if !ok {
+		return
+	}
+	opts, err := a.parseExportValues(url.Values(run.Params))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Run %s cannot be repeated: %v", run.ID, err), http.StatusBadRequest)
+		return
+	}
+	opts.user = requestUser(r.Context())
+	opts.rerunOf = run.ID
+	if err := gd.ResolveRegions(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+	if err := gd.ResolveAccounts(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+
+	job := a.startJob(opts, "")
+	telemetry.Logger(r.Context()).Info("Repeating export", "run_id", run.ID, "job_id", job.id)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", a.path("/api/jobs/"+job.id))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.view())
+}
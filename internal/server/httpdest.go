@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+)
+
+// The http destination's modes: NDJSON requests of a batch of findings, or
+// a JSON request per finding
+const (
+	httpModeBatch   = "batch"
+	httpModeFinding = "finding"
+)
+
+// Headers set on the http destination's requests. The delivery ID stays
+// the same when a request is retried, so receivers can drop duplicates.
+const (
+	httpSignatureHeader = "X-GuardDuty-Signature"
+	httpTimestampHeader = "X-GuardDuty-Timestamp"
+	httpDeliveryHeader  = "X-GuardDuty-Delivery"
+)
+
+// httpConfig selects the endpoint that the http destination POSTs findings
+// to, such as the webhook of a SOAR playbook
+type httpConfig struct {
+	URL string `yaml:"url"`
+	// Mode is batch, NDJSON bodies of up to BatchSize findings, or finding,
+	// a JSON body per finding
+	Mode string `yaml:"mode"`
+	// Secret signs each request with HMAC-SHA256 over its timestamp, a
+	// period, and its body, sent as sha256=<hex> in X-GuardDuty-Signature
+	Secret string `yaml:"secret"`
+	// Headers are added to each request, such as an API key the endpoint
+	// requires
+	Headers   map[string]string `yaml:"headers"`
+	BatchSize int               `yaml:"batchSize"`
+	Retries   int               `yaml:"retries"`
+}
+
+func (c httpConfig) validate() error {
+	if c.URL != "" {
+		if err := validateEndpoint("http.url", c.URL); err != nil {
+			return err
+		}
+	}
+	if c.Mode != httpModeBatch && c.Mode != httpModeFinding {
+		return fmt.Errorf("invalid http.mode %q: must be batch or finding", c.Mode)
+	}
+	for name := range c.Headers {
+		switch textproto.CanonicalMIMEHeaderKey(name) {
+		case "", "Content-Type", "Content-Length", "Host", httpSignatureHeader, httpTimestampHeader, httpDeliveryHeader:
+			return fmt.Errorf("invalid http.headers %q: the header is set by the exporter", name)
+		}
+		if strings.ContainsAny(name, " :\r\n") {
+			return fmt.Errorf("invalid http.headers %q: must be a header name", name)
+		}
+	}
+	return validateSIEMBatching("http", c.BatchSize, c.Retries)
+}
+
+// target names the endpoint without its query or credentials, which may
+// hold a secret
+func (c httpConfig) target() string {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// sendHTTP POSTs findings to the http destination's endpoint, retrying
+// throttled and failed requests under one delivery ID
+func (a *App) sendHTTP(ctx context.Context, findings []types.Finding) error {
+	conf := a.config().HTTP
+	var body bytes.Buffer
+	contentType := "application/json"
+	if conf.Mode == httpModeFinding {
+		if err := json.NewEncoder(&body).Encode(findings[0]); err != nil {
+			return fmt.Errorf("error encoding finding: %v", err)
+		}
+	} else {
+		contentType = "application/x-ndjson"
+		encoder := json.NewEncoder(&body)
+		for _, finding := range findings {
+			if err := encoder.Encode(finding); err != nil {
+				return fmt.Errorf("error encoding finding: %v", err)
+			}
+		}
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	delivery := hex.EncodeToString(id)
+	return a.retryRequest(ctx, "http", conf.Retries, func() (bool, error) {
+		ctx, cancel := context.WithTimeout(ctx, siemRequestTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.URL, bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return false, fmt.Errorf("error sending findings to %s: %v", conf.target(), err)
+		}
+		for name, value := range conf.Headers {
+			req.Header.Set(name, value)
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set(httpDeliveryHeader, delivery)
+		// The signature covers the time it was made, so a receiver can turn
+		// away old requests replayed to it
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(httpTimestampHeader, timestamp)
+		if conf.Secret != "" {
+			mac := hmac.New(sha256.New, []byte(conf.Secret))
+			mac.Write([]byte(timestamp + "."))
+			mac.Write(body.Bytes())
+			req.Header.Set(httpSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			// The client's errors name the URL, which may hold a secret
+			if urlErr, ok := err.(*url.Error); ok {
+				err = urlErr.Err
+			}
+			return true, fmt.Errorf("error sending findings to %s: %v", conf.target(), err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			data, _ := io.ReadAll(io.LimitReader(resp.Body, siemMaxResponseLength))
+			return retryableStatus(resp.StatusCode), fmt.Errorf("error sending findings to %s: %s: %s", conf.target(), resp.Status, strings.TrimSpace(string(data)))
+		}
+		return false, nil
+	})
+}
@@ -0,0 +1,527 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// importBatch is the number of imported findings stored in one transaction
+const importBatch = 500
+
+// importReport counts the findings read from the artifacts of an import
+type importReport struct {
+	Files []importedFile `json:"files"`
+	// Findings counts the distinct findings, and Duplicates the copies left
+	// out because another file had the same finding
+	Findings   int `json:"findings"`
+	Duplicates int `json:"duplicates"`
+}
+
+// importedFile is one artifact of an import and the findings read from it
+type importedFile struct {
+	Name     string `json:"name"`
+	Findings int    `json:"findings"`
+}
+
+// importSet collects the findings of several export artifacts, such as the
+// per-account exports of different people, keeping one copy of each: the
+// one updated last, or of copies updated at the same time the first read.
+// Findings stay in the order they were first read.
+type importSet struct {
+	findings map[string]types.Finding
+	keys     []string
+	report   importReport
+}
+
+func newImportSet() *importSet {
+	return &importSet{findings: make(map[string]types.Finding), report: importReport{Files: []importedFile{}}}
+}
+
+// read adds the findings of the artifact named name
+func (s *importSet) read(r io.Reader, name string) error {
+	file := importedFile{Name: name}
+	err := readArtifact(r, name, func(finding types.Finding) {
+		file.Findings++
+		s.add(finding)
+	})
+	if err != nil {
+		return err
+	}
+	s.report.Files = append(s.report.Files, file)
+	return nil
+}
+
+// readFile adds the findings of the artifact at path
+func (s *importSet) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", path, err)
+	}
+	defer file.Close()
+	return s.read(file, filepath.Base(path))
+}
+
+// add keeps a finding unless a copy updated later was already read. Copies
+// are matched by account, region, and ID, as in diffs.
+func (s *importSet) add(finding types.Finding) {
+	key := aws.ToString(finding.AccountId) + "/" + aws.ToString(finding.Region) + "/" + aws.ToString(finding.Id)
+	previous, ok := s.findings[key]
+	if !ok {
+		s.findings[key] = finding
+		s.keys = append(s.keys, key)
+		s.report.Findings++
+		return
+	}
+	s.report.Duplicates++
+	if updatedAt(finding).After(updatedAt(previous)) {
+		s.findings[key] = finding
+	}
+}
+
+// updatedAt returns when a finding was last updated, or the zero time
+func updatedAt(finding types.Finding) time.Time {
+	t, _ := time.Parse(time.RFC3339, aws.ToString(finding.UpdatedAt))
+	return t
+}
+
+// list returns the findings in the order they were first read
+func (s *importSet) list() []types.Finding {
+	findings := make([]types.Finding, 0, len(s.keys))
+	for _, key := range s.keys {
+		findings = append(findings, s.findings[key])
+	}
+	return findings
+}
+
+// results groups the findings by account and region, in that order, as the
+// results of an export
+func (s *importSet) results() []gd.RegionResult {
+	var results []gd.RegionResult
+	index := make(map[string]int)
+	for _, finding := range s.list() {
+		account, region := aws.ToString(finding.AccountId), aws.ToString(finding.Region)
+		label := gd.TargetLabel(account, region)
+		i, ok := index[label]
+		if !ok {
+			i = len(results)
+			index[label] = i
+			results = append(results, gd.RegionResult{Account: account, Region: region, BySeverity: make(map[string]int)})
+		}
+		results[i].Findings = append(results[i].Findings, finding)
+		results[i].Count++
+		results[i].BySeverity[gd.SeverityLabel(aws.ToFloat64(finding.Severity))]++
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Account != results[j].Account {
+			return results[i].Account < results[j].Account
+		}
+		return results[i].Region < results[j].Region
+	})
+	return results
+}
+
+// readArtifact passes each finding of an export artifact to add, choosing
+// the format from name as diffs do. JSON and NDJSON exports hold complete
+// findings; a CSV export's findings have only the fields of its columns.
+// The error records of failed regions are left out.
+func readArtifact(r io.Reader, name string, add func(types.Finding)) error {
+	switch {
+	case strings.HasSuffix(name, encryptedSuffix):
+		return fmt.Errorf("error reading %s: encrypted exports must be decrypted first, with guardduty decrypt", name)
+	case strings.HasSuffix(name, ".gz"):
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("error decompressing %s: %v", name, err)
+		}
+		defer zr.Close()
+		return readArtifact(zr, strings.TrimSuffix(name, ".gz"), add)
+	case strings.HasSuffix(name, ".zip"):
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", name, err)
+		}
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", name, err)
+		}
+		for _, entry := range archive.File {
+			if entry.Name == "manifest.json" || entry.Name == "summary.json" || entry.FileInfo().IsDir() {
+				continue
+			}
+			f, err := entry.Open()
+			if err != nil {
+				return fmt.Errorf("error reading %s in %s: %v", entry.Name, name, err)
+			}
+			err = readArtifact(f, entry.Name, add)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case strings.HasSuffix(name, ".ocsf.ndjson"), strings.HasSuffix(name, ".asff.json"):
+		return fmt.Errorf("cannot import %s: OCSF and ASFF exports do not hold GuardDuty findings", name)
+	case strings.HasSuffix(name, ".csv"):
+		return readCSVFindings(r, name, add)
+	case strings.HasSuffix(name, ".json"):
+		var findings []types.Finding
+		if err := json.NewDecoder(r).Decode(&findings); err != nil {
+			return fmt.Errorf("error parsing %s: %v", name, err)
+		}
+		for _, finding := range findings {
+			addImported(finding, add)
+		}
+		return nil
+	case strings.HasSuffix(name, ".ndjson"):
+		decoder := json.NewDecoder(bufio.NewReader(r))
+		for {
+			var finding types.Finding
+			err := decoder.Decode(&finding)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error parsing %s: %v", name, err)
+			}
+			addImported(finding, add)
+		}
+	}
+	return fmt.Errorf("cannot import %s: only csv, json, and ndjson exports can be imported", name)
+}
+
+// addImported passes a finding to add unless it has no ID or is the error
+// record of a failed region
+func addImported(finding types.Finding, add func(types.Finding)) {
+	if id := aws.ToString(finding.Id); id != "" && id != "ERROR" {
+		add(finding)
+	}
+}
+
+// readCSVFindings reads the findings of a CSV export with the default
+// dialect, which must have the FindingId and Region columns. The other
+// default columns that name a field of the finding are read back into it
+// when present.
+func readCSVFindings(r io.Reader, name string, add func(types.Finding)) error {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", name, err)
+	}
+	columns := make(map[string]int)
+	for i, column := range header {
+		// An export written with bom starts with a byte order mark
+		columns[strings.TrimPrefix(column, "\ufeff")] = i
+	}
+	for _, required := range []string{"FindingId", "Region"} {
+		if _, ok := columns[required]; !ok {
+			return fmt.Errorf("cannot import %s: it has no %s column", name, required)
+		}
+	}
+
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", name, err)
+		}
+		addImported(csvFinding(func(column string) string {
+			if i, ok := columns[column]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}), add)
+	}
+}
+
+// csvFinding rebuilds a finding from the cells of a CSV row, by column
+func csvFinding(value func(column string) string) types.Finding {
+	optional := func(column string) *string {
+		if v := value(column); v != "" {
+			return aws.String(v)
+		}
+		return nil
+	}
+	finding := types.Finding{
+		Id:          optional("FindingId"),
+		Region:      optional("Region"),
+		AccountId:   optional("AccountId"),
+		Title:       optional("Title"),
+		Description: optional("Description"),
+		CreatedAt:   optional("CreatedAt"),
+		UpdatedAt:   optional("UpdatedAt"),
+		Type:        optional("FindingType"),
+	}
+	if severity, err := strconv.ParseFloat(value("Severity"), 64); err == nil {
+		finding.Severity = aws.Float64(severity)
+	}
+	service := &types.Service{DetectorId: optional("DetectorId"), ServiceName: aws.String("guardduty")}
+	if count, err := strconv.Atoi(value("Count")); err == nil {
+		service.Count = aws.Int32(int32(count))
+	}
+	if archived, err := strconv.ParseBool(value("Archived")); err == nil {
+		service.Archived = aws.Bool(archived)
+	}
+	if actionType := value("ActionType"); actionType != "" {
+		service.Action = &types.Action{ActionType: aws.String(actionType)}
+	}
+	finding.Service = service
+	if resourceType := value("ResourceType"); resourceType != "" {
+		finding.Resource = csvResource(resourceType, value("ResourceId"))
+	}
+	return finding
+}
+
+// csvResource rebuilds the affected resource of a finding from its
+// ResourceType and ResourceId, the reverse of the ResourceId column
+func csvResource(resourceType, id string) *types.Resource {
+	resource := &types.Resource{ResourceType: aws.String(resourceType)}
+	if id == "" {
+		return resource
+	}
+	switch resourceType {
+	case "Instance":
+		resource.InstanceDetails = &types.InstanceDetails{InstanceId: aws.String(id)}
+	case "AccessKey":
+		resource.AccessKeyDetails = &types.AccessKeyDetails{AccessKeyId: aws.String(id)}
+	case "S3Bucket":
+		for _, name := range strings.Split(id, ", ") {
+			resource.S3BucketDetails = append(resource.S3BucketDetails, types.S3BucketDetail{Name: aws.String(name)})
+		}
+	case "EKSCluster":
+		resource.EksClusterDetails = &types.EksClusterDetails{Name: aws.String(id)}
+	case "ECSCluster":
+		resource.EcsClusterDetails = &types.EcsClusterDetails{Name: aws.String(id)}
+	case "Container":
+		resource.ContainerDetails = &types.Container{Id: aws.String(id)}
+	case "Lambda":
+		resource.LambdaDetails = &types.LambdaDetails{FunctionName: aws.String(id)}
+	case "RDSDBInstance":
+		resource.RdsDbInstanceDetails = &types.RdsDbInstanceDetails{DbInstanceIdentifier: aws.String(id)}
+	}
+	return resource
+}
+
+// storeImported keeps the findings of an import in the findings store. A
+// stored finding is replaced only by a copy updated at or after it, so
+// importing an old export does not undo what later exports stored.
+func (s *findingsStore) storeImported(ctx context.Context, findings []types.Finding) error {
+	for start := 0; start < len(findings); start += importBatch {
+		if err := s.upsertFindings(ctx, findings[start:min(start+importBatch, len(findings))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeWriteOptions reads the format and columns of a merged file, which
+// default to those of exports
+func (a *App) mergeWriteOptions(query url.Values) (export.WriteOptions, error) {
+	opts := export.WriteOptions{Format: a.config().Format, Sanitize: a.config().CSVSanitize, BOM: a.config().CSVBOM}
+	if v := query.Get("format"); v != "" {
+		if !export.ValidFormat(v) || v == "template" {
+			return opts, fmt.Errorf("Unsupported format %q", v)
+		}
+		opts.Format = v
+	}
+	opts.Pretty, _ = strconv.ParseBool(query.Get("pretty"))
+	columns, err := a.fields.ParseColumns(query, a.config().Columns)
+	if err != nil {
+		return opts, err
+	}
+	opts.Columns, opts.Fields = columns, a.fields
+	return opts, nil
+}
+
+// writeMerged writes the findings of set as one export to out
+func writeMerged(ctx context.Context, out io.Writer, opts export.WriteOptions, filename string, set *importSet) error {
+	stream := gd.StreamResults(set.results())
+	defer stream.Close()
+	_, err := export.Write(ctx, out, opts, filename, stream)
+	return err
+}
+
+// importUploads reads the artifacts uploaded as the file fields of a
+// multipart form
+func importUploads(r *http.Request) (*importSet, error) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return nil, fmt.Errorf("Invalid upload, %v", err)
+	}
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		return nil, fmt.Errorf("Missing file: upload one or more exports as file fields")
+	}
+	set := newImportSet()
+	for _, header := range files {
+		file, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = set.read(file, header.Filename)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// handleStoreImport keeps the findings of uploaded exports in the findings
+// store and reports how many were read
+func (a *App) handleStoreImport(w http.ResponseWriter, r *http.Request) {
+	if a.store == nil {
+		http.Error(w, "The findings store is not enabled: set storeFile", http.StatusNotFound)
+		return
+	}
+	set, err := importUploads(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.store.storeImported(r.Context(), set.list()); err != nil {
+		telemetry.Logger(r.Context()).Error("Error importing findings", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	telemetry.Logger(r.Context()).Info("Imported findings", "files", len(set.report.Files), "findings", set.report.Findings, "duplicates", set.report.Duplicates)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(set.report)
+}
+
+// handleMerge merges uploaded exports into one export without duplicates,
+// in the format and columns of the query
+func (a *App) handleMerge(w http.ResponseWriter, r *http.Request) {
+	opts, err := a.mergeWriteOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	set, err := importUploads(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filename := export.Filename(time.Now(), opts.Format)
+	w.Header().Set("Content-Type", export.ContentType(opts.Format, ""))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("X-Export-Findings", strconv.Itoa(set.report.Findings))
+	w.Header().Set("X-Import-Duplicates", strconv.Itoa(set.report.Duplicates))
+	if err := writeMerged(r.Context(), w, opts, filename, set); err != nil {
+		telemetry.Logger(r.Context()).Error("Error writing merged export", "error", err)
+	}
+}
+
+// runImportCommand reads export files from the command line into the
+// findings store, or with -out merges them into one file, and returns the
+// process exit code
+func runImportCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: guardduty import [-out merged.csv] FILE...")
+		fs.PrintDefaults()
+	}
+	out := fs.String("out", "", "merge the files into this export, or - for standard output, instead of keeping them in the findings store")
+	columns := fs.String("columns", "", "comma-separated CSV and XLSX columns of the merged export (default the columns setting)")
+	app, err := loadApp(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *out == "" && app.store == nil {
+		fmt.Fprintln(os.Stderr, "The import command requires storeFile or -store-file, or -out to merge the files")
+		return 2
+	}
+
+	set := newImportSet()
+	for _, path := range fs.Args() {
+		if err := set.readFile(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	ctx := context.Background()
+	log := telemetry.Logger(ctx)
+	if *out == "" {
+		if err := app.store.storeImported(ctx, set.list()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		log.Info("Imported findings", "files", len(set.report.Files), "findings", set.report.Findings, "duplicates", set.report.Duplicates)
+		return 0
+	}
+
+	// The merged export takes the format setting, such as from -format,
+	// or else the format its extension names
+	query := url.Values{}
+	explicit := false
+	fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "format" })
+	if format := formatOfFile(*out); format != "" && !explicit {
+		query.Set("format", format)
+	}
+	if *columns != "" {
+		query.Set("columns", *columns)
+	}
+	opts, err := app.mergeWriteOptions(query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var w io.Writer = os.Stdout
+	filename := export.Filename(time.Now(), opts.Format)
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error creating %s: %v\n", *out, err)
+			return 1
+		}
+		defer file.Close()
+		w, filename = file, filepath.Base(*out)
+	}
+	if err := writeMerged(ctx, w, opts, filename, set); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	log.Info("Merged exports", "files", len(set.report.Files), "findings", set.report.Findings, "duplicates", set.report.Duplicates, "file", *out)
+	return 0
+}
+
+// formatOfFile returns the export format whose extension ends path, the
+// longest such as ocsf for .ocsf.ndjson, or ""
+func formatOfFile(path string) string {
+	match := ""
+	for name, format := range export.Formats {
+		if strings.HasSuffix(path, "."+format.Extension) && (match == "" || len(format.Extension) > len(export.Formats[match].Extension)) {
+			match = name
+		}
+	}
+	return match
+}
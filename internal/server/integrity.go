@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// Sidecar files stored beside each export: its SHA-256 checksum in the
+// format of sha256sum, which sha256sum -c verifies, and its detached
+// signature when signing is on, ASCII-armored for GPG or the raw signature
+// bytes for KMS. Encrypted exports also have a decryption manifest.
+const (
+	checksumSuffix     = ".sha256"
+	gpgSignatureSuffix = ".asc"
+	kmsSignatureSuffix = ".sig"
+)
+
+var sidecarSuffixes = []string{checksumSuffix, gpgSignatureSuffix, kmsSignatureSuffix, decryptionManifestSuffix}
+
+// kmsSigningAlgorithms are the KMS signing algorithms that sign a SHA-256
+// digest, as exports are signed by their checksum
+var kmsSigningAlgorithms = []string{"RSASSA_PSS_SHA_256", "RSASSA_PKCS1_V1_5_SHA_256", "ECDSA_SHA_256"}
+
+const defaultKMSSigningAlgorithm = "RSASSA_PSS_SHA_256"
+
+// signingConfig signs the exports the server stores with a detached
+// signature, made with a GPG private key or an asymmetric KMS key
+type signingConfig struct {
+	// GPGKeyFile is an ASCII-armored OpenPGP private key, decrypted with
+	// GPGPassphrase when it is protected
+	GPGKeyFile    string `yaml:"gpgKeyFile"`
+	GPGPassphrase string `yaml:"gpgPassphrase"`
+	// KMSKeyID is the ID, ARN, or alias of a KMS key with the SIGN_VERIFY
+	// usage, which signs with KMSAlgorithm
+	KMSKeyID     string `yaml:"kmsKeyId"`
+	KMSAlgorithm string `yaml:"kmsAlgorithm"`
+	// KMSRegion is the key's region, by default the SDK region
+	KMSRegion string `yaml:"kmsRegion"`
+}
+
+func (c signingConfig) validate() error {
+	if c.GPGKeyFile != "" && c.KMSKeyID != "" {
+		return fmt.Errorf("invalid signing: gpgKeyFile and kmsKeyId must not both be set")
+	}
+	if c.GPGPassphrase != "" && c.GPGKeyFile == "" {
+		return fmt.Errorf("invalid signing.gpgPassphrase: requires gpgKeyFile")
+	}
+	if !slices.Contains(kmsSigningAlgorithms, c.KMSAlgorithm) {
+		return fmt.Errorf("invalid signing.kmsAlgorithm %q: must be one of %s", c.KMSAlgorithm, strings.Join(kmsSigningAlgorithms, ", "))
+	}
+	return nil
+}
+
+// loadSigningKey reads the GPG key of the signing setting, so a key that
+// cannot sign stops the server from starting rather than failing its
+// exports. It returns nil when the setting has no GPG key.
+func loadSigningKey(c signingConfig) (*openpgp.Entity, error) {
+	if c.GPGKeyFile == "" {
+		return nil, nil
+	}
+	file, err := os.Open(c.GPGKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing.gpgKeyFile: %v", err)
+	}
+	defer file.Close()
+	keys, err := openpgp.ReadArmoredKeyRing(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing.gpgKeyFile %s: %v", c.GPGKeyFile, err)
+	}
+	for _, entity := range keys {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			if err := entity.PrivateKey.Decrypt([]byte(c.GPGPassphrase)); err != nil {
+				return nil, fmt.Errorf("invalid signing.gpgPassphrase: %v", err)
+			}
+		}
+		return entity, nil
+	}
+	return nil, fmt.Errorf("invalid signing.gpgKeyFile %s: holds no private key", c.GPGKeyFile)
+}
+
+// artifactSeal is the checksum and signature of a stored export
+type artifactSeal struct {
+	SHA256 string
+	// Signature is the name of the detached signature file, when signing
+	// is on
+	Signature string
+}
+
+// sealExport writes the sidecar files of the export at path, stored under
+// name: its checksum, its detached signature when signing is configured,
+// and its decryption manifest when it is encrypted. Sidecars left beside
+// path by an earlier export are replaced.
+func (a *App) sealExport(ctx context.Context, path, name string) (artifactSeal, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return artifactSeal{}, fmt.Errorf("error reading export: %v", err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return artifactSeal{}, fmt.Errorf("error reading export: %v", err)
+	}
+	digest := hash.Sum(nil)
+	seal := artifactSeal{SHA256: hex.EncodeToString(digest)}
+	if err := os.WriteFile(path+checksumSuffix, []byte(seal.SHA256+"  "+name+"\n"), 0o644); err != nil {
+		return artifactSeal{}, fmt.Errorf("error writing checksum: %v", err)
+	}
+	if a.config().Encryption.enabled() {
+		if err := a.writeDecryptionManifest(path, name, seal.SHA256); err != nil {
+			return artifactSeal{}, err
+		}
+	} else if err := os.Remove(path + decryptionManifestSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return artifactSeal{}, fmt.Errorf("error removing decryption manifest: %v", err)
+	}
+
+	var signature []byte
+	var suffix string
+	switch {
+	case a.signingKey != nil:
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return artifactSeal{}, fmt.Errorf("error reading export: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := openpgp.ArmoredDetachSign(&buf, a.signingKey, file, nil); err != nil {
+			return artifactSeal{}, fmt.Errorf("error signing export: %v", err)
+		}
+		signature, suffix = buf.Bytes(), gpgSignatureSuffix
+	case a.config().Signing.KMSKeyID != "":
+		if signature, err = a.signKMS(ctx, digest); err != nil {
+			return artifactSeal{}, err
+		}
+		suffix = kmsSignatureSuffix
+	}
+	for _, stale := range []string{gpgSignatureSuffix, kmsSignatureSuffix} {
+		if stale != suffix {
+			if err := os.Remove(path + stale); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return artifactSeal{}, fmt.Errorf("error removing signature: %v", err)
+			}
+		}
+	}
+	if suffix == "" {
+		return seal, nil
+	}
+	if err := os.WriteFile(path+suffix, signature, 0o644); err != nil {
+		return artifactSeal{}, fmt.Errorf("error writing signature: %v", err)
+	}
+	seal.Signature = name + suffix
+	return seal, nil
+}
+
+// removeExportFile deletes an export that sealExport wrote sidecars for,
+// with its sidecars
+func removeExportFile(path string) {
+	os.Remove(path)
+	for _, suffix := range sidecarSuffixes {
+		os.Remove(path + suffix)
+	}
+}
+
+// isSidecar reports whether name is a sidecar file of an export
+func isSidecar(name string) bool {
+	return slices.ContainsFunc(sidecarSuffixes, func(suffix string) bool { return strings.HasSuffix(name, suffix) })
+}
+
+// sidecarContentType returns the media type of a checksum, signature, or
+// decryption manifest
+func sidecarContentType(name string) string {
+	switch {
+	case strings.HasSuffix(name, checksumSuffix):
+		return "text/plain; charset=utf-8"
+	case strings.HasSuffix(name, gpgSignatureSuffix):
+		return "application/pgp-signature"
+	case strings.HasSuffix(name, decryptionManifestSuffix):
+		return "application/json"
+	}
+	return "application/octet-stream"
+}
+
+// signKMS signs a SHA-256 digest with the KMS key of the signing setting
+func (a *App) signKMS(ctx context.Context, digest []byte) ([]byte, error) {
+	conf := a.config().Signing
+	input := map[string]any{
+		"KeyId":            conf.KMSKeyID,
+		"Message":          digest,
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": conf.KMSAlgorithm,
+	}
+	var output struct {
+		Signature []byte `json:"Signature"`
+	}
+	if err := a.callKMS(ctx, conf.KMSRegion, "Sign", input, &output); err != nil {
+		return nil, fmt.Errorf("error signing export with KMS: %v", err)
+	}
+	if len(output.Signature) == 0 {
+		return nil, fmt.Errorf("error signing export with KMS: no signature returned")
+	}
+	return output.Signature, nil
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// Defaults and limits of Jira issue filing
+const (
+	defaultJiraIssueType   = "Task"
+	defaultJiraMinSeverity = 7
+	// jiraSearchBatch is the number of findings whose issues are looked up
+	// per search
+	jiraSearchBatch = 50
+	// jiraLabelPrefix starts the label that ties an issue to its finding
+	jiraLabelPrefix   = "guardduty-"
+	maxJiraSummary    = 255
+	jiraMaxResponse   = 64 << 10
+	jiraRequestPrefix = "/rest/api/2"
+)
+
+// jiraConfig selects the Jira project that exports asking for it file
+// issues in, one per finding at or above MinSeverity. Each issue carries a
+// label naming its finding, so a finding exported again updates its issue
+// instead of filing another.
+type jiraConfig struct {
+	// URL is the site's base URL, such as https://example.atlassian.net
+	URL string `yaml:"url"`
+	// Username and Token sign in with basic auth, as a Jira Cloud account's
+	// email and API token; a Token alone is sent as a Data Center personal
+	// access token
+	Username  string `yaml:"username"`
+	Token     string `yaml:"token"`
+	Project   string `yaml:"project"`
+	IssueType string `yaml:"issueType"`
+	// MinSeverity is the lowest GuardDuty severity that files an issue,
+	// 7 (High) by default
+	MinSeverity float64 `yaml:"minSeverity"`
+	// Labels are added to new issues alongside the finding's own label
+	Labels []string `yaml:"labels"`
+	// Priorities maps severity labels to the names of Jira priorities;
+	// issues of a label without one get the project's default priority
+	Priorities map[string]string `yaml:"priorities"`
+	// Fields maps Jira fields, such as customfield_10042, to the export
+	// columns whose values fill them; the fields must take text
+	Fields map[string]string `yaml:"fields"`
+	// Retries is the number of times a throttled or failed request is
+	// retried
+	Retries int `yaml:"retries"`
+}
+
+// enabled reports whether exports can file Jira issues
+func (c jiraConfig) enabled() bool {
+	return c.URL != ""
+}
+
+// validate reports the first invalid setting. The columns of fields are
+// accepted as the mapped fields' columns.
+func (c jiraConfig) validate(fields export.Fields) error {
+	if !c.enabled() {
+		return nil
+	}
+	if err := validateEndpoint("jira.url", c.URL); err != nil {
+		return err
+	}
+	if c.Token == "" {
+		return fmt.Errorf("jira.url requires jira.token")
+	}
+	if c.Project == "" {
+		return fmt.Errorf("jira.url requires jira.project")
+	}
+	if c.IssueType == "" {
+		return fmt.Errorf("invalid jira.issueType: must not be empty")
+	}
+	if c.MinSeverity < 0 || c.MinSeverity > 10 {
+		return fmt.Errorf("invalid jira.minSeverity %v: must be between 0 and 10", c.MinSeverity)
+	}
+	for _, label := range c.Labels {
+		if label == "" || strings.ContainsAny(label, " \t\r\n") {
+			return fmt.Errorf("invalid jira.labels %q: labels cannot be empty or contain spaces", label)
+		}
+	}
+	for severity := range c.Priorities {
+		if !slices.Contains(gd.SeverityLabels, severity) {
+			return fmt.Errorf("invalid jira.priorities severity %q: must be one of %s", severity, strings.Join(gd.SeverityLabels, ", "))
+		}
+	}
+	for field, column := range c.Fields {
+		if field == "" {
+			return fmt.Errorf("invalid jira.fields: field names cannot be empty")
+		}
+		if err := fields.ValidColumn(column); err != nil {
+			return fmt.Errorf("invalid jira.fields column %q: %v", column, err)
+		}
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("invalid jira.retries %d: must not be negative", c.Retries)
+	}
+	return nil
+}
+
+// searchPath is the path of the site's JQL search. Jira Cloud has replaced
+// the search of version 2 of its API with one of its own.
+func (c jiraConfig) searchPath() string {
+	if u, err := url.Parse(c.URL); err == nil && strings.HasSuffix(u.Hostname(), ".atlassian.net") {
+		return "/rest/api/3/search/jql"
+	}
+	return jiraRequestPrefix + "/search"
+}
+
+// fileIssues files a Jira issue for each exported finding at or above the
+// configured severity, or updates the issue already filed for it. A finding
+// whose issue cannot be filed is logged and the others are still filed, but
+// a failed search stops the filing, since filing without it could file
+// duplicate issues.
+func (a *App) fileIssues(ctx context.Context, results []gd.RegionResult) {
+	log := telemetry.Logger(ctx)
+	var findings []types.Finding
+	seen := make(map[string]bool)
+	for _, result := range results {
+		for _, finding := range result.Ticketed {
+			id := aws.ToString(finding.Id)
+			if id != "" && !seen[id] {
+				seen[id] = true
+				findings = append(findings, finding)
+			}
+		}
+	}
+	if len(findings) == 0 {
+		return
+	}
+
+	var created, updated, failed int
+	for start := 0; start < len(findings); start += jiraSearchBatch {
+		batch := findings[start:min(start+jiraSearchBatch, len(findings))]
+		issues, err := a.findIssues(ctx, batch)
+		if err != nil {
+			log.Error("Error searching Jira issues", "error", err)
+			failed += len(findings) - start
+			break
+		}
+		for _, finding := range batch {
+			key, filed := issues[aws.ToString(finding.Id)]
+			if filed {
+				err = a.updateIssue(ctx, key, finding)
+			} else {
+				key, err = a.createIssue(ctx, finding)
+			}
+			switch {
+			case err != nil:
+				log.Error("Error filing Jira issue", "finding_id", aws.ToString(finding.Id), "error", err)
+				failed++
+			case filed:
+				updated++
+			default:
+				created++
+			}
+		}
+	}
+	log.Info("Filed Jira issues", "created", created, "updated", updated, "failed", failed, "project", a.config().Jira.Project)
+}
+
+// issueLabel is the label that ties an issue to a finding
+func issueLabel(findingID string) string {
+	return jiraLabelPrefix + findingID
+}
+
+// findIssues returns the keys of the issues already filed for findings,
+// keyed by finding ID
+func (a *App) findIssues(ctx context.Context, findings []types.Finding) (map[string]string, error) {
+	labels := make([]string, len(findings))
+	for i, finding := range findings {
+		labels[i] = strconv.Quote(issueLabel(aws.ToString(finding.Id)))
+	}
+	search := map[string]any{
+		"jql":        fmt.Sprintf("project = %s AND labels in (%s)", strconv.Quote(a.config().Jira.Project), strings.Join(labels, ", ")),
+		"fields":     []string{"labels"},
+		"maxResults": 2 * len(findings),
+	}
+	var found struct {
+		Issues []struct {
+			Key    string `json:"key"`
+			Fields struct {
+				Labels []string `json:"labels"`
+			} `json:"fields"`
+		} `json:"issues"`
+	}
+	if err := a.jiraRequest(ctx, http.MethodPost, a.config().Jira.searchPath(), search, &found); err != nil {
+		return nil, err
+	}
+	issues := make(map[string]string)
+	for _, issue := range found.Issues {
+		for _, label := range issue.Fields.Labels {
+			if id, ok := strings.CutPrefix(label, jiraLabelPrefix); ok {
+				// Of duplicate issues, the first found is kept up to date
+				if _, seen := issues[id]; !seen {
+					issues[id] = issue.Key
+				}
+			}
+		}
+	}
+	return issues, nil
+}
+
+// createIssue files an issue for a finding and returns its key
+func (a *App) createIssue(ctx context.Context, finding types.Finding) (string, error) {
+	conf := a.config().Jira
+	fields := a.issueFields(finding)
+	fields["project"] = map[string]string{"key": conf.Project}
+	fields["issuetype"] = map[string]string{"name": conf.IssueType}
+	fields["labels"] = append(append([]string{}, conf.Labels...), issueLabel(aws.ToString(finding.Id)))
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := a.jiraRequest(ctx, http.MethodPost, jiraRequestPrefix+"/issue", map[string]any{"fields": fields}, &created); err != nil {
+		return "", err
+	}
+	return created.Key, nil
+}
+
+// updateIssue brings an issue filed for a finding up to date, leaving its
+// status, assignee, and labels as they are
+func (a *App) updateIssue(ctx context.Context, key string, finding types.Finding) error {
+	return a.jiraRequest(ctx, http.MethodPut, jiraRequestPrefix+"/issue/"+url.PathEscape(key), map[string]any{"fields": a.issueFields(finding)}, nil)
+}
+
+// issueFields are the fields of a finding's issue that follow the finding:
+// its summary, description, priority, and mapped fields
+func (a *App) issueFields(finding types.Finding) map[string]any {
+	conf := a.config().Jira
+	summary := "GuardDuty: " + aws.ToString(finding.Title)
+	if len(summary) > maxJiraSummary {
+		summary = strings.ToValidUTF8(summary[:maxJiraSummary], "")
+	}
+	fields := map[string]any{
+		"summary":     summary,
+		"description": issueDescription(finding),
+	}
+	if priority := conf.Priorities[gd.SeverityLabel(aws.ToFloat64(finding.Severity))]; priority != "" {
+		fields["priority"] = map[string]string{"name": priority}
+	}
+	// Mapped fields read the resource states exports looked up and the
+	// server's own columns
+	columns := export.WriteOptions{States: a.states, Fields: a.fields}
+	for field, column := range conf.Fields {
+		fields[field] = columns.ColumnValue(finding, column)
+	}
+	return fields
+}
+
+// jiraEscaper keeps finding text from being read as wiki markup
+var jiraEscaper = strings.NewReplacer(`\`, `\\`, `{`, `\{`, `}`, `\}`, `[`, `\[`, `]`, `\]`, `|`, `\|`, `*`, `\*`, `_`, `\_`)
+
+// issueDescription describes a finding in Jira wiki markup: a table of its
+// details, its description, and a link to it in the GuardDuty console
+func issueDescription(finding types.Finding) string {
+	rows := [][2]string{
+		{"Finding ID", aws.ToString(finding.Id)},
+		{"Type", aws.ToString(finding.Type)},
+		{"Severity", export.ColumnValue(finding, "Severity") + " (" + export.ColumnValue(finding, "SeverityLabel") + ")"},
+		{"Account", aws.ToString(finding.AccountId)},
+		{"Region", aws.ToString(finding.Region)},
+		{"Resource", strings.TrimSpace(export.ColumnValue(finding, "ResourceType") + " " + export.ColumnValue(finding, "ResourceId"))},
+		{"Actor IP", export.ColumnValue(finding, "ActorIp")},
+		{"First seen", export.ColumnValue(finding, "Service.EventFirstSeen")},
+		{"Last seen", export.ColumnValue(finding, "Service.EventLastSeen")},
+		{"Count", export.ColumnValue(finding, "Service.Count")},
+	}
+	var b strings.Builder
+	b.WriteString("||Field||Value||\n")
+	for _, row := range rows {
+		if row[1] != "" {
+			fmt.Fprintf(&b, "|%s|%s|\n", row[0], jiraEscaper.Replace(row[1]))
+		}
+	}
+	if description := aws.ToString(finding.Description); description != "" {
+		b.WriteString("\n" + jiraEscaper.Replace(description) + "\n")
+	}
+	consoleURL := gd.ConsoleURL(aws.ToString(finding.Partition), aws.ToString(finding.Region), aws.ToString(finding.Id))
+	fmt.Fprintf(&b, "\n[View in the GuardDuty console|%s]\n", consoleURL)
+	return b.String()
+}
+
+// jiraRequest sends a request to the site's REST API, retrying throttled
+// and failed requests, and decodes the response into out unless it is nil
+func (a *App) jiraRequest(ctx context.Context, method, path string, body, out any) error {
+	conf := a.config().Jira
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("error encoding Jira request: %v", err)
+	}
+	return a.retryRequest(ctx, "jira", conf.Retries, func() (bool, error) {
+		ctx, cancel := context.WithTimeout(ctx, siemRequestTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(conf.URL, "/")+path, bytes.NewReader(data))
+		if err != nil {
+			return false, fmt.Errorf("error sending Jira request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		if conf.Username != "" {
+			req.SetBasicAuth(conf.Username, conf.Token)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+conf.Token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return true, fmt.Errorf("error sending Jira request: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return retryableStatus(resp.StatusCode), jiraError(resp)
+		}
+		if out == nil {
+			return false, nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return false, fmt.Errorf("error reading Jira response: %v", err)
+		}
+		return false, nil
+	})
+}
+
+// jiraError describes a failed request from the site's error response,
+// {"errorMessages": [...], "errors": {field: message}}, or its body
+func jiraError(resp *http.Response) error {
+	var failure struct {
+		ErrorMessages []string          `json:"errorMessages"`
+		Errors        map[string]string `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, jiraMaxResponse))
+	message := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &failure) == nil && (len(failure.ErrorMessages) > 0 || len(failure.Errors) > 0) {
+		messages := failure.ErrorMessages
+		fields := make([]string, 0, len(failure.Errors))
+		for field := range failure.Errors {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			messages = append(messages, field+": "+failure.Errors[field])
+		}
+		message = strings.Join(messages, "; ")
+	}
+	return fmt.Errorf("error from Jira: %s: %s", resp.Status, message)
+}
@@ -0,0 +1,978 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// jobStatus is the lifecycle state of an export job
+type jobStatus string
+
+const (
+	jobQueued    jobStatus = "queued"
+	jobRunning   jobStatus = "running"
+	jobSucceeded jobStatus = "succeeded"
+	jobFailed    jobStatus = "failed"
+	jobCanceled  jobStatus = "canceled"
+)
+
+// finished reports whether a job in this state has stopped
+func (s jobStatus) finished() bool {
+	return s != jobQueued && s != jobRunning
+}
+
+// Job is an export running in the background. The artifact is written to a
+// temporary file that is served by the download endpoint, and uploaded to S3
+// when the job's destination includes it.
+type Job struct {
+	mu sync.Mutex
+
+	id            string
+	opts          exportOptions
+	schedule      string
+	status        jobStatus
+	err           string
+	currentRegion string
+	activeRegions map[string]struct{}
+	skipped       map[string]string
+	failed        map[string]string
+	succeeded     []string
+	regionsDone   int
+	findings      int
+	throttles     int
+	// queuePosition is the job's place in the queue while it waits, 1 for
+	// the next to start
+	queuePosition int
+	createdAt     time.Time
+	startedAt     time.Time
+	finishedAt    time.Time
+	filename      string
+	path          string
+	upload        s3Upload
+	archive       *gd.ArchiveReport
+	truncation    *gd.Truncation
+	// emailedTo lists the recipients the export was emailed to, and
+	// emailError why emailing it failed
+	emailedTo  []string
+	emailError string
+	// pushedTo is where the findings of an export to a SIEM destination
+	// were sent
+	pushedTo string
+	// results are the outcomes of the job's regions, and summary the
+	// end-of-run report of the export, once it has finished
+	results []gd.RegionResult
+	summary *gd.ExportSummary
+	// size, seal, and contentType describe the file the job wrote, when it
+	// wrote one
+	size        int64
+	seal        artifactSeal
+	contentType string
+	// aggregator counts the job's findings as they are fetched, for its
+	// dashboard
+	aggregator *export.Aggregator
+	// pace measures the job's throughput for its completion estimate
+	pace jobPace
+	// credentialsExpired is set when the job failed because the credentials
+	// of its profile expired
+	credentialsExpired bool
+	// resumedBy is the job that resumed this failed one from its
+	// checkpoint, which moved to it
+	resumedBy   string
+	cancel      context.CancelFunc
+	subscribers map[chan gd.Event]struct{}
+}
+
+// jobView is the JSON representation of a job returned by the API
+type jobView struct {
+	ID     string    `json:"id"`
+	Status jobStatus `json:"status"`
+	// Schedule is the ID of the schedule that started the job
+	Schedule string `json:"schedule,omitempty"`
+	// User is who started the job, such as "oidc alice@example.com", when
+	// authentication is on
+	User  string `json:"user,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Preset is the preset the export's parameters were filled in from
+	Preset string `json:"preset,omitempty"`
+	// Profile is the shared config profile the export used, if any
+	Profile       string   `json:"profile,omitempty"`
+	Regions       []string `json:"regions"`
+	CurrentRegion string   `json:"currentRegion,omitempty"`
+	// ActiveRegions and SkippedRegions are keyed by region, prefixed with
+	// the account ID when roles are assumed
+	ActiveRegions []string `json:"activeRegions,omitempty"`
+	// SkippedRegions maps regions that were not queried to the reason why
+	SkippedRegions map[string]string `json:"skippedRegions,omitempty"`
+	// SucceededRegions have been exported, and FailedRegions maps the regions
+	// that failed to their errors
+	SucceededRegions []string          `json:"succeededRegions,omitempty"`
+	FailedRegions    map[string]string `json:"failedRegions,omitempty"`
+	RegionsDone      int               `json:"regionsDone"`
+	RegionsTotal     int               `json:"regionsTotal"`
+	Findings         int               `json:"findings"`
+	// FindingsPerSecond, EstimatedFindings, and EstimatedCompletion are the
+	// pace of a running job, as in its progress events; AveragePageLatency
+	// is the mean time its pages took to fetch
+	FindingsPerSecond   float64    `json:"findingsPerSecond,omitempty"`
+	EstimatedFindings   int        `json:"estimatedFindings,omitempty"`
+	EstimatedCompletion *time.Time `json:"estimatedCompletion,omitempty"`
+	AveragePageLatency  int64      `json:"averagePageLatencyMs,omitempty"`
+	// QueuePosition is the place in line of a queued job, 1 for the next
+	// to start
+	QueuePosition int        `json:"queuePosition,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	StartedAt     *time.Time `json:"startedAt,omitempty"`
+	FinishedAt    *time.Time `json:"finishedAt,omitempty"`
+	Filename      string     `json:"filename,omitempty"`
+	// S3URI and DownloadURL are set when the export was uploaded to S3
+	S3URI        string     `json:"s3Uri,omitempty"`
+	DownloadURL  string     `json:"downloadUrl,omitempty"`
+	URLExpiresAt *time.Time `json:"urlExpiresAt,omitempty"`
+	// Partitioned is set for partitioned Parquet and CSV exports, which are not
+	// downloadable and are found at S3URI
+	Partitioned bool `json:"partitioned,omitempty"`
+	// PushedTo is where the findings were sent by an export to the splunk
+	// or elasticsearch destination, which has nothing to download
+	PushedTo string `json:"pushedTo,omitempty"`
+	// Archive reports the findings archived after the export, when requested
+	Archive *gd.ArchiveReport `json:"archive,omitempty"`
+	// Truncation is set when the export's limits stopped it early; the job
+	// still succeeds with the findings written before the limit
+	Truncation *gd.Truncation `json:"truncation,omitempty"`
+	// CredentialsExpired is set when the job failed because the profile's
+	// credentials expired and the user must sign in again
+	CredentialsExpired bool `json:"credentialsExpired,omitempty"`
+	// Resumable is set on a failed job with a checkpoint to resume from;
+	// ResumeOf is the failed job a job resumes, and ResumedBy the job that
+	// resumed a failed one
+	Resumable bool   `json:"resumable,omitempty"`
+	ResumeOf  string `json:"resumeOf,omitempty"`
+	ResumedBy string `json:"resumedBy,omitempty"`
+	// Throttles counts the attempts of API calls that AWS throttled
+	Throttles int `json:"throttles,omitempty"`
+	// EmailedTo lists the recipients of an emailed export, and EmailError
+	// is set when it could not be sent; the job still succeeds, since the
+	// export was stored
+	EmailedTo  []string `json:"emailedTo,omitempty"`
+	EmailError string   `json:"emailError,omitempty"`
+	// Summary is the end-of-run report of a finished job
+	Summary *jobSummary `json:"summary,omitempty"`
+}
+
+// jobSummary is the end-of-run report of a job: the findings, pages, and API
+// calls of the export and of each of its regions, and what it produced
+type jobSummary struct {
+	gd.ExportSummary
+	Artifact *artifactView `json:"artifact,omitempty"`
+}
+
+// artifactView describes what a job's export produced: the file it wrote,
+// where it was uploaded, or where its findings were sent
+type artifactView struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Bytes       int64  `json:"bytes,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	S3URI       string `json:"s3Uri,omitempty"`
+	PushedTo    string `json:"pushedTo,omitempty"`
+	// Signature names the detached signature of the file, when signing is
+	// on, which /jobs/{id}/signature downloads
+	Signature string `json:"signature,omitempty"`
+}
+
+// view returns a consistent snapshot of the job for the API
+func (j *Job) view() jobView {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	v := jobView{
+		ID:            j.id,
+		Status:        j.status,
+		Schedule:      j.schedule,
+		User:          j.opts.user,
+		Error:         j.err,
+		Preset:        j.opts.preset,
+		Profile:       j.opts.Profile,
+		Regions:       j.opts.Regions,
+		CurrentRegion: j.currentRegion,
+		RegionsDone:   j.regionsDone,
+		RegionsTotal:  j.opts.TargetCount(),
+		Findings:      j.findings,
+		Throttles:     j.throttles,
+		QueuePosition: j.queuePosition,
+		CreatedAt:     j.createdAt,
+		Filename:      j.filename,
+		EmailedTo:     j.emailedTo,
+		EmailError:    j.emailError,
+	}
+	if j.status == jobRunning {
+		v.FindingsPerSecond, v.EstimatedFindings, v.EstimatedCompletion = j.pace.current(time.Now(), j.findings)
+	}
+	v.AveragePageLatency = j.pace.averageLatency()
+	if len(j.skipped) > 0 {
+		v.SkippedRegions = make(map[string]string, len(j.skipped))
+		for region, reason := range j.skipped {
+			v.SkippedRegions[region] = reason
+		}
+	}
+	if len(j.failed) > 0 {
+		v.FailedRegions = make(map[string]string, len(j.failed))
+		for region, err := range j.failed {
+			v.FailedRegions[region] = err
+		}
+	}
+	v.SucceededRegions = append([]string(nil), j.succeeded...)
+	sort.Strings(v.SucceededRegions)
+	for label := range j.activeRegions {
+		v.ActiveRegions = append(v.ActiveRegions, label)
+	}
+	sort.Strings(v.ActiveRegions)
+	if j.upload.key != "" {
+		v.S3URI = j.upload.uri()
+	}
+	if j.upload.url != "" {
+		expiresAt := j.upload.expiresAt
+		v.DownloadURL = j.upload.url
+		v.URLExpiresAt = &expiresAt
+	}
+	v.Partitioned = j.opts.partition
+	v.PushedTo = j.pushedTo
+	v.Archive = j.archive
+	v.Truncation = j.truncation
+	v.CredentialsExpired = j.credentialsExpired
+	v.Resumable = j.status == jobFailed && j.opts.Checkpoint != nil
+	v.ResumeOf = j.opts.resumeOf
+	v.ResumedBy = j.resumedBy
+	if !j.startedAt.IsZero() {
+		startedAt := j.startedAt
+		v.StartedAt = &startedAt
+	}
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		v.FinishedAt = &finishedAt
+	}
+	if j.summary != nil {
+		v.Summary = &jobSummary{ExportSummary: *j.summary}
+		if j.status == jobSucceeded {
+			v.Summary.Artifact = &artifactView{Filename: j.filename, Bytes: j.size, SHA256: j.seal.SHA256, Signature: j.seal.Signature, S3URI: v.S3URI, PushedTo: j.pushedTo}
+			if j.filename != "" {
+				v.Summary.Artifact.ContentType = j.contentType
+			}
+		}
+	}
+	return v
+}
+
+// queued records the job's place in the queue, telling subscribers when it
+// changes
+func (j *Job) queued(position int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.queuePosition == position {
+		return
+	}
+	j.queuePosition = position
+	j.publish(gd.Event{Type: gd.EventQueued, QueuePosition: position})
+}
+
+// start marks a queued job as running
+func (j *Job) start() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = jobRunning
+	j.queuePosition = 0
+	j.startedAt = time.Now()
+}
+
+// progress updates the job's counters from a fetcher event and forwards the
+// event, with the running totals filled in, to every subscriber
+func (j *Job) progress(event gd.Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	label := gd.TargetLabel(event.Account, event.Region)
+	switch event.Type {
+	case gd.EventRegionStarted:
+		if j.activeRegions == nil {
+			j.activeRegions = make(map[string]struct{})
+		}
+		j.activeRegions[label] = struct{}{}
+		j.currentRegion = label
+	case gd.EventDetectorStarted:
+		j.currentRegion = label
+	case gd.EventPageFetched:
+		j.currentRegion = label
+		j.findings += event.PageFindings
+		// Pages replayed from a checkpoint have no detector
+		j.pace.page(time.Now(), j.findings, event.Detector != "", time.Duration(event.PageLatency)*time.Millisecond)
+	case gd.EventThrottled:
+		j.throttles++
+	case gd.EventRegionDone:
+		delete(j.activeRegions, label)
+		j.regionsDone++
+		switch {
+		case event.Skipped != "":
+			if j.skipped == nil {
+				j.skipped = make(map[string]string)
+			}
+			j.skipped[label] = event.Skipped
+		case event.Error != "":
+			if j.failed == nil {
+				j.failed = make(map[string]string)
+			}
+			j.failed[label] = event.Error
+		default:
+			j.succeeded = append(j.succeeded, label)
+		}
+	}
+	j.publish(event)
+}
+
+// publish fills in the totals of event and sends it to subscribers. Slow
+// subscribers miss events rather than stalling the export. j.mu must be held.
+func (j *Job) publish(event gd.Event) {
+	event.Findings = j.findings
+	event.RegionsDone = j.regionsDone
+	event.RegionsTotal = j.opts.TargetCount()
+	event.Throttles = j.throttles
+	if j.status == jobRunning {
+		event.FindingsPerSecond, event.EstimatedFindings, event.EstimatedCompletion = j.pace.current(time.Now(), j.findings)
+	}
+	for ch := range j.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel of progress events for the job and a function
+// that stops the subscription. The channel is closed once the job finishes.
+func (j *Job) subscribe() (<-chan gd.Event, func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ch := make(chan gd.Event, 64)
+	if j.status.finished() {
+		close(ch)
+		return ch, func() {}
+	}
+	if j.subscribers == nil {
+		j.subscribers = make(map[chan gd.Event]struct{})
+	}
+	j.subscribers[ch] = struct{}{}
+	return ch, func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if _, ok := j.subscribers[ch]; ok {
+			delete(j.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// finish records the final state of a job, sends a done event, and closes
+// all subscriptions
+func (j *Job) finish(status jobStatus, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = status
+	if err != nil {
+		j.err = err.Error()
+	}
+	j.finishedAt = time.Now()
+	j.currentRegion = ""
+	j.queuePosition = 0
+
+	telemetry.JobDuration.Observe(j.finishedAt.Sub(j.createdAt).Seconds(), string(status))
+	switch status {
+	case jobFailed:
+		telemetry.ExportsFailed.Inc()
+	case jobCanceled:
+		telemetry.ExportsCanceled.Inc()
+	}
+
+	j.publish(gd.Event{Type: gd.EventDone, Status: string(status), Error: j.err})
+	for ch := range j.subscribers {
+		close(ch)
+	}
+	j.subscribers = nil
+}
+
+// jobManager tracks export jobs by ID. running counts the jobs whose
+// export has not returned, so shutdown can wait for them.
+type jobManager struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	running sync.WaitGroup
+}
+
+func newJobManager() *jobManager {
+	return &jobManager{jobs: make(map[string]*Job)}
+}
+
+func (m *jobManager) add(job *Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[job.id] = job
+}
+
+func (m *jobManager) get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+func (m *jobManager) remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.jobs, id)
+}
+
+// finishedBefore returns the jobs that finished before cutoff
+func (m *jobManager) finishedBefore(cutoff time.Time) []*Job {
+	m.mu.Lock()
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	m.mu.Unlock()
+
+	var finished []*Job
+	for _, job := range jobs {
+		job.mu.Lock()
+		if job.status.finished() && job.finishedAt.Before(cutoff) {
+			finished = append(finished, job)
+		}
+		job.mu.Unlock()
+	}
+	return finished
+}
+
+// countRunning returns the number of jobs whose export has started and not
+// finished
+func (m *jobManager) countRunning() int {
+	m.mu.Lock()
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	m.mu.Unlock()
+
+	running := 0
+	for _, job := range jobs {
+		job.mu.Lock()
+		if job.status == jobRunning {
+			running++
+		}
+		job.mu.Unlock()
+	}
+	return running
+}
+
+// drain waits for running jobs to finish until ctx is done, then cancels
+// the jobs still running and waits for them to stop
+func (m *jobManager) drain(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	m.mu.Lock()
+	for _, job := range m.jobs {
+		job.cancel()
+	}
+	m.mu.Unlock()
+	<-done
+}
+
+// newJobID returns a random identifier for a job
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// handleCreateJob starts an export in the background and returns its job ID
+func (a *App) handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	opts, err := a.parseExportOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.dryRun {
+		http.Error(w, "Dry runs are answered by GET /api/export and cannot run as jobs", http.StatusBadRequest)
+		return
+	}
+	if opts.report != "" {
+		http.Error(w, fmt.Sprintf("The %s report is answered by GET /api/export and cannot run as a job", opts.report), http.StatusBadRequest)
+		return
+	}
+	if err := gd.ResolveRegions(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+	if err := gd.ResolveAccounts(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+
+	job := a.startJob(opts, "")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", a.path("/api/jobs/"+job.id))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.view())
+}
+
+// startJob starts a background export with resolved options. schedule is
+// the ID of the schedule that started the job, if any. The job checkpoints
+// its progress when checkpointing is on, unless it resumes the checkpoint of
+// another.
+func (a *App) startJob(opts exportOptions, schedule string) *Job {
+	// The job outlives the request, so its context is not derived from it
+	ctx, cancel := context.WithCancel(context.Background())
+	id := newJobID()
+	if opts.Checkpoint == nil {
+		opts.Checkpoint = a.openCheckpoint(id)
+	}
+	job := &Job{
+		id:         id,
+		opts:       opts,
+		schedule:   schedule,
+		status:     jobQueued,
+		createdAt:  time.Now(),
+		aggregator: export.NewAggregator(),
+		cancel:     cancel,
+	}
+	// Everything the job logs carries its ID, and the schedule that started it
+	log := slog.Default().With("job_id", job.id)
+	if schedule != "" {
+		log = log.With("schedule_id", schedule)
+	}
+	if opts.user != "" {
+		log = log.With("principal", opts.user)
+	}
+	ctx = telemetry.WithLogger(ctx, log)
+
+	a.jobs.add(job)
+	telemetry.ExportsStarted.Inc()
+	a.jobs.running.Add(1)
+	log.Info("Queued export job", "regions", opts.Regions)
+	entry := a.queue.add(job)
+	go func() {
+		defer a.jobs.running.Done()
+		ctx, span := telemetry.StartSpan(ctx, "export job", "job_id", job.id, "regions", len(opts.Regions), "format", opts.Format)
+		if schedule != "" {
+			span.Set("schedule_id", schedule)
+		}
+		run := newRun(runSourceJob, opts)
+		run.JobID, run.Schedule, run.StartedAt = job.id, schedule, job.createdAt
+		if schedule != "" {
+			run.Source = runSourceSchedule
+		}
+		if err := a.queue.wait(ctx, entry); err != nil {
+			log.Info("Export job canceled while queued")
+			job.finish(jobCanceled, nil)
+		} else {
+			log.Info("Started export job")
+			a.runJob(ctx, job)
+			a.queue.release(entry)
+		}
+		view := job.view()
+		// Only a failed job keeps its checkpoint, to be resumed
+		if view.Status != jobFailed {
+			a.removeCheckpoint(ctx, opts.Checkpoint)
+		}
+		job.mu.Lock()
+		run.finish(view.Status, view.Error, job.results)
+		run.Truncation = view.Truncation
+		job.mu.Unlock()
+		a.recordRun(ctx, run)
+		if schedule != "" {
+			// The schedule's history now has the job's outcome
+			a.saveSchedules(ctx)
+		}
+		a.notifyJob(ctx, job, view)
+		span.Set("status", string(view.Status), "findings", view.Findings)
+		if view.Status != jobSucceeded {
+			span.Finish(fmt.Errorf("job %s: %s", view.Status, view.Error))
+			return
+		}
+		span.Finish(nil)
+	}()
+	return job
+}
+
+// runJob fetches the findings for a job and writes its artifact as they
+// arrive
+func (a *App) runJob(ctx context.Context, job *Job) {
+	defer job.cancel()
+	log := telemetry.Logger(ctx)
+	start := time.Now()
+	// Jobs stage their export in the temporary directory
+	if err := a.checkPreflight(ctx, &job.opts, a.storedDestination(job.opts, os.TempDir())); err != nil {
+		log.Warn("Export job stopped by its preflight", "error", err)
+		job.finish(jobFailed, err)
+		return
+	}
+
+	// The aggregator is the job's own, so it is not copied into the options
+	// of the jobs rerunning or resuming this one
+	fetchOpts := job.opts.FetchOptions
+	fetchOpts.Enrichers = append(slices.Clip(fetchOpts.Enrichers), job.aggregator)
+	// Incremental exports have no estimate, as the findings counted would
+	// not be limited to those updated since the watermarks
+	if len(fetchOpts.Watermarks) == 0 {
+		go job.estimate(ctx, job.opts.FetchOptions)
+	}
+	stream := gd.StreamRegions(ctx, fetchOpts, job.progress)
+	defer stream.Close()
+	defer func() {
+		summary := stream.Summary()
+		job.mu.Lock()
+		job.results = stream.Results()
+		job.summary = &summary
+		job.mu.Unlock()
+	}()
+	// stopped finishes a job whose fetch was canceled or failed, reporting
+	// whether it did
+	stopped := func() bool {
+		if ctx.Err() != nil {
+			log.Info("Export job canceled", "duration", time.Since(start))
+			job.finish(jobCanceled, nil)
+			return true
+		}
+		result, failed := stream.Failed()
+		if !failed {
+			return false
+		}
+		log.Error("Export job failed", "region", gd.TargetLabel(result.Account, result.Region), "duration", time.Since(start), "error", result.Err)
+		job.mu.Lock()
+		job.credentialsExpired = a.sso.isExpired(job.opts.Profile)
+		job.mu.Unlock()
+		job.finish(jobFailed, result.Err)
+		return true
+	}
+
+	filename := export.Filename(job.createdAt, job.opts.Format)
+	if job.opts.partition {
+		upload, totalFindings, err := a.uploadPartitions(ctx, job.opts.WriteOptions, filename, stream)
+		if stopped() {
+			return
+		}
+		if err != nil {
+			job.finish(jobFailed, err)
+			return
+		}
+		job.mu.Lock()
+		job.upload = upload
+		job.filename = filename
+		job.findings = totalFindings
+		job.truncation = streamTruncation(stream)
+		job.mu.Unlock()
+
+		archive := a.finishExport(ctx, job.opts, stream.Results())
+		job.mu.Lock()
+		job.archive = archive
+		job.mu.Unlock()
+		log.Info("Export job completed", "findings", totalFindings, "duration", time.Since(start))
+		job.finish(jobSucceeded, nil)
+		return
+	}
+	if pushesToSIEM(job.opts.destination) {
+		target, totalFindings, err := a.pushFindings(ctx, job.opts.destination, stream)
+		if stopped() {
+			return
+		}
+		if err != nil {
+			job.finish(jobFailed, err)
+			return
+		}
+		job.mu.Lock()
+		job.pushedTo = target
+		job.findings = totalFindings
+		job.truncation = streamTruncation(stream)
+		job.mu.Unlock()
+
+		archive := a.finishExport(ctx, job.opts, stream.Results())
+		job.mu.Lock()
+		job.archive = archive
+		job.mu.Unlock()
+		log.Info("Export job completed", "findings", totalFindings, "duration", time.Since(start))
+		job.finish(jobSucceeded, nil)
+		return
+	}
+
+	name := a.storedName(filename, job.opts.Compression)
+	contentType := a.storedContentType(job.opts.Format, job.opts.Compression)
+	file, err := os.CreateTemp("", "*_"+name)
+	if err != nil {
+		job.finish(jobFailed, fmt.Errorf("error creating file: %v", err))
+		return
+	}
+	defer file.Close()
+	out, err := a.encryptExport(ctx, file)
+	if err != nil {
+		os.Remove(file.Name())
+		job.finish(jobFailed, err)
+		return
+	}
+
+	totalFindings, err := export.Write(ctx, out, job.opts.WriteOptions, filename, stream)
+	if err == nil {
+		err = out.Close()
+	}
+	if stopped() {
+		os.Remove(file.Name())
+		return
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		job.finish(jobFailed, err)
+		return
+	}
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	path := file.Name()
+	seal, err := a.sealExport(ctx, path, name)
+	if err != nil {
+		removeExportFile(path)
+		job.finish(jobFailed, err)
+		return
+	}
+	var upload s3Upload
+	if usesS3(job.opts.destination) {
+		upload, err = a.uploadExport(ctx, path, name, contentType)
+		if err != nil {
+			removeExportFile(path)
+			if !stopped() {
+				job.finish(jobFailed, err)
+			}
+			return
+		}
+		if job.opts.destination == destinationS3 {
+			removeExportFile(path)
+			path = ""
+		}
+	}
+
+	job.mu.Lock()
+	job.path = path
+	job.upload = upload
+	job.filename = name
+	job.size = size
+	job.seal = seal
+	job.contentType = contentType
+	job.findings = totalFindings
+	job.truncation = streamTruncation(stream)
+	job.mu.Unlock()
+
+	archive := a.finishExport(ctx, job.opts, stream.Results())
+	job.mu.Lock()
+	job.archive = archive
+	job.mu.Unlock()
+	if job.opts.email {
+		err := a.emailExport(ctx, emailedExport{
+			filename:    name,
+			contentType: contentType,
+			path:        path,
+			upload:      upload,
+			size:        size,
+			findings:    totalFindings,
+			results:     stream.Results(),
+			truncation:  streamTruncation(stream),
+			schedule:    job.schedule,
+			startedAt:   start,
+		})
+		job.mu.Lock()
+		if err != nil {
+			log.Error("Error emailing export", "error", err)
+			job.emailError = err.Error()
+		} else {
+			job.emailedTo = a.config().Email.To
+		}
+		job.mu.Unlock()
+	}
+	log.Info("Export job completed", "findings", totalFindings, "duration", time.Since(start))
+	job.finish(jobSucceeded, nil)
+}
+
+// lookupJob returns the job named by the id path value, writing a 404 if there is none
+func (a *App) lookupJob(w http.ResponseWriter, r *http.Request) (*Job, bool) {
+	job, ok := a.jobs.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+	}
+	return job, ok
+}
+
+// handleGetJob reports the status and progress of a job
+func (a *App) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.lookupJob(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.view())
+}
+
+// handleDownloadJob serves the artifact of a completed job
+func (a *App) handleDownloadJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.lookupJob(w, r)
+	if !ok {
+		return
+	}
+
+	job.mu.Lock()
+	status, path, filename, upload, pushedTo := job.status, job.path, job.filename, job.upload, job.pushedTo
+	job.mu.Unlock()
+	if status != jobSucceeded {
+		http.Error(w, fmt.Sprintf("Job is %s", status), http.StatusConflict)
+		return
+	}
+
+	// A partitioned export is a table of many objects rather than a file
+	if job.opts.partition {
+		http.Error(w, fmt.Sprintf("Partitioned exports cannot be downloaded; query them at %s", upload.uri()), http.StatusConflict)
+		return
+	}
+	if pushedTo != "" {
+		http.Error(w, fmt.Sprintf("Exports to the %s destination cannot be downloaded; their findings were sent to %s", job.opts.destination, pushedTo), http.StatusConflict)
+		return
+	}
+
+	// An export kept only in S3 is downloaded through a fresh presigned URL
+	if path == "" {
+		if err := a.presignUpload(r.Context(), &upload, filename); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, upload.url, http.StatusFound)
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", job.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	http.ServeContent(w, r, filename, info.ModTime(), file)
+}
+
+// handleJobSignature serves the detached signature of the artifact of a
+// completed job, from S3 through a fresh presigned URL when the artifact is
+// kept only there
+func (a *App) handleJobSignature(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.lookupJob(w, r)
+	if !ok {
+		return
+	}
+
+	job.mu.Lock()
+	status, path, upload, signature := job.status, job.path, job.upload, job.seal.Signature
+	job.mu.Unlock()
+	if status != jobSucceeded {
+		http.Error(w, fmt.Sprintf("Job is %s", status), http.StatusConflict)
+		return
+	}
+	if signature == "" {
+		http.Error(w, "Job export is not signed", http.StatusNotFound)
+		return
+	}
+	suffix := filepath.Ext(signature)
+	if path == "" {
+		upload.key += suffix
+		if err := a.presignUpload(r.Context(), &upload, signature); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, upload.url, http.StatusFound)
+		return
+	}
+	data, err := os.ReadFile(path + suffix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", sidecarContentType(signature))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", signature))
+	w.Write(data)
+}
+
+// handleDeleteJob cancels a running job. A job that has already finished is
+// removed along with its local artifact; uploaded objects are kept.
+func (a *App) handleDeleteJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.lookupJob(w, r)
+	if !ok {
+		return
+	}
+
+	job.mu.Lock()
+	status, path, checkpoint := job.status, job.path, job.opts.Checkpoint
+	job.mu.Unlock()
+
+	if !status.finished() {
+		telemetry.Logger(r.Context()).Info("Canceling export job", "job_id", job.id)
+		job.cancel()
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	a.removeJob(r.Context(), job.id, path, checkpoint)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeJob forgets a finished job and removes its local artifact at path,
+// with the artifact's integrity files, and its checkpoint. It reports
+// whether an artifact was removed.
+func (a *App) removeJob(ctx context.Context, id, path string, checkpoint *gd.Checkpoint) bool {
+	a.jobs.remove(id)
+	removed := false
+	if path != "" {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			telemetry.Logger(ctx).Error("Error removing job artifact", "job_id", id, "error", err)
+		}
+		removed = err == nil
+		for _, suffix := range sidecarSuffixes {
+			os.Remove(path + suffix)
+		}
+	}
+	a.removeCheckpoint(ctx, checkpoint)
+	return removed
+}
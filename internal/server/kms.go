@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// callKMS calls the KMS API action, such as Sign, in region, by default the
+// SDK region, and decodes its response into output. The API is called with
+// the server's AWS credentials rather than through an SDK client, as SES is.
+func (a *App) callKMS(ctx context.Context, region, action string, input, output any) error {
+	if region == "" {
+		region = a.awsCfg.Region
+	}
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.kmsEndpoint(region)+"/", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	creds, err := a.awsCfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(payload)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), "kms", region, time.Now()); err != nil {
+		return err
+	}
+	resp, err := a.awsCfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &failure) != nil || failure.Message == "" {
+			failure.Message = strings.TrimSpace(string(body))
+		}
+		return fmt.Errorf("%s: %s", resp.Status, failure.Message)
+	}
+	if err := json.Unmarshal(body, output); err != nil {
+		return fmt.Errorf("unexpected response %q", body)
+	}
+	return nil
+}
+
+// kmsEndpoint returns the base URL of the KMS API in region: the kms
+// endpoint or the endpoint replacing every service when one is set
+func (a *App) kmsEndpoint(region string) string {
+	if endpoint := a.config().Endpoints["kms"]; endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	if a.config().EndpointURL != "" {
+		return strings.TrimSuffix(a.config().EndpointURL, "/")
+	}
+	host := "kms"
+	if a.config().UseFIPS {
+		host = "kms-fips"
+	}
+	suffix := "amazonaws.com"
+	if strings.HasPrefix(region, "cn-") {
+		suffix = "amazonaws.com.cn"
+	}
+	return fmt.Sprintf("https://%s.%s.%s", host, region, suffix)
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// The Lambda runtime API, whose address the runtime sets in
+// AWS_LAMBDA_RUNTIME_API, and the headers of its invocations
+const (
+	lambdaRuntimeEnv      = "AWS_LAMBDA_RUNTIME_API"
+	lambdaRuntimeVersion  = "2018-06-01"
+	lambdaRequestIDHeader = "Lambda-Runtime-Aws-Request-Id"
+	lambdaDeadlineHeader  = "Lambda-Runtime-Deadline-Ms"
+	lambdaErrorTypeHeader = "Lambda-Runtime-Function-Error-Type"
+	// lambdaMaxResponse is the largest response Lambda returns from a
+	// synchronous invocation
+	lambdaMaxResponse = 6 << 20
+	// lambdaDeadlineMargin is how long before the invocation's deadline an
+	// export is canceled, leaving time to remove its files and report
+	// the failure before Lambda stops the function
+	lambdaDeadlineMargin = 10 * time.Second
+)
+
+// lambdaError is the body of a failed invocation or initialization, shown
+// by Lambda as the function's error
+type lambdaError struct {
+	ErrorMessage string `json:"errorMessage"`
+	ErrorType    string `json:"errorType"`
+}
+
+// runLambdaCommand serves the invocations of a Lambda function through the
+// Lambda runtime API, running an export for each, and returns the process
+// exit code when the runtime API fails
+func runLambdaCommand(args []string) int {
+	runtimeAPI := os.Getenv(lambdaRuntimeEnv)
+	if runtimeAPI == "" {
+		fmt.Fprintf(os.Stderr, "The lambda command runs in the Lambda runtime: %s is not set\n", lambdaRuntimeEnv)
+		return 2
+	}
+	runtime := "http://" + runtimeAPI + "/" + lambdaRuntimeVersion + "/runtime"
+
+	// Only /tmp is writable in Lambda, so exports are written there before
+	// they are uploaded unless the environment names another directory
+	if _, ok := os.LookupEnv(envPrefix + "OUTPUT_DIR"); !ok {
+		os.Setenv(envPrefix+"OUTPUT_DIR", os.TempDir())
+	}
+	fs := flag.NewFlagSet("lambda", flag.ExitOnError)
+	app, err := loadApp(fs, args)
+	if err != nil {
+		// Lambda reports the error of a failed initialization as the
+		// function's error
+		postLambda(runtime+"/init/error", "InitError", err)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for {
+		if err := app.serveInvocation(runtime); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+}
+
+// serveInvocation waits for the next invocation, runs its export, and posts
+// the outcome. It returns an error only when the runtime API fails.
+func (a *App) serveInvocation(runtime string) error {
+	resp, err := http.Get(runtime + "/invocation/next")
+	if err != nil {
+		return fmt.Errorf("error getting the next invocation: %v", err)
+	}
+	payload, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error getting the next invocation: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error getting the next invocation: %s", resp.Status)
+	}
+	requestID := resp.Header.Get(lambdaRequestIDHeader)
+
+	ctx := context.Background()
+	if ms, err := strconv.ParseInt(resp.Header.Get(lambdaDeadlineHeader), 10, 64); err == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.UnixMilli(ms).Add(-lambdaDeadlineMargin))
+		defer cancel()
+	}
+	ctx = telemetry.WithLogger(ctx, telemetry.Logger(ctx).With("request_id", requestID))
+
+	invocation := runtime + "/invocation/" + url.PathEscape(requestID)
+	output, errorType, err := a.invokeExport(ctx, payload)
+	if err != nil {
+		telemetry.Logger(ctx).Error("Invocation failed", "error", err)
+		return postLambda(invocation+"/error", errorType, err)
+	}
+	if len(output) > lambdaMaxResponse {
+		err := fmt.Errorf("The output of %d bytes is larger than Lambda's response limit: export it to S3 instead", len(output))
+		telemetry.Logger(ctx).Error("Invocation failed", "error", err)
+		return postLambda(invocation+"/error", "ResponseTooLarge", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, invocation+"/response", bytes.NewReader(output))
+	if err != nil {
+		return fmt.Errorf("error posting the invocation response: %v", err)
+	}
+	return sendLambda(req)
+}
+
+// invokeExport runs the export of an invocation's payload: a JSON object
+// of export parameters, like the params of a schedule, or the event of an
+// EventBridge schedule rule, which exports with the config's options.
+// Exports are written to S3 or pushed to a SIEM, and the response of dry
+// runs and reports is their output. It returns the response, or the error
+// and its type.
+func (a *App) invokeExport(ctx context.Context, payload []byte) ([]byte, string, error) {
+	query := url.Values{}
+	if len(bytes.TrimSpace(payload)) == 0 {
+		payload = []byte("{}")
+	}
+	var params map[string]paramValues
+	if err := json.Unmarshal(payload, &params); err != nil {
+		return nil, "InvalidOptions", fmt.Errorf("Invalid options: the payload must be a JSON object of export parameters")
+	}
+	scheduled := slices.Equal(params["source"], paramValues{"aws.events"}) && slices.Equal(params["detail-type"], paramValues{"Scheduled Event"})
+	if !scheduled {
+		for param, values := range params {
+			query[param] = values
+		}
+	}
+	// Regions may be given as a comma-separated list
+	query["regions"] = gd.SplitList(query["regions"])
+
+	opts, err := a.parseExportValues(query)
+	if err != nil {
+		return nil, "InvalidOptions", err
+	}
+	// Files in /tmp are lost when the function's environment is recycled,
+	// so local exports are uploaded to S3 instead
+	if opts.destination == destinationLocal || opts.destination == destinationBoth {
+		query.Set("destination", destinationS3)
+		if opts, err = a.parseExportValues(query); err != nil {
+			return nil, "InvalidOptions", err
+		}
+	}
+
+	// The invocation's files are written to a directory of its own, removed
+	// when it ends, so exports that failed to upload don't fill /tmp over
+	// the invocations of a warm function
+	dir, err := os.MkdirTemp(a.config().OutputDir, "invocation-")
+	if err != nil {
+		return nil, "ExportError", fmt.Errorf("error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	outputDir := a.config().OutputDir
+	a.config().OutputDir = dir
+	defer func() { a.config().OutputDir = outputDir }()
+
+	var output bytes.Buffer
+	path := ""
+	if opts.dryRun || opts.report != "" {
+		path = "-"
+	}
+	ctx, span := telemetry.StartSpan(ctx, "export", "regions", len(opts.Regions), "format", opts.Format)
+	err = a.runExport(ctx, opts, path, &output)
+	span.Finish(err)
+	if err != nil {
+		return nil, "ExportError", err
+	}
+	if path == "" {
+		return []byte(`{"status":"succeeded"}`), "", nil
+	}
+	return output.Bytes(), "", nil
+}
+
+// postLambda reports an error to the runtime API at url
+func postLambda(url, errorType string, err error) error {
+	body, _ := json.Marshal(lambdaError{ErrorMessage: err.Error(), ErrorType: errorType})
+	req, reqErr := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if reqErr != nil {
+		return fmt.Errorf("error posting the invocation error: %v", reqErr)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(lambdaErrorTypeHeader, errorType)
+	return sendLambda(req)
+}
+
+// sendLambda sends a request to the runtime API, which accepts the outcome
+// of an invocation with 202 Accepted
+func sendLambda(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting to the runtime API: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, siemMaxResponseLength))
+		return fmt.Errorf("error posting to the runtime API: %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return nil
+}
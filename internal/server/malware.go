@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+)
+
+// malwareScanReport lists the malware scans of the accounts and regions of
+// an export
+func malwareScanReport(ctx context.Context, opts gd.FetchOptions) reportOutput {
+	report := gd.MalwareScans(ctx, opts)
+	out := reportOutput{value: report, table: malwareScanTable(report), regions: len(report.Regions)}
+	for _, region := range report.Regions {
+		if region.Error != "" {
+			out.failed++
+		}
+	}
+	return out
+}
+
+// malwareScanTable lays out a malware scan report as one row per scan, with
+// its volumes and threats joined in a cell each, followed by a row for each
+// region that was skipped or could not be listed
+func malwareScanTable(report gd.MalwareScanReport) export.Table {
+	table := export.Table{
+		Name:    "Malware Scans",
+		Columns: []string{"AccountId", "Region", "DetectorId", "ScanId", "ScanType", "ScanStatus", "ScanResult", "Threats", "InstanceArn", "Volumes", "FileCount", "TotalBytes", "TriggerFindingId", "FindingIds", "ScanStartTime", "ScanEndTime", "Notes"},
+	}
+	for _, s := range report.Scans {
+		volumes := make([]string, len(s.Volumes))
+		for i, v := range s.Volumes {
+			volumes[i] = v.VolumeArn
+			if v.SizeGB > 0 {
+				volumes[i] += fmt.Sprintf(" (%d GB)", v.SizeGB)
+			}
+		}
+		threats := make([]string, len(s.Threats))
+		for i, t := range s.Threats {
+			threats[i] = t.Name
+			if len(t.Files) > 0 {
+				threats[i] += " in " + strings.Join(t.Files, ", ")
+			}
+		}
+		table.Rows = append(table.Rows, []any{s.AccountID, s.Region, s.DetectorID, s.ScanID, s.ScanType, s.Status, s.Result, strings.Join(threats, "; "), s.InstanceArn, strings.Join(volumes, "; "), reportCell(s.FileCount), reportCell(s.TotalBytes), s.TriggerFindingID, strings.Join(s.FindingIDs, "; "), reportTime(s.StartedAt), reportTime(s.EndedAt), s.FailureReason})
+	}
+	for _, region := range report.Regions {
+		switch {
+		case region.Error != "":
+			table.Rows = append(table.Rows, []any{region.Account, region.Region, "", "", "", inventoryError, "", "", "", "", "", "", "", "", "", "", region.Error})
+		case region.Skipped != "":
+			table.Rows = append(table.Rows, []any{region.Account, region.Region, "", "", "", inventorySkipped, "", "", "", "", "", "", "", "", "", "", region.Skipped})
+		}
+	}
+	return table
+}
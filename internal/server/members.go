@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+)
+
+// memberReport lists the member accounts and administrators of the
+// accounts and regions of an export
+func memberReport(ctx context.Context, opts gd.FetchOptions) reportOutput {
+	report := gd.ListMemberAccounts(ctx, opts)
+	out := reportOutput{value: report, table: memberTable(report), regions: len(report.Regions)}
+	for _, region := range report.Regions {
+		if region.Error != "" {
+			out.failed++
+		}
+	}
+	return out
+}
+
+// memberTable lays out a member report as one row per member of an
+// administrator, then one row for each account and region that is itself a
+// member, naming its administrator, and one for each region that was
+// skipped or could not be listed
+func memberTable(report gd.MemberReport) export.Table {
+	table := export.Table{
+		Name:    "Members",
+		Columns: []string{"AdministratorId", "AccountId", "Region", "DetectorId", "Email", "RelationshipStatus", "InvitedAt", "UpdatedAt", "Notes"},
+	}
+	for _, m := range report.Members {
+		table.Rows = append(table.Rows, []any{m.AdministratorID, m.AccountID, m.Region, m.MemberDetectorID, m.Email, m.RelationshipStatus, m.InvitedAt, m.UpdatedAt, ""})
+	}
+	for _, region := range report.Regions {
+		switch {
+		case region.Error != "":
+			table.Rows = append(table.Rows, []any{"", region.Account, region.Region, "", "", inventoryError, "", "", region.Error})
+		case region.Skipped != "":
+			table.Rows = append(table.Rows, []any{"", region.Account, region.Region, "", "", inventorySkipped, "", "", region.Skipped})
+		case region.Administrator != nil:
+			admin := region.Administrator
+			table.Rows = append(table.Rows, []any{admin.AccountID, region.Account, region.Region, region.DetectorID, "", admin.RelationshipStatus, admin.InvitedAt, "", "invitation " + admin.InvitationID})
+		}
+	}
+	return table
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// recordExportCompleted counts an export that has been stored and the
+// findings it wrote from each region
+func recordExportCompleted(results []gd.RegionResult) {
+	telemetry.ExportsCompleted.Inc()
+	telemetry.LastCompleted.Set(float64(time.Now().Unix()))
+	for _, result := range results {
+		if result.Count > 0 {
+			telemetry.FindingsExported.Add(float64(result.Count), result.Region)
+		}
+	}
+}
+
+// handleMetrics serves the exporter metrics for Prometheus, along with the
+// running jobs and the last successful run of each schedule
+func (a *App) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	telemetry.WriteMetrics(w)
+
+	running := telemetry.NewGauge("guardduty_export_jobs_running", "Export jobs in progress.")
+	running.Set(float64(a.jobs.countRunning()))
+	running.Write(w)
+
+	queued := telemetry.NewGauge("guardduty_export_jobs_queued", "Export jobs waiting in the job queue.")
+	queued.Set(float64(a.queue.countWaiting()))
+	queued.Write(w)
+
+	lastSuccess := telemetry.NewGauge("guardduty_export_schedule_last_success_timestamp_seconds",
+		"Unix time the last job of each schedule succeeded.", "schedule", "name")
+	for _, s := range a.schedules.list() {
+		view := s.view()
+		var last time.Time
+		for _, run := range view.History {
+			if run.Status == jobSucceeded && run.FinishedAt != nil && run.FinishedAt.After(last) {
+				last = *run.FinishedAt
+			}
+		}
+		if !last.IsZero() {
+			lastSuccess.Set(float64(last.Unix()), view.ID, view.Name)
+		}
+	}
+	lastSuccess.Write(w)
+}
@@ -0,0 +1,602 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"guardduty/internal/telemetry"
+)
+
+// Paths of the OIDC sign-in flow, outside /api so they are reachable
+// without a session
+const (
+	oidcLoginPath    = "/auth/login"
+	oidcCallbackPath = "/auth/callback"
+	oidcLogoutPath   = "/auth/logout"
+)
+
+// Cookies holding the session and the state of a sign-in in progress
+const (
+	sessionCookie   = "guardduty_export_session"
+	oidcStateCookie = "guardduty_export_oidc"
+)
+
+// oidcPrincipalPrefix starts the principal name of OIDC users
+const oidcPrincipalPrefix = "oidc "
+
+// oidcLoginTimeout bounds the time between starting a sign-in and the
+// identity provider redirecting back
+const oidcLoginTimeout = 10 * time.Minute
+
+// jwksRefreshInterval is the least time between fetches of the provider's
+// signing keys when a token names an unknown key
+const jwksRefreshInterval = time.Minute
+
+// oidcConfig is an OpenID Connect identity provider that users of the web
+// interface sign in with, using the authorization code flow with PKCE
+type oidcConfig struct {
+	// Issuer is the provider's issuer URL, whose discovery document is at
+	// /.well-known/openid-configuration
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"clientId"`
+	ClientSecret string `yaml:"clientSecret"`
+	// RedirectURL is the server's /auth/callback URL as registered with the
+	// provider, such as https://exports.example.com/auth/callback
+	RedirectURL string   `yaml:"redirectUrl"`
+	Scopes      []string `yaml:"scopes"`
+	// UsernameClaim and GroupsClaim name the ID token claims holding the
+	// user's name and groups, such as cognito:groups for Cognito
+	UsernameClaim string `yaml:"usernameClaim"`
+	GroupsClaim   string `yaml:"groupsClaim"`
+	// AllowedGroups may sign in; empty allows every user of the provider
+	AllowedGroups []string `yaml:"allowedGroups"`
+	// ExportGroups are operators, who may start exports and mark findings;
+	// empty makes every signed-in user one. Users outside them are viewers.
+	ExportGroups []string `yaml:"exportGroups"`
+	// AdminGroups are admins, who also manage schedules, presets, filters,
+	// and credentials; empty makes every operator one
+	AdminGroups []string `yaml:"adminGroups"`
+	// SessionDuration is how long a sign-in lasts
+	SessionDuration time.Duration `yaml:"sessionDuration"`
+	// SessionSecret signs the session cookies. Without it a random secret
+	// is used, so sessions end when the server restarts.
+	SessionSecret string `yaml:"sessionSecret"`
+}
+
+// enabled reports whether users sign in through an identity provider
+func (c oidcConfig) enabled() bool {
+	return c.Issuer != ""
+}
+
+func (c oidcConfig) validate(basePath string) error {
+	if !c.enabled() {
+		return nil
+	}
+	if u, err := url.Parse(c.Issuer); err != nil || u.Scheme != "https" && u.Hostname() != "localhost" {
+		return fmt.Errorf("invalid auth.oidc.issuer %q: must be an https URL", c.Issuer)
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("invalid auth.oidc.clientId: must be set")
+	}
+	if u, err := url.Parse(c.RedirectURL); err != nil || u.Host == "" || u.Path != basePath+oidcCallbackPath {
+		return fmt.Errorf("invalid auth.oidc.redirectUrl %q: must be the server's absolute %s URL", c.RedirectURL, basePath+oidcCallbackPath)
+	}
+	if !slices.Contains(c.Scopes, "openid") {
+		return fmt.Errorf("invalid auth.oidc.scopes: must include openid")
+	}
+	if c.UsernameClaim == "" || c.GroupsClaim == "" {
+		return fmt.Errorf("invalid auth.oidc: usernameClaim and groupsClaim must be set")
+	}
+	if c.SessionDuration <= 0 {
+		return fmt.Errorf("invalid auth.oidc.sessionDuration %v: must be positive", c.SessionDuration)
+	}
+	return nil
+}
+
+// oidcProvider signs users in through the configured identity provider.
+// The discovery document and signing keys are fetched on first use, so the
+// server starts while the provider is unreachable.
+type oidcProvider struct {
+	config oidcConfig
+	// basePath is the server's URL prefix, which the cookie paths and
+	// redirects include
+	basePath string
+	secret   []byte
+	secure   bool
+	client   *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// oidcDiscovery is the part of the provider's discovery document used
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// newOIDCProvider returns the provider of c, or nil when OIDC is not
+// configured
+func newOIDCProvider(c oidcConfig, basePath string) *oidcProvider {
+	if !c.enabled() {
+		return nil
+	}
+	secret := []byte(c.SessionSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+		slog.Info("No OIDC session secret is configured, so sessions end when the server restarts")
+	}
+	return &oidcProvider{
+		config:   c,
+		basePath: basePath,
+		secret:   secret,
+		secure:   strings.HasPrefix(c.RedirectURL, "https://"),
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// sessionClaims is the content of a session cookie
+type sessionClaims struct {
+	User    string   `json:"user"`
+	Groups  []string `json:"groups,omitempty"`
+	Role    string   `json:"role"`
+	Expires int64    `json:"exp"`
+}
+
+// loginState is the content of the cookie kept during a sign-in
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next"`
+	Expires  int64  `json:"exp"`
+}
+
+// sign encodes v as a cookie value with an HMAC of its content
+func (o *oidcProvider) sign(v any) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, o.secret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify decodes a cookie value written by sign into v, rejecting values
+// whose HMAC does not match
+func (o *oidcProvider) verify(value string, v any) error {
+	payload, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return errors.New("malformed cookie")
+	}
+	given, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("malformed cookie")
+	}
+	mac := hmac.New(sha256.New, o.secret)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return errors.New("cookie signature does not match")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return errors.New("malformed cookie")
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (o *oidcProvider) setCookie(w http.ResponseWriter, name, value, path string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   o.secure,
+		// Lax sends the cookie on the identity provider's redirect back
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// session returns the user signed in with the request's session cookie
+func (o *oidcProvider) session(r *http.Request) (principal, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return principal{}, false
+	}
+	var claims sessionClaims
+	if err := o.verify(cookie.Value, &claims); err != nil || time.Now().Unix() >= claims.Expires {
+		return principal{}, false
+	}
+	// Every session names its role; an empty one would parse as admin
+	if claims.Role == "" {
+		return principal{}, false
+	}
+	p := principal{name: oidcPrincipalPrefix + claims.User, groups: claims.Groups}
+	if p.role, err = parseRole(claims.Role); err != nil {
+		return principal{}, false
+	}
+	return p, true
+}
+
+// groupsRole returns the role of a user in groups
+func (o *oidcProvider) groupsRole(groups []string) role {
+	switch {
+	case len(o.config.ExportGroups) > 0 && !inAnyGroup(groups, o.config.ExportGroups) && !inAnyGroup(groups, o.config.AdminGroups):
+		return roleViewer
+	case len(o.config.AdminGroups) == 0 || inAnyGroup(groups, o.config.AdminGroups):
+		return roleAdmin
+	}
+	return roleOperator
+}
+
+// metadata returns the provider's discovery document, fetching it once
+func (o *oidcProvider) metadata(ctx context.Context) (*oidcDiscovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := o.getJSON(ctx, strings.TrimSuffix(o.config.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("error fetching OIDC discovery document: %v", err)
+	}
+	if d.Issuer != o.config.Issuer || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery document of %s is incomplete or names another issuer", o.config.Issuer)
+	}
+	o.discovery = &d
+	return o.discovery, nil
+}
+
+func (o *oidcProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// randomToken returns a random URL-safe string for states, nonces, and
+// PKCE verifiers
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// handleLogin starts a sign-in by redirecting to the identity provider.
+// next is the page to return to, which must be on this server.
+func (o *oidcProvider) handleLogin(w http.ResponseWriter, r *http.Request) {
+	d, err := o.metadata(r.Context())
+	if err != nil {
+		telemetry.Logger(r.Context()).Error("Unable to start sign-in", "error", err)
+		http.Error(w, "The identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	next := r.URL.Query().Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+	state := loginState{State: randomToken(), Nonce: randomToken(), Verifier: randomToken(), Next: next}
+	expires := time.Now().Add(oidcLoginTimeout)
+	state.Expires = expires.Unix()
+	o.setCookie(w, oidcStateCookie, o.sign(state), o.basePath+oidcCallbackPath, expires)
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.config.ClientID},
+		"redirect_uri":          {o.config.RedirectURL},
+		"scope":                 {strings.Join(o.config.Scopes, " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// handleCallback finishes a sign-in: it exchanges the authorization code
+// for an ID token, checks the user's groups, and sets the session cookie
+func (o *oidcProvider) handleCallback(w http.ResponseWriter, r *http.Request) {
+	l := telemetry.Logger(r.Context())
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		l.Warn("Identity provider refused sign-in", "error", e, "description", query.Get("error_description"))
+		http.Error(w, fmt.Sprintf("Sign-in failed: %s", e), http.StatusUnauthorized)
+		return
+	}
+	var state loginState
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err == nil {
+		err = o.verify(cookie.Value, &state)
+	}
+	if err != nil || time.Now().Unix() >= state.Expires || !secretsEqual(query.Get("state"), state.State) {
+		http.Error(w, "Sign-in expired or was not started here; sign in again", http.StatusBadRequest)
+		return
+	}
+	o.setCookie(w, oidcStateCookie, "", o.basePath+oidcCallbackPath, time.Unix(0, 0))
+
+	claims, err := o.exchange(r.Context(), query.Get("code"), state)
+	if err != nil {
+		l.Warn("Sign-in failed", "error", err)
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+	user, _ := claims[o.config.UsernameClaim].(string)
+	if user == "" {
+		user, _ = claims["sub"].(string)
+	}
+	groups := claimStrings(claims[o.config.GroupsClaim])
+	if len(o.config.AllowedGroups) > 0 && !inAnyGroup(groups, o.config.AllowedGroups) {
+		l.Warn("Rejected sign-in outside the allowed groups", "user", user, "groups", groups)
+		http.Error(w, "You are not in a group allowed to use the exporter", http.StatusForbidden)
+		return
+	}
+
+	expires := time.Now().Add(o.config.SessionDuration)
+	session := sessionClaims{
+		User:    user,
+		Groups:  o.accessGroups(groups),
+		Role:    o.groupsRole(groups).String(),
+		Expires: expires.Unix(),
+	}
+	o.setCookie(w, sessionCookie, o.sign(session), o.basePath+"/", expires)
+	l.Info("User signed in", "user", user, "groups", groups, "role", session.Role)
+	http.Redirect(w, r, o.basePath+state.Next, http.StatusFound)
+}
+
+// handleLogout ends the session
+func (o *oidcProvider) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if p, ok := o.session(r); ok {
+		telemetry.Logger(r.Context()).Info("User signed out", "principal", p.name)
+	}
+	o.setCookie(w, sessionCookie, "", o.basePath+"/", time.Unix(0, 0))
+	http.Redirect(w, r, o.basePath+"/", http.StatusSeeOther)
+}
+
+// exchange trades an authorization code for an ID token and returns the
+// token's verified claims
+func (o *oidcProvider) exchange(ctx context.Context, code string, state loginState) (map[string]any, error) {
+	d, err := o.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.config.RedirectURL},
+		"client_id":     {o.config.ClientID},
+		"code_verifier": {state.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret))
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling token endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return nil, fmt.Errorf("error reading token response (%s): %v", resp.Status, err)
+	}
+	if token.Error != "" {
+		return nil, fmt.Errorf("token endpoint returned %s: %s", token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint returned no ID token")
+	}
+	return o.verifyIDToken(ctx, d, token.IDToken, state.Nonce)
+}
+
+// verifyIDToken checks an ID token's signature against the provider's keys
+// and its issuer, audience, expiry, and nonce, and returns its claims
+func (o *oidcProvider) verifyIDToken(ctx context.Context, d *oidcDiscovery, raw, nonce string) (map[string]any, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed ID token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature")
+	}
+	key, err := o.signingKey(ctx, d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) != nil {
+			return nil, fmt.Errorf("ID token signature is invalid")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return nil, fmt.Errorf("ID token signature is invalid")
+		}
+	default:
+		return nil, fmt.Errorf("ID token is signed with unsupported algorithm %q", header.Alg)
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token claims: %v", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != d.Issuer {
+		return nil, fmt.Errorf("ID token was issued by %q", iss)
+	}
+	if !slices.Contains(claimStrings(claims["aud"]), o.config.ClientID) {
+		return nil, fmt.Errorf("ID token is not meant for this client")
+	}
+	// Allow a minute of clock skew
+	if exp, _ := claims["exp"].(float64); time.Now().Add(-time.Minute).Unix() >= int64(exp) {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+	if n, _ := claims["nonce"].(string); !secretsEqual(n, nonce) {
+		return nil, fmt.Errorf("ID token nonce does not match the sign-in")
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// signingKey returns the provider's key with ID kid, fetching the key set
+// again when the key is unknown, as after the provider rotates its keys
+func (o *oidcProvider) signingKey(ctx context.Context, d *oidcDiscovery, kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(o.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("ID token is signed with unknown key %q", kid)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("error fetching OIDC signing keys: %v", err)
+	}
+	o.keysFetched = time.Now()
+	o.keys = make(map[string]crypto.PublicKey)
+	decode := base64.RawURLEncoding.DecodeString
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := decode(k.N)
+			e, errE := decode(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			o.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, errX := decode(k.X)
+			y, errY := decode(k.Y)
+			if k.Crv != "P-256" || errX != nil || errY != nil {
+				continue
+			}
+			o.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	key, ok := o.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("ID token is signed with unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// claimStrings reads a claim that is a string or a list of strings, as the
+// audience and group claims may be
+func claimStrings(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// accessGroups returns the user's groups that grant access, which are kept
+// in the session, or all of them when access is not limited by group. Users
+// of some providers are in hundreds of groups, more than a cookie holds.
+func (o *oidcProvider) accessGroups(groups []string) []string {
+	if len(o.config.AllowedGroups) == 0 && len(o.config.ExportGroups) == 0 && len(o.config.AdminGroups) == 0 {
+		return groups
+	}
+	var kept []string
+	for _, group := range groups {
+		if slices.Contains(o.config.AllowedGroups, group) || slices.Contains(o.config.ExportGroups, group) || slices.Contains(o.config.AdminGroups, group) {
+			kept = append(kept, group)
+		}
+	}
+	return kept
+}
+
+// inAnyGroup reports whether groups includes one of wanted
+func inAnyGroup(groups, wanted []string) bool {
+	for _, group := range groups {
+		if slices.Contains(wanted, group) {
+			return true
+		}
+	}
+	return false
+}
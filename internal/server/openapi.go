@@ -0,0 +1,288 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// swaggerUIVersion is the release of swagger-ui-dist that the API docs load
+const swaggerUIVersion = "5.17.14"
+
+// pathParam matches the wildcards of route paths, such as {id}
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// openAPI builds the OpenAPI 3 document of the v1 API from its routes, with
+// schemas generated from the Go types of their bodies
+func (a *App) openAPI(routes []apiRoute) map[string]any {
+	schemas := &schemaBuilder{schemas: map[string]any{}, names: map[reflect.Type]string{}}
+	errorResponse := map[string]any{
+		"description": "Error",
+		"content":     jsonContent(schemas.schema(reflect.TypeOf(apiError{}))),
+	}
+
+	paths := map[string]any{}
+	operationIDs := map[string]bool{}
+	for _, route := range routes {
+		operation := map[string]any{
+			"operationId": operationID(route, operationIDs),
+			"summary":     route.summary,
+			// The least role that may call the operation when
+			// authentication is on
+			"x-role": route.role.String(),
+		}
+
+		var parameters []any
+		for _, match := range pathParam.FindAllStringSubmatch(route.path, -1) {
+			parameters = append(parameters, map[string]any{
+				"name": match[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+			})
+		}
+		params := route.params
+		if route.page != nil {
+			params = pageParams
+		}
+		if route.exportParams {
+			params = append(slices.Clone(params), exportParams()...)
+		}
+		for _, p := range params {
+			schema := map[string]any{"type": p.kind}
+			if route.exportParams && slices.Contains(repeatableParams, p.name) {
+				schema = map[string]any{"type": "array", "items": schema}
+			}
+			parameters = append(parameters, map[string]any{
+				"name": p.name, "in": "query", "description": p.description, "schema": schema,
+			})
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if route.body != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  jsonContent(schemas.schema(reflect.TypeOf(route.body))),
+			}
+		}
+
+		status := route.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		response := map[string]any{"description": http.StatusText(status)}
+		switch {
+		case route.page != nil:
+			response["content"] = jsonContent(map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"items":     schemas.schema(reflect.TypeOf(route.response)),
+					"nextToken": map[string]any{"type": "string"},
+				},
+			})
+		case route.response != nil:
+			response["content"] = jsonContent(schemas.schema(reflect.TypeOf(route.response)))
+		case route.produces != "":
+			response["content"] = map[string]any{
+				route.produces: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+			}
+		}
+		operation["responses"] = map[string]any{strconv.Itoa(status): response, "default": errorResponse}
+
+		item, _ := paths[route.path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[route.path] = item
+		}
+		item[strings.ToLower(route.method)] = operation
+	}
+
+	document := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "GuardDuty Findings Exporter API",
+			"version": "1",
+		},
+		"servers": []any{map[string]any{"url": a.path(apiV1Prefix)}},
+		"paths":   paths,
+	}
+	components := map[string]any{"schemas": schemas.schemas}
+	if a.config().Auth.enabled() {
+		components["securitySchemes"] = map[string]any{
+			"basic":  map[string]any{"type": "http", "scheme": "basic"},
+			"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+		}
+		document["security"] = []any{
+			map[string]any{"basic": []string{}},
+			map[string]any{"apiKey": []string{}},
+			map[string]any{"bearer": []string{}},
+		}
+	}
+	document["components"] = components
+	return document
+}
+
+// operationID names a route's operation after its handler, such as
+// getJob for handleGetJob, prefixed with the method when another
+// operation has the same handler
+func operationID(route apiRoute, taken map[string]bool) string {
+	name := runtime.FuncForPC(reflect.ValueOf(route.handler).Pointer()).Name()
+	name = name[strings.LastIndex(name, ".")+1:]
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "handle"), "-fm")
+	id := lowerFirst(name)
+	if taken[id] {
+		id = strings.ToLower(route.method) + name
+	}
+	taken[id] = true
+	return id
+}
+
+func jsonContent(schema any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// lowerFirst lowers the leading capitals of s, keeping the last of several
+// when it starts a word: IPSets becomes ipSets
+func lowerFirst(s string) string {
+	n := 0
+	for n < len(s) && unicode.IsUpper(rune(s[n])) {
+		n++
+	}
+	if n > 1 && n < len(s) {
+		n--
+	}
+	return strings.ToLower(s[:n]) + s[n:]
+}
+
+// schemaBuilder generates the JSON schemas of Go types as encoding/json
+// writes them. Named structs become components, referred to by name.
+type schemaBuilder struct {
+	schemas map[string]any
+	names   map[reflect.Type]string
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]any{}
+	case reflect.TypeOf(paramValues{}):
+		// Parameters are given as a single value or a list
+		return map[string]any{"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		}}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name, ok := b.names[t]
+		if !ok {
+			name = b.componentName(t)
+			b.names[t] = name
+			// The name is taken before the properties are built, so types
+			// that contain themselves refer to their own component
+			b.schemas[name] = nil
+			b.schemas[name] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// componentName names a struct's component after its type, such as JobView,
+// or after its package too when another package has a type of that name
+func (b *schemaBuilder) componentName(t reflect.Type) string {
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	if _, taken := b.schemas[name]; taken {
+		pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	return name
+}
+
+// object builds the schema of a struct's JSON fields, including those of
+// the structs it embeds
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	b.addFields(t, properties)
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+func (b *schemaBuilder) addFields(t reflect.Type, properties map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			b.addFields(fieldType, properties)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = b.schema(field.Type)
+	}
+}
+
+// handleAPIDocs serves Swagger UI for the OpenAPI document, loaded from the
+// unpkg CDN
+func (a *App) handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	dist := "https://unpkg.com/swagger-ui-dist@" + swaggerUIVersion
+	w.Write([]byte(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>GuardDuty Findings Exporter API</title>
+  <link rel="stylesheet" href="` + dist + `/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="` + dist + `/swagger-ui-bundle.js"></script>
+  <script>
+    SwaggerUIBundle({url: 'openapi.json', dom_id: '#swagger-ui'});
+  </script>
+</body>
+</html>
+`))
+}
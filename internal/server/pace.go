@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// paceWindow is how far back the throughput of a job is measured, so that
+// its rate follows throttling and slow regions rather than the whole run
+const paceWindow = 30 * time.Second
+
+// jobPace measures the throughput of a running job and estimates when it
+// finishes, from the findings its export is expected to have. It is guarded
+// by the job's mu.
+type jobPace struct {
+	// samples are the job's findings count after each page of the last
+	// paceWindow, oldest first, with the last sample before it
+	samples []paceSample
+	// pages and latency count the pages fetched from GuardDuty and the time
+	// they took, leaving out pages replayed from a checkpoint
+	pages   int
+	latency time.Duration
+	// expected is the number of findings the export is expected to have,
+	// zero until they are counted
+	expected int
+}
+
+// paceSample is the findings count of a job at one time
+type paceSample struct {
+	at       time.Time
+	findings int
+}
+
+// page records a page of the fetch, once findings includes it. fetched is
+// set for pages fetched from GuardDuty, which took latency.
+func (p *jobPace) page(at time.Time, findings int, fetched bool, latency time.Duration) {
+	if fetched {
+		p.pages++
+		p.latency += latency
+	}
+	p.samples = append(p.samples, paceSample{at: at, findings: findings})
+	for len(p.samples) > 2 && at.Sub(p.samples[1].at) > paceWindow {
+		p.samples = p.samples[1:]
+	}
+}
+
+// rate returns the findings fetched per second since the oldest sample,
+// rounded to a tenth, or zero before there is a pace to measure
+func (p *jobPace) rate(now time.Time, findings int) float64 {
+	if len(p.samples) == 0 {
+		return 0
+	}
+	first := p.samples[0]
+	elapsed := now.Sub(first.at).Seconds()
+	if elapsed < 1 || findings <= first.findings {
+		return 0
+	}
+	return math.Round(float64(findings-first.findings)/elapsed*10) / 10
+}
+
+// completion estimates when the job finishes at its current rate, or
+// returns nil when it cannot: before the findings are counted or a rate is
+// measured, or once the job has more findings than expected
+func (p *jobPace) completion(now time.Time, findings int) *time.Time {
+	rate := p.rate(now, findings)
+	if rate == 0 || p.expected <= findings {
+		return nil
+	}
+	eta := now.Add(time.Duration(float64(p.expected-findings) / rate * float64(time.Second))).Truncate(time.Second)
+	return &eta
+}
+
+// current returns the rate, expected findings, and completion estimate of a
+// job that has findings so far
+func (p *jobPace) current(now time.Time, findings int) (float64, int, *time.Time) {
+	return p.rate(now, findings), p.expected, p.completion(now, findings)
+}
+
+// averageLatency returns the mean time pages took to fetch, in milliseconds
+func (p *jobPace) averageLatency() int64 {
+	if p.pages == 0 {
+		return 0
+	}
+	return (p.latency / time.Duration(p.pages)).Milliseconds()
+}
+
+// estimate counts the findings the job's export is expected to have, for
+// its completion estimate. The count is left out when a region could not be
+// counted, since the estimate would then come too early.
+func (j *Job) estimate(ctx context.Context, opts gd.FetchOptions) {
+	stats := gd.FindingStatistics(ctx, opts)
+	for _, region := range stats.Regions {
+		if region.Error != "" {
+			telemetry.Logger(ctx).Debug("Export job has no completion estimate", "region", gd.TargetLabel(region.Account, region.Region), "error", region.Error)
+			return
+		}
+	}
+	expected := stats.Findings
+	if opts.MaxFindings > 0 {
+		expected = min(expected, opts.MaxFindings)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.pace.expected = expected
+}
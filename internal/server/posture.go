@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+)
+
+// postureReport describes the GuardDuty configuration of the accounts and
+// regions of an export
+func postureReport(ctx context.Context, opts gd.FetchOptions) reportOutput {
+	report := gd.GuardDutyPosture(ctx, opts)
+	out := reportOutput{value: report, table: postureTable(report), regions: len(report.Regions)}
+	for _, region := range report.Regions {
+		if region.Error != "" {
+			out.failed++
+		}
+	}
+	return out
+}
+
+// postureTable lays out a posture report as one row per account and region,
+// with a column for the status of each protection feature, the
+// organization's auto-enable settings joined in cells, and the flags in
+// Flags
+func postureTable(report gd.PostureReport) export.Table {
+	columns := []string{"AccountId", "Region", "DetectorId", "DetectorStatus"}
+	for _, feature := range gd.ProtectionFeatures {
+		columns = append(columns, string(feature))
+	}
+	columns = append(columns, "AutoEnableMembers", "AutoEnableFeatures", "AdministratorId", "Members", "EnabledMembers", "Flags", "Notes")
+	table := export.Table{Name: "Posture", Columns: columns}
+
+	for _, region := range report.Regions {
+		status := region.DetectorStatus
+		notes := ""
+		switch {
+		case region.Error != "":
+			status, notes = inventoryError, region.Error
+		case region.Skipped != "":
+			status, notes = inventorySkipped, region.Skipped
+		case region.DetectorID == "":
+			status = inventoryNoDetector
+		}
+		row := []any{region.Account, region.Region, region.DetectorID, status}
+		detector := gd.DetectorInfo{Features: region.Features}
+		for _, feature := range gd.ProtectionFeatures {
+			row = append(row, detector.FeatureStatus(feature))
+		}
+		autoEnableMembers, autoEnableFeatures := "", ""
+		if org := region.Organization; org != nil {
+			features := make([]string, len(org.Features))
+			for i, feature := range org.Features {
+				features[i] = feature.Name + "=" + feature.AutoEnable
+			}
+			autoEnableMembers, autoEnableFeatures = org.AutoEnableMembers, strings.Join(features, "; ")
+		}
+		administrator := ""
+		if region.Administrator != nil {
+			administrator = region.Administrator.AccountID
+		}
+		row = append(row, autoEnableMembers, autoEnableFeatures, administrator, region.Members, region.Enabled, strings.Join(region.Flags, "; "), notes)
+		table.Rows = append(table.Rows, row)
+	}
+	return table
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// whoamiView is the body of /api/whoami
+type whoamiView struct {
+	Profile string `json:"profile,omitempty"`
+	*callerIdentity
+	// Credentials describes where the profile's credentials come from
+	Credentials credentialsView `json:"credentials"`
+}
+
+// preflightView is the body of /api/preflight
+type preflightView struct {
+	Ready bool `json:"ready"`
+	gd.Preflight
+	Destination destinationCheck `json:"destination"`
+}
+
+// preflightDestination is where an export is written and uploaded, which
+// its preflight checks can take it
+type preflightDestination struct {
+	// dirs are the directories the export file is written to
+	dirs []string
+	// s3 is set when the export is uploaded to the configured bucket
+	s3 bool
+	// compress is set when the export may be compressed with gzip to fit
+	// its directories, as a file the exporter names may be
+	compress bool
+}
+
+// storedDestination returns the destination of an export the server
+// stores in dir, or stages in the temporary directory when it is only
+// uploaded. Streamed exports and those pushed to a SIEM are stored nowhere.
+func (a *App) storedDestination(opts exportOptions, dir string) preflightDestination {
+	switch {
+	case opts.partition:
+		return preflightDestination{dirs: []string{os.TempDir()}, s3: true}
+	case pushesToSIEM(opts.destination):
+		return preflightDestination{}
+	case opts.destination == destinationS3:
+		dir = os.TempDir()
+	}
+	return preflightDestination{dirs: []string{dir}, s3: usesS3(opts.destination), compress: true}
+}
+
+// destinationCheck is the outcome of checking that the destination of an
+// export can take it: that its directories have room for the export's
+// estimated size, and that it can be uploaded to the bucket
+type destinationCheck struct {
+	// EstimatedFindings is the number of findings GetFindingsStatistics
+	// counts for the export, and EstimatedBytes the size of the export
+	// file as it will be written
+	EstimatedFindings int   `json:"estimatedFindings"`
+	EstimatedBytes    int64 `json:"estimatedBytes"`
+	// EstimateError is why regions could not be counted, which leaves
+	// the estimate short
+	EstimateError string              `json:"estimateError,omitempty"`
+	Directories   []directoryCheck    `json:"directories,omitempty"`
+	S3            *gd.PermissionCheck `json:"s3,omitempty"`
+	// Compress is the compression the export is switched to, gzip, when
+	// it fits its directories only once compressed
+	Compress string   `json:"compress,omitempty"`
+	Failures []string `json:"failures"`
+}
+
+// directoryCheck is the free space of a directory an export is written to
+type directoryCheck struct {
+	Path      string `json:"path"`
+	FreeBytes int64  `json:"freeBytes"`
+}
+
+// checkDestination estimates the size of an export from
+// GetFindingsStatistics, with the same filter and limits, and checks that
+// dest can take it. The bucket is checked by uploading and deleting an
+// empty object, encrypted as exports are.
+func (a *App) checkDestination(ctx context.Context, opts exportOptions, dest preflightDestination) destinationCheck {
+	check := destinationCheck{Failures: []string{}}
+	if len(dest.dirs) > 0 {
+		stats := gd.FindingStatistics(ctx, opts.FetchOptions)
+		check.EstimatedFindings = stats.Findings
+		if opts.MaxFindings > 0 {
+			check.EstimatedFindings = min(check.EstimatedFindings, opts.MaxFindings)
+		}
+		var failed []string
+		for _, region := range stats.Regions {
+			if region.Error != "" {
+				failed = append(failed, gd.TargetLabel(region.Account, region.Region)+": "+region.Error)
+			}
+		}
+		if len(failed) > 0 {
+			check.EstimateError = fmt.Sprintf("%d of %d regions could not be counted: %s", len(failed), len(stats.Regions), failed[0])
+			telemetry.Logger(ctx).Warn("Export size estimate is incomplete", "error", check.EstimateError)
+		}
+		check.EstimatedBytes = export.EstimatedSize(opts.WriteOptions, check.EstimatedFindings)
+		compressed := opts.WriteOptions
+		compressed.Compression = export.CompressGzip
+		compressedBytes := export.EstimatedSize(compressed, check.EstimatedFindings)
+
+		for _, dir := range dest.dirs {
+			free, err := freeSpace(dir)
+			check.Directories = append(check.Directories, directoryCheck{Path: dir, FreeBytes: free})
+			if err != nil {
+				check.Failures = append(check.Failures, fmt.Sprintf("%s: %v", dir, err))
+				continue
+			}
+			needed := check.EstimatedBytes
+			if check.Compress != "" {
+				needed = compressedBytes
+			}
+			switch {
+			case needed <= free:
+			case dest.compress && opts.Compression == "" && compressedBytes <= free:
+				check.Compress = export.CompressGzip
+			default:
+				check.Failures = append(check.Failures, fmt.Sprintf("%s: the export needs about %s and %s is free", dir, megabytes(needed), megabytes(free)))
+			}
+		}
+	}
+	if dest.s3 {
+		s3Check := a.probeS3(ctx)
+		check.S3 = &s3Check
+		if s3Check.Status != gd.CheckAllowed {
+			check.Failures = append(check.Failures, fmt.Sprintf("s3://%s/%s: %s %s", a.config().S3.Bucket, a.config().S3.Prefix, s3Check.Action, s3Check.Status))
+		}
+	}
+	return check
+}
+
+// probeS3 uploads an empty object beneath the configured prefix and
+// deletes it. An object that cannot be deleted is logged and left.
+func (a *App) probeS3(ctx context.Context) gd.PermissionCheck {
+	key := path.Join(a.config().S3.Prefix, fmt.Sprintf(".guardduty_export_preflight_%d", time.Now().UnixNano()))
+	err := a.putObjectBody(ctx, bytes.NewReader(nil), key, "application/octet-stream")
+	check := gd.PermissionCheck{Action: "s3:PutObject", Status: gd.CheckStatus(err)}
+	if err != nil {
+		check.Error = err.Error()
+		telemetry.Logger(ctx).Warn("Preflight check did not pass", "action", check.Action, "status", check.Status, "error", err)
+		return check
+	}
+	if _, err := a.s3Client().DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(a.config().S3.Bucket), Key: aws.String(key)}); err != nil {
+		telemetry.Logger(ctx).Warn("Error deleting preflight object", "object", fmt.Sprintf("s3://%s/%s", a.config().S3.Bucket, key), "error", err)
+	}
+	return check
+}
+
+// freeSpace returns the bytes available to the exporter in the filesystem
+// of dir
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("error reading free space: %v", err)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// megabytes formats a size in megabytes
+func megabytes(n int64) string {
+	return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+}
+
+// err returns an error listing the checks that failed, or nil when there
+// are none
+func (c destinationCheck) err() error {
+	if len(c.Failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("preflight failed: %s", strings.Join(c.Failures, "; "))
+}
+
+// handleWhoami returns the AWS identity exports run as: that of the
+// server's default credentials, or with profile, that of another profile
+func (a *App) handleWhoami(w http.ResponseWriter, r *http.Request) {
+	profile := a.config().Profile
+	if p := r.URL.Query().Get("profile"); p != "" {
+		profile = p
+	}
+	cfg, err := a.profileConfig(profile)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid profile %q: %v", profile, err), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	credentials := describeCredentials(*a.config(), profile)
+	identity, err := lookupIdentity(ctx, a.awsClients(), cfg)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if a.sso.isExpired(profile) {
+			status = http.StatusUnauthorized
+		}
+		message := err.Error()
+		if credentials.Source != "" {
+			message = fmt.Sprintf("%s (%s credentials: %s)", message, credentials.Source, credentials.Hint)
+		} else if credentials.Hint != "" {
+			message = fmt.Sprintf("%s (%s)", message, credentials.Hint)
+		}
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(whoamiView{Profile: profile, callerIdentity: identity, Credentials: credentials})
+}
+
+// handlePreflight makes, in every account and region an export with the
+// request's parameters would cover, the calls the export would make, and
+// reports which are denied, without exporting anything
+func (a *App) handlePreflight(w http.ResponseWriter, r *http.Request) {
+	opts, err := a.parseExportOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := gd.ResolveRegions(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+	if err := gd.ResolveAccounts(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+	preflight := gd.RunPreflight(r.Context(), opts.FetchOptions)
+	destination := a.checkDestination(r.Context(), opts, a.storedDestination(opts, a.config().OutputDir))
+	telemetry.Logger(r.Context()).Info("Preflight completed", "regions", opts.Regions, "failures", len(preflight.Failures)+len(destination.Failures))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preflightView{Ready: preflight.Ready() && destination.err() == nil, Preflight: preflight, Destination: destination})
+}
+
+// checkPreflight runs the preflight of an export that asked for one, with
+// resolved options: the permission checks, and once they pass, the checks
+// that dest can take the export, which switch an export that fits only
+// once compressed to gzip. It returns an error listing the checks that
+// failed.
+func (a *App) checkPreflight(ctx context.Context, opts *exportOptions, dest preflightDestination) error {
+	if !opts.preflight {
+		return nil
+	}
+	if err := gd.RunPreflight(ctx, opts.FetchOptions).Err(); err != nil {
+		return err
+	}
+	check := a.checkDestination(ctx, *opts, dest)
+	if err := check.err(); err != nil {
+		return err
+	}
+	if check.Compress != "" {
+		telemetry.Logger(ctx).Warn("Compressing export to fit the free disk space", "compress", check.Compress, "estimated_bytes", check.EstimatedBytes)
+		opts.Compression = check.Compress
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"guardduty/internal/telemetry"
+)
+
+// defaultPresetsFile is the name of the presets file in the output directory
+// when no presetsFile is configured
+const defaultPresetsFile = ".guardduty_export_presets.json"
+
+// presetNamePattern restricts preset names to what can be given in a URL
+// path and a command-line flag without escaping
+var presetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// Errors of preset updates, answered with 409 and 404
+var (
+	errPresetExists   = errors.New("Preset already exists")
+	errPresetNotFound = errors.New("Preset not found")
+)
+
+// presetConfig is a saved export configuration that exports, schedules, and
+// the command line refer to by name. Params are export query parameters, as
+// in a schedule's params.
+type presetConfig struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Params      map[string]paramValues `json:"params"`
+	// UpdatedAt and UpdatedBy are when and by whom the preset was last
+	// saved; UpdatedBy is set when authentication is on
+	UpdatedAt time.Time `json:"updatedAt"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+}
+
+// presetsState is the content of the presets file
+type presetsState struct {
+	Presets []presetConfig `json:"presets"`
+}
+
+// presetStore persists presets in a JSON file, so they outlive restarts and
+// are shared with the export command. Updates are serialized so concurrent
+// requests don't lose each other's changes.
+type presetStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// load reads the presets file keyed by name; a missing file has no presets
+func (s *presetStore) load() (map[string]presetConfig, error) {
+	presets := make(map[string]presetConfig)
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return presets, nil
+	}
+	if err != nil {
+		return presets, fmt.Errorf("error reading presets file %s: %v", s.path, err)
+	}
+	var state presetsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return presets, fmt.Errorf("error parsing presets file %s: %v", s.path, err)
+	}
+	for _, preset := range state.Presets {
+		presets[preset.Name] = preset
+	}
+	return presets, nil
+}
+
+// save rewrites the presets file, ordered by name
+func (s *presetStore) save(presets map[string]presetConfig) error {
+	state := presetsState{Presets: make([]presetConfig, 0, len(presets))}
+	for _, preset := range presets {
+		state.Presets = append(state.Presets, preset)
+	}
+	sort.Slice(state.Presets, func(i, j int) bool {
+		return state.Presets[i].Name < state.Presets[j].Name
+	})
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding presets: %v", err)
+	}
+	if err := writeFileAtomic(s.path, append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing presets file %s: %v", s.path, err)
+	}
+	return nil
+}
+
+// list returns the presets ordered by name
+func (s *presetStore) list() ([]presetConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	presets, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]presetConfig, 0, len(presets))
+	for _, preset := range presets {
+		list = append(list, preset)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+// get returns the preset name, or errPresetNotFound
+func (s *presetStore) get(name string) (presetConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	presets, err := s.load()
+	if err != nil {
+		return presetConfig{}, err
+	}
+	preset, ok := presets[name]
+	if !ok {
+		return presetConfig{}, errPresetNotFound
+	}
+	return preset, nil
+}
+
+// put saves preset, as a new preset when create is set or in place of an
+// existing one otherwise
+func (s *presetStore) put(preset presetConfig, create bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	presets, err := s.load()
+	if err != nil {
+		return err
+	}
+	_, exists := presets[preset.Name]
+	if create && exists {
+		return errPresetExists
+	}
+	if !create && !exists {
+		return errPresetNotFound
+	}
+	presets[preset.Name] = preset
+	return s.save(presets)
+}
+
+// remove deletes the preset name
+func (s *presetStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	presets, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := presets[name]; !ok {
+		return errPresetNotFound
+	}
+	delete(presets, name)
+	return s.save(presets)
+}
+
+// withPreset returns the export parameters of query with those of the
+// preset it names filled in. Parameters in query take precedence, and its
+// regions or regionGroup replace both of the preset's, so a request can run
+// a preset against other regions.
+func (a *App) withPreset(query url.Values) (url.Values, error) {
+	name := query.Get("preset")
+	if name == "" {
+		return query, nil
+	}
+	preset, err := a.presets.get(name)
+	if errors.Is(err, errPresetNotFound) {
+		return nil, fmt.Errorf("Preset %q not found", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make(url.Values, len(preset.Params)+len(query))
+	for param, values := range preset.Params {
+		merged[param] = values
+	}
+	if len(query["regions"]) > 0 || query.Get("regionGroup") != "" {
+		delete(merged, "regions")
+		delete(merged, "regionGroup")
+	}
+	for param, values := range query {
+		if len(values) > 0 && param != "preset" {
+			merged[param] = values
+		}
+	}
+	return merged, nil
+}
+
+// checkPreset validates the name of preset and its export parameters
+// against the current defaults
+func (a *App) checkPreset(preset presetConfig) error {
+	if !presetNamePattern.MatchString(preset.Name) {
+		return fmt.Errorf("name %q must be 1 to 64 letters, digits, dots, dashes, or underscores", preset.Name)
+	}
+	if _, ok := preset.Params["preset"]; ok {
+		return fmt.Errorf("params must not refer to another preset")
+	}
+	query := make(url.Values, len(preset.Params))
+	for param, values := range preset.Params {
+		query[param] = values
+	}
+	// A preset without regions takes them from the request it is used in
+	if len(query["regions"]) == 0 && query.Get("regionGroup") == "" {
+		query.Set("regionGroup", "all")
+	}
+	if _, err := a.parseExportValues(query); err != nil {
+		return fmt.Errorf("invalid params: %v", err)
+	}
+	return nil
+}
+
+// decodePreset reads a preset from a JSON request body
+func decodePreset(r *http.Request) (presetConfig, error) {
+	var preset presetConfig
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&preset); err != nil {
+		return preset, fmt.Errorf("Invalid preset: %v", err)
+	}
+	return preset, nil
+}
+
+// presetErrorStatus maps an error from the preset store to a status code
+func presetErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errPresetNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errPresetExists):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// handleListPresets returns every preset
+func (a *App) handleListPresets(w http.ResponseWriter, r *http.Request) {
+	presets, err := a.presets.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presets)
+}
+
+// handleGetPreset returns one preset
+func (a *App) handleGetPreset(w http.ResponseWriter, r *http.Request) {
+	preset, err := a.presets.get(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), presetErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preset)
+}
+
+// handleCreatePreset saves a new preset from a JSON definition
+func (a *App) handleCreatePreset(w http.ResponseWriter, r *http.Request) {
+	preset, err := decodePreset(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.savePreset(w, r, preset, true)
+}
+
+// handleUpdatePreset replaces the definition of a preset
+func (a *App) handleUpdatePreset(w http.ResponseWriter, r *http.Request) {
+	preset, err := decodePreset(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.PathValue("name")
+	if preset.Name != "" && preset.Name != name {
+		http.Error(w, fmt.Sprintf("Invalid preset: name %q does not match the URL; presets cannot be renamed", preset.Name), http.StatusBadRequest)
+		return
+	}
+	preset.Name = name
+	a.savePreset(w, r, preset, false)
+}
+
+// savePreset validates and stores a preset created or updated by a request
+func (a *App) savePreset(w http.ResponseWriter, r *http.Request, preset presetConfig, create bool) {
+	if err := a.checkPreset(preset); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid preset: %v", err), http.StatusBadRequest)
+		return
+	}
+	preset.UpdatedAt = time.Now()
+	preset.UpdatedBy = requestUser(r.Context())
+	if err := a.presets.put(preset, create); err != nil {
+		http.Error(w, err.Error(), presetErrorStatus(err))
+		return
+	}
+
+	log := telemetry.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if create {
+		log.Info("Created preset", "preset", preset.Name)
+		w.Header().Set("Location", a.path("/api/presets/"+preset.Name))
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		log.Info("Updated preset", "preset", preset.Name)
+	}
+	json.NewEncoder(w).Encode(preset)
+}
+
+// handleDeletePreset removes a preset. Schedules that refer to it fail from
+// their next run.
+func (a *App) handleDeletePreset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := a.presets.remove(name); err != nil {
+		http.Error(w, err.Error(), presetErrorStatus(err))
+		return
+	}
+	telemetry.Logger(r.Context()).Info("Deleted preset", "preset", name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// Sizes of the sample of an export preview
+const (
+	defaultPreviewLimit = 20
+	maxPreviewLimit     = 100
+)
+
+// previewView is a sample of the first findings an export would write, as
+// the rows of its columns
+type previewView struct {
+	Columns  []string   `json:"columns"`
+	Rows     [][]string `json:"rows"`
+	Findings int        `json:"findings"`
+	// Complete is set when the sample holds every finding of the export
+	Complete bool `json:"complete"`
+	// Regions is the outcome of each account and region sampled
+	Regions gd.RegionSummary `json:"regions"`
+}
+
+// handlePreview fetches the first limit findings an export with the same
+// parameters would write, in its order and with its lookups, and answers
+// with them in the export's columns, so the filters and column mapping of a
+// long export can be checked before it starts. The sample is not kept in
+// the findings store and is neither archived nor ticketed.
+func (a *App) handlePreview(w http.ResponseWriter, r *http.Request) {
+	opts, err := a.parseExportOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.report != "" {
+		http.Error(w, fmt.Sprintf("Reports cannot be previewed: the %s report has no findings", opts.report), http.StatusBadRequest)
+		return
+	}
+	limit := defaultPreviewLimit
+	if v := r.Form.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPreviewLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit %q: a preview holds 1 to %d findings", v, maxPreviewLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if err := gd.ResolveRegions(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+	if err := gd.ResolveAccounts(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+	opts.MaxFindings, opts.MaxDuration = limit, 0
+	opts.Store, opts.Archiving, opts.Ticketing = nil, false, false
+
+	stream := gd.StreamRegions(r.Context(), opts.FetchOptions, nil)
+	defer stream.Close()
+	results := stream.Collect()
+	if result, failed := stream.Failed(); failed {
+		http.Error(w, fmt.Sprintf("error getting findings for region %s: %v", gd.TargetLabel(result.Account, result.Region), result.Err), a.exportErrorStatus(opts))
+		return
+	}
+	_, truncated := stream.Truncated()
+	columns, rows := export.FindingRows(results, opts.WriteOptions)
+	view := previewView{Columns: columns, Rows: rows, Findings: len(rows), Complete: !truncated, Regions: gd.SummarizeRegions(results)}
+	telemetry.Logger(r.Context()).Info("Previewed export", "regions", opts.Regions, "findings", view.Findings)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// awsProfile is a named profile from the shared config or credentials file
+type awsProfile struct {
+	Name string `json:"name"`
+	// Source is how the profile gets credentials: sso, assumeRole,
+	// webIdentity, process, static, or empty when it has none of its own,
+	// such as a profile that only sets a region
+	Source string `json:"source,omitempty"`
+}
+
+// sharedFiles returns the shared config and credentials files the SDK
+// reads, honoring AWS_CONFIG_FILE and AWS_SHARED_CREDENTIALS_FILE
+func sharedFiles() (configFile, credentialsFile string) {
+	configFile = os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = config.DefaultSharedConfigFilename()
+	}
+	credentialsFile = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = config.DefaultSharedCredentialsFilename()
+	}
+	return configFile, credentialsFile
+}
+
+// listProfiles returns the profiles of the shared config and credentials
+// files ordered by name. Files that don't exist are treated as empty.
+func listProfiles() ([]awsProfile, error) {
+	configFile, credentialsFile := sharedFiles()
+	keys := make(map[string]map[string]bool)
+	if err := readProfileKeys(configFile, true, keys); err != nil {
+		return nil, err
+	}
+	if err := readProfileKeys(credentialsFile, false, keys); err != nil {
+		return nil, err
+	}
+
+	profiles := make([]awsProfile, 0, len(keys))
+	for name, profileKeys := range keys {
+		profiles = append(profiles, awsProfile{Name: name, Source: credentialSource(profileKeys)})
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles, nil
+}
+
+// readProfileKeys adds the keys set by each profile in an INI file to keys.
+// In the config file profiles other than default are named [profile name],
+// and other sections such as [sso-session name] are skipped.
+func readProfileKeys(path string, configFile bool, keys map[string]map[string]bool) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var profile map[string]bool
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			profile = nil
+			if configFile && name != "default" {
+				var ok bool
+				if name, ok = strings.CutPrefix(name, "profile "); !ok {
+					continue
+				}
+				name = strings.TrimSpace(name)
+			}
+			if keys[name] == nil {
+				keys[name] = make(map[string]bool)
+			}
+			profile = keys[name]
+			continue
+		}
+		if key, _, ok := strings.Cut(line, "="); ok && profile != nil {
+			profile[strings.ToLower(strings.TrimSpace(key))] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return nil
+}
+
+// credentialSource names how a profile with these keys gets credentials, in
+// the order the SDK checks them
+func credentialSource(keys map[string]bool) string {
+	switch {
+	case keys["aws_access_key_id"]:
+		return "static"
+	case keys["role_arn"] && keys["web_identity_token_file"]:
+		return "webIdentity"
+	case keys["role_arn"]:
+		return "assumeRole"
+	case keys["sso_session"] || keys["sso_start_url"]:
+		return "sso"
+	case keys["credential_process"]:
+		return "process"
+	}
+	return ""
+}
+
+// loadAWSConfig loads the SDK configuration for profile, or for the SDK's
+// default credential chain when profile is empty, with the exporter's retry
+// settings, HTTP client, endpoints, and instrumentation. Profiles without a region use
+// the default region of the configured partition. The configured profile
+// gets its credentials from the sources of conf.Credentials when they are
+// set. Expired credentials are recorded in sessions. With synthetic
+// findings, which answer GuardDuty in its place, every profile signs its
+// calls with placeholder credentials.
+func loadAWSConfig(ctx context.Context, conf Config, profile string, sessions *ssoSessions) (aws.Config, error) {
+	options := []func(*config.LoadOptions) error{
+		config.WithRetryer(gd.NewRetryer(conf.RetryMode, conf.RetryAttempts, conf.RetryMaxBackoff)),
+		config.WithSharedConfigProfile(profile),
+	}
+	if conf.UseFIPS {
+		options = append(options, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if conf.AWSHTTP.configured() {
+		client, err := newAWSHTTPClient(conf.AWSHTTP)
+		if err != nil {
+			return aws.Config{}, err
+		}
+		options = append(options, config.WithHTTPClient(client))
+	}
+	if conf.Synthetic.enabled() {
+		options = append(options, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider("SYNTHETIC", "synthetic", "")))
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if awsCfg.Region == "" {
+		awsCfg.Region = gd.PartitionRegions[conf.AWSPartition]
+	}
+	if conf.EndpointURL != "" {
+		awsCfg.BaseEndpoint = aws.String(conf.EndpointURL)
+	}
+	if len(conf.Endpoints) > 0 {
+		awsCfg.ConfigSources = append([]any{serviceEndpoints(conf.Endpoints)}, awsCfg.ConfigSources...)
+	}
+	awsCfg.APIOptions = append(awsCfg.APIOptions, telemetry.RecordAPICalls, gd.ReportThrottles, gd.CountCalls, detectExpiredCredentials(profile, sessions))
+	if telemetry.TracingEnabled() {
+		awsCfg.APIOptions = append(awsCfg.APIOptions, telemetry.TraceAPICalls)
+	}
+	if profile == conf.Profile && conf.Credentials.configured() && !conf.Synthetic.enabled() {
+		provider, err := configuredCredentials(ctx, conf, awsCfg)
+		if err != nil {
+			return aws.Config{}, err
+		}
+		awsCfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	return awsCfg, nil
+}
+
+// profileConfigs caches the SDK configuration of each profile selected by an
+// export, so its cached credentials, such as an SSO token or an assumed
+// role, are reused by later exports
+type profileConfigs struct {
+	mu      sync.Mutex
+	configs map[string]aws.Config
+}
+
+func newProfileConfigs() *profileConfigs {
+	return &profileConfigs{configs: make(map[string]aws.Config)}
+}
+
+// awsClients returns the clients exports call GuardDuty, EC2, and STS
+// through: those of the synthetic findings when they are on, or the SDK's
+func (a *App) awsClients() gd.Clients {
+	if a.clients == nil {
+		return gd.SDKClients{}
+	}
+	return a.clients
+}
+
+// profileConfig returns the SDK configuration of profile. The configured
+// profile uses the exporter's own configuration.
+func (a *App) profileConfig(profile string) (aws.Config, error) {
+	if profile == a.config().Profile {
+		return a.awsCfg, nil
+	}
+	a.profiles.mu.Lock()
+	defer a.profiles.mu.Unlock()
+	if cfg, ok := a.profiles.configs[profile]; ok {
+		return cfg, nil
+	}
+	cfg, err := loadAWSConfig(context.Background(), *a.config(), profile, a.sso)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	a.profiles.configs[profile] = cfg
+	return cfg, nil
+}
+
+// handleProfiles returns the profiles of the shared config files, the
+// profile used when an export selects none, and whether SSO sign-in and
+// enabling detectors from the server are enabled
+func (a *App) handleProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, err := listProfiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"profiles":        profiles,
+		"default":         a.config().Profile,
+		"ssoLogin":        a.config().SSOLogin,
+		"enableDetectors": a.config().EnableDetectors,
+	})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+)
+
+// publishingNoDestination is the status of a publishing report row for a
+// region that does not publish its findings anywhere
+const publishingNoDestination = "NO_DESTINATION"
+
+// publishingReport lists the publishing destinations of the accounts and
+// regions of an export
+func publishingReport(ctx context.Context, opts gd.FetchOptions) reportOutput {
+	inventory := gd.ListPublishingDestinations(ctx, opts)
+	out := reportOutput{value: inventory, table: publishingTable(inventory), regions: len(inventory.Regions)}
+	for _, region := range inventory.Regions {
+		if region.Error != "" {
+			out.failed++
+		}
+	}
+	return out
+}
+
+// publishingTable lays out a publishing inventory as one row per
+// destination, followed by a row for each region without a destination,
+// that was skipped, or that could not be listed
+func publishingTable(inventory gd.PublishingInventory) export.Table {
+	table := export.Table{
+		Name:    "Publishing Destinations",
+		Columns: []string{"AccountId", "Region", "DetectorId", "DestinationId", "DestinationType", "DestinationArn", "KmsKeyArn", "Status", "Healthy", "FailingSince", "Notes"},
+	}
+	for _, d := range inventory.Destinations {
+		failingSince := ""
+		if d.FailingSince != nil {
+			failingSince = d.FailingSince.Format(time.RFC3339)
+		}
+		table.Rows = append(table.Rows, []any{d.Account, d.Region, d.DetectorID, d.ID, d.Type, d.DestinationArn, d.KmsKeyArn, d.Status, d.Healthy, failingSince, ""})
+	}
+	for _, region := range inventory.Regions {
+		switch {
+		case region.Error != "":
+			table.Rows = append(table.Rows, []any{region.Account, region.Region, "", "", "", "", "", inventoryError, "", "", region.Error})
+		case region.Skipped != "":
+			table.Rows = append(table.Rows, []any{region.Account, region.Region, "", "", "", "", "", inventorySkipped, "", "", region.Skipped})
+		case region.Destinations == 0:
+			table.Rows = append(table.Rows, []any{region.Account, region.Region, "", "", "", "", "", publishingNoDestination, false, "", "GuardDuty does not publish the findings of this region"})
+		}
+	}
+	return table
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// jobQueue limits how many export jobs run at once, and how many of them
+// export the same AWS account, so one user's large export doesn't hold up
+// everyone else's or draw throttling onto the exports sharing its account.
+// Waiting jobs start in turn across users: the next to start is the oldest
+// job of the user with the fewest running, among those whose accounts have
+// room.
+type jobQueue struct {
+	mu            sync.Mutex
+	maxJobs       int
+	maxPerAccount int
+	// waiting are the queued jobs in the order they were started
+	waiting []*queueEntry
+	running int
+	// accounts and users count the running jobs of each account and user
+	accounts map[string]int
+	users    map[string]int
+}
+
+// queueEntry is a job waiting for, or holding, one of the queue's slots
+type queueEntry struct {
+	job      *Job
+	user     string
+	accounts []string
+	// ready is closed once the job may start
+	ready chan struct{}
+}
+
+// newJobQueue returns a queue running at most maxJobs jobs, and at most
+// maxPerAccount jobs of each account; zero means no limit
+func newJobQueue(maxJobs, maxPerAccount int) *jobQueue {
+	return &jobQueue{maxJobs: maxJobs, maxPerAccount: maxPerAccount, accounts: make(map[string]int), users: make(map[string]int)}
+}
+
+// add queues a job, starting it at once when there is room, and returns
+// its entry
+func (q *jobQueue) add(job *Job) *queueEntry {
+	entry := &queueEntry{job: job, user: job.opts.user, accounts: job.opts.AccountKeys(), ready: make(chan struct{})}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.waiting = append(q.waiting, entry)
+	q.dispatch()
+	return entry
+}
+
+// wait blocks until the job of entry has started, after which release must
+// free its slot. A job whose ctx is done first leaves the queue with ctx's
+// error.
+func (q *jobQueue) wait(ctx context.Context, entry *queueEntry) error {
+	select {
+	case <-entry.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.Index(q.waiting, entry)
+	if i < 0 {
+		// The job was started as it was canceled
+		return nil
+	}
+	q.waiting = slices.Delete(q.waiting, i, i+1)
+	q.dispatch()
+	return ctx.Err()
+}
+
+// release frees the slot of a job that has finished and starts the jobs
+// waiting for it
+func (q *jobQueue) release(entry *queueEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running--
+	decrement(q.users, entry.user)
+	for _, account := range entry.accounts {
+		decrement(q.accounts, account)
+	}
+	q.dispatch()
+}
+
+// dispatch starts waiting jobs while there are free slots, then tells the
+// rest their place in line. q.mu must be held.
+func (q *jobQueue) dispatch() {
+	for q.maxJobs <= 0 || q.running < q.maxJobs {
+		i := q.next()
+		if i < 0 {
+			break
+		}
+		entry := q.waiting[i]
+		q.waiting = slices.Delete(q.waiting, i, i+1)
+		q.running++
+		q.users[entry.user]++
+		for _, account := range entry.accounts {
+			q.accounts[account]++
+		}
+		entry.job.start()
+		close(entry.ready)
+	}
+	for i, entry := range q.waiting {
+		entry.job.queued(i + 1)
+	}
+}
+
+// next returns the index of the waiting job to start next, or -1 when no
+// waiting job has room in all of its accounts. q.mu must be held.
+func (q *jobQueue) next() int {
+	best := -1
+	for i, entry := range q.waiting {
+		if !q.hasRoom(entry) {
+			continue
+		}
+		if best < 0 || q.users[entry.user] < q.users[q.waiting[best].user] {
+			best = i
+		}
+	}
+	return best
+}
+
+// hasRoom reports whether every account of entry runs fewer jobs than the
+// per-account limit. q.mu must be held.
+func (q *jobQueue) hasRoom(entry *queueEntry) bool {
+	if q.maxPerAccount <= 0 {
+		return true
+	}
+	for _, account := range entry.accounts {
+		if q.accounts[account] >= q.maxPerAccount {
+			return false
+		}
+	}
+	return true
+}
+
+// countWaiting returns the number of queued jobs
+func (q *jobQueue) countWaiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+// decrement lowers the count of key, removing it at zero
+func decrement(counts map[string]int, key string) {
+	counts[key]--
+	if counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+
+	"guardduty/internal/telemetry"
+)
+
+// auditConfigReload is the action of config reloads on SIGHUP; those of
+// POST /api/config/reload are recorded as requests
+const auditConfigReload = "config.reload"
+
+// reloadableSettings are the settings, by their YAML name, that a config
+// reload applies. They are read each time an export, schedule, or delivery
+// uses them. The others set up what the server built as it started, such as
+// its listeners, AWS SDK configuration, caches, and files, and keep their
+// values until it restarts.
+var reloadableSettings = map[string]bool{
+	"regions":          true,
+	"regionScope":      true,
+	"concurrency":      true,
+	"timeout":          true,
+	"callTimeout":      true,
+	"minSeverity":      true,
+	"format":           true,
+	"columns":          true,
+	"csvSanitize":      true,
+	"csvBom":           true,
+	"locale":           true,
+	"columnMappings":   true,
+	"batchSize":        true,
+	"batchRetries":     true,
+	"maxFindings":      true,
+	"maxDuration":      true,
+	"roles":            true,
+	"suppressionsFile": true,
+	"discovery":        true,
+	"credentialMap":    true,
+	"destination":      true,
+	"s3":               true,
+	"athena":           true,
+	"splunk":           true,
+	"elasticsearch":    true,
+	"syslog":           true,
+	"http":             true,
+	"email":            true,
+	"jira":             true,
+	"encryption":       true,
+	"webhooks":         true,
+	"publicUrl":        true,
+	"retention":        true,
+	"logFormat":        true,
+	"logLevel":         true,
+	"schedules":        true,
+}
+
+// reloadView is the outcome of a config reload
+type reloadView struct {
+	// Changed lists the settings the reload applied, and RestartRequired
+	// those that changed in the config but keep their values until the
+	// server restarts
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restartRequired"`
+	// Schedules counts the schedules of the config added, updated, and
+	// removed
+	Schedules scheduleChanges `json:"schedules"`
+}
+
+// scheduleChanges counts the schedules a reload changed
+type scheduleChanges struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Removed int `json:"removed"`
+}
+
+// settingName returns the YAML name of a Config field
+func settingName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	return name
+}
+
+// reloadConfig reads the config again, from the file, environment, and
+// flags the server was started with, and applies its reloadable settings.
+// Jobs already running keep the settings they started with. A config that
+// cannot be loaded, or whose schedules are invalid, changes nothing.
+func (a *App) reloadConfig(ctx context.Context) (reloadView, error) {
+	a.reloading.Lock()
+	defer a.reloading.Unlock()
+
+	conf, err := a.loadConfig()
+	if err != nil {
+		return reloadView{}, err
+	}
+	old := a.config()
+	view := reloadView{Changed: []string{}, RestartRequired: []string{}}
+	next, prev := reflect.ValueOf(&conf).Elem(), reflect.ValueOf(old).Elem()
+	for i := 0; i < next.NumField(); i++ {
+		if reflect.DeepEqual(next.Field(i).Interface(), prev.Field(i).Interface()) {
+			continue
+		}
+		name := settingName(next.Type().Field(i))
+		if reloadableSettings[name] {
+			view.Changed = append(view.Changed, name)
+			continue
+		}
+		view.RestartRequired = append(view.RestartRequired, name)
+		next.Field(i).Set(prev.Field(i))
+	}
+
+	// Schedules are checked against the new defaults, so the new config is
+	// put in place first and taken back if one is invalid
+	a.current.Store(&conf)
+	if view.Schedules, err = a.syncSchedules(conf.Schedules); err != nil {
+		a.current.Store(old)
+		return reloadView{}, fmt.Errorf("Invalid config, %v", err)
+	}
+	if conf.LogFormat != old.LogFormat || conf.LogLevel != old.LogLevel {
+		slog.SetDefault(telemetry.NewLogger(os.Stdout, conf.LogFormat, conf.LogLevel))
+	}
+
+	log := telemetry.Logger(ctx)
+	log.Info("Reloaded config", "changed", view.Changed, "schedules_added", view.Schedules.Added, "schedules_updated", view.Schedules.Updated, "schedules_removed", view.Schedules.Removed)
+	if len(view.RestartRequired) > 0 {
+		log.Warn("Some changed settings take effect only after a restart", "settings", view.RestartRequired)
+	}
+	return view, nil
+}
+
+// syncSchedules makes the schedules of the config file those of configs. A
+// schedule is matched by its name, or by its whole definition if it has
+// none, so matched schedules keep their ID and history. Schedules created
+// through the API are left alone. Every schedule is checked before any is
+// changed, and the schedules file is saved after.
+func (a *App) syncSchedules(configs []scheduleConfig) (scheduleChanges, error) {
+	specs := make([]cronSpec, len(configs))
+	for i, config := range configs {
+		spec, err := a.checkSchedule(config)
+		if err != nil {
+			return scheduleChanges{}, fmt.Errorf("invalid schedule %q: %v", config.Name, err)
+		}
+		specs[i] = spec
+	}
+
+	var existing []*Schedule
+	for _, s := range a.schedules.list() {
+		if s.fromConfig {
+			existing = append(existing, s)
+		}
+	}
+	var changes scheduleChanges
+	for i, config := range configs {
+		match := -1
+		for j, s := range existing {
+			if s == nil {
+				continue
+			}
+			current := s.definition()
+			if (config.Name != "" && current.Name == config.Name) || (config.Name == "" && current.Name == "" && reflect.DeepEqual(current, config)) {
+				match = j
+				break
+			}
+		}
+		if match < 0 {
+			a.schedules.add(&Schedule{id: newJobID(), config: config, spec: specs[i], fromConfig: true})
+			changes.Added++
+			continue
+		}
+		if s := existing[match]; !reflect.DeepEqual(s.definition(), config) {
+			s.update(config, specs[i])
+			changes.Updated++
+		}
+		existing[match] = nil
+	}
+	for _, s := range existing {
+		if s != nil {
+			a.schedules.remove(s.id)
+			changes.Removed++
+		}
+	}
+	a.saveSchedules(context.Background())
+	return changes, nil
+}
+
+// reloadOnHangup reloads the config each time the process receives SIGHUP
+// on hangup, until ctx is done
+func (a *App) reloadOnHangup(ctx context.Context, hangup <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		}
+		entry := auditEntry{Action: auditConfigReload, Outcome: jobSucceeded}
+		if _, err := a.reloadConfig(ctx); err != nil {
+			slog.Error("Error reloading config", "error", err)
+			entry.Outcome, entry.Error = jobFailed, err.Error()
+		}
+		a.recordAudit(ctx, entry)
+	}
+}
+
+// handleReloadConfig reloads the config and returns what changed
+func (a *App) handleReloadConfig(w http.ResponseWriter, r *http.Request) {
+	view, err := a.reloadConfig(r.Context())
+	if err != nil {
+		telemetry.Logger(r.Context()).Error("Error reloading config", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
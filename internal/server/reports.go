@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// Reports that an export produces in place of its findings, each selected by
+// setting its query parameter to true
+const (
+	reportCoverage     = "coverage"
+	reportUsage        = "usage"
+	reportMalwareScans = "malwareScans"
+	reportIPSets       = "ipSets"
+	reportMembers      = "members"
+	reportFilters      = "filters"
+	reportPublishing   = "publishingDestinations"
+	reportPosture      = "posture"
+)
+
+// reportOutput is the outcome of a report: its value, written as JSON, and
+// the same report laid out as a table for the other formats. failed counts
+// the regions of the report that could not be queried.
+type reportOutput struct {
+	value   any
+	table   export.Table
+	failed  int
+	regions int
+}
+
+// reportKind describes how a report is produced and what its files are
+// named after
+type reportKind struct {
+	file  string
+	build func(ctx context.Context, opts gd.FetchOptions) reportOutput
+}
+
+// reports lists the reports by query parameter
+var reports = map[string]reportKind{
+	reportCoverage:     {file: "guardduty_coverage", build: coverageReport},
+	reportUsage:        {file: "guardduty_usage", build: usageReport},
+	reportMalwareScans: {file: "guardduty_malware_scans", build: malwareScanReport},
+	reportIPSets:       {file: "guardduty_ipsets", build: ipSetReport},
+	reportMembers:      {file: "guardduty_members", build: memberReport},
+	reportFilters:      {file: "guardduty_filters", build: filterReport},
+	reportPublishing:   {file: "guardduty_publishing_destinations", build: publishingReport},
+	reportPosture:      {file: "guardduty_posture", build: postureReport},
+}
+
+// reportNames are the report query parameters in the order they are checked
+var reportNames = []string{reportCoverage, reportUsage, reportMalwareScans, reportIPSets, reportMembers, reportFilters, reportPublishing, reportPosture}
+
+// parseReport sets opts.report from the report query parameters, and checks
+// the options it is combined with. Reports are JSON or one of the table
+// formats, and are neither compressed nor partitioned.
+func parseReport(query url.Values, opts *exportOptions) error {
+	for _, name := range reportNames {
+		if set, _ := strconv.ParseBool(query.Get(name)); !set {
+			continue
+		}
+		if opts.report != "" || opts.dryRun {
+			return fmt.Errorf("Only one of dryRun, coverage, usage, malwareScans, ipSets, members, filters, publishingDestinations, and posture can be set")
+		}
+		opts.report = name
+	}
+	if opts.report == "" {
+		return nil
+	}
+	if opts.Format != "json" && !export.ValidTableFormat(opts.Format) {
+		return fmt.Errorf("Invalid format %q: reports are csv, json, ndjson, or xlsx", opts.Format)
+	}
+	if opts.Compression != "" || opts.partition {
+		return fmt.Errorf("Reports cannot be compressed, split, or partitioned")
+	}
+	filter := opts.Filter
+	if opts.report == reportUsage && (!filter.CreatedAfter.IsZero() || !filter.CreatedBefore.IsZero() || !filter.UpdatedAfter.IsZero() || !filter.UpdatedBefore.IsZero()) {
+		return fmt.Errorf("Usage reports cover the last 30 days, which GuardDuty does not narrow down by date")
+	}
+	return nil
+}
+
+// reportFilename is the name of a report written at t
+func reportFilename(report string, t time.Time, format string) string {
+	return fmt.Sprintf("%s_%s.%s", reports[report].file, t.Format("20060102_150405"), export.Formats[format].Extension)
+}
+
+// writeReportOutput writes out in the format of opts
+func writeReportOutput(w io.Writer, opts exportOptions, out reportOutput) error {
+	if opts.Format != "json" {
+		return export.WriteTable(w, opts.WriteOptions, out.table)
+	}
+	encoder := json.NewEncoder(w)
+	if opts.Pretty {
+		encoder.SetIndent("", "  ")
+	}
+	return encoder.Encode(out.value)
+}
+
+// serveReport answers an export that selects a report with the report, as
+// JSON or as a download in one of the table formats
+func (a *App) serveReport(w http.ResponseWriter, r *http.Request, opts exportOptions) {
+	out := reports[opts.report].build(r.Context(), opts.FetchOptions)
+	log := telemetry.Logger(r.Context())
+	log.Info("Report completed", "report", opts.report, "regions", opts.Regions, "failed_regions", out.failed)
+	if opts.Format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", export.Formats[opts.Format].ContentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", reportFilename(opts.report, time.Now(), opts.Format)))
+	}
+	if err := writeReportOutput(w, opts, out); err != nil {
+		log.Error("Error writing report", "report", opts.report, "error", err)
+	}
+}
+
+// runReport writes the report of a command-line export to path, to stdout
+// when path is "-", or to a timestamped file in the output directory. A
+// region that could not be queried fails the command once every region is
+// written.
+func (a *App) runReport(ctx context.Context, opts exportOptions, path string, stdout io.Writer) error {
+	out := reports[opts.report].build(ctx, opts.FetchOptions)
+	path, err := a.writeReport(ctx, path, reportFilename(opts.report, time.Now(), opts.Format), stdout, func(w io.Writer) error {
+		return writeReportOutput(w, opts, out)
+	})
+	if err != nil {
+		return err
+	}
+	telemetry.Logger(ctx).Info("Report completed", "report", opts.report, "failed_regions", out.failed, "file", path)
+	if out.failed > 0 {
+		return fmt.Errorf("error getting the %s report in %d of %d regions", opts.report, out.failed, out.regions)
+	}
+	return nil
+}
+
+// writeReport writes a report of a command-line export with write: to path,
+// to stdout when path is "-", or to the file name in the output directory
+// when path is empty. A report written to a file is encrypted when
+// encryption is on and gets its checksum and signature beside it. It returns
+// where the report went, and removes a file left by a failed write.
+func (a *App) writeReport(ctx context.Context, path, name string, stdout io.Writer, write func(io.Writer) error) (string, error) {
+	if path == "-" {
+		if err := write(stdout); err != nil {
+			return path, fmt.Errorf("error writing report: %v", err)
+		}
+		return path, nil
+	}
+	if path == "" {
+		path = filepath.Join(a.config().OutputDir, a.storedName(name, ""))
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return path, fmt.Errorf("error creating file: %v", err)
+	}
+	out, err := a.encryptExport(ctx, file)
+	if err == nil {
+		if err = write(out); err == nil {
+			err = out.Close()
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return path, fmt.Errorf("error writing report: %v", err)
+	}
+	if _, err := a.sealExport(ctx, path, filepath.Base(path)); err != nil {
+		removeExportFile(path)
+		return path, err
+	}
+	return path, nil
+}
+
+// reportCell is a table cell for a count that GuardDuty may leave out
+func reportCell(n *int64) any {
+	if n == nil {
+		return ""
+	}
+	return float64(*n)
+}
+
+// reportTime is a table cell for a time that GuardDuty may leave out
+func reportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"guardduty/internal/gd"
+)
+
+// resourceStateConfig looks up whether the resource of each finding still
+// exists and its current state, such as a terminated instance, a bucket
+// that blocks public access, or an EKS cluster's version, for the
+// ResourceExists and ResourceState columns
+type resourceStateConfig struct {
+	// Enabled looks up states for every export that doesn't set
+	// resourceState=false
+	Enabled bool `yaml:"enabled"`
+	// Concurrency is the most EC2, S3, and EKS calls in flight at once
+	// across the exports of the server
+	Concurrency int `yaml:"concurrency"`
+	// CacheTTL is how long the state of a resource is reused before it is
+	// looked up again
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+}
+
+func (c resourceStateConfig) validate() error {
+	if c.Concurrency < 1 {
+		return fmt.Errorf("invalid resourceState.concurrency %d: must be at least 1", c.Concurrency)
+	}
+	if c.CacheTTL <= 0 {
+		return fmt.Errorf("invalid resourceState.cacheTTL %v: must be positive", c.CacheTTL)
+	}
+	return nil
+}
+
+// parseResourceState reads the resourceState export option, defaulting to
+// the resourceState.enabled setting. Exports that look up states and name
+// no columns get the state columns after the default ones.
+func (a *App) parseResourceState(query url.Values, opts *exportOptions) error {
+	enabled := a.config().ResourceState.Enabled
+	if v := query.Get("resourceState"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Invalid resourceState %q", v)
+		}
+		enabled = b
+	}
+	if !enabled {
+		return nil
+	}
+	opts.FetchOptions.ResourceState, opts.States = a.states, a.states
+	if len(query["columns"]) == 0 {
+		opts.Columns = appendColumns(opts.Columns, gd.ResourceStateColumns)
+	}
+	return nil
+}
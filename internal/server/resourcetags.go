@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"guardduty/internal/gd"
+)
+
+// resourceTagsConfig looks up the current tags of the resource of each
+// finding through the Resource Groups Tagging API, for the Owner, Team,
+// Environment, and CostCenter columns
+type resourceTagsConfig struct {
+	// Enabled looks up tags for every export that doesn't set
+	// resourceTags=false
+	Enabled bool `yaml:"enabled"`
+	// Concurrency is the most GetResources calls in flight at once across
+	// the exports of the server
+	Concurrency int `yaml:"concurrency"`
+	// CacheTTL is how long the tags of a resource are reused before they
+	// are looked up again
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+}
+
+func (c resourceTagsConfig) validate() error {
+	if c.Concurrency < 1 {
+		return fmt.Errorf("invalid resourceTags.concurrency %d: must be at least 1", c.Concurrency)
+	}
+	if c.CacheTTL <= 0 {
+		return fmt.Errorf("invalid resourceTags.cacheTTL %v: must be positive", c.CacheTTL)
+	}
+	return nil
+}
+
+// parseResourceTags reads the resourceTags export option, defaulting to the
+// resourceTags.enabled setting. Exports that look up tags and name no
+// columns get the tag columns after the default ones.
+func (a *App) parseResourceTags(query url.Values, opts *exportOptions) error {
+	enabled := a.config().ResourceTags.Enabled
+	if v := query.Get("resourceTags"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Invalid resourceTags %q", v)
+		}
+		enabled = b
+	}
+	if !enabled {
+		return nil
+	}
+	opts.ResourceTags = a.tags
+	if len(query["columns"]) == 0 {
+		opts.Columns = appendColumns(opts.Columns, gd.ResourceTagKeys)
+	}
+	return nil
+}
+
+// appendColumns returns columns followed by those of extra it lacks
+func appendColumns(columns, extra []string) []string {
+	columns = slices.Clone(columns)
+	for _, column := range extra {
+		if !slices.Contains(columns, column) {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"guardduty/internal/telemetry"
+)
+
+// retentionInterval is how often the server applies the retention policy,
+// in addition to after each export it saves
+const retentionInterval = time.Hour
+
+// deletedExportsDir is the directory of OutputDir that soft-deleted exports
+// are moved to until they are purged
+const deletedExportsDir = ".deleted"
+
+// retentionConfig removes what the exporter keeps once it is too old: the
+// exports saved in OutputDir, also once they take up too much space, the
+// runs of the history, the findings of the store, the entries of the audit
+// file, and finished jobs with their artifacts. With nothing set,
+// everything is kept forever.
+type retentionConfig struct {
+	// MaxAge deletes the exports saved longer ago, such as 720h for 30 days
+	MaxAge time.Duration `yaml:"maxAge"`
+	// MaxSizeMB deletes the oldest exports until the rest fit in this many
+	// megabytes. The newest export is always kept.
+	MaxSizeMB int64 `yaml:"maxSizeMb"`
+	// HistoryMaxAge deletes the runs of the history that started longer ago
+	HistoryMaxAge time.Duration `yaml:"historyMaxAge"`
+	// StoreMaxAge deletes the findings of the store that no export has
+	// fetched for this long
+	StoreMaxAge time.Duration `yaml:"storeMaxAge"`
+	// AuditMaxAge purges the entries of the audit file written longer ago.
+	// The entries in CloudWatch Logs are kept for the retention of their
+	// log group.
+	AuditMaxAge time.Duration `yaml:"auditMaxAge"`
+	// JobMaxAge removes the jobs that finished longer ago, with their
+	// artifacts in the temporary directory. Jobs are held in memory, so they
+	// are removed without a purge delay.
+	JobMaxAge time.Duration `yaml:"jobMaxAge"`
+	// PurgeDelay soft-deletes exports, runs, and findings for this long
+	// before purging them, so they can be restored if a policy was wrong:
+	// until then exports are moved to the .deleted directory of OutputDir,
+	// and runs and findings are hidden. Zero purges them right away.
+	PurgeDelay time.Duration `yaml:"purgeDelay"`
+}
+
+// enabled reports whether saved exports are ever deleted
+func (c retentionConfig) enabled() bool {
+	return c.MaxAge > 0 || c.MaxSizeMB > 0
+}
+
+func (c retentionConfig) validate() error {
+	if c.MaxAge < 0 {
+		return fmt.Errorf("invalid retention.maxAge %v: must not be negative", c.MaxAge)
+	}
+	if c.MaxSizeMB < 0 {
+		return fmt.Errorf("invalid retention.maxSizeMb %d: must not be negative", c.MaxSizeMB)
+	}
+	if c.HistoryMaxAge < 0 {
+		return fmt.Errorf("invalid retention.historyMaxAge %v: must not be negative", c.HistoryMaxAge)
+	}
+	if c.StoreMaxAge < 0 {
+		return fmt.Errorf("invalid retention.storeMaxAge %v: must not be negative", c.StoreMaxAge)
+	}
+	if c.AuditMaxAge < 0 {
+		return fmt.Errorf("invalid retention.auditMaxAge %v: must not be negative", c.AuditMaxAge)
+	}
+	if c.JobMaxAge < 0 {
+		return fmt.Errorf("invalid retention.jobMaxAge %v: must not be negative", c.JobMaxAge)
+	}
+	if c.PurgeDelay < 0 {
+		return fmt.Errorf("invalid retention.purgeDelay %v: must not be negative", c.PurgeDelay)
+	}
+	return nil
+}
+
+// soft reports whether what the policy deletes is soft-deleted rather than
+// purged, unless purge asks for it to be purged now
+func (c retentionConfig) soft(purge bool) bool {
+	return c.PurgeDelay > 0 && !purge
+}
+
+// expired reports whether something soft-deleted at deletedAt is past the
+// policy's purge delay, or purge asks for it to be purged now
+func (c retentionConfig) expired(now, deletedAt time.Time, purge bool) bool {
+	return purge || now.Sub(deletedAt) > c.PurgeDelay
+}
+
+// retentionCounts is what a pass of the retention policy removed from one
+// kind of data
+type retentionCounts struct {
+	// Deleted were soft-deleted, and Purged removed for good
+	Deleted int `json:"deleted"`
+	Purged  int `json:"purged"`
+	// Restored were soft-deleted and brought back
+	Restored int `json:"restored,omitempty"`
+}
+
+// retentionView is the JSON form of a pass of the retention policy
+type retentionView struct {
+	Exports retentionCounts `json:"exports"`
+	History retentionCounts `json:"history"`
+	Store   retentionCounts `json:"store"`
+	Audit   retentionCounts `json:"audit"`
+	// Jobs counts the finished jobs removed, and Artifacts their files
+	Jobs      retentionCounts `json:"jobs"`
+	Artifacts retentionCounts `json:"artifacts"`
+}
+
+// empty reports whether the pass changed nothing
+func (v retentionView) empty() bool {
+	return v == retentionView{}
+}
+
+// applyRetention deletes the saved exports older than the retention policy's
+// MaxAge, then the oldest exports until the rest fit in its MaxSizeMB. The
+// newest export is kept whatever its size, so an export larger than the
+// quota is not deleted as soon as it is written. With a purge delay the
+// exports are soft-deleted.
+func (a *App) applyRetention(ctx context.Context) {
+	if _, err := a.retireExports(ctx, a.config().Retention, time.Now(), false); err != nil {
+		telemetry.Logger(ctx).Error("Error applying retention policy", "error", err)
+	}
+}
+
+// retireExports deletes the saved exports the policy no longer keeps, then
+// purges the soft-deleted exports past its purge delay, or all of them with
+// purge
+func (a *App) retireExports(ctx context.Context, policy retentionConfig, now time.Time, purge bool) (retentionCounts, error) {
+	var counts retentionCounts
+	dir := a.config().OutputDir
+	log := telemetry.Logger(ctx)
+	if policy.enabled() {
+		exports, err := listSavedExports(dir)
+		if err != nil {
+			return counts, err
+		}
+		var kept int64
+		full := false
+		for i, saved := range exports {
+			var reason string
+			switch {
+			case policy.MaxAge > 0 && now.Sub(saved.createdAt) > policy.MaxAge:
+				reason = "maxAge"
+			case full, i > 0 && policy.MaxSizeMB > 0 && kept+saved.size > policy.MaxSizeMB<<20:
+				// Once the quota is reached every older export is deleted,
+				// so a small old export does not outlive a larger newer one
+				full = true
+				reason = "maxSizeMb"
+			}
+			if reason == "" {
+				kept += saved.size
+				continue
+			}
+			soft := policy.soft(purge)
+			if soft {
+				err = moveSavedExport(dir, filepath.Join(dir, deletedExportsDir), saved.name, now)
+			} else {
+				err = removeSavedExport(dir, saved.name)
+			}
+			if err != nil {
+				log.Error("Error deleting saved export", "file", saved.name, "error", err)
+				kept += saved.size
+				continue
+			}
+			if soft {
+				counts.Deleted++
+			} else {
+				counts.Purged++
+			}
+			log.Info("Deleted saved export", "file", saved.name, "reason", reason, "soft", soft, "created_at", saved.createdAt, "size", saved.size)
+		}
+	}
+
+	deleted, err := listDeletedExports(dir)
+	if err != nil {
+		return counts, err
+	}
+	for name, deletedAt := range deleted {
+		if !policy.expired(now, deletedAt, purge) {
+			continue
+		}
+		if err := removeSavedExport(filepath.Join(dir, deletedExportsDir), name); err != nil {
+			log.Error("Error purging saved export", "file", name, "error", err)
+			continue
+		}
+		counts.Purged++
+		log.Info("Purged saved export", "file", name, "deleted_at", deletedAt)
+	}
+	return counts, nil
+}
+
+// listDeletedExports returns the soft-deleted exports of dir with when they
+// were deleted, which is their modification time
+func listDeletedExports(dir string) (map[string]time.Time, error) {
+	trash := filepath.Join(dir, deletedExportsDir)
+	entries, err := os.ReadDir(trash)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %v", trash, err)
+	}
+	deleted := make(map[string]time.Time)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !validSavedExportName(entry.Name()) || isSidecar(entry.Name()) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			deleted[entry.Name()] = info.ModTime()
+		}
+	}
+	return deleted, nil
+}
+
+// moveSavedExport moves a saved export, its checksum and signature, and its
+// metadata from one directory to another, and sets the export's
+// modification time to now, which is when a soft-deleted export was deleted
+func moveSavedExport(from, to, name string, now time.Time) error {
+	if err := os.MkdirAll(to, 0o755); err != nil {
+		return err
+	}
+	files := []string{name, filepath.Base(metaPath(from, name))}
+	for _, suffix := range sidecarSuffixes {
+		files = append(files, name+suffix)
+	}
+	for _, file := range files {
+		if err := os.Rename(filepath.Join(from, file), filepath.Join(to, file)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Chtimes(filepath.Join(to, name), now, now)
+}
+
+// retireJobs removes the jobs that finished longer ago than the policy's
+// JobMaxAge, with their artifacts and checkpoints
+func (a *App) retireJobs(ctx context.Context, policy retentionConfig, now time.Time) (jobs, artifacts retentionCounts) {
+	if policy.JobMaxAge <= 0 {
+		return jobs, artifacts
+	}
+	for _, job := range a.jobs.finishedBefore(now.Add(-policy.JobMaxAge)) {
+		job.mu.Lock()
+		path, checkpoint, finishedAt := job.path, job.opts.Checkpoint, job.finishedAt
+		job.mu.Unlock()
+		if a.removeJob(ctx, job.id, path, checkpoint) {
+			artifacts.Purged++
+		}
+		jobs.Purged++
+		telemetry.Logger(ctx).Info("Removed finished job", "job_id", job.id, "finished_at", finishedAt, "artifact", path)
+	}
+	return jobs, artifacts
+}
+
+// enforceRetention applies every retention policy: it deletes the saved
+// exports, runs, and findings the policy no longer keeps, purges the audit
+// entries past auditMaxAge, and removes the jobs past jobMaxAge, then purges what was soft-deleted longer
+// ago than the purge delay, or all of it with purge. Each kind of data is
+// retired whatever happens to the others; the first error is returned.
+func (a *App) enforceRetention(ctx context.Context, purge bool) (retentionView, error) {
+	policy := a.config().Retention
+	now := time.Now()
+	var view retentionView
+	var errs []error
+	var err error
+	if view.Exports, err = a.retireExports(ctx, policy, now, purge); err != nil {
+		errs = append(errs, fmt.Errorf("error retiring saved exports: %v", err))
+	}
+	if view.History, err = a.history.retire(now, policy, purge); err != nil {
+		errs = append(errs, err)
+	}
+	if a.store != nil {
+		if view.Store, err = a.store.retire(ctx, now, policy, purge); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if a.audit != nil && policy.AuditMaxAge > 0 {
+		if view.Audit.Purged, err = a.audit.purge(now.Add(-policy.AuditMaxAge)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	view.Jobs, view.Artifacts = a.retireJobs(ctx, policy, now)
+	if !view.empty() {
+		telemetry.Logger(ctx).Info("Applied retention policy",
+			"exports_deleted", view.Exports.Deleted, "exports_purged", view.Exports.Purged,
+			"runs_deleted", view.History.Deleted, "runs_purged", view.History.Purged,
+			"findings_deleted", view.Store.Deleted, "findings_purged", view.Store.Purged,
+			"audit_purged", view.Audit.Purged,
+			"jobs_purged", view.Jobs.Purged, "artifacts_purged", view.Artifacts.Purged)
+	}
+	if len(errs) > 0 {
+		return view, errs[0]
+	}
+	return view, nil
+}
+
+// restoreRetention brings back every soft-deleted export, run, and finding
+func (a *App) restoreRetention(ctx context.Context) (retentionView, error) {
+	var view retentionView
+	dir := a.config().OutputDir
+	deleted, err := listDeletedExports(dir)
+	if err != nil {
+		return view, err
+	}
+	now := time.Now()
+	for name := range deleted {
+		if err := moveSavedExport(filepath.Join(dir, deletedExportsDir), dir, name, now); err != nil {
+			return view, fmt.Errorf("error restoring saved export %s: %v", name, err)
+		}
+		view.Exports.Restored++
+	}
+	if view.History.Restored, err = a.history.restore(); err != nil {
+		return view, err
+	}
+	if a.store != nil {
+		if view.Store.Restored, err = a.store.restore(ctx); err != nil {
+			return view, err
+		}
+	}
+	telemetry.Logger(ctx).Info("Restored soft-deleted data", "exports", view.Exports.Restored, "history", view.History.Restored, "store", view.Store.Restored)
+	return view, nil
+}
+
+// runRetention applies the retention policy now and then every
+// retentionInterval until ctx is done. It runs when no policy is set too, so
+// a config reload can add one.
+func (a *App) runRetention(ctx context.Context) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := a.enforceRetention(ctx, false); err != nil {
+			telemetry.Logger(ctx).Error("Error applying retention policy", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handlePurgeRetention applies the retention policy now and purges
+// everything it soft-deleted without waiting for the purge delay,
+// answering with what was removed
+func (a *App) handlePurgeRetention(w http.ResponseWriter, r *http.Request) {
+	view, err := a.enforceRetention(r.Context(), true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
+
+// handleRestoreRetention brings back what the retention policy soft-deleted
+// and has not purged yet. Unless the policy was changed, the next pass
+// deletes it again.
+func (a *App) handleRestoreRetention(w http.ResponseWriter, r *http.Request) {
+	view, err := a.restoreRetention(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
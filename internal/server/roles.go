@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"guardduty/internal/telemetry"
+)
+
+// role is what a principal may do. Each role may do what the ones before it
+// may.
+type role int
+
+const (
+	// roleViewer browses findings, jobs, schedules, and presets, and
+	// downloads past exports
+	roleViewer role = iota
+	// roleOperator also runs exports, cancels jobs, and marks findings
+	roleOperator
+	// roleAdmin also manages schedules, presets, filters, and the server's
+	// AWS credentials
+	roleAdmin
+)
+
+var roleNames = []string{"viewer", "operator", "admin"}
+
+func (r role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// parseRole reads the role of a user or API key, which is admin when not
+// set, as every principal was before roles
+func parseRole(name string) (role, error) {
+	if name == "" {
+		return roleAdmin, nil
+	}
+	for r, n := range roleNames {
+		if n == name {
+			return role(r), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q: must be viewer, operator, or admin", name)
+}
+
+// requestRole returns the role of the principal that made the request ctx
+// belongs to, which is admin when authentication is off
+func requestRole(ctx context.Context) role {
+	p, ok := ctx.Value(principalKey{}).(principal)
+	if !ok {
+		return roleAdmin
+	}
+	return p.role
+}
+
+// authorize rejects requests to a route from principals whose role is below
+// the route's. requireAuth has authenticated them by then.
+func (a *App) authorize(route apiRoute, next http.Handler) http.Handler {
+	if !a.config().Auth.enabled() || route.role == roleViewer {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := requestRole(r.Context()); got < route.role {
+			telemetry.Logger(r.Context()).Warn("Rejected request outside the principal's role", "method", r.Method, "path", r.URL.Path, "role", got.String(), "required_role", route.role.String())
+			http.Error(w, fmt.Sprintf("Your role (%s) does not allow this: it requires %s", got, route.role), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    role
+		wantErr bool
+	}{
+		{name: "", want: roleAdmin},
+		{name: "viewer", want: roleViewer},
+		{name: "operator", want: roleOperator},
+		{name: "admin", want: roleAdmin},
+		{name: "Admin", wantErr: true},
+		{name: "root", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRole(tt.name)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseRole(%q) = %v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseRole(%q) = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	a := &App{}
+	a.current.Store(&Config{Auth: testAuth})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	// The least role of the routes that change state or read the audit log
+	want := map[string]role{
+		"GET /export":            roleOperator,
+		"POST /export":           roleOperator,
+		"POST /schedules":        roleAdmin,
+		"PUT /schedules/{id}":    roleAdmin,
+		"DELETE /schedules/{id}": roleAdmin,
+		"POST /presets":          roleAdmin,
+		"GET /audit":             roleAdmin,
+		"DELETE /jobs/{id}":      roleOperator,
+		"POST /jobs/{id}/resume": roleOperator,
+		"GET /jobs/{id}":         roleViewer,
+		"GET /downloads":         roleViewer,
+		"GET /diff":              roleViewer,
+	}
+	routes := make(map[string]apiRoute)
+	for _, route := range a.apiRoutes() {
+		routes[route.method+" "+route.path] = route
+	}
+	for key, least := range want {
+		route, ok := routes[key]
+		if !ok {
+			t.Errorf("no route %s", key)
+			continue
+		}
+		if route.role != least {
+			t.Errorf("route %s requires %s, want %s", key, route.role, least)
+		}
+	}
+
+	for key, route := range routes {
+		for _, r := range []role{roleViewer, roleOperator, roleAdmin} {
+			req := httptest.NewRequest(route.method, "/api"+route.path, nil)
+			req = req.WithContext(context.WithValue(req.Context(), principalKey{}, principal{name: "user test", role: r}))
+			w := httptest.NewRecorder()
+			a.authorize(route, next).ServeHTTP(w, req)
+			if allowed := w.Code != http.StatusForbidden; allowed != (r >= route.role) {
+				t.Errorf("%s by a %s: got status %d, route requires %s", key, r, w.Code, route.role)
+			}
+		}
+	}
+}
+
+func TestAuthorizeWithoutAuth(t *testing.T) {
+	a := &App{}
+	a.current.Store(&Config{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	w := httptest.NewRecorder()
+	a.authorize(apiRoute{role: roleAdmin}, next).ServeHTTP(w, httptest.NewRequest("GET", "/api/audit", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("got status %d without authentication, want every route open", w.Code)
+	}
+}
+
+func TestViewerForbidden(t *testing.T) {
+	h := testHandler(testAuth)
+	tests := []struct {
+		method, path string
+	}{
+		{"POST", "/api/export"},
+		{"GET", "/api/export"},
+		{"GET", "/api/audit"},
+		{"POST", "/api/v1/export"},
+		{"GET", "/api/v1/audit"},
+		{"POST", "/api/schedules"},
+	}
+	for _, tt := range tests {
+		for _, viewer := range []func(*http.Request){
+			func(r *http.Request) { r.SetBasicAuth("vera", "viewer-password") },
+			func(r *http.Request) { r.Header.Set("X-API-Key", "viewer-key-0123456789") },
+		} {
+			r := httptest.NewRequest(tt.method, tt.path+"?regions=us-east-1", nil)
+			viewer(r)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%s %s by a viewer: got status %d, want 403", tt.method, tt.path, w.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// validateRules checks the rules setting, including that each destination a
+// rule routes findings to is a configured SIEM destination
+func validateRules(c Config) error {
+	if _, err := gd.NewRuleSet(c.Rules); err != nil {
+		return err
+	}
+	for _, rule := range c.Rules {
+		for _, destination := range rule.Route {
+			if !pushesToSIEM(destination) {
+				return fmt.Errorf("invalid rule %q: route %q must be splunk, elasticsearch, syslog, or http", rule.Name, destination)
+			}
+			if err := c.siemConfigured(destination); err != nil {
+				return fmt.Errorf("invalid rule %q: the %s destination it routes to is not configured", rule.Name, destination)
+			}
+		}
+	}
+	return nil
+}
+
+// addRuleColumns adds a column to fields for each tag the rules give
+// findings. A tag named like another column, such as the Team column of
+// resource tags, takes its place where a rule tagged the finding and falls
+// back to it elsewhere.
+func addRuleColumns(rules *gd.RuleSet, fields export.Fields) {
+	for _, name := range rules.TagNames() {
+		fallback, ok := fields[name]
+		if !ok {
+			fallback, _ = export.Column(name)
+		}
+		fields[name] = func(finding types.Finding) string {
+			if value := rules.Tag(finding, name); value != "" || fallback == nil {
+				return value
+			}
+			return fallback(finding)
+		}
+	}
+}
+
+// parseRules reads the rules export option, which applies the rules setting
+// unless it is false. Exports that apply rules and name no columns get the
+// rules' tag columns after the default ones.
+func (a *App) parseRules(query url.Values, opts *exportOptions) error {
+	enabled := true
+	if v := query.Get("rules"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Invalid rules %q", v)
+		}
+		enabled = b
+	}
+	if !enabled || a.rules == nil {
+		return nil
+	}
+	opts.Rules = a.rules
+	if len(query["columns"]) == 0 {
+		opts.Columns = appendColumns(opts.Columns, a.rules.TagNames())
+	}
+	return nil
+}
+
+// routeFindings pushes the findings the rules routed to each destination
+// once the export is stored. A destination that cannot be pushed to is
+// logged without failing the export or the other destinations.
+func (a *App) routeFindings(ctx context.Context, results []gd.RegionResult) {
+	routed := make(map[string][]types.Finding)
+	for _, result := range results {
+		for destination, findings := range result.Routed {
+			routed[destination] = append(routed[destination], findings...)
+		}
+	}
+	for _, destination := range slices.Sorted(maps.Keys(routed)) {
+		findings := routed[destination]
+		stream := gd.StreamResults([]gd.RegionResult{{Findings: findings, Count: len(findings)}})
+		_, _, err := a.pushFindings(ctx, destination, stream)
+		stream.Close()
+		if err != nil {
+			telemetry.Logger(ctx).Error("Error routing findings", "destination", destination, "findings", len(findings), "error", err)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/gd"
+)
+
+func TestExportFieldsPerConfig(t *testing.T) {
+	tagged := Config{Rules: []gd.Rule{{Name: "squad", Tags: map[string]string{"Squad": "blue", "Team": "secops"}}}}
+	rules, err := gd.NewRuleSet(tagged.Rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := exportFields(nil, nil, rules)
+	// The rules tagged no finding yet, so Team falls back to the resource tag
+	finding := types.Finding{Id: aws.String("a"), Resource: &types.Resource{InstanceDetails: &types.InstanceDetails{Tags: []types.Tag{{Key: aws.String("Team"), Value: aws.String("platform")}}}}}
+	if squad, ok := fields["Squad"]; !ok || squad(finding) != "" {
+		t.Errorf("the rule's Squad tag is not an empty export field")
+	}
+	if got := fields["Team"](finding); got != "platform" {
+		t.Errorf("got Team %q, want the resource tag", got)
+	}
+	if err := tagged.columnFields().ValidColumn("Squad"); err != nil {
+		t.Errorf("the config's rule tag is not a valid column: %v", err)
+	}
+
+	// Another config in the same process has none of the rule's columns
+	if err := (Config{}).columnFields().ValidColumn("Squad"); err == nil {
+		t.Errorf("the rule tag of another config is a valid column")
+	}
+	if _, ok := exportFields(nil, nil, nil)["Squad"]; ok {
+		t.Errorf("the rule tag of another config is an export field")
+	}
+}
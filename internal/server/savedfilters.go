@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// handleListFilters lists the saved filters and suppression rules of the
+// accounts and regions selected by the export parameters. It answers as an
+// export with filters=true would, but as JSON unless another format is
+// given.
+func (a *App) handleListFilters(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Form.Set(reportFilters, "true")
+	if r.Form.Get("format") == "" {
+		r.Form.Set("format", "json")
+	}
+	opts, err := a.parseExportOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := gd.ResolveRegions(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+	if err := gd.ResolveAccounts(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+	a.serveReport(w, r, opts)
+}
+
+// handleCreateFilter saves a new filter in the account and region the
+// request selects
+func (a *App) handleCreateFilter(w http.ResponseWriter, r *http.Request) {
+	filter, err := decodeFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.saveFilter(w, r, filter, true)
+}
+
+// handleUpdateFilter replaces the definition of a filter in the account and
+// region the request selects
+func (a *App) handleUpdateFilter(w http.ResponseWriter, r *http.Request) {
+	filter, err := decodeFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.PathValue("name")
+	if filter.Name != "" && filter.Name != name {
+		http.Error(w, fmt.Sprintf("Invalid filter: name %q does not match the URL; filters cannot be renamed", filter.Name), http.StatusBadRequest)
+		return
+	}
+	if len(filter.Tags) > 0 {
+		http.Error(w, "Invalid filter: tags are set when a filter is created and cannot be updated", http.StatusBadRequest)
+		return
+	}
+	filter.Name = name
+	a.saveFilter(w, r, filter, false)
+}
+
+// saveFilter validates and stores a filter created or updated by a request
+func (a *App) saveFilter(w http.ResponseWriter, r *http.Request, filter gd.SavedFilter, create bool) {
+	if err := filter.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filter: %v", err), http.StatusBadRequest)
+		return
+	}
+	opts, status, err := a.targetOptions(r, "Filters are changed")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	save := gd.UpdateSavedFilter
+	if create {
+		save = gd.CreateSavedFilter
+	}
+	saved, err := save(r.Context(), opts.FetchOptions, filter)
+	if err != nil {
+		http.Error(w, err.Error(), a.callErrorStatus(opts, err))
+		return
+	}
+
+	log := telemetry.Logger(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if create {
+		log.Info("Created filter", "region", opts.Regions[0], "filter", saved.Name, "action", saved.Action, "user", opts.user)
+		w.Header().Set("Location", a.path("/api/filters/"+saved.Name))
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		log.Info("Updated filter", "region", opts.Regions[0], "filter", saved.Name, "action", saved.Action, "user", opts.user)
+	}
+	json.NewEncoder(w).Encode(saved)
+}
+
+// handleDeleteFilter deletes a filter in the account and region the request
+// selects
+func (a *App) handleDeleteFilter(w http.ResponseWriter, r *http.Request) {
+	opts, status, err := a.targetOptions(r, "Filters are changed")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	name := r.PathValue("name")
+	if err := gd.DeleteSavedFilter(r.Context(), opts.FetchOptions, name); err != nil {
+		http.Error(w, err.Error(), a.callErrorStatus(opts, err))
+		return
+	}
+	telemetry.Logger(r.Context()).Info("Deleted filter", "region", opts.Regions[0], "filter", name, "user", opts.user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeFilter reads the filter in a request body
+func decodeFilter(r *http.Request) (gd.SavedFilter, error) {
+	var filter gd.SavedFilter
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&filter); err != nil {
+		return filter, fmt.Errorf("Invalid filter: %v", err)
+	}
+	return filter, nil
+}
+
+// filterReport lists the saved filters of the accounts and regions of an
+// export
+func filterReport(ctx context.Context, opts gd.FetchOptions) reportOutput {
+	inventory := gd.ListSavedFilters(ctx, opts)
+	out := reportOutput{value: inventory, table: filterTable(inventory), regions: len(inventory.Regions)}
+	for _, region := range inventory.Regions {
+		if region.Error != "" {
+			out.failed++
+		}
+	}
+	return out
+}
+
+// filterTable lays out a filter inventory as one row per filter, with its
+// criteria as JSON and its tags joined in a cell, followed by a row for each
+// region that was skipped or could not be listed
+func filterTable(inventory gd.SavedFilterInventory) export.Table {
+	table := export.Table{
+		Name:    "Filters",
+		Columns: []string{"AccountId", "Region", "DetectorId", "Name", "Action", "Rank", "Description", "Criteria", "Tags", "Notes"},
+	}
+	for _, f := range inventory.Filters {
+		// Marshaling sorts the fields, so unchanged filters export the same
+		criteria, _ := json.Marshal(f.Criteria)
+		tags := make([]string, 0, len(f.Tags))
+		for key, value := range f.Tags {
+			tags = append(tags, key+"="+value)
+		}
+		sort.Strings(tags)
+		table.Rows = append(table.Rows, []any{f.Account, f.Region, f.DetectorID, f.Name, f.Action, float64(f.Rank), f.Description, string(criteria), strings.Join(tags, "; "), ""})
+	}
+	for _, region := range inventory.Regions {
+		switch {
+		case region.Error != "":
+			table.Rows = append(table.Rows, []any{region.Account, region.Region, "", "", inventoryError, "", "", "", "", region.Error})
+		case region.Skipped != "":
+			table.Rows = append(table.Rows, []any{region.Account, region.Region, "", "", inventorySkipped, "", "", "", "", region.Skipped})
+		}
+	}
+	return table
+}
@@ -0,0 +1,535 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// maxScheduleHistory is the number of runs remembered for each schedule
+const maxScheduleHistory = 20
+
+// defaultSchedulesFile is the name of the schedules file in the output
+// directory when no schedulesFile is configured
+const defaultSchedulesFile = ".guardduty_export_schedules.json"
+
+// errRestartedRun is the error of a saved run whose job was still queued or
+// running when the server stopped
+const errRestartedRun = "The server restarted before the job finished"
+
+// scheduleConfig defines a recurring export. Params are the export query
+// parameters, such as regions, format, or destination, and fill in those of
+// the saved preset named by Preset.
+type scheduleConfig struct {
+	Name   string                 `yaml:"name" json:"name"`
+	Cron   string                 `yaml:"cron" json:"cron"`
+	Preset string                 `yaml:"preset" json:"preset,omitempty"`
+	Params map[string]paramValues `yaml:"params" json:"params"`
+}
+
+// query returns the schedule's export parameters
+func (c scheduleConfig) query() url.Values {
+	query := make(url.Values, len(c.Params)+1)
+	for param, values := range c.Params {
+		query[param] = values
+	}
+	if c.Preset != "" {
+		query.Set("preset", c.Preset)
+	}
+	return query
+}
+
+// paramValues holds the values of one export parameter, which config files
+// and API requests may give as a single value or a list
+type paramValues []string
+
+func (p *paramValues) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*p = paramValues{node.Value}
+		return nil
+	}
+	var values []string
+	if err := node.Decode(&values); err != nil {
+		return err
+	}
+	*p = values
+	return nil
+}
+
+func (p *paramValues) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case []any:
+		values := make(paramValues, 0, len(v))
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		*p = values
+	case nil:
+		*p = nil
+	default:
+		*p = paramValues{fmt.Sprint(v)}
+	}
+	return nil
+}
+
+// Schedule is a recurring export and the history of its runs
+type Schedule struct {
+	mu sync.Mutex
+
+	id      string
+	config  scheduleConfig
+	spec    cronSpec
+	history []scheduleRun
+	// fromConfig is set for the schedules of the config file, which a
+	// config reload updates
+	fromConfig bool
+}
+
+// scheduleRun is one run of a schedule. job is nil if the export could not
+// be started, or if the run was restored from the schedules file, which
+// saved it as saved.
+type scheduleRun struct {
+	startedAt time.Time
+	job       *Job
+	err       string
+	saved     *scheduleRunView
+}
+
+// view returns the run for the API, with the current state of its job
+func (run scheduleRun) view() scheduleRunView {
+	if run.saved != nil {
+		return *run.saved
+	}
+	v := scheduleRunView{StartedAt: run.startedAt, Status: jobFailed, Error: run.err}
+	if run.job != nil {
+		job := run.job.view()
+		v.JobID = job.ID
+		v.Status = job.Status
+		v.Error = job.Error
+		v.Findings = job.Findings
+		v.FinishedAt = job.FinishedAt
+	}
+	return v
+}
+
+// scheduleView is the JSON representation of a schedule returned by the API
+type scheduleView struct {
+	ID      string                 `json:"id"`
+	Name    string                 `json:"name,omitempty"`
+	Cron    string                 `json:"cron"`
+	Preset  string                 `json:"preset,omitempty"`
+	Params  map[string]paramValues `json:"params"`
+	NextRun *time.Time             `json:"nextRun,omitempty"`
+	// History lists the most recent runs, oldest first
+	History []scheduleRunView `json:"history"`
+}
+
+// scheduleRunView is the JSON representation of a schedule run
+type scheduleRunView struct {
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	JobID      string     `json:"jobId,omitempty"`
+	Status     jobStatus  `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	Findings   int        `json:"findings"`
+}
+
+// view returns a consistent snapshot of the schedule for the API
+func (s *Schedule) view() scheduleView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := scheduleView{
+		ID:      s.id,
+		Name:    s.config.Name,
+		Cron:    s.config.Cron,
+		Preset:  s.config.Preset,
+		Params:  s.config.Params,
+		History: make([]scheduleRunView, 0, len(s.history)),
+	}
+	if next := s.spec.next(time.Now()); !next.IsZero() {
+		v.NextRun = &next
+	}
+	for _, run := range s.history {
+		v.History = append(v.History, run.view())
+	}
+	return v
+}
+
+// stored returns the schedule as it is kept in the schedules file
+func (s *Schedule) stored() storedSchedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := storedSchedule{ID: s.id, scheduleConfig: s.config, FromConfig: s.fromConfig, History: make([]scheduleRunView, 0, len(s.history))}
+	for _, run := range s.history {
+		stored.History = append(stored.History, run.view())
+	}
+	return stored
+}
+
+// name returns the schedule's display name
+func (s *Schedule) name() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config.Name
+}
+
+// record adds a run to the schedule's history
+func (s *Schedule) record(run scheduleRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append(s.history, run)
+	if len(s.history) > maxScheduleHistory {
+		s.history = s.history[len(s.history)-maxScheduleHistory:]
+	}
+}
+
+// update replaces the schedule's definition, keeping its history
+func (s *Schedule) update(config scheduleConfig, spec cronSpec) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	s.spec = spec
+}
+
+// definition returns the schedule's definition
+func (s *Schedule) definition() scheduleConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+// due returns the schedule's definition if it fires in the minute at
+func (s *Schedule) due(at time.Time) (scheduleConfig, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config, s.spec.matches(at)
+}
+
+// scheduleManager tracks schedules by ID
+type scheduleManager struct {
+	mu        sync.Mutex
+	schedules map[string]*Schedule
+}
+
+func newScheduleManager() *scheduleManager {
+	return &scheduleManager{schedules: make(map[string]*Schedule)}
+}
+
+func (m *scheduleManager) add(s *Schedule) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.schedules[s.id] = s
+}
+
+func (m *scheduleManager) get(id string) (*Schedule, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.schedules[id]
+	return s, ok
+}
+
+func (m *scheduleManager) remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.schedules, id)
+}
+
+// list returns the schedules ordered by name, then ID
+func (m *scheduleManager) list() []*Schedule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	schedules := make([]*Schedule, 0, len(m.schedules))
+	for _, s := range m.schedules {
+		schedules = append(schedules, s)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		if ni, nj := schedules[i].name(), schedules[j].name(); ni != nj {
+			return ni < nj
+		}
+		return schedules[i].id < schedules[j].id
+	})
+	return schedules
+}
+
+// storedSchedule is a schedule in the schedules file, with its recent runs
+type storedSchedule struct {
+	ID string `json:"id"`
+	scheduleConfig
+	// FromConfig is set for the schedules of the config file, which are
+	// kept for their history and matched to those of the config again
+	FromConfig bool              `json:"fromConfig,omitempty"`
+	History    []scheduleRunView `json:"history"`
+}
+
+// schedulesState is the content of the schedules file
+type schedulesState struct {
+	Schedules []storedSchedule `json:"schedules"`
+}
+
+// scheduleStore persists the schedules created through the API and the
+// recent runs of every schedule in a JSON file, so they outlive restarts.
+// Saves are serialized so an older snapshot can't replace a newer one.
+type scheduleStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// load reads the schedules file; a missing file has no schedules
+func (s *scheduleStore) load() ([]storedSchedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading schedules file %s: %v", s.path, err)
+	}
+	var state schedulesState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error parsing schedules file %s: %v", s.path, err)
+	}
+	return state.Schedules, nil
+}
+
+// save rewrites the schedules file with schedules
+func (s *scheduleStore) save(schedules *scheduleManager) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := schedulesState{Schedules: []storedSchedule{}}
+	for _, schedule := range schedules.list() {
+		state.Schedules = append(state.Schedules, schedule.stored())
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding schedules: %v", err)
+	}
+	if err := writeFileAtomic(s.path, append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing schedules file %s: %v", s.path, err)
+	}
+	return nil
+}
+
+// saveSchedules writes every schedule to the schedules file. A failure is
+// only logged: the schedules keep running, and the next change saves them.
+func (a *App) saveSchedules(ctx context.Context) {
+	if err := a.scheduleStore.save(a.schedules); err != nil {
+		telemetry.Logger(ctx).Error("Error saving schedules", "error", err)
+	}
+}
+
+// restoreSchedules adds the schedules of the schedules file with their
+// history, before those of the config file are synced with them. Runs whose
+// jobs had not finished are failed, and a schedule whose cron expression no
+// longer parses is dropped.
+func (a *App) restoreSchedules() error {
+	stored, err := a.scheduleStore.load()
+	if err != nil {
+		return err
+	}
+	for _, saved := range stored {
+		spec, err := parseCron(saved.Cron)
+		if err != nil {
+			slog.Warn("Dropping saved schedule", "schedule_id", saved.ID, "error", err)
+			continue
+		}
+		s := &Schedule{id: saved.ID, config: saved.scheduleConfig, spec: spec, fromConfig: saved.FromConfig}
+		for _, run := range saved.History {
+			if !run.Status.finished() {
+				run.Status, run.Error = jobFailed, errRestartedRun
+			}
+			s.history = append(s.history, scheduleRun{startedAt: run.StartedAt, saved: &run})
+		}
+		a.schedules.add(s)
+	}
+	return nil
+}
+
+// checkSchedule parses the cron expression of config and validates its
+// export parameters against the current defaults
+func (a *App) checkSchedule(config scheduleConfig) (cronSpec, error) {
+	spec, err := parseCron(config.Cron)
+	if err != nil {
+		return cronSpec{}, err
+	}
+	opts, err := a.parseExportValues(config.query())
+	if err != nil {
+		return cronSpec{}, fmt.Errorf("invalid params: %v", err)
+	}
+	if opts.dryRun {
+		return cronSpec{}, fmt.Errorf("invalid params: dry runs cannot be scheduled")
+	}
+	if opts.report != "" {
+		return cronSpec{}, fmt.Errorf("invalid params: the %s report cannot be scheduled", opts.report)
+	}
+	return spec, nil
+}
+
+// addSchedule creates a schedule from config and registers it
+func (a *App) addSchedule(config scheduleConfig) (*Schedule, error) {
+	spec, err := a.checkSchedule(config)
+	if err != nil {
+		return nil, err
+	}
+	s := &Schedule{id: newJobID(), config: config, spec: spec}
+	a.schedules.add(s)
+	return s, nil
+}
+
+// runSchedules starts every due schedule at the start of each minute, in the
+// server's local time zone, until ctx is done
+func (a *App) runSchedules(ctx context.Context) {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		for _, s := range a.schedules.list() {
+			if config, ok := s.due(next); ok {
+				go a.runSchedule(ctx, s, config, next)
+			}
+		}
+	}
+}
+
+// runSchedule starts the export job for one run of a schedule
+func (a *App) runSchedule(ctx context.Context, s *Schedule, config scheduleConfig, at time.Time) {
+	opts, err := a.parseExportValues(config.query())
+	if err == nil {
+		err = gd.ResolveRegions(ctx, &opts.FetchOptions)
+	}
+	if err == nil {
+		err = gd.ResolveAccounts(ctx, &opts.FetchOptions)
+	}
+	if err != nil {
+		telemetry.Logger(ctx).Error("Error starting schedule", "schedule_id", s.id, "error", err)
+		s.record(scheduleRun{startedAt: at, err: err.Error()})
+		a.saveSchedules(ctx)
+		return
+	}
+
+	job := a.startJob(opts, s.id)
+	s.record(scheduleRun{startedAt: at, job: job})
+	a.saveSchedules(ctx)
+}
+
+// decodeSchedule reads a schedule definition from a JSON request body
+func decodeSchedule(r *http.Request) (scheduleConfig, error) {
+	var config scheduleConfig
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return config, fmt.Errorf("Invalid schedule: %v", err)
+	}
+	return config, nil
+}
+
+// lookupSchedule returns the schedule named by the id path value, writing a
+// 404 if there is none
+func (a *App) lookupSchedule(w http.ResponseWriter, r *http.Request) (*Schedule, bool) {
+	s, ok := a.schedules.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+	}
+	return s, ok
+}
+
+// handleListSchedules returns every schedule with its recent runs
+func (a *App) handleListSchedules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.scheduleViews())
+}
+
+// scheduleViews describes every schedule with its recent runs
+func (a *App) scheduleViews() []scheduleView {
+	views := []scheduleView{}
+	for _, s := range a.schedules.list() {
+		views = append(views, s.view())
+	}
+	return views
+}
+
+// handleCreateSchedule adds a schedule from a JSON definition
+func (a *App) handleCreateSchedule(w http.ResponseWriter, r *http.Request) {
+	config, err := decodeSchedule(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s, err := a.addSchedule(config)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid schedule: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	a.saveSchedules(r.Context())
+	telemetry.Logger(r.Context()).Info("Created schedule", "schedule_id", s.id, "cron", config.Cron)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", a.path("/api/schedules/"+s.id))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s.view())
+}
+
+// handleGetSchedule returns a schedule with its recent runs
+func (a *App) handleGetSchedule(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.lookupSchedule(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.view())
+}
+
+// handleUpdateSchedule replaces the definition of a schedule
+func (a *App) handleUpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.lookupSchedule(w, r)
+	if !ok {
+		return
+	}
+	config, err := decodeSchedule(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	spec, err := a.checkSchedule(config)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid schedule: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.update(config, spec)
+	a.saveSchedules(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.view())
+}
+
+// handleDeleteSchedule removes a schedule. Jobs it already started are kept.
+func (a *App) handleDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.lookupSchedule(w, r)
+	if !ok {
+		return
+	}
+	a.schedules.remove(s.id)
+	a.saveSchedules(r.Context())
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRestoreSchedules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), defaultSchedulesFile)
+	newApp := func() *App {
+		return &App{schedules: newScheduleManager(), scheduleStore: &scheduleStore{path: path}}
+	}
+	config := scheduleConfig{Name: "nightly", Cron: "0 2 * * *", Params: map[string]paramValues{"regions": {"us-east-1"}, "format": {"json"}}}
+	spec, err := parseCron(config.Cron)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startedAt := time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+
+	a := newApp()
+	api := &Schedule{id: "api-schedule", config: config, spec: spec}
+	api.record(scheduleRun{startedAt: startedAt, err: "Invalid preset"})
+	api.record(scheduleRun{startedAt: startedAt.AddDate(0, 0, 1), job: &Job{id: "job-1", status: jobRunning}})
+	a.schedules.add(api)
+	a.schedules.add(&Schedule{id: "config-schedule", config: scheduleConfig{Cron: "@hourly"}, spec: spec, fromConfig: true})
+	a.saveSchedules(context.Background())
+
+	restored := newApp()
+	if err := restored.restoreSchedules(); err != nil {
+		t.Fatalf("error restoring schedules: %v", err)
+	}
+	s, ok := restored.schedules.get("api-schedule")
+	if !ok {
+		t.Fatalf("schedule created through the API was not restored")
+	}
+	if s.fromConfig || !reflect.DeepEqual(s.definition(), config) {
+		t.Errorf("got schedule %+v, fromConfig %v, want %+v", s.definition(), s.fromConfig, config)
+	}
+	history := s.view().History
+	if len(history) != 2 {
+		t.Fatalf("got %d runs, want 2", len(history))
+	}
+	if history[0].Status != jobFailed || history[0].Error != "Invalid preset" || !history[0].StartedAt.Equal(startedAt) {
+		t.Errorf("got first run %+v, want the failed start", history[0])
+	}
+	if history[1].JobID != "job-1" || history[1].Status != jobFailed || history[1].Error != errRestartedRun {
+		t.Errorf("got second run %+v, want job-1 failed by the restart", history[1])
+	}
+	if s, ok := restored.schedules.get("config-schedule"); !ok || !s.fromConfig {
+		t.Errorf("schedule of the config file was not restored to be synced")
+	}
+}
+
+func TestRestoreSchedulesMissingFile(t *testing.T) {
+	a := &App{schedules: newScheduleManager(), scheduleStore: &scheduleStore{path: filepath.Join(t.TempDir(), defaultSchedulesFile)}}
+	if err := a.restoreSchedules(); err != nil {
+		t.Fatalf("error restoring without a schedules file: %v", err)
+	}
+	if got := a.schedules.list(); len(got) != 0 {
+		t.Errorf("got %d schedules, want none", len(got))
+	}
+}
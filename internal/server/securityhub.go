@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+)
+
+// securityHubConfig looks up the Security Hub record of each finding for
+// the triage state tracked there: the WorkflowStatus, WorkflowNote, and
+// WorkflowNoteUpdatedBy columns
+type securityHubConfig struct {
+	// Enabled looks up records for every export that doesn't set
+	// securityHub=false
+	Enabled bool `yaml:"enabled"`
+	// Concurrency is the most GetFindings calls in flight at once across
+	// the exports of the server
+	Concurrency int `yaml:"concurrency"`
+	// CacheTTL is how long the record of a finding is reused before it is
+	// looked up again
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+}
+
+func (c securityHubConfig) validate() error {
+	if c.Concurrency < 1 {
+		return fmt.Errorf("invalid securityHub.concurrency %d: must be at least 1", c.Concurrency)
+	}
+	if c.CacheTTL <= 0 {
+		return fmt.Errorf("invalid securityHub.cacheTTL %v: must be positive", c.CacheTTL)
+	}
+	return nil
+}
+
+// addWorkflowColumns adds the Security Hub columns to fields, read from what
+// the exports looked up in workflows
+func addWorkflowColumns(workflows *gd.WorkflowCache, fields export.Fields) {
+	fields["WorkflowStatus"] = workflows.Status
+	fields["WorkflowNote"] = workflows.Note
+	fields["WorkflowNoteUpdatedBy"] = workflows.NoteUpdatedBy
+}
+
+// parseSecurityHub reads the securityHub export option, defaulting to the
+// securityHub.enabled setting. Exports that look up records and name no
+// columns get the Security Hub columns after the default ones.
+func (a *App) parseSecurityHub(query url.Values, opts *exportOptions) error {
+	enabled := a.config().SecurityHub.Enabled
+	if v := query.Get("securityHub"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Invalid securityHub %q", v)
+		}
+		enabled = b
+	}
+	if !enabled {
+		return nil
+	}
+	opts.SecurityHub = a.workflows
+	if len(query["columns"]) == 0 {
+		opts.Columns = appendColumns(opts.Columns, gd.SecurityHubColumns)
+	}
+	return nil
+}
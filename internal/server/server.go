@@ -0,0 +1,1197 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// App holds the AWS configuration and exporter settings shared by the HTTP handlers
+type App struct {
+	awsCfg aws.Config
+	// current is the config in effect, replaced as a whole when the config
+	// is reloaded; handlers read it through config
+	current atomic.Pointer[Config]
+	// loadConfig reads the config again from the file, environment, and
+	// flags the server was started with
+	loadConfig func() (Config, error)
+	// reloading serializes config reloads
+	reloading sync.Mutex
+	jobs      *jobManager
+	queue     *jobQueue
+	schedules *scheduleManager
+	state     *stateFile
+	presets   *presetStore
+	history   *historyStore
+	// suppressed records the findings suppressions left out of exports
+	suppressed *suppressedLog
+	profiles   *profileConfigs
+	sso        *ssoSessions
+	limiters   *gd.RateLimiters
+	// scheduleStore keeps the schedules and their runs across restarts
+	scheduleStore *scheduleStore
+	// clients answers the GuardDuty, EC2, and STS calls of exports with
+	// synthetic findings in place of AWS; nil calls AWS
+	clients gd.Clients
+	// oidc signs users in through an identity provider, when configured
+	oidc *oidcProvider
+	// findingsMetrics holds the finding counts served on /metrics/findings
+	findingsMetrics *findingsMetrics
+	// store keeps the fetched findings, when storeFile is set
+	store *findingsStore
+	// tags caches the resource tags looked up by exports
+	tags *gd.TagCache
+	// states caches the resource states looked up by exports
+	states *gd.StateCache
+	// workflows caches the Security Hub records looked up by exports
+	workflows *gd.WorkflowCache
+	// geoIP resolves remote addresses, when geoip databases are set
+	geoIP *gd.GeoIP
+	// intel looks up the reputations of indicators, when a threat
+	// intelligence service has an API key
+	intel *threatIntel
+	// fields are the export columns computed from the config, such as the
+	// Security Hub, reputation, and rule tag columns
+	fields export.Fields
+	// rules post-process the findings of exports, when rules are set
+	rules *gd.RuleSet
+	// templates are the parsed files of the templates setting
+	templates map[string]*export.Template
+	// audit records exports and changes, when the audit log is on
+	audit *auditLog
+	// signingKey signs stored exports, when signing uses a GPG key
+	signingKey *openpgp.Entity
+	// ready is the outcome of the last readiness check of /readyz
+	ready readiness
+}
+
+// config returns the config in effect. Callers that read several settings
+// together should keep the returned value, as a reload may replace it.
+func (a *App) config() *Config {
+	return a.current.Load()
+}
+
+// Main runs the exporter: the export, diff, and watch subcommands, or
+// otherwise the web server
+func Main() {
+	// The export subcommand runs a single export without the web server
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(runExportCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		os.Exit(runDiffCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "watch" {
+		os.Exit(runWatchCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		os.Exit(runDecryptCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImportCommand(os.Args[2:]))
+	}
+	// Started by the Lambda runtime as the bootstrap of a function, the
+	// program serves its invocations instead of the web server
+	if len(os.Args) > 1 && os.Args[1] == "lambda" {
+		os.Exit(runLambdaCommand(os.Args[2:]))
+	}
+	if len(os.Args) == 1 && os.Getenv(lambdaRuntimeEnv) != "" {
+		os.Exit(runLambdaCommand(nil))
+	}
+
+	app, err := loadApp(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		slog.Error("Unable to start", "error", err)
+		return
+	}
+
+	app.oidc = newOIDCProvider(app.config().Auth.OIDC, app.config().BasePath)
+
+	// Set up HTTP routes
+	http.HandleFunc("/", app.handleIndex)
+	http.HandleFunc("GET /metrics", app.handleMetrics)
+	http.HandleFunc("GET /metrics/findings", app.handleFindingsMetrics)
+	http.HandleFunc("GET /healthz", app.handleHealth)
+	http.HandleFunc("GET /readyz", app.handleReady)
+	app.handleAPI(http.DefaultServeMux)
+	if app.oidc != nil {
+		http.HandleFunc("GET "+oidcLoginPath, app.oidc.handleLogin)
+		http.HandleFunc("GET "+oidcCallbackPath, app.oidc.handleCallback)
+		http.HandleFunc("POST "+oidcLogoutPath, app.oidc.handleLogout)
+	}
+
+	// Start the saved and configured schedules
+	if err := app.restoreSchedules(); err != nil {
+		slog.Error("Unable to load schedules", "error", err)
+		return
+	}
+	if _, err := app.syncSchedules(app.config().Schedules); err != nil {
+		slog.Error("Invalid config", "error", err)
+		return
+	}
+	if app.config().FindingsMetrics.enabled() {
+		if _, err := app.parseExportValues(app.config().FindingsMetrics.query()); err != nil {
+			slog.Error("Invalid findingsMetrics", "error", err)
+			return
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	app.auditStart(ctx, flag.Lookup("config").Value.String())
+	app.removeStaleCheckpoints()
+	go app.runSchedules(ctx)
+	go app.runRetention(ctx)
+	go app.runFindingsMetrics(ctx)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go app.reloadOnHangup(ctx, hangup)
+
+	// Requests are canceled through their base context if they are still
+	// running when the shutdown timeout expires
+	requests, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	server := &http.Server{
+		Addr:              app.config().Listen,
+		Handler:           logRequests(withBasePath(app.config().BasePath, apiErrors(app.config().BasePath, app.requireAuth(http.DefaultServeMux)))),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return requests },
+	}
+	// The gRPC service has a listener of its own, speaking HTTP/2 without
+	// TLS unless the server has a certificate
+	grpc := &grpcService{app: app}
+	var grpcServer *http.Server
+	if app.config().GRPCListen != "" {
+		grpcServer = &http.Server{
+			Addr:              app.config().GRPCListen,
+			Handler:           logRequests(grpc),
+			ReadHeaderTimeout: 10 * time.Second,
+			BaseContext:       func(net.Listener) context.Context { return requests },
+		}
+	}
+
+	// Start the HTTP server, or the HTTPS server and its HTTP redirect
+	if !app.config().Auth.enabled() {
+		slog.Warn("The API is open to anyone who can reach the server; configure auth users or API keys to protect it")
+	}
+	serveErr := make(chan error, 3)
+	var redirect *http.Server
+	if app.config().TLS.enabled() {
+		tlsConfig, redirectHandler, err := serverTLS(app.config().TLS, app.config().OutputDir, app.config().Listen)
+		if err != nil {
+			slog.Error("Unable to start", "error", err)
+			return
+		}
+		server.TLSConfig = tlsConfig
+		if grpcServer != nil {
+			grpcServer.TLSConfig = tlsConfig.Clone()
+		}
+		if app.config().TLS.RedirectHTTP != "" {
+			redirect = &http.Server{Addr: app.config().TLS.RedirectHTTP, Handler: redirectHandler, ReadHeaderTimeout: 10 * time.Second}
+			slog.Info("Redirecting HTTP to HTTPS", "address", redirect.Addr)
+			go func() {
+				serveErr <- redirect.ListenAndServe()
+			}()
+		}
+		slog.Info("Server is listening", "address", app.config().Listen, "base_path", app.config().BasePath, "tls", true)
+		go func() {
+			serveErr <- server.ListenAndServeTLS("", "")
+		}()
+	} else {
+		slog.Info("Server is listening", "address", app.config().Listen, "base_path", app.config().BasePath)
+		go func() {
+			serveErr <- server.ListenAndServe()
+		}()
+	}
+	if grpcServer != nil {
+		slog.Info("gRPC server is listening", "address", grpcServer.Addr, "tls", grpcServer.TLSConfig != nil)
+		go func() {
+			if grpcServer.TLSConfig != nil {
+				serveErr <- grpcServer.ListenAndServeTLS("", "")
+				return
+			}
+			grpcServer.Handler = h2c.NewHandler(grpcServer.Handler, &http2.Server{})
+			serveErr <- grpcServer.ListenAndServe()
+		}()
+	}
+	select {
+	case err := <-serveErr:
+		slog.Error("Server stopped", "error", err)
+		return
+	case <-ctx.Done():
+	}
+
+	// A second signal stops the server immediately
+	stop()
+	app.ready.drain()
+	slog.Info("Shutting down, waiting for requests and jobs to finish", "timeout", app.config().ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), app.config().ShutdownTimeout)
+	defer cancel()
+	jobsDone := make(chan struct{})
+	go func() {
+		app.jobs.drain(shutdownCtx)
+		close(jobsDone)
+	}()
+	if redirect != nil {
+		redirect.Shutdown(shutdownCtx)
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Canceling requests still in progress", "error", err)
+		cancelRequests()
+	}
+	if grpcServer != nil {
+		// Calls over HTTP/2 without TLS are served on connections the
+		// server no longer tracks, so they are waited for here
+		grpcServer.Shutdown(shutdownCtx)
+		if err := grpc.wait(shutdownCtx); err != nil {
+			slog.Warn("Canceling gRPC calls still in progress", "error", err)
+			cancelRequests()
+		}
+	}
+	<-jobsDone
+	telemetry.StopTracing(shutdownCtx)
+	slog.Info("Server stopped")
+}
+
+// loadApp parses the command-line flags in args, which must already be
+// defined on fs apart from the config flags, and builds the App from the
+// resulting configuration. Explicitly set flags override the config file.
+func loadApp(fs *flag.FlagSet, args []string) (*App, error) {
+	configPath := fs.String("config", "", "path to a YAML or JSON config file")
+	flags := defaultConfig()
+	registerFlags(fs, &flags)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := applyEnvOverrides(fs); err != nil {
+		return nil, fmt.Errorf("Invalid environment, %v", err)
+	}
+
+	load := func() (Config, error) {
+		conf := defaultConfig()
+		if *configPath != "" {
+			if err := loadConfigFile(*configPath, &conf); err != nil {
+				return Config{}, fmt.Errorf("Unable to load config, %v", err)
+			}
+		}
+		applyFlagOverrides(fs, &conf, &flags)
+		if err := conf.validate(); err != nil {
+			return Config{}, fmt.Errorf("Invalid config, %v", err)
+		}
+		return conf, nil
+	}
+	conf, err := load()
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(telemetry.NewLogger(os.Stdout, conf.LogFormat, conf.LogLevel))
+
+	if endpoint := conf.Tracing.EndpointURL(); endpoint != "" {
+		telemetry.StartTracing(endpoint, conf.Tracing.ServiceName)
+	}
+
+	// Load the AWS SDK configuration
+	sessions := newSSOSessions()
+	awsCfg, err := loadAWSConfig(context.Background(), conf, conf.Profile, sessions)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load SDK config, %v", err)
+	}
+	if conf.Synthetic.enabled() {
+		slog.Warn("Exporting synthetic findings instead of calling GuardDuty", "findings_per_region", conf.Synthetic.Findings, "seed", conf.Synthetic.Seed, "latency", conf.Synthetic.Latency)
+	} else if credentials := describeCredentials(conf, conf.Profile); credentials.Source != "" {
+		slog.Info("Using AWS credentials", "source", credentials.Source, "providers", credentials.Providers)
+	} else {
+		slog.Warn("No source of AWS credentials is set up", "providers", credentials.Providers, "reasons", credentials.Unavailable)
+	}
+	statePath := conf.StateFile
+	if statePath == "" {
+		statePath = filepath.Join(conf.OutputDir, defaultStateFile)
+	}
+	presetsPath := conf.PresetsFile
+	if presetsPath == "" {
+		presetsPath = filepath.Join(conf.OutputDir, defaultPresetsFile)
+	}
+	historyPath := conf.HistoryFile
+	if historyPath == "" {
+		historyPath = filepath.Join(conf.OutputDir, defaultHistoryFile)
+	}
+	schedulesPath := conf.SchedulesFile
+	if schedulesPath == "" {
+		schedulesPath = filepath.Join(conf.OutputDir, defaultSchedulesFile)
+	}
+	suppressedPath := conf.SuppressedFile
+	if suppressedPath == "" {
+		suppressedPath = filepath.Join(conf.OutputDir, defaultSuppressedFile)
+	}
+	var store *findingsStore
+	if conf.StoreFile != "" {
+		if store, err = openFindingsStore(conf.StoreFile); err != nil {
+			return nil, err
+		}
+	}
+	templates, err := loadTemplates(conf.Templates)
+	if err != nil {
+		return nil, err
+	}
+	var geoIP *gd.GeoIP
+	if conf.GeoIP.enabled() {
+		if geoIP, err = gd.OpenGeoIP(conf.GeoIP.CountryDatabase, conf.GeoIP.ASNDatabase); err != nil {
+			return nil, err
+		}
+	}
+	signingKey, err := loadSigningKey(conf.Signing)
+	if err != nil {
+		return nil, err
+	}
+	app := &App{
+		awsCfg:          awsCfg,
+		loadConfig:      load,
+		jobs:            newJobManager(),
+		queue:           newJobQueue(conf.MaxConcurrentJobs, conf.MaxJobsPerAccount),
+		schedules:       newScheduleManager(),
+		scheduleStore:   &scheduleStore{path: schedulesPath},
+		state:           &stateFile{path: statePath},
+		presets:         &presetStore{path: presetsPath},
+		history:         &historyStore{path: historyPath, limit: conf.HistoryLimit},
+		suppressed:      &suppressedLog{path: suppressedPath},
+		profiles:        newProfileConfigs(),
+		findingsMetrics: &findingsMetrics{},
+		store:           store,
+		geoIP:           geoIP,
+		templates:       templates,
+		tags:            gd.NewTagCache(conf.ResourceTags.CacheTTL, conf.ResourceTags.Concurrency),
+		states:          gd.NewStateCache(conf.ResourceState.CacheTTL, conf.ResourceState.Concurrency, conf.S3.PathStyle),
+		workflows:       gd.NewWorkflowCache(conf.SecurityHub.CacheTTL, conf.SecurityHub.Concurrency),
+		sso:             sessions,
+		limiters:        gd.NewRateLimiters(conf.RateLimit, conf.RateBurst),
+		clients:         conf.Synthetic.clients(),
+		audit:           newAuditLog(conf.Audit, awsCfg),
+		signingKey:      signingKey,
+	}
+	app.current.Store(&conf)
+	if conf.ThreatIntel.configured() {
+		app.intel = newThreatIntel(app, conf.ThreatIntel)
+	}
+	if len(conf.Rules) > 0 {
+		if app.rules, err = gd.NewRuleSet(conf.Rules); err != nil {
+			return nil, err
+		}
+	}
+	app.fields = exportFields(app.workflows, app.intel, app.rules)
+	return app, nil
+}
+
+// exportFields returns the columns that exports compute from the server's
+// config, with the Security Hub records of workflows, the reputations of
+// intel when a service is configured, and the tags of rules when there are
+// any. They are passed to each export, so two configs never share them.
+func exportFields(workflows *gd.WorkflowCache, intel *threatIntel, rules *gd.RuleSet) export.Fields {
+	fields := export.Fields{}
+	addWorkflowColumns(workflows, fields)
+	if intel != nil {
+		intel.addColumns(fields)
+	}
+	if rules != nil {
+		addRuleColumns(rules, fields)
+	}
+	return fields
+}
+
+// withBasePath serves next under the URL prefix base, which is stripped
+// from request paths so routes stay the same, and redirects the prefix
+// itself to the web interface. Requests outside the prefix get 404.
+func withBasePath(base string, next http.Handler) http.Handler {
+	if base == "" {
+		return next
+	}
+	strip := http.StripPrefix(base, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == base {
+			http.Redirect(w, r, base+"/", http.StatusMovedPermanently)
+			return
+		}
+		strip.ServeHTTP(w, r)
+	})
+}
+
+// path returns the URL path of a route, under the base path
+func (a *App) path(route string) string {
+	return a.config().BasePath + route
+}
+
+// handleIndex serves the main HTML page
+func (a *App) handleIndex(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := a.indexTemplate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, nil)
+}
+
+// handleRegions returns the enabled AWS regions as JSON. The optional scope
+// query parameter names a region group that overrides the configured scope,
+// and profile lists the regions enabled for another profile's account.
+func (a *App) handleRegions(w http.ResponseWriter, r *http.Request) {
+	scope := a.config().RegionScope
+	if s := r.URL.Query().Get("scope"); s != "" {
+		scope = s
+	}
+	if !gd.ValidRegionGroup(scope) {
+		http.Error(w, fmt.Sprintf("Invalid scope %q", scope), http.StatusBadRequest)
+		return
+	}
+	profile := a.config().Profile
+	if p := r.URL.Query().Get("profile"); p != "" {
+		profile = p
+	}
+	cfg, err := a.profileConfig(profile)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid profile %q: %v", profile, err), http.StatusBadRequest)
+		return
+	}
+
+	regions, err := gd.AllRegions(r.Context(), a.awsClients(), cfg, a.config().CallTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(gd.FilterRegionGroup(regions, scope))
+}
+
+// handleColumns returns the named export columns and the default selection
+func (a *App) handleColumns(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{
+		"available": a.fields.Names(),
+		"default":   a.config().Columns,
+	})
+}
+
+// exportOptions holds the settings for a single export request: what is
+// fetched, how it is written, and what the server does with the result
+type exportOptions struct {
+	gd.FetchOptions
+	export.WriteOptions
+	// incremental names the watermarks of an incremental export, whose
+	// values when the export started are in Watermarks
+	incremental string
+	partition   bool
+	// archive archives the exported findings once the export is stored,
+	// or lists them in a dry run
+	archive     string
+	destination string
+	// preset names the preset the export's parameters were filled in from,
+	// and params are the parameters with the preset's filled in, recorded in
+	// the history so the export can be repeated
+	preset string
+	params url.Values
+	// rerunOf is the history entry of the run the export repeats
+	rerunOf string
+	// resumeOf is the failed job whose checkpoint the export resumes
+	resumeOf string
+	// dryRun counts the findings through ListFindings alone instead of
+	// exporting them
+	dryRun bool
+	// preflight checks the export's permissions in every account and
+	// region before fetching any findings
+	preflight bool
+	// report names the report, such as coverage, that the export produces
+	// in place of its findings
+	report string
+	// user is the principal that requested the export, when
+	// authentication is on
+	user string
+	// email sends the export to the configured recipients once it is
+	// stored
+	email bool
+	// notify names the webhooks posted to when the job finishes
+	notify []string
+	// jira files Jira issues for the exported findings at or above the
+	// configured severity
+	jira bool
+}
+
+// parseExportOptions reads the export settings from the request query or
+// form body, falling back to the configured defaults for parameters that are absent
+func (a *App) parseExportOptions(r *http.Request) (exportOptions, error) {
+	if err := r.ParseForm(); err != nil {
+		return exportOptions{}, err
+	}
+	opts, err := a.parseExportValues(r.Form)
+	opts.user = requestUser(r.Context())
+	return opts, err
+}
+
+// parseExportValues reads the export settings from query parameters, and
+// those of the preset they name
+func (a *App) parseExportValues(query url.Values) (exportOptions, error) {
+	preset := query.Get("preset")
+	query, err := a.withPreset(query)
+	if err != nil {
+		return exportOptions{}, err
+	}
+	opts := exportOptions{
+		FetchOptions: gd.FetchOptions{
+			Regions:      query["regions"],
+			RegionGroup:  query.Get("regionGroup"),
+			Concurrency:  a.config().Concurrency,
+			Timeout:      a.config().Timeout,
+			CallTimeout:  a.config().CallTimeout,
+			BatchSize:    a.config().BatchSize,
+			BatchRetries: a.config().BatchRetries,
+			Roles:        a.config().Roles,
+			Limiters:     a.limiters,
+			Clients:      a.clients,
+			MaxFindings:  a.config().MaxFindings,
+			MaxDuration:  a.config().MaxDuration,
+		},
+		WriteOptions: export.WriteOptions{Format: a.config().Format},
+		destination:  a.config().Destination,
+		preset:       preset,
+		params:       query,
+	}
+	// Every export keeps the findings it fetches in the findings store
+	if a.store != nil {
+		opts.Store = a.store.upsert
+	}
+	if opts.RegionGroup != "" && !gd.ValidRegionGroup(opts.RegionGroup) {
+		return opts, fmt.Errorf("Invalid regionGroup %q", opts.RegionGroup)
+	}
+	if len(opts.Regions) == 0 && opts.RegionGroup == "" {
+		opts.Regions = a.config().Regions
+	}
+	if len(opts.Regions) == 0 && opts.RegionGroup == "" {
+		return opts, fmt.Errorf("No regions specified")
+	}
+	opts.Profile = a.config().Profile
+	if p := query.Get("profile"); p != "" {
+		opts.Profile = p
+	}
+	cfg, err := a.profileConfig(opts.Profile)
+	if err != nil {
+		return opts, fmt.Errorf("Invalid profile %q: %v", opts.Profile, err)
+	}
+	opts.AWSConfig = cfg
+	opts.CredentialMap = a.config().CredentialMap
+	for _, profile := range gd.CredentialProfileNames(opts.CredentialMap) {
+		cfg, err := a.profileConfig(profile)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid profile %q of the credential map: %v", profile, err)
+		}
+		if opts.CredentialProfiles == nil {
+			opts.CredentialProfiles = make(map[string]aws.Config)
+		}
+		opts.CredentialProfiles[profile] = cfg
+	}
+
+	// Roles in the request replace the configured roles. A single externalId
+	// applies to every role in the request.
+	if arns := query["roleArn"]; len(arns) > 0 {
+		opts.Roles = nil
+		for _, roleARN := range arns {
+			role := gd.Role{ARN: roleARN, ExternalID: query.Get("externalId")}
+			if err := role.Validate(); err != nil {
+				return opts, err
+			}
+			opts.Roles = append(opts.Roles, role)
+		}
+	}
+	discovery, err := gd.ParseDiscovery(query, a.config().Discovery)
+	if err != nil {
+		return opts, err
+	}
+	opts.Discovery = discovery
+	// Detectors may be given as a comma-separated list
+	opts.Detectors = gd.SplitList(query["detectors"])
+	if err := gd.CheckPartition(opts.FetchOptions); err != nil {
+		return opts, err
+	}
+
+	// When reportErrors is set, a failing region is recorded as an ERROR record
+	// in the output and the export continues with the remaining regions.
+	opts.ReportErrors, _ = strconv.ParseBool(query.Get("reportErrors"))
+
+	if v := query.Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("Invalid concurrency %q", v)
+		}
+		opts.Concurrency = n
+	}
+	if v := query.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("Invalid timeout %q", v)
+		}
+		opts.Timeout = d
+	}
+	if v := query.Get("callTimeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("Invalid callTimeout %q", v)
+		}
+		opts.CallTimeout = d
+	}
+	filter, err := gd.ParseFilter(query, a.config().MinSeverity)
+	if err != nil {
+		return opts, err
+	}
+	opts.Filter = filter
+	dedupe, err := gd.ParseDedupe(query.Get("dedupe"), query.Get("dedupeKeep"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Dedupe = dedupe
+	// An incremental export only fetches findings updated since the
+	// watermarks saved under its name by the previous run
+	if v := query.Get("incremental"); v != "" {
+		watermarks, err := a.state.watermarks(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.incremental = v
+		opts.Watermarks = watermarks
+	}
+	// A request can tighten the configured limits but not lift them
+	if v := query.Get("maxFindings"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("Invalid maxFindings %q", v)
+		}
+		if a.config().MaxFindings > 0 && n > a.config().MaxFindings {
+			return opts, fmt.Errorf("Invalid maxFindings %q: the server allows at most %d", v, a.config().MaxFindings)
+		}
+		opts.MaxFindings = n
+	}
+	if v := query.Get("maxDuration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("Invalid maxDuration %q", v)
+		}
+		if a.config().MaxDuration > 0 && d > a.config().MaxDuration {
+			return opts, fmt.Errorf("Invalid maxDuration %q: the server allows at most %s", v, a.config().MaxDuration)
+		}
+		opts.MaxDuration = d
+	}
+	if v := query.Get("batchSize"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > gd.MaxGetFindingsBatch {
+			return opts, fmt.Errorf("Invalid batchSize %q", v)
+		}
+		opts.BatchSize = n
+	}
+	if v := query.Get("format"); v != "" {
+		if !export.ValidFormat(v) {
+			return opts, fmt.Errorf("Unsupported format %q", v)
+		}
+		opts.Format = v
+	}
+	opts.Pretty, _ = strconv.ParseBool(query.Get("pretty"))
+	if err := a.parseTemplate(query, &opts); err != nil {
+		return opts, err
+	}
+	order, err := gd.ParseSort(query.Get("sort"), query.Get("sortOrder"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Sort = order
+	columns, err := a.fields.ParseColumns(query, a.config().Columns)
+	if err != nil {
+		return opts, err
+	}
+	opts.Columns, opts.Fields = columns, a.fields
+	if err := a.parseResourceTags(query, &opts); err != nil {
+		return opts, err
+	}
+	if err := a.parseResourceState(query, &opts); err != nil {
+		return opts, err
+	}
+	if err := a.parseSecurityHub(query, &opts); err != nil {
+		return opts, err
+	}
+	if err := a.parseThreatIntel(query, &opts); err != nil {
+		return opts, err
+	}
+	if err := a.parseSuppressions(query, &opts); err != nil {
+		return opts, err
+	}
+	if err := a.parseRules(query, &opts); err != nil {
+		return opts, err
+	}
+	// Every export resolves remote addresses once geoip databases are set
+	if a.geoIP != nil {
+		opts.GeoIP = a.geoIP
+		if len(query["columns"]) == 0 {
+			opts.Columns = appendColumns(opts.Columns, geoIPColumns)
+		}
+	}
+	// flatten replaces the columns with every field present in the findings
+	opts.Flatten, _ = strconv.ParseBool(query.Get("flatten"))
+	if err := a.parseColumnMapping(query, &opts); err != nil {
+		return opts, err
+	}
+	// sanitize and bom make CSV exports safe to open in Excel, defaulting to
+	// the csvSanitize and csvBom settings
+	opts.Sanitize = a.config().CSVSanitize
+	if v := query.Get("sanitize"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid sanitize %q", v)
+		}
+		opts.Sanitize = b
+	}
+	opts.BOM = a.config().CSVBOM
+	if v := query.Get("bom"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid bom %q", v)
+		}
+		opts.BOM = b
+	}
+	// The csv options adapt CSV exports to the tools that read them
+	dialect, err := export.ParseCSVDialect(query.Get("csvDelimiter"), query.Get("csvLineEnding"), query.Get("csvQuote"), query.Get("csvTimeFormat"), query.Get("csvTimezone"))
+	if err != nil {
+		return opts, err
+	}
+	opts.CSV = dialect
+	// productArn sets the Security Hub product that ASFF findings are
+	// imported as, for replaying into another account or partition
+	if v := query.Get("productArn"); v != "" {
+		if !export.ValidProductARN(v) {
+			return opts, fmt.Errorf("Invalid productArn %q", v)
+		}
+		opts.ProductARN = v
+	}
+	// topFindings and groupBy choose the most severe findings that Markdown
+	// reports list and how they are grouped
+	if v := query.Get("topFindings"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > export.MaxTopFindings {
+			return opts, fmt.Errorf("Invalid topFindings %q: must be 1 to %d", v, export.MaxTopFindings)
+		}
+		opts.TopFindings = n
+	}
+	if v := query.Get("groupBy"); v != "" {
+		if !export.ValidGroupBy(v) {
+			return opts, fmt.Errorf("Invalid groupBy %q: must be type or resource", v)
+		}
+		opts.GroupBy = v
+	}
+	// locale translates the headings, labels, and dates of reports,
+	// defaulting to the locale setting
+	opts.Locale = a.config().Locale
+	if v := query.Get("locale"); v != "" {
+		if !export.ValidLocale(v) {
+			return opts, fmt.Errorf("Unsupported locale %q: must be one of %s", v, strings.Join(export.Locales, ", "))
+		}
+		opts.Locale = v
+	}
+	if v := query.Get("destination"); v != "" {
+		if !validDestination(v) {
+			return opts, fmt.Errorf("Invalid destination %q: must be local, s3, both, splunk, elasticsearch, syslog, or http", v)
+		}
+		opts.destination = v
+	}
+	if usesS3(opts.destination) && a.config().S3.Bucket == "" {
+		return opts, fmt.Errorf("The %s destination requires an S3 bucket in the server config", opts.destination)
+	}
+	if err := a.config().siemConfigured(opts.destination); err != nil {
+		return opts, err
+	}
+	if v := query.Get("compress"); v != "" {
+		if !export.ValidCompression(v) {
+			return opts, fmt.Errorf("Invalid compress %q: must be gzip or zip", v)
+		}
+		opts.Compression = v
+	}
+	// split writes a file per account and region with a manifest, which
+	// is always packaged as a zip archive
+	opts.Split, _ = strconv.ParseBool(query.Get("split"))
+	if opts.Split {
+		if opts.Compression == export.CompressGzip {
+			return opts, fmt.Errorf("Split exports are packaged as zip and cannot be compressed with gzip")
+		}
+		opts.Compression = export.CompressZip
+	}
+	// partition uploads Parquet or CSV files in Hive-style region and
+	// date directories for Athena, in place of a single export file
+	opts.partition, _ = strconv.ParseBool(query.Get("partition"))
+	if opts.partition && ((opts.Format != "parquet" && opts.Format != "csv") || opts.destination != destinationS3) {
+		return opts, fmt.Errorf("Partitioning requires the parquet or csv format and the s3 destination")
+	}
+	if opts.partition && opts.Flatten {
+		return opts, fmt.Errorf("Partitioned exports cannot be flattened, as every file of a table has its columns")
+	}
+	if opts.partition && opts.Compression != "" {
+		return opts, fmt.Errorf("Partitioned exports cannot be compressed or split")
+	}
+	if opts.partition && a.config().Encryption.enabled() {
+		return opts, fmt.Errorf("Partitioned exports cannot be encrypted, as Athena reads them in place")
+	}
+	if v := query.Get("archive"); v != "" && v != "false" {
+		if !validArchive(v) {
+			return opts, fmt.Errorf("Invalid archive %q: must be true, false, or dryRun", v)
+		}
+		opts.archive = v
+		opts.Archiving = true
+	}
+	opts.dryRun, _ = strconv.ParseBool(query.Get("dryRun"))
+	opts.preflight, _ = strconv.ParseBool(query.Get("preflight"))
+	if err := parseReport(query, &opts); err != nil {
+		return opts, err
+	}
+	// email sends the stored export to the configured recipients
+	opts.email, _ = strconv.ParseBool(query.Get("email"))
+	if opts.email && !a.config().Email.enabled() {
+		return opts, fmt.Errorf("Emailing exports requires email settings in the server config")
+	}
+	if opts.email && (opts.partition || opts.dryRun || opts.report != "") {
+		return opts, fmt.Errorf("Partitioned exports, dry runs, and reports cannot be emailed")
+	}
+	if opts.email && pushesToSIEM(opts.destination) {
+		return opts, fmt.Errorf("Exports pushed to the %s destination cannot be emailed", opts.destination)
+	}
+	// notify posts the job's outcome to the named webhooks
+	if v := query.Get("notify"); v != "" {
+		for _, name := range gd.SplitList([]string{v}) {
+			if _, ok := a.webhook(name); !ok {
+				return opts, fmt.Errorf("Invalid notify %q: no webhook has that name", name)
+			}
+			opts.notify = append(opts.notify, name)
+		}
+	}
+	// jira files issues for the most severe findings once they are exported
+	opts.jira, _ = strconv.ParseBool(query.Get("jira"))
+	if opts.jira && !a.config().Jira.enabled() {
+		return opts, fmt.Errorf("Filing Jira issues requires jira settings in the server config")
+	}
+	if opts.jira && (opts.dryRun || opts.report != "") {
+		return opts, fmt.Errorf("Dry runs and reports cannot file Jira issues")
+	}
+	if opts.jira {
+		opts.Ticketing = true
+		opts.TicketSeverity = a.config().Jira.MinSeverity
+	}
+	return opts, nil
+}
+
+// handleExport generates a file with GuardDuty findings from selected regions
+// in the requested format. By default the file is written to the working
+// directory and its name is returned; with stream=true it is sent as the
+// response body instead.
+func (a *App) handleExport(w http.ResponseWriter, r *http.Request) {
+	log := telemetry.Logger(r.Context())
+	opts, err := a.parseExportOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := gd.ResolveRegions(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+	if err := gd.ResolveAccounts(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+	if opts.dryRun {
+		report := gd.CountFindings(r.Context(), opts.FetchOptions)
+		log.Info("Dry run completed", "regions", opts.Regions, "findings", report.Findings, "pages", report.Pages)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	if opts.report != "" {
+		a.serveReport(w, r, opts)
+		return
+	}
+	if opts.email || len(opts.notify) > 0 {
+		http.Error(w, "Emailed and notifying exports run in the background: start them with POST /api/export", http.StatusBadRequest)
+		return
+	}
+	// GET requests change nothing in GuardDuty or Jira, so a link cannot
+	// archive findings or file issues
+	if opts.archive == archiveFindings || opts.jira {
+		http.Error(w, "Exports that archive findings or file Jira issues must be started with POST /api/export", http.StatusBadRequest)
+		return
+	}
+	stream, _ := strconv.ParseBool(r.URL.Query().Get("stream"))
+	if stream && usesS3(opts.destination) {
+		http.Error(w, "Streaming cannot be combined with an S3 destination", http.StatusBadRequest)
+		return
+	}
+	if stream && pushesToSIEM(opts.destination) {
+		http.Error(w, fmt.Sprintf("Streaming cannot be combined with the %s destination", opts.destination), http.StatusBadRequest)
+		return
+	}
+	var dest preflightDestination
+	if !stream {
+		dest = a.storedDestination(opts, a.config().OutputDir)
+	}
+	if err := a.checkPreflight(r.Context(), &opts, dest); err != nil {
+		log.Warn("Export stopped by its preflight", "error", err)
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	log.Info("Export started", "regions", opts.Regions)
+	ctx, span := telemetry.StartSpan(r.Context(), "export", "regions", len(opts.Regions), "format", opts.Format)
+	telemetry.ExportsStarted.Inc()
+	completed := false
+	defer func() {
+		if !completed {
+			telemetry.ExportsFailed.Inc()
+			span.Finish(errors.New("export failed"))
+			return
+		}
+		span.Finish(nil)
+	}()
+
+	regions := gd.StreamRegions(ctx, opts.FetchOptions, nil)
+	defer regions.Close()
+	run := newRun(runSourceExport, opts)
+	// runErr is why the export failed, when not because of a region
+	var runErr error
+	defer func() {
+		var message string
+		if runErr != nil {
+			message = runErr.Error()
+		}
+		run.finish(runOutcome(r.Context(), completed), message, regions.Results())
+		run.Truncation = streamTruncation(regions)
+		a.recordRun(r.Context(), run)
+	}()
+	// failed answers a request whose export was stopped by a failed region
+	failed := func() bool {
+		result, failed := regions.Failed()
+		if failed {
+			log.Error("Export failed", "region", gd.TargetLabel(result.Account, result.Region), "error", result.Err)
+			http.Error(w, result.Err.Error(), a.exportErrorStatus(opts))
+		}
+		return failed
+	}
+	filename := export.Filename(time.Now(), opts.Format)
+
+	if stream {
+		// A gzip stream is sent with Content-Encoding so the browser saves it
+		// decompressed under the usual name; a zip is downloaded as an archive
+		streamName := filename
+		if opts.Compression == export.CompressGzip {
+			w.Header().Set("Content-Type", export.Formats[opts.Format].ContentType)
+			w.Header().Set("Content-Encoding", "gzip")
+		} else {
+			streamName = export.CompressedName(filename, opts.Compression)
+			w.Header().Set("Content-Type", export.ContentType(opts.Format, opts.Compression))
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", streamName))
+		// The body is written as the findings arrive, so the outcome of each
+		// region follows it in trailers
+		w.Header().Set("Trailer", "X-Export-Succeeded-Regions, X-Export-Failed-Regions, X-Export-Truncated, X-Export-Truncated-Regions, X-Export-Findings, X-Export-Pages, X-Export-API-Calls, X-Export-Duration")
+		totalFindings, err := export.Write(ctx, w, opts.WriteOptions, filename, regions)
+		if result, failed := regions.Failed(); failed {
+			err = fmt.Errorf("error getting findings for region %s: %v", gd.TargetLabel(result.Account, result.Region), result.Err)
+		}
+		if err != nil {
+			// Headers are already sent, so the connection is cut to keep the
+			// client from taking a truncated export for a complete one
+			log.Error("Error streaming export", "error", err)
+			runErr = err
+			panic(http.ErrAbortHandler)
+		}
+		setRegionHeaders(r.Context(), w.Header(), regions)
+		a.finishExport(r.Context(), opts, regions.Results())
+		completed = true
+		log.Info("Export completed", "findings", totalFindings, "streamed_as", streamName)
+		return
+	}
+
+	if opts.partition {
+		upload, totalFindings, err := a.uploadPartitions(r.Context(), opts.WriteOptions, filename, regions)
+		if failed() {
+			return
+		}
+		if err != nil {
+			log.Error("Error uploading export", "error", err)
+			runErr = err
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setRegionHeaders(r.Context(), w.Header(), regions)
+		a.finishExport(r.Context(), opts, regions.Results())
+		completed = true
+		log.Info("Export completed", "findings", totalFindings, "table", upload.uri())
+		w.Write([]byte(upload.uri()))
+		return
+	}
+
+	// Findings pushed to a SIEM are not written to a file, and the response
+	// names where they were sent
+	if pushesToSIEM(opts.destination) {
+		target, totalFindings, err := a.pushFindings(ctx, opts.destination, regions)
+		if failed() {
+			return
+		}
+		if err != nil {
+			log.Error("Error pushing export", "error", err)
+			runErr = err
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		setRegionHeaders(r.Context(), w.Header(), regions)
+		a.finishExport(r.Context(), opts, regions.Results())
+		completed = true
+		log.Info("Export completed", "findings", totalFindings, "pushed_to", target)
+		w.Write([]byte(target))
+		return
+	}
+
+	// An export that is only uploaded is staged in a temporary file
+	name := a.storedName(filename, opts.Compression)
+	var file *os.File
+	if opts.destination == destinationS3 {
+		file, err = os.CreateTemp("", "*_"+name)
+	} else {
+		file, err = os.Create(filepath.Join(a.config().OutputDir, name))
+	}
+	if err != nil {
+		log.Error("Error creating file", "error", err)
+		runErr = err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	out, err := a.encryptExport(ctx, file)
+	if err != nil {
+		log.Error("Error encrypting export", "error", err)
+		runErr = err
+		file.Close()
+		os.Remove(file.Name())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A half-written export is removed rather than left for a reader, and a
+	// failed region is still reported with an error status
+	totalFindings, err := export.Write(ctx, out, opts.WriteOptions, filename, regions)
+	if err == nil {
+		err = out.Close()
+	}
+	if failed() {
+		file.Close()
+		os.Remove(file.Name())
+		return
+	}
+	if err != nil {
+		log.Error("Error writing export", "error", err)
+		runErr = err
+		file.Close()
+		os.Remove(file.Name())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setRegionHeaders(r.Context(), w.Header(), regions)
+	seal, err := a.sealExport(r.Context(), file.Name(), name)
+	if err != nil {
+		log.Error("Error sealing export", "error", err)
+		runErr = err
+		file.Close()
+		removeExportFile(file.Name())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Export-SHA256", seal.SHA256)
+
+	if !usesS3(opts.destination) {
+		a.finishExport(r.Context(), opts, regions.Results())
+		a.recordSavedExport(r.Context(), name, opts, totalFindings, regions, seal)
+		completed = true
+		log.Info("Export completed", "findings", totalFindings, "file", file.Name())
+		w.Write([]byte(name))
+		return
+	}
+	if opts.destination == destinationS3 {
+		defer removeExportFile(file.Name())
+	}
+
+	upload, err := a.uploadExport(r.Context(), file.Name(), name, a.storedContentType(opts.Format, opts.Compression))
+	if err != nil {
+		log.Error("Error uploading export", "error", err)
+		runErr = err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.finishExport(r.Context(), opts, regions.Results())
+	if opts.destination == destinationBoth {
+		a.recordSavedExport(r.Context(), name, opts, totalFindings, regions, seal)
+	}
+	completed = true
+	log.Info("Export completed", "findings", totalFindings, "object", upload.uri())
+	w.Write([]byte(upload.url))
+}
+
+// streamTruncation returns how the export read from stream was truncated,
+// or nil if it was not
+func streamTruncation(stream *gd.Stream) *gd.Truncation {
+	if truncation, ok := stream.Truncated(); ok {
+		return &truncation
+	}
+	return nil
+}
+
+// setRegionHeaders logs the regions that failed in an export that reported
+// them and sets the outcome of each account and region in the response
+// headers, or the trailers of a streamed export, with the export's totals of
+// findings, pages, and API calls and its duration in seconds. A truncated
+// export names the limit that stopped it and the regions that were cut off
+// or not reached.
+func setRegionHeaders(ctx context.Context, h http.Header, stream *gd.Stream) {
+	if truncation, ok := stream.Truncated(); ok {
+		h.Set("X-Export-Truncated", truncation.Reason)
+		regions := truncation.Remaining
+		if truncation.Region != "" {
+			regions = append([]string{truncation.Region}, regions...)
+		}
+		h.Set("X-Export-Truncated-Regions", strings.Join(regions, ","))
+	}
+	summary := gd.SummarizeRegions(stream.Results())
+	summary.LogFailures(ctx)
+	h.Set("X-Export-Succeeded-Regions", strings.Join(summary.Succeeded, ","))
+	if len(summary.Failed) > 0 {
+		failed := make([]string, 0, len(summary.Failed))
+		for label := range summary.Failed {
+			failed = append(failed, label)
+		}
+		sort.Strings(failed)
+		h.Set("X-Export-Failed-Regions", strings.Join(failed, ","))
+	}
+	totals := stream.Summary()
+	h.Set("X-Export-Findings", strconv.Itoa(totals.Findings))
+	h.Set("X-Export-Pages", strconv.Itoa(totals.Pages))
+	h.Set("X-Export-API-Calls", strconv.Itoa(totals.APICalls))
+	h.Set("X-Export-Duration", strconv.FormatFloat(totals.DurationSeconds, 'f', 3, 64))
+}
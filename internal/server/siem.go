@@ -0,0 +1,500 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// SIEM destinations, which push the findings of an export to Splunk, to
+// Elasticsearch or OpenSearch, to a syslog collector, or to any HTTP
+// endpoint instead of storing a file
+const (
+	destinationSplunk        = "splunk"
+	destinationElasticsearch = "elasticsearch"
+	destinationSyslog        = "syslog"
+	destinationHTTP          = "http"
+)
+
+// Defaults and limits of the SIEM destinations
+const (
+	defaultSIEMBatchSize    = 500
+	defaultSIEMRetries      = 3
+	defaultSplunkSourceType = "aws:cloudwatch:guardduty"
+	defaultElasticIndex     = "guardduty-findings"
+	maxSIEMBatchSize        = 10000
+	siemRequestTimeout      = time.Minute
+	siemMaxResponseLength   = 64 << 10
+)
+
+// splunkConfig selects the Splunk HTTP Event Collector that the splunk
+// destination sends findings to, one event per finding
+type splunkConfig struct {
+	// URL is the collector's base URL, such as https://splunk.example.com:8088
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+	// Index, Source, and SourceType are set on each event; an empty index
+	// is the token's default index
+	Index      string `yaml:"index"`
+	Source     string `yaml:"source"`
+	SourceType string `yaml:"sourcetype"`
+	// BatchSize is the number of findings sent per request, and Retries the
+	// number of times a throttled or failed request is retried
+	BatchSize int `yaml:"batchSize"`
+	Retries   int `yaml:"retries"`
+}
+
+func (c splunkConfig) validate() error {
+	if c.URL != "" {
+		if err := validateEndpoint("splunk.url", c.URL); err != nil {
+			return err
+		}
+	}
+	return validateSIEMBatching("splunk", c.BatchSize, c.Retries)
+}
+
+// elasticsearchConfig selects the Elasticsearch or OpenSearch cluster that
+// the elasticsearch destination indexes findings into through the bulk API
+type elasticsearchConfig struct {
+	// URL is the cluster's base URL, such as https://search.example.com:9200
+	URL   string `yaml:"url"`
+	Index string `yaml:"index"`
+	// Username and Password sign in with basic authentication and APIKey
+	// with an Elasticsearch API key. AWSRegion signs requests with the
+	// server's AWS credentials instead, for Amazon OpenSearch Service.
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+	APIKey    string `yaml:"apiKey"`
+	AWSRegion string `yaml:"awsRegion"`
+	// IndexTemplate installs an index template mapping the findings'
+	// fields before findings are indexed
+	IndexTemplate bool `yaml:"indexTemplate"`
+	BatchSize     int  `yaml:"batchSize"`
+	Retries       int  `yaml:"retries"`
+}
+
+func (c elasticsearchConfig) validate() error {
+	if c.URL != "" {
+		if err := validateEndpoint("elasticsearch.url", c.URL); err != nil {
+			return err
+		}
+	}
+	// Index names are lowercase and cannot hold the characters that
+	// separate them in URLs and patterns
+	if c.Index == "" || c.Index != strings.ToLower(c.Index) || strings.ContainsAny(c.Index, `\/*?"<>| ,#:`) {
+		return fmt.Errorf("invalid elasticsearch.index %q: must be a lowercase index name", c.Index)
+	}
+	if c.APIKey != "" && (c.Username != "" || c.AWSRegion != "") || c.Username != "" && c.AWSRegion != "" {
+		return fmt.Errorf("invalid elasticsearch authentication: set only one of username, apiKey, and awsRegion")
+	}
+	return validateSIEMBatching("elasticsearch", c.BatchSize, c.Retries)
+}
+
+// validateSIEMBatching reports an invalid batch size or retry count of the
+// SIEM destination name
+func validateSIEMBatching(name string, batchSize, retries int) error {
+	if batchSize < 1 || batchSize > maxSIEMBatchSize {
+		return fmt.Errorf("invalid %s.batchSize %d: must be 1 to %d", name, batchSize, maxSIEMBatchSize)
+	}
+	if retries < 0 {
+		return fmt.Errorf("invalid %s.retries %d: must not be negative", name, retries)
+	}
+	return nil
+}
+
+// pushesToSIEM reports whether exports to destination d are pushed to a
+// SIEM rather than stored as a file
+func pushesToSIEM(d string) bool {
+	return d == destinationSplunk || d == destinationElasticsearch || d == destinationSyslog || d == destinationHTTP
+}
+
+// siemConfigured returns why an export cannot be pushed to the SIEM
+// destination d with the config, or nil if it can
+func (c Config) siemConfigured(d string) error {
+	switch {
+	case d == destinationSplunk && (c.Splunk.URL == "" || c.Splunk.Token == ""):
+		return fmt.Errorf("The splunk destination requires splunk.url and splunk.token in the server config")
+	case d == destinationElasticsearch && c.Elasticsearch.URL == "":
+		return fmt.Errorf("The elasticsearch destination requires elasticsearch.url in the server config")
+	case d == destinationSyslog && c.Syslog.Address == "":
+		return fmt.Errorf("The syslog destination requires syslog.address in the server config")
+	case d == destinationHTTP && c.HTTP.URL == "":
+		return fmt.Errorf("The http destination requires http.url in the server config")
+	}
+	return nil
+}
+
+// pushFindings sends the findings of the stream to the SIEM of destination
+// as they are fetched, in batches for Splunk, Elasticsearch, and HTTP
+// endpoints, and returns where they were sent and how many. Unlike an
+// upload, findings already sent stay in the SIEM when a region fails or the
+// export is canceled; pushing the export again replaces them in
+// Elasticsearch, which keys documents by finding ID.
+func (a *App) pushFindings(ctx context.Context, destination string, stream *gd.Stream) (string, int, error) {
+	var w export.FindingWriter
+	var target string
+	switch destination {
+	case destinationSyslog:
+		target = a.config().Syslog.target()
+		w = a.newSyslogWriter(ctx)
+	case destinationHTTP:
+		target = a.config().HTTP.target()
+		size := a.config().HTTP.BatchSize
+		if a.config().HTTP.Mode == httpModeFinding {
+			size = 1
+		}
+		w = &siemWriter{ctx: ctx, size: size, send: a.sendHTTP}
+	case destinationSplunk:
+		conf := a.config().Splunk
+		target = strings.TrimSuffix(conf.URL, "/") + "/services/collector/event"
+		w = &siemWriter{ctx: ctx, size: conf.BatchSize, send: func(ctx context.Context, findings []types.Finding) error {
+			return a.retryRequest(ctx, "splunk", conf.Retries, func() (bool, error) {
+				return a.sendSplunk(ctx, target, findings)
+			})
+		}}
+	default:
+		conf := a.config().Elasticsearch
+		target = strings.TrimSuffix(conf.URL, "/") + "/" + conf.Index
+		if conf.IndexTemplate {
+			err := a.retryRequest(ctx, "elasticsearch", conf.Retries, func() (bool, error) {
+				return a.putIndexTemplate(ctx)
+			})
+			if err != nil {
+				return target, 0, err
+			}
+		}
+		w = &siemWriter{ctx: ctx, size: conf.BatchSize, send: func(ctx context.Context, findings []types.Finding) error {
+			return a.retryRequest(ctx, "elasticsearch", conf.Retries, func() (bool, error) {
+				var retry bool
+				var err error
+				findings, retry, err = a.sendBulk(ctx, findings)
+				return retry, err
+			})
+		}}
+	}
+	totalFindings, err := export.WriteFindings(ctx, w, stream)
+	if err != nil {
+		return target, totalFindings, err
+	}
+	telemetry.Logger(ctx).Info("Pushed findings", "destination", destination, "findings", totalFindings)
+	return target, totalFindings, nil
+}
+
+// siemWriter is the FindingWriter of the SIEM destinations. It collects
+// findings into batches of size and passes each full batch, and the rest
+// when closed, to send.
+type siemWriter struct {
+	ctx   context.Context
+	size  int
+	send  func(ctx context.Context, findings []types.Finding) error
+	batch []types.Finding
+	// failed is set once a batch could not be sent, so Close does not send
+	// the rest after an error
+	failed bool
+}
+
+func (w *siemWriter) WriteHeader() error {
+	return nil
+}
+
+func (w *siemWriter) WriteFinding(finding types.Finding) error {
+	w.batch = append(w.batch, finding)
+	if len(w.batch) < w.size {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *siemWriter) Close() error {
+	if w.failed || len(w.batch) == 0 {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *siemWriter) flush() error {
+	err := w.send(w.ctx, w.batch)
+	w.batch = w.batch[:0]
+	if err != nil {
+		w.failed = true
+	}
+	return err
+}
+
+// retryRequest calls send, a request to a SIEM or an issue tracker, until
+// it succeeds, fails with an error that retrying would not fix, or has been
+// retried retries times. It waits a second before the first retry and twice
+// as long before each one after, up to the retryMaxBackoff setting.
+func (a *App) retryRequest(ctx context.Context, name string, retries int, send func() (retry bool, err error)) error {
+	wait := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := send()
+		if err == nil || !retry || attempt == retries || ctx.Err() != nil {
+			return err
+		}
+		telemetry.Logger(ctx).Warn("Retrying request", "service", name, "attempt", attempt+1, "error", err)
+		timer := time.NewTimer(min(wait, a.config().RetryMaxBackoff))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		wait *= 2
+	}
+}
+
+// retryableStatus reports whether a request answered with status may
+// succeed when retried: it was throttled or the service failed
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// splunkEvent is a finding as an HTTP Event Collector event, timed by when
+// the finding was last updated
+type splunkEvent struct {
+	Time       float64       `json:"time,omitempty"`
+	Index      string        `json:"index,omitempty"`
+	Source     string        `json:"source,omitempty"`
+	SourceType string        `json:"sourcetype,omitempty"`
+	Event      types.Finding `json:"event"`
+}
+
+// sendSplunk sends a batch of findings to the collector's event endpoint,
+// reporting whether a failure may be retried
+func (a *App) sendSplunk(ctx context.Context, target string, findings []types.Finding) (bool, error) {
+	conf := a.config().Splunk
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, finding := range findings {
+		event := splunkEvent{Index: conf.Index, Source: conf.Source, SourceType: conf.SourceType, Event: finding}
+		if t, err := time.Parse(time.RFC3339, aws.ToString(finding.UpdatedAt)); err == nil {
+			event.Time = float64(t.UnixMilli()) / 1000
+		}
+		if err := encoder.Encode(event); err != nil {
+			return false, fmt.Errorf("error encoding finding: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, siemRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, &body)
+	if err != nil {
+		return false, fmt.Errorf("error sending findings to Splunk: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Splunk "+conf.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("error sending findings to Splunk: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// The collector describes failures as {"text": ..., "code": ...}
+		var failure struct {
+			Text string `json:"text"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, siemMaxResponseLength))
+		if json.Unmarshal(data, &failure) != nil || failure.Text == "" {
+			failure.Text = strings.TrimSpace(string(data))
+		}
+		return retryableStatus(resp.StatusCode), fmt.Errorf("error sending findings to Splunk: %s: %s", resp.Status, failure.Text)
+	}
+	return false, nil
+}
+
+// bulkItem is the outcome of one action of a bulk request
+type bulkItem struct {
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// sendBulk indexes a batch of findings with the bulk API, each under its
+// finding ID, and returns the findings to retry: the whole batch if the
+// request failed, or the findings the cluster rejected as throttled
+func (a *App) sendBulk(ctx context.Context, findings []types.Finding) ([]types.Finding, bool, error) {
+	conf := a.config().Elasticsearch
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, finding := range findings {
+		action := map[string]any{"index": map[string]string{"_index": conf.Index, "_id": aws.ToString(finding.Id)}}
+		if err := encoder.Encode(action); err != nil {
+			return nil, false, fmt.Errorf("error encoding finding: %v", err)
+		}
+		if err := encoder.Encode(finding); err != nil {
+			return nil, false, fmt.Errorf("error encoding finding: %v", err)
+		}
+	}
+
+	resp, err := a.elasticsearchRequest(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return findings, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return findings, retryableStatus(resp.StatusCode), elasticsearchError(resp)
+	}
+	var result struct {
+		Errors bool                  `json:"errors"`
+		Items  []map[string]bulkItem `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return findings, true, fmt.Errorf("error reading bulk response: %v", err)
+	}
+	if !result.Errors {
+		return nil, false, nil
+	}
+
+	// Items are answered in the order of their actions
+	var throttled []types.Finding
+	for i, item := range result.Items {
+		outcome := item["index"]
+		if outcome.Error == nil || i >= len(findings) {
+			continue
+		}
+		if outcome.Status != http.StatusTooManyRequests {
+			return nil, false, fmt.Errorf("error indexing finding %s: %s: %s", outcome.ID, outcome.Error.Type, outcome.Error.Reason)
+		}
+		throttled = append(throttled, findings[i])
+	}
+	if len(throttled) == 0 {
+		return nil, false, nil
+	}
+	return throttled, true, fmt.Errorf("error indexing findings: %d of %d throttled by the cluster", len(throttled), len(findings))
+}
+
+// putIndexTemplate installs an index template, named after the index, that
+// maps the fields of findings in indexes matching the index name. The
+// finding IDs, accounts, regions, and types are keywords for aggregations,
+// the severity and confidence numbers, the timestamps dates, and the raise
+// of the field limit leaves room for the many fields of a finding's
+// resource and service details.
+func (a *App) putIndexTemplate(ctx context.Context) (bool, error) {
+	index := a.config().Elasticsearch.Index
+	keyword := map[string]string{"type": "keyword"}
+	template := map[string]any{
+		"index_patterns": []string{index + "*"},
+		"priority":       100,
+		"template": map[string]any{
+			"settings": map[string]any{"index.mapping.total_fields.limit": 5000},
+			"mappings": map[string]any{
+				"properties": map[string]any{
+					"Id":            keyword,
+					"Arn":           keyword,
+					"AccountId":     keyword,
+					"Region":        keyword,
+					"Partition":     keyword,
+					"Type":          keyword,
+					"SchemaVersion": keyword,
+					"Severity":      map[string]string{"type": "float"},
+					"Confidence":    map[string]string{"type": "float"},
+					"Title":         map[string]string{"type": "text"},
+					"Description":   map[string]string{"type": "text"},
+					"CreatedAt":     map[string]string{"type": "date"},
+					"UpdatedAt":     map[string]string{"type": "date"},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(template)
+	if err != nil {
+		return false, err
+	}
+	resp, err := a.elasticsearchRequest(ctx, http.MethodPut, "/_index_template/"+index, "application/json", body)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := elasticsearchError(resp)
+		return retryableStatus(resp.StatusCode), fmt.Errorf("error installing index template: %v", err)
+	}
+	return false, nil
+}
+
+// elasticsearchRequest sends a request to the cluster with the configured
+// authentication, signing it for Amazon OpenSearch Service when
+// awsRegion is set
+func (a *App) elasticsearchRequest(ctx context.Context, method, path, contentType string, body []byte) (*http.Response, error) {
+	conf := a.config().Elasticsearch
+	ctx, cancel := context.WithTimeout(ctx, siemRequestTimeout)
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(conf.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("error sending findings to Elasticsearch: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	switch {
+	case conf.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+conf.APIKey)
+	case conf.Username != "":
+		req.SetBasicAuth(conf.Username, conf.Password)
+	case conf.AWSRegion != "":
+		creds, err := a.awsCfg.Credentials.Retrieve(ctx)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("error signing Elasticsearch request: %v", err)
+		}
+		hash := sha256.Sum256(body)
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+		if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), "es", conf.AWSRegion, time.Now()); err != nil {
+			cancel()
+			return nil, fmt.Errorf("error signing Elasticsearch request: %v", err)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("error sending findings to Elasticsearch: %v", err)
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the context of a response once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// elasticsearchError describes a failed request from the cluster's error
+// response, {"error": {"type": ..., "reason": ...}}, or its body
+func elasticsearchError(resp *http.Response) error {
+	var failure struct {
+		Error struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, siemMaxResponseLength))
+	message := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &failure) == nil && failure.Error.Type != "" {
+		message = failure.Error.Type + ": " + failure.Error.Reason
+	}
+	return fmt.Errorf("error sending findings to Elasticsearch: %s: %s", resp.Status, message)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// Commands the web interface sends over a job's WebSocket
+const socketCancel = "cancel"
+
+// socketCommand is a message from the client of a job's WebSocket
+type socketCommand struct {
+	Command string `json:"command"`
+}
+
+// socketStatus is the first message of a job's WebSocket, the job as
+// GET /api/jobs/{id} returns it
+type socketStatus struct {
+	Type string `json:"type"`
+	jobView
+}
+
+// socketError answers a command that could not be carried out
+type socketError struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+// handleJobSocket follows a job over a WebSocket. Like the Server-Sent
+// Events endpoint, it sends the current status and then each progress
+// event, ending with the done event, as JSON text messages. The client can
+// send {"command": "cancel"} at any time to stop the export, which cancels
+// the job's context as DELETE /api/jobs/{id} does.
+func (a *App) handleJobSocket(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.lookupJob(w, r)
+	if !ok {
+		return
+	}
+	if err := checkSameOrigin(r); err != nil {
+		telemetry.Logger(r.Context()).Warn("Rejected WebSocket request", "job_id", job.id, "error", err)
+		http.Error(w, "Cross-origin WebSocket requests are not allowed", http.StatusForbidden)
+		return
+	}
+	// The origin is checked above, where the rejection can be a plain
+	// response
+	server := websocket.Server{
+		Handler: func(conn *websocket.Conn) {
+			a.serveJobSocket(conn, r, job)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// serveJobSocket sends the job's progress over conn until the job finishes
+// or the client goes away, while carrying out the client's commands
+func (a *App) serveJobSocket(conn *websocket.Conn, r *http.Request, job *Job) {
+	log := telemetry.Logger(r.Context()).With("job_id", job.id)
+	events, unsubscribe := job.subscribe()
+	defer unsubscribe()
+
+	// The connection is hijacked, so the request's context is not canceled
+	// when the client disconnects; the reader notices instead
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			var command socketCommand
+			if err := websocket.JSON.Receive(conn, &command); err != nil {
+				return
+			}
+			switch {
+			case command.Command != socketCancel:
+				websocket.JSON.Send(conn, socketError{Type: "error", Error: fmt.Sprintf("Unknown command %q", command.Command)})
+			case requestRole(r.Context()) < roleOperator:
+				websocket.JSON.Send(conn, socketError{Type: "error", Error: "Your role does not allow canceling exports"})
+			default:
+				log.Info("Canceling export job")
+				job.cancel()
+				a.recordAudit(r.Context(), auditEntry{User: requestUser(r.Context()), Action: auditJobCancel, Method: r.Method, Path: r.URL.Path, RemoteAddr: r.RemoteAddr, JobID: job.id})
+			}
+		}
+	}()
+
+	if err := websocket.JSON.Send(conn, socketStatus{Type: "status", jobView: job.view()}); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-gone:
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := websocket.JSON.Send(conn, event); err != nil {
+				return
+			}
+			if event.Type == gd.EventDone {
+				return
+			}
+		}
+	}
+}
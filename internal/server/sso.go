@@ -0,0 +1,453 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc"
+	ssooidctypes "github.com/aws/aws-sdk-go-v2/service/ssooidc/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// expiredCredentialCodes are the API error codes of calls made with
+// credentials or an SSO token that have expired
+var expiredCredentialCodes = map[string]bool{
+	"ExpiredToken":          true,
+	"ExpiredTokenException": true,
+	"UnauthorizedException": true,
+	"InvalidGrantException": true,
+}
+
+// expiredTokenMessages are returned by the SDK's SSO token provider, for
+// sso-session profiles, without a typed error
+var expiredTokenMessages = []string{
+	"cached SSO token is expired",
+	"failed to read cached SSO token file",
+}
+
+// credentialsExpired reports whether err comes from expired credentials,
+// which no retry can fix until the user signs in again
+func credentialsExpired(err error) bool {
+	var tokenErr *ssocreds.InvalidTokenError
+	if errors.As(err, &tokenErr) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && expiredCredentialCodes[apiErr.ErrorCode()] {
+		return true
+	}
+	for _, message := range expiredTokenMessages {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// expiredCredentialsError replaces the SDK's error for expired credentials
+// with one that says how to sign in again
+type expiredCredentialsError struct {
+	profile string
+	err     error
+}
+
+func (e *expiredCredentialsError) Error() string {
+	how := "aws sso login"
+	if e.profile != "" {
+		how += " --profile " + e.profile
+	}
+	return fmt.Sprintf("the AWS credentials of %s have expired; sign in again with `%s` or from the web interface (%v)", profileLabel(e.profile), how, e.err)
+}
+
+func (e *expiredCredentialsError) Unwrap() error {
+	return e.err
+}
+
+// profileLabel names a profile in messages
+func profileLabel(profile string) string {
+	if profile == "" {
+		return "the default profile"
+	}
+	return "profile " + profile
+}
+
+// ssoSessions tracks which profiles' credentials have expired and the SSO
+// sign-ins started from the server
+type ssoSessions struct {
+	mu      sync.Mutex
+	expired map[string]bool
+	logins  map[string]*ssoLogin
+}
+
+func newSSOSessions() *ssoSessions {
+	return &ssoSessions{expired: make(map[string]bool), logins: make(map[string]*ssoLogin)}
+}
+
+// setExpired records whether the last call made with profile's credentials
+// failed because they had expired
+func (s *ssoSessions) setExpired(profile string, expired bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expired {
+		s.expired[profile] = true
+	} else {
+		delete(s.expired, profile)
+	}
+}
+
+// isExpired reports whether profile needs to sign in again
+func (s *ssoSessions) isExpired(profile string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expired[profile]
+}
+
+// exportErrorStatus is the HTTP status of a failed export: 401 when its
+// credentials have expired, so clients know to sign in again, otherwise 500
+func (a *App) exportErrorStatus(opts exportOptions) int {
+	if a.sso.isExpired(opts.Profile) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// detectExpiredCredentials is an SDK middleware that records whether each
+// call made with profile's credentials found them expired, and explains how
+// to sign in again in the call's error
+func detectExpiredCredentials(profile string, sessions *ssoSessions) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("DetectExpiredCredentials",
+			func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				out, metadata, err := next.HandleInitialize(ctx, in)
+				expired := err != nil && credentialsExpired(err)
+				if err == nil || expired {
+					sessions.setExpired(profile, expired)
+				}
+				if expired {
+					err = &expiredCredentialsError{profile: profile, err: err}
+				}
+				return out, metadata, err
+			}), middleware.After)
+	}
+}
+
+// ssoSettings are the IAM Identity Center settings of a profile, from the
+// profile itself or the profile its assumed role starts from
+type ssoSettings struct {
+	// cacheKey names the SDK's token cache file: the sso-session name, or
+	// the start URL of a legacy profile
+	cacheKey string
+	startURL string
+	region   string
+	// session is set for sso-session profiles, whose tokens can be refreshed
+	session bool
+}
+
+// loadSSOSettings returns the SSO settings of profile, or an error if the
+// profile doesn't sign in through IAM Identity Center
+func loadSSOSettings(ctx context.Context, profile string) (ssoSettings, error) {
+	configFile, credentialsFile := sharedFiles()
+	name := profile
+	if name == "" {
+		name = os.Getenv("AWS_PROFILE")
+	}
+	if name == "" {
+		name = "default"
+	}
+	shared, err := config.LoadSharedConfigProfile(ctx, name, func(o *config.LoadSharedConfigOptions) {
+		o.ConfigFiles = []string{configFile}
+		o.CredentialsFiles = []string{credentialsFile}
+	})
+	if err != nil {
+		return ssoSettings{}, err
+	}
+	for c := &shared; c != nil; c = c.Source {
+		if c.SSOSession != nil {
+			return ssoSettings{cacheKey: c.SSOSession.Name, startURL: c.SSOSession.SSOStartURL, region: c.SSOSession.SSORegion, session: true}, nil
+		}
+		if c.SSOStartURL != "" {
+			return ssoSettings{cacheKey: c.SSOStartURL, startURL: c.SSOStartURL, region: c.SSORegion}, nil
+		}
+	}
+	return ssoSettings{}, fmt.Errorf("%s does not sign in through AWS SSO", profileLabel(profile))
+}
+
+// SSO sign-in states
+const (
+	ssoLoginPending   = "pending"
+	ssoLoginSucceeded = "succeeded"
+	ssoLoginFailed    = "failed"
+)
+
+// ssoLogin is an OAuth device authorization started from the server: the
+// user opens the verification URL, confirms the code, and the server stores
+// the resulting token where the SDK reads it
+type ssoLogin struct {
+	mu sync.Mutex
+
+	id              string
+	profile         string
+	status          string
+	err             string
+	userCode        string
+	verificationURI string
+	// verificationURIComplete includes the user code
+	verificationURIComplete string
+	expiresAt               time.Time
+}
+
+// ssoLoginView is the JSON representation of an SSO sign-in
+type ssoLoginView struct {
+	ID                      string    `json:"id"`
+	Profile                 string    `json:"profile,omitempty"`
+	Status                  string    `json:"status"`
+	Error                   string    `json:"error,omitempty"`
+	UserCode                string    `json:"userCode"`
+	VerificationURI         string    `json:"verificationUri"`
+	VerificationURIComplete string    `json:"verificationUriComplete"`
+	ExpiresAt               time.Time `json:"expiresAt"`
+}
+
+func (l *ssoLogin) view() ssoLoginView {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return ssoLoginView{
+		ID:                      l.id,
+		Profile:                 l.profile,
+		Status:                  l.status,
+		Error:                   l.err,
+		UserCode:                l.userCode,
+		VerificationURI:         l.verificationURI,
+		VerificationURIComplete: l.verificationURIComplete,
+		ExpiresAt:               l.expiresAt,
+	}
+}
+
+func (l *ssoLogin) finish(status string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.status = status
+	if err != nil {
+		l.err = err.Error()
+	}
+}
+
+// startSSOLogin starts the device authorization of profile, or returns the
+// one already pending for it
+func (a *App) startSSOLogin(ctx context.Context, profile string) (*ssoLogin, error) {
+	settings, err := loadSSOSettings(ctx, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sign-ins are forgotten once their code has expired
+	a.sso.mu.Lock()
+	for id, login := range a.sso.logins {
+		view := login.view()
+		if time.Now().After(view.ExpiresAt) {
+			delete(a.sso.logins, id)
+			continue
+		}
+		if view.Profile == profile && view.Status == ssoLoginPending {
+			a.sso.mu.Unlock()
+			return login, nil
+		}
+	}
+	a.sso.mu.Unlock()
+
+	client := ssooidc.New(ssooidc.Options{Region: settings.region})
+	// Tokens of sso-session profiles carry a refresh token, so the SDK can
+	// renew them without another sign-in
+	var scopes []string
+	if settings.session {
+		scopes = []string{"sso:account:access"}
+	}
+	registration, err := client.RegisterClient(ctx, &ssooidc.RegisterClientInput{
+		ClientName: aws.String(gd.RoleSessionName),
+		ClientType: aws.String("public"),
+		Scopes:     scopes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error registering with IAM Identity Center: %v", err)
+	}
+	authorization, err := client.StartDeviceAuthorization(ctx, &ssooidc.StartDeviceAuthorizationInput{
+		ClientId:     registration.ClientId,
+		ClientSecret: registration.ClientSecret,
+		StartUrl:     aws.String(settings.startURL),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error starting device authorization: %v", err)
+	}
+
+	login := &ssoLogin{
+		id:                      newJobID(),
+		profile:                 profile,
+		status:                  ssoLoginPending,
+		userCode:                aws.ToString(authorization.UserCode),
+		verificationURI:         aws.ToString(authorization.VerificationUri),
+		verificationURIComplete: aws.ToString(authorization.VerificationUriComplete),
+		expiresAt:               time.Now().Add(time.Duration(authorization.ExpiresIn) * time.Second),
+	}
+	a.sso.mu.Lock()
+	a.sso.logins[login.id] = login
+	a.sso.mu.Unlock()
+
+	go a.completeSSOLogin(login, client, settings, registration, authorization)
+	return login, nil
+}
+
+// completeSSOLogin polls for the token until the user approves the sign-in
+// or the device code expires, then writes it to the SDK's token cache
+func (a *App) completeSSOLogin(login *ssoLogin, client *ssooidc.Client, settings ssoSettings, registration *ssooidc.RegisterClientOutput, authorization *ssooidc.StartDeviceAuthorizationOutput) {
+	ctx, cancel := context.WithDeadline(context.Background(), login.expiresAt)
+	defer cancel()
+	log := telemetry.Logger(ctx).With("profile", login.profile)
+
+	interval := max(time.Duration(authorization.Interval)*time.Second, time.Second)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Warn("SSO sign-in expired")
+			login.finish(ssoLoginFailed, errors.New("the sign-in was not approved before the code expired"))
+			return
+		case <-time.After(interval):
+		}
+
+		token, err := client.CreateToken(ctx, &ssooidc.CreateTokenInput{
+			ClientId:     registration.ClientId,
+			ClientSecret: registration.ClientSecret,
+			DeviceCode:   authorization.DeviceCode,
+			GrantType:    aws.String("urn:ietf:params:oauth:grant-type:device_code"),
+		})
+		var pending *ssooidctypes.AuthorizationPendingException
+		var slowDown *ssooidctypes.SlowDownException
+		switch {
+		case errors.As(err, &pending):
+			continue
+		case errors.As(err, &slowDown):
+			interval += 5 * time.Second
+			continue
+		case err != nil:
+			log.Error("SSO sign-in failed", "error", err)
+			login.finish(ssoLoginFailed, err)
+			return
+		}
+
+		if err := writeSSOToken(settings, registration, token); err != nil {
+			log.Error("Unable to save SSO token", "error", err)
+			login.finish(ssoLoginFailed, err)
+			return
+		}
+		a.sso.setExpired(login.profile, false)
+		// Drop credentials cached from the expired session
+		if cfg, err := a.profileConfig(login.profile); err == nil {
+			if cache, ok := cfg.Credentials.(*aws.CredentialsCache); ok {
+				cache.Invalidate()
+			}
+		}
+		log.Info("SSO sign-in succeeded")
+		login.finish(ssoLoginSucceeded, nil)
+		return
+	}
+}
+
+// ssoCachedToken is the token cache file format read by the SDK and the AWS
+// CLI
+type ssoCachedToken struct {
+	AccessToken           string `json:"accessToken"`
+	ExpiresAt             string `json:"expiresAt"`
+	RefreshToken          string `json:"refreshToken,omitempty"`
+	ClientID              string `json:"clientId,omitempty"`
+	ClientSecret          string `json:"clientSecret,omitempty"`
+	RegistrationExpiresAt string `json:"registrationExpiresAt,omitempty"`
+	Region                string `json:"region"`
+	StartURL              string `json:"startUrl"`
+}
+
+// writeSSOToken saves token to the cache file of settings, readable only
+// by the server's user
+func writeSSOToken(settings ssoSettings, registration *ssooidc.RegisterClientOutput, token *ssooidc.CreateTokenOutput) error {
+	path, err := ssocreds.StandardCachedTokenFilepath(settings.cacheKey)
+	if err != nil {
+		return err
+	}
+	cached := ssoCachedToken{
+		AccessToken: aws.ToString(token.AccessToken),
+		ExpiresAt:   time.Now().Add(time.Duration(token.ExpiresIn) * time.Second).UTC().Format(time.RFC3339),
+		Region:      settings.region,
+		StartURL:    settings.startURL,
+	}
+	if settings.session {
+		cached.RefreshToken = aws.ToString(token.RefreshToken)
+		cached.ClientID = aws.ToString(registration.ClientId)
+		cached.ClientSecret = aws.ToString(registration.ClientSecret)
+		cached.RegistrationExpiresAt = time.Unix(registration.ClientSecretExpiresAt, 0).UTC().Format(time.RFC3339)
+	}
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("error creating token cache: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("error writing token cache: %v", err)
+	}
+	return nil
+}
+
+// handleStartSSOLogin starts an SSO sign-in for the profile parameter and
+// returns the verification URL and code to show the user
+func (a *App) handleStartSSOLogin(w http.ResponseWriter, r *http.Request) {
+	if !a.config().SSOLogin {
+		http.Error(w, "SSO sign-in from the server is disabled", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	profile := a.config().Profile
+	if p := r.Form.Get("profile"); p != "" {
+		profile = p
+	}
+	login, err := a.startSSOLogin(r.Context(), profile)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to start SSO sign-in: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	telemetry.Logger(r.Context()).Info("Started SSO sign-in", "profile", profile, "login_id", login.id)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", a.path("/api/sso/login/"+login.id))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(login.view())
+}
+
+// handleGetSSOLogin reports whether an SSO sign-in has completed
+func (a *App) handleGetSSOLogin(w http.ResponseWriter, r *http.Request) {
+	a.sso.mu.Lock()
+	login, ok := a.sso.logins[r.PathValue("id")]
+	a.sso.mu.Unlock()
+	if !ok {
+		http.Error(w, "Sign-in not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(login.view())
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// defaultStateFile is the name of the state file in the output directory
+// when no stateFile is configured
+const defaultStateFile = ".guardduty_export_state.json"
+
+// exportState is the content of the state file. Watermarks maps the name of
+// each incremental export to the latest UpdatedAt it has exported for each
+// region and detector, keyed by watermarkKey.
+type exportState struct {
+	Watermarks map[string]map[string]time.Time `json:"watermarks"`
+}
+
+// stateFile persists the watermarks of incremental exports. Updates are
+// serialized so concurrent jobs don't lose each other's watermarks.
+type stateFile struct {
+	mu   sync.Mutex
+	path string
+}
+
+// load reads the state file; a missing file is an empty state
+func (s *stateFile) load() (exportState, error) {
+	state := exportState{Watermarks: make(map[string]map[string]time.Time)}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("error reading state file %s: %v", s.path, err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("error parsing state file %s: %v", s.path, err)
+	}
+	if state.Watermarks == nil {
+		state.Watermarks = make(map[string]map[string]time.Time)
+	}
+	return state, nil
+}
+
+// watermarks returns the watermarks of the incremental export name
+func (s *stateFile) watermarks(name string) (map[string]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return state.Watermarks[name], nil
+}
+
+// advance moves the watermarks of the incremental export name forward to
+// marks, keeping any that are already later, and rewrites the state file
+func (s *stateFile) advance(name string, marks map[string]time.Time) error {
+	if len(marks) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.load()
+	if err != nil {
+		return err
+	}
+	current := state.Watermarks[name]
+	if current == nil {
+		current = make(map[string]time.Time)
+		state.Watermarks[name] = current
+	}
+	for key, mark := range marks {
+		if mark.After(current[key]) {
+			current[key] = mark
+		}
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding state: %v", err)
+	}
+	if err := writeFileAtomic(s.path, append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing state file %s: %v", s.path, err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data. It writes a temporary
+// file and renames it, so a crash can't leave the file truncated.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// commitWatermarks records what an incremental export wrote, once it has been
+// stored. A failure is only logged: the next run exports the findings again.
+func (a *App) commitWatermarks(ctx context.Context, opts exportOptions, results []gd.RegionResult) {
+	if opts.incremental == "" {
+		return
+	}
+	if err := a.state.advance(opts.incremental, gd.ExportedWatermarks(results)); err != nil {
+		telemetry.Logger(ctx).Error("Error saving watermarks", "incremental", opts.incremental, "error", err)
+	}
+}
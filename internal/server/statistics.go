@@ -0,0 +1,44 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// handleStatistics counts the findings an export with the same parameters
+// would fetch, by severity and finding type, without fetching them
+func (a *App) handleStatistics(w http.ResponseWriter, r *http.Request) {
+	opts, err := a.parseExportOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := gd.ResolveRegions(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+	if err := gd.ResolveAccounts(r.Context(), &opts.FetchOptions); err != nil {
+		http.Error(w, err.Error(), a.exportErrorStatus(opts))
+		return
+	}
+
+	stats := gd.FindingStatistics(r.Context(), opts.FetchOptions)
+	telemetry.Logger(r.Context()).Info("Counted findings", "regions", opts.Regions, "findings", stats.Findings)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleJobAggregates counts the findings a job has fetched so far by
+// severity, type, account and region, and affected resource, for its
+// dashboard
+func (a *App) handleJobAggregates(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.lookupJob(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.aggregator.Aggregates())
+}
@@ -0,0 +1,442 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+	_ "modernc.org/sqlite"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// findingsStoreSchema creates the tables of the findings store. Each
+// finding has one row in findings, keyed by its ID, with its times in Unix
+// milliseconds so ranges compare as numbers and archived_at for when it
+// was first seen archived; findings_text indexes the
+// titles and descriptions for full-text search and is kept in step by the
+// triggers. The columns added since are in findingsStoreMigrations.
+const findingsStoreSchema = `
+CREATE TABLE IF NOT EXISTS findings (
+	id TEXT PRIMARY KEY,
+	account_id TEXT,
+	region TEXT,
+	type TEXT,
+	title TEXT,
+	description TEXT,
+	severity REAL,
+	created_at INTEGER,
+	updated_at INTEGER,
+	archived INTEGER,
+	archived_at INTEGER,
+	first_stored_at INTEGER NOT NULL,
+	stored_at INTEGER NOT NULL,
+	finding TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS findings_account_region ON findings(account_id, region);
+CREATE INDEX IF NOT EXISTS findings_type ON findings(type);
+CREATE INDEX IF NOT EXISTS findings_created_at ON findings(created_at);
+CREATE INDEX IF NOT EXISTS findings_updated_at ON findings(updated_at);
+CREATE VIRTUAL TABLE IF NOT EXISTS findings_text USING fts5(title, description, content='findings');
+CREATE TRIGGER IF NOT EXISTS findings_text_insert AFTER INSERT ON findings BEGIN
+	INSERT INTO findings_text(rowid, title, description) VALUES (new.rowid, new.title, new.description);
+END;
+CREATE TRIGGER IF NOT EXISTS findings_text_update AFTER UPDATE ON findings BEGIN
+	INSERT INTO findings_text(findings_text, rowid, title, description) VALUES ('delete', old.rowid, old.title, old.description);
+	INSERT INTO findings_text(rowid, title, description) VALUES (new.rowid, new.title, new.description);
+END;
+CREATE TRIGGER IF NOT EXISTS findings_text_delete AFTER DELETE ON findings BEGIN
+	INSERT INTO findings_text(findings_text, rowid, title, description) VALUES ('delete', old.rowid, old.title, old.description);
+END;
+`
+
+// findingsStoreMigrations add the columns of later versions to a store
+// created by an earlier one: deleted_at for when the retention policy
+// soft-deleted a finding
+var findingsStoreMigrations = []string{
+	"ALTER TABLE findings ADD COLUMN deleted_at INTEGER",
+}
+
+// upsertFinding stores a finding, or replaces the stored one unless that
+// was updated later, keeping when the finding was first stored. A finding
+// first stored archived counts as archived at its last update, and one
+// archived since it was stored as archived when that was seen. A finding
+// fetched again after it was soft-deleted is no longer deleted.
+const upsertFinding = `
+INSERT INTO findings (id, account_id, region, type, title, description, severity, created_at, updated_at, archived, archived_at, first_stored_at, stored_at, finding)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, CASE WHEN ?10 THEN ?9 END, ?, ?, ?)
+ON CONFLICT(id) DO UPDATE SET
+	account_id = excluded.account_id, region = excluded.region, type = excluded.type,
+	title = excluded.title, description = excluded.description, severity = excluded.severity,
+	created_at = excluded.created_at, updated_at = excluded.updated_at, archived = excluded.archived,
+	archived_at = CASE WHEN NOT excluded.archived THEN NULL WHEN findings.archived THEN findings.archived_at ELSE excluded.stored_at END,
+	stored_at = excluded.stored_at, finding = excluded.finding, deleted_at = NULL
+WHERE excluded.updated_at >= findings.updated_at
+`
+
+// findingsStore keeps every finding the exports fetch in a SQLite database,
+// so findings can be searched across runs rather than one export at a time.
+// The database is shared with the export command, and writers wait for
+// each other's transactions.
+type findingsStore struct {
+	db *sql.DB
+}
+
+// openFindingsStore opens the database at path, creating it and its tables
+// as needed
+func openFindingsStore(path string) (*findingsStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("error opening findings store %s: %v", path, err)
+	}
+	if _, err := db.Exec(findingsStoreSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating findings store %s: %v", path, err)
+	}
+	for _, migration := range findingsStoreMigrations {
+		if _, err := db.Exec(migration); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			db.Close()
+			return nil, fmt.Errorf("error migrating findings store %s: %v", path, err)
+		}
+	}
+	return &findingsStore{db: db}, nil
+}
+
+// retire deletes the findings no export has stored for longer than the
+// policy's StoreMaxAge, soft-deleting them with a purge delay, and purges
+// the soft-deleted findings past it, or all of them with purge
+func (s *findingsStore) retire(ctx context.Context, now time.Time, policy retentionConfig, purge bool) (retentionCounts, error) {
+	var counts retentionCounts
+	exec := func(query string, args ...any) (int, error) {
+		result, err := s.db.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, fmt.Errorf("error retiring stored findings: %v", err)
+		}
+		n, err := result.RowsAffected()
+		return int(n), err
+	}
+	var err error
+	if policy.StoreMaxAge > 0 {
+		cutoff := now.Add(-policy.StoreMaxAge).UnixMilli()
+		if policy.soft(purge) {
+			counts.Deleted, err = exec("UPDATE findings SET deleted_at = ? WHERE deleted_at IS NULL AND stored_at < ?", now.UnixMilli(), cutoff)
+		} else {
+			counts.Purged, err = exec("DELETE FROM findings WHERE deleted_at IS NULL AND stored_at < ?", cutoff)
+		}
+		if err != nil {
+			return counts, err
+		}
+	}
+	purgeBefore := now.Add(-policy.PurgeDelay).UnixMilli()
+	if purge {
+		purgeBefore = now.UnixMilli() + 1
+	}
+	n, err := exec("DELETE FROM findings WHERE deleted_at < ?", purgeBefore)
+	counts.Purged += n
+	return counts, err
+}
+
+// restore brings back the soft-deleted findings, returning how many
+func (s *findingsStore) restore(ctx context.Context) (int, error) {
+	result, err := s.db.ExecContext(ctx, "UPDATE findings SET deleted_at = NULL WHERE deleted_at IS NOT NULL")
+	if err != nil {
+		return 0, fmt.Errorf("error restoring stored findings: %v", err)
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// upsert stores a page of fetched findings. A page that cannot be stored
+// is logged and counted rather than failing the export that fetched it.
+func (s *findingsStore) upsert(ctx context.Context, findings []types.Finding) {
+	if err := s.upsertFindings(ctx, findings); err != nil {
+		telemetry.Logger(ctx).Error("Error storing findings", "findings", len(findings), "error", err)
+		telemetry.StoreErrors.Inc()
+	}
+}
+
+func (s *findingsStore) upsertFindings(ctx context.Context, findings []types.Finding) error {
+	// Storing outlives a canceled export, so the findings it fetched are kept
+	ctx = context.WithoutCancel(ctx)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, upsertFinding)
+	if err != nil {
+		return fmt.Errorf("error preparing insert: %v", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now().UnixMilli()
+	for _, finding := range findings {
+		id := aws.ToString(finding.Id)
+		if id == "" {
+			continue
+		}
+		data, err := json.Marshal(finding)
+		if err != nil {
+			return fmt.Errorf("error encoding finding %s: %v", id, err)
+		}
+		archived := finding.Service != nil && aws.ToBool(finding.Service.Archived)
+		_, err = stmt.ExecContext(ctx, id, aws.ToString(finding.AccountId), aws.ToString(finding.Region),
+			aws.ToString(finding.Type), aws.ToString(finding.Title), aws.ToString(finding.Description),
+			aws.ToFloat64(finding.Severity), storeTime(finding.CreatedAt), storeTime(finding.UpdatedAt),
+			archived, now, now, string(data))
+		if err != nil {
+			return fmt.Errorf("error storing finding %s: %v", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing findings: %v", err)
+	}
+	return nil
+}
+
+// storeTime returns a finding timestamp in Unix milliseconds, or nil when it
+// is missing or malformed
+func storeTime(s *string) any {
+	t, err := time.Parse(time.RFC3339, aws.ToString(s))
+	if err != nil {
+		return nil
+	}
+	return t.UnixMilli()
+}
+
+// storedFinding is a finding of the store, with the finding itself as
+// GuardDuty returned it
+type storedFinding struct {
+	ID        string  `json:"id"`
+	AccountID string  `json:"accountId"`
+	Region    string  `json:"region"`
+	Type      string  `json:"type"`
+	Title     string  `json:"title"`
+	Severity  float64 `json:"severity"`
+	Archived  bool    `json:"archived"`
+	// FirstStoredAt is when an export first fetched the finding, and
+	// StoredAt when one last stored a change to it
+	FirstStoredAt time.Time       `json:"firstStoredAt"`
+	StoredAt      time.Time       `json:"storedAt"`
+	Finding       json.RawMessage `json:"finding"`
+}
+
+// storePage is a page of the findings store
+type storePage struct {
+	Items []storedFinding `json:"items"`
+	// NextToken requests the next page, and is left out on the last
+	NextToken string `json:"nextToken,omitempty"`
+}
+
+// storeQuery selects findings of the store
+type storeQuery struct {
+	filter   gd.Filter
+	accounts []string
+	regions  []string
+	// types, when not nil, are the stored finding types matching the
+	// taxonomy of the filter, which SQL cannot evaluate
+	types []string
+	// text holds the words that titles or descriptions must contain
+	text   string
+	offset int
+	limit  int
+}
+
+// where returns the SQL conditions of the query and their arguments
+func (q storeQuery) where() (string, []any) {
+	// Soft-deleted findings are hidden until they are purged
+	conditions := []string{"deleted_at IS NULL"}
+	var args []any
+	in := func(column string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		conditions = append(conditions, column+" IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")+")")
+		for _, v := range values {
+			args = append(args, v)
+		}
+	}
+	in("account_id", q.accounts)
+	in("region", q.regions)
+	if q.filter.MinSeverity > 0 {
+		conditions = append(conditions, "severity >= ?")
+		args = append(args, q.filter.MinSeverity)
+	}
+	between := func(column string, after, before time.Time) {
+		if !after.IsZero() {
+			conditions = append(conditions, column+" >= ?")
+			args = append(args, after.UnixMilli())
+		}
+		if !before.IsZero() {
+			conditions = append(conditions, column+" < ?")
+			args = append(args, before.UnixMilli())
+		}
+	}
+	between("created_at", q.filter.CreatedAfter, q.filter.CreatedBefore)
+	between("updated_at", q.filter.UpdatedAfter, q.filter.UpdatedBefore)
+	if len(q.filter.FindingTypes) > 0 {
+		var types []string
+		for _, pattern := range q.filter.FindingTypes {
+			if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+				types = append(types, "substr(type, 1, ?) = ?")
+				args = append(args, len(prefix), prefix)
+			} else {
+				types = append(types, "type = ?")
+				args = append(args, pattern)
+			}
+		}
+		conditions = append(conditions, "("+strings.Join(types, " OR ")+")")
+	}
+	if q.types != nil {
+		if len(q.types) == 0 {
+			conditions = append(conditions, "0")
+		}
+		in("type", q.types)
+	}
+	if q.filter.Archived != nil {
+		conditions = append(conditions, "archived = ?")
+		args = append(args, *q.filter.Archived)
+	}
+	if q.text != "" {
+		conditions = append(conditions, "rowid IN (SELECT rowid FROM findings_text WHERE findings_text MATCH ?)")
+		args = append(args, q.text)
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// search returns a page of the findings the query selects, most recently
+// updated first, and whether more follow
+func (s *findingsStore) search(ctx context.Context, q storeQuery) ([]storedFinding, bool, error) {
+	q, err := s.withTaxonomy(ctx, q)
+	if err != nil {
+		return nil, false, err
+	}
+	where, args := q.where()
+	rows, err := s.db.QueryContext(ctx, "SELECT id, account_id, region, type, title, severity, archived, first_stored_at, stored_at, finding FROM findings"+
+		where+" ORDER BY updated_at DESC, id LIMIT ? OFFSET ?", append(args, q.limit+1, q.offset)...)
+	if err != nil {
+		return nil, false, fmt.Errorf("error querying findings store: %v", err)
+	}
+	defer rows.Close()
+	findings := []storedFinding{}
+	for rows.Next() {
+		var f storedFinding
+		var firstStored, stored int64
+		var data string
+		if err := rows.Scan(&f.ID, &f.AccountID, &f.Region, &f.Type, &f.Title, &f.Severity, &f.Archived, &firstStored, &stored, &data); err != nil {
+			return nil, false, fmt.Errorf("error reading findings store: %v", err)
+		}
+		f.FirstStoredAt, f.StoredAt = time.UnixMilli(firstStored).UTC(), time.UnixMilli(stored).UTC()
+		f.Finding = json.RawMessage(data)
+		findings = append(findings, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("error reading findings store: %v", err)
+	}
+	if len(findings) > q.limit {
+		return findings[:q.limit], true, nil
+	}
+	return findings, false, nil
+}
+
+// withTaxonomy returns the query restricted to the stored finding types that
+// match the taxonomy of its filter, if it has one
+func (s *findingsStore) withTaxonomy(ctx context.Context, q storeQuery) (storeQuery, error) {
+	if !q.filter.HasTaxonomy() {
+		return q, nil
+	}
+	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT type FROM findings WHERE deleted_at IS NULL")
+	if err != nil {
+		return q, fmt.Errorf("error querying findings store: %v", err)
+	}
+	defer rows.Close()
+	q.types = []string{}
+	for rows.Next() {
+		var findingType string
+		if err := rows.Scan(&findingType); err != nil {
+			return q, fmt.Errorf("error reading findings store: %v", err)
+		}
+		if q.filter.MatchesTaxonomy(findingType) {
+			q.types = append(q.types, findingType)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return q, fmt.Errorf("error reading findings store: %v", err)
+	}
+	return q, nil
+}
+
+// textQuery turns the words of a search into a full-text query matching
+// titles or descriptions that contain all of them. A word ending in "*"
+// matches as a prefix; any other syntax is searched for literally.
+func textQuery(search string) string {
+	var terms []string
+	for _, word := range strings.Fields(search) {
+		word, prefix := strings.CutSuffix(word, "*")
+		word = strings.ReplaceAll(word, `"`, `""`)
+		if word == "" {
+			continue
+		}
+		term := `"` + word + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
+// handleStoreFindings searches the findings store by account, region,
+// severity, type, time range, and the words of titles and descriptions
+func (a *App) handleStoreFindings(w http.ResponseWriter, r *http.Request) {
+	if a.store == nil {
+		http.Error(w, "The findings store is not enabled: set storeFile", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	filter, err := gd.ParseFilter(query, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := storeQuery{filter: filter, accounts: query["accountId"], regions: query["region"], text: textQuery(query.Get("q")), limit: defaultPageLimit}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit %q: must be 1 to %d", v, maxPageLimit), http.StatusBadRequest)
+			return
+		}
+		q.limit = n
+	}
+	if v := query.Get("nextToken"); v != "" {
+		position, err := base64.RawURLEncoding.DecodeString(v)
+		n, convErr := strconv.Atoi(string(position))
+		if err != nil || convErr != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("Invalid nextToken %q", v), http.StatusBadRequest)
+			return
+		}
+		q.offset = n
+	}
+
+	findings, more, err := a.store.search(r.Context(), q)
+	if err != nil {
+		telemetry.Logger(r.Context()).Error("Error searching findings store", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := storePage{Items: findings}
+	if more {
+		result.NextToken = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(q.offset + q.limit)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// defaultSuppressedFile is the name of the suppressed file in the output
+// directory
+const defaultSuppressedFile = "suppressed.csv"
+
+// suppressedColumns are the export columns of each finding recorded in the
+// suppressed file, between its SuppressedAt and Reason
+var suppressedColumns = []string{"AccountId", "Region", "FindingId", "FindingType", "Severity", "ResourceType", "ResourceId", "Title", "UpdatedAt"}
+
+// loadSuppressions reads the suppression file at path, a YAML or JSON list
+// of suppressions, and returns those that have not expired
+func loadSuppressions(path string) (*gd.SuppressionList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading suppression file %s: %v", path, err)
+	}
+	var suppressions []gd.Suppression
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&suppressions); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error parsing suppression file %s: %v", path, err)
+	}
+	return gd.NewSuppressionList(suppressions, time.Now())
+}
+
+// parseSuppressions reads the suppress export option, which applies the
+// suppression file unless it is false. The file is read again for each
+// export, so edits to it apply without a restart.
+func (a *App) parseSuppressions(query url.Values, opts *exportOptions) error {
+	enabled := true
+	if v := query.Get("suppress"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Invalid suppress %q", v)
+		}
+		enabled = b
+	}
+	path := a.config().SuppressionsFile
+	if !enabled || path == "" {
+		return nil
+	}
+	suppressions, err := loadSuppressions(path)
+	if err != nil {
+		return fmt.Errorf("Invalid suppressionsFile, %v", err)
+	}
+	opts.Suppressions = suppressions
+	return nil
+}
+
+// suppressedLog appends the findings suppressions left out of exports to a
+// CSV file, so that none disappears without a record. The header is written
+// when the file is created.
+type suppressedLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+// add records the suppressed findings of an export's results
+func (l *suppressedLog) add(results []gd.RegionResult, at time.Time) error {
+	var rows [][]string
+	for _, result := range results {
+		for _, suppressed := range result.Suppressed {
+			row := []string{at.UTC().Format(time.RFC3339)}
+			for _, column := range suppressedColumns {
+				row = append(row, export.ColumnValue(suppressed.Finding, column))
+			}
+			rows = append(rows, append(row, suppressed.Reason))
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("error writing suppressed file %s: %v", l.path, err)
+	}
+	w := csv.NewWriter(file)
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		w.Write(append(append([]string{"SuppressedAt"}, suppressedColumns...), "Reason"))
+	}
+	w.WriteAll(rows)
+	err = w.Error()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing suppressed file %s: %v", l.path, err)
+	}
+	return nil
+}
+
+// recordSuppressed records the findings suppressions left out of an export
+// in the suppressed file. A record that cannot be written is logged, with
+// the number of findings, without failing the export.
+func (a *App) recordSuppressed(ctx context.Context, results []gd.RegionResult) {
+	n := 0
+	for _, result := range results {
+		n += len(result.Suppressed)
+	}
+	if n == 0 {
+		return
+	}
+	log := telemetry.Logger(ctx)
+	if err := a.suppressed.add(results, time.Now()); err != nil {
+		log.Error("Error recording suppressed findings", "findings", n, "error", err)
+		return
+	}
+	log.Info("Recorded suppressed findings", "findings", n, "file", a.suppressed.path)
+}
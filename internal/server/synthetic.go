@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// maxSyntheticFindings is the most synthetic findings of a region, which
+// are all held in memory once the region is exported
+const maxSyntheticFindings = 1_000_000
+
+// syntheticConfig replaces GuardDuty with generated findings, so the export
+// pipeline, its writers and destinations, the web interface, and the
+// concurrency settings can be load tested at any volume without AWS. It is
+// off unless findings is set.
+type syntheticConfig struct {
+	// Findings is the number of findings of each region
+	Findings int `yaml:"findings"`
+	// Seed selects the findings generated: runs with the same seed export
+	// the same findings
+	Seed uint64 `yaml:"seed"`
+	// Latency delays every GuardDuty call, such as 50ms for the round trip
+	// to a distant region
+	Latency time.Duration `yaml:"latency"`
+	// AccountID owns the findings (default 123456789012)
+	AccountID string `yaml:"accountId"`
+}
+
+func (c syntheticConfig) enabled() bool {
+	return c.Findings > 0
+}
+
+func (c syntheticConfig) validate() error {
+	if c.Findings < 0 || c.Findings > maxSyntheticFindings {
+		return fmt.Errorf("invalid synthetic.findings %d: must be 0 to %d", c.Findings, maxSyntheticFindings)
+	}
+	if c.Latency < 0 {
+		return fmt.Errorf("invalid synthetic.latency %v: must not be negative", c.Latency)
+	}
+	if c.AccountID != "" && (len(c.AccountID) != 12 || strings.Trim(c.AccountID, "0123456789") != "") {
+		return fmt.Errorf("invalid synthetic.accountId %q: must be 12 digits", c.AccountID)
+	}
+	return nil
+}
+
+// clients returns the clients answering exports with the synthetic
+// findings of c, or nil when they are off
+func (c syntheticConfig) clients() gd.Clients {
+	if !c.enabled() {
+		return nil
+	}
+	return gd.NewSynthetic(gd.SyntheticOptions{Findings: c.Findings, Seed: c.Seed, Latency: c.Latency, AccountID: c.AccountID})
+}
+
+// logSyntheticRun logs the throughput of a run against synthetic findings
+// and the memory the process has taken, for sizing hardware and comparing
+// builds. The rate counts the findings written over the whole run.
+func (a *App) logSyntheticRun(ctx context.Context, run historyRun) {
+	if !a.config().Synthetic.enabled() {
+		return
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	var rate float64
+	if run.DurationSeconds > 0 {
+		rate = float64(run.Findings) / run.DurationSeconds
+	}
+	telemetry.Logger(ctx).Info("Synthetic export throughput",
+		"run_id", run.ID,
+		"status", run.Status,
+		"findings", run.Findings,
+		"regions", len(run.Regions),
+		"pages", run.Pages,
+		"api_calls", run.APICalls,
+		"duration_seconds", run.DurationSeconds,
+		"findings_per_second", int(rate),
+		"memory_bytes", mem.Sys,
+		"heap_bytes", mem.HeapAlloc,
+		"gc_cycles", mem.NumGC)
+}
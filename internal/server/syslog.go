@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+)
+
+// Syslog transports, message headers, and the events they carry
+const (
+	syslogUDP     = "udp"
+	syslogTCP     = "tcp"
+	syslogTLS     = "tls"
+	syslogRFC3164 = "rfc3164"
+	syslogRFC5424 = "rfc5424"
+	syslogCEF     = "cef"
+	syslogLEEF    = "leef"
+)
+
+// Limits of syslog messages: the longest UDP datagram, beyond which an event
+// is cut short, and how long a connection or a write may take
+const (
+	maxSyslogDatagram = 65000
+	syslogTimeout     = 30 * time.Second
+	syslogAppName     = "guardduty-export"
+)
+
+// syslogFacilities are the facility codes of the facility names
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "daemon": 3, "auth": 4, "authpriv": 10,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogConfig selects the collector that the syslog destination sends
+// findings to, one CEF or LEEF event per message
+type syslogConfig struct {
+	// Address is the collector's host:port
+	Address string `yaml:"address"`
+	// Network is udp, tcp, or tls
+	Network string `yaml:"network"`
+	// Format is cef or leef, and Header the syslog header of each message:
+	// rfc3164, the BSD format most collectors expect, or rfc5424
+	Format   string `yaml:"format"`
+	Header   string `yaml:"header"`
+	Facility string `yaml:"facility"`
+	// CAFile holds the certificates that verify a tls collector instead of
+	// the system's
+	CAFile string `yaml:"caFile"`
+	// Retries is the number of times a message is sent again over a new
+	// connection after a tcp or tls connection fails
+	Retries int `yaml:"retries"`
+}
+
+func (c syslogConfig) validate() error {
+	if c.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return fmt.Errorf("invalid syslog.address %q: must be host:port", c.Address)
+		}
+	}
+	if c.Network != syslogUDP && c.Network != syslogTCP && c.Network != syslogTLS {
+		return fmt.Errorf("invalid syslog.network %q: must be udp, tcp, or tls", c.Network)
+	}
+	if c.Format != syslogCEF && c.Format != syslogLEEF {
+		return fmt.Errorf("invalid syslog.format %q: must be cef or leef", c.Format)
+	}
+	if c.Header != syslogRFC3164 && c.Header != syslogRFC5424 {
+		return fmt.Errorf("invalid syslog.header %q: must be rfc3164 or rfc5424", c.Header)
+	}
+	if _, ok := syslogFacilities[c.Facility]; !ok {
+		return fmt.Errorf("invalid syslog.facility %q: must be kern, user, daemon, auth, authpriv, or local0 to local7", c.Facility)
+	}
+	if c.CAFile != "" {
+		if _, err := os.Stat(c.CAFile); err != nil {
+			return fmt.Errorf("invalid syslog.caFile %q: %v", c.CAFile, err)
+		}
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("invalid syslog.retries %d: must not be negative", c.Retries)
+	}
+	return nil
+}
+
+// syslogWriter is the FindingWriter of the syslog destination. It sends
+// each finding as a message of its own, on a connection it opens on the
+// first finding and opens again when a tcp or tls connection fails.
+type syslogWriter struct {
+	app      *App
+	ctx      context.Context
+	conf     syslogConfig
+	hostname string
+	conn     net.Conn
+}
+
+func (a *App) newSyslogWriter(ctx context.Context) *syslogWriter {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &syslogWriter{app: a, ctx: ctx, conf: a.config().Syslog, hostname: hostname}
+}
+
+// target names the collector, such as tls://siem.example.com:6514
+func (c syslogConfig) target() string {
+	return c.Network + "://" + c.Address
+}
+
+func (w *syslogWriter) WriteHeader() error {
+	return nil
+}
+
+func (w *syslogWriter) WriteFinding(finding types.Finding) error {
+	message := w.message(finding)
+	return w.app.retryRequest(w.ctx, "syslog", w.conf.Retries, func() (bool, error) {
+		if w.conn == nil {
+			conn, err := w.dial()
+			if err != nil {
+				return true, err
+			}
+			w.conn = conn
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err := w.conn.Write(message); err != nil {
+			w.conn.Close()
+			w.conn = nil
+			// A datagram that was not delivered is not known to have failed,
+			// so only stream connections are retried
+			return w.conf.Network != syslogUDP, fmt.Errorf("error sending finding to %s: %v", w.conf.target(), err)
+		}
+		return false, nil
+	})
+}
+
+// Close shuts down the sending side of a tcp or tls connection first and
+// waits briefly for the collector to close its own. Closing a connection
+// with unread data, such as the session tickets of a TLS 1.3 collector,
+// resets it, and the collector may lose the last messages.
+func (w *syslogWriter) Close() error {
+	if w.conn == nil {
+		return nil
+	}
+	if conn, ok := w.conn.(interface{ CloseWrite() error }); ok && conn.CloseWrite() == nil {
+		w.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		io.Copy(io.Discard, w.conn)
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// dial connects to the collector, verifying a tls collector's certificate
+// against the configured CA file or the system's roots
+func (w *syslogWriter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogTimeout}
+	if w.conf.Network != syslogTLS {
+		conn, err := dialer.DialContext(w.ctx, w.conf.Network, w.conf.Address)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to %s: %v", w.conf.target(), err)
+		}
+		return conn, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if w.conf.CAFile != "" {
+		pem, err := os.ReadFile(w.conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading syslog.caFile: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("error reading syslog.caFile: no certificates found")
+		}
+	}
+	conn, err := (&tls.Dialer{NetDialer: dialer, Config: config}).DialContext(w.ctx, "tcp", w.conf.Address)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %v", w.conf.target(), err)
+	}
+	return conn, nil
+}
+
+// message formats a finding as a syslog message. Its priority combines
+// the facility with a severity following the finding's: critical, error,
+// warning, or notice. Messages on tcp and tls connections end in a line
+// feed, which CEF and LEEF events never contain.
+func (w *syslogWriter) message(finding types.Finding) []byte {
+	event := export.CEF(finding)
+	if w.conf.Format == syslogLEEF {
+		event = export.LEEF(finding)
+	}
+	severity := 5
+	switch gd.SeverityLabel(aws.ToFloat64(finding.Severity)) {
+	case "Critical":
+		severity = 2
+	case "High":
+		severity = 3
+	case "Medium":
+		severity = 4
+	}
+	priority := syslogFacilities[w.conf.Facility]*8 + severity
+
+	var message string
+	now := time.Now()
+	if w.conf.Header == syslogRFC5424 {
+		message = fmt.Sprintf("<%d>1 %s %s %s - - - %s", priority, now.UTC().Format("2006-01-02T15:04:05.000Z07:00"), w.hostname, syslogAppName, event)
+	} else {
+		message = fmt.Sprintf("<%d>%s %s %s: %s", priority, now.Format(time.Stamp), w.hostname, syslogAppName, event)
+	}
+	if w.conf.Network == syslogUDP {
+		if len(message) > maxSyslogDatagram {
+			message = strings.ToValidUTF8(message[:maxSyslogDatagram], "")
+		}
+		return []byte(message)
+	}
+	return []byte(message + "\n")
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"guardduty/internal/export"
+)
+
+// validateTemplates reports the first template, in name order, whose name
+// can't be given as an export option or that has no file
+func validateTemplates(templates map[string]string) error {
+	for _, name := range sortedNames(templates) {
+		if !presetNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid templates name %q: must be letters, digits, '.', '_', or '-'", name)
+		}
+		if templates[name] == "" {
+			return fmt.Errorf("invalid templates.%s: must be the path of a template file", name)
+		}
+	}
+	return nil
+}
+
+// loadTemplates parses the template files of the templates setting, so a
+// template that doesn't parse stops the server from starting rather than
+// failing its exports
+func loadTemplates(templates map[string]string) (map[string]*export.Template, error) {
+	loaded := make(map[string]*export.Template, len(templates))
+	for name, path := range templates {
+		tmpl, err := export.LoadTemplate(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid templates.%s: %v", name, err)
+		}
+		loaded[name] = tmpl
+	}
+	return loaded, nil
+}
+
+// parseTemplate reads the template export option, which names the template
+// of the templates setting that the template format writes with
+func (a *App) parseTemplate(query url.Values, opts *exportOptions) error {
+	name := query.Get("template")
+	if opts.Format != "template" {
+		if name != "" {
+			return fmt.Errorf("The template option requires the template format")
+		}
+		return nil
+	}
+	names := sortedNames(a.templates)
+	if name == "" {
+		if len(names) == 0 {
+			return fmt.Errorf("The template format requires templates in the server config")
+		}
+		return fmt.Errorf("The template format requires a template: one of %s", strings.Join(names, ", "))
+	}
+	if !slices.Contains(names, name) {
+		return fmt.Errorf("Unknown template %q", name)
+	}
+	opts.Template = a.templates[name]
+	return nil
+}
@@ -0,0 +1,438 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// The kinds of indicators looked up with threat-intelligence services
+const (
+	indicatorIP     = "ip"
+	indicatorDomain = "domain"
+	indicatorHash   = "hash"
+)
+
+// threatIntelColumns hold the reputations of a finding's remote address,
+// DNS domain, and file hashes, by the kind of indicator they show
+var threatIntelColumns = []struct {
+	name, kind string
+}{
+	{"ActorIpReputation", indicatorIP},
+	{"DomainReputation", indicatorDomain},
+	{"FileReputation", indicatorHash},
+}
+
+// The defaults of the threat-intelligence settings. VirusTotal's public API
+// allows 4 requests a minute and AbuseIPDB's free plan 1000 checks a day.
+const (
+	defaultThreatIntelCacheTTL = 24 * time.Hour
+	defaultVirusTotalURL       = "https://www.virustotal.com/api/v3"
+	defaultVirusTotalRate      = 4
+	defaultAbuseIPDBURL        = "https://api.abuseipdb.com/api/v2"
+	defaultAbuseIPDBRate       = 10
+	defaultAbuseIPDBMaxAge     = 90
+	threatIntelRetries         = 2
+	threatIntelMaxResponse     = 1 << 20
+	maxThreatIntelEntries      = 100000
+)
+
+// threatIntelConfig looks up the indicators of findings with VirusTotal and
+// AbuseIPDB, for the reputation columns
+type threatIntelConfig struct {
+	// Enabled looks up the indicators of every export that doesn't set
+	// threatIntel=false
+	Enabled bool `yaml:"enabled"`
+	// CacheTTL is how long a reputation is reused before it is looked up
+	// again
+	CacheTTL   time.Duration    `yaml:"cacheTTL"`
+	VirusTotal virusTotalConfig `yaml:"virusTotal"`
+	AbuseIPDB  abuseIPDBConfig  `yaml:"abuseIPDB"`
+}
+
+// virusTotalConfig looks up addresses, domains, and file hashes with the
+// VirusTotal v3 API
+type virusTotalConfig struct {
+	APIKey string `yaml:"apiKey"`
+	// RateLimit is the most requests a minute
+	RateLimit float64 `yaml:"rateLimit"`
+	// URL is the API's base URL, such as that of a proxy
+	URL string `yaml:"url"`
+}
+
+// abuseIPDBConfig looks up addresses with the AbuseIPDB v2 check API
+type abuseIPDBConfig struct {
+	APIKey string `yaml:"apiKey"`
+	// RateLimit is the most requests a minute
+	RateLimit float64 `yaml:"rateLimit"`
+	// MaxAgeDays is how far back the reports of an address are counted
+	MaxAgeDays int `yaml:"maxAgeDays"`
+	// URL is the API's base URL, such as that of a proxy
+	URL string `yaml:"url"`
+}
+
+// configured reports whether a service has an API key
+func (c threatIntelConfig) configured() bool {
+	return c.VirusTotal.APIKey != "" || c.AbuseIPDB.APIKey != ""
+}
+
+func (c threatIntelConfig) validate() error {
+	if c.Enabled && !c.configured() {
+		return fmt.Errorf("invalid threatIntel.enabled: requires a virusTotal or abuseIPDB apiKey")
+	}
+	if c.CacheTTL <= 0 {
+		return fmt.Errorf("invalid threatIntel.cacheTTL %v: must be positive", c.CacheTTL)
+	}
+	if c.VirusTotal.RateLimit <= 0 {
+		return fmt.Errorf("invalid threatIntel.virusTotal.rateLimit %v: must be positive", c.VirusTotal.RateLimit)
+	}
+	if err := validateEndpoint("threatIntel.virusTotal.url", c.VirusTotal.URL); err != nil {
+		return err
+	}
+	if c.AbuseIPDB.RateLimit <= 0 {
+		return fmt.Errorf("invalid threatIntel.abuseIPDB.rateLimit %v: must be positive", c.AbuseIPDB.RateLimit)
+	}
+	if c.AbuseIPDB.MaxAgeDays < 1 || c.AbuseIPDB.MaxAgeDays > 365 {
+		return fmt.Errorf("invalid threatIntel.abuseIPDB.maxAgeDays %d: must be 1 to 365", c.AbuseIPDB.MaxAgeDays)
+	}
+	return validateEndpoint("threatIntel.abuseIPDB.url", c.AbuseIPDB.URL)
+}
+
+// intelProvider looks up indicators with one threat-intelligence service
+type intelProvider interface {
+	// name labels the provider's reputations in the columns
+	name() string
+	supports(kind string) bool
+	// lookup returns the reputation of an indicator and its score, higher
+	// for worse, with found false when the service doesn't know it
+	lookup(ctx context.Context, kind, indicator string) (reputation string, score float64, found bool, err error)
+}
+
+// threatIntel looks up the remote address, DNS domain, and file hashes of
+// each exported finding with the configured services, as a gd.Enricher, and
+// caches their reputations for the columns and later exports
+type threatIntel struct {
+	providers []intelProvider
+	ttl       time.Duration
+
+	mu    sync.Mutex
+	cache map[string]intelEntry
+}
+
+// intelEntry is the reputation of an indicator with one service, empty when
+// the service doesn't know it
+type intelEntry struct {
+	reputation string
+	score      float64
+	expires    time.Time
+}
+
+// newThreatIntel returns the lookups of the services with API keys
+func newThreatIntel(a *App, conf threatIntelConfig) *threatIntel {
+	t := &threatIntel{ttl: conf.CacheTTL, cache: make(map[string]intelEntry)}
+	if conf.VirusTotal.APIKey != "" {
+		t.providers = append(t.providers, &virusTotal{app: a, conf: conf.VirusTotal, limiter: gd.NewLimiter(conf.VirusTotal.RateLimit/60, 1)})
+	}
+	if conf.AbuseIPDB.APIKey != "" {
+		t.providers = append(t.providers, &abuseIPDB{app: a, conf: conf.AbuseIPDB, limiter: gd.NewLimiter(conf.AbuseIPDB.RateLimit/60, 1)})
+	}
+	return t
+}
+
+// addColumns adds the reputation columns to fields
+func (t *threatIntel) addColumns(fields export.Fields) {
+	for _, column := range threatIntelColumns {
+		kind := column.kind
+		fields[column.name] = func(finding types.Finding) string {
+			return t.reputation(kind, findingIndicators(finding)[kind])
+		}
+	}
+}
+
+// Enrich looks up the indicators of a page of findings that are not cached,
+// waiting for each service's rate limit. A service that fails is logged and
+// not asked again for the rest of the page.
+func (t *threatIntel) Enrich(ctx context.Context, findings []types.Finding) {
+	indicators := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, finding := range findings {
+		for kind, values := range findingIndicators(finding) {
+			for _, value := range values {
+				if key := kind + "/" + value; !seen[key] {
+					seen[key] = true
+					indicators[kind] = append(indicators[kind], value)
+				}
+			}
+		}
+	}
+	for _, provider := range t.providers {
+		for _, column := range threatIntelColumns {
+			if !provider.supports(column.kind) {
+				continue
+			}
+			if err := t.lookup(ctx, provider, column.kind, indicators[column.kind]); err != nil {
+				if ctx.Err() == nil {
+					telemetry.Logger(ctx).Warn("Error looking up threat intelligence", "provider", provider.name(), "error", err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// lookup fetches the reputations of indicators of one kind that provider
+// has no current one for
+func (t *threatIntel) lookup(ctx context.Context, provider intelProvider, kind string, indicators []string) error {
+	for _, indicator := range indicators {
+		key := provider.name() + "/" + kind + "/" + indicator
+		t.mu.Lock()
+		entry, ok := t.cache[key]
+		t.mu.Unlock()
+		if ok && time.Now().Before(entry.expires) {
+			continue
+		}
+		reputation, score, found, err := provider.lookup(ctx, kind, indicator)
+		if err != nil {
+			return err
+		}
+		if !found {
+			reputation, score = "", 0
+		}
+		t.store(key, intelEntry{reputation: reputation, score: score, expires: time.Now().Add(t.ttl)})
+	}
+	return nil
+}
+
+// store caches the reputation of an indicator, dropping expired ones once
+// the cache is full
+func (t *threatIntel) store(key string, entry intelEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.cache) >= maxThreatIntelEntries {
+		now := time.Now()
+		for k, e := range t.cache {
+			if now.After(e.expires) {
+				delete(t.cache, k)
+			}
+		}
+	}
+	t.cache[key] = entry
+}
+
+// reputation returns the worst cached reputation of the indicators with
+// each service, as provider=reputation pairs joined with "; "
+func (t *threatIntel) reputation(kind string, indicators []string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var reputations []string
+	for _, provider := range t.providers {
+		worst := intelEntry{score: -1}
+		for _, indicator := range indicators {
+			if entry, ok := t.cache[provider.name()+"/"+kind+"/"+indicator]; ok && entry.reputation != "" && entry.score > worst.score {
+				worst = entry
+			}
+		}
+		if worst.reputation != "" {
+			reputations = append(reputations, provider.name()+"="+worst.reputation)
+		}
+	}
+	return strings.Join(reputations, "; ")
+}
+
+// findingIndicators returns the indicators of a finding by kind: the remote
+// address of its action, the domain of a DNS request, and the hashes of the
+// files that malware scans or Runtime Monitoring report
+func findingIndicators(finding types.Finding) map[string][]string {
+	indicators := make(map[string][]string)
+	if ip := export.ColumnValue(finding, "ActorIp"); ip != "" {
+		indicators[indicatorIP] = []string{ip}
+	}
+	service := finding.Service
+	if service == nil {
+		return indicators
+	}
+	if service.Action != nil && service.Action.DnsRequestAction != nil {
+		if domain := aws.ToString(service.Action.DnsRequestAction.Domain); domain != "" {
+			indicators[indicatorDomain] = []string{strings.TrimSuffix(domain, ".")}
+		}
+	}
+	var hashes []string
+	addHash := func(hash *string) {
+		if h := strings.ToLower(aws.ToString(hash)); h != "" && !slices.Contains(hashes, h) {
+			hashes = append(hashes, h)
+		}
+	}
+	if service.RuntimeDetails != nil && service.RuntimeDetails.Process != nil {
+		addHash(service.RuntimeDetails.Process.ExecutableSha256)
+	}
+	if service.EbsVolumeScanDetails != nil && service.EbsVolumeScanDetails.ScanDetections != nil && service.EbsVolumeScanDetails.ScanDetections.ThreatDetectedByName != nil {
+		for _, threat := range service.EbsVolumeScanDetails.ScanDetections.ThreatDetectedByName.ThreatNames {
+			for _, file := range threat.FilePaths {
+				addHash(file.Hash)
+			}
+		}
+	}
+	if service.MalwareScanDetails != nil {
+		for _, threat := range service.MalwareScanDetails.Threats {
+			for _, item := range threat.ItemPaths {
+				addHash(item.Hash)
+			}
+		}
+	}
+	if len(hashes) > 0 {
+		indicators[indicatorHash] = hashes
+	}
+	return indicators
+}
+
+// parseThreatIntel reads the threatIntel export option, defaulting to the
+// threatIntel.enabled setting. Exports that look up indicators and name no
+// columns get the reputation columns after the default ones.
+func (a *App) parseThreatIntel(query url.Values, opts *exportOptions) error {
+	enabled := a.config().ThreatIntel.Enabled
+	if v := query.Get("threatIntel"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("Invalid threatIntel %q", v)
+		}
+		enabled = b
+	}
+	if !enabled {
+		return nil
+	}
+	if a.intel == nil {
+		return fmt.Errorf("Threat intelligence lookups require a virusTotal or abuseIPDB apiKey in the server config")
+	}
+	opts.Enrichers = append(opts.Enrichers, a.intel)
+	if len(query["columns"]) == 0 {
+		names := make([]string, len(threatIntelColumns))
+		for i, column := range threatIntelColumns {
+			names[i] = column.name
+		}
+		opts.Columns = appendColumns(opts.Columns, names)
+	}
+	return nil
+}
+
+// virusTotal looks up addresses, domains, and file hashes with VirusTotal.
+// An indicator's reputation is the number of engines whose last analysis
+// found it malicious out of those that analyzed it, such as 5/94.
+type virusTotal struct {
+	app     *App
+	conf    virusTotalConfig
+	limiter *gd.Limiter
+}
+
+func (v *virusTotal) name() string { return "virustotal" }
+
+func (v *virusTotal) supports(kind string) bool { return true }
+
+func (v *virusTotal) lookup(ctx context.Context, kind, indicator string) (string, float64, bool, error) {
+	collection := map[string]string{indicatorIP: "ip_addresses", indicatorDomain: "domains", indicatorHash: "files"}[kind]
+	var report struct {
+		Data struct {
+			Attributes struct {
+				LastAnalysisStats map[string]int `json:"last_analysis_stats"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	found, err := intelRequest(ctx, v.app, v.name(), v.limiter, strings.TrimSuffix(v.conf.URL, "/")+"/"+collection+"/"+url.PathEscape(indicator),
+		map[string]string{"x-apikey": v.conf.APIKey}, &report)
+	if err != nil || !found {
+		return "", 0, found, err
+	}
+	stats := report.Data.Attributes.LastAnalysisStats
+	total := 0
+	for _, n := range stats {
+		total += n
+	}
+	if total == 0 {
+		return "", 0, false, nil
+	}
+	return fmt.Sprintf("%d/%d", stats["malicious"], total), float64(stats["malicious"]), true, nil
+}
+
+// abuseIPDB looks up addresses with AbuseIPDB. An address's reputation is
+// its abuse confidence score from 0 to 100.
+type abuseIPDB struct {
+	app     *App
+	conf    abuseIPDBConfig
+	limiter *gd.Limiter
+}
+
+func (b *abuseIPDB) name() string { return "abuseipdb" }
+
+func (b *abuseIPDB) supports(kind string) bool { return kind == indicatorIP }
+
+func (b *abuseIPDB) lookup(ctx context.Context, kind, indicator string) (string, float64, bool, error) {
+	query := url.Values{"ipAddress": {indicator}, "maxAgeInDays": {strconv.Itoa(b.conf.MaxAgeDays)}}
+	var report struct {
+		Data struct {
+			AbuseConfidenceScore *int `json:"abuseConfidenceScore"`
+		} `json:"data"`
+	}
+	found, err := intelRequest(ctx, b.app, b.name(), b.limiter, strings.TrimSuffix(b.conf.URL, "/")+"/check?"+query.Encode(),
+		map[string]string{"Key": b.conf.APIKey}, &report)
+	if err != nil || !found || report.Data.AbuseConfidenceScore == nil {
+		return "", 0, false, err
+	}
+	score := *report.Data.AbuseConfidenceScore
+	return strconv.Itoa(score), float64(score), true, nil
+}
+
+// intelRequest gets a report from a threat-intelligence service once its
+// limiter allows, retrying throttled and failed requests, and decodes it
+// into out. It reports found false when the service doesn't know the
+// indicator.
+func intelRequest(ctx context.Context, a *App, name string, limiter *gd.Limiter, endpoint string, headers map[string]string, out any) (bool, error) {
+	found := true
+	err := a.retryRequest(ctx, name, threatIntelRetries, func() (bool, error) {
+		if err := limiter.Wait(ctx); err != nil {
+			return false, err
+		}
+		ctx, cancel := context.WithTimeout(ctx, siemRequestTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return false, fmt.Errorf("error sending %s request: %v", name, err)
+		}
+		req.Header.Set("Accept", "application/json")
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return true, fmt.Errorf("error sending %s request: %v", name, err)
+		}
+		defer resp.Body.Close()
+		body := io.LimitReader(resp.Body, threatIntelMaxResponse)
+		if resp.StatusCode == http.StatusNotFound {
+			found = false
+			return false, nil
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			data, _ := io.ReadAll(body)
+			return retryableStatus(resp.StatusCode), fmt.Errorf("error from %s: %s: %s", name, resp.Status, strings.TrimSpace(string(data)))
+		}
+		if err := json.NewDecoder(body).Decode(out); err != nil {
+			return false, fmt.Errorf("error reading %s response: %v", name, err)
+		}
+		return false, nil
+	})
+	return found, err
+}
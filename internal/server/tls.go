@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// defaultAutocertCache is the directory in OutputDir where certificates
+// from Let's Encrypt are kept when no cache directory is configured
+const defaultAutocertCache = ".autocert"
+
+// tlsConfig serves HTTPS, with a certificate from files or one obtained
+// from Let's Encrypt for the configured host names
+type tlsConfig struct {
+	CertFile string         `yaml:"certFile"`
+	KeyFile  string         `yaml:"keyFile"`
+	Autocert autocertConfig `yaml:"autocert"`
+	// RedirectHTTP is the address of a plain HTTP listener, such as :80,
+	// that redirects to HTTPS and answers the ACME HTTP-01 challenges
+	RedirectHTTP string `yaml:"redirectHttp"`
+}
+
+type autocertConfig struct {
+	// Hosts are the host names certificates are requested for; the server
+	// must be reachable under them on port 443, or port 80 for RedirectHTTP
+	Hosts []string `yaml:"hosts"`
+	// CacheDir keeps the account key and certificates across restarts, so
+	// they are not requested again; by default .autocert in OutputDir
+	CacheDir string `yaml:"cacheDir"`
+	// Email is given to the certificate authority for expiry notices
+	Email string `yaml:"email"`
+	// DirectoryURL is the ACME directory, Let's Encrypt's by default; use
+	// the staging directory while testing to avoid its rate limits
+	DirectoryURL string `yaml:"directoryUrl"`
+}
+
+// enabled reports whether the server serves HTTPS
+func (c tlsConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || len(c.Autocert.Hosts) > 0
+}
+
+func (c tlsConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("invalid tls: certFile and keyFile must be set together")
+	}
+	if c.CertFile != "" && len(c.Autocert.Hosts) > 0 {
+		return fmt.Errorf("invalid tls: use either certFile and keyFile or autocert, not both")
+	}
+	for _, host := range c.Autocert.Hosts {
+		if host == "" || strings.ContainsAny(host, ":/") {
+			return fmt.Errorf("invalid tls.autocert.hosts %q: must be host names", host)
+		}
+	}
+	if c.RedirectHTTP != "" && !c.enabled() {
+		return fmt.Errorf("invalid tls.redirectHttp: HTTPS is not configured")
+	}
+	return nil
+}
+
+// serverTLS returns the TLS configuration of the HTTPS server, and the
+// handler of the HTTP redirect listener. A certificate from files is
+// loaded now, so a bad one stops the server from starting.
+func serverTLS(c tlsConfig, outputDir, listen string) (*tls.Config, http.Handler, error) {
+	redirect := redirectToHTTPS(listen)
+	if len(c.Autocert.Hosts) == 0 {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading TLS certificate: %v", err)
+		}
+		return &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}, redirect, nil
+	}
+
+	cacheDir := c.Autocert.CacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(outputDir, defaultAutocertCache)
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Autocert.Hosts...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      c.Autocert.Email,
+	}
+	if c.Autocert.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: c.Autocert.DirectoryURL}
+	}
+	config := manager.TLSConfig()
+	config.MinVersion = tls.VersionTLS12
+	return config, manager.HTTPHandler(redirect), nil
+}
+
+// redirectToHTTPS redirects requests to the same URL on the HTTPS server
+// listening on listen, keeping the method and body of POST requests
+func redirectToHTTPS(listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(r.Host, "[]")
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		switch {
+		case port != "" && port != "443":
+			host = net.JoinHostPort(host, port)
+		case strings.Contains(host, ":"):
+			host = "[" + host + "]"
+		}
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
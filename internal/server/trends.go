@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// The weeks a trends report covers by default and at most, and the number
+// of recurring finding types it lists
+const (
+	defaultTrendsWeeks = 12
+	maxTrendsWeeks     = 104
+	trendsTopTypes     = 10
+)
+
+// trends builds the trends report of the findings q selects over the weeks
+// up to and including the one of now. Findings are new in the week they
+// were created and resolved in the week they were archived; the recurring
+// types are those of the findings updated in the period, ranked by how
+// often GuardDuty saw them occur.
+func (s *findingsStore) trends(ctx context.Context, q storeQuery, weeks int, now time.Time) (export.Trends, error) {
+	day := now.UTC().Truncate(24 * time.Hour)
+	to := day.AddDate(0, 0, 7-(int(day.Weekday())+6)%7)
+	from := to.AddDate(0, 0, -7*weeks)
+	trends := export.Trends{From: from, To: to, Weeks: make([]export.TrendsWeek, weeks), TopTypes: []export.RecurringType{}}
+	for i := range trends.Weeks {
+		trends.Weeks[i] = export.TrendsWeek{Week: from.AddDate(0, 0, 7*i).Format("2006-01-02"), BySeverity: make(map[string]int)}
+		for _, label := range gd.SeverityLabels {
+			trends.Weeks[i].BySeverity[label] = 0
+		}
+	}
+	week := func(ms int64) int {
+		return int(time.UnixMilli(ms).Sub(from) / (7 * 24 * time.Hour))
+	}
+
+	q, err := s.withTaxonomy(ctx, q)
+	if err != nil {
+		return trends, err
+	}
+	where, args := q.where()
+	rows, err := s.db.QueryContext(ctx, "SELECT created_at, severity, archived_at FROM findings"+
+		andWhere(where, "(created_at >= ? OR archived_at >= ?)"), append(args, from.UnixMilli(), from.UnixMilli())...)
+	if err != nil {
+		return trends, fmt.Errorf("error querying findings store: %v", err)
+	}
+	defer rows.Close()
+	activeDays := make([]float64, weeks)
+	var totalActiveDays float64
+	var resolved int
+	for rows.Next() {
+		var created, archived sql.NullInt64
+		var severity float64
+		if err := rows.Scan(&created, &severity, &archived); err != nil {
+			return trends, fmt.Errorf("error reading findings store: %v", err)
+		}
+		if created.Valid && created.Int64 >= from.UnixMilli() {
+			if i := week(created.Int64); i < weeks {
+				trends.Weeks[i].New++
+				trends.Weeks[i].BySeverity[gd.SeverityLabel(severity)]++
+			}
+		}
+		if archived.Valid && archived.Int64 >= from.UnixMilli() {
+			i := week(archived.Int64)
+			if i >= weeks {
+				continue
+			}
+			trends.Weeks[i].Resolved++
+			if created.Valid && archived.Int64 >= created.Int64 {
+				days := float64(archived.Int64-created.Int64) / float64(24*time.Hour/time.Millisecond)
+				activeDays[i] += days
+				totalActiveDays += days
+				resolved++
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return trends, fmt.Errorf("error reading findings store: %v", err)
+	}
+	for i := range trends.Weeks {
+		if trends.Weeks[i].Resolved > 0 {
+			trends.Weeks[i].MeanActiveDays = roundDays(activeDays[i] / float64(trends.Weeks[i].Resolved))
+		}
+	}
+	if resolved > 0 {
+		trends.MeanActiveDays = roundDays(totalActiveDays / float64(resolved))
+	}
+
+	rows, err = s.db.QueryContext(ctx, "SELECT type, count(*), sum(coalesce(json_extract(finding, '$.Service.Count'), 1)) AS occurrences FROM findings"+
+		andWhere(where, "updated_at >= ?")+" GROUP BY type ORDER BY occurrences DESC, type LIMIT ?", append(args, from.UnixMilli(), trendsTopTypes)...)
+	if err != nil {
+		return trends, fmt.Errorf("error querying findings store: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t export.RecurringType
+		if err := rows.Scan(&t.Type, &t.Findings, &t.Occurrences); err != nil {
+			return trends, fmt.Errorf("error reading findings store: %v", err)
+		}
+		trends.TopTypes = append(trends.TopTypes, t)
+	}
+	if err := rows.Err(); err != nil {
+		return trends, fmt.Errorf("error reading findings store: %v", err)
+	}
+	return trends, nil
+}
+
+// andWhere adds condition to the WHERE clause of a storeQuery
+func andWhere(where, condition string) string {
+	if where == "" {
+		return " WHERE " + condition
+	}
+	return where + " AND " + condition
+}
+
+// roundDays rounds a number of days to a tenth
+func roundDays(days float64) float64 {
+	return math.Round(days*10) / 10
+}
+
+// handleStoreTrends serves the trends report of the findings store as JSON,
+// as CSV of its weeks, or as an HTML page of charts
+func (a *App) handleStoreTrends(w http.ResponseWriter, r *http.Request) {
+	if a.store == nil {
+		http.Error(w, "The findings store is not enabled: set storeFile", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" && format != "html" {
+		http.Error(w, fmt.Sprintf("Invalid format %q: trends are csv, json, or html", format), http.StatusBadRequest)
+		return
+	}
+	weeks := defaultTrendsWeeks
+	if v := query.Get("weeks"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTrendsWeeks {
+			http.Error(w, fmt.Sprintf("Invalid weeks %q: must be 1 to %d", v, maxTrendsWeeks), http.StatusBadRequest)
+			return
+		}
+		weeks = n
+	}
+	locale := a.config().Locale
+	if v := query.Get("locale"); v != "" {
+		if !export.ValidLocale(v) {
+			http.Error(w, fmt.Sprintf("Unsupported locale %q: must be one of %s", v, strings.Join(export.Locales, ", ")), http.StatusBadRequest)
+			return
+		}
+		locale = v
+	}
+	filter, err := gd.ParseFilter(query, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The report's period takes the place of time ranges, and archived
+	// findings are what it counts as resolved
+	q := storeQuery{
+		filter: gd.Filter{
+			MinSeverity:     filter.MinSeverity,
+			FindingTypes:    filter.FindingTypes,
+			ThreatPurposes:  filter.ThreatPurposes,
+			ThreatResources: filter.ThreatResources,
+			Tactics:         filter.Tactics,
+			Techniques:      filter.Techniques,
+		},
+		accounts: query["accountId"],
+		regions:  query["region"],
+	}
+
+	trends, err := a.store.trends(r.Context(), q, weeks, time.Now())
+	if err != nil {
+		telemetry.Logger(r.Context()).Error("Error building trends report", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(trends)
+		return
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+	case "html":
+		w.Header().Set("Content-Type", "text/html")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("guardduty_trends_%s.%s", time.Now().Format("20060102_150405"), format)))
+	if format == "csv" {
+		err = export.WriteTable(w, export.WriteOptions{Format: "csv", Sanitize: a.config().CSVSanitize, BOM: a.config().CSVBOM}, export.TrendsTable(trends))
+	} else {
+		err = export.WriteTrendsHTML(w, trends, locale)
+	}
+	if err != nil {
+		telemetry.Logger(r.Context()).Error("Error writing trends report", "error", err)
+	}
+}
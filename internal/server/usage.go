@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+)
+
+// usageReport gets the usage costs of the accounts and regions of an export
+func usageReport(ctx context.Context, opts gd.FetchOptions) reportOutput {
+	report := gd.UsageStatistics(ctx, opts)
+	out := reportOutput{value: report, table: usageTable(report), regions: len(report.Regions)}
+	for _, region := range report.Regions {
+		if region.Error != "" {
+			out.failed++
+		}
+	}
+	return out
+}
+
+// usageTable lays out a usage report as one row per account, region, and
+// feature with a cost, followed by a row for each region that was skipped
+// or could not be queried
+func usageTable(report gd.UsageReport) export.Table {
+	table := export.Table{
+		Name:    "Usage",
+		Columns: []string{"AccountId", "Region", "DetectorId", "Feature", "Amount", "Unit", "Start", "End", "Notes"},
+	}
+	start, end := report.Start.Format(time.RFC3339), report.End.Format(time.RFC3339)
+	for _, cost := range report.Costs {
+		table.Rows = append(table.Rows, []any{cost.AccountID, cost.Region, cost.DetectorID, cost.Feature, cost.Amount, report.Unit, start, end, ""})
+	}
+	for _, region := range report.Regions {
+		switch {
+		case region.Error != "":
+			table.Rows = append(table.Rows, []any{region.Account, region.Region, "", "", "", "", start, end, inventoryError + ": " + region.Error})
+		case region.Skipped != "":
+			table.Rows = append(table.Rows, []any{region.Account, region.Region, "", "", "", "", start, end, inventorySkipped + ": " + region.Skipped})
+		}
+	}
+	return table
+}
@@ -0,0 +1,486 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/guardduty/types"
+
+	"guardduty/internal/export"
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// Defaults and limits of watch mode
+const (
+	defaultWatchRotate      = time.Hour
+	defaultWatchMaxFindings = 10000
+	// maxWatchRotate leaves room under the 12 hour SQS visibility timeout
+	// for storing a file before its messages would be delivered again
+	maxWatchRotate = 11 * time.Hour
+	// sqsWaitTime is the longest a receive waits for messages, and
+	// sqsVisibilityMargin how long past a file's rotation its messages stay
+	// hidden from other consumers
+	sqsWaitTime         = 20 * time.Second
+	sqsVisibilityMargin = 5 * time.Minute
+	sqsMaxMessages      = 10
+)
+
+// watchConfig selects the SQS queue that watch mode reads GuardDuty
+// findings from, fed by an EventBridge rule matching GuardDuty Finding
+// events
+type watchConfig struct {
+	QueueURL string `yaml:"queueUrl"`
+	// Region is the queue's region, by default the one in its URL or the
+	// SDK region
+	Region string `yaml:"region"`
+	// Rotate is how often the findings received are stored as a new export
+	// file, and MaxFindings the most findings in a file, which stores it
+	// sooner
+	Rotate      time.Duration `yaml:"rotate"`
+	MaxFindings int           `yaml:"maxFindings"`
+}
+
+func (c watchConfig) validate() error {
+	if c.QueueURL != "" {
+		if err := validateEndpoint("watch.queueUrl", c.QueueURL); err != nil {
+			return err
+		}
+	}
+	if c.Rotate < time.Minute || c.Rotate > maxWatchRotate {
+		return fmt.Errorf("invalid watch.rotate %v: must be 1m to %v", c.Rotate, maxWatchRotate)
+	}
+	if c.MaxFindings < 1 {
+		return fmt.Errorf("invalid watch.maxFindings %d: must be positive", c.MaxFindings)
+	}
+	return nil
+}
+
+// region returns the queue's region: the configured one, the one in a
+// queue URL such as https://sqs.us-east-1.amazonaws.com/123456789012/name,
+// or the SDK region
+func (c watchConfig) region(sdkRegion string) string {
+	if c.Region != "" {
+		return c.Region
+	}
+	if u, err := url.Parse(c.QueueURL); err == nil {
+		if parts := strings.Split(u.Hostname(), "."); len(parts) > 2 && parts[0] == "sqs" {
+			return parts[1]
+		}
+	}
+	return sdkRegion
+}
+
+// runWatchCommand reads GuardDuty findings from an SQS queue until it is
+// interrupted, storing them as rolling export files or pushing them to the
+// configured SIEM as they arrive, and returns the process exit code
+func runWatchCommand(args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	app, err := loadApp(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %v\n", fs.Args())
+		return 2
+	}
+	if app.config().Watch.QueueURL == "" {
+		fmt.Fprintln(os.Stderr, "The watch command requires watch.queueUrl or -watch-queue-url")
+		return 2
+	}
+	// The export options come from the config. The findings of a watch
+	// come from whatever accounts and regions feed the queue, so the
+	// queue's region stands in for the regions of an export.
+	region := app.config().Watch.region(app.awsCfg.Region)
+	if region == "" {
+		fmt.Fprintln(os.Stderr, "The queue's region is unknown: set watch.region or the SDK region")
+		return 2
+	}
+	opts, err := app.parseExportValues(url.Values{"regions": {region}})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = app.watchQueue(ctx, opts, region)
+	flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	telemetry.StopTracing(flushCtx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// sqsMessage is a message received from the queue
+type sqsMessage struct {
+	MessageID     string `json:"MessageId"`
+	ReceiptHandle string `json:"ReceiptHandle"`
+	Body          string `json:"Body"`
+}
+
+// watchBatch holds the findings received since the last file was stored,
+// grouped by account and region, and the receipt handles of their messages,
+// which are deleted once the file is stored
+type watchBatch struct {
+	startedAt time.Time
+	results   []gd.RegionResult
+	targets   map[string]int
+	findings  int
+	receipts  []string
+}
+
+func (b *watchBatch) add(finding types.Finding, receipt string) {
+	if b.findings == 0 {
+		b.startedAt = time.Now()
+		b.targets = make(map[string]int)
+	}
+	label := gd.TargetLabel(aws.ToString(finding.AccountId), aws.ToString(finding.Region))
+	i, ok := b.targets[label]
+	if !ok {
+		i = len(b.results)
+		b.targets[label] = i
+		b.results = append(b.results, gd.RegionResult{Account: aws.ToString(finding.AccountId), Region: aws.ToString(finding.Region)})
+	}
+	b.results[i].Findings = append(b.results[i].Findings, finding)
+	b.results[i].Count++
+	b.findings++
+	b.receipts = append(b.receipts, receipt)
+}
+
+// watchQueue receives the queue's messages until ctx is canceled. Findings
+// pushed to a SIEM have their messages deleted once they are sent; others
+// are collected into a file stored every watch.rotate, and their messages
+// stay hidden until the file is stored and then deleted. A message whose
+// findings could not be stored or sent is received again once its
+// visibility timeout ends. Only a failure of the first receive ends the
+// watch, so a wrong queue URL or a missing permission is reported at once.
+func (a *App) watchQueue(ctx context.Context, opts exportOptions, region string) error {
+	log := telemetry.Logger(ctx)
+	conf := a.config().Watch
+	push := pushesToSIEM(opts.destination)
+	visibility := sqsVisibilityMargin
+	if !push {
+		visibility += conf.Rotate
+	}
+	log.Info("Watching queue", "queue", conf.QueueURL, "destination", opts.destination, "rotate", conf.Rotate)
+
+	var batch watchBatch
+	// stored is when the last file stored was started. Files are named by
+	// the second they start in, so a file filled within the same second
+	// starts a second later instead of replacing it.
+	var stored time.Time
+	store := func(ctx context.Context) {
+		if !batch.startedAt.Truncate(time.Second).After(stored) {
+			batch.startedAt = stored.Add(time.Second)
+		}
+		stored = batch.startedAt.Truncate(time.Second)
+		a.storeWatchBatch(ctx, opts, region, batch)
+		batch = watchBatch{}
+	}
+	for polled := false; ctx.Err() == nil; polled = true {
+		wait := sqsWaitTime
+		if batch.findings > 0 {
+			wait = min(wait, max(time.Until(batch.startedAt.Add(conf.Rotate)), time.Second))
+		}
+		messages, err := a.receiveMessages(ctx, region, wait, visibility)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			if !polled {
+				return err
+			}
+			log.Error("Error receiving queue messages", "error", err)
+			sleep(ctx, 5*time.Second)
+			continue
+		}
+
+		var findings []types.Finding
+		var receipts, done []string
+		for _, message := range messages {
+			finding, ok, err := parseFindingEvent(message.Body)
+			switch {
+			case err != nil:
+				// A message that cannot be read never will be, so it is
+				// dropped rather than received again
+				log.Error("Error reading queue message", "message_id", message.MessageID, "error", err)
+				done = append(done, message.ReceiptHandle)
+			case !ok || !opts.Filter.Matches(finding):
+				done = append(done, message.ReceiptHandle)
+			default:
+				findings = append(findings, finding)
+				receipts = append(receipts, message.ReceiptHandle)
+			}
+		}
+
+		if push && len(findings) > 0 {
+			stream := gd.StreamResults([]gd.RegionResult{{Findings: findings, Count: len(findings)}})
+			_, _, err := a.pushFindings(ctx, opts.destination, stream)
+			stream.Close()
+			if err != nil {
+				log.Error("Error pushing watched findings", "findings", len(findings), "error", err)
+			} else {
+				done = append(done, receipts...)
+			}
+		} else {
+			for i, finding := range findings {
+				batch.add(finding, receipts[i])
+			}
+		}
+		a.deleteMessages(ctx, region, done)
+
+		if batch.findings > 0 && (batch.findings >= conf.MaxFindings || time.Since(batch.startedAt) >= conf.Rotate) {
+			store(ctx)
+		}
+	}
+	if batch.findings > 0 {
+		// The findings received before the watch was stopped are still
+		// stored, without the canceled context
+		store(context.WithoutCancel(ctx))
+	}
+	log.Info("Stopped watching queue", "queue", conf.QueueURL)
+	return nil
+}
+
+// sleep waits for d or until ctx is canceled
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// storeWatchBatch writes the findings of a batch as an export file named by
+// when its first finding arrived, stores it at the destination, and deletes
+// their messages. A batch that cannot be stored is logged and left in the
+// queue.
+func (a *App) storeWatchBatch(ctx context.Context, opts exportOptions, region string, batch watchBatch) {
+	log := telemetry.Logger(ctx)
+	filename := export.Filename(batch.startedAt, opts.Format)
+	name := a.storedName(filename, opts.Compression)
+	var file *os.File
+	var err error
+	if opts.destination == destinationS3 {
+		file, err = os.CreateTemp("", "*_"+name)
+	} else {
+		file, err = os.Create(filepath.Join(a.config().OutputDir, name))
+	}
+	if err != nil {
+		log.Error("Error creating file", "error", err)
+		return
+	}
+	path := file.Name()
+
+	stream := gd.StreamResults(batch.results)
+	defer stream.Close()
+	out, err := a.encryptExport(ctx, file)
+	var totalFindings int
+	if err == nil {
+		totalFindings, err = export.Write(ctx, out, opts.WriteOptions, filename, stream)
+		if err == nil {
+			err = out.Close()
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Error("Error writing watched findings", "file", name, "error", err)
+		os.Remove(path)
+		return
+	}
+	seal, err := a.sealExport(ctx, path, name)
+	if err != nil {
+		log.Error("Error sealing watched findings", "file", name, "error", err)
+		removeExportFile(path)
+		return
+	}
+	if usesS3(opts.destination) {
+		upload, err := a.uploadExport(ctx, path, name, a.storedContentType(opts.Format, opts.Compression))
+		if opts.destination == destinationS3 {
+			removeExportFile(path)
+		}
+		if err != nil {
+			log.Error("Error uploading watched findings", "file", name, "error", err)
+			if opts.destination == destinationS3 {
+				return
+			}
+		} else {
+			log.Info("Uploaded watched findings", "object", upload.uri())
+		}
+	}
+	if opts.destination != destinationS3 {
+		a.recordSavedExport(ctx, name, opts, totalFindings, stream, seal)
+	}
+	a.deleteMessages(ctx, region, batch.receipts)
+	log.Info("Stored watched findings", "file", name, "findings", totalFindings)
+}
+
+// parseFindingEvent reads the finding of a GuardDuty Finding event, as
+// EventBridge delivers it to the queue or wrapped in an SNS notification.
+// It reports false for other events, and an error for bodies that are not
+// events.
+func parseFindingEvent(body string) (types.Finding, bool, error) {
+	var event struct {
+		Source     string          `json:"source"`
+		DetailType string          `json:"detail-type"`
+		Detail     json.RawMessage `json:"detail"`
+		// Type and Message are the fields of an SNS notification
+		Type    string `json:"Type"`
+		Message string `json:"Message"`
+	}
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return types.Finding{}, false, fmt.Errorf("error parsing event: %v", err)
+	}
+	if event.Type == "Notification" && event.Source == "" {
+		return parseFindingEvent(event.Message)
+	}
+	if event.Source != "aws.guardduty" || event.DetailType != "GuardDuty Finding" {
+		return types.Finding{}, false, nil
+	}
+	// The event's detail is the finding as the GuardDuty API returns it,
+	// whose camel-case names the SDK's fields match without regard to case
+	var finding types.Finding
+	if err := json.Unmarshal(event.Detail, &finding); err != nil {
+		return types.Finding{}, false, fmt.Errorf("error parsing finding: %v", err)
+	}
+	if finding.Id == nil {
+		return types.Finding{}, false, fmt.Errorf("error parsing finding: no id")
+	}
+	return finding, true, nil
+}
+
+// receiveMessages long-polls the queue for up to wait, hiding the messages
+// received from other consumers for visibility
+func (a *App) receiveMessages(ctx context.Context, region string, wait, visibility time.Duration) ([]sqsMessage, error) {
+	var received struct {
+		Messages []sqsMessage `json:"Messages"`
+	}
+	err := a.sqsRequest(ctx, region, "ReceiveMessage", map[string]any{
+		"QueueUrl":            a.config().Watch.QueueURL,
+		"MaxNumberOfMessages": sqsMaxMessages,
+		"WaitTimeSeconds":     int(wait.Seconds()),
+		"VisibilityTimeout":   int(visibility.Seconds()),
+	}, wait+10*time.Second, &received)
+	return received.Messages, err
+}
+
+// deleteMessages deletes handled messages from the queue, ten at a time. A
+// message that cannot be deleted is logged and will be received again.
+func (a *App) deleteMessages(ctx context.Context, region string, receipts []string) {
+	for start := 0; start < len(receipts); start += sqsMaxMessages {
+		var entries []map[string]string
+		for i, receipt := range receipts[start:min(start+sqsMaxMessages, len(receipts))] {
+			entries = append(entries, map[string]string{"Id": strconv.Itoa(i), "ReceiptHandle": receipt})
+		}
+		var deleted struct {
+			Failed []struct {
+				ID      string `json:"Id"`
+				Message string `json:"Message"`
+			} `json:"Failed"`
+		}
+		err := a.sqsRequest(ctx, region, "DeleteMessageBatch", map[string]any{
+			"QueueUrl": a.config().Watch.QueueURL,
+			"Entries":  entries,
+		}, time.Minute, &deleted)
+		if err != nil {
+			telemetry.Logger(ctx).Error("Error deleting queue messages", "messages", len(entries), "error", err)
+			continue
+		}
+		for _, failure := range deleted.Failed {
+			telemetry.Logger(ctx).Error("Error deleting queue message", "error", failure.Message)
+		}
+	}
+}
+
+// sqsRequest calls an SQS action with the JSON protocol, signed with the
+// server's AWS credentials, and decodes its response into out
+func (a *App) sqsRequest(ctx context.Context, region, action string, input any, timeout time.Duration, out any) error {
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("error calling SQS %s: %v", action, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.sqsEndpoint(region)+"/", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("error calling SQS %s: %v", action, err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+	creds, err := a.awsCfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("error calling SQS %s: %v", action, err)
+	}
+	hash := sha256.Sum256(payload)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), "sqs", region, time.Now()); err != nil {
+		return fmt.Errorf("error calling SQS %s: %v", action, err)
+	}
+	resp, err := a.awsCfg.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling SQS %s: %v", action, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// SQS describes failures as {"__type": ..., "message": ...}
+		var failure struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, siemMaxResponseLength))
+		message := strings.TrimSpace(string(data))
+		if json.Unmarshal(data, &failure) == nil && failure.Type != "" {
+			_, code, _ := strings.Cut(failure.Type, "#")
+			message = strings.TrimSpace(code + ": " + failure.Message)
+		}
+		return fmt.Errorf("error calling SQS %s: %s: %s", action, resp.Status, message)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error reading SQS %s response: %v", action, err)
+	}
+	return nil
+}
+
+// sqsEndpoint returns the base URL of the SQS API in region: the sqs
+// endpoint or the endpoint replacing every service when one is set
+func (a *App) sqsEndpoint(region string) string {
+	if endpoint := a.config().Endpoints["sqs"]; endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	if a.config().EndpointURL != "" {
+		return strings.TrimSuffix(a.config().EndpointURL, "/")
+	}
+	host := "sqs"
+	if a.config().UseFIPS {
+		host = "sqs-fips"
+	}
+	suffix := "amazonaws.com"
+	if strings.HasPrefix(region, "cn-") {
+		suffix = "amazonaws.com.cn"
+	}
+	return fmt.Sprintf("https://%s.%s.%s", host, region, suffix)
+}
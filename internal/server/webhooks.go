@@ -0,0 +1,303 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"guardduty/internal/gd"
+	"guardduty/internal/telemetry"
+)
+
+// Webhook types, which decide how a notification is formatted
+const (
+	webhookSlack = "slack"
+	webhookTeams = "teams"
+)
+
+// maxNotifiedFailures is the number of failed regions a notification lists
+// with their errors
+const maxNotifiedFailures = 10
+
+// webhookConfig is a Slack or Microsoft Teams incoming webhook that export
+// jobs naming it in their notify parameter post to when they finish
+type webhookConfig struct {
+	Name string `yaml:"name"`
+	// Type is slack or teams
+	Type string `yaml:"type"`
+	URL  string `yaml:"url"`
+	// On lists the job outcomes posted, succeeded and failed by default
+	On []jobStatus `yaml:"on"`
+}
+
+func (c webhookConfig) validate() error {
+	if c.Name == "" || strings.Contains(c.Name, ",") {
+		return fmt.Errorf("invalid webhook name %q: must be set and not contain commas", c.Name)
+	}
+	if c.Type != webhookSlack && c.Type != webhookTeams {
+		return fmt.Errorf("invalid webhook %q type %q: must be slack or teams", c.Name, c.Type)
+	}
+	if err := validateEndpoint(fmt.Sprintf("webhook %q url", c.Name), c.URL); err != nil {
+		return err
+	}
+	for _, status := range c.On {
+		if status != jobSucceeded && status != jobFailed && status != jobCanceled {
+			return fmt.Errorf("invalid webhook %q on %q: must be succeeded, failed, or canceled", c.Name, status)
+		}
+	}
+	return nil
+}
+
+// posts reports whether the webhook is posted to for jobs ending in status
+func (c webhookConfig) posts(status jobStatus) bool {
+	if len(c.On) == 0 {
+		return status == jobSucceeded || status == jobFailed
+	}
+	return slices.Contains(c.On, status)
+}
+
+// validateWebhooks reports the first invalid or duplicate webhook
+func validateWebhooks(webhooks []webhookConfig) error {
+	names := make(map[string]bool, len(webhooks))
+	for _, webhook := range webhooks {
+		if err := webhook.validate(); err != nil {
+			return err
+		}
+		if names[webhook.Name] {
+			return fmt.Errorf("invalid webhook name %q: used more than once", webhook.Name)
+		}
+		names[webhook.Name] = true
+	}
+	return nil
+}
+
+// webhook returns the configured webhook called name
+func (a *App) webhook(name string) (webhookConfig, bool) {
+	for _, webhook := range a.config().Webhooks {
+		if webhook.Name == name {
+			return webhook, true
+		}
+	}
+	return webhookConfig{}, false
+}
+
+// jobNotification summarizes a finished job for its webhooks
+type jobNotification struct {
+	title  string
+	status jobStatus
+	// facts are the labeled lines of the summary, in order
+	facts [][2]string
+	// failures lists the regions that failed with their errors
+	failures []string
+	link     string
+}
+
+// notifyJob posts the outcome of a finished job to the webhooks it names
+// that post jobs ending as it did. A webhook that cannot be posted to is
+// logged and does not affect the job.
+func (a *App) notifyJob(ctx context.Context, job *Job, view jobView) {
+	var webhooks []webhookConfig
+	for _, name := range job.opts.notify {
+		if webhook, ok := a.webhook(name); ok && webhook.posts(view.Status) {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+	job.mu.Lock()
+	results := job.results
+	job.mu.Unlock()
+	n := a.jobNotification(view, results)
+
+	// The job may have been canceled, but its notification is still sent
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	log := telemetry.Logger(ctx)
+	for _, webhook := range webhooks {
+		if err := postWebhook(ctx, webhook, n); err != nil {
+			log.Error("Error posting notification", "webhook", webhook.Name, "error", err)
+			continue
+		}
+		log.Info("Posted notification", "webhook", webhook.Name, "status", string(view.Status))
+	}
+}
+
+// jobNotification builds the summary of a finished job: its findings by
+// severity, its regions, and a link to download its export
+func (a *App) jobNotification(view jobView, results []gd.RegionResult) jobNotification {
+	n := jobNotification{title: fmt.Sprintf("GuardDuty export %s", view.Status), status: view.Status}
+	if view.Schedule != "" {
+		name := view.Schedule
+		if s, ok := a.schedules.get(view.Schedule); ok && s.view().Name != "" {
+			name = s.view().Name
+		}
+		n.title = fmt.Sprintf("GuardDuty export %s: %s", view.Status, name)
+	}
+
+	bySeverity := make(map[string]int)
+	for _, result := range results {
+		for label, count := range result.BySeverity {
+			bySeverity[label] += count
+		}
+	}
+	counts := make([]string, 0, len(gd.SeverityLabels))
+	for _, label := range gd.SeverityLabels {
+		counts = append(counts, fmt.Sprintf("%d %s", bySeverity[label], label))
+	}
+	n.facts = append(n.facts, [2]string{"Findings", fmt.Sprintf("%d (%s)", view.Findings, strings.Join(counts, ", "))})
+	regions := fmt.Sprintf("%d exported", len(view.SucceededRegions))
+	if len(view.FailedRegions) > 0 {
+		regions += fmt.Sprintf(", %d failed", len(view.FailedRegions))
+	}
+	if len(view.SkippedRegions) > 0 {
+		regions += fmt.Sprintf(", %d skipped", len(view.SkippedRegions))
+	}
+	n.facts = append(n.facts, [2]string{"Regions", regions})
+	if view.FinishedAt != nil {
+		n.facts = append(n.facts, [2]string{"Duration", view.FinishedAt.Sub(view.CreatedAt).Round(time.Second).String()})
+	}
+	if view.PushedTo != "" {
+		n.facts = append(n.facts, [2]string{"Sent to", view.PushedTo})
+	}
+	if view.Truncation != nil {
+		n.facts = append(n.facts, [2]string{"Truncated", view.Truncation.String()})
+	}
+	if view.Error != "" {
+		n.facts = append(n.facts, [2]string{"Error", view.Error})
+	}
+	if view.User != "" {
+		n.facts = append(n.facts, [2]string{"Started by", view.User})
+	}
+
+	failed := make([]string, 0, len(view.FailedRegions))
+	for label := range view.FailedRegions {
+		failed = append(failed, label)
+	}
+	sort.Strings(failed)
+	for i, label := range failed {
+		if i == maxNotifiedFailures {
+			n.failures = append(n.failures, fmt.Sprintf("and %d more", len(failed)-i))
+			break
+		}
+		n.failures = append(n.failures, fmt.Sprintf("%s: %s", label, view.FailedRegions[label]))
+	}
+
+	// The server's download endpoint presigns a fresh URL for exports kept
+	// in S3, so it is linked in preference to the job's presigned URL
+	if view.Status == jobSucceeded && !view.Partitioned && view.PushedTo == "" {
+		switch {
+		case a.config().PublicURL != "":
+			n.link = strings.TrimSuffix(a.config().PublicURL, "/") + "/api/jobs/" + view.ID + "/download"
+		case view.DownloadURL != "":
+			n.link = view.DownloadURL
+		}
+	}
+	return n
+}
+
+// postWebhook posts a notification formatted for the webhook's type
+func postWebhook(ctx context.Context, webhook webhookConfig, n jobNotification) error {
+	var payload any
+	if webhook.Type == webhookSlack {
+		payload = slackMessage(n)
+	} else {
+		payload = teamsMessage(n)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// The URL is the webhook's secret, so it is left out of the error
+		if urlErr, ok := err.(interface{ Unwrap() error }); ok {
+			err = urlErr.Unwrap()
+		}
+		return fmt.Errorf("error posting to webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// slackMessage formats a notification as a Slack message with Block Kit
+// sections, and text for clients that show no blocks
+func slackMessage(n jobNotification) map[string]any {
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+	icon := ":white_check_mark:"
+	if n.status != jobSucceeded {
+		icon = ":x:"
+	}
+	var lines []string
+	for _, fact := range n.facts {
+		lines = append(lines, fmt.Sprintf("*%s:* %s", fact[0], escape(fact[1])))
+	}
+	if len(n.failures) > 0 {
+		lines = append(lines, "*Failed regions:*")
+		for _, failure := range n.failures {
+			lines = append(lines, "• "+escape(failure))
+		}
+	}
+	if n.link != "" {
+		lines = append(lines, fmt.Sprintf("<%s|Download the export>", n.link))
+	}
+	return map[string]any{
+		"text": fmt.Sprintf("%s %s", icon, escape(n.title)),
+		"blocks": []map[string]any{
+			{"type": "section", "text": map[string]any{"type": "mrkdwn", "text": fmt.Sprintf("%s *%s*", icon, escape(n.title))}},
+			{"type": "section", "text": map[string]any{"type": "mrkdwn", "text": strings.Join(lines, "\n")}},
+		},
+	}
+}
+
+// teamsMessage formats a notification as an Adaptive Card, which both
+// Teams workflow webhooks and the older connector webhooks accept
+func teamsMessage(n jobNotification) map[string]any {
+	color := "Good"
+	if n.status != jobSucceeded {
+		color = "Attention"
+	}
+	facts := make([]map[string]any, 0, len(n.facts))
+	for _, fact := range n.facts {
+		facts = append(facts, map[string]any{"title": fact[0], "value": fact[1]})
+	}
+	body := []map[string]any{
+		{"type": "TextBlock", "text": n.title, "weight": "Bolder", "size": "Medium", "color": color, "wrap": true},
+		{"type": "FactSet", "facts": facts},
+	}
+	if len(n.failures) > 0 {
+		body = append(body, map[string]any{"type": "TextBlock", "text": "Failed regions", "weight": "Bolder", "wrap": true})
+		for _, failure := range n.failures {
+			body = append(body, map[string]any{"type": "TextBlock", "text": failure, "wrap": true, "spacing": "None"})
+		}
+	}
+	card := map[string]any{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+	}
+	if n.link != "" {
+		card["actions"] = []map[string]any{{"type": "Action.OpenUrl", "title": "Download the export", "url": n.link}}
+	}
+	return map[string]any{
+		"type":        "message",
+		"attachments": []map[string]any{{"contentType": "application/vnd.microsoft.card.adaptive", "content": card}},
+	}
+}
@@ -0,0 +1,48 @@
+package telemetry
+
+import (
+	"context"
+	"io"
+	"log/slog"
+)
+
+// Log output formats
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// LogLevels maps the logLevel setting to slog levels
+var LogLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// NewLogger returns a logger writing to w in the given format, text or json,
+// that drops messages below level. The setting values are validated with the
+// config, so unknown ones fall back to text and info.
+func NewLogger(w io.Writer, format, level string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: LogLevels[level]}
+	if format == LogJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying l, which Logger returns
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// Logger returns the logger of ctx, tagged with its request or job ID, or
+// the default logger outside requests and jobs
+func Logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
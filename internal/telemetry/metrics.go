@@ -0,0 +1,214 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// Metric is a counter, gauge, or histogram with its samples keyed by
+// label values, written in the Prometheus text exposition format
+type Metric struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	// values holds a sample for each combination of label values
+	values map[string]*metricSample
+}
+
+// metricSample is one labeled value. Histograms also count observations in
+// each bucket, cumulatively by upper bound.
+type metricSample struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+}
+
+func newMetric(kind, name, help string, labels ...string) *Metric {
+	return &Metric{name: name, help: help, kind: kind, labels: labels, values: make(map[string]*metricSample)}
+}
+
+// NewCounter returns a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Metric {
+	return newMetric("counter", name, help, labels...)
+}
+
+// NewGauge returns a gauge with the given label names
+func NewGauge(name, help string, labels ...string) *Metric {
+	return newMetric("gauge", name, help, labels...)
+}
+
+// NewHistogram returns a histogram with the given bucket bounds and label
+// names
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Metric {
+	m := newMetric("histogram", name, help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+// sample returns the sample for labelValues, creating it. m.mu must be held.
+func (m *Metric) sample(labelValues []string) *metricSample {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.values[key]
+	if !ok {
+		s = &metricSample{labelValues: labelValues}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.values[key] = s
+	}
+	return s
+}
+
+// Add adds v to a counter or gauge
+func (m *Metric) Add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sample(labelValues).value += v
+}
+
+// Inc adds 1 to a counter
+func (m *Metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Set sets a gauge to v
+func (m *Metric) Set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sample(labelValues).value = v
+}
+
+// Observe records v in a histogram
+func (m *Metric) Observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.sample(labelValues)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// Write writes the family in the text exposition format, samples sorted by
+// label values so scrapes are stable
+func (m *Metric) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.values[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatMetricValue(s.value))
+			continue
+		}
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", formatMetricValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatMetricValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+// formatLabels returns {name="value",...} with an optional extra label such
+// as a histogram bucket's le, or nothing when there are no labels
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(values[i]))
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+strconv.Quote(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// durationBuckets are the histogram bounds, in seconds, of API calls and jobs
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// Exporter metrics. Exports count both synchronous requests and jobs.
+var (
+	ExportsStarted = NewCounter("guardduty_export_exports_started_total",
+		"Exports started.")
+	ExportsCompleted = NewCounter("guardduty_export_exports_completed_total",
+		"Exports written and stored.")
+	ExportsFailed = NewCounter("guardduty_export_exports_failed_total",
+		"Exports that failed.")
+	ExportsCanceled = NewCounter("guardduty_export_exports_canceled_total",
+		"Export jobs canceled before finishing.")
+	LastCompleted = NewGauge("guardduty_export_last_completed_timestamp_seconds",
+		"Unix time the last export completed.")
+	FindingsExported = NewCounter("guardduty_export_findings_exported_total",
+		"Findings written by completed exports.", "region")
+	PagesFetched = NewCounter("guardduty_export_pages_fetched_total",
+		"ListFindings pages fetched.", "region")
+	metricAPICallDuration = NewHistogram("guardduty_export_aws_api_call_duration_seconds",
+		"Latency of AWS API calls, including retries.", durationBuckets, "service", "operation")
+	metricAPICallErrors = NewCounter("guardduty_export_aws_api_call_errors_total",
+		"AWS API calls that returned an error.", "service", "operation")
+	APIThrottles = NewCounter("guardduty_export_aws_api_throttles_total",
+		"Attempts of AWS API calls that were throttled.", "service", "operation")
+	JobDuration = NewHistogram("guardduty_export_job_duration_seconds",
+		"Duration of export jobs by final status.", durationBuckets, "status")
+	StoreErrors = NewCounter("guardduty_export_store_errors_total",
+		"Pages of fetched findings the findings store failed to keep.")
+)
+
+// RecordAPICalls is an SDK middleware timing every AWS API call
+func RecordAPICalls(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("RecordAPICall",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			start := time.Now()
+			out, metadata, err := next.HandleInitialize(ctx, in)
+			service, operation := awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx)
+			metricAPICallDuration.Observe(time.Since(start).Seconds(), service, operation)
+			if err != nil {
+				metricAPICallErrors.Inc(service, operation)
+			}
+			return out, metadata, err
+		}), middleware.After)
+}
+
+// WriteMetrics writes the exporter metrics to w in the Prometheus text
+// exposition format
+func WriteMetrics(w io.Writer) {
+	for _, m := range []*Metric{
+		ExportsStarted, ExportsCompleted, ExportsFailed, ExportsCanceled,
+		LastCompleted, FindingsExported, PagesFetched,
+		metricAPICallDuration, metricAPICallErrors, APIThrottles, JobDuration, StoreErrors,
+	} {
+		m.Write(w)
+	}
+}
@@ -0,0 +1,399 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// TracingConfig sends OpenTelemetry traces of each export to an OTLP/HTTP
+// endpoint, such as a collector, Jaeger, or the AWS Distro for
+// OpenTelemetry forwarding to X-Ray
+type TracingConfig struct {
+	// Endpoint is the base URL of the OTLP/HTTP receiver, such as
+	// http://localhost:4318; spans are posted to its /v1/traces path. Empty
+	// uses OTEL_EXPORTER_OTLP_ENDPOINT, and tracing is off if that is unset.
+	Endpoint string `yaml:"endpoint"`
+	// ServiceName is the service.name resource attribute of every span
+	ServiceName string `yaml:"serviceName"`
+}
+
+// EndpointURL returns the configured OTLP endpoint or the standard environment
+// variable, or "" when tracing is off
+func (c TracingConfig) EndpointURL() string {
+	if c.Endpoint != "" {
+		return c.Endpoint
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+}
+
+// Validate reports the first invalid tracing setting
+func (c TracingConfig) Validate() error {
+	endpoint := c.EndpointURL()
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid tracing.endpoint %q: must be an http or https URL", endpoint)
+	}
+	if c.ServiceName == "" {
+		return fmt.Errorf("invalid tracing.serviceName: must not be empty")
+	}
+	return nil
+}
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+// Span is one timed operation of a trace. A nil span, returned while
+// tracing is off, ignores every call, so callers need not check.
+type Span struct {
+	mu sync.Mutex
+
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []otlpAttribute
+	err      string
+}
+
+type spanKey struct{}
+
+// activeTracer exports the spans of the running process; nil means tracing
+// is off. It is set once on startup by StartTracing.
+var activeTracer *tracer
+
+// StartTracing exports the spans of the process to the OTLP/HTTP endpoint,
+// tagged with the service name. It must be called before any span starts.
+func StartTracing(endpoint, service string) {
+	activeTracer = newTracer(endpoint, service)
+}
+
+// TracingEnabled reports whether StartTracing has been called
+func TracingEnabled() bool {
+	return activeTracer != nil
+}
+
+// StopTracing exports the queued spans, waiting until ctx is done at most.
+// It does nothing when tracing is off.
+func StopTracing(ctx context.Context) {
+	activeTracer.shutdown(ctx)
+}
+
+// StartSpan starts a span named name as a child of the span in ctx, or as
+// the root of a new trace, with attributes given as key and value pairs. It
+// returns a copy of ctx carrying the span.
+func StartSpan(ctx context.Context, name string, attrs ...any) (context.Context, *Span) {
+	return startSpanKind(ctx, name, spanKindInternal, attrs...)
+}
+
+func startSpanKind(ctx context.Context, name string, kind int, attrs ...any) (context.Context, *Span) {
+	if activeTracer == nil {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now()}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	s.Set(attrs...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Set adds attributes given as key and value pairs
+func (s *Span) Set(attrs ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs = append(s.attrs, otlpAttr(fmt.Sprint(attrs[i]), attrs[i+1]))
+	}
+}
+
+// Finish ends the span, marking it failed when err is not nil, and queues
+// it for export
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.mu.Unlock()
+	activeTracer.queue(s)
+}
+
+// TraceAPICalls is an SDK middleware recording each AWS API call as a client
+// span, with the attempts the SDK made so throttling retries stand out
+func TraceAPICalls(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("TraceAPICall",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			service, operation := awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx)
+			ctx, s := startSpanKind(ctx, service+"."+operation, spanKindClient,
+				"rpc.system", "aws-api", "rpc.service", service, "rpc.method", operation)
+			if region := awsmiddleware.GetRegion(ctx); region != "" {
+				s.Set("cloud.region", region)
+			}
+			out, metadata, err := next.HandleInitialize(ctx, in)
+			if attempts, ok := retry.GetAttemptResults(metadata); ok {
+				s.Set("aws.attempts", len(attempts.Results))
+			}
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) {
+				s.Set("aws.error_code", apiErr.ErrorCode())
+			}
+			s.Finish(err)
+			return out, metadata, err
+		}), middleware.After)
+}
+
+// Span batching limits
+const (
+	maxQueuedSpans  = 4096
+	maxExportBatch  = 512
+	spanExportDelay = 5 * time.Second
+)
+
+// tracer collects finished spans and posts them to the OTLP endpoint in
+// batches. Spans finished while the queue is full are dropped rather than
+// slowing the export down.
+type tracer struct {
+	url     string
+	service string
+	client  *http.Client
+	spans   chan *Span
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newTracer(endpoint, service string) *tracer {
+	t := &tracer{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		spans:   make(chan *Span, maxQueuedSpans),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *tracer) queue(s *Span) {
+	select {
+	case t.spans <- s:
+	default:
+	}
+}
+
+// run exports a batch whenever it is full or spanExportDelay has passed,
+// and the remaining spans once shutdown is called
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(spanExportDelay)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			Logger(context.Background()).Warn("Unable to export spans", "spans", len(batch), "error", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= maxExportBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+					if len(batch) >= maxExportBatch {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// shutdown exports the queued spans, waiting until ctx is done at most. It
+// does nothing when tracing is off.
+func (t *tracer) shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+	}
+}
+
+// export posts spans to the endpoint in the OTLP/HTTP JSON encoding
+func (t *tracer) export(spans []*Span) error {
+	request := otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{otlpAttr("service.name", t.service)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "guardduty-export"},
+			Spans: make([]otlpSpan, 0, len(spans)),
+		}},
+	}}}
+	scope := &request.ResourceSpans[0].ScopeSpans[0]
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, s.otlp())
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", t.url, resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON request body, as defined by the OpenTelemetry protocol
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue holds one of the value kinds; 64-bit integers are strings in the
+// JSON encoding
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func otlpAttr(key string, value any) otlpAttribute {
+	var v otlpValue
+	switch value := value.(type) {
+	case int:
+		s := strconv.Itoa(value)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &value
+	case bool:
+		v.BoolValue = &value
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parentID != [8]byte{} {
+		v.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != "" {
+		v.Status = &otlpStatus{Code: spanStatusError, Message: s.err}
+	}
+	return v
+}